@@ -0,0 +1,208 @@
+package qcow2
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// AmendVersion converts the image to version 2 or 3 of the format, like
+// `qemu-img amend -o compat=`. Upgrading preserves everything while adding
+// the version 3 fields and the feature name table. Downgrading refuses while
+// any version 3 only feature is in use; zero clusters are the exception when
+// force is set, as they are then rewritten as allocated clusters of zeros.
+func (img *Image) AmendVersion(v Version, force bool) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	if v == img.Header.Version {
+		return nil
+	}
+	switch v {
+	case 3:
+		return img.upgrade()
+	case 2:
+		return img.downgrade(force)
+	}
+	return UnsupportedVersionError{Version: v}
+}
+
+func (img *Image) upgrade() error {
+	h := img.Header
+	h.ExtHeaders = append([]ExtHeader(nil), h.ExtHeaders...)
+	follows := h.backingFollowsExtensions()
+
+	h.Version = 3
+	h.IncompatibleFeatures, h.CompatibleFeatures, h.AutoclearFeatures = 0, 0, 0
+	h.RefcountOrder = 4
+	h.HeaderLength = V2HeaderSize + V3HeaderSize
+	h.ExtraHeader = nil
+	if err := h.AddExtension(HdrExtFeatureNameTable, encodeFeatureNames(KnownFeatures)); err != nil {
+		return err
+	}
+	h.placeBackingFile(follows)
+	return img.writeFullHeader(h)
+}
+
+func (img *Image) downgrade(force bool) error {
+	var inUse []string
+	for _, f := range KnownFeatures {
+		if f.Type == FeatureIncompatible && img.Header.IncompatibleFeatures&(1<<f.Bit) != 0 {
+			inUse = append(inUse, f.Name)
+		}
+	}
+	if img.Header.IncompatibleFeatures&^knownFeatureMask(FeatureIncompatible) != 0 {
+		inUse = append(inUse, fmt.Sprintf("incompatible features %#x", img.Header.IncompatibleFeatures))
+	}
+	if img.Header.CompatibleFeatures&CompatLazyRefcounts != 0 {
+		inUse = append(inUse, "lazy refcounts")
+	}
+	if img.Header.RefcountOrder != 4 {
+		inUse = append(inUse, fmt.Sprintf("%d bit refcounts", img.refcountBits()))
+	}
+	for _, e := range img.Header.ExtHeaders {
+		if e.Type == HdrExtBitmaps {
+			inUse = append(inUse, "persistent bitmaps")
+		}
+	}
+	if len(inUse) > 0 {
+		return fmt.Errorf("qcow2: cannot downgrade to version 2 while using %s", strings.Join(inUse, ", "))
+	}
+
+	zeros, err := img.countZeroClusters()
+	if err != nil {
+		return err
+	}
+	if zeros > 0 {
+		if !force {
+			return fmt.Errorf("qcow2: cannot downgrade to version 2 with %d zero clusters, unless forced to expand them", zeros)
+		}
+		if err := img.expandZeroClusters(); err != nil {
+			return err
+		}
+	}
+
+	h := img.Header
+	h.ExtHeaders = append([]ExtHeader(nil), h.ExtHeaders...)
+	follows := h.backingFollowsExtensions()
+	h.Version = 2
+	h.IncompatibleFeatures, h.CompatibleFeatures, h.AutoclearFeatures = 0, 0, 0
+	h.RefcountOrder = 4
+	h.HeaderLength = V2HeaderSize
+	h.ExtraHeader = nil
+	h.RemoveExtension(HdrExtFeatureNameTable)
+	h.placeBackingFile(follows)
+	return img.writeFullHeader(h)
+}
+
+// l1Tables are the L1 tables of the active state followed by those of every snapshot
+func (img *Image) l1Tables() ([][]uint64, error) {
+	tables := [][]uint64{img.l1}
+	for _, s := range img.snapshots {
+		l1, err := img.readTable(s.L1TableOffset, s.L1Size)
+		if err != nil {
+			return nil, fmt.Errorf("qcow2: reading L1 table of snapshot %q: %w", s.Name, err)
+		}
+		tables = append(tables, l1)
+	}
+	return tables, nil
+}
+
+// l2Tables are the host offsets of every distinct L2 table of the image
+func (img *Image) l2Tables() ([]int64, error) {
+	tables, err := img.l1Tables()
+	if err != nil {
+		return nil, err
+	}
+	var offsets []int64
+	seen := map[int64]bool{}
+	for _, l1 := range tables {
+		for _, e := range l1 {
+			off := int64(e & entryOffsetMask)
+			if off != 0 && !seen[off] {
+				seen[off] = true
+				offsets = append(offsets, off)
+			}
+		}
+	}
+	return offsets, nil
+}
+
+func (img *Image) countZeroClusters() (int, error) {
+	offsets, err := img.l2Tables()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, off := range offsets {
+		l2, err := img.readTable(off, int(img.l2Entries))
+		if err != nil {
+			return 0, err
+		}
+		for _, entry := range l2 {
+			if img.classify(entry) == clusterZero {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// expandZeroClusters replaces every zero cluster, in the active state and in
+// the snapshots, by an allocated cluster of zeros
+func (img *Image) expandZeroClusters() error {
+	offsets, err := img.l2Tables()
+	if err != nil {
+		return err
+	}
+	zeros := make([]byte, img.clusterSize)
+	for _, off := range offsets {
+		l2, err := img.readTable(off, int(img.l2Entries))
+		if err != nil {
+			return err
+		}
+		// a table reached through several L1 tables gives each of its
+		// clusters that many references
+		refs, err := img.refcount(off)
+		if err != nil {
+			return err
+		}
+		if refs == 0 {
+			return errors.New("qcow2: L2 table without a refcount")
+		}
+		changed := false
+		for i, entry := range l2 {
+			if img.classify(entry) != clusterZero {
+				continue
+			}
+			host, err := img.allocClusters(1)
+			if err != nil {
+				return err
+			}
+			if _, err := img.fh.WriteAt(zeros, host); err != nil {
+				return err
+			}
+			if err := img.setRefcount(host, refs); err != nil {
+				return err
+			}
+			l2[i] = uint64(host)
+			if refs == 1 {
+				l2[i] |= flagCopied
+			}
+			if old := int64(entry & entryOffsetMask); old != 0 {
+				if err := img.updateRefcount(old, img.clusterSize, -int(refs)); err != nil {
+					return err
+				}
+			}
+			changed = true
+		}
+		if changed {
+			if err := img.writeTable(l2, off); err != nil {
+				return err
+			}
+		}
+	}
+	return img.fixCopiedFlags()
+}
@@ -0,0 +1,124 @@
+package qcow2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"testing"
+)
+
+// checksum hashes the guest visible disk contents
+func checksum(t *testing.T, img *Image) [sha256.Size]byte {
+	t.Helper()
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(img, 0, img.Size())); err != nil {
+		t.Fatal(err)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// reopen closes img and opens it again read-write
+func reopen(t *testing.T, img *Image) *Image {
+	t.Helper()
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+	img, err := OpenFile(img.Name(), os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { img.Close() })
+	return img
+}
+
+func TestAmendVersion(t *testing.T) {
+	img := tempImage(t)
+	if err := img.SetMetadata(map[string]string{"kept": "yes"}); err != nil {
+		t.Fatal(err)
+	}
+	sum := checksum(t, img)
+
+	if err := img.AmendVersion(2, false); err != nil {
+		t.Fatal(err)
+	}
+	img = reopen(t, img)
+	if img.Header.Version != 2 || img.Header.HeaderLength != V2HeaderSize {
+		t.Fatalf("expected a version 2 header, got %#v", img.Header)
+	}
+	if md, _ := img.Metadata(); md["kept"] != "yes" {
+		t.Errorf("extensions lost in downgrade: %#v", img.Header.ExtHeaders)
+	}
+	if checksum(t, img) != sum {
+		t.Error("contents changed by downgrade")
+	}
+	verifyRefcounts(t, img)
+
+	if err := img.AmendVersion(3, false); err != nil {
+		t.Fatal(err)
+	}
+	img = reopen(t, img)
+	if img.Header.Version != 3 || img.Header.RefcountOrder != 4 || img.Header.HeaderLength != 104 {
+		t.Fatalf("expected a version 3 header, got %#v", img.Header)
+	}
+	if len(img.Header.FeatureNames()) != len(KnownFeatures) {
+		t.Errorf("expected the feature name table, got %#v", img.Header.FeatureNames())
+	}
+	if checksum(t, img) != sum {
+		t.Error("contents changed by upgrade")
+	}
+	verifyRefcounts(t, img)
+}
+
+func TestAmendVersionZeroClusters(t *testing.T) {
+	img := tempImage(t)
+
+	// turn an allocated cluster of the active state into a zero cluster
+	off := int64(0)
+	entry, entryOff, err := img.l2Entry(img.l1, img.Header.L1TableOffset, off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.classify(entry) != clusterNormal {
+		t.Fatalf("expected the first cluster to be allocated, got %#x", entry)
+	}
+	if err := img.writeEntry(entryOff, entry|flagZero); err != nil {
+		t.Fatal(err)
+	}
+	sum := checksum(t, img)
+
+	if err := img.AmendVersion(2, false); err == nil {
+		t.Fatal("expected an error downgrading with zero clusters")
+	}
+	if err := img.AmendVersion(2, true); err != nil {
+		t.Fatal(err)
+	}
+	img = reopen(t, img)
+	if n, err := img.countZeroClusters(); err != nil || n != 0 {
+		t.Errorf("expected the zero clusters to be expanded, got %d (%v)", n, err)
+	}
+	if checksum(t, img) != sum {
+		t.Error("contents changed by expanding zero clusters")
+	}
+	buf := make([]byte, img.clusterSize)
+	if _, err := img.ReadAt(buf, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, make([]byte, img.clusterSize)) {
+		t.Error("expanded cluster does not read as zeros")
+	}
+	verifyRefcounts(t, img)
+}
+
+func TestAmendVersionRefusesFeatures(t *testing.T) {
+	img := tempImage(t)
+	img.Header.CompatibleFeatures |= CompatLazyRefcounts
+	if err := img.writeHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.AmendVersion(2, true); err == nil {
+		t.Error("expected an error downgrading with lazy refcounts")
+	}
+}
@@ -0,0 +1,65 @@
+package qcow2
+
+import (
+	"fmt"
+	"io"
+)
+
+// ApplyOptions tune ApplyTo
+type ApplyOptions struct {
+	// DryRun only reports the extents that would be written
+	DryRun bool
+	// Progress is told how many bytes of the extents have been written
+	Progress ProgressFunc
+}
+
+// ApplyTo writes the changes the image holds over its backing file onto dst,
+// a raw disk of dstSize bytes matching the backing file, at the same guest
+// offsets: the data and zero clusters of the image itself are written, and
+// what the image leaves to its backing file is not touched. It returns the
+// extents written. dst must be at least as large as the virtual size.
+func (img *Image) ApplyTo(dst io.WriterAt, dstSize int64, opts *ApplyOptions) ([]Extent, error) {
+	if opts == nil {
+		opts = &ApplyOptions{}
+	}
+	if dstSize < img.Size() {
+		return nil, fmt.Errorf("qcow2: target of %d bytes is smaller than the virtual size %d", dstSize, img.Size())
+	}
+	var changes []Extent
+	var total int64
+	if err := img.WalkExtents(0, img.Size(), func(e Extent) error {
+		if e.Depth == 0 && e.Type != ExtentUnallocated {
+			changes = append(changes, e)
+			total += e.Length
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if opts.DryRun {
+		return changes, nil
+	}
+
+	prog := newProgress(opts.Progress, total)
+	buf := make([]byte, convertChunk)
+	zero := make([]byte, convertChunk)
+	for _, e := range changes {
+		for off := e.Start; off < e.Start+e.Length; {
+			n := min(convertChunk, e.Start+e.Length-off)
+			p := zero[:n]
+			if e.Type != ExtentZero {
+				p = buf[:n]
+				if _, err := img.ReadAt(p, off); err != nil {
+					return nil, err
+				}
+			}
+			if _, err := dst.WriteAt(p, off); err != nil {
+				return nil, err
+			}
+			prog.add(n)
+			off += n
+		}
+	}
+	prog.finish()
+	return changes, nil
+}
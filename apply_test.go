@@ -0,0 +1,60 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyTo(t *testing.T) {
+	const size = 1 << 20
+	dir := t.TempDir()
+	base := bytes.Repeat([]byte("base "), size/5+1)[:size]
+	raw := filepath.Join(dir, "base.raw")
+	if err := os.WriteFile(raw, base, 0644); err != nil {
+		t.Fatal(err)
+	}
+	delta := backedImage(t, filepath.Join(dir, "delta.qcow2"), size, "base.raw", "raw")
+	if _, err := delta.WriteAt([]byte("changed"), 10000); err != nil {
+		t.Fatal(err)
+	}
+	if err := delta.writeZeroes(8*4096, 2*4096); err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, size)
+	if _, err := delta.ReadAt(want, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(dir, "target.raw")
+	if err := os.WriteFile(target, base, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(target, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	dry, err := delta.ApplyTo(f, size, &ApplyOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(target); !bytes.Equal(got, base) {
+		t.Error("a dry run changed the target")
+	}
+	changes, err := delta.ApplyTo(f, size, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || len(dry) != len(changes) || changes[1].Type != ExtentZero {
+		t.Errorf("unexpected changes %+v", changes)
+	}
+	if got, _ := os.ReadFile(target); !bytes.Equal(got, want) {
+		t.Error("the target does not read as the delta")
+	}
+
+	if _, err := delta.ApplyTo(f, size-4096, nil); err == nil {
+		t.Error("expected an error applying onto a smaller target")
+	}
+}
@@ -0,0 +1,193 @@
+package qcow2
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+)
+
+// BackupOptions are the parameters of Backup and BackupToRaw
+type BackupOptions struct {
+	// ConvertOptions apply to the image Backup creates, but for Compress,
+	// KeepCompressed and Dedupe, which only apply to a full backup, and
+	// Jobs. Only Progress applies to BackupToRaw.
+	ConvertOptions
+	// NewBitmap names a bitmap to create once the backup is done, with no
+	// bits set and the granularity of the one backed up, for the next backup
+	// to take, leaving the bits of the one backed up as they are. Otherwise
+	// those bits are cleared.
+	NewBitmap string
+}
+
+// Backup creates the image dst as a backup of the disk driven by the
+// persistent bitmap named bitmap. With a previous backup base, dst is an
+// overlay of it holding the clusters of the ranges whose bits are set, in
+// whole clusters of dst, so that dst reads as the image. The backing file
+// reference is opts.BackingFile when set, and otherwise the name of base
+// relative to dst. Without base, dst is a full backup, as by Flatten. Once dst
+// is stored, the bits of the bitmap are cleared, or a new bitmap is created as
+// opts.NewBitmap says, so that the next backup takes only the writes that
+// follow. The bitmap must not be in use, as its bits could not be trusted. On
+// failure the output file is removed, and the bitmap is left as it was.
+func (img *Image) Backup(bitmap string, base *Image, dst string, opts *BackupOptions) error {
+	var o BackupOptions
+	if opts != nil {
+		o = *opts
+	}
+	b, err := img.backupBitmap(bitmap)
+	if err != nil {
+		return err
+	}
+	if base != nil {
+		if base.Size() != img.Size() {
+			return fmt.Errorf("qcow2: cannot back up a disk of %d bytes over a backup of %d", img.Size(), base.Size())
+		}
+		if o.BackingFile == "" {
+			o.BackingFile = base.Name()
+			if rel, err := relativeTo(dst, base.Name()); err == nil {
+				o.BackingFile = rel
+			}
+			o.BackingFormat = "qcow2"
+		}
+	} else {
+		o.BackingFile, o.BackingFormat = "", ""
+	}
+	out, err := o.create(dst, img.Size())
+	if err != nil {
+		return err
+	}
+	if base == nil {
+		err = out.copyFlattened(img, &o.ConvertOptions)
+	} else {
+		err = out.copyDirty(img, b, &o.ConvertOptions)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return img.nextGeneration(bitmap, b, o.NewBitmap)
+}
+
+// BackupToRaw patches dst, a raw copy of the disk as of the last backup, in
+// place, writing to it the ranges whose bits are set in the persistent bitmap
+// named bitmap, so that dst reads as the image. The bitmap is then cleared, or
+// a new one created, as by Backup.
+func (img *Image) BackupToRaw(bitmap string, dst *os.File, opts *BackupOptions) error {
+	var o BackupOptions
+	if opts != nil {
+		o = *opts
+	}
+	b, err := img.backupBitmap(bitmap)
+	if err != nil {
+		return err
+	}
+	fi, err := dst.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() != img.Size() {
+		return fmt.Errorf("qcow2: cannot apply a backup of a disk of %d bytes to %s of %d bytes", img.Size(), dst.Name(), fi.Size())
+	}
+	ranges := b.Ranges()
+	var total int64
+	for _, r := range ranges {
+		total += r.Length
+	}
+	prog := o.progress(total)
+	buf := make([]byte, convertChunk)
+	for _, r := range ranges {
+		for off := r.Start; off < r.Start+r.Length; {
+			p := buf[:min(int64(len(buf)), r.Start+r.Length-off)]
+			if _, err := img.ReadAt(p, off); err != nil && err != io.EOF {
+				return err
+			}
+			if _, err := dst.WriteAt(p, off); err != nil {
+				return err
+			}
+			off += int64(len(p))
+			prog.add(int64(len(p)))
+		}
+	}
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+	prog.finish()
+	return img.nextGeneration(bitmap, b, o.NewBitmap)
+}
+
+// backupBitmap reads the bitmap named name for a backup, refusing one in use
+func (img *Image) backupBitmap(name string) (*Bitmap, error) {
+	b, err := img.ReadBitmap(name)
+	if err != nil {
+		return nil, err
+	}
+	if b.InUse {
+		return nil, fmt.Errorf("qcow2: bitmap %q is in use, so its bits can not be trusted: take a full backup", name)
+	}
+	return b, nil
+}
+
+// nextGeneration clears the bits of the bitmap named name, which were b when
+// backed up, or creates the bitmap next when set
+func (img *Image) nextGeneration(name string, b *Bitmap, next string) error {
+	if next != "" {
+		return img.AddBitmap(next, bits.TrailingZeros64(uint64(b.Granularity)))
+	}
+	return img.WriteBitmap(name, NewBitmap(b.Size, b.Granularity))
+}
+
+// copyDirty stores into the image, an overlay of the previous backup, the
+// clusters of src overlapping the ranges whose bits are set in b. A cluster
+// is copied whole, however little of it the bits cover, so that rounding to
+// clusters never skips a byte written to.
+func (img *Image) copyDirty(src *Image, b *Bitmap, opts *ConvertOptions) error {
+	var ranges [][2]int64
+	for _, r := range b.Ranges() {
+		ranges = append(ranges, [2]int64{r.Start &^ (img.clusterSize - 1), min(img.alignUp(r.Start+r.Length), img.Size())})
+	}
+	ranges = mergeRanges(ranges)
+	var total int64
+	for _, r := range ranges {
+		total += r[1] - r[0]
+	}
+	prog := opts.progress(total)
+
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	buf := make([]byte, img.chunkSize())
+	zero := make([]byte, img.clusterSize)
+	for _, r := range ranges {
+		for off := r[0]; off < r[1]; {
+			n := min(img.chunkSize(), r[1]-off)
+			p := buf[:n]
+			if m, err := src.ReadAt(p, off); err != nil && !(err == io.EOF && int64(m) == n) {
+				return err
+			}
+			for len(p) > 0 {
+				c := img.clusterChunk(p, off)
+				var err error
+				// zeros hide the data of the previous backup too
+				if img.Header.Version >= 3 && bytes.Equal(c, zero[:len(c)]) {
+					err = img.replaceEntry(off, flagZero)
+				} else {
+					err = img.writeGuest(c, off)
+				}
+				if err != nil {
+					return err
+				}
+				p, off = p[len(c):], off+int64(len(c))
+			}
+			prog.add(n)
+		}
+	}
+	prog.finish()
+	return nil
+}
@@ -0,0 +1,139 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	img, err := Create(filepath.Join(dir, "live.qcow2"), 4<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if _, err := img.WriteAt(bytes.Repeat([]byte("A"), 1<<20), 0); err != nil {
+		t.Fatal(err)
+	}
+	// a bitmap finer than the clusters of the backups, and one coarser
+	if err := img.AddBitmap("inc", 9); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.AddBitmap("raw", 16); err != nil {
+		t.Fatal(err)
+	}
+
+	full := filepath.Join(dir, "full.qcow2")
+	if err := img.Backup("inc", nil, full, nil); err != nil {
+		t.Fatal(err)
+	}
+	raw := filepath.Join(dir, "copy.raw")
+	if err := img.ConvertToRaw(raw, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the writes are recorded in both bitmaps
+	if _, err := img.WriteAt([]byte("x"), 5*4096+7); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte("B"), 10000), 3<<20+100); err != nil {
+		t.Fatal(err)
+	}
+	// zeros over the data of the full backup
+	if _, err := img.WriteAt(make([]byte, 8192), 64<<10); err != nil {
+		t.Fatal(err)
+	}
+
+	chain := []string{full}
+	backup := func(name string, opts *BackupOptions) {
+		t.Helper()
+		base, err := Open(chain[len(chain)-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer base.Close()
+		dst := filepath.Join(dir, name)
+		if err := img.Backup("inc", base, dst, opts); err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, dst)
+		out, err := Open(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+		if out.Header.BackingFile != filepath.Base(chain[len(chain)-2]) {
+			t.Errorf("%s is backed by %q", name, out.Header.BackingFile)
+		}
+		if !bytes.Equal(readAll(t, out), readAll(t, img)) {
+			t.Errorf("the chain of %s does not read as the image", name)
+		}
+		if got := out.Header.Size; got != img.Size() {
+			t.Errorf("%s of %d bytes", name, got)
+		}
+	}
+	backup("inc1.qcow2", &BackupOptions{ConvertOptions: ConvertOptions{CreateOptions: CreateOptions{ClusterSize: 4096}}})
+	inc, err := img.ReadBitmap("inc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inc.Count() != 0 {
+		t.Errorf("%d bits are left set after the backup", inc.Count())
+	}
+	// only the clusters written to, rounded out to whole clusters of the
+	// backup
+	if extents, err := newExtents(t, chain[1]); err != nil || extents != 1+3+2 {
+		t.Errorf("the incremental backup allocates %d clusters, want 6: %v", extents, err)
+	}
+
+	if _, err := img.WriteAt(bytes.Repeat([]byte("C"), 4096), 2<<20); err != nil {
+		t.Fatal(err)
+	}
+	backup("inc2.qcow2", &BackupOptions{NewBitmap: "inc-next"})
+	if inc, err := img.ReadBitmap("inc"); err != nil || inc.Count() != 8 {
+		t.Errorf("the bitmap backed up with a new generation: %v", err)
+	}
+	if next, err := img.ReadBitmap("inc-next"); err != nil || next.Count() != 0 || next.Granularity != 512 {
+		t.Errorf("the new generation: %+v, %v", next, err)
+	}
+
+	fh, err := os.OpenFile(raw, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	if err := img.BackupToRaw("raw", fh, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(raw); err != nil || !bytes.Equal(got, readAll(t, img)) {
+		t.Errorf("the patched raw copy does not read as the image: %v", err)
+	}
+	img = reopen(t, img)
+	checkClean(t, img)
+
+	// a bitmap in use can not drive a backup
+	addBitmaps(t, img, []bitmap{{name: "crashed", tableSize: 1, typ: bitmapTypeDirty, granularityBits: 16, flags: bitmapAuto | bitmapInUse}})
+	if err := img.Backup("crashed", nil, filepath.Join(dir, "crashed.qcow2"), nil); err == nil {
+		t.Error("expected an error backing up with a bitmap in use")
+	}
+}
+
+// newExtents counts the clusters the image named allocates itself
+func newExtents(t *testing.T, name string) (int64, error) {
+	t.Helper()
+	img, err := Open(name, WithNoBacking())
+	if err != nil {
+		return 0, err
+	}
+	defer img.Close()
+	var n int64
+	err = img.WalkExtents(0, img.Size(), func(e Extent) error {
+		if e.Depth == 0 && e.Type != ExtentUnallocated {
+			n += e.Length / img.clusterSize
+		}
+		return nil
+	})
+	return n, err
+}
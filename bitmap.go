@@ -0,0 +1,591 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// bitmapExtSize is the size of the bitmaps header extension
+const bitmapExtSize = 24
+
+// bitmapHeaderSize is the fixed part of a bitmap directory entry
+const bitmapHeaderSize = 24
+
+// limits of the bitmaps, as qemu enforces them
+const (
+	maxBitmaps               = 65535
+	maxBitmapNameSize        = 1023
+	maxBitmapTableSize       = 0x8000000
+	maxBitmapDirectorySize   = 64 << 20
+	minBitmapGranularityBits = 9
+	maxBitmapGranularityBits = 31
+)
+
+// bitmap flags
+const (
+	// bitmapInUse is set while the bitmap is being changed, so a bitmap left
+	// with it set was not saved and can not be trusted
+	bitmapInUse = 1 << 0
+	bitmapAuto  = 1 << 1
+	// bitmapExtraDataCompatible allows ignoring the extra data
+	bitmapExtraDataCompatible = 1 << 2
+)
+
+// bitmapTypeDirty is the only bitmap type, of dirty tracking bitmaps
+const bitmapTypeDirty = 1
+
+// bitmapEntryReserved are the bits of a bitmap table entry that must be zero.
+// Bit 0 is only allowed without an offset, for a cluster of all ones.
+const bitmapEntryReserved = 0xff000000000001fe
+
+// bitmapsExt is the bitmaps header extension
+type bitmapsExt struct {
+	nbBitmaps int
+	dirSize   int64
+	dirOffset int64
+	// at is the offset in the file of the extension, the index-th one
+	at    int64
+	index int
+}
+
+// bitmap is an entry of the bitmap directory
+type bitmap struct {
+	name            string
+	tableOffset     int64
+	tableSize       int
+	flags           uint32
+	typ             uint8
+	granularityBits int
+	extraData       []byte
+}
+
+// readBitmapsExt decodes the bitmaps header extension, reporting false when
+// the image has none
+func (h Header) readBitmapsExt() (bitmapsExt, bool, error) {
+	for i, e := range h.ExtHeaders {
+		if e.Type != HdrExtBitmaps {
+			continue
+		}
+		at := h.ExtensionOffset(i)
+		if len(e.Data) < bitmapExtSize {
+			return bitmapsExt{}, true, CorruptionError{Offset: at, Structure: StructExtension, Index: int64(i), Value: uint64(len(e.Data)),
+				Reason: fmt.Sprintf("bitmaps extension of %d bytes is too short", len(e.Data))}
+		}
+		return bitmapsExt{
+			nbBitmaps: be32(e.Data[0:4]),
+			dirSize:   be64(e.Data[8:16]),
+			dirOffset: be64(e.Data[16:24]),
+			at:        at,
+			index:     i,
+		}, true, nil
+	}
+	return bitmapsExt{}, false, nil
+}
+
+// readBitmaps reads the bitmap directory described by ext
+func (img *Image) readBitmaps(ext bitmapsExt) ([]bitmap, error) {
+	if ext.dirSize < 0 || ext.dirSize > maxBitmapDirectorySize {
+		return nil, CorruptionError{Offset: ext.at + 8 + 8, Structure: StructExtension, Index: int64(ext.index), Value: uint64(ext.dirSize),
+			Reason: fmt.Sprintf("invalid bitmap directory size %d", ext.dirSize)}
+	}
+	buf := make([]byte, ext.dirSize)
+	if _, err := img.fh.ReadAt(buf, ext.dirOffset); err != nil {
+		if err == io.EOF {
+			err = errors.New("past the end of the file")
+		}
+		return nil, fmt.Errorf("qcow2: reading bitmap directory at %#x: %w", ext.dirOffset, err)
+	}
+	var bitmaps []bitmap
+	for i := 0; i < ext.nbBitmaps; i++ {
+		at := ext.dirOffset + ext.dirSize - int64(len(buf))
+		if len(buf) < bitmapHeaderSize {
+			return nil, CorruptionError{Offset: at, Structure: StructBitmapDirectory, Index: int64(i), Value: uint64(ext.dirSize),
+				Reason: fmt.Sprintf("bitmap directory of %d bytes ends before bitmap %d", ext.dirSize, i)}
+		}
+		b := bitmap{
+			tableOffset:     be64(buf[0:8]),
+			tableSize:       be32(buf[8:12]),
+			flags:           uint32(be32(buf[12:16])),
+			typ:             buf[16],
+			granularityBits: int(buf[17]),
+		}
+		nameSize, extraSize := be16(buf[18:20]), be32(buf[20:24])
+		entry := bitmapHeaderSize + extraSize + nameSize
+		if entry > len(buf) {
+			return nil, CorruptionError{Offset: at, Structure: StructBitmapDirectory, Index: int64(i), Value: uint64(entry),
+				Reason: fmt.Sprintf("directory entry of %d bytes exceeds the bitmap directory", entry)}
+		}
+		b.extraData = buf[bitmapHeaderSize : bitmapHeaderSize+extraSize]
+		b.name = string(buf[bitmapHeaderSize+extraSize : entry])
+		bitmaps = append(bitmaps, b)
+		buf = buf[min(len(buf), (entry+7)&^7):]
+	}
+	return bitmaps, nil
+}
+
+// entrySize is the size of the directory entry of b, padded to 8 bytes
+func (b bitmap) entrySize() int64 {
+	return int64(bitmapHeaderSize+len(b.extraData)+len(b.name)+7) &^ 7
+}
+
+// bitmapTableSize is the number of entries of the table of a bitmap of the
+// disk with each bit standing for 1<<granularityBits bytes, each entry a
+// cluster of bits
+func (img *Image) bitmapTableSize(granularityBits int) int64 {
+	return ceilDiv(ceilDiv(img.Header.Size, 1<<granularityBits), img.clusterSize*8)
+}
+
+// marshalBitmaps encodes the bitmap directory
+func marshalBitmaps(bitmaps []bitmap) []byte {
+	var out []byte
+	for _, b := range bitmaps {
+		buf := make([]byte, b.entrySize())
+		binary.BigEndian.PutUint64(buf[0:8], uint64(b.tableOffset))
+		binary.BigEndian.PutUint32(buf[8:12], uint32(b.tableSize))
+		binary.BigEndian.PutUint32(buf[12:16], b.flags)
+		buf[16], buf[17] = b.typ, byte(b.granularityBits)
+		binary.BigEndian.PutUint16(buf[18:20], uint16(len(b.name)))
+		binary.BigEndian.PutUint32(buf[20:24], uint32(len(b.extraData)))
+		copy(buf[bitmapHeaderSize:], b.extraData)
+		copy(buf[bitmapHeaderSize+len(b.extraData):], b.name)
+		out = append(out, buf...)
+	}
+	return out
+}
+
+// errStaleBitmaps is returned for the bitmaps of an image whose bitmaps
+// autoclear bit is clear, left by another program writing to the image
+// without updating them
+var errStaleBitmaps = errors.New("qcow2: the bitmaps are stale, as the bitmaps autoclear bit is clear")
+
+// loadBitmaps reads the bitmap directory, reporting in stale that the bitmaps
+// autoclear bit is clear: another program wrote to the image without updating
+// the bitmaps
+func (img *Image) loadBitmaps() (bitmaps []bitmap, stale bool, err error) {
+	if img.Header.ExtensionsSkipped {
+		return nil, false, ErrExtensionsSkipped
+	}
+	ext, ok, err := img.Header.readBitmapsExt()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	bitmaps, err = img.readBitmaps(ext)
+	return bitmaps, img.Header.AutoclearFeatures&AutoclearBitmaps == 0, err
+}
+
+// writeBitmaps stores bitmaps as a new bitmap directory, or drops the bitmaps
+// extension when there are none, then frees the old directory. The autoclear
+// bit is set for the first bitmap, and otherwise left as it was, so that stale
+// bitmaps stay stale.
+func (img *Image) writeBitmaps(bitmaps []bitmap) error {
+	old, had, err := img.Header.readBitmapsExt()
+	if err != nil {
+		return err
+	}
+	h := img.Header
+	h.ExtHeaders = append([]ExtHeader(nil), h.ExtHeaders...)
+	if len(bitmaps) == 0 {
+		h.RemoveExtension(HdrExtBitmaps)
+		h.AutoclearFeatures &^= AutoclearBitmaps
+	} else {
+		dir := marshalBitmaps(bitmaps)
+		if len(dir) > maxBitmapDirectorySize {
+			return fmt.Errorf("qcow2: a bitmap directory of %d bytes is larger than the maximum of %d", len(dir), maxBitmapDirectorySize)
+		}
+		buf := make([]byte, img.alignUp(int64(len(dir))))
+		copy(buf, dir)
+		off, err := img.allocClusters(int64(len(buf)) / img.clusterSize)
+		if err != nil {
+			return err
+		}
+		if _, err := img.fh.WriteAt(buf, off); err != nil {
+			return err
+		}
+		data := make([]byte, bitmapExtSize)
+		binary.BigEndian.PutUint32(data[0:4], uint32(len(bitmaps)))
+		binary.BigEndian.PutUint64(data[8:16], uint64(len(dir)))
+		binary.BigEndian.PutUint64(data[16:24], uint64(off))
+		if err := h.AddExtension(HdrExtBitmaps, data); err != nil {
+			return err
+		}
+		if !had {
+			h.AutoclearFeatures |= AutoclearBitmaps
+		}
+	}
+	if err := img.writeFullHeader(h); err != nil {
+		return err
+	}
+	if had {
+		return img.updateRefcount(old.dirOffset, old.dirSize, -1)
+	}
+	return nil
+}
+
+// AddBitmap creates a persistent dirty bitmap of the guest disk named name,
+// each bit of which stands for 1<<granularityBits bytes, of 2^9 to 2^31, as
+// qemu-img bitmap --add does. The bitmap has no bits set, its table entries
+// standing for clusters of zeros until bits are set in them, and it is
+// enabled: writes to the disk are to be recorded in it.
+func (img *Image) AddBitmap(name string, granularityBits int) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	if err := img.storeTracked(); err != nil {
+		return err
+	}
+	if img.Header.Version < 3 {
+		return errors.New("qcow2: version 2 images do not support persistent bitmaps")
+	}
+	if name == "" || len(name) > maxBitmapNameSize {
+		return fmt.Errorf("qcow2: bitmap name of %d bytes, where 1 to %d are allowed", len(name), maxBitmapNameSize)
+	}
+	if granularityBits < minBitmapGranularityBits || granularityBits > maxBitmapGranularityBits {
+		return fmt.Errorf("qcow2: bitmap granularity of 2^%d bytes, where 2^%d to 2^%d are allowed", granularityBits, minBitmapGranularityBits, maxBitmapGranularityBits)
+	}
+	bitmaps, stale, err := img.loadBitmaps()
+	if err != nil {
+		return err
+	}
+	if stale {
+		return fmt.Errorf("%w: remove them first", errStaleBitmaps)
+	}
+	if len(bitmaps) >= maxBitmaps {
+		return fmt.Errorf("qcow2: the image already has the maximum of %d bitmaps", maxBitmaps)
+	}
+	if findBitmap(bitmaps, name) >= 0 {
+		return fmt.Errorf("qcow2: a bitmap named %q already exists", name)
+	}
+	n := img.bitmapTableSize(granularityBits)
+	if n == 0 {
+		return errors.New("qcow2: a disk of 0 bytes has no bitmaps")
+	}
+	if n > maxBitmapTableSize {
+		return fmt.Errorf("qcow2: a bitmap of %d bytes at a granularity of 2^%d bytes needs a table of %d entries, more than the maximum of %d", img.Header.Size, granularityBits, n, maxBitmapTableSize)
+	}
+	clusters := img.alignUp(n*8) / img.clusterSize
+	table, err := img.allocClusters(clusters)
+	if err != nil {
+		return err
+	}
+	if _, err := img.fh.WriteAt(make([]byte, clusters*img.clusterSize), table); err != nil {
+		return err
+	}
+	b := bitmap{
+		name:            name,
+		tableOffset:     table,
+		tableSize:       int(n),
+		flags:           bitmapAuto,
+		typ:             bitmapTypeDirty,
+		granularityBits: granularityBits,
+	}
+	if err := img.writeBitmaps(append(bitmaps, b)); err != nil {
+		img.freeClusters(table, clusters)
+		return err
+	}
+	return nil
+}
+
+// RemoveBitmap deletes the persistent bitmap named name, freeing its table
+// and data clusters once the bitmap directory no longer holds it
+func (img *Image) RemoveBitmap(name string) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	if err := img.storeTracked(); err != nil {
+		return err
+	}
+	bitmaps, _, err := img.loadBitmaps()
+	if err != nil {
+		return err
+	}
+	i := findBitmap(bitmaps, name)
+	if i < 0 {
+		return fmt.Errorf("qcow2: no bitmap named %q", name)
+	}
+	b := bitmaps[i]
+	table, err := img.readTable(b.tableOffset, b.tableSize)
+	if err != nil {
+		return fmt.Errorf("qcow2: reading the table of bitmap %q: %w", name, err)
+	}
+	if err := img.writeBitmaps(append(bitmaps[:i:i], bitmaps[i+1:]...)); err != nil {
+		return err
+	}
+	return img.freeBitmapTable(b, table)
+}
+
+// findBitmap is the index of the bitmap named name, or -1
+func findBitmap(bitmaps []bitmap, name string) int {
+	for i, b := range bitmaps {
+		if b.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// freeBitmapTable drops the references of the table of b, holding table, and
+// of its data clusters
+func (img *Image) freeBitmapTable(b bitmap, table []uint64) error {
+	for _, e := range table {
+		if data := int64(e & entryOffsetMask); data != 0 {
+			if err := img.freeClusters(data, 1); err != nil {
+				return err
+			}
+		}
+	}
+	return img.updateRefcount(b.tableOffset, int64(b.tableSize)*8, -1)
+}
+
+// ReadBitmap reads the bits of the persistent bitmap named name. A table
+// entry without a data cluster stands for a cluster of bits that are all
+// clear, or all set when its lowest bit is. The bits of a bitmap that is in
+// use, as reported by Bitmap.InUse, can not be trusted. A bitmap the writes to
+// the image are being recorded in is read with the writes not yet stored.
+func (img *Image) ReadBitmap(name string) (*Bitmap, error) {
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+	bitmaps, stale, err := img.loadBitmaps()
+	if err != nil {
+		return nil, err
+	}
+	if stale {
+		return nil, errStaleBitmaps
+	}
+	i := findBitmap(bitmaps, name)
+	if i < 0 {
+		return nil, fmt.Errorf("qcow2: no bitmap named %q", name)
+	}
+	if b := img.tracked[name]; b != nil {
+		// the bits with the writes not stored yet, which are trusted
+		return &Bitmap{Granularity: b.Granularity, Size: b.Size, Bits: append([]byte(nil), b.Bits...)}, nil
+	}
+	return img.bitmapContents(bitmaps[i])
+}
+
+// bitmapContents reads the bitmap b as a Bitmap
+func (img *Image) bitmapContents(b bitmap) (*Bitmap, error) {
+	data, err := img.readBitmapBits(b)
+	if err != nil {
+		return nil, err
+	}
+	return &Bitmap{Granularity: 1 << b.granularityBits, Size: img.Header.Size, InUse: b.flags&bitmapInUse != 0, Bits: data}, nil
+}
+
+// readBitmapBits reads the bits of the bitmap b through its table
+func (img *Image) readBitmapBits(b bitmap) ([]byte, error) {
+	if b.typ != bitmapTypeDirty {
+		return nil, fmt.Errorf("qcow2: bitmap %q is of unknown type %d", b.name, b.typ)
+	}
+	g := b.granularityBits
+	if g < minBitmapGranularityBits || g > maxBitmapGranularityBits {
+		return nil, fmt.Errorf("qcow2: bitmap %q has a granularity of 2^%d bytes, where 2^%d to 2^%d are allowed", b.name, g, minBitmapGranularityBits, maxBitmapGranularityBits)
+	}
+	if want := img.bitmapTableSize(g); int64(b.tableSize) != want {
+		return nil, fmt.Errorf("qcow2: bitmap %q has a table of %d entries, where a disk of %d bytes needs %d", b.name, b.tableSize, img.Header.Size, want)
+	}
+	table, err := img.readTable(b.tableOffset, b.tableSize)
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: reading the table of bitmap %q: %w", b.name, err)
+	}
+	n := ceilDiv(img.Header.Size, 1<<g)
+	out := make([]byte, ceilDiv(n, 8))
+	for i, e := range table {
+		chunk := out[int64(i)*img.clusterSize : min(int64(i+1)*img.clusterSize, int64(len(out)))]
+		data := int64(e & entryOffsetMask)
+		switch {
+		case e&bitmapEntryReserved != 0 || data != 0 && e&1 != 0:
+			return nil, fmt.Errorf("qcow2: bitmap %q: table entry %d %#x has reserved bits set", b.name, i, e)
+		case data != 0:
+			if why := img.invalidOffset(data, img.clusterSize, true); why != "" {
+				return nil, fmt.Errorf("qcow2: bitmap %q: table entry %d: offset %#x %s", b.name, i, data, why)
+			}
+			if _, err := img.fh.ReadAt(chunk, data); err != nil {
+				return nil, fmt.Errorf("qcow2: reading bitmap %q at %#x: %w", b.name, data, err)
+			}
+		case e&1 != 0:
+			for j := range chunk {
+				chunk[j] = 0xff
+			}
+		}
+	}
+	// the bits past the end of the disk are clear
+	if r := n % 8; r != 0 {
+		out[len(out)-1] &= 1<<r - 1
+	}
+	return out, nil
+}
+
+// WriteBitmap replaces the bits of the persistent bitmap named name with
+// those of b, which must be of the granularity of the bitmap and of the size
+// of the disk, as ReadBitmap returns them. The bitmap is no longer in use
+// afterwards. The bits are written to a new table and data clusters, which
+// the bitmap directory is then switched over to, so that a crash leaves the
+// bitmap as it was before.
+func (img *Image) WriteBitmap(name string, b *Bitmap) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	if err := img.storeTracked(); err != nil {
+		return err
+	}
+	bitmaps, stale, err := img.loadBitmaps()
+	if err != nil {
+		return err
+	}
+	if stale {
+		return errStaleBitmaps
+	}
+	i := findBitmap(bitmaps, name)
+	if i < 0 {
+		return fmt.Errorf("qcow2: no bitmap named %q", name)
+	}
+	g := int64(1) << bitmaps[i].granularityBits
+	if b.Granularity != g || b.Size != img.Header.Size {
+		return fmt.Errorf("qcow2: bitmap %q has a granularity of %d bytes of a disk of %d bytes, not %d bytes of %d", name, g, img.Header.Size, b.Granularity, b.Size)
+	}
+	if want := ceilDiv(ceilDiv(b.Size, g), 8); int64(len(b.Bits)) != want {
+		return fmt.Errorf("qcow2: bitmap of %d bytes, where a disk of %d bytes needs %d", len(b.Bits), b.Size, want)
+	}
+	return img.storeBitmapBits(bitmaps, i, b.Bits)
+}
+
+// MergeBitmaps sets the bits of the persistent bitmap named dst for every
+// range of the disk whose bits are set in the bitmap named src, as
+// Bitmap.Merge, leaving src as it is. Neither may be in use, as the bits of a
+// bitmap in use can not be trusted.
+func (img *Image) MergeBitmaps(dst, src string) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	if err := img.storeTracked(); err != nil {
+		return err
+	}
+	bitmaps, stale, err := img.loadBitmaps()
+	if err != nil {
+		return err
+	}
+	if stale {
+		return errStaleBitmaps
+	}
+	di, si := findBitmap(bitmaps, dst), findBitmap(bitmaps, src)
+	if si < 0 {
+		return fmt.Errorf("qcow2: no bitmap named %q", src)
+	}
+	if di < 0 {
+		return fmt.Errorf("qcow2: no bitmap named %q", dst)
+	}
+	if di == si {
+		return fmt.Errorf("qcow2: cannot merge bitmap %q into itself", dst)
+	}
+	d, err := img.bitmapContents(bitmaps[di])
+	if err != nil {
+		return err
+	}
+	s, err := img.bitmapContents(bitmaps[si])
+	if err != nil {
+		return err
+	}
+	if s.InUse {
+		return fmt.Errorf("qcow2: bitmap %q is in use, so its bits can not be trusted", src)
+	}
+	if d.InUse {
+		return fmt.Errorf("qcow2: bitmap %q is in use, so its bits can not be trusted", dst)
+	}
+	if err := d.Merge(s); err != nil {
+		return err
+	}
+	return img.storeBitmapBits(bitmaps, di, d.Bits)
+}
+
+// storeBitmapBits writes data as the bits of the i-th of bitmaps, to a new
+// table and data clusters, stores the directory pointing to them with the
+// bitmap no longer in use, then frees the old table and data clusters.
+// Clusters of bits that are all clear or all set take no data cluster.
+func (img *Image) storeBitmapBits(bitmaps []bitmap, i int, data []byte) error {
+	b := bitmaps[i]
+	old, err := img.readTable(b.tableOffset, b.tableSize)
+	if err != nil {
+		return fmt.Errorf("qcow2: reading the table of bitmap %q: %w", b.name, err)
+	}
+	clusters := img.alignUp(int64(b.tableSize)*8) / img.clusterSize
+	table := make([]uint64, clusters*img.l2Entries)
+	for j := 0; j < b.tableSize; j++ {
+		chunk := data[int64(j)*img.clusterSize : min(int64(j+1)*img.clusterSize, int64(len(data)))]
+		switch {
+		case allBytes(chunk, 0):
+		case allBytes(chunk, 0xff):
+			table[j] = 1
+		default:
+			off, err := img.allocClusters(1)
+			if err != nil {
+				return err
+			}
+			buf := make([]byte, img.clusterSize)
+			copy(buf, chunk)
+			if _, err := img.fh.WriteAt(buf, off); err != nil {
+				return err
+			}
+			table[j] = uint64(off)
+		}
+	}
+	off, err := img.allocClusters(clusters)
+	if err != nil {
+		return err
+	}
+	if err := img.writeTable(table, off); err != nil {
+		return err
+	}
+	bitmaps[i].tableOffset = off
+	bitmaps[i].flags &^= bitmapInUse
+	if err := img.writeBitmaps(bitmaps); err != nil {
+		return err
+	}
+	return img.freeBitmapTable(b, old)
+}
+
+// allBytes reports whether every byte of p is c
+func allBytes(p []byte, c byte) bool {
+	for _, b := range p {
+		if b != c {
+			return false
+		}
+	}
+	return true
+}
+
+// refBitmaps calls ref with the bitmap directory, and the table and data
+// clusters of every bitmap
+func (img *Image) refBitmaps(ref func(off, size int64)) error {
+	ext, ok, err := img.Header.readBitmapsExt()
+	if err != nil || !ok {
+		return err
+	}
+	bitmaps, err := img.readBitmaps(ext)
+	if err != nil {
+		return err
+	}
+	ref(ext.dirOffset, ext.dirSize)
+	for _, b := range bitmaps {
+		table, err := img.readTable(b.tableOffset, b.tableSize)
+		if err != nil {
+			return fmt.Errorf("qcow2: reading the table of bitmap %q: %w", b.name, err)
+		}
+		ref(b.tableOffset, int64(b.tableSize)*8)
+		for _, e := range table {
+			if data := int64(e & entryOffsetMask); data != 0 {
+				ref(data, img.clusterSize)
+			}
+		}
+	}
+	return nil
+}
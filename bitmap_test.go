@@ -0,0 +1,411 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// checkClean fails the test when Check finds corruptions or leaks in img.
+// Freed clusters may be left at the end of the file.
+func checkClean(t *testing.T, img *Image) {
+	t.Helper()
+	rep, err := img.Check(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Corruptions+rep.Leaks+rep.CheckErrors != 0 {
+		t.Fatalf("expected no corruptions or leaks, got %+v", rep.Findings)
+	}
+}
+
+func TestAddRemoveBitmap(t *testing.T) {
+	img, err := Create(filepath.Join(t.TempDir(), "file.qcow2"), 64<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if _, err := img.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+	// 64 MiB at 512 bytes takes 2^17 bits, 4 clusters of bits, so the table
+	// has 4 entries
+	if err := img.AddBitmap("fine", 9); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.AddBitmap("coarse", 16); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name        string
+		granularity int
+		want        string
+	}{
+		{"fine", 16, `a bitmap named "fine" already exists`},
+		{"", 16, "bitmap name of 0 bytes"},
+		{strings.Repeat("n", 1024), 16, "bitmap name of 1024 bytes"},
+		{"small", 8, "granularity of 2^8 bytes"},
+		{"large", 32, "granularity of 2^32 bytes"},
+	} {
+		if err := img.AddBitmap(tc.name, tc.granularity); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("adding %.10q of 2^%d bytes: got %v, want %q", tc.name, tc.granularity, err, tc.want)
+		}
+	}
+
+	img = reopen(t, img)
+	if img.Header.AutoclearFeatures&AutoclearBitmaps == 0 {
+		t.Error("the bitmaps autoclear bit is clear")
+	}
+	bitmaps, err := img.Bitmaps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bitmaps) != 2 || bitmaps[0].Name != "fine" || bitmaps[0].Granularity != 512 || bitmaps[0].TableSize != 4 ||
+		!bitmaps[1].Auto || bitmaps[1].InUse || bitmaps[1].Granularity != 64<<10 {
+		t.Fatalf("got bitmaps %+v", bitmaps)
+	}
+	checkClean(t, img)
+	table, err := img.readTable(bitmaps[0].TableOffset, bitmaps[0].TableSize)
+	if err != nil || table[0]|table[1]|table[2]|table[3] != 0 {
+		t.Errorf("got table %x, %v, want zeros", table, err)
+	}
+
+	// the refcounts of the bitmap clusters survive a rebuild
+	if err := img.AmendRefcountOrder(5); err != nil {
+		t.Fatal(err)
+	}
+	checkClean(t, img)
+
+	if err := img.RemoveBitmap("missing"); err == nil {
+		t.Error("expected an error removing a missing bitmap")
+	}
+	if err := img.RemoveBitmap("fine"); err != nil {
+		t.Fatal(err)
+	}
+	img = reopen(t, img)
+	if bitmaps, err := img.Bitmaps(); err != nil || len(bitmaps) != 1 || bitmaps[0].Name != "coarse" {
+		t.Fatalf("got bitmaps %+v, %v", bitmaps, err)
+	}
+	checkClean(t, img)
+	if err := img.RemoveBitmap("coarse"); err != nil {
+		t.Fatal(err)
+	}
+	img = reopen(t, img)
+	if _, ok, _ := img.Header.readBitmapsExt(); ok || img.Header.AutoclearFeatures&AutoclearBitmaps != 0 {
+		t.Errorf("the bitmaps extension or autoclear bit is left: %+v", img.Header)
+	}
+	checkClean(t, img)
+}
+
+func TestRemoveBitmapData(t *testing.T) {
+	img, err := Create(filepath.Join(t.TempDir(), "file.qcow2"), 1<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	// a bitmap as qemu saves it, with a data cluster
+	addBitmaps(t, img, []bitmap{{name: "qemu", tableSize: 1, typ: bitmapTypeDirty, granularityBits: 16, flags: bitmapAuto}})
+	if err := img.AddBitmap("ours", 16); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.RemoveBitmap("qemu"); err != nil {
+		t.Fatal(err)
+	}
+	img = reopen(t, img)
+	checkClean(t, img)
+
+	// stale bitmaps are not added to, but may be removed
+	img.Header.AutoclearFeatures &^= AutoclearBitmaps
+	if err := img.writeHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.AddBitmap("more", 16); err == nil || !strings.Contains(err.Error(), "stale") {
+		t.Errorf("adding to stale bitmaps: got %v", err)
+	}
+	if err := img.RemoveBitmap("ours"); err != nil {
+		t.Fatal(err)
+	}
+	img = reopen(t, img)
+	checkClean(t, img)
+
+	v2, err := Create(filepath.Join(t.TempDir(), "v2.qcow2"), 1<<20, &CreateOptions{Version: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v2.Close()
+	if err := v2.AddBitmap("b", 16); err == nil {
+		t.Error("expected an error adding a bitmap to a version 2 image")
+	}
+}
+
+func TestReadWriteBitmap(t *testing.T) {
+	img, err := Create(filepath.Join(t.TempDir(), "file.qcow2"), 64<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if err := img.AddBitmap("fine", 9); err != nil {
+		t.Fatal(err)
+	}
+	empty, err := img.ReadBitmap("fine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.Len() != 1<<17 || len(empty.Bits) != 1<<14 || empty.Count() != 0 || empty.InUse {
+		t.Fatalf("got a new bitmap of %d bits, %d set", empty.Len(), empty.Count())
+	}
+
+	// each table entry stands for 16 MiB: the first and third hold some
+	// bits, the second all of them and the last none
+	b := NewBitmap(64<<20, 512)
+	b.SetRange(0, 1)
+	b.SetRange(16<<20, 16<<20)
+	b.SetRange(40<<20+5, 600)
+	if b.Count() != 1+1<<15+2 || !b.Get(0) || b.Get(1) {
+		t.Fatalf("got %d bits set", b.Count())
+	}
+	if err := img.WriteBitmap("fine", b); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		img = reopen(t, img)
+		checkClean(t, img)
+		got, err := img.ReadBitmap("fine")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bits, b.Bits) {
+			t.Fatalf("read %d bits set, wrote %d", got.Count(), b.Count())
+		}
+		infos, _ := img.Bitmaps()
+		table, err := img.readTable(infos[0].TableOffset, infos[0].TableSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if table[0] == 0 || table[1] != 1 || table[2] == 0 || table[3] != 0 {
+			t.Errorf("got table %x", table)
+		}
+		// writing again frees the clusters of the bits before
+		if err := img.WriteBitmap("fine", got); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := img.WriteBitmap("fine", NewBitmap(64<<20, 1024)); err == nil {
+		t.Error("expected an error writing a bitmap of another granularity")
+	}
+	if _, err := img.ReadBitmap("missing"); err == nil {
+		t.Error("expected an error reading a missing bitmap")
+	}
+
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Bitmap
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Granularity != 512 || decoded.Size != 64<<20 || !bytes.Equal(decoded.Bits, b.Bits) {
+		t.Errorf("decoded %+v", decoded)
+	}
+	data[100] ^= 1
+	if err := decoded.UnmarshalBinary(data); err == nil {
+		t.Error("expected an error decoding a changed bitmap")
+	}
+}
+
+func TestReadBitmapInUse(t *testing.T) {
+	img, err := Create(filepath.Join(t.TempDir(), "file.qcow2"), 1<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	addBitmaps(t, img, []bitmap{{name: "crashed", tableSize: 1, typ: bitmapTypeDirty, granularityBits: 16, flags: bitmapAuto | bitmapInUse}})
+	b, err := img.ReadBitmap("crashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.InUse || b.Len() != 16 {
+		t.Fatalf("got %+v", b)
+	}
+	b.SetRange(0, 1<<20)
+	if err := img.WriteBitmap("crashed", b); err != nil {
+		t.Fatal(err)
+	}
+	img = reopen(t, img)
+	checkClean(t, img)
+	if b, err := img.ReadBitmap("crashed"); err != nil || b.InUse || b.Count() != 16 {
+		t.Errorf("got %+v, %v", b, err)
+	}
+}
+
+func TestMergeBitmaps(t *testing.T) {
+	img, err := Create(filepath.Join(t.TempDir(), "file.qcow2"), 64<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	for _, b := range []struct {
+		name        string
+		granularity int
+		ranges      []Range
+	}{
+		{"weekly", 16, []Range{{0, 64 << 10}, {1 << 20, 1}}},
+		{"tmp", 9, []Range{{64<<10 + 512, 512}, {8 << 20, 4096}, {64<<20 - 1, 1}}},
+		{"coarse", 20, []Range{{32 << 20, 1}}},
+	} {
+		if err := img.AddBitmap(b.name, b.granularity); err != nil {
+			t.Fatal(err)
+		}
+		bits := NewBitmap(64<<20, 1<<b.granularity)
+		for _, r := range b.ranges {
+			bits.SetRange(r.Start, r.Length)
+		}
+		if err := img.WriteBitmap(b.name, bits); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmp, err := img.ReadBitmap("tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the finer bits set the 64 KiB granules covering them, and the coarse
+	// bit all of its 1 MiB
+	if err := img.MergeBitmaps("weekly", "tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.MergeBitmaps("weekly", "coarse"); err != nil {
+		t.Fatal(err)
+	}
+	img = reopen(t, img)
+	checkClean(t, img)
+	weekly, err := img.ReadBitmap("weekly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Range{{0, 128 << 10}, {1 << 20, 64 << 10}, {8 << 20, 64 << 10}, {32 << 20, 1 << 20}, {64<<20 - 64<<10, 64 << 10}}
+	if got := weekly.Ranges(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got dirty ranges %v, want %v", got, want)
+	}
+	if got, err := img.ReadBitmap("tmp"); err != nil || !bytes.Equal(got.Bits, tmp.Bits) {
+		t.Errorf("the source bitmap changed: %v", err)
+	}
+
+	if err := img.MergeBitmaps("weekly", "weekly"); err == nil {
+		t.Error("expected an error merging a bitmap into itself")
+	}
+	if err := img.MergeBitmaps("weekly", "missing"); err == nil {
+		t.Error("expected an error merging a missing bitmap")
+	}
+	if err := NewBitmap(1<<20, 512).Merge(NewBitmap(2<<20, 512)); err == nil {
+		t.Error("expected an error merging bitmaps of disks of different sizes")
+	}
+}
+
+func TestBitmapTracking(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "file.qcow2")
+	img, err := Create(name, 4<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { img.Close() }()
+	addBitmaps(t, img, []bitmap{
+		{name: "disabled", tableSize: 1, typ: bitmapTypeDirty, granularityBits: 16},
+		{name: "crashed", tableSize: 1, typ: bitmapTypeDirty, granularityBits: 16, flags: bitmapAuto | bitmapInUse},
+	})
+	if err := img.AddBitmap("auto", 16); err != nil {
+		t.Fatal(err)
+	}
+	disabled, err := img.ReadBitmap("disabled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inUse := func(want bool) {
+		t.Helper()
+		infos, err := img.Bitmaps()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range infos {
+			if b.Name == "auto" && b.InUse != want {
+				t.Errorf("bitmap %q in use: %v, want %v", b.Name, b.InUse, want)
+			}
+			if b.Name == "crashed" && !b.InUse {
+				t.Errorf("bitmap %q is no longer in use", b.Name)
+			}
+		}
+	}
+
+	if _, err := img.WriteAt([]byte("data"), 100<<10); err != nil {
+		t.Fatal(err)
+	}
+	inUse(true)
+	if err := img.writeZeroes(1<<20, 64<<10+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteCompressedAt(bytes.Repeat([]byte("z"), 4096), 3<<20); err != nil {
+		t.Fatal(err)
+	}
+	want := []Range{{64 << 10, 64 << 10}, {1 << 20, 128 << 10}, {3 << 20, 64 << 10}}
+	// the writes not yet stored are read back
+	if b, err := img.ReadBitmap("auto"); err != nil || b.InUse || !reflect.DeepEqual(b.Ranges(), want) {
+		t.Fatalf("got bitmap %+v, %v", b, err)
+	}
+	if err := img.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	inUse(false)
+	if _, err := img.WriteAt([]byte("more"), 2<<20); err != nil {
+		t.Fatal(err)
+	}
+	inUse(true)
+	want = []Range{want[0], want[1], {2 << 20, 64 << 10}, want[2]}
+
+	img = reopen(t, img)
+	inUse(false)
+	checkFindings := func() {
+		t.Helper()
+		rep, err := img.Check(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// only the bitmap left in use by a crash is reported
+		for _, f := range rep.Findings {
+			switch {
+			case f.Kind == FindingNote || f.Kind == FindingTrailingData:
+			case f.Kind == FindingBitmap && strings.Contains(f.Message, `"crashed" is in use`):
+			default:
+				t.Errorf("found %s", f.Message)
+			}
+		}
+	}
+	checkFindings()
+	for name, ranges := range map[string][]Range{"auto": want, "disabled": disabled.Ranges()} {
+		if b, err := img.ReadBitmap(name); err != nil || !reflect.DeepEqual(b.Ranges(), ranges) {
+			t.Errorf("got bitmap %s of ranges %v, %v, want %v", name, b.Ranges(), err, ranges)
+		}
+	}
+
+	// writes that are not recorded leave the bitmaps in use
+	img.Close()
+	if img, err = OpenFile(name, os.O_RDWR, WithoutBitmapTracking()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt([]byte("bulk"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	inUse(true)
+	img = reopen(t, img)
+	inUse(true)
+	if b, err := img.ReadBitmap("auto"); err != nil || !b.InUse || !reflect.DeepEqual(b.Ranges(), want) {
+		t.Errorf("got bitmap %+v, %v", b, err)
+	}
+}
@@ -0,0 +1,82 @@
+package qcow2
+
+import "fmt"
+
+// trackWrite records a write of n guest bytes at off in the enabled
+// persistent bitmaps, and is called with the lock held before the data is
+// written. The first write after the bitmaps were stored loads their bits and
+// marks them in use on disk, so that a crash before they are stored again
+// leaves them untrusted rather than missing writes.
+func (img *Image) trackWrite(off, n int64) error {
+	if !img.tracking {
+		if err := img.startTracking(); err != nil {
+			return err
+		}
+	}
+	for _, b := range img.tracked {
+		b.SetRange(off, n)
+	}
+	return nil
+}
+
+// startTracking loads the bits of the enabled bitmaps that are not in use
+// into tracked, and marks them in use. WithoutBitmapTracking only marks them.
+// Stale bitmaps are left alone, as are those already in use, whose bits can
+// not be trusted anyway.
+func (img *Image) startTracking() error {
+	bitmaps, stale, err := img.loadBitmaps()
+	if err != nil {
+		return err
+	}
+	if stale || len(bitmaps) == 0 {
+		img.tracking = true
+		return nil
+	}
+	tracked := map[string]*Bitmap{}
+	changed := false
+	for i, b := range bitmaps {
+		if b.flags&bitmapAuto == 0 || b.flags&bitmapInUse != 0 {
+			continue
+		}
+		if !img.opts.noBitmapTracking {
+			bits, err := img.bitmapContents(b)
+			if err != nil {
+				return fmt.Errorf("qcow2: recording writes in bitmap %q: %w", b.name, err)
+			}
+			tracked[b.name] = bits
+		}
+		bitmaps[i].flags |= bitmapInUse
+		changed = true
+	}
+	if changed {
+		if err := img.writeBitmaps(bitmaps); err != nil {
+			return err
+		}
+	}
+	img.tracked, img.tracking = tracked, true
+	return nil
+}
+
+// storeTracked writes the bits of the tracked bitmaps back, no longer in use,
+// so that the next write loads them again. Bitmaps marked in use
+// WithoutBitmapTracking stay in use.
+func (img *Image) storeTracked() error {
+	if !img.tracking {
+		return nil
+	}
+	if len(img.tracked) > 0 {
+		bitmaps, _, err := img.loadBitmaps()
+		if err != nil {
+			return err
+		}
+		for i, b := range bitmaps {
+			if bits := img.tracked[b.name]; bits != nil {
+				if err := img.storeBitmapBits(bitmaps, i, bits.Bits); err != nil {
+					return fmt.Errorf("qcow2: storing bitmap %q: %w", b.name, err)
+				}
+			}
+		}
+	}
+	img.tracked, img.tracking = nil, false
+	return nil
+}
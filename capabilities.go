@@ -0,0 +1,62 @@
+package qcow2
+
+// Capabilities are what this package does with images, as a tool reports it
+// for bug reports. They come from the tables the package consults, so they
+// do not drift from what it does.
+type Capabilities struct {
+	// Versions are the versions of images read and created
+	Versions []Version
+	// Features are the KnownFeatures, with whether images of each open
+	Features []FeatureSupport
+	// CompressionTypes are the compressions of clusters read and written
+	CompressionTypes []string
+	// Encryption are the encryption methods images may have
+	Encryption []EncryptionSupport
+	// MinClusterBits and MaxClusterBits bound the cluster sizes of images
+	MinClusterBits, MaxClusterBits int
+	// Write is whether images are written, as opposed to only read
+	Write bool
+}
+
+// FeatureSupport is a known feature and whether it is supported
+type FeatureSupport struct {
+	Feature
+	// Supported is false for the incompatible features this package does
+	// not implement, which stop images from opening. Compatible features
+	// are safe to ignore and autoclear ones get cleared as the
+	// specification asks, so those are always supported.
+	Supported bool
+}
+
+// EncryptionSupport is an encryption method and what is done with images of
+// it
+type EncryptionSupport struct {
+	Method CryptMethod
+	// Read is whether the guest disk of an image can be read, with the
+	// passphrase of WithPassphrase for an encrypted one, and Write whether
+	// it can be written
+	Read, Write bool
+	// Header is whether the encryption header is decoded, by LUKSHeader
+	Header bool
+}
+
+// SupportedCapabilities is what this build of the package does with images
+func SupportedCapabilities() Capabilities {
+	c := Capabilities{
+		Versions:         append([]Version(nil), supportedVersions...),
+		CompressionTypes: append([]string(nil), compressionTypes...),
+		MinClusterBits:   minClusterBits,
+		MaxClusterBits:   maxClusterBits,
+		Write:            true,
+	}
+	for _, f := range KnownFeatures {
+		supported := f.Type != FeatureIncompatible || supportedIncompatible&(1<<f.Bit) != 0
+		c.Features = append(c.Features, FeatureSupport{f, supported})
+	}
+	for _, m := range []CryptMethod{CryptNone, CryptAES, CryptLUKS} {
+		// unlock only knows LUKS, and the writes refuse encrypted images
+		// with ErrEncrypted
+		c.Encryption = append(c.Encryption, EncryptionSupport{Method: m, Read: m != CryptAES, Write: m == CryptNone, Header: m == CryptLUKS})
+	}
+	return c
+}
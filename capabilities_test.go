@@ -0,0 +1,55 @@
+package qcow2
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestSupportedCapabilities(t *testing.T) {
+	c := SupportedCapabilities()
+	if len(c.Features) != len(KnownFeatures) || len(c.Versions) == 0 || len(c.CompressionTypes) == 0 {
+		t.Fatalf("got %+v", c)
+	}
+	// what is reported is what opening the images does
+	for _, f := range c.Features {
+		if f.Type != FeatureIncompatible {
+			continue
+		}
+		name := filepath.Join(t.TempDir(), "feature.qcow2")
+		img, err := Create(name, 1<<20, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img.Header.IncompatibleFeatures |= 1 << f.Bit
+		if err := img.writeHeader(); err != nil {
+			t.Fatal(err)
+		}
+		img.Close()
+		img, err = Open(name)
+		var ue UnsupportedFeaturesError
+		if f.Supported && err != nil {
+			t.Errorf("%s: supported, and the image did not open: %v", f.Name, err)
+		} else if !f.Supported && !errors.As(err, &ue) {
+			t.Errorf("%s: unsupported, and opening the image got %v", f.Name, err)
+		}
+		if err == nil {
+			img.Close()
+		}
+	}
+	for bits := c.MinClusterBits - 1; bits <= c.MaxClusterBits+1; bits++ {
+		_, err := Create(filepath.Join(t.TempDir(), "bits.qcow2"), 1<<20, &CreateOptions{ClusterSize: 1 << bits})
+		if ok := bits >= c.MinClusterBits && bits <= c.MaxClusterBits; ok != (err == nil) {
+			t.Errorf("cluster bits %d: got %v", bits, err)
+		}
+	}
+	for _, v := range []Version{1, 2, 3, 4} {
+		img, err := Create(filepath.Join(t.TempDir(), "version.qcow2"), 1<<20, &CreateOptions{Version: v})
+		if v.supported() != (err == nil) {
+			t.Errorf("version %d: got %v", v, err)
+		}
+		if err == nil {
+			img.Close()
+		}
+	}
+}
@@ -0,0 +1,1483 @@
+package qcow2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// FindingKind classifies the findings of Check. Its values are stable, to be
+// matched by tools reading the JSON of a CheckReport.
+type FindingKind string
+
+const (
+	// FindingLeak is a cluster whose refcount is higher than the number of
+	// references to it, which wastes space but does no harm
+	FindingLeak FindingKind = "leak"
+	// FindingRefcount is a cluster referenced more often than its refcount
+	// says, so that it may be freed and overwritten while still in use
+	FindingRefcount FindingKind = "refcount-error"
+	// FindingCopiedFlag is an active L1 or L2 entry whose COPIED flag does
+	// not match the refcount of its cluster
+	FindingCopiedFlag FindingKind = "copied-flag"
+	// FindingInvalidEntry is an L1, L2 or refcount table entry whose offset
+	// is not cluster aligned, lies in the header cluster or past the end of
+	// the file, which is not counted as a reference
+	FindingInvalidEntry FindingKind = "invalid-entry"
+	// FindingOverlap is a cluster claimed by more than one structure, or
+	// twice by one that can not be shared. It is never repaired.
+	FindingOverlap FindingKind = "overlap"
+	// FindingSnapshot is a snapshot table entry, or the snapshot table
+	// itself, that is inconsistent
+	FindingSnapshot FindingKind = "snapshot"
+	// FindingBacking is a backing file that is missing, of another
+	// format than recorded, part of a loop or smaller than it should be
+	FindingBacking FindingKind = "backing-chain"
+	// FindingNote is worth knowing but not a problem, and is not counted
+	FindingNote FindingKind = "note"
+	// FindingTrailingData is data past the last cluster in use, that no
+	// refcount accounts for. It is not counted either, and Compact or
+	// TruncateTrailing removes it.
+	FindingTrailingData FindingKind = "trailing-data"
+	// FindingCompressed is a compressed cluster whose descriptor is
+	// inconsistent, or whose data does not decompress to one cluster
+	FindingCompressed FindingKind = "compressed-cluster"
+	// FindingBitmap is a persistent bitmap, or the bitmap directory, that is
+	// inconsistent, or a bitmap left in use, which can not be trusted
+	FindingBitmap FindingKind = "bitmap"
+	// FindingCheckError is a structure that could not be read or checked
+	FindingCheckError FindingKind = "check-error"
+)
+
+// Finding is a problem found by Check
+type Finding struct {
+	Kind FindingKind `json:"kind"`
+	// Offset is the host offset of the cluster or entry concerned
+	Offset int64 `json:"offset"`
+	// Length is the size of the range of clusters concerned, for leaks and
+	// refcount errors
+	Length int64 `json:"length"`
+	// Refcount and References are the stored refcount of the clusters and
+	// the number of references found to them
+	Refcount   uint64 `json:"refcount"`
+	References uint64 `json:"references"`
+	// Referrers are the structures referencing the cluster, for refcount
+	// errors and overlaps, or the one holding the entry, for invalid entries
+	Referrers []Referrer `json:"referrers,omitempty"`
+	// Entry is the value of an invalid entry
+	Entry uint64 `json:"entry,omitempty"`
+	// GuestOffset is the guest offset of a compressed cluster
+	GuestOffset int64 `json:"guest-offset,omitempty"`
+	// Level and Path locate the backing file concerned in the backing chain,
+	// where the backing file of the image is at level 1
+	Level int    `json:"level,omitempty"`
+	Path  string `json:"path,omitempty"`
+	// Orphan is what the leaked clusters look like when no structure
+	// references them at all: "snapshot-l1-table" for the L1 table of a
+	// snapshot no longer in the snapshot table, or "l2-table"
+	Orphan string `json:"orphan,omitempty"`
+	// Message describes the problem, worded as by qemu-img check where it
+	// reports the same problem
+	Message string `json:"message"`
+}
+
+func (f Finding) String() string {
+	return f.Message
+}
+
+// Referrer is a structure holding a reference to a cluster
+type Referrer struct {
+	// Structure is what the cluster is to the referrer: "header",
+	// "l1-table", "refcount-table", "refcount-block", "snapshot-table",
+	// "l2-table", "data", "bitmap-directory", "bitmap-table" or
+	// "bitmap-data"
+	Structure string `json:"structure"`
+	// Snapshot is the ID of the snapshot whose tables hold the reference,
+	// empty for the active state and for the structures of the image
+	Snapshot string `json:"snapshot,omitempty"`
+	// Bitmap is the name of the bitmap holding the reference
+	Bitmap string `json:"bitmap,omitempty"`
+	// L1Index and L2Index locate the entry holding the reference in the L1,
+	// refcount or bitmap table and in the L2 table, or are -1
+	L1Index int `json:"l1-index"`
+	L2Index int `json:"l2-index"`
+}
+
+func (r Referrer) String() string {
+	s := r.Structure
+	switch {
+	case r.L1Index < 0:
+	case r.Structure == "refcount-block":
+		s += fmt.Sprintf(" at refcount table index %d", r.L1Index)
+	case r.Bitmap != "":
+		s += fmt.Sprintf(" at bitmap table index %d", r.L1Index)
+	default:
+		s += fmt.Sprintf(" at L1 index %d", r.L1Index)
+	}
+	if r.L2Index >= 0 {
+		s += fmt.Sprintf(", L2 index %d", r.L2Index)
+	}
+	if r.Snapshot != "" {
+		s += " of snapshot " + r.Snapshot
+	}
+	if r.Bitmap != "" {
+		s += fmt.Sprintf(" of bitmap %q", r.Bitmap)
+	}
+	return s
+}
+
+// refBy is a Referrer with no table entry
+func refBy(structure string) Referrer {
+	return Referrer{Structure: structure, L1Index: -1, L2Index: -1}
+}
+
+// CheckReport is the outcome of Check. It marshals to JSON with the names
+// qemu-img check uses for the same counts, and new fields are only ever
+// added.
+type CheckReport struct {
+	// Corruptions counts the findings that may lose data
+	Corruptions int `json:"corruptions"`
+	// Leaks counts the leaked clusters, which hold LeakedBytes
+	Leaks       int   `json:"leaks"`
+	LeakedBytes int64 `json:"leaked-bytes"`
+	// CheckErrors counts the structures that could not be checked
+	CheckErrors int `json:"check-errors"`
+	// LeaksFixed and CorruptionsFixed count the leaks and corruptions that
+	// a repair fixed, after which the other fields describe the repaired
+	// image
+	LeaksFixed       int `json:"leaks-fixed"`
+	CorruptionsFixed int `json:"corruptions-fixed"`
+	// Findings lists the problems found, in the order of the host offsets
+	// of the clusters for refcount problems
+	Findings []Finding `json:"findings"`
+	// MarkCorrupt recommends setting the corrupt bit, so that the image is
+	// not written to, because its metadata overlaps. A repair sets it.
+	MarkCorrupt bool `json:"mark-corrupt"`
+
+	// ImageEndOffset is the end of the last cluster in use
+	ImageEndOffset int64 `json:"image-end-offset"`
+	// TotalClusters is the number of clusters of the guest disk, of which
+	// AllocatedClusters are allocated by the image itself.
+	// FragmentedClusters do not follow the cluster before them in the file,
+	// and CompressedClusters are compressed.
+	TotalClusters      int64 `json:"total-clusters"`
+	AllocatedClusters  int64 `json:"allocated-clusters"`
+	FragmentedClusters int64 `json:"fragmented-clusters"`
+	CompressedClusters int64 `json:"compressed-clusters"`
+}
+
+// Clean reports whether nothing at all was found
+func (r *CheckReport) Clean() bool {
+	return r.Corruptions == 0 && r.Leaks == 0 && r.CheckErrors == 0
+}
+
+// ExitCode is the exit status of qemu-img check for the report: 0 when the
+// image is clean, including when a repair fixed everything found, 1 when
+// the check could not be completed, 2 when the image has errors and 3 when
+// it only has leaked clusters
+func (r *CheckReport) ExitCode() int {
+	switch {
+	case r.CheckErrors > 0:
+		return 1
+	case r.Corruptions > 0:
+		return 2
+	case r.Leaks > 0:
+		return 3
+	}
+	return 0
+}
+
+// RepairMode is what Check repairs
+type RepairMode int
+
+const (
+	// RepairNone only reports
+	RepairNone RepairMode = iota
+	// RepairLeaks lowers the refcounts of leaked clusters to the number of
+	// references found, which returns them to the allocator without
+	// touching anything in use
+	RepairLeaks
+	// RepairAll also rebuilds the refcount table and blocks from the
+	// references found, when refcounts are too low or the refcount
+	// structures are damaged, and fixes the COPIED flags. Invalid entries
+	// are reported and left alone, and nothing is rebuilt when a structure
+	// holding references could not be read, since the clusters it
+	// references would then be freed.
+	RepairAll
+)
+
+// With either repair mode, an image whose metadata overlaps is not repaired
+// but marked corrupt: any write could then destroy what another structure
+// holds.
+
+// CheckOptions tune Check
+type CheckOptions struct {
+	// Progress is told how many clusters have been compared with their
+	// refcounts
+	Progress ProgressFunc
+	// Repair needs the image to be writable
+	Repair RepairMode
+	// Jobs is the number of L2 tables read and counted in parallel, all
+	// CPUs when zero. The report does not depend on it.
+	Jobs int
+	// Deep also decompresses every compressed cluster, which must give
+	// exactly one cluster of data
+	Deep bool
+	// Chain also validates the backing chain, down to its base: each backing
+	// file opens, has the format recorded above it and is not smaller than
+	// it should be.
+	Chain bool
+	// Window is the number of clusters whose references are counted at a
+	// time, 16M when zero, which bounds the memory taken by the counts to
+	// 12 bytes a cluster. Larger images are walked once for each window.
+	// Neither does the report depend on it, but a repair of all errors
+	// counts the references of the whole image at once.
+	Window int64
+}
+
+// Check verifies the consistency of the image metadata, like qemu-img check:
+// the reference count of every host cluster is recomputed from the header,
+// the L1 and L2 tables of the active state and of the snapshots, the
+// refcount structures, the snapshot table and the persistent bitmaps, and
+// compared with the stored refcounts. The error is only for failing to run
+// the check; what is wrong with the image is in the report.
+//
+// With a repair mode, what is found is repaired, and the image checked again
+// for the report. The dirty bit is cleared when nothing remains to repair.
+func (img *Image) Check(opts *CheckOptions) (*CheckReport, error) {
+	return img.CheckContext(context.Background(), opts)
+}
+
+// CheckContext is Check, stopping with the error of ctx once it is done
+func (img *Image) CheckContext(ctx context.Context, opts *CheckOptions) (*CheckReport, error) {
+	if opts == nil {
+		opts = &CheckOptions{}
+	}
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if opts.Repair != RepairNone && img.readOnly {
+		return nil, ErrReadOnly
+	}
+	jobs := workers(opts.Jobs)
+	rep, err := img.check(ctx, jobs, opts.Window, opts.Deep, opts.Progress)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Repair == RepairNone {
+		if opts.Chain {
+			img.checkChain(rep)
+		}
+		return rep, nil
+	}
+
+	var repaired bool
+	if rep.MarkCorrupt {
+		img.Header.IncompatibleFeatures |= IncompatCorrupt
+		if err := img.writeHeader(); err != nil {
+			return nil, err
+		}
+		return rep, nil
+	}
+	if opts.Repair == RepairAll {
+		repaired, err = img.repairAll(ctx, jobs, opts.Window, rep)
+	} else {
+		repaired, err = img.repairLeaks(rep)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if repaired {
+		if err := img.fh.Sync(); err != nil {
+			return nil, err
+		}
+		after, err := img.check(ctx, jobs, opts.Window, opts.Deep, nil)
+		if err != nil {
+			return nil, err
+		}
+		after.LeaksFixed = max(0, rep.Leaks-after.Leaks)
+		after.CorruptionsFixed = max(0, rep.Corruptions-after.Corruptions)
+		rep = after
+	}
+	features := img.Header.IncompatibleFeatures
+	if rep.Clean() {
+		features &^= IncompatDirty
+	}
+	if opts.Repair == RepairAll && rep.Corruptions == 0 && rep.CheckErrors == 0 {
+		features &^= IncompatCorrupt
+	}
+	if features != img.Header.IncompatibleFeatures {
+		img.Header.IncompatibleFeatures = features
+		if err := img.writeHeader(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Chain {
+		img.checkChain(rep)
+	}
+	return rep, nil
+}
+
+// check runs the checks of Check on up to workers goroutines, counting the
+// references to window clusters at a time, and decompressing the compressed
+// clusters when deep is set
+func (img *Image) check(ctx context.Context, workers int, window int64, deep bool, progress ProgressFunc) (*CheckReport, error) {
+	if window <= 0 {
+		window = defaultCheckWindow
+	}
+	c := newChecker(img)
+	c.deep = deep
+	clusters := img.end / img.clusterSize
+	c.refs = newRefCounts(0, min(window, clusters))
+	if err := c.countReferences(ctx, workers); err != nil {
+		return nil, err
+	}
+	// metadata past the end of the file is compared too
+	clusters = max(clusters, c.refs.last.Load()+1)
+	prog := newProgress(progress, clusters)
+	if err := c.compareRefcounts(ctx, prog); err != nil {
+		return nil, err
+	}
+	c.counting = true
+	for lo := int64(len(c.refs.counts)); lo < clusters; lo += window {
+		c.refs = newRefCounts(lo, min(window, clusters-lo))
+		if err := c.countReferences(ctx, workers); err != nil {
+			return nil, err
+		}
+		if err := c.compareRefcounts(ctx, prog); err != nil {
+			return nil, err
+		}
+	}
+	c.counting = false
+	prog.finish()
+	// clusters with a refcount and no reference are leaks, like those of a
+	// preallocated image, so only what is past them is trailing data
+	fi, err := img.fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() > c.used {
+		c.add(FindingTrailingData, c.used, "Trailing data: %d bytes at offset %d, past the last cluster in use", fi.Size()-c.used, c.used)
+		c.rep.Findings[len(c.rep.Findings)-1].Length = fi.Size() - c.used
+	}
+
+	if err := c.findReferrers(ctx, workers); err != nil {
+		return nil, err
+	}
+	c.attributeLeaks()
+	c.checkCopiedFlags()
+	c.rep.TotalClusters = ceilDiv(img.Size(), img.clusterSize)
+	return c.rep, nil
+}
+
+// repairLeaks lowers the refcounts of the leaks of rep to their references,
+// and reports whether there were any
+func (img *Image) repairLeaks(rep *CheckReport) (bool, error) {
+	repaired := false
+	for _, f := range rep.Findings {
+		if f.Kind != FindingLeak {
+			continue
+		}
+		for off := f.Offset; off < f.Offset+f.Length; off += img.clusterSize {
+			if err := img.setRefcount(off, f.References); err != nil {
+				return repaired, err
+			}
+			repaired = true
+		}
+	}
+	return repaired, nil
+}
+
+// rebuildStart is the cluster index where the refcount structures rebuilt
+// from the references found by c go: in free clusters of the file when
+// there are enough, which leaves entries pointing past its end invalid, or
+// else past its end as long as no such entry comes to point into them
+func (img *Image) rebuildStart(c *checker) (int64, error) {
+	order := img.Header.RefcountOrder
+	blocks, tableClusters := img.refcountClusters(order, 0)
+	need := blocks + tableClusters
+
+	// the old structures are only free once the header no longer uses them
+	old := map[int64]bool{}
+	h := img.Header
+	for i := int64(0); i < int64(h.RefcountTableClusters); i++ {
+		old[h.RefcountTableOffset/img.clusterSize+i] = true
+	}
+	for _, e := range img.reftable {
+		old[int64(e&entryOffsetMask)/img.clusterSize] = true
+	}
+	run := int64(0)
+	for i := int64(1); i < img.end/img.clusterSize; i++ {
+		if c.refs.get(i) != 0 || old[i] {
+			run = 0
+			continue
+		}
+		if run++; run == need {
+			return i - need + 1, nil
+		}
+	}
+
+	start := img.end / img.clusterSize
+	blocks, tableClusters = img.refcountClusters(order, start)
+	if end := (start + blocks + tableClusters) * img.clusterSize; c.pastEnd < end {
+		return 0, fmt.Errorf("qcow2: rebuilding the refcounts would make the entry pointing to %#x, past the end of the file, valid", c.pastEnd)
+	}
+	return start, nil
+}
+
+// repairAll rebuilds the refcount structures when rep has findings about
+// refcounts, then fixes the COPIED flags, and reports whether it changed
+// anything
+func (img *Image) repairAll(ctx context.Context, workers int, window int64, rep *CheckReport) (bool, error) {
+	rebuild := false
+	for _, f := range rep.Findings {
+		switch f.Kind {
+		case FindingLeak, FindingRefcount, FindingCheckError:
+			rebuild = true
+		}
+	}
+	repaired := false
+	if rebuild {
+		// the new refcounts are all built in memory, so the references are
+		// counted in a single window
+		c := newChecker(img)
+		c.noRefcounts = true
+		c.refs = newRefCounts(0, img.end/img.clusterSize)
+		if err := c.countReferences(ctx, workers); err != nil {
+			return false, err
+		}
+		if c.incomplete {
+			return false, nil
+		}
+		if last := c.refs.last.Load(); last >= img.end/img.clusterSize {
+			return false, fmt.Errorf("qcow2: cluster %d is referenced past the end of the file", last)
+		}
+		refs := map[int64]uint64{}
+		var err error
+		c.refs.each(func(i int64, n uint64) {
+			if n > img.refcountMax() {
+				err = fmt.Errorf("qcow2: cluster %d is referenced %d times, more than %d bit refcounts can count", i, n, img.refcountBits())
+			}
+			refs[i*img.clusterSize] = n
+		})
+		if err != nil {
+			return false, err
+		}
+		start, err := img.rebuildStart(c)
+		if err != nil {
+			return false, err
+		}
+		if err := img.rebuildRefcountsAt(refs, img.Header.RefcountOrder, start); err != nil {
+			return false, err
+		}
+		if err := img.writeHeader(); err != nil {
+			return false, err
+		}
+		if err := img.fh.Sync(); err != nil {
+			return false, err
+		}
+		repaired = true
+	}
+
+	// the flags follow the refcounts, so they are fixed after the rebuild
+	after, err := img.check(ctx, workers, window, false, nil)
+	if err != nil {
+		return repaired, err
+	}
+	for _, f := range after.Findings {
+		if f.Kind != FindingCopiedFlag {
+			continue
+		}
+		entry, err := img.readEntry(f.Offset)
+		if err != nil {
+			return repaired, err
+		}
+		rc, err := img.refcount(int64(entry & entryOffsetMask))
+		if err != nil {
+			return repaired, err
+		}
+		entry &^= flagCopied
+		if rc == 1 {
+			entry |= flagCopied
+		}
+		if l1i := (f.Offset - img.Header.L1TableOffset) / 8; f.Offset >= img.Header.L1TableOffset && l1i < int64(len(img.l1)) {
+			err = img.setL1(l1i, entry)
+		} else {
+			err = img.writeEntry(f.Offset, entry)
+		}
+		if err != nil {
+			return repaired, err
+		}
+		repaired = true
+	}
+	return repaired, nil
+}
+
+// checker holds the state of Check
+type checker struct {
+	img *Image
+	rep *CheckReport
+	// refs are the references found to each cluster of the window counted
+	refs *refCounts
+	// counting is set for the windows after the first, for which only the
+	// references are counted, everything else having been found already
+	counting bool
+	// traced, when set, holds the clusters whose referrers are gathered
+	// into referrers instead of counting references
+	traced    map[int64]bool
+	referrers map[int64][]Referrer
+	// noRefcounts leaves the refcount structures out of the references
+	noRefcounts bool
+	// deep decompresses the compressed clusters
+	deep bool
+	// incomplete is set when a structure holding references could not be
+	// read
+	incomplete bool
+	// pastEnd is the lowest offset of an invalid entry running past the end
+	// of the file
+	pastEnd int64
+	// next is where a cluster contiguous with the last one of the active
+	// state walked would follow
+	next int64
+	// trees are the L1 tables walked, the active one first
+	trees []*tree
+	// used is the end of the last cluster with a refcount or a reference
+	used int64
+}
+
+func newChecker(img *Image) *checker {
+	return &checker{img: img, rep: &CheckReport{}, refs: newRefCounts(0, 0), pastEnd: math.MaxInt64}
+}
+
+// defaultCheckWindow is the number of clusters whose references Check
+// counts at a time, taking 128 MiB
+const defaultCheckWindow = 1 << 24
+
+// refCounts are the references found to a window of clusters, counted in
+// parallel
+type refCounts struct {
+	// counts are those of the cluster indexes from lo
+	lo     int64
+	counts []uint64
+	// claims are the roles of the structures referencing each cluster
+	claims []uint32
+	// last is the highest cluster index referenced, in the window or not
+	last atomic.Int64
+}
+
+func newRefCounts(lo, n int64) *refCounts {
+	r := &refCounts{lo: lo, counts: make([]uint64, n), claims: make([]uint32, n)}
+	r.last.Store(-1)
+	return r
+}
+
+// add counts a reference to cluster index i by a structure of the given role
+func (r *refCounts) add(i int64, role uint32) {
+	for last := r.last.Load(); i > last && !r.last.CompareAndSwap(last, i); last = r.last.Load() {
+	}
+	if i < r.lo || i >= r.lo+int64(len(r.counts)) {
+		return
+	}
+	atomic.AddUint64(&r.counts[i-r.lo], 1)
+	claim := &r.claims[i-r.lo]
+	for old := atomic.LoadUint32(claim); old&role == 0 && !atomic.CompareAndSwapUint32(claim, old, old|role); old = atomic.LoadUint32(claim) {
+	}
+}
+
+// roles are the structures that may reference a cluster, as named by
+// Referrer. Only L2 tables and data clusters are shared, between the
+// active state and the snapshots.
+var roles = []string{"header", "l1-table", "refcount-table", "refcount-block", "snapshot-table", "l2-table", "data", "bitmap-directory", "bitmap-table", "bitmap-data"}
+
+const sharedRoles = 1<<5 | 1<<6
+
+// role is the bit of the structure in the claims of a cluster
+func role(structure string) uint32 {
+	for i, r := range roles {
+		if r == structure {
+			return 1 << i
+		}
+	}
+	return 0
+}
+
+// overlaps reports whether a cluster referenced refs times by structures
+// of the roles claimed overlaps
+func overlaps(claimed uint32, refs uint64) bool {
+	if claimed&(claimed-1) != 0 {
+		return true // more than one role
+	}
+	return claimed&sharedRoles == 0 && refs > 1
+}
+
+// roleNames lists the roles claimed
+func roleNames(claimed uint32) string {
+	var names []string
+	for i, r := range roles {
+		if claimed&(1<<i) != 0 {
+			names = append(names, r)
+		}
+	}
+	return strings.Join(names, " and ")
+}
+
+// get is the count of cluster index i, which is in the window, once
+// counting is over
+func (r *refCounts) get(i int64) uint64 {
+	if i < r.lo || i >= r.lo+int64(len(r.counts)) {
+		return 0
+	}
+	return r.counts[i-r.lo]
+}
+
+// claimed are the roles of the structures referencing cluster index i,
+// which is in the window, once counting is over
+func (r *refCounts) claimed(i int64) uint32 {
+	return r.claims[i-r.lo]
+}
+
+// each calls fn with the count of every cluster of the window referenced,
+// once counting is over
+func (r *refCounts) each(fn func(i int64, n uint64)) {
+	for i, n := range r.counts {
+		if n != 0 {
+			fn(r.lo+int64(i), n)
+		}
+	}
+}
+
+// walk collects what is found walking part of the structures of the
+// image, which is merged into the checker in the order of the structures
+// so that reports do not depend on how the walks were run
+type walk struct {
+	c        *checker
+	findings []Finding
+	// referrers are those of the traced clusters, in the order found
+	referrers []tracedReferrer
+
+	incomplete bool
+	pastEnd    int64
+
+	// statistics of the active state, with the first cluster walked and
+	// where one following the last would be
+	allocated, compressed, fragmented int64
+	first, next                       int64
+}
+
+type tracedReferrer struct {
+	cluster int64
+	r       Referrer
+}
+
+func (c *checker) newWalk() *walk {
+	return &walk{c: c, pastEnd: math.MaxInt64}
+}
+
+// merge adds what w found to the checker
+func (c *checker) merge(w *walk) {
+	if c.counting {
+		return
+	}
+	for _, f := range w.findings {
+		c.addFinding(f)
+	}
+	for _, t := range w.referrers {
+		c.referrers[t.cluster] = append(c.referrers[t.cluster], t.r)
+	}
+	c.incomplete = c.incomplete || w.incomplete
+	c.pastEnd = min(c.pastEnd, w.pastEnd)
+	c.rep.AllocatedClusters += w.allocated
+	c.rep.CompressedClusters += w.compressed
+	c.rep.FragmentedClusters += w.fragmented
+	if w.first != 0 {
+		if c.next != 0 && w.first != c.next {
+			c.rep.FragmentedClusters++
+		}
+		c.next = w.next
+	}
+}
+
+func (c *checker) addFinding(f Finding) {
+	c.rep.add(f)
+}
+
+func (r *CheckReport) add(f Finding) {
+	switch f.Kind {
+	case FindingCheckError:
+		r.CheckErrors++
+	case FindingNote, FindingTrailingData:
+	default:
+		r.Corruptions++
+	}
+	r.Findings = append(r.Findings, f)
+}
+
+func (c *checker) add(kind FindingKind, off int64, format string, args ...any) {
+	c.addFinding(Finding{Kind: kind, Offset: off, Message: fmt.Sprintf(format, args...)})
+}
+
+func (w *walk) add(kind FindingKind, off int64, format string, args ...any) {
+	w.findings = append(w.findings, Finding{Kind: kind, Offset: off, Message: fmt.Sprintf(format, args...)})
+}
+
+// corruptionOffset is where the bad bytes are when err is a CorruptionError,
+// or else off
+func corruptionOffset(err error, off int64) int64 {
+	var ce CorruptionError
+	if errors.As(err, &ce) {
+		return ce.Offset
+	}
+	return off
+}
+
+// unreadable reports a structure holding references that could not be read
+func (w *walk) unreadable(off int64, format string, args ...any) {
+	w.incomplete = true
+	w.add(FindingCheckError, off, format, args...)
+}
+
+// addLeak reports the cluster at off as leaked, extending the leak found
+// just before it when the counts are the same
+func (c *checker) addLeak(off int64, rc, refs uint64) {
+	cs := c.img.clusterSize
+	c.rep.Leaks++
+	c.rep.LeakedBytes += cs
+	if n := len(c.rep.Findings); n > 0 {
+		if f := &c.rep.Findings[n-1]; f.Kind == FindingLeak && f.Offset+f.Length == off && f.Refcount == rc && f.References == refs {
+			f.Length += cs
+			f.Message = leakMessage(*f, cs)
+			return
+		}
+	}
+	f := Finding{Kind: FindingLeak, Offset: off, Length: cs, Refcount: rc, References: refs}
+	f.Message = leakMessage(f, cs)
+	c.rep.Findings = append(c.rep.Findings, f)
+}
+
+// attributeLeaks splits off the leaked clusters that nothing references and
+// that hold the tables of a snapshot dropped from the snapshot table: an L1
+// table pointing to leaked L2 tables, themselves pointing to leaked clusters
+func (c *checker) attributeLeaks() {
+	img := c.img
+	cs := img.clusterSize
+	var leaks []Finding
+	for _, f := range c.rep.Findings {
+		if f.Kind == FindingLeak {
+			leaks = append(leaks, f)
+		}
+	}
+	leaked := func(off int64) bool {
+		i := sort.Search(len(leaks), func(i int) bool { return leaks[i].Offset+leaks[i].Length > off })
+		return i < len(leaks) && leaks[i].Offset <= off
+	}
+	// table reads the cluster at off as a table whose entries all point to
+	// leaked clusters, or returns nil
+	table := func(off int64) []int64 {
+		entries, err := img.readTable(off, int(cs/8))
+		if err != nil {
+			return nil
+		}
+		var targets []int64
+		for _, e := range entries {
+			if e == 0 {
+				continue
+			}
+			t := int64(e & entryOffsetMask)
+			if e&^(entryOffsetMask|flagCopied) != 0 || img.invalidOffset(t, cs, true) != "" || !leaked(t) {
+				return nil
+			}
+			targets = append(targets, t)
+		}
+		return targets
+	}
+	orphan := func(off int64) string {
+		targets := table(off)
+		if targets == nil {
+			return ""
+		}
+		for _, t := range targets {
+			if table(t) == nil {
+				return "l2-table"
+			}
+		}
+		return "snapshot-l1-table"
+	}
+
+	var findings []Finding
+	for _, f := range c.rep.Findings {
+		if f.Kind != FindingLeak || f.References != 0 {
+			findings = append(findings, f)
+			continue
+		}
+		var run *Finding
+		for off := f.Offset; off < f.Offset+f.Length; off += cs {
+			o := orphan(off)
+			if run != nil && run.Orphan == o {
+				run.Length += cs
+				continue
+			}
+			findings = append(findings, Finding{Kind: FindingLeak, Offset: off, Length: cs, Refcount: f.Refcount, Orphan: o})
+			run = &findings[len(findings)-1]
+		}
+	}
+	for i := range findings {
+		if f := &findings[i]; f.Kind == FindingLeak && f.References == 0 {
+			f.Message = leakMessage(*f, cs)
+		}
+	}
+	c.rep.Findings = findings
+}
+
+// leakMessage describes the leak f as qemu-img check does, saying what the
+// clusters look like when they are orphaned
+func leakMessage(f Finding, cs int64) string {
+	var s string
+	if f.Length == cs {
+		s = fmt.Sprintf("Leaked cluster %d refcount=%d reference=%d", f.Offset/cs, f.Refcount, f.References)
+	} else {
+		s = fmt.Sprintf("Leaked clusters %d-%d refcount=%d reference=%d", f.Offset/cs, (f.Offset+f.Length)/cs-1, f.Refcount, f.References)
+	}
+	switch f.Orphan {
+	case "snapshot-l1-table":
+		s += " (orphaned snapshot L1 table)"
+	case "l2-table":
+		s += " (orphaned L2 table)"
+	}
+	return s
+}
+
+// valid reports whether the entry at host offset at, held by r, points to
+// [off, off+size) within the image, and reports it otherwise
+func (w *walk) valid(r Referrer, at int64, entry uint64, off, size int64, aligned bool) bool {
+	img := w.c.img
+	why := img.invalidOffset(off, size, aligned)
+	if why == "" {
+		return true
+	}
+	if off+size > img.end {
+		w.pastEnd = min(w.pastEnd, off)
+	}
+	w.findings = append(w.findings, Finding{
+		Kind:      FindingInvalidEntry,
+		Offset:    at,
+		Referrers: []Referrer{r},
+		Entry:     entry,
+		Message:   fmt.Sprintf("ERROR %s: entry %#x: offset %#x %s", r, entry, off, why),
+	})
+	return false
+}
+
+// ref counts a reference by r to every cluster overlapping [off, off+size)
+func (w *walk) ref(off, size int64, r Referrer) {
+	if size <= 0 {
+		// an empty table references no cluster, wherever it points
+		return
+	}
+	cs := w.c.img.clusterSize
+	for i := off / cs; i < ceilDiv(off+size, cs); i++ {
+		if w.c.traced == nil {
+			w.c.refs.add(i, role(r.Structure))
+		} else if w.c.traced[i] {
+			w.referrers = append(w.referrers, tracedReferrer{i, r})
+		}
+	}
+}
+
+// findReferrers lists the referrers of the clusters with refcount errors.
+// Keeping them for every cluster would take too much memory, so the
+// references are walked a second time for those clusters only.
+func (c *checker) findReferrers(ctx context.Context, workers int) error {
+	t := newChecker(c.img)
+	t.traced, t.referrers = map[int64]bool{}, map[int64][]Referrer{}
+	for _, f := range c.rep.Findings {
+		if f.Kind == FindingRefcount || f.Kind == FindingOverlap {
+			t.traced[f.Offset/c.img.clusterSize] = true
+		}
+	}
+	if len(t.traced) == 0 {
+		return nil
+	}
+	if err := t.countReferences(ctx, workers); err != nil {
+		return err
+	}
+	for i, f := range c.rep.Findings {
+		switch f.Kind {
+		case FindingRefcount:
+			c.rep.Findings[i].Referrers = t.referrers[f.Offset/c.img.clusterSize]
+		case FindingOverlap:
+			// the message tells the claimants apart by their indexes
+			refs := t.referrers[f.Offset/c.img.clusterSize]
+			names := make([]string, len(refs))
+			for j, r := range refs {
+				names[j] = r.String()
+			}
+			c.rep.Findings[i].Referrers = refs
+			c.rep.Findings[i].Message = fmt.Sprintf("ERROR cluster %d is claimed by the %s", f.Offset/c.img.clusterSize, strings.Join(names, " and the "))
+		}
+	}
+	return nil
+}
+
+// tree is an L1 table, of the snapshot with the given ID or of the active
+// state
+type tree struct {
+	l1       []uint64
+	l1Off    int64
+	snapshot string
+}
+
+// l2Job is an L2 table to walk, that of L1 index l1i of a tree
+type l2Job struct {
+	tree *tree
+	l1i  int
+	// first is set for the first job of the L2 table, whose compressed
+	// clusters are checked by it alone
+	first bool
+}
+
+// countReferences finds the references to every cluster. The L2 tables are
+// walked by up to workers goroutines.
+func (c *checker) countReferences(ctx context.Context, workers int) error {
+	img := c.img
+	h := img.Header
+	w := c.newWalk()
+	w.ref(0, img.clusterSize, refBy("header"))
+	w.ref(h.L1TableOffset, int64(h.L1Size)*8, refBy("l1-table"))
+	if !c.noRefcounts {
+		w.countRefcounts()
+	}
+	trees := []*tree{{l1: img.l1, l1Off: h.L1TableOffset}}
+	valid := w.checkSnapshots()
+	for i, s := range img.snapshots {
+		if !valid[i] {
+			continue
+		}
+		r := refBy("l1-table")
+		r.Snapshot = s.ID
+		w.ref(s.L1TableOffset, int64(s.L1Size)*8, r)
+		l1, err := img.readTable(s.L1TableOffset, s.L1Size)
+		if err != nil {
+			w.unreadable(s.L1TableOffset, "ERROR reading L1 table of snapshot %s (%s): %v", s.ID, s.Name, err)
+			continue
+		}
+		trees = append(trees, &tree{l1: l1, l1Off: s.L1TableOffset, snapshot: s.ID})
+	}
+	w.countBitmaps()
+	c.merge(w)
+	c.trees = trees
+
+	t, l1i := 0, 0
+	seen := map[uint64]bool{}
+	next := func() (l2Job, bool, error) {
+		for ; t < len(trees); t, l1i = t+1, 0 {
+			for ; l1i < len(trees[t].l1); l1i++ {
+				if l2off := trees[t].l1[l1i] & entryOffsetMask; l2off != 0 {
+					l1i++
+					first := !seen[l2off]
+					seen[l2off] = true
+					return l2Job{trees[t], l1i - 1, first}, true, nil
+				}
+			}
+		}
+		return l2Job{}, false, nil
+	}
+	work := func(_ context.Context, j l2Job) (*walk, error) {
+		w := c.newWalk()
+		w.countL2(j)
+		return w, nil
+	}
+	return runOrdered(ctx, workers, next, work, func(w *walk) error {
+		c.merge(w)
+		return nil
+	})
+}
+
+// checkSnapshots checks the snapshot table and its entries, and reports
+// which snapshots have an L1 table that can be walked
+func (w *walk) checkSnapshots() []bool {
+	img := w.c.img
+	h := img.Header
+	if h.NbSnapshots == 0 {
+		return nil
+	}
+	table := refBy("snapshot-table")
+	if why := img.invalidOffset(h.SnapshotsOffset, img.snapTableSize, true); why != "" {
+		w.snapshotFinding(h.SnapshotsOffset, table, "ERROR snapshot table at %#x %s", h.SnapshotsOffset, why)
+	} else {
+		w.ref(h.SnapshotsOffset, img.snapTableSize, table)
+	}
+	if img.snapshotsErr != nil {
+		w.incomplete = true
+		w.snapshotFinding(corruptionOffset(img.snapshotsErr, h.SnapshotsOffset), table, "ERROR snapshot table: only %d of the %d snapshots could be read: %v", len(img.snapshots), h.NbSnapshots, img.snapshotsErr)
+	}
+
+	valid := make([]bool, len(img.snapshots))
+	ids := map[string]bool{}
+	at := h.SnapshotsOffset
+	for i, s := range img.snapshots {
+		r := table
+		r.Snapshot = s.ID
+		name := fmt.Sprintf("snapshot %s (%s)", s.ID, s.Name)
+		if ids[s.ID] {
+			w.snapshotFinding(at, r, "ERROR %s: another snapshot has the same ID", name)
+		}
+		ids[s.ID] = true
+		valid[i] = true
+		switch why := img.invalidOffset(s.L1TableOffset, int64(s.L1Size)*8, true); {
+		case s.L1Size > maxL1Entries:
+			w.snapshotFinding(at, r, "ERROR %s: L1 table of %d entries is larger than the maximum of %d", name, s.L1Size, maxL1Entries)
+			valid[i], w.incomplete = false, true
+		case s.L1Size > 0 && why != "":
+			w.snapshotFinding(at, r, "ERROR %s: L1 table offset %#x %s", name, s.L1TableOffset, why)
+			valid[i], w.incomplete = false, true
+		case int64(s.L1Size)*img.l2Entries*img.clusterSize < s.DiskSize:
+			w.snapshotFinding(at, r, "ERROR %s: L1 table of %d entries is too small for a disk of %d bytes", name, s.L1Size, s.DiskSize)
+		}
+		if h.Version >= 3 && len(s.ExtraData) < 16 {
+			w.snapshotFinding(at, r, "ERROR %s: %d bytes of extra data, where version 3 needs at least 16", name, len(s.ExtraData))
+		}
+		entry := int64(snapshotHeaderSize + len(s.ExtraData) + len(s.ID) + len(s.Name))
+		at += (entry + 7) &^ 7
+	}
+	return valid
+}
+
+// snapshotFinding reports a problem of the snapshot table, with the entry
+// concerned at off
+func (w *walk) snapshotFinding(off int64, r Referrer, format string, args ...any) {
+	w.add(FindingSnapshot, off, format, args...)
+	w.findings[len(w.findings)-1].Referrers = []Referrer{r}
+}
+
+// countRefcounts counts the references of the refcount table and blocks
+func (w *walk) countRefcounts() {
+	img := w.c.img
+	h := img.Header
+	w.ref(h.RefcountTableOffset, int64(h.RefcountTableClusters)*img.clusterSize, refBy("refcount-table"))
+	for i, e := range img.reftable {
+		if off := int64(e & entryOffsetMask); off != 0 {
+			r := Referrer{Structure: "refcount-block", L1Index: i, L2Index: -1}
+			if w.valid(r, h.RefcountTableOffset+int64(i)*8, e, off, img.clusterSize, true) {
+				w.ref(off, img.clusterSize, r)
+			}
+		}
+	}
+}
+
+// countL2 counts the references of an L2 table and its clusters, and the
+// statistics of the active state
+func (w *walk) countL2(j l2Job) {
+	img := w.c.img
+	active := j.tree.snapshot == ""
+	e := j.tree.l1[j.l1i]
+	l2off := int64(e & entryOffsetMask)
+	r := Referrer{Structure: "l2-table", Snapshot: j.tree.snapshot, L1Index: j.l1i, L2Index: -1}
+	if !w.valid(r, j.tree.l1Off+int64(j.l1i)*8, e, l2off, img.clusterSize, true) {
+		return
+	}
+	w.ref(l2off, img.clusterSize, r)
+	l2, err := img.readTable(l2off, int(img.l2Entries))
+	if err != nil {
+		w.unreadable(l2off, "ERROR reading L2 table of L1 index %d: %v", j.l1i, err)
+		return
+	}
+	for i, entry := range l2 {
+		r := Referrer{Structure: "data", Snapshot: j.tree.snapshot, L1Index: j.l1i, L2Index: i}
+		at := l2off + int64(i)*8
+		switch img.classify(entry) {
+		case clusterCompressed:
+			off, size := img.compressedRange(entry)
+			if !w.valid(r, at, entry, off, size, false) {
+				continue
+			}
+			w.ref(off, size, r)
+			if j.first && !w.c.counting && w.c.traced == nil {
+				w.checkCompressed(r, (int64(j.l1i)*img.l2Entries+int64(i))*img.clusterSize, entry)
+			}
+			if active {
+				// compressed clusters are fragmented by nature
+				w.allocated++
+				w.compressed++
+				w.fragmented++
+			}
+		case clusterNormal, clusterZero:
+			host := int64(entry & entryOffsetMask)
+			if host == 0 || !w.valid(r, at, entry, host, img.clusterSize, true) {
+				continue
+			}
+			w.ref(host, img.clusterSize, r)
+			if active {
+				w.allocated++
+				if w.first == 0 {
+					w.first = host
+				} else if host != w.next {
+					w.fragmented++
+				}
+				w.next = host + img.clusterSize
+			}
+		}
+	}
+}
+
+// checkCompressed checks the descriptor of the compressed cluster at guest
+// offset guest, and that it decompresses when the check is deep
+func (w *walk) checkCompressed(r Referrer, guest int64, entry uint64) {
+	img := w.c.img
+	off, size := img.compressedRange(entry)
+	add := func(format string, args ...any) {
+		w.findings = append(w.findings, Finding{
+			Kind:        FindingCompressed,
+			Offset:      off,
+			Length:      size,
+			Referrers:   []Referrer{r},
+			Entry:       entry,
+			GuestOffset: guest,
+			Message:     fmt.Sprintf("ERROR compressed cluster at guest offset %#x, %d bytes at %#x: ", guest, size, off) + fmt.Sprintf(format, args...),
+		})
+	}
+	if entry&flagCopied != 0 {
+		add("entry %#x has the COPIED flag set", entry)
+	}
+	// less than a cluster of compressed data spans one more sector at most
+	if sectors := (off&511 + size) / 512; sectors > img.clusterSize/512+1 {
+		add("%d sectors are more than a cluster compresses to", sectors)
+	}
+	if !w.c.deep {
+		return
+	}
+	if n, err := img.decompressedSize(entry); err != nil {
+		add("%v", err)
+	} else if n != img.clusterSize {
+		add("decompresses to %d bytes instead of %d", n, img.clusterSize)
+	}
+}
+
+// countBitmaps checks the persistent bitmaps and counts their references
+func (w *walk) countBitmaps() {
+	img := w.c.img
+	h := img.Header
+	ext, ok, err := h.readBitmapsExt()
+	dir := refBy("bitmap-directory")
+	switch {
+	case h.ExtensionsSkipped:
+		if h.AutoclearFeatures&AutoclearBitmaps != 0 {
+			w.add(FindingNote, 0, "the bitmaps were not checked, as the header extensions were skipped: the clusters they use are counted as leaked")
+		}
+		return
+	case !ok && h.AutoclearFeatures&AutoclearBitmaps != 0:
+		w.bitmapFinding(0, dir, "ERROR the bitmaps autoclear bit is set, but there is no bitmaps extension")
+	case ok && h.AutoclearFeatures&AutoclearBitmaps == 0:
+		// another program changed the image without updating the bitmaps
+		w.bitmapFinding(0, dir, "ERROR the bitmaps autoclear bit is clear, so the bitmaps of the bitmaps extension are stale")
+	}
+	if !ok {
+		return
+	}
+	if err != nil {
+		w.unreadable(corruptionOffset(err, 0), "ERROR %v", err)
+		return
+	}
+	if ext.nbBitmaps == 0 || ext.nbBitmaps > maxBitmaps {
+		w.bitmapFinding(0, dir, "ERROR the bitmaps extension counts %d bitmaps, where 1 to %d are allowed", ext.nbBitmaps, maxBitmaps)
+	}
+	if why := img.invalidOffset(ext.dirOffset, ext.dirSize, true); why != "" {
+		w.incomplete = true
+		w.bitmapFinding(0, dir, "ERROR bitmap directory at %#x %s", ext.dirOffset, why)
+		return
+	}
+	w.ref(ext.dirOffset, ext.dirSize, dir)
+	bitmaps, err := img.readBitmaps(ext)
+	if err != nil {
+		w.incomplete = true
+		w.bitmapFinding(corruptionOffset(err, ext.dirOffset), dir, "ERROR %v", err)
+		return
+	}
+	var size int64
+	for _, b := range bitmaps {
+		size += b.entrySize()
+	}
+	if size != ext.dirSize {
+		w.bitmapFinding(ext.dirOffset, dir, "ERROR bitmap directory of %d bytes, where its %d bitmaps take %d", ext.dirSize, len(bitmaps), size)
+	}
+
+	names := map[string]bool{}
+	at := ext.dirOffset
+	for _, b := range bitmaps {
+		w.checkBitmap(at, b, names)
+		at += b.entrySize()
+	}
+}
+
+// checkBitmap checks the bitmap b of the directory entry at off, and counts
+// the references of its table
+func (w *walk) checkBitmap(off int64, b bitmap, names map[string]bool) {
+	img := w.c.img
+	r := refBy("bitmap-directory")
+	r.Bitmap = b.name
+	name := fmt.Sprintf("bitmap %q", b.name)
+	if names[b.name] {
+		w.bitmapFinding(off, r, "ERROR %s: another bitmap has the same name", name)
+	}
+	names[b.name] = true
+	if b.name == "" || len(b.name) > maxBitmapNameSize {
+		w.bitmapFinding(off, r, "ERROR %s: name of %d bytes, where 1 to %d are allowed", name, len(b.name), maxBitmapNameSize)
+	}
+	if b.flags&bitmapInUse != 0 {
+		w.bitmapFinding(off, r, "ERROR %s is in use: it was not saved cleanly and can not be trusted", name)
+	}
+	if reserved := b.flags &^ (bitmapInUse | bitmapAuto | bitmapExtraDataCompatible); reserved != 0 {
+		w.bitmapFinding(off, r, "ERROR %s: reserved flags %#x are set", name, reserved)
+	}
+	if len(b.extraData) > 0 && b.flags&bitmapExtraDataCompatible == 0 {
+		w.bitmapFinding(off, r, "ERROR %s: %d bytes of extra data that can not be ignored", name, len(b.extraData))
+	}
+	if b.typ != bitmapTypeDirty {
+		w.bitmapFinding(off, r, "ERROR %s: unknown type %d", name, b.typ)
+	}
+	if g := b.granularityBits; g < minBitmapGranularityBits || g > maxBitmapGranularityBits {
+		w.bitmapFinding(off, r, "ERROR %s: granularity of 2^%d bytes, where 2^%d to 2^%d are allowed", name, g, minBitmapGranularityBits, maxBitmapGranularityBits)
+	} else if want := img.bitmapTableSize(g); int64(b.tableSize) != want {
+		w.bitmapFinding(off, r, "ERROR %s: table of %d entries, where a disk of %d bytes needs %d", name, b.tableSize, img.Header.Size, want)
+	}
+
+	r.Structure = "bitmap-table"
+	why := img.invalidOffset(b.tableOffset, int64(b.tableSize)*8, true)
+	if b.tableSize > maxBitmapTableSize {
+		why = fmt.Sprintf("has %d entries, more than the maximum of %d", b.tableSize, maxBitmapTableSize)
+	}
+	if why != "" {
+		w.incomplete = true
+		w.bitmapFinding(off, r, "ERROR %s: table at %#x %s", name, b.tableOffset, why)
+		return
+	}
+	w.ref(b.tableOffset, int64(b.tableSize)*8, r)
+	table, err := img.readTable(b.tableOffset, b.tableSize)
+	if err != nil {
+		w.unreadable(b.tableOffset, "ERROR reading the table of bitmap %q: %v", b.name, err)
+		return
+	}
+	for i, e := range table {
+		dr := Referrer{Structure: "bitmap-data", Bitmap: b.name, L1Index: i, L2Index: -1}
+		at := b.tableOffset + int64(i)*8
+		data := int64(e & entryOffsetMask)
+		if e&bitmapEntryReserved != 0 || data != 0 && e&1 != 0 {
+			w.bitmapFinding(at, dr, "ERROR %s: entry %#x has reserved bits set", dr, e)
+			continue
+		}
+		if data != 0 && w.valid(dr, at, e, data, img.clusterSize, true) {
+			w.ref(data, img.clusterSize, dr)
+		}
+	}
+}
+
+// bitmapFinding reports a problem of the bitmap directory or of a bitmap,
+// with the entry concerned at off
+func (w *walk) bitmapFinding(off int64, r Referrer, format string, args ...any) {
+	w.add(FindingBitmap, off, format, args...)
+	w.findings[len(w.findings)-1].Referrers = []Referrer{r}
+}
+
+// compareRefcounts compares the references found to the clusters of the
+// window with their stored refcounts
+func (c *checker) compareRefcounts(ctx context.Context, prog *progress) error {
+	img := c.img
+	for i := c.refs.lo; i < c.refs.lo+int64(len(c.refs.counts)); i++ {
+		if i%img.refblockEntries() == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		prog.add(1)
+		off := i * img.clusterSize
+		rc, err := img.refcount(off)
+		if err != nil {
+			c.add(FindingCheckError, corruptionOffset(err, off), "ERROR cluster %d: %v", i, err)
+			c.used = off + img.clusterSize
+			continue
+		}
+		refs := c.refs.get(i)
+		if rc > 0 || refs > 0 {
+			c.used = off + img.clusterSize
+		}
+		switch {
+		case rc < refs:
+			c.add(FindingRefcount, off, "ERROR cluster %d refcount=%d reference=%d", i, rc, refs)
+			f := &c.rep.Findings[len(c.rep.Findings)-1]
+			f.Length, f.Refcount, f.References = img.clusterSize, rc, refs
+		case rc > refs:
+			c.addLeak(off, rc, refs)
+		}
+		if claimed := c.refs.claimed(i); overlaps(claimed, refs) {
+			c.add(FindingOverlap, off, "ERROR cluster %d is claimed by the %s", i, roleNames(claimed))
+			f := &c.rep.Findings[len(c.rep.Findings)-1]
+			f.Length, f.Refcount, f.References = img.clusterSize, rc, refs
+			c.rep.MarkCorrupt = true
+		}
+		if refs > 0 {
+			c.rep.ImageEndOffset = off + img.clusterSize
+		}
+	}
+	return nil
+}
+
+// checkCopiedFlags checks that the active L1 and L2 entries have the COPIED
+// flag exactly when their cluster is referenced once, and that those of the
+// snapshots do not have it when their cluster is shared
+func (c *checker) checkCopiedFlags() {
+	img := c.img
+	for _, t := range c.trees {
+		of := ""
+		if t.snapshot != "" {
+			of = " of snapshot " + t.snapshot
+		}
+		for i, e := range t.l1 {
+			l2off := int64(e & entryOffsetMask)
+			if l2off == 0 || img.invalidOffset(l2off, img.clusterSize, true) != "" {
+				continue // invalid entries are reported when counting
+			}
+			if !c.copiedMatches(e, l2off, t.snapshot != "") {
+				rc, _ := img.refcount(l2off)
+				c.add(FindingCopiedFlag, t.l1Off+int64(i)*8, "ERROR OFLAG_COPIED L2 cluster%s: l1_index=%d l1_entry=%x refcount=%d", of, i, e, rc)
+			}
+			l2, err := img.readTable(l2off, int(img.l2Entries))
+			if err != nil {
+				continue // reported when counting
+			}
+			for j, entry := range l2 {
+				host := int64(entry & entryOffsetMask)
+				if img.classify(entry) == clusterCompressed || host == 0 || img.invalidOffset(host, img.clusterSize, true) != "" {
+					continue
+				}
+				if !c.copiedMatches(entry, host, t.snapshot != "") {
+					rc, _ := img.refcount(host)
+					c.add(FindingCopiedFlag, l2off+int64(j)*8, "ERROR OFLAG_COPIED data cluster%s: l2_entry=%x refcount=%d", of, entry, rc)
+				}
+			}
+		}
+	}
+}
+
+// copiedMatches reports whether the COPIED flag of entry is set exactly when
+// the cluster at host has a refcount of one, or only then for a snapshot,
+// whose flags need not be kept up to date
+func (c *checker) copiedMatches(entry uint64, host int64, snapshot bool) bool {
+	rc, err := c.img.refcount(host)
+	if err != nil {
+		return true // reported when comparing refcounts
+	}
+	if snapshot {
+		return entry&flagCopied == 0 || rc == 1
+	}
+	return (entry&flagCopied != 0) == (rc == 1)
+}
+
+// checkChain validates the backing chain of the image into rep, level by
+// level, opening each backing file without its own backing file so that
+// what is wrong further down is a finding and not an error
+func (img *Image) checkChain(rep *CheckReport) {
+	var closers []*Image
+	defer func() {
+		for _, b := range closers {
+			b.Close()
+		}
+	}()
+	above := img
+	for level := 1; above.Header.BackingFile != ""; level++ {
+		path := above.backingPath(above.Header.BackingFile)
+		add := func(kind FindingKind, format string, args ...any) {
+			rep.add(Finding{Kind: kind, Level: level, Path: path, Message: fmt.Sprintf("backing file %d, %s: ", level, path) + fmt.Sprintf(format, args...)})
+		}
+		chain, err := above.chainTo(path)
+		if err != nil {
+			add(FindingBacking, "%v", err)
+			return
+		}
+		// a remote backing file is read from what resolves it
+		r, size, err := above.resolveBacking(path, above.Header.BackingFormat())
+		if err != nil {
+			add(FindingBacking, "%v", err)
+			return
+		}
+		var remote *readerStorage
+		var format string
+		if r != nil {
+			remote = newReaderStorage(path, r, size)
+			format = probeReader(io.NewSectionReader(r, 0, size))
+		} else if format, err = ProbeFormat(path); err != nil {
+			add(FindingBacking, "%v", err)
+			return
+		}
+		switch recorded := above.Header.BackingFormat(); recorded {
+		case format:
+		case "":
+			if above.Header.ExtensionsSkipped {
+				add(FindingNote, "format unknown, as the header extensions were skipped, probed as %s", format)
+			} else {
+				add(FindingNote, "no format recorded, probed as %s", format)
+			}
+		default:
+			add(FindingBacking, "recorded as %s, but the file is %s", recorded, format)
+		}
+		if format == "raw" {
+			if remote == nil {
+				fi, err := os.Stat(path)
+				if err != nil {
+					add(FindingBacking, "%v", err)
+					return
+				}
+				size = fi.Size()
+			} else {
+				remote.Close()
+			}
+			if size < above.Size() {
+				add(FindingBacking, "raw file of %d bytes is smaller than the %d bytes above it, it may have been truncated or recreated", size, above.Size())
+			}
+			return
+		}
+		o := img.opts
+		o.noBacking, o.chain = true, chain
+		var b *Image
+		if remote != nil {
+			if b, err = newImage(path, remote, true, o); err != nil {
+				remote.Close()
+			}
+		} else {
+			b, err = OpenFile(path, os.O_RDONLY, func(opts *options) { *opts = o })
+		}
+		if err != nil {
+			add(FindingBacking, "%v", err)
+			return
+		}
+		closers = append(closers, b)
+		if b.Size() < above.Size() {
+			add(FindingNote, "virtual size of %d bytes is smaller than the %d bytes above it, the rest reads as zeros", b.Size(), above.Size())
+		}
+		above = b
+	}
+}
+
+// ProbeFormat is "qcow2" or "raw", from the magic of the file at path, the way
+// qemu guesses the format of an image given without one
+func ProbeFormat(path string) (string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	return probeReader(fh), nil
+}
+
+// probeReader is "qcow2" or "raw", from the magic at the start of r
+func probeReader(r io.Reader) string {
+	// files too short for a header are raw too, and what else is wrong with
+	// a qcow2 header is found opening it
+	if _, err := ReadHeader(r); errors.Is(err, ErrBadMagic) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return "raw"
+	}
+	return "qcow2"
+}
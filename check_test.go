@@ -0,0 +1,1247 @@
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	img := tempImage(t)
+	rep, err := img.Check(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Clean() || len(rep.Findings) != 0 {
+		t.Fatalf("expected the qemu image to be clean, got %+v", rep)
+	}
+	if rep.TotalClusters != 1600 || rep.AllocatedClusters != 64 || rep.ImageEndOffset != 5308416 {
+		t.Errorf("unexpected statistics %+v", rep)
+	}
+
+	if err := img.CreateSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt([]byte("after the snapshot"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if rep, err := img.Check(nil); err != nil || !rep.Clean() {
+		t.Fatalf("expected the image to be clean with a snapshot, got %+v: %v", rep, err)
+	}
+}
+
+func TestCheckFindings(t *testing.T) {
+	img := tempImage(t)
+	// a cluster nothing references
+	leaked, err := img.allocClusters(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// and one referenced but free
+	entry, _, err := img.l2Entry(img.l1, img.Header.L1TableOffset, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := int64(entry & entryOffsetMask)
+	if err := img.setRefcount(host, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := img.Check(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Leaks != 1 || rep.Corruptions != 2 || rep.CheckErrors != 0 {
+		t.Errorf("expected a leak and two corruptions, got %+v", rep)
+	}
+	want := map[FindingKind]string{
+		FindingLeak:       fmt.Sprintf("Leaked cluster %d refcount=1 reference=0", leaked/img.clusterSize),
+		FindingRefcount:   fmt.Sprintf("ERROR cluster %d refcount=0 reference=1", host/img.clusterSize),
+		FindingCopiedFlag: fmt.Sprintf("ERROR OFLAG_COPIED data cluster: l2_entry=%x refcount=0", entry),
+	}
+	for _, f := range rep.Findings {
+		if f.Message != want[f.Kind] {
+			t.Errorf("%s: got %q, want %q", f.Kind, f.Message, want[f.Kind])
+		}
+		delete(want, f.Kind)
+	}
+	for kind := range want {
+		t.Errorf("no %s finding", kind)
+	}
+}
+
+func TestCheckLeakRanges(t *testing.T) {
+	img := tempImage(t)
+	leaked, err := img.allocClusters(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a refcount of 2 on the last one starts a range of its own
+	if err := img.setRefcount(leaked+2*img.clusterSize, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := img.Check(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Leaks != 3 || rep.LeakedBytes != 3*img.clusterSize || rep.Corruptions != 0 {
+		t.Errorf("expected three leaked clusters and no corruption, got %+v", rep)
+	}
+	first := leaked / img.clusterSize
+	want := []Finding{{
+		Kind:     FindingLeak,
+		Offset:   leaked,
+		Length:   2 * img.clusterSize,
+		Refcount: 1,
+		Message:  fmt.Sprintf("Leaked clusters %d-%d refcount=1 reference=0", first, first+1),
+	}, {
+		Kind:     FindingLeak,
+		Offset:   leaked + 2*img.clusterSize,
+		Length:   img.clusterSize,
+		Refcount: 2,
+		Message:  fmt.Sprintf("Leaked cluster %d refcount=2 reference=0", first+2),
+	}}
+	if !reflect.DeepEqual(rep.Findings, want) {
+		t.Errorf("got findings %+v, want %+v", rep.Findings, want)
+	}
+}
+
+func TestCheckReferrers(t *testing.T) {
+	for _, bits := range []int{4, 16, 64} {
+		t.Run(fmt.Sprint(bits), func(t *testing.T) {
+			img, err := Create(filepath.Join(t.TempDir(), "file.qcow2"), 1<<20, &CreateOptions{RefcountBits: bits})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer img.Close()
+			if _, err := img.WriteAt([]byte("referenced twice"), 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := img.CreateSnapshot("snap"); err != nil {
+				t.Fatal(err)
+			}
+			entry, _, err := img.l2Entry(img.l1, img.Header.L1TableOffset, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			host := int64(entry & entryOffsetMask)
+			if err := img.setRefcount(host, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			rep, err := img.Check(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var found []Finding
+			for _, f := range rep.Findings {
+				if f.Kind == FindingRefcount {
+					found = append(found, f)
+				}
+			}
+			if len(found) != 1 || found[0].Offset != host || found[0].Refcount != 1 || found[0].References != 2 {
+				t.Fatalf("expected a refcount error on the data cluster, got %+v", rep.Findings)
+			}
+			want := []Referrer{
+				{Structure: "data", L1Index: 0, L2Index: 0},
+				{Structure: "data", Snapshot: img.snapshots[0].ID, L1Index: 0, L2Index: 0},
+			}
+			if !reflect.DeepEqual(found[0].Referrers, want) {
+				t.Errorf("got referrers %+v, want %+v", found[0].Referrers, want)
+			}
+		})
+	}
+}
+
+func TestCheckInvalidEntries(t *testing.T) {
+	img := tempImage(t)
+	cs := img.clusterSize
+	l2off := int64(img.l1[0] & entryOffsetMask)
+	compressed := uint64(flagCompressed) | uint64(img.end-512) | 3<<(62-(img.clusterBits-8))
+	entries := []struct {
+		index int
+		entry uint64
+		why   string
+	}{
+		{10, uint64(img.end+cs) | flagCopied, "lies past the end of the file"},
+		{11, uint64(2*cs+512) | flagCopied, "is not cluster aligned"},
+		{12, 512, "lies in the header cluster"},
+		{13, compressed, "lies past the end of the file"},
+	}
+	for _, e := range entries {
+		if err := img.writeEntry(l2off+int64(e.index)*8, e.entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rep, err := img.Check(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Corruptions != len(entries) || len(rep.Findings) != len(entries) {
+		t.Fatalf("expected %d invalid entries, got %+v", len(entries), rep)
+	}
+	for i, e := range entries {
+		f := rep.Findings[i]
+		r := Referrer{Structure: "data", L1Index: 0, L2Index: e.index}
+		if f.Kind != FindingInvalidEntry || f.Offset != l2off+int64(e.index)*8 || f.Entry != e.entry || !reflect.DeepEqual(f.Referrers, []Referrer{r}) {
+			t.Errorf("L2 index %d: got %+v", e.index, f)
+		}
+		if !strings.HasSuffix(f.Message, e.why) {
+			t.Errorf("L2 index %d: got %q, want it to end with %q", e.index, f.Message, e.why)
+		}
+	}
+
+	// and reading them fails rather than returning garbage
+	buf := make([]byte, cs)
+	for _, e := range entries {
+		if _, err := img.ReadAt(buf, int64(e.index)*cs); !errors.Is(err, ErrInvalidEntry) {
+			t.Errorf("reading L2 index %d: got %v, want %v", e.index, err, ErrInvalidEntry)
+		}
+	}
+}
+
+func TestCheckRepairLeaks(t *testing.T) {
+	img := tempImage(t)
+	if _, err := img.allocClusters(3); err != nil {
+		t.Fatal(err)
+	}
+	// a corruption is left alone
+	entry, _, err := img.l2Entry(img.l1, img.Header.L1TableOffset, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := int64(entry & entryOffsetMask)
+	if err := img.setRefcount(host, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := img.Check(&CheckOptions{Repair: RepairLeaks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.LeaksFixed != 3 || rep.Leaks != 0 || rep.Corruptions != 2 {
+		t.Errorf("expected three leaks fixed and the corruptions left, got %+v", rep)
+	}
+	if rc, err := img.refcount(host); err != nil || rc != 0 {
+		t.Errorf("the refcount of the data cluster changed to %d: %v", rc, err)
+	}
+
+	// and once nothing remains, the dirty bit is cleared
+	if err := img.setRefcount(host, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.allocClusters(1); err != nil {
+		t.Fatal(err)
+	}
+	img.Header.IncompatibleFeatures |= IncompatDirty
+	if err := img.writeHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if rep, err = img.Check(&CheckOptions{Repair: RepairLeaks}); err != nil || !rep.Clean() || rep.LeaksFixed != 1 {
+		t.Fatalf("expected a clean image after fixing a leak, got %+v: %v", rep, err)
+	}
+	h, err := ReadHeader(io.NewSectionReader(img.fh, 0, img.clusterSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.IncompatibleFeatures&IncompatDirty != 0 {
+		t.Error("the dirty bit is still set")
+	}
+}
+
+func TestCheckRepairReadOnly(t *testing.T) {
+	img, err := Open(tempImage(t).name, WithNoLock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if _, err := img.Check(&CheckOptions{Repair: RepairLeaks}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("got %v, want %v", err, ErrReadOnly)
+	}
+}
+
+func TestCheckRepairAll(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// corrupt damages the image and returns the corruptions to remain
+		corrupt func(t *testing.T, img *Image) int
+	}{{
+		name: "refcount too low",
+		corrupt: func(t *testing.T, img *Image) int {
+			entry, _, err := img.l2Entry(img.l1, img.Header.L1TableOffset, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := img.setRefcount(int64(entry&entryOffsetMask), 0); err != nil {
+				t.Fatal(err)
+			}
+			return 0
+		},
+	}, {
+		name: "refcount block past the end of the file",
+		corrupt: func(t *testing.T, img *Image) int {
+			img.reftable[0] = uint64(img.end + img.clusterSize)
+			img.fh.evict(0, math.MaxInt64)
+			if err := img.writeEntry(img.Header.RefcountTableOffset, img.reftable[0]); err != nil {
+				t.Fatal(err)
+			}
+			return 0
+		},
+	}, {
+		name: "leaks and an L2 entry past the end of the file",
+		corrupt: func(t *testing.T, img *Image) int {
+			if _, err := img.allocClusters(2); err != nil {
+				t.Fatal(err)
+			}
+			l2off := int64(img.l1[0] & entryOffsetMask)
+			if err := img.writeEntry(l2off+10*8, uint64(img.end+img.clusterSize)|flagCopied); err != nil {
+				t.Fatal(err)
+			}
+			return 1
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			img := tempImage(t)
+			// up to the cluster whose entry is made invalid
+			want := make([]byte, 10*img.clusterSize)
+			if _, err := img.ReadAt(want, 0); err != nil {
+				t.Fatal(err)
+			}
+			remaining := tc.corrupt(t, img)
+			before, err := img.Check(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if before.Clean() {
+				t.Fatal("the image is clean before the repair")
+			}
+
+			rep, err := img.Check(&CheckOptions{Repair: RepairAll})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rep.Leaks != 0 || rep.CheckErrors != 0 || rep.Corruptions != remaining {
+				t.Errorf("expected %d corruptions to remain, got %+v", remaining, rep)
+			}
+			if rep.LeaksFixed+rep.CorruptionsFixed == 0 {
+				t.Errorf("nothing reported as fixed: %+v", rep)
+			}
+			got := make([]byte, len(want))
+			if _, err := img.ReadAt(got, 0); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Error("the guest data changed")
+			}
+		})
+	}
+}
+
+func TestCheckExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		rep  CheckReport
+		want int
+	}{
+		{CheckReport{}, 0},
+		{CheckReport{LeaksFixed: 3, CorruptionsFixed: 1}, 0},
+		{CheckReport{CheckErrors: 1, Corruptions: 1, Leaks: 1}, 1},
+		{CheckReport{Corruptions: 1, Leaks: 1}, 2},
+		{CheckReport{Leaks: 1, LeakedBytes: 65536}, 3},
+	} {
+		if got := tc.rep.ExitCode(); got != tc.want {
+			t.Errorf("%+v: got %d, want %d", tc.rep, got, tc.want)
+		}
+	}
+}
+
+func TestCheckReportJSON(t *testing.T) {
+	img := tempImage(t)
+	// a leak, a refcount error with a COPIED flag error, and an invalid entry
+	if _, err := img.allocClusters(1); err != nil {
+		t.Fatal(err)
+	}
+	entry, _, err := img.l2Entry(img.l1, img.Header.L1TableOffset, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.setRefcount(int64(entry&entryOffsetMask), 0); err != nil {
+		t.Fatal(err)
+	}
+	l2off := int64(img.l1[0] & entryOffsetMask)
+	if err := img.writeEntry(l2off+10*8, 512); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := img.Check(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := json.Marshal(rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back CheckReport
+	if err := json.Unmarshal(buf, &back); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&back, rep) {
+		t.Errorf("the report changed through JSON: got %+v, want %+v", back, rep)
+	}
+
+	// the names are part of the interface, so spell them out
+	var doc map[string]any
+	if err := json.Unmarshal(buf, &doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"corruptions", "leaks", "leaked-bytes", "check-errors", "leaks-fixed", "corruptions-fixed", "findings",
+		"image-end-offset", "total-clusters", "allocated-clusters", "fragmented-clusters", "compressed-clusters"} {
+		if _, ok := doc[key]; !ok {
+			t.Errorf("no %q in the report", key)
+		}
+	}
+	keys := map[FindingKind][]string{
+		FindingLeak:         {"kind", "offset", "length", "refcount", "references", "message"},
+		FindingRefcount:     {"kind", "offset", "length", "refcount", "references", "referrers", "message"},
+		FindingCopiedFlag:   {"kind", "offset", "message"},
+		FindingInvalidEntry: {"kind", "offset", "referrers", "entry", "message"},
+	}
+	referrerKeys := []string{"structure", "l1-index", "l2-index"}
+	for _, f := range doc["findings"].([]any) {
+		f := f.(map[string]any)
+		kind := FindingKind(f["kind"].(string))
+		want, ok := keys[kind]
+		if !ok {
+			continue
+		}
+		delete(keys, kind)
+		for _, key := range want {
+			if _, ok := f[key]; !ok {
+				t.Errorf("no %q in a %s finding", key, kind)
+			}
+		}
+		if refs, ok := f["referrers"].([]any); ok {
+			for _, key := range referrerKeys {
+				if _, ok := refs[0].(map[string]any)[key]; !ok {
+					t.Errorf("no %q in a referrer of a %s finding", key, kind)
+				}
+			}
+		}
+	}
+	for kind := range keys {
+		t.Errorf("no %s finding", kind)
+	}
+}
+
+// snapshottedImage makes an image of many small L2 tables, each copied by
+// the writes following each of its snapshots
+func snapshottedImage(tb testing.TB, snapshots int) *Image {
+	tb.Helper()
+	img, err := Create(filepath.Join(tb.TempDir(), "file.qcow2"), 256<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { img.Close() })
+	span := img.l2Entries * img.clusterSize
+	for s := 0; s <= snapshots; s++ {
+		if s > 0 {
+			if err := img.CreateSnapshot(fmt.Sprint("snap", s)); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		for off := int64(0); off < img.Size(); off += span {
+			if _, err := img.WriteAt([]byte{byte(s)}, off+int64(s)*img.clusterSize); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+	return img
+}
+
+func TestCheckJobs(t *testing.T) {
+	img := snapshottedImage(t, 3)
+	if _, err := img.allocClusters(2); err != nil {
+		t.Fatal(err)
+	}
+	entry, _, err := img.l2Entry(img.l1, img.Header.L1TableOffset, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.setRefcount(int64(entry&entryOffsetMask), 0); err != nil {
+		t.Fatal(err)
+	}
+	want, err := img.Check(&CheckOptions{Jobs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want.Clean() || want.FragmentedClusters == 0 {
+		t.Fatalf("expected findings and fragmentation, got %+v", want)
+	}
+	for _, jobs := range []int{2, 8} {
+		got, err := img.Check(&CheckOptions{Jobs: jobs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("jobs=%d: got %+v, want %+v", jobs, got, want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := img.CheckContext(ctx, &CheckOptions{Jobs: 4}); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestCheckWindows(t *testing.T) {
+	img := snapshottedImage(t, 2)
+	// a leak across windows, and a refcount error
+	if _, err := img.allocClusters(9); err != nil {
+		t.Fatal(err)
+	}
+	entry, _, err := img.l2Entry(img.l1, img.Header.L1TableOffset, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.setRefcount(int64(entry&entryOffsetMask), 1); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := img.Check(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Leaks != 9 || rep.Corruptions == 0 {
+		t.Fatalf("expected leaks and corruptions, got %+v", rep)
+	}
+	want, err := json.Marshal(rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, window := range []int64{1, 7, 64} {
+		rep, err := img.Check(&CheckOptions{Window: window})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := json.Marshal(rep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("window of %d clusters: got %s, want %s", window, got, want)
+		}
+	}
+}
+
+// snapshotFindings returns the findings of rep about the snapshot table
+func snapshotFindings(rep *CheckReport) []Finding {
+	var findings []Finding
+	for _, f := range rep.Findings {
+		if f.Kind == FindingSnapshot {
+			findings = append(findings, f)
+		}
+	}
+	return findings
+}
+
+func TestCheckOverlaps(t *testing.T) {
+	img := tempImage(t)
+	l1 := img.Header.L1TableOffset
+	l2off := int64(img.l1[0] & entryOffsetMask)
+	if err := img.writeEntry(l2off+5*8, uint64(l1)|flagCopied); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := img.Check(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var overlaps []Finding
+	for _, f := range rep.Findings {
+		if f.Kind == FindingOverlap {
+			overlaps = append(overlaps, f)
+		}
+	}
+	want := []Referrer{
+		{Structure: "l1-table", L1Index: -1, L2Index: -1},
+		{Structure: "data", L1Index: 0, L2Index: 5},
+	}
+	if len(overlaps) != 1 || overlaps[0].Offset != l1 || !reflect.DeepEqual(overlaps[0].Referrers, want) {
+		t.Fatalf("expected the L1 table to overlap data, got %+v", rep.Findings)
+	}
+	cluster := l1 / img.clusterSize
+	if msg := fmt.Sprintf("ERROR cluster %d is claimed by the l1-table and the data at L1 index 0, L2 index 5", cluster); overlaps[0].Message != msg {
+		t.Errorf("got %q, want %q", overlaps[0].Message, msg)
+	}
+	if !rep.MarkCorrupt || rep.Corruptions == 0 {
+		t.Errorf("expected a corruption and the corrupt bit recommended, got %+v", rep)
+	}
+
+	// repairing only marks the image corrupt
+	rep, err = img.Check(&CheckOptions{Repair: RepairAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.CorruptionsFixed != 0 || img.Header.IncompatibleFeatures&IncompatCorrupt == 0 {
+		t.Errorf("expected the image marked corrupt and not repaired, got %+v", rep)
+	}
+	if entry, _, err := img.l2Entry(img.l1, img.Header.L1TableOffset, 5*img.clusterSize); err != nil || int64(entry&entryOffsetMask) != l1 {
+		t.Errorf("the overlapping entry changed: %#x, %v", entry, err)
+	}
+}
+
+// chainFindings returns the findings of rep about the backing chain
+func chainFindings(rep *CheckReport) []Finding {
+	var findings []Finding
+	for _, f := range rep.Findings {
+		if f.Kind == FindingBacking || f.Kind == FindingNote {
+			findings = append(findings, f)
+		}
+	}
+	return findings
+}
+
+func TestCheckChain(t *testing.T) {
+	const size = 1 << 20
+	for _, tc := range []struct {
+		name string
+		// damage is done to the chain of top.qcow2 on mid.qcow2 on
+		// base.raw, in dir
+		damage func(t *testing.T, dir string)
+		kind   FindingKind
+		level  int
+		path   string
+		want   string
+	}{
+		{"clean", func(*testing.T, string) {}, "", 0, "", ""},
+		{"missing", func(t *testing.T, dir string) {
+			if err := os.Remove(filepath.Join(dir, "base.raw")); err != nil {
+				t.Fatal(err)
+			}
+		}, FindingBacking, 2, "base.raw", "no such file or directory"},
+		{"truncated raw", func(t *testing.T, dir string) {
+			if err := os.Truncate(filepath.Join(dir, "base.raw"), size/2); err != nil {
+				t.Fatal(err)
+			}
+		}, FindingBacking, 2, "base.raw", "raw file of 524288 bytes is smaller than the 1048576 bytes above it, it may have been truncated or recreated"},
+		{"recreated as qcow2", func(t *testing.T, dir string) {
+			img, err := Create(filepath.Join(dir, "base.raw"), size, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img.Close()
+		}, FindingBacking, 2, "base.raw", "recorded as raw, but the file is qcow2"},
+		{"smaller qcow2", func(t *testing.T, dir string) {
+			mid, err := Create(filepath.Join(dir, "mid.qcow2"), size/2, &CreateOptions{BackingFile: "base.raw", BackingFormat: "raw"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			mid.Close()
+		}, FindingNote, 1, "mid.qcow2", "virtual size of 524288 bytes is smaller than the 1048576 bytes above it, the rest reads as zeros"},
+		{"no format", func(t *testing.T, dir string) {
+			mid, err := OpenFile(filepath.Join(dir, "mid.qcow2"), os.O_RDWR, WithNoBacking())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mid.Close()
+			if err := mid.SetBackingFile("base.raw", ""); err != nil {
+				t.Fatal(err)
+			}
+		}, FindingNote, 2, "base.raw", "no format recorded, probed as raw"},
+		{"loop", func(t *testing.T, dir string) {
+			mid, err := OpenFile(filepath.Join(dir, "mid.qcow2"), os.O_RDWR)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mid.Close()
+			// the loop is stored, but refused when opening it
+			if err := mid.SetBackingFile("top.qcow2", "qcow2"); !errors.Is(err, ErrBackingLoop) {
+				t.Fatalf("got %v, want %v", err, ErrBackingLoop)
+			}
+		}, FindingBacking, 2, "top.qcow2", ErrBackingLoop.Error()},
+	} {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "base.raw"), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, img := range []struct{ name, backing, format string }{
+			{"mid.qcow2", "base.raw", "raw"},
+			{"top.qcow2", "mid.qcow2", "qcow2"},
+		} {
+			img, err := Create(filepath.Join(dir, img.name), size, &CreateOptions{BackingFile: img.backing, BackingFormat: img.format})
+			if err != nil {
+				t.Fatal(err)
+			}
+			img.Close()
+		}
+		tc.damage(t, dir)
+
+		top, err := Open(filepath.Join(dir, "top.qcow2"), WithNoBacking())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rep, err := top.Check(&CheckOptions{Chain: true})
+		top.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		findings := chainFindings(rep)
+		if tc.kind == "" {
+			if len(rep.Findings) != 0 {
+				t.Errorf("%s: got %+v", tc.name, rep.Findings)
+			}
+			continue
+		}
+		if len(findings) != 1 {
+			t.Errorf("%s: got %+v", tc.name, rep.Findings)
+			continue
+		}
+		f, path := findings[0], filepath.Join(dir, tc.path)
+		if f.Kind != tc.kind || f.Level != tc.level || f.Path != path || !strings.HasSuffix(f.Message, tc.want) {
+			t.Errorf("%s: got %+v, want a %s at level %d of %s ending with %q", tc.name, f, tc.kind, tc.level, path, tc.want)
+		}
+		if clean := tc.kind == FindingNote; rep.Clean() != clean {
+			t.Errorf("%s: got a report clean %v, want %v", tc.name, rep.Clean(), clean)
+		}
+	}
+}
+
+func TestCheckTrailingData(t *testing.T) {
+	img := tempImage(t)
+	// clusters leaked at the end are accounted for by their refcounts
+	leaked, err := img.allocClusters(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := leaked + 2*img.clusterSize
+	fh, err := os.OpenFile(img.name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	if _, err := fh.WriteAt(bytes.Repeat([]byte("payload"), 1000), end); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := img.Check(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trailing []Finding
+	for _, f := range rep.Findings {
+		if f.Kind == FindingTrailingData {
+			trailing = append(trailing, f)
+		}
+	}
+	if len(trailing) != 1 || trailing[0].Offset != end || trailing[0].Length != 7000 {
+		t.Fatalf("expected 7000 bytes of trailing data at %#x, got %+v", end, rep.Findings)
+	}
+	if rep.Leaks != 2 || rep.Corruptions != 0 {
+		t.Errorf("expected only the leaks counted, got %+v", rep)
+	}
+
+	reclaimed, err := img.TruncateTrailing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed != 7000 {
+		t.Errorf("reclaimed %d bytes, want 7000", reclaimed)
+	}
+	if rep, err := img.Check(nil); err != nil || len(rep.Findings) != 1 || rep.Findings[0].Kind != FindingLeak {
+		t.Errorf("expected the leaks alone, got %+v, %v", rep, err)
+	}
+}
+
+// compressedImage creates an image of n compressed clusters of 4 KiB, and
+// returns it with the host offset of the data of each
+func compressedImage(t *testing.T, n int) (*Image, []int64) {
+	t.Helper()
+	img, err := Create(filepath.Join(t.TempDir(), "file.qcow2"), int64(n)*4096, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { img.Close() })
+	offsets := make([]int64, n)
+	for i := range offsets {
+		// of 16 letters, which compress to about half of the cluster
+		p := make([]byte, 4096)
+		for j := range p {
+			p[j] = 'a' + byte((i*4096+j)*7919%65521%16)
+		}
+		if _, err := img.WriteCompressedAt(p, int64(i)*4096); err != nil {
+			t.Fatal(err)
+		}
+		entry, _, err := img.l2Entry(img.l1, img.Header.L1TableOffset, int64(i)*4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.classify(entry) != clusterCompressed {
+			t.Fatalf("cluster %d is not compressed", i)
+		}
+		offsets[i], _ = img.compressedRange(entry)
+	}
+	return img, offsets
+}
+
+func TestCheckCompressed(t *testing.T) {
+	img, _ := compressedImage(t, 32)
+	l2off := int64(img.l1[0] & entryOffsetMask)
+	entry, err := img.readEntry(l2off + 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.writeEntry(l2off+8, entry|flagCopied); err != nil {
+		t.Fatal(err)
+	}
+	// all the sectors the entry can count
+	x := 62 - (img.clusterBits - 8)
+	if err := img.writeEntry(l2off+16, entry|(1<<62-1)&^(1<<x-1)); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := img.Check(&CheckOptions{Deep: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var findings []Finding
+	for _, f := range rep.Findings {
+		if f.Kind == FindingCompressed {
+			findings = append(findings, f)
+		}
+	}
+	if len(findings) != 2 {
+		t.Fatalf("expected 2 compressed cluster findings, got %+v", rep.Findings)
+	}
+	for i, want := range []string{"has the COPIED flag set", "16 sectors are more than a cluster compresses to"} {
+		f := findings[i]
+		if f.GuestOffset != int64(i+1)*4096 || !strings.HasSuffix(f.Message, want) {
+			t.Errorf("got %+v, want guest offset %#x and a message ending with %q", f, (i+1)*4096, want)
+		}
+	}
+}
+
+func TestCheckCompressedTruncated(t *testing.T) {
+	img, offsets := compressedImage(t, 32)
+	name := img.name
+	img.Close()
+	// cut into the data of the cluster written 24th, which is packed after
+	// the others before it
+	const cut = 24
+	if err := os.Truncate(name, offsets[cut]+10); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Open(name, WithNoLock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	for _, deep := range []bool{false, true} {
+		rep, err := img.Check(&CheckOptions{Deep: deep})
+		if err != nil {
+			t.Fatal(err)
+		}
+		affected := map[int64]bool{}
+		for _, f := range rep.Findings {
+			switch f.Kind {
+			case FindingInvalidEntry:
+				r := f.Referrers[0]
+				affected[(int64(r.L1Index)*img.l2Entries+int64(r.L2Index))*img.clusterSize] = true
+			case FindingCompressed:
+				affected[f.GuestOffset] = true
+			}
+		}
+		// without decompressing, only the data past the end of the last
+		// cluster of the file is found to be missing
+		for i, off := range offsets {
+			guest := int64(i) * 4096
+			want := i >= cut
+			if !deep {
+				want = off >= img.end
+			}
+			if affected[guest] != want {
+				t.Errorf("deep %v: guest cluster %d at %#x: got affected %v, want %v", deep, i, off, affected[guest], want)
+			}
+		}
+	}
+}
+
+func TestCheckSnapshots(t *testing.T) {
+	img := snapshottedImage(t, 2)
+	rep, err := img.Check(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Clean() {
+		t.Fatalf("expected a clean image, got %+v", rep)
+	}
+
+	// the L1 size of the first snapshot, hand-corrupted in the file
+	name, off := img.name, img.Header.SnapshotsOffset
+	fh, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	for _, tc := range []struct {
+		l1Size uint32
+		want   string
+	}{
+		{1 << 30, "snapshot 1 (snap1): L1 table of 1073741824 entries is larger than the maximum of 4194304"},
+		{1 << 20, "lies past the end of the file"},
+		{0, "snapshot 1 (snap1): L1 table of 0 entries is too small for a disk of 268435456 bytes"},
+	} {
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], tc.l1Size)
+		if _, err := fh.WriteAt(buf[:], off+8); err != nil {
+			t.Fatal(err)
+		}
+		corrupt, err := Open(name, WithNoLock())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rep, err := corrupt.Check(nil)
+		corrupt.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		findings := snapshotFindings(rep)
+		if len(findings) != 1 || !strings.HasSuffix(findings[0].Message, tc.want) || rep.Corruptions == 0 {
+			t.Errorf("L1 size %d: got %+v, want a finding ending with %q", tc.l1Size, rep.Findings, tc.want)
+			continue
+		}
+		r := Referrer{Structure: "snapshot-table", Snapshot: "1", L1Index: -1, L2Index: -1}
+		if f := findings[0]; f.Offset != off || !reflect.DeepEqual(f.Referrers, []Referrer{r}) {
+			t.Errorf("L1 size %d: got %+v", tc.l1Size, f)
+		}
+	}
+}
+
+func TestCheckSnapshotIDs(t *testing.T) {
+	img := snapshottedImage(t, 2)
+	snaps := img.Snapshots()
+	snaps[1].ID = snaps[0].ID
+	if err := img.writeSnapshots(snaps); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := img.Check(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	findings := snapshotFindings(rep)
+	if len(findings) != 1 || findings[0].Message != "ERROR snapshot 1 (snap2): another snapshot has the same ID" {
+		t.Fatalf("expected a duplicate ID, got %+v", rep.Findings)
+	}
+	// the second entry is found after the first one
+	if want := img.Header.SnapshotsOffset + int64(len(marshalSnapshots(snaps[:1]))); findings[0].Offset != want {
+		t.Errorf("got offset %#x, want %#x", findings[0].Offset, want)
+	}
+}
+
+func TestCheckOrphanedSnapshot(t *testing.T) {
+	img := snapshottedImage(t, 2)
+	snaps := img.Snapshots()
+	l1 := snaps[1].L1TableOffset
+	// dropping the entry without freeing its tables leaks them
+	if err := img.writeSnapshots(snaps[:1]); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := img.Check(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Leaks == 0 || rep.Corruptions != 0 {
+		t.Fatalf("expected leaks only, got %+v", rep)
+	}
+	var orphans []Finding
+	for _, f := range rep.Findings {
+		if f.Orphan == "snapshot-l1-table" {
+			orphans = append(orphans, f)
+		}
+	}
+	if len(orphans) != 1 || orphans[0].Offset != l1 || orphans[0].Length != img.clusterSize {
+		t.Fatalf("expected the L1 table at %#x orphaned, got %+v", l1, rep.Findings)
+	}
+	if !strings.HasSuffix(orphans[0].Message, " (orphaned snapshot L1 table)") {
+		t.Errorf("got %q", orphans[0].Message)
+	}
+	// the clusters it shared are the active state's alone again, which
+	// needs their COPIED flags set too
+	if _, err := img.Check(&CheckOptions{Repair: RepairAll}); err != nil {
+		t.Fatal(err)
+	}
+	if rep, err := img.Check(nil); err != nil || !rep.Clean() {
+		t.Errorf("after repairing: got %+v, %v", rep, err)
+	}
+}
+
+func TestCheckDamagedSnapshotTable(t *testing.T) {
+	img := snapshottedImage(t, 2)
+	name := img.name
+	// a third snapshot past the end of the table
+	h := img.Header
+	h.NbSnapshots++
+	hdr, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	if _, err := fh.WriteAt(hdr[:V2HeaderSize], 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := fh.Truncate(h.SnapshotsOffset + img.snapTableSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(name, WithNoLock()); err == nil {
+		t.Fatal("opened an image with a damaged snapshot table")
+	}
+	if _, err := OpenFile(name, os.O_RDWR, WithNoLock(), WithDamagedSnapshots()); err == nil {
+		t.Fatal("opened an image with a damaged snapshot table for writing")
+	}
+	damaged, err := Open(name, WithNoLock(), WithDamagedSnapshots())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer damaged.Close()
+	if n := len(damaged.Snapshots()); n != 2 {
+		t.Errorf("got %d snapshots, want the 2 readable", n)
+	}
+	rep, err := damaged.Check(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	findings := snapshotFindings(rep)
+	if len(findings) != 1 || !strings.HasPrefix(findings[0].Message, "ERROR snapshot table: only 2 of the 3 snapshots could be read") {
+		t.Errorf("got %+v", rep.Findings)
+	}
+}
+
+func BenchmarkCheck(b *testing.B) {
+	img := snapshottedImage(b, 16)
+	for _, jobs := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if rep, err := img.Check(&CheckOptions{Jobs: jobs}); err != nil || !rep.Clean() {
+					b.Fatalf("%+v: %v", rep, err)
+				}
+			}
+		})
+	}
+}
+
+// addBitmaps stores a bitmap directory holding bitmaps in img, with the
+// extension and autoclear bit as qemu writes them. The table of each bitmap
+// with a zero offset is allocated, and its first entry is a data cluster.
+func addBitmaps(t testing.TB, img *Image, bitmaps []bitmap) bitmapsExt {
+	t.Helper()
+	var dir []byte
+	for _, b := range bitmaps {
+		if b.tableOffset == 0 {
+			table, err := img.allocClusters(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := img.allocClusters(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := img.fh.WriteAt(binary.BigEndian.AppendUint64(nil, uint64(data)), table); err != nil {
+				t.Fatal(err)
+			}
+			b.tableOffset = table
+		}
+		e := make([]byte, bitmapHeaderSize, b.entrySize())
+		binary.BigEndian.PutUint64(e[0:], uint64(b.tableOffset))
+		binary.BigEndian.PutUint32(e[8:], uint32(b.tableSize))
+		binary.BigEndian.PutUint32(e[12:], b.flags)
+		e[16], e[17] = b.typ, byte(b.granularityBits)
+		binary.BigEndian.PutUint16(e[18:], uint16(len(b.name)))
+		binary.BigEndian.PutUint32(e[20:], uint32(len(b.extraData)))
+		e = append(append(e, b.extraData...), b.name...)
+		dir = append(dir, e[:cap(e)]...)
+	}
+	off, err := img.allocClusters(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.fh.WriteAt(dir, off); err != nil {
+		t.Fatal(err)
+	}
+	ext := bitmapsExt{nbBitmaps: len(bitmaps), dirSize: int64(len(dir)), dirOffset: off}
+	data := make([]byte, bitmapExtSize)
+	binary.BigEndian.PutUint32(data[0:], uint32(ext.nbBitmaps))
+	binary.BigEndian.PutUint64(data[8:], uint64(ext.dirSize))
+	binary.BigEndian.PutUint64(data[16:], uint64(ext.dirOffset))
+	if err := img.AddExtension(HdrExtBitmaps, data); err != nil {
+		t.Fatal(err)
+	}
+	img.Header.AutoclearFeatures |= AutoclearBitmaps
+	if err := img.writeHeader(); err != nil {
+		t.Fatal(err)
+	}
+	return ext
+}
+
+func TestCheckBitmaps(t *testing.T) {
+	// a bitmap of 64 KiB granularity of a 1 MiB disk takes 2 bytes, in a
+	// table of 1 cluster
+	good := bitmap{name: "b0", tableSize: 1, typ: bitmapTypeDirty, granularityBits: 16, flags: bitmapAuto}
+	for _, tc := range []struct {
+		name   string
+		change func(t *testing.T, img *Image, bitmaps []bitmap)
+		kind   FindingKind
+		want   string // in the message
+	}{
+		{"clean", nil, "", ""},
+		{"in use", func(t *testing.T, img *Image, bitmaps []bitmap) {
+			// as left by qemu when it is killed while writing to the disk
+			bitmaps[0].flags |= bitmapInUse
+			addBitmaps(t, img, bitmaps)
+		}, FindingBitmap, `bitmap "b0" is in use`},
+		{"granularity", func(t *testing.T, img *Image, bitmaps []bitmap) {
+			bitmaps[1].granularityBits = 40
+			addBitmaps(t, img, bitmaps)
+		}, FindingBitmap, `bitmap "b1": granularity of 2^40 bytes`},
+		{"table size", func(t *testing.T, img *Image, bitmaps []bitmap) {
+			bitmaps[0].tableSize = 2
+			addBitmaps(t, img, bitmaps)
+		}, FindingBitmap, `bitmap "b0": table of 2 entries, where a disk of 1048576 bytes needs 1`},
+		{"same name", func(t *testing.T, img *Image, bitmaps []bitmap) {
+			bitmaps[1].name = "b0"
+			addBitmaps(t, img, bitmaps)
+		}, FindingBitmap, "another bitmap has the same name"},
+		{"table out of bounds", func(t *testing.T, img *Image, bitmaps []bitmap) {
+			bitmaps[1].tableOffset = 1 << 40
+			addBitmaps(t, img, bitmaps)
+		}, FindingBitmap, `bitmap "b1": table at 0x10000000000 lies past the end of the file`},
+		{"entry out of bounds", func(t *testing.T, img *Image, bitmaps []bitmap) {
+			ext := addBitmaps(t, img, bitmaps)
+			got, err := img.readBitmaps(ext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := img.fh.WriteAt(binary.BigEndian.AppendUint64(nil, 1<<40), got[1].tableOffset); err != nil {
+				t.Fatal(err)
+			}
+		}, FindingInvalidEntry, `bitmap-data at bitmap table index 0 of bitmap "b1": entry 0x10000000000: offset 0x10000000000 lies past the end of the file`},
+		{"entry reserved bits", func(t *testing.T, img *Image, bitmaps []bitmap) {
+			ext := addBitmaps(t, img, bitmaps)
+			got, err := img.readBitmaps(ext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			table, err := img.readTable(got[0].tableOffset, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := img.fh.WriteAt(binary.BigEndian.AppendUint64(nil, table[0]|1), got[0].tableOffset); err != nil {
+				t.Fatal(err)
+			}
+		}, FindingBitmap, "has reserved bits set"},
+		{"directory size", func(t *testing.T, img *Image, bitmaps []bitmap) {
+			ext := addBitmaps(t, img, bitmaps)
+			data := make([]byte, bitmapExtSize)
+			binary.BigEndian.PutUint32(data[0:], 1)
+			binary.BigEndian.PutUint64(data[8:], uint64(ext.dirSize))
+			binary.BigEndian.PutUint64(data[16:], uint64(ext.dirOffset))
+			if err := img.AddExtension(HdrExtBitmaps, data); err != nil {
+				t.Fatal(err)
+			}
+		}, FindingBitmap, "bitmap directory of 64 bytes, where its 1 bitmaps take 32"},
+		{"negative directory size", func(t *testing.T, img *Image, bitmaps []bitmap) {
+			ext := addBitmaps(t, img, bitmaps)
+			data := make([]byte, bitmapExtSize)
+			binary.BigEndian.PutUint32(data[0:], uint32(ext.nbBitmaps))
+			binary.BigEndian.PutUint64(data[8:], 1<<63)
+			binary.BigEndian.PutUint64(data[16:], uint64(ext.dirOffset))
+			if err := img.AddExtension(HdrExtBitmaps, data); err != nil {
+				t.Fatal(err)
+			}
+		}, FindingBitmap, "invalid bitmap directory size"},
+		{"refcount missing", func(t *testing.T, img *Image, bitmaps []bitmap) {
+			ext := addBitmaps(t, img, bitmaps)
+			got, err := img.readBitmaps(ext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			table, err := img.readTable(got[1].tableOffset, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := img.setRefcount(int64(table[0]&entryOffsetMask), 0); err != nil {
+				t.Fatal(err)
+			}
+		}, FindingRefcount, "refcount=0 reference=1"},
+		{"autoclear clear", func(t *testing.T, img *Image, bitmaps []bitmap) {
+			addBitmaps(t, img, bitmaps)
+			img.Header.AutoclearFeatures &^= AutoclearBitmaps
+			if err := img.writeHeader(); err != nil {
+				t.Fatal(err)
+			}
+		}, FindingBitmap, "the bitmaps autoclear bit is clear"},
+		{"autoclear without extension", func(t *testing.T, img *Image, bitmaps []bitmap) {
+			img.Header.AutoclearFeatures |= AutoclearBitmaps
+			if err := img.writeHeader(); err != nil {
+				t.Fatal(err)
+			}
+		}, FindingBitmap, "there is no bitmaps extension"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			img, err := Create(filepath.Join(t.TempDir(), "file.qcow2"), 1<<20, &CreateOptions{ClusterSize: 4096})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer img.Close()
+			if _, err := img.WriteAt([]byte("data"), 0); err != nil {
+				t.Fatal(err)
+			}
+			b1 := good
+			b1.name = "b1"
+			bitmaps := []bitmap{good, b1}
+			if tc.change == nil {
+				addBitmaps(t, img, bitmaps)
+			} else {
+				tc.change(t, img, bitmaps)
+			}
+			img = reopen(t, img)
+
+			rep, err := img.Check(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.kind == "" {
+				// the bitmap clusters are referenced, not leaked
+				if len(rep.Findings) != 0 {
+					t.Fatalf("expected no findings, got %+v", rep.Findings)
+				}
+				return
+			}
+			var found bool
+			for _, f := range rep.Findings {
+				if f.Kind == tc.kind && strings.Contains(f.Message, tc.want) {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("expected a %s finding with %q, got %+v", tc.kind, tc.want, rep.Findings)
+			}
+			if rep.Corruptions == 0 {
+				t.Error("expected the finding counted as a corruption")
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package qcow2
+
+import (
+	"context"
+	"hash"
+	"sync"
+)
+
+// ChecksumOptions are the parameters of ChecksumWithOptions
+type ChecksumOptions struct {
+	// Progress is told how many bytes of the virtual size have been hashed
+	Progress ProgressFunc
+	// Jobs is the number of chunks of the disk read ahead of the hash in
+	// parallel, all CPUs when zero. The checksum does not depend on it.
+	Jobs int
+}
+
+// Checksum feeds the guest visible contents of the image, as WriteRawTo
+// writes them, to h and returns the digest. Images with the same contents
+// have the same checksum however their clusters are allocated. Zero and
+// unallocated ranges are hashed from a reused block of zeros, without
+// reading them. progress, which may be nil, is told how many bytes of the
+// virtual size have been hashed.
+func (img *Image) Checksum(ctx context.Context, h hash.Hash, progress ProgressFunc) ([]byte, error) {
+	return img.ChecksumWithOptions(ctx, h, &ChecksumOptions{Progress: progress})
+}
+
+// ChecksumWithOptions is Checksum with the parameters of opts, which may be
+// nil. The contents are still hashed in order, by the calling goroutine, while
+// the jobs read and decompress the chunks after the one being hashed.
+func (img *Image) ChecksumWithOptions(ctx context.Context, h hash.Hash, opts *ChecksumOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &ChecksumOptions{}
+	}
+	prog := newProgress(opts.Progress, img.Size())
+	zero := make([]byte, convertChunk)
+	bufs := sync.Pool{New: func() any {
+		b := make([]byte, convertChunk)
+		return &b
+	}}
+	// a chunk read into buf, which goes back to bufs once hashed
+	type chunk struct {
+		p   []byte
+		buf *[]byte
+	}
+	err := runOrdered(ctx, workers(opts.Jobs), img.rawJobs(),
+		func(_ context.Context, r convertRange) (chunk, error) {
+			if r.zero {
+				return chunk{p: zero[:r.n]}, nil
+			}
+			buf := bufs.Get().(*[]byte)
+			p := (*buf)[:r.n]
+			if _, err := img.ReadAt(p, r.off); err != nil {
+				bufs.Put(buf)
+				return chunk{}, err
+			}
+			return chunk{p, buf}, nil
+		},
+		func(c chunk) error {
+			h.Write(c.p)
+			prog.add(int64(len(c.p)))
+			if c.buf != nil {
+				bufs.Put(c.buf)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	prog.finish()
+	return h.Sum(nil), nil
+}
+
+// rawJobs splits the guest disk into chunks of up to convertChunk bytes,
+// those that read as zeros marked zero, in order
+func (img *Image) rawJobs() func() (convertRange, bool, error) {
+	next := img.extentsIn(0, img.Size())
+	return chunkJobs(func() (convertRange, bool, error) {
+		e, ok, err := next()
+		return convertRange{off: e.Start, n: e.Length, zero: e.ReadsAsZeros()}, ok, err
+	}, convertChunk)
+}
@@ -0,0 +1,102 @@
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("checksum"), 8192)
+	want := make([]byte, 1<<20)
+	copy(want[128<<10:], data)
+
+	// the same contents, allocated differently
+	a, err := Create(filepath.Join(dir, "a.qcow2"), int64(len(want)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if _, err := a.WriteAt(data, 128<<10); err != nil {
+		t.Fatal(err)
+	}
+	b, err := Create(filepath.Join(dir, "b.qcow2"), int64(len(want)), &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for off := int64(0); off < int64(len(data)); off += 4096 {
+		if _, err := b.WriteCompressedAt(data[off:off+4096], 128<<10+off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.WriteAt(make([]byte, 8192), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	wantSum := sha256.Sum256(want)
+	for _, img := range []*Image{a, b} {
+		for _, jobs := range []int{0, 1, 2, 8} {
+			var last int64
+			sum, err := img.ChecksumWithOptions(context.Background(), sha256.New(), &ChecksumOptions{Progress: func(done, total int64) { last = done }, Jobs: jobs})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(sum, wantSum[:]) {
+				t.Errorf("%s, %d jobs: got %x, want %x", img.Name(), jobs, sum, wantSum)
+			}
+			if last != img.Size() {
+				t.Errorf("%s, %d jobs: progress ended at %d of %d", img.Name(), jobs, last, img.Size())
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := a.Checksum(ctx, sha256.New(), nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the checksum to be canceled, got %v", err)
+	}
+	if _, err := a.ChecksumWithOptions(ctx, sha256.New(), &ChecksumOptions{Jobs: 4}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the parallel checksum to be canceled, got %v", err)
+	}
+}
+
+// packedImage is an image of 16 MiB of data with every cluster compressed,
+// so that reading it is work
+func packedImage(b *testing.B) *Image {
+	b.Helper()
+	// of 16 letters, which compress to about half
+	data := make([]byte, 16<<20)
+	for i := range data {
+		data[i] = 'a' + byte(i*7919%65521%16)
+	}
+	name := filepath.Join(b.TempDir(), "packed.qcow2")
+	if err := ConvertRawToQcow2(bytes.NewReader(data), int64(len(data)), name, &ConvertOptions{Compress: true}); err != nil {
+		b.Fatal(err)
+	}
+	img, err := Open(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { img.Close() })
+	return img
+}
+
+func BenchmarkChecksumCompressed(b *testing.B) {
+	img := packedImage(b)
+	for _, jobs := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			b.SetBytes(img.Size())
+			for i := 0; i < b.N; i++ {
+				if _, err := img.ChecksumWithOptions(context.Background(), sha256.New(), &ChecksumOptions{Jobs: jobs}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
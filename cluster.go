@@ -0,0 +1,609 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// offset bits of L1 and L2 table entries
+	entryOffsetMask = 0x00fffffffffffe00
+
+	// flagCopied marks an entry whose cluster has a refcount of exactly one
+	flagCopied = 1 << 63
+	// flagCompressed marks an L2 entry as a compressed cluster descriptor
+	flagCompressed = 1 << 62
+	// flagZero marks an L2 entry whose cluster reads as all zeros (v3)
+	flagZero = 1 << 0
+)
+
+// ErrInvalidEntry is an L1, L2 or refcount table entry whose offset can not
+// be that of a cluster of the image. The CorruptionError of such an entry
+// matches it with errors.Is.
+var ErrInvalidEntry = errors.New("qcow2: invalid table entry")
+
+// Structure is a metadata structure of an image, named as in Referrer
+type Structure int
+
+const (
+	StructHeader Structure = iota
+	StructExtension
+	StructL1Table
+	StructL2Table
+	StructRefcountTable
+	StructRefcountBlock
+	StructSnapshotTable
+	StructBitmapDirectory
+)
+
+var structureNames = []string{"header", "header-extension", "l1-table", "l2-table", "refcount-table", "refcount-block", "snapshot-table", "bitmap-directory"}
+
+func (s Structure) String() string {
+	if s < 0 || int(s) >= len(structureNames) {
+		return fmt.Sprintf("structure %d", int(s))
+	}
+	return structureNames[s]
+}
+
+// CorruptionError is metadata of an image that can not be right, found while
+// parsing or walking it
+type CorruptionError struct {
+	// Offset is the host offset of the bad bytes, those of the field or
+	// table entry holding Value
+	Offset    int64
+	Structure Structure
+	// Index is the entry within the structure: the table entry, extension,
+	// snapshot or bitmap, or -1 for the header
+	Index int64
+	// Value is the offending value
+	Value  uint64
+	Reason string
+}
+
+func (e CorruptionError) Error() string {
+	s := fmt.Sprintf("qcow2: corrupt %s at %#x", e.Structure, e.Offset)
+	if e.Index >= 0 {
+		s += fmt.Sprintf(", index %d", e.Index)
+	}
+	return s + fmt.Sprintf(", value %#x: %s", e.Value, e.Reason)
+}
+
+// Is matches the entries of the L1, L2 and refcount tables to
+// ErrInvalidEntry
+func (e CorruptionError) Is(target error) bool {
+	switch e.Structure {
+	case StructL1Table, StructL2Table, StructRefcountTable:
+		return target == ErrInvalidEntry
+	}
+	return false
+}
+
+// invalidEntry is a CorruptionError of the entry at index of the table of
+// structure s at tableOff
+func invalidEntry(s Structure, tableOff, index int64, entry uint64, format string, args ...any) error {
+	return CorruptionError{Offset: tableOff + index*8, Structure: s, Index: index, Value: entry, Reason: fmt.Sprintf(format, args...)}
+}
+
+// headerField is a CorruptionError of the header field at off
+func headerField(off int64, value uint64, format string, args ...any) error {
+	return CorruptionError{Offset: off, Structure: StructHeader, Index: -1, Value: value, Reason: fmt.Sprintf(format, args...)}
+}
+
+type clusterKind int
+
+const (
+	clusterUnallocated clusterKind = iota
+	clusterZero
+	clusterNormal
+	clusterCompressed
+)
+
+func (k clusterKind) String() string {
+	return [...]string{"unallocated", "zero", "data", "compressed"}[k]
+}
+
+func (img *Image) alignUp(off int64) int64 {
+	return (off + img.clusterSize - 1) &^ (img.clusterSize - 1)
+}
+
+// invalidOffset says why [off, off+size) can not be data of the image, or
+// is empty when it can: that is when it lies after the header cluster,
+// starts a cluster if aligned is set, and ends before the end of the file
+func (img *Image) invalidOffset(off, size int64, aligned bool) string {
+	switch {
+	case off < img.clusterSize:
+		return "lies in the header cluster"
+	case aligned && off&(img.clusterSize-1) != 0:
+		return "is not cluster aligned"
+	case off+size > img.end:
+		return "lies past the end of the file"
+	}
+	return ""
+}
+
+// readTable reads n big-endian 64 bit entries at off
+func (img *Image) readTable(off int64, n int) ([]uint64, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	if off <= 0 || off&(img.clusterSize-1) != 0 {
+		return nil, fmt.Errorf("qcow2: table offset %#x is not cluster aligned", off)
+	}
+	// the file bounds the size of the tables, which must not be taken on
+	// trust from the metadata
+	if n < 0 || int64(n) > (img.end-off)/8 {
+		return nil, fmt.Errorf("qcow2: table of %d entries at %#x lies past the end of the file", n, off)
+	}
+	buf := make([]byte, n*8)
+	if _, err := img.fh.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	t := make([]uint64, n)
+	for i := range t {
+		t[i] = binary.BigEndian.Uint64(buf[i*8:])
+	}
+	return t, nil
+}
+
+// writeTable stores the entries of t at off
+func (img *Image) writeTable(t []uint64, off int64) error {
+	buf := make([]byte, len(t)*8)
+	for i, e := range t {
+		binary.BigEndian.PutUint64(buf[i*8:], e)
+	}
+	_, err := img.fh.WriteAt(buf, off)
+	return err
+}
+
+func (img *Image) writeEntry(off int64, e uint64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], e)
+	_, err := img.fh.WriteAt(buf[:], off)
+	return err
+}
+
+func (img *Image) readEntry(off int64) (uint64, error) {
+	var buf [8]byte
+	if _, err := img.fh.ReadAt(buf[:], off); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+// l2Entry looks up the L2 entry for the guest offset off through the L1 table
+// l1 stored at l1Off. The host offset of the entry itself is returned, or zero
+// when there is no L2 table for off.
+func (img *Image) l2Entry(l1 []uint64, l1Off, off int64) (entry uint64, entryOff int64, err error) {
+	if img.featuresErr != nil {
+		return 0, 0, img.featuresErr
+	}
+	l1i := off >> img.clusterBits / img.l2Entries
+	if l1i >= int64(len(l1)) {
+		return 0, 0, nil
+	}
+	l2off := int64(l1[l1i] & entryOffsetMask)
+	if l2off == 0 {
+		return 0, 0, nil
+	}
+	if why := img.invalidOffset(l2off, img.clusterSize, true); why != "" {
+		return 0, 0, invalidEntry(StructL1Table, l1Off, l1i, l1[l1i], "L2 table offset %#x %s", l2off, why)
+	}
+	entryOff = l2off + (off>>img.clusterBits%img.l2Entries)*8
+	if img.fh.l2 != nil {
+		entry, err = img.fh.l2Entry(l2off, entryOff, img.clusterSize)
+	} else {
+		entry, err = img.readEntry(entryOff)
+	}
+	return entry, entryOff, err
+}
+
+// classify decodes an L2 entry
+func (img *Image) classify(entry uint64) clusterKind {
+	switch {
+	case entry&flagCompressed != 0:
+		return clusterCompressed
+	case entry&flagZero != 0:
+		return clusterZero
+	case entry&entryOffsetMask != 0:
+		return clusterNormal
+	}
+	return clusterUnallocated
+}
+
+// compressedRange is the host offset and length of a compressed cluster descriptor
+func (img *Image) compressedRange(entry uint64) (off, size int64) {
+	x := 62 - (img.clusterBits - 8)
+	off = int64(entry & (1<<x - 1))
+	sectors := int64(entry&(1<<62-1)>>x) + 1
+	return off, sectors*512 - off&511
+}
+
+// readGuest fills p, which lies within one cluster, from guest offset off
+// as mapped by the L1 table l1 stored at l1Off
+func (img *Image) readGuest(l1 []uint64, l1Off int64, p []byte, off int64) error {
+	entry, entryOff, err := img.l2Entry(l1, l1Off, off)
+	if err != nil {
+		return err
+	}
+	return img.readCluster(entry, entryOff, p, off)
+}
+
+// defaultMaxIOSize is the most readRun reads at once unless opened
+// WithMaxIOSize
+const defaultMaxIOSize = 1 << 20
+
+// readRun fills p from guest offset off, as mapped by the L1 table l1 stored
+// at l1Off, reading the cluster holding off along with those after it that
+// follow it in the image file with one read of up to maxIO bytes. It returns
+// how many bytes of p it filled. Clusters other than plain data, and those of
+// encrypted images, are read one at a time.
+func (img *Image) readRun(l1 []uint64, l1Off int64, p []byte, off, maxIO int64) (int, error) {
+	chunk := img.clusterChunk(p, off)
+	entry, entryOff, err := img.l2Entry(l1, l1Off, off)
+	if err != nil {
+		return 0, err
+	}
+	host := img.dataOffset(entry)
+	if host == 0 || img.crypt != nil {
+		return len(chunk), img.readCluster(entry, entryOff, chunk, off)
+	}
+	host += off & (img.clusterSize - 1)
+	n := int64(len(chunk))
+	for n < int64(len(p)) {
+		next := int64(len(img.clusterChunk(p[n:], off+n)))
+		if n+next > maxIO {
+			break
+		}
+		// an entry that can not be looked up ends the run, and is reported
+		// when read on its own
+		if entry, _, err := img.l2Entry(l1, l1Off, off+n); err != nil || img.dataOffset(entry) != host+n {
+			break
+		}
+		n += next
+	}
+	m, err := img.fh.ReadAt(p[:n], host)
+	if err == io.EOF {
+		// clusters allocated past the end of the file read as zeros
+		clear(p[m:n])
+		err = nil
+	}
+	return int(n), err
+}
+
+// dataOffset is the host offset of the cluster of data of an L2 entry, or
+// zero when the entry is not of one, or of one at an invalid offset
+func (img *Image) dataOffset(entry uint64) int64 {
+	if img.classify(entry) != clusterNormal {
+		return 0
+	}
+	host := int64(entry & entryOffsetMask)
+	if img.invalidOffset(host, img.clusterSize, true) != "" {
+		return 0
+	}
+	return host
+}
+
+// readCluster fills p, which lies within one cluster, from guest offset off
+// as mapped by entry, the L2 entry at entryOff
+func (img *Image) readCluster(entry uint64, entryOff int64, p []byte, off int64) error {
+	within := off & (img.clusterSize - 1)
+	l2i := off >> img.clusterBits % img.l2Entries
+	switch img.classify(entry) {
+	case clusterUnallocated:
+		return img.readBacking(p, off)
+	case clusterZero:
+		clear(p)
+		return nil
+	case clusterCompressed:
+		if img.crypt != nil {
+			return invalidEntry(StructL2Table, entryOff-l2i*8, l2i, entry, "compressed cluster of guest offset %#x in an encrypted image", off)
+		}
+		if coff, size := img.compressedRange(entry); img.invalidOffset(coff, size, false) != "" {
+			return invalidEntry(StructL2Table, entryOff-l2i*8, l2i, entry, "compressed cluster at %#x of %d bytes %s", coff, size, img.invalidOffset(coff, size, false))
+		}
+		buf, err := img.decompress(entry)
+		if err != nil {
+			return err
+		}
+		copy(p, buf[within:])
+		return nil
+	}
+	host := int64(entry & entryOffsetMask)
+	if why := img.invalidOffset(host, img.clusterSize, true); why != "" {
+		return invalidEntry(StructL2Table, entryOff-l2i*8, l2i, entry, "cluster offset %#x of guest offset %#x %s", host, off, why)
+	}
+	if img.crypt != nil {
+		return img.readDecrypted(p, host+within)
+	}
+	n, err := img.fh.ReadAt(p, host+within)
+	if err == io.EOF {
+		// clusters allocated past the end of the file read as zeros
+		clear(p[n:])
+		err = nil
+	}
+	return err
+}
+
+// readBacking fills p from the backing file, which reads as zeros past its end
+func (img *Image) readBacking(p []byte, off int64) error {
+	n := 0
+	if img.backing != nil && off < img.backingSize {
+		var err error
+		n, err = img.backing.ReadAt(p, off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	clear(p[n:])
+	return nil
+}
+
+// decompress returns the full cluster described by a compressed L2 entry,
+// whose range readGuest checked
+func (img *Image) decompress(entry uint64) ([]byte, error) {
+	off, size := img.compressedRange(entry)
+	buf := make([]byte, size)
+	n, err := img.fh.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	out := make([]byte, img.clusterSize)
+	zr := flate.NewReader(bytes.NewReader(buf[:n]))
+	if _, err := io.ReadFull(zr, out); err != nil {
+		return nil, fmt.Errorf("qcow2: decompressing cluster at %#x: %w", off, err)
+	}
+	return out, nil
+}
+
+// decompressedSize is the size of the data the compressed cluster of entry
+// decompresses to, up to one byte more than a cluster
+func (img *Image) decompressedSize(entry uint64) (int64, error) {
+	off, size := img.compressedRange(entry)
+	buf := make([]byte, size)
+	n, err := img.fh.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	zr := flate.NewReader(bytes.NewReader(buf[:n]))
+	m, err := io.Copy(io.Discard, io.LimitReader(zr, img.clusterSize+1))
+	if err != nil && m < img.clusterSize {
+		return 0, fmt.Errorf("decompressing: %w", err)
+	}
+	return m, nil
+}
+
+// writeGuest stores p, which lies within one cluster, at guest offset off
+func (img *Image) writeGuest(p []byte, off int64) error {
+	entryOff, err := img.l2ForWrite(off)
+	if err != nil {
+		return err
+	}
+	entry, err := img.readEntry(entryOff)
+	if err != nil {
+		return err
+	}
+	within := off & (img.clusterSize - 1)
+	host := int64(entry & entryOffsetMask)
+
+	kind := img.classify(entry)
+	if kind == clusterNormal {
+		if why := img.invalidOffset(host, img.clusterSize, true); why != "" {
+			l2i := off >> img.clusterBits % img.l2Entries
+			return invalidEntry(StructL2Table, entryOff-l2i*8, l2i, entry, "cluster offset %#x of guest offset %#x %s", host, off, why)
+		}
+		owned, err := img.owned(entry)
+		if err != nil {
+			return err
+		}
+		if owned {
+			if entry&flagCopied == 0 {
+				if err := img.writeEntry(entryOff, entry|flagCopied); err != nil {
+					return err
+				}
+			}
+			_, err = img.fh.WriteAt(p, host+within)
+			return err
+		}
+	}
+
+	// build the whole cluster, then store it in a cluster of its own
+	buf := make([]byte, img.clusterSize)
+	if int64(len(p)) < img.clusterSize {
+		if err := img.readGuest(img.l1, img.Header.L1TableOffset, buf, off-within); err != nil {
+			return err
+		}
+	}
+	copy(buf[within:], p)
+
+	target := host
+	owned := false
+	if kind == clusterZero && host != 0 {
+		// a preallocated zero cluster can be reused when not shared
+		if owned, err = img.owned(entry); err != nil {
+			return err
+		}
+	}
+	if !owned {
+		if target, err = img.allocClusters(1); err != nil {
+			return err
+		}
+		img.log.Debug("allocated data cluster", "guest-offset", off-within, "offset", target, "replaces", kind.String())
+	} else {
+		img.log.Debug("reused preallocated zero cluster", "guest-offset", off-within, "offset", target)
+	}
+	if _, err := img.fh.WriteAt(buf, target); err != nil {
+		return err
+	}
+	if err := img.writeEntry(entryOff, uint64(target)|flagCopied); err != nil {
+		return err
+	}
+	if !owned {
+		return img.releaseEntry(entry)
+	}
+	return nil
+}
+
+// owned reports whether the cluster of a standard entry is referenced only once
+func (img *Image) owned(entry uint64) (bool, error) {
+	if entry&flagCopied != 0 {
+		return true, nil
+	}
+	rc, err := img.refcount(int64(entry & entryOffsetMask))
+	return rc == 1, err
+}
+
+// l2ForWrite returns the host offset of the L2 entry for guest offset off,
+// allocating the L2 table or copying it when it is shared
+func (img *Image) l2ForWrite(off int64) (int64, error) {
+	l1i := off >> img.clusterBits / img.l2Entries
+	if l1i >= int64(len(img.l1)) {
+		return 0, errors.New("qcow2: offset beyond the L1 table")
+	}
+	idx := (off >> img.clusterBits % img.l2Entries) * 8
+
+	e := img.l1[l1i]
+	l2off := int64(e & entryOffsetMask)
+	if l2off != 0 {
+		if why := img.invalidOffset(l2off, img.clusterSize, true); why != "" {
+			return 0, invalidEntry(StructL1Table, img.Header.L1TableOffset, l1i, e, "L2 table offset %#x %s", l2off, why)
+		}
+	}
+	if l2off != 0 && e&flagCopied != 0 {
+		return l2off + idx, nil
+	}
+	table := make([]byte, img.clusterSize)
+	if l2off != 0 {
+		rc, err := img.refcount(l2off)
+		if err != nil {
+			return 0, err
+		}
+		if rc == 1 {
+			img.log.Debug("set the copied flag of an L2 table", "offset", l2off, structure(StructL2Table))
+			return l2off + idx, img.setL1(l1i, uint64(l2off)|flagCopied)
+		}
+		if _, err := img.fh.ReadAt(table, l2off); err != nil {
+			return 0, err
+		}
+	}
+	newOff, err := img.allocClusters(1)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := img.fh.WriteAt(table, newOff); err != nil {
+		return 0, err
+	}
+	if err := img.setL1(l1i, uint64(newOff)|flagCopied); err != nil {
+		return 0, err
+	}
+	if l2off != 0 {
+		img.log.Debug("copied shared L2 table", "offset", newOff, "from", l2off, structure(StructL2Table))
+	} else {
+		img.log.Debug("allocated L2 table", "offset", newOff, structure(StructL2Table))
+	}
+	if l2off != 0 {
+		if err := img.updateRefcount(l2off, img.clusterSize, -1); err != nil {
+			return 0, err
+		}
+	}
+	return newOff + idx, nil
+}
+
+func (img *Image) setL1(l1i int64, e uint64) error {
+	img.l1[l1i] = e
+	return img.writeEntry(img.Header.L1TableOffset+l1i*8, e)
+}
+
+// releaseEntry drops the reference an L2 entry holds on its host clusters
+func (img *Image) releaseEntry(entry uint64) error {
+	switch img.classify(entry) {
+	case clusterCompressed:
+		off, size := img.compressedRange(entry)
+		return img.updateRefcount(off, size, -1)
+	case clusterNormal, clusterZero:
+		if host := int64(entry & entryOffsetMask); host != 0 {
+			return img.updateRefcount(host, img.clusterSize, -1)
+		}
+	}
+	return nil
+}
+
+// writeZeroes makes [off, off+n) of the guest disk read as zeros, using zero
+// clusters or dropping clusters where it can rather than storing zeros
+func (img *Image) writeZeroes(off, n int64) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	if err := img.trackWrite(off, n); err != nil {
+		return err
+	}
+	zeros := make([]byte, img.clusterSize)
+	for end := off + n; off < end; {
+		within := off & (img.clusterSize - 1)
+		m := min(img.clusterSize-within, end-off)
+		done := false
+		if within == 0 && (m == img.clusterSize || off+m == img.Header.Size) {
+			var err error
+			if done, err = img.zeroCluster(off); err != nil {
+				return err
+			}
+		}
+		if !done {
+			if err := img.writeGuest(zeros[:m], off); err != nil {
+				return err
+			}
+		}
+		off += m
+	}
+	return nil
+}
+
+// zeroCluster makes the cluster at guest offset off read as zeros without
+// storing data: with a zero cluster, or by leaving it unallocated when there
+// is no backing file. It reports false when the image can do neither.
+func (img *Image) zeroCluster(off int64) (bool, error) {
+	var zero uint64
+	switch {
+	case img.Header.Version >= 3:
+		zero = flagZero
+	case img.backing != nil:
+		return false, nil
+	}
+	entry, _, err := img.l2Entry(img.l1, img.Header.L1TableOffset, off)
+	if err != nil {
+		return false, err
+	}
+	switch img.classify(entry) {
+	case clusterUnallocated:
+		if img.backing == nil {
+			return true, nil
+		}
+	case clusterZero:
+		if entry&entryOffsetMask == 0 {
+			return true, nil
+		}
+	}
+	return true, img.replaceEntry(off, zero)
+}
+
+// replaceEntry stores a new L2 entry without data for the cluster at guest
+// offset off, such as a zero cluster, dropping what it mapped before
+func (img *Image) replaceEntry(off int64, e uint64) error {
+	entryOff, err := img.l2ForWrite(off)
+	if err != nil {
+		return err
+	}
+	old, err := img.readEntry(entryOff)
+	if err != nil {
+		return err
+	}
+	if err := img.writeEntry(entryOff, e); err != nil {
+		return err
+	}
+	return img.releaseEntry(old)
+}
@@ -0,0 +1,307 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// corruptImage creates an image with a snapshot, a bitmap directory of two
+// bitmaps and data at guest offset 0, then lets damage write to the file
+// before it is opened again
+func corruptImage(t *testing.T, damage func(img *Image, fh io.WriterAt)) (*Image, error) {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "file.qcow2")
+	img, err := Create(name, 1<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.CreateSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	addBitmaps(t, img, []bitmap{
+		{name: "first", tableSize: 1, typ: bitmapTypeDirty, granularityBits: 16},
+		{name: "second", tableSize: 1, typ: bitmapTypeDirty, granularityBits: 16},
+	})
+	damage(img, img.fh)
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+	img, err = Open(name, WithNoLock())
+	if err == nil {
+		t.Cleanup(func() { img.Close() })
+	}
+	return img, err
+}
+
+func putUint32At(t *testing.T, fh io.WriterAt, off int64, v uint32) {
+	t.Helper()
+	if _, err := fh.WriteAt(binary.BigEndian.AppendUint32(nil, v), off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func putUint64At(t *testing.T, fh io.WriterAt, off int64, v uint64) {
+	t.Helper()
+	if _, err := fh.WriteAt(binary.BigEndian.AppendUint64(nil, v), off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCorruptionError(t *testing.T) {
+	var want CorruptionError
+	for _, tc := range []struct {
+		name   string
+		damage func(img *Image, fh io.WriterAt)
+		// use is what fails on the damaged image, when opening it does not
+		use          func(img *Image) error
+		invalidEntry bool
+	}{
+		{
+			name: "header",
+			damage: func(img *Image, fh io.WriterAt) {
+				putUint32At(t, fh, 20, 40)
+				want = CorruptionError{Offset: 20, Structure: StructHeader, Index: -1, Value: 40}
+			},
+		},
+		{
+			name: "extension",
+			damage: func(img *Image, fh io.WriterAt) {
+				at := img.Header.ExtensionOffset(1)
+				putUint32At(t, fh, at+4, 5000)
+				want = CorruptionError{Offset: at, Structure: StructExtension, Index: 1, Value: 5000}
+			},
+		},
+		{
+			name: "L1 table",
+			damage: func(img *Image, fh io.WriterAt) {
+				entry := uint64(img.clusterSize+512) | flagCopied
+				putUint64At(t, fh, img.Header.L1TableOffset, entry)
+				want = CorruptionError{Offset: img.Header.L1TableOffset, Structure: StructL1Table, Index: 0, Value: entry}
+			},
+			use: func(img *Image) error {
+				_, err := img.ReadAt(make([]byte, 512), 0)
+				return err
+			},
+			invalidEntry: true,
+		},
+		{
+			name: "L2 table",
+			damage: func(img *Image, fh io.WriterAt) {
+				l2off := int64(img.l1[0] & entryOffsetMask)
+				entry := uint64(img.end+img.clusterSize) | flagCopied
+				putUint64At(t, fh, l2off+3*8, entry)
+				want = CorruptionError{Offset: l2off + 3*8, Structure: StructL2Table, Index: 3, Value: entry}
+			},
+			use: func(img *Image) error {
+				_, err := img.ReadAt(make([]byte, 512), 3*img.clusterSize+100)
+				return err
+			},
+			invalidEntry: true,
+		},
+		{
+			name: "refcount table",
+			damage: func(img *Image, fh io.WriterAt) {
+				entry := uint64(img.end + 4*img.clusterSize)
+				putUint64At(t, fh, img.Header.RefcountTableOffset+8, entry)
+				want = CorruptionError{Offset: img.Header.RefcountTableOffset + 8, Structure: StructRefcountTable, Index: 1, Value: entry}
+			},
+			use: func(img *Image) error {
+				_, err := img.refcount(img.refblockEntries() * img.clusterSize)
+				return err
+			},
+			invalidEntry: true,
+		},
+		{
+			name: "snapshot table",
+			damage: func(img *Image, fh io.WriterAt) {
+				putUint32At(t, fh, img.Header.SnapshotsOffset+36, 2000)
+				want = CorruptionError{Offset: img.Header.SnapshotsOffset + 36, Structure: StructSnapshotTable, Index: 0, Value: 2000}
+			},
+		},
+		{
+			name: "bitmap directory",
+			damage: func(img *Image, fh io.WriterAt) {
+				ext, _, err := img.Header.readBitmapsExt()
+				if err != nil {
+					t.Fatal(err)
+				}
+				// the second entry claims a name running past the directory
+				at := ext.dirOffset + bitmap{name: "first"}.entrySize()
+				if _, err := fh.WriteAt([]byte{0x10, 0}, at+18); err != nil {
+					t.Fatal(err)
+				}
+				want = CorruptionError{Offset: at, Structure: StructBitmapDirectory, Index: 1, Value: bitmapHeaderSize + 0x1000}
+			},
+			use: func(img *Image) error {
+				ext, _, err := img.Header.readBitmapsExt()
+				if err != nil {
+					return err
+				}
+				_, err = img.readBitmaps(ext)
+				return err
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			img, err := corruptImage(t, tc.damage)
+			if tc.use != nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = tc.use(img)
+			}
+			var got CorruptionError
+			if !errors.As(err, &got) {
+				t.Fatalf("got %v, want a CorruptionError", err)
+			}
+			if got.Offset != want.Offset || got.Structure != want.Structure || got.Index != want.Index || got.Value != want.Value {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+			if got.Reason == "" || !strings.Contains(err.Error(), got.Reason) {
+				t.Errorf("got reason %q in %q", got.Reason, err)
+			}
+			if errors.Is(err, ErrInvalidEntry) != tc.invalidEntry {
+				t.Errorf("errors.Is(%v, ErrInvalidEntry) is %v", err, !tc.invalidEntry)
+			}
+		})
+	}
+}
+
+func TestCheckCorruptionOffset(t *testing.T) {
+	img, err := corruptImage(t, func(img *Image, fh io.WriterAt) {
+		putUint64At(t, fh, img.Header.RefcountTableOffset+8, uint64(img.end+4*img.clusterSize))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := img.Check(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, f := range rep.Findings {
+		if f.Offset == img.Header.RefcountTableOffset+8 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("got %+v, want a finding at the refcount table entry", rep.Findings)
+	}
+}
+
+// countingStorage counts the reads of the file of an image
+type countingStorage struct {
+	storage
+	reads atomic.Int64
+}
+
+func (s *countingStorage) ReadAt(p []byte, off int64) (int, error) {
+	s.reads.Add(1)
+	return s.storage.ReadAt(p, off)
+}
+
+// countReads reads all of img twice, the first time to cache its L2 tables,
+// and returns how many reads of the file the second time took
+func countReads(t *testing.T, img *Image) ([]byte, int64) {
+	t.Helper()
+	s := &countingStorage{storage: img.fh.storage}
+	img.fh.storage = s
+	readAll(t, img)
+	s.reads.Store(0)
+	return readAll(t, img), s.reads.Load()
+}
+
+func TestReadCoalescing(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "file.qcow2")
+	img, err := Create(name, 1<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 1<<20)
+	for i := range want {
+		want[i] = byte(i/4096 + 1)
+	}
+	clear(want[100*4096 : 101*4096])
+	// cluster 10 is allocated before the rest, and cluster 100 not at all,
+	// each ending a run of contiguous clusters
+	for _, r := range [][2]int64{{10, 11}, {0, 10}, {11, 100}, {101, 256}} {
+		if _, err := img.WriteAt(want[r[0]*4096:r[1]*4096], r[0]*4096); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		opts  []Option
+		reads int64
+	}{
+		{nil, 4},
+		// runs of 16 clusters, then one a cluster
+		{[]Option{WithMaxIOSize(64 << 10)}, 1 + 1 + 6 + 10},
+		{[]Option{WithMaxIOSize(0)}, 255},
+		// with every entry read from the file, those ending a run twice
+		{[]Option{WithL2CacheSize(0)}, 4 + 256 + 3},
+	} {
+		img, err := Open(name, c.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, reads := countReads(t, img)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%d options: the image reads differently", len(c.opts))
+		}
+		if reads != c.reads {
+			t.Errorf("%d options: got %d reads of the file, want %d", len(c.opts), reads, c.reads)
+		}
+		img.Close()
+	}
+}
+
+func BenchmarkSequentialRead(b *testing.B) {
+	const size = 32 << 20
+	name := filepath.Join(b.TempDir(), "file.qcow2")
+	img, err := Create(name, size, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte("data"), size/4), 0); err != nil {
+		b.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		b.Fatal(err)
+	}
+	for _, maxIO := range []int64{64 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("max-io=%d", maxIO), func(b *testing.B) {
+			img, err := Open(name, WithMaxIOSize(maxIO))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer img.Close()
+			s := &countingStorage{storage: img.fh.storage}
+			img.fh.storage = s
+			p := make([]byte, 4<<20)
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for off := int64(0); off < size; off += int64(len(p)) {
+					if _, err := img.ReadAt(p, off); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(s.reads.Load())/float64(b.N), "reads/op")
+		})
+	}
+}
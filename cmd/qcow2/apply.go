@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["apply"] = command{
+		usage: "apply [-p] [--dry-run] [--hex] DELTA TARGET (writes the clusters of DELTA onto the raw TARGET)",
+		run:   apply,
+	}
+}
+
+func apply(args []string) error {
+	fs := newFlagSet("apply")
+	dryRun := fs.Bool("dry-run", false, "print the ranges that would be written")
+	r := hexFlag(fs, false)
+	showProgress := fs.Bool("p", false, "show progress on a terminal")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 2 {
+		return fmt.Errorf("apply: expected DELTA and TARGET")
+	}
+	img, err := openImage(operands[0], qcow2.WithNoBacking())
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	flag := os.O_RDWR
+	if *dryRun {
+		flag = os.O_RDONLY
+	}
+	fh, err := os.OpenFile(operands[1], flag, 0)
+	if err != nil {
+		return err
+	}
+	target := rawFile{fh}
+
+	changes, err := img.ApplyTo(target, target.Size(), &qcow2.ApplyOptions{DryRun: *dryRun, Progress: progressBar(*showProgress)})
+	if err != nil {
+		target.Close()
+		return err
+	}
+	if *dryRun {
+		for _, e := range changes {
+			fmt.Printf("%s %s %s\n", r.format(e.Start), r.format(e.Length), e.Type)
+		}
+		return target.Close()
+	}
+	if err := target.Sync(); err != nil {
+		target.Close()
+		return err
+	}
+	return target.Close()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["backup"] = command{
+		usage: "backup [-p] --bitmap NAME [-b PREV] [-o OPTIONS] [--new-bitmap NEW] IMAGE TARGET | --target raw --apply-to RAW IMAGE (back up what the bitmap marks written since the last backup, then clear it)",
+		run:   backup,
+	}
+}
+
+func backup(args []string) error {
+	fs := newFlagSet("backup")
+	bitmapName := fs.String("bitmap", "", "the persistent bitmap of the writes since the last backup")
+	prev := fs.String("b", "", "the previous backup, which TARGET is an overlay of; without it TARGET is a full backup")
+	target := fs.String("target", "qcow2", "qcow2 to create TARGET, or raw to patch the raw copy of --apply-to")
+	applyTo := fs.String("apply-to", "", "the raw copy of the disk as of the last backup, patched in place")
+	newBitmap := fs.String("new-bitmap", "", "create this bitmap for the next backup, leaving the bits of --bitmap set")
+	createOpts := fs.String("o", "", "comma separated qcow2 options: cluster_size, compat, refcount_bits, backing_file")
+	showProgress := fs.Bool("p", false, "show progress on a terminal")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if *bitmapName == "" {
+		return fmt.Errorf("backup: expected --bitmap NAME")
+	}
+	opts, err := parseCreateOptions(*createOpts)
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	opts.Progress = progressBar(*showProgress)
+	bopts := &qcow2.BackupOptions{ConvertOptions: *opts, NewBitmap: *newBitmap}
+
+	switch *target {
+	case "qcow2":
+		if len(operands) != 2 || *applyTo != "" {
+			return fmt.Errorf("backup: expected IMAGE and TARGET")
+		}
+	case "raw":
+		if len(operands) != 1 || *applyTo == "" || *prev != "" {
+			return fmt.Errorf("backup: expected --apply-to RAW and IMAGE")
+		}
+	default:
+		return fmt.Errorf("backup: unknown target %q, expected qcow2 or raw", *target)
+	}
+	img, err := openImageFile(operands[0], os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	if *target == "raw" {
+		fh, err := os.OpenFile(*applyTo, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		return img.BackupToRaw(*bitmapName, fh, bopts)
+	}
+	var base *qcow2.Image
+	if *prev != "" {
+		if base, err = openImage(*prev); err != nil {
+			return err
+		}
+		defer base.Close()
+	}
+	return img.Backup(*bitmapName, base, operands[1], bopts)
+}
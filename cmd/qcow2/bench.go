@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["bench"] = command{
+		usage: "bench [--force-share] [--pattern seq|rand] [--bs SIZE] [--duration D] [--warmup D] [--jobs N] [--no-cache] [--offset N] [--length N] [--output human|json] IMAGE",
+		run:   bench,
+	}
+}
+
+// benchResult is what bench measured, after the warm up
+type benchResult struct {
+	Image     string `json:"image"`
+	Pattern   string `json:"pattern"`
+	BlockSize int64  `json:"block-size"`
+	Jobs      int    `json:"jobs"`
+	L2Cache   bool   `json:"l2-cache"`
+	Offset    int64  `json:"offset"`
+	Length    int64  `json:"length"`
+	// Duration is the seconds measured, shorter than asked for when
+	// Interrupted
+	Duration    float64 `json:"duration"`
+	Interrupted bool    `json:"interrupted"`
+	Reads       int64   `json:"reads"`
+	Bytes       int64   `json:"bytes"`
+	Throughput  float64 `json:"bytes-per-second"`
+	IOPS        float64 `json:"iops"`
+	// Latency are the percentiles of the time each read took, in
+	// microseconds
+	Latency benchLatency `json:"latency-us"`
+}
+
+type benchLatency struct {
+	Min  float64 `json:"min"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p99.9"`
+	Max  float64 `json:"max"`
+}
+
+func bench(args []string) error {
+	fs := newFlagSet("bench")
+	forceShareFlag(fs)
+	pattern := fs.String("pattern", "seq", "read the blocks in sequence or at random")
+	bs := fs.String("bs", "64k", "size of each read")
+	duration := fs.Duration("duration", 10*time.Second, "how long to measure for")
+	warmup := fs.Duration("warmup", time.Second, "how long to read before measuring")
+	jobs := fs.Int("jobs", 1, "number of concurrent readers")
+	noCache := fs.Bool("no-cache", false, "read every L2 entry from the file, without the L2 cache")
+	offset := fs.String("offset", "0", "guest offset of the region to read")
+	length := fs.String("length", "", "length of the region to read, up to the end of the disk when empty")
+	output := fs.String("output", "human", "print the results as human text or as json")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 1 {
+		return fmt.Errorf("bench: expected IMAGE")
+	}
+	if *pattern != "seq" && *pattern != "rand" {
+		return fmt.Errorf("bench: unknown pattern %q", *pattern)
+	}
+	if *output != "human" && *output != "json" {
+		return fmt.Errorf("bench: unknown output %q", *output)
+	}
+	if *jobs < 1 {
+		return fmt.Errorf("bench: --jobs must be at least 1")
+	}
+	if *duration <= 0 || *warmup < 0 {
+		return fmt.Errorf("bench: --duration must be positive and --warmup not negative")
+	}
+	r := benchResult{Image: operands[0], Pattern: *pattern, Jobs: *jobs, L2Cache: !*noCache}
+	if r.BlockSize, err = parseSize(*bs); err != nil || r.BlockSize <= 0 {
+		return fmt.Errorf("bench: --bs: invalid size %q", *bs)
+	}
+	if r.Offset, err = parseSize(*offset); err != nil {
+		return fmt.Errorf("bench: --offset: %w", err)
+	}
+
+	var opts []qcow2.Option
+	if *noCache {
+		opts = append(opts, qcow2.WithL2CacheSize(0))
+	}
+	img, err := openImage(r.Image, opts...)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	r.Length = img.Size() - r.Offset
+	if *length != "" {
+		if r.Length, err = parseSize(*length); err != nil {
+			return fmt.Errorf("bench: --length: %w", err)
+		}
+	}
+	if r.Offset < 0 || r.Length < r.BlockSize || r.Offset+r.Length > img.Size() {
+		return fmt.Errorf("bench: a region of %d bytes at %d does not fit a block of %d bytes in the disk of %d bytes", r.Length, r.Offset, r.BlockSize, img.Size())
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	latencies, elapsed, err := runBench(ctx, img, r, *warmup, *duration)
+	if err != nil {
+		return err
+	}
+	r.Interrupted = ctx.Err() != nil
+	r.Duration = elapsed.Seconds()
+	r.summarize(latencies)
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	} else {
+		r.print()
+	}
+	if r.Interrupted {
+		return exitStatus(130)
+	}
+	return nil
+}
+
+// runBench reads the region of r with its jobs through ReadAt, as any reader
+// of the image does, until ctx is done or the warm up and duration are over.
+// It returns the latencies of the reads after the warm up, and the time they
+// span.
+func runBench(ctx context.Context, img *qcow2.Image, r benchResult, warmup, duration time.Duration) ([]time.Duration, time.Duration, error) {
+	start := time.Now()
+	measureFrom, end := start.Add(warmup), start.Add(warmup+duration)
+	blocks := r.Length / r.BlockSize
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		latencies []time.Duration
+		firstErr  error
+	)
+	ctx, cancel := context.WithDeadline(ctx, end)
+	defer cancel()
+	for j := 0; j < r.Jobs; j++ {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			buf := make([]byte, r.BlockSize)
+			rnd := rand.New(rand.NewSource(int64(j) + 1))
+			// sequential jobs start spread over the region
+			block := blocks * int64(j) / int64(r.Jobs)
+			var mine []time.Duration
+			for ctx.Err() == nil {
+				if r.Pattern == "rand" {
+					block = rnd.Int63n(blocks)
+				}
+				t0 := time.Now()
+				if _, err := img.ReadAt(buf, r.Offset+block*r.BlockSize); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					cancel()
+					break
+				}
+				if t0.After(measureFrom) {
+					mine = append(mine, time.Since(t0))
+				}
+				if block++; block == blocks {
+					block = 0
+				}
+			}
+			mu.Lock()
+			latencies = append(latencies, mine...)
+			mu.Unlock()
+		}(j)
+	}
+	wg.Wait()
+	elapsed := min(time.Since(measureFrom), duration)
+	return latencies, max(elapsed, 0), firstErr
+}
+
+// summarize fills in the totals and percentiles of the latencies
+func (r *benchResult) summarize(latencies []time.Duration) {
+	r.Reads = int64(len(latencies))
+	r.Bytes = r.Reads * r.BlockSize
+	if r.Duration > 0 {
+		r.Throughput = float64(r.Bytes) / r.Duration
+		r.IOPS = float64(r.Reads) / r.Duration
+	}
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	at := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(latencies)))) - 1
+		return float64(latencies[max(i, 0)]) / float64(time.Microsecond)
+	}
+	r.Latency = benchLatency{Min: at(0), P50: at(0.5), P90: at(0.9), P99: at(0.99), P999: at(0.999), Max: at(1)}
+}
+
+func (r benchResult) print() {
+	cache := "on"
+	if !r.L2Cache {
+		cache = "off"
+	}
+	took := roundDuration(time.Duration(r.Duration * float64(time.Second))).String()
+	if r.Interrupted {
+		took += " (interrupted)"
+	}
+	us := func(v float64) time.Duration { return roundDuration(time.Duration(v * float64(time.Microsecond))) }
+	l := r.Latency
+	fmt.Printf("image:      %s\n", r.Image)
+	fmt.Printf("pattern:    %s reads of %s over %s at %d\n", r.Pattern, qcow2.FormatSize(r.BlockSize), qcow2.FormatSize(r.Length), r.Offset)
+	fmt.Printf("jobs:       %d\n", r.Jobs)
+	fmt.Printf("L2 cache:   %s\n", cache)
+	fmt.Printf("duration:   %s\n", took)
+	fmt.Printf("reads:      %d (%s)\n", r.Reads, qcow2.FormatSize(r.Bytes))
+	fmt.Printf("throughput: %s/s\n", qcow2.FormatSize(int64(r.Throughput)))
+	fmt.Printf("IOPS:       %.1f\n", r.IOPS)
+	fmt.Printf("latency:    min %s, p50 %s, p90 %s, p99 %s, p99.9 %s, max %s\n", us(l.Min), us(l.P50), us(l.P90), us(l.P99), us(l.P999), us(l.Max))
+}
+
+// roundDuration keeps three significant digits of d, up to a second
+func roundDuration(d time.Duration) time.Duration {
+	for p := time.Duration(1); p < 10*time.Millisecond; p *= 10 {
+		if d < 1000*p {
+			return d.Round(p)
+		}
+	}
+	return d.Round(10 * time.Millisecond)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["bitmap"] = command{
+		usage: "bitmap --add [-g GRANULARITY] | --remove | --dump [--force] [-o FILE] | --load [-i FILE] NAME IMAGE | --merge SRC --into DST IMAGE (create, remove, write out, replace the bits of or merge persistent dirty bitmaps, - is stdout or stdin)",
+		run:   bitmap,
+	}
+}
+
+func bitmap(args []string) error {
+	fs := newFlagSet("bitmap")
+	add := fs.Bool("add", false, "create the bitmap, with no bits set")
+	remove := fs.Bool("remove", false, "remove the bitmap")
+	dump := fs.Bool("dump", false, "write the bits of the bitmap, as qcow2.Bitmap.MarshalBinary encodes them")
+	load := fs.Bool("load", false, "replace the bits of the bitmap with those written by --dump")
+	granularity := fs.String("g", "64K", "the bytes each bit of a new bitmap stands for, a power of two from 512 bytes to 2 GiB")
+	out := fs.String("o", "-", "file --dump writes to, - for stdout")
+	in := fs.String("i", "-", "file --load reads from, - for stdin")
+	force := fs.Bool("force", false, "dump a bitmap that is in use, whose bits can not be trusted")
+	merge := fs.String("merge", "", "set the bits of the bitmap of --into for the ranges set in this bitmap")
+	into := fs.String("into", "", "the bitmap --merge sets bits of")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	actions := 0
+	for _, set := range []bool{*add, *remove, *dump, *load, *merge != ""} {
+		if set {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return fmt.Errorf("bitmap: expected one of --add, --remove, --dump, --load and --merge")
+	}
+	if *merge != "" {
+		if len(operands) != 1 || *into == "" {
+			return fmt.Errorf("bitmap: expected --merge SRC --into DST IMAGE")
+		}
+		img, err := openImageFile(operands[0], os.O_RDWR)
+		if err != nil {
+			return err
+		}
+		defer img.Close()
+		return img.MergeBitmaps(*into, *merge)
+	}
+	if len(operands) != 2 {
+		return fmt.Errorf("bitmap: expected NAME and IMAGE")
+	}
+	name := operands[0]
+	if *dump {
+		return dumpBitmap(name, operands[1], *out, *force)
+	}
+
+	img, err := openImageFile(operands[1], os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	switch {
+	case *add:
+		g, err := parseSize(*granularity)
+		if err != nil || g <= 0 || g&(g-1) != 0 {
+			return fmt.Errorf("bitmap: invalid granularity %q", *granularity)
+		}
+		return img.AddBitmap(name, bits.TrailingZeros64(uint64(g)))
+	case *remove:
+		return img.RemoveBitmap(name)
+	}
+	r := os.Stdin
+	if *in != "-" {
+		if r, err = os.Open(*in); err != nil {
+			return err
+		}
+		defer r.Close()
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var b qcow2.Bitmap
+	if err := b.UnmarshalBinary(data); err != nil {
+		return fmt.Errorf("%s: %w", *in, err)
+	}
+	return img.WriteBitmap(name, &b)
+}
+
+// dumpBitmap writes the bits of the bitmap name of the image to out, refusing
+// a bitmap in use unless forced
+func dumpBitmap(name, image, out string, force bool) error {
+	img, err := openImage(image, qcow2.WithNoBacking())
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	b, err := img.ReadBitmap(name)
+	if err != nil {
+		return err
+	}
+	if b.InUse && !force {
+		return fmt.Errorf("bitmap: %q is in use, so its bits can not be trusted: --force dumps them anyway", name)
+	}
+	data, err := b.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if out == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(out, data, 0o644)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["check"] = command{
+		usage: "check [--force-share] [--skip-extensions] [-p] [-r leaks|all] [--chain] [--deep] [--output human|json] [--jobs N] IMAGE",
+		run:   check,
+		// qemu-img check exits 1 when it could not check the image
+		errorStatus: 1,
+	}
+}
+
+func check(args []string) error {
+	fs := newFlagSet("check")
+	forceShareFlag(fs)
+	skipExtensionsFlag(fs)
+	showProgress := fs.Bool("p", false, "show progress on a terminal")
+	repair := fs.String("r", "", "repair leaks, or all to also rebuild the refcounts")
+	output := fs.String("output", "human", "print the report as human text or as json")
+	jobs := fs.Int("jobs", 0, "number of parallel workers, all CPUs when 0")
+	chain := fs.Bool("chain", false, "also validate the backing files, down to the base")
+	deep := fs.Bool("deep", false, "also decompress every compressed cluster")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s\n", progName, commands["check"].usage)
+		fs.PrintDefaults()
+		fmt.Fprint(fs.Output(), checkExitCodes)
+	}
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 1 {
+		return fmt.Errorf("check: expected IMAGE")
+	}
+	opts := &qcow2.CheckOptions{Progress: progressBar(*showProgress), Jobs: *jobs, Chain: *chain, Deep: *deep}
+	flag := os.O_RDONLY
+	switch *repair {
+	case "":
+	case "leaks":
+		opts.Repair, flag = qcow2.RepairLeaks, os.O_RDWR
+	case "all":
+		opts.Repair, flag = qcow2.RepairAll, os.O_RDWR
+	default:
+		return fmt.Errorf("check: unknown repair mode %q", *repair)
+	}
+	if forceShare && *repair != "" {
+		return fmt.Errorf("check: --force-share opens the image read-only, so it can not be repaired with -r")
+	}
+	if skipExtensions && *repair != "" {
+		return fmt.Errorf("check: --skip-extensions opens the image read-only, so it can not be repaired with -r")
+	}
+	if *output != "human" && *output != "json" {
+		return fmt.Errorf("check: unknown output format %q", *output)
+	}
+	// the backing files are not needed, and checked on their own with --chain
+	img, err := openImageFile(operands[0], flag, qcow2.WithDamagedSnapshots(), qcow2.WithIgnoreUnknownIncompatible(), qcow2.WithNoBacking())
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	if skipExtensions {
+		fmt.Fprintf(os.Stderr, "[WARN] %s: %s\n", operands[0], skippedExtensions(img.Header))
+	}
+	rep, err := img.Check(opts)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		if rep.Findings == nil {
+			rep.Findings = []qcow2.Finding{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		err := enc.Encode(struct {
+			Filename string `json:"filename"`
+			Format   string `json:"format"`
+			*qcow2.CheckReport
+		}{operands[0], "qcow2", rep})
+		if err != nil {
+			return err
+		}
+	} else {
+		printCheckReport(rep)
+	}
+	if code := rep.ExitCode(); code != 0 {
+		return exitStatus(code)
+	}
+	return nil
+}
+
+// checkExitCodes are those of qemu-img check
+const checkExitCodes = `
+Exit status:
+  0  no errors were found, or all were repaired
+  1  the check could not be completed
+  2  errors were found
+  3  only leaked clusters were found
+`
+
+// printCheckReport prints the report in the words of qemu-img check
+func printCheckReport(rep *qcow2.CheckReport) {
+	if rep.LeaksFixed > 0 || rep.CorruptionsFixed > 0 {
+		fmt.Printf("The following inconsistencies were found and repaired:\n\n    %d leaked clusters\n    %d corruptions\n\nDouble checking the fixed image now...\n", rep.LeaksFixed, rep.CorruptionsFixed)
+	}
+	for _, f := range rep.Findings {
+		fmt.Println(f)
+		if f.Kind == qcow2.FindingOverlap {
+			continue // the message names the claimants
+		}
+		for _, r := range f.Referrers {
+			fmt.Printf("  referenced by the %s\n", r)
+		}
+	}
+	if rep.Clean() {
+		fmt.Println("No errors were found on the image.")
+	}
+	if rep.Corruptions > 0 {
+		fmt.Printf("\n%d errors were found on the image.\nData may be corrupted, or further writes to the image may corrupt it.\n", rep.Corruptions)
+	}
+	if rep.MarkCorrupt {
+		fmt.Println("Metadata overlaps: the image should be marked corrupt, and is not repaired.")
+	}
+	if rep.Leaks > 0 {
+		fmt.Printf("\n%d leaked clusters (%d bytes) were found on the image.\nThis means waste of disk space, but no harm to data.\n", rep.Leaks, rep.LeakedBytes)
+	}
+	if rep.CheckErrors > 0 {
+		fmt.Printf("\n%d internal errors have occurred during the check.\n", rep.CheckErrors)
+	}
+	if rep.TotalClusters != 0 && rep.AllocatedClusters != 0 {
+		fmt.Printf("%d/%d = %0.2f%% allocated, %0.2f%% fragmented, %0.2f%% compressed clusters\n",
+			rep.AllocatedClusters, rep.TotalClusters,
+			float64(rep.AllocatedClusters)*100/float64(rep.TotalClusters),
+			float64(rep.FragmentedClusters)*100/float64(rep.AllocatedClusters),
+			float64(rep.CompressedClusters)*100/float64(rep.AllocatedClusters))
+	}
+	if rep.ImageEndOffset > 0 {
+		fmt.Printf("Image end offset: %d\n", rep.ImageEndOffset)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["checksum"] = command{
+		usage: "checksum [--force-share] [-p] [--algo sha256|sha512|sha1|md5] [--fail-fast] [--jobs N] IMAGE...",
+		run:   checksum,
+	}
+}
+
+// hashes are the algorithms of checksum
+var hashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"sha1":   sha1.New,
+	"md5":    md5.New,
+}
+
+func checksum(args []string) error {
+	fs := newFlagSet("checksum")
+	forceShareFlag(fs)
+	algo := fs.String("algo", "sha256", "hash algorithm")
+	showProgress := fs.Bool("p", false, "show progress on a terminal")
+	failFast := fs.Bool("fail-fast", false, "stop at the first image that fails")
+	jobs := fs.Int("jobs", 0, "number of parallel readers, all CPUs when 0")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) == 0 {
+		return fmt.Errorf("checksum: expected IMAGE")
+	}
+	newHash, ok := hashes[*algo]
+	if !ok {
+		return fmt.Errorf("checksum: unsupported algorithm %q", *algo)
+	}
+	return eachImage(operands, *failFast, func(name string) error {
+		img, err := openImage(name)
+		if err != nil {
+			return err
+		}
+		sum, err := img.ChecksumWithOptions(context.Background(), newHash(), &qcow2.ChecksumOptions{Progress: progressBar(*showProgress), Jobs: *jobs})
+		img.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%x  %s\n", sum, name)
+		return nil
+	})
+}
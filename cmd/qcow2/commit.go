@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["commit"] = command{
+		usage: "commit [-p] [-d] [--base DEPTH|FILE] IMAGE",
+		run:   commit,
+	}
+}
+
+func commit(args []string) error {
+	fs := newFlagSet("commit")
+	keep := fs.Bool("d", false, "keep the clusters of IMAGE rather than emptying it")
+	base := fs.String("base", "", "the backing file to commit into, by depth or name, the direct backing file by default; implies -d")
+	showProgress := fs.Bool("p", false, "show progress on a terminal")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 1 {
+		return fmt.Errorf("commit: expected IMAGE")
+	}
+	img, err := openImageFile(operands[0], os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	opts := &qcow2.CommitOptions{Base: 1, Progress: progressBar(*showProgress)}
+	if *base != "" {
+		if opts.Base, err = baseDepth(img, *base); err != nil {
+			return err
+		}
+	}
+	opts.Empty = !*keep && opts.Base == 1
+	if err := img.Commit(opts); err != nil {
+		return err
+	}
+	fmt.Println("Image committed.")
+	return nil
+}
+
+// baseDepth finds the depth of an image in the backing chain of img, given as
+// a depth or as a file name
+func baseDepth(img *qcow2.Image, base string) (int, error) {
+	if n, err := strconv.Atoi(base); err == nil {
+		return n, nil
+	}
+	want, err := filepath.Abs(base)
+	if err != nil {
+		return 0, err
+	}
+	for depth := 0; img != nil; depth++ {
+		if img.Header.BackingFile == "" {
+			break
+		}
+		if abs, err := filepath.Abs(backingPath(img, img.Header.BackingFile)); err == nil && abs == want {
+			return depth + 1, nil
+		}
+		img = img.BackingImage()
+	}
+	return 0, fmt.Errorf("commit: %s is not in the backing chain", base)
+}
+
+// backingPath is where a backing file name of img refers to
+func backingPath(img *qcow2.Image, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(filepath.Dir(img.Name()), name)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func init() {
+	commands["compact"] = command{
+		usage: "compact [--trailing-only] IMAGE (--trailing-only truncates what follows the last cluster in use, moving nothing)",
+		run:   compact,
+	}
+}
+
+func compact(args []string) error {
+	fs := newFlagSet("compact")
+	trailingOnly := fs.Bool("trailing-only", false, "only truncate the data past the last cluster in use")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 1 {
+		return fmt.Errorf("compact: expected IMAGE")
+	}
+	img, err := openImageFile(operands[0], os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	compact := img.Compact
+	if *trailingOnly {
+		compact = img.TruncateTrailing
+	}
+	n, err := compact()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("reclaimed %d bytes\n", n)
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["compare"] = command{
+		usage:       "compare [--force-share] [--strict] [--trailing-zeros] [--count] [-f FORMAT] [-F FORMAT] A B (A and B are qcow2 or raw, probed unless given by -f and -F; exits 0 when identical, 1 when different, 2 on errors, 3 when only the allocation differs)",
+		run:         compare,
+		errorStatus: 2,
+	}
+}
+
+func compare(args []string) error {
+	fs := newFlagSet("compare")
+	forceShareFlag(fs)
+	trailingZeros := fs.Bool("trailing-zeros", false, "compare images of different sizes, the rest of the larger having to read as zeros")
+	count := fs.Bool("count", false, "count all differing bytes")
+	strict := fs.Bool("strict", false, "also compare how the images allocate their contents")
+	formatA := fs.String("f", "", "format of A, qcow2 or raw")
+	formatB := fs.String("F", "", "format of B, qcow2 or raw")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 2 {
+		return fmt.Errorf("compare: expected A and B")
+	}
+	var opts []qcow2.CompareOption
+	if *trailingZeros {
+		opts = append(opts, qcow2.CompareTrailingZeros())
+	}
+	if *count {
+		opts = append(opts, qcow2.CompareCountDiffering())
+	}
+	if *strict {
+		opts = append(opts, qcow2.CompareStrict())
+	}
+	a, closeA, err := openCompared(operands[0], *formatA)
+	if err != nil {
+		return err
+	}
+	defer closeA()
+	b, closeB, err := openCompared(operands[1], *formatB)
+	if err != nil {
+		return err
+	}
+	defer closeB()
+
+	res, err := qcow2.Compare(a, b, opts...)
+	if err != nil {
+		return err
+	}
+	for _, m := range res.AllocationMismatches {
+		fmt.Printf("Allocation mismatch at offset %d, %d bytes: %s and %s\n", m.Start, m.Length, describeAllocation(m.A), describeAllocation(m.B))
+	}
+	switch {
+	case res.Identical && len(res.AllocationMismatches) > 0:
+		fmt.Println("Image contents are identical.")
+		return exitStatus(3)
+	case res.Identical:
+		fmt.Println("Images are identical.")
+		return nil
+	case res.SizeMismatch:
+		fmt.Printf("Image size mismatch: %d and %d bytes\n", a.Size(), b.Size())
+	default:
+		fmt.Printf("Content mismatch at offset %d!\n", res.FirstDifference)
+		if *count {
+			fmt.Printf("%d bytes differ\n", res.DifferingBytes)
+		}
+	}
+	return exitStatus(1)
+}
+
+// openCompared opens the named file of the format to compare, probing it
+// when format is empty. A raw file is read through a temporary overlay that
+// has it as its backing file, and which the returned function removes.
+func openCompared(name, format string) (*qcow2.Image, func(), error) {
+	var err error
+	if format == "" {
+		if format, err = probe(name); err != nil {
+			return nil, nil, err
+		}
+	}
+	switch format {
+	case "qcow2":
+		img, err := openImage(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return img, func() { img.Close() }, nil
+	case "raw":
+	default:
+		return nil, nil, fmt.Errorf("compare: unsupported format %q", format)
+	}
+	path, err := filepath.Abs(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	size := rawFile{fh}.Size()
+	fh.Close()
+	dir, err := os.MkdirTemp("", "qcow2-compare")
+	if err != nil {
+		return nil, nil, err
+	}
+	img, err := qcow2.Create(filepath.Join(dir, "overlay.qcow2"), size, &qcow2.CreateOptions{BackingFile: path, BackingFormat: "raw"}, imageOptions(nil)...)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	return img, func() {
+		img.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+// describeAllocation names how an extent is mapped
+func describeAllocation(e qcow2.Extent) string {
+	if e.Type != qcow2.ExtentUnallocated && e.Depth > 0 {
+		return fmt.Sprintf("%s in the backing file", e.Type)
+	}
+	return e.Type.String()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// container is a compression an image may be shipped in, as a whole file
+// (image.qcow2.xz), around the image rather than within its clusters
+type container struct {
+	name  string
+	magic []byte
+	// command decompresses the container from stdin to stdout, for those
+	// the standard library has no reader of
+	command string
+}
+
+var containers = []*container{
+	{name: "gzip", magic: []byte{0x1f, 0x8b}},
+	{name: "xz", magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0}, command: "xz"},
+	{name: "zstd", magic: []byte{0x28, 0xb5, 0x2f, 0xfd}, command: "zstd"},
+}
+
+// containerMagicLen is the length of the longest magic of containers
+const containerMagicLen = 6
+
+// sniffContainer is the container whose magic starts b, or nil
+func sniffContainer(b []byte) *container {
+	for _, c := range containers {
+		if bytes.HasPrefix(b, c.magic) {
+			return c
+		}
+	}
+	return nil
+}
+
+// containerOf is the container of the file at name, or nil when it is not
+// compressed
+func containerOf(name string) (*container, error) {
+	fh, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	b := make([]byte, containerMagicLen)
+	n, err := io.ReadFull(fh, b)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return sniffContainer(b[:n]), nil
+}
+
+// errCompressed is the error of the commands that read images at random,
+// when given one in a container
+type errCompressed struct {
+	c *container
+}
+
+func (e errCompressed) Error() string {
+	return fmt.Sprintf("the image is %s-compressed as a whole, and random access into it is not supported: decompress it first (only its header can be read as it is, by info, ext-list and ext-dump)", e.c.name)
+}
+
+// checkCompressed is errCompressed when the file at name is in a container,
+// to explain why err, of opening it as an image, happened
+func checkCompressed(name string, err error) error {
+	if c, cerr := containerOf(name); cerr == nil && c != nil {
+		return fmt.Errorf("%s: %w", name, errCompressed{c})
+	}
+	return err
+}
+
+// openContainer is what r holds, decompressed when it starts with the magic
+// of a container, which is then returned too. Closing the reader ends the
+// decompression, which the rest of r is left to once the header is read.
+func openContainer(r io.Reader) (io.ReadCloser, *container, error) {
+	br := bufio.NewReader(r)
+	// a short stream is not one of a container, and its error is the
+	// header's to report
+	magic, _ := br.Peek(containerMagicLen)
+	c := sniffContainer(magic)
+	if c == nil {
+		return io.NopCloser(br), nil, nil
+	}
+	if c.command == "" {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, c, fmt.Errorf("in a %s container: %w", c.name, err)
+		}
+		return zr, c, nil
+	}
+	rc, err := startDecompressor(c, br)
+	return rc, c, err
+}
+
+// decompressor is the output of a command decompressing a container
+type decompressor struct {
+	io.ReadCloser
+	in  io.WriteCloser
+	cmd *exec.Cmd
+}
+
+// startDecompressor runs the command of c on what is left of r. It is fed
+// here rather than by exec, whose copy Wait would wait for on a stdin that
+// may never end.
+func startDecompressor(c *container, r io.Reader) (*decompressor, error) {
+	cmd := exec.Command(c.command, "-dc")
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("in a %s container, which needs the %s command to decompress, and it is not installed", c.name, c.command)
+		}
+		return nil, fmt.Errorf("in a %s container: %w", c.name, err)
+	}
+	go func() {
+		io.Copy(in, r)
+		in.Close()
+	}()
+	return &decompressor{out, in, cmd}, nil
+}
+
+// Close stops the command, which is still decompressing what follows the
+// header. Closing its input first ends the copy feeding it at its next write,
+// rather than leaving it blocked on a pipe that nothing reads any more.
+func (d *decompressor) Close() error {
+	d.in.Close()
+	d.cmd.Process.Kill()
+	d.cmd.Wait()
+	return nil
+}
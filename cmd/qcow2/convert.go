@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["convert"] = command{
+		usage: "convert [--force-share] [-p] [-f raw|qcow2] -O raw|qcow2|vpc [-c] [--dedupe] [-o OPTIONS] [--jobs N] [--rate BYTES] [--size SIZE] SOURCE DEST (- is stdin or stdout)",
+		run:   convert,
+	}
+}
+
+func convert(args []string) error {
+	fs := newFlagSet("convert")
+	forceShareFlag(fs)
+	inFormat := fs.String("f", "", "input format, probed when empty")
+	format := fs.String("O", "raw", "output format")
+	createOpts := fs.String("o", "", "comma separated qcow2 options: cluster_size, preallocation, compat, refcount_bits")
+	size := fs.String("size", "", "virtual size of a raw SOURCE read from stdin")
+	compress := fs.Bool("c", false, "compress the data clusters of a qcow2 DEST")
+	compressionType := fs.String("compression-type", "zlib", "compression of the data clusters")
+	dedupe := fs.Bool("dedupe", false, "store identical data clusters of a qcow2 DEST once")
+	jobs := fs.Int("jobs", 0, "number of parallel workers, all CPUs when 0")
+	rate := fs.String("rate", "", "limit file I/O to this many bytes per second")
+	showProgress := fs.Bool("p", false, "show progress on a terminal")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 2 {
+		return fmt.Errorf("convert: expected SOURCE and DEST")
+	}
+	src, dst := operands[0], operands[1]
+	var limiter *qcow2.RateLimiter
+	if *rate != "" {
+		n, err := parseSize(*rate)
+		if err != nil {
+			return fmt.Errorf("convert: --rate: %w", err)
+		}
+		limiter = qcow2.NewRateLimiter(n)
+	}
+
+	if src == "-" {
+		if *format != "qcow2" {
+			return fmt.Errorf("convert: reading stdin requires -O qcow2")
+		}
+		if *size == "" {
+			return fmt.Errorf("convert: reading stdin requires --size")
+		}
+		n, err := parseSize(*size)
+		if err != nil {
+			return fmt.Errorf("convert: --size: %w", err)
+		}
+		opts, err := parseCreateOptions(*createOpts)
+		if err != nil {
+			return fmt.Errorf("convert: %w", err)
+		}
+		opts.Compress, opts.CompressionType, opts.Dedupe, opts.Jobs = *compress, *compressionType, *dedupe, *jobs
+		opts.RateLimiter, opts.Progress = limiter, progressBar(*showProgress)
+		if err := qcow2.ConvertStreamToQcow2(os.Stdin, n, dst, opts); err != nil {
+			return err
+		}
+		reportDedupe(opts)
+		if *compress {
+			return reportCompression(dst)
+		}
+		return nil
+	}
+	if *inFormat == "" {
+		var err error
+		if *inFormat, err = probe(src); err != nil {
+			return err
+		}
+	}
+	var in interface {
+		io.ReaderAt
+		io.Closer
+		Size() int64
+	}
+	switch *inFormat {
+	case "qcow2":
+		img, err := openImage(src, qcow2.WithRateLimiter(limiter))
+		if err != nil {
+			return err
+		}
+		in = img
+	case "raw":
+		fh, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		in = rawFile{fh}
+	default:
+		return fmt.Errorf("convert: unsupported input format %q", *inFormat)
+	}
+	defer in.Close()
+
+	switch *format {
+	case "raw":
+		if img, ok := in.(*qcow2.Image); ok {
+			if dst == "-" {
+				_, err := img.WriteRawTo(os.Stdout)
+				return err
+			}
+			return img.ConvertToRaw(dst, &qcow2.ConvertOptions{Jobs: *jobs, RateLimiter: limiter, Progress: progressBar(*showProgress), Logger: logger})
+		}
+		return fmt.Errorf("convert: the source is already raw")
+	case "vpc":
+		img, ok := in.(*qcow2.Image)
+		if !ok {
+			return fmt.Errorf("convert: -O vpc takes a qcow2 source")
+		}
+		if dst == "-" {
+			_, err := img.WriteVHDTo(os.Stdout)
+			return err
+		}
+		return img.ConvertToVHD(dst, &qcow2.ConvertOptions{Jobs: *jobs, RateLimiter: limiter, Progress: progressBar(*showProgress), Logger: logger})
+	case "qcow2":
+		opts, err := parseCreateOptions(*createOpts)
+		if err != nil {
+			return fmt.Errorf("convert: %w", err)
+		}
+		opts.Compress, opts.CompressionType, opts.Dedupe, opts.Jobs = *compress, *compressionType, *dedupe, *jobs
+		opts.RateLimiter, opts.Progress = limiter, progressBar(*showProgress)
+		var src io.ReaderAt = in
+		if rf, ok := in.(rawFile); ok {
+			// hand over the file itself, so its holes can be found
+			src = rf.File
+		}
+		if err := qcow2.ConvertRawToQcow2(src, in.Size(), dst, opts); err != nil {
+			return err
+		}
+		reportDedupe(opts)
+		if *compress {
+			return reportCompression(dst)
+		}
+		return nil
+	}
+	return fmt.Errorf("convert: unsupported output format %q", *format)
+}
+
+// reportCompression prints how the size of the compressed image compares to
+// the data it holds
+func reportCompression(name string) error {
+	img, err := openImage(name)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	var data int64
+	if err := img.WalkExtents(0, img.Size(), func(e qcow2.Extent) error {
+		if !e.ReadsAsZeros() {
+			data += e.Length
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	pct := 100.0
+	if data > 0 {
+		pct = float64(fi.Size()) * 100 / float64(data)
+	}
+	fmt.Fprintf(os.Stderr, "compressed %d bytes of data into an image of %d bytes (%.1f%%)\n", data, fi.Size(), pct)
+	return nil
+}
+
+// reportDedupe prints how much deduplication saved
+func reportDedupe(opts *qcow2.ConvertOptions) {
+	if !opts.Dedupe {
+		return
+	}
+	cs := opts.ClusterSize
+	if cs == 0 {
+		cs = 64 << 10
+	}
+	fmt.Fprintf(os.Stderr, "deduplicated %d clusters, saving %d bytes\n", opts.Deduplicated, opts.Deduplicated*cs)
+}
+
+// probe guesses the format of a file from its magic, as qcow2.ProbeFormat
+// does, but a compressed image is not one to take for a raw disk
+func probe(name string) (string, error) {
+	format, err := qcow2.ProbeFormat(name)
+	if err != nil || format != "raw" {
+		return format, err
+	}
+	if err := checkCompressed(name, nil); err != nil {
+		return "", err
+	}
+	return format, nil
+}
+
+// rawFile is a raw disk image
+type rawFile struct {
+	*os.File
+}
+
+// Size is the size of the file, or of the device when it is a block device
+func (f rawFile) Size() int64 {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+	if fi.Mode()&os.ModeDevice != 0 {
+		n, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0
+		}
+		return n
+	}
+	return fi.Size()
+}
+
+// parseCreateOptions reads the -o options, named as by qemu-img
+func parseCreateOptions(s string) (*qcow2.ConvertOptions, error) {
+	opts := &qcow2.ConvertOptions{Logger: logger}
+	if s == "" {
+		return opts, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(kv, "=")
+		var err error
+		switch k {
+		case "cluster_size":
+			opts.ClusterSize, err = parseSize(v)
+		case "preallocation":
+			opts.Preallocation = v
+		case "compat":
+			switch v {
+			case "0.10":
+				opts.Version = 2
+			case "1.1", "v3":
+				opts.Version = 3
+			default:
+				err = fmt.Errorf("unknown compat level %q", v)
+			}
+		case "refcount_bits":
+			opts.RefcountBits, err = strconv.Atoi(v)
+		case "backing_file":
+			opts.BackingFile = v
+		case "backing_fmt":
+			opts.BackingFormat = v
+		case "extended_l2":
+			opts.ExtendedL2, err = parseOnOff(v)
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("-o %s: %w", kv, err)
+		}
+	}
+	return opts, nil
+}
+
+// parseOnOff reads a boolean option
+func parseOnOff(s string) (bool, error) {
+	switch s {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected on or off, not %q", s)
+}
+
+// parseSize reads a byte count as qcow2.ParseSize does, or in hex when it
+// starts with 0x
+func parseSize(s string) (int64, error) {
+	if hex, ok := strings.CutPrefix(s, "0x"); ok {
+		return strconv.ParseInt(hex, 16, 64)
+	}
+	return qcow2.ParseSize(s)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["create"] = command{
+		usage: "create [-f qcow2] [-o OPTIONS] [-b BACKING [-F FORMAT]] IMAGE [SIZE] (SIZE defaults to that of BACKING)",
+		run:   create,
+	}
+}
+
+func create(args []string) error {
+	fs := newFlagSet("create")
+	format := fs.String("f", "qcow2", "format of the image")
+	createOpts := fs.String("o", "", "comma separated qcow2 options: cluster_size, preallocation, compat, refcount_bits, backing_file, backing_fmt")
+	backing := fs.String("b", "", "backing file of the image")
+	backingFormat := fs.String("F", "", "format of the backing file")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 1 && len(operands) != 2 {
+		return fmt.Errorf("create: expected IMAGE and SIZE")
+	}
+	if *format != "qcow2" {
+		return fmt.Errorf("create: unsupported format %q", *format)
+	}
+	opts, err := parseCreateOptions(*createOpts)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	if *backing != "" {
+		opts.BackingFile = *backing
+	}
+	if *backingFormat != "" {
+		opts.BackingFormat = *backingFormat
+	}
+
+	var size int64
+	if len(operands) == 2 {
+		if size, err = parseSize(operands[1]); err != nil {
+			return fmt.Errorf("create: SIZE: %w", err)
+		}
+	} else {
+		if opts.BackingFile == "" {
+			return fmt.Errorf("create: expected SIZE, or a backing file to take it from")
+		}
+		if size, err = backingSize(operands[0], opts.BackingFile, opts.BackingFormat); err != nil {
+			return err
+		}
+	}
+	img, err := qcow2.Create(operands[0], size, &opts.CreateOptions, qcow2.WithLogger(logger))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Formatting '%s', fmt=qcow2 cluster_size=%d size=%d\n", operands[0], img.Header.ClusterSize(), img.Size())
+	return img.Close()
+}
+
+// backingSize is the virtual size of the backing file of the image to be
+// created at name, found relative to the image as it will be when opened, and
+// read as format, or as what its magic says when format is empty
+func backingSize(name, backing, format string) (int64, error) {
+	path := backing
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(name), path)
+	}
+	var err error
+	if format == "" {
+		if format, err = probe(path); err != nil {
+			return 0, err
+		}
+	}
+	if format == "raw" {
+		fh, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer fh.Close()
+		return rawFile{fh}.Size(), nil
+	}
+	base, err := openImage(path, qcow2.WithNoLock())
+	if err != nil {
+		return 0, err
+	}
+	defer base.Close()
+	return base.Size(), nil
+}
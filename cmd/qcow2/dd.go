@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+func init() {
+	commands["dd"] = command{
+		usage: "dd [if=SOURCE] [of=DEST] [skip=OFFSET] [seek=OFFSET] [count=BYTES] [bs=N] [conv=sparse] (offsets and counts are in bytes, SOURCE is stdin, read as raw, and DEST stdout by default)",
+		run:   dd,
+	}
+}
+
+// ddOperands are the operands of dd, in bytes
+type ddOperands struct {
+	in, out    string
+	skip, seek int64
+	count      int64 // -1 copies to the end of the input
+	bs         int64
+	sparse     bool
+}
+
+func parseDDOperands(args []string) (*ddOperands, error) {
+	o := &ddOperands{count: -1, bs: 64 << 10}
+	for _, arg := range args {
+		k, v, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, fmt.Errorf("dd: expected KEY=VALUE, not %q", arg)
+		}
+		var err error
+		switch k {
+		case "if":
+			o.in = v
+		case "of":
+			o.out = v
+		case "skip":
+			o.skip, err = parseSize(v)
+		case "seek":
+			o.seek, err = parseSize(v)
+		case "count":
+			o.count, err = parseSize(v)
+		case "bs":
+			o.bs, err = parseSize(v)
+		case "conv":
+			for _, c := range strings.Split(v, ",") {
+				if c != "sparse" {
+					return nil, fmt.Errorf("dd: unsupported conversion %q", c)
+				}
+				o.sparse = true
+			}
+		default:
+			return nil, fmt.Errorf("dd: unknown operand %q", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("dd: %s: %w", arg, err)
+		}
+	}
+	if o.in == "" {
+		o.in = stdinName
+	}
+	switch {
+	case o.skip < 0 || o.seek < 0:
+		return nil, errors.New("dd: negative offset")
+	case o.bs <= 0:
+		return nil, errors.New("dd: bs must be positive")
+	}
+	return o, nil
+}
+
+func dd(args []string) error {
+	o, err := parseDDOperands(args)
+	if err != nil {
+		return err
+	}
+	// n is what is copied, or -1 from stdin, whose length is not known
+	var src io.Reader
+	n := int64(-1)
+	if o.in == stdinName {
+		if _, err := io.CopyN(io.Discard, os.Stdin, o.skip); err != nil && err != io.EOF {
+			return err
+		}
+		src = os.Stdin
+		if o.count >= 0 {
+			src = io.LimitReader(os.Stdin, o.count)
+		}
+	} else {
+		in, size, err := openInput(o.in)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		n = max(0, size-o.skip)
+		if o.count >= 0 {
+			n = min(n, o.count)
+		}
+		src = io.NewSectionReader(in, o.skip, n)
+	}
+
+	if o.out == "" || o.out == "-" {
+		_, err := io.CopyBuffer(os.Stdout, src, make([]byte, o.bs))
+		return err
+	}
+	format := "raw"
+	if _, err := os.Stat(o.out); err == nil {
+		if format, err = probe(o.out); err != nil {
+			return err
+		}
+	}
+	if format == "qcow2" {
+		img, err := openImageFile(o.out, os.O_RDWR)
+		if err != nil {
+			return err
+		}
+		// what goes past the end from stdin fails to be written instead
+		if n >= 0 && o.seek+n > img.Size() {
+			img.Close()
+			return fmt.Errorf("dd: writing %d bytes at %d is beyond the virtual size %d of %s", n, o.seek, img.Size(), o.out)
+		}
+		if _, err := ddCopy(img, src, o); err != nil {
+			img.Close()
+			return err
+		}
+		return img.Close()
+	}
+	out, err := os.OpenFile(o.out, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// like dd, the output ends with what was copied
+	if err := out.Truncate(o.seek); err != nil {
+		out.Close()
+		return err
+	}
+	copied, err := ddCopy(out, src, o)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	// skipped zeros at the end still count
+	if err := out.Truncate(o.seek + copied); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// openInput opens a raw file or qcow2 image to read, returning its size
+func openInput(name string) (interface {
+	io.ReaderAt
+	io.Closer
+}, int64, error) {
+	format, err := probe(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if format == "qcow2" {
+		img, err := openImage(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		return img, img.Size(), nil
+	}
+	fh, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return fh, rawFile{fh}.Size(), nil
+}
+
+// ddCopy copies src to w at o.seek in blocks of o.bs, leaving out the blocks
+// of zeros with o.sparse, and returns the number of bytes copied
+func ddCopy(w io.WriterAt, src io.Reader, o *ddOperands) (int64, error) {
+	buf := make([]byte, o.bs)
+	off := o.seek
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			if !o.sparse || !allZeros(buf[:n]) {
+				if _, werr := w.WriteAt(buf[:n], off); werr != nil {
+					return off - o.seek, werr
+				}
+			}
+			off += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return off - o.seek, nil
+		}
+		if err != nil {
+			return off - o.seek, err
+		}
+	}
+}
+
+func allZeros(p []byte) bool {
+	return len(bytes.TrimLeft(p, "\x00")) == 0
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+)
+
+func init() {
+	commands["diff"] = command{
+		usage: "diff [-p] --base OLD [-o OPTIONS] NEW DELTA (DELTA is backed by OLD and reads as NEW)",
+		run:   diff,
+	}
+}
+
+func diff(args []string) error {
+	fs := newFlagSet("diff")
+	baseName := fs.String("base", "", "the image DELTA is backed by")
+	createOpts := fs.String("o", "", "comma separated qcow2 options: cluster_size, compat, refcount_bits, backing_file")
+	showProgress := fs.Bool("p", false, "show progress on a terminal")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 2 || *baseName == "" {
+		return fmt.Errorf("diff: expected --base OLD, NEW and DELTA")
+	}
+	opts, err := parseCreateOptions(*createOpts)
+	if err != nil {
+		return fmt.Errorf("diff: %w", err)
+	}
+	opts.Progress = progressBar(*showProgress)
+	base, err := openImage(*baseName)
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+	img, err := openImage(operands[0])
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	return img.Diff(base, operands[1], opts)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["digests"] = command{
+		usage: "digests [--force-share] [--granularity BYTES] [--json] [--hex] [--jobs N] IMAGE (one SHA-256 per block, all zeros for blocks of zeros)",
+		run:   digests,
+	}
+}
+
+func digests(args []string) error {
+	fs := newFlagSet("digests")
+	forceShareFlag(fs)
+	granularity := fs.String("granularity", "", "block size, the cluster size by default")
+	asJSON := fs.Bool("json", false, "print a JSON record per line")
+	jobs := fs.Int("jobs", 0, "number of blocks read and hashed in parallel, all CPUs when 0")
+	r := hexFlag(fs, false)
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 1 {
+		return fmt.Errorf("digests: expected IMAGE")
+	}
+	var g int64
+	if *granularity != "" {
+		var err error
+		if g, err = parseSize(*granularity); err != nil {
+			return fmt.Errorf("digests: --granularity: %w", err)
+		}
+	}
+	img, err := openImage(operands[0])
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	w := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(w)
+	err = img.DigestsContext(context.Background(), &qcow2.DigestOptions{Granularity: g, Jobs: *jobs}, func(b qcow2.BlockDigest) error {
+		if *asJSON {
+			return enc.Encode(struct {
+				Offset    int64   `json:"offset"`
+				OffsetHex *string `json:"offset-hex,omitempty"`
+				Length    int64   `json:"length"`
+				LengthHex *string `json:"length-hex,omitempty"`
+				Type      string  `json:"type"`
+				SHA256    string  `json:"sha256"`
+			}{b.Start, r.field(b.Start), b.Length, r.field(b.Length), b.Type.String(), hex.EncodeToString(b.Sum[:])})
+		}
+		_, err := fmt.Fprintf(w, "%s %s %s %x\n", r.format(b.Start), r.format(b.Length), b.Type, b.Sum)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"syscall"
+
+	"github.com/vbatts/qcow2"
+)
+
+// The exit statuses of the commands, but for those of check and compare,
+// which exit as qemu-img does
+const (
+	exitOK = 0
+	// exitUsage is for bad flags and operands, and the failures of no other
+	// class
+	exitUsage = 1
+	// exitIO is for files that are missing or can not be read or written
+	exitIO = 2
+	// exitNotQcow2 is for files that are not qcow2 images, as they are
+	exitNotQcow2 = 3
+	// exitUnsupported is for images of a version, feature or encryption
+	// this tool does not support
+	exitUnsupported = 4
+	// exitCorrupt is for images whose metadata is corrupt, or that fail
+	// verification
+	exitCorrupt = 5
+)
+
+const exitCodes = `
+Exit status:
+  0  success
+  1  bad flags or operands, or a failure of no other class
+  2  a file is missing, or can not be read or written
+  3  not a qcow2 image
+  4  an unsupported version, feature or encryption
+  5  a corrupt image, or one failing verify
+check and compare exit as qemu-img does instead, as their help says.
+`
+
+// errBadFlags is returned for the bad flags of a command, which the flag set
+// has reported
+var errBadFlags = errors.New("bad flags")
+
+// exitCode is the exit status of a command failing with err, by the class of
+// the error: an exitStatus is its own
+func exitCode(err error) int {
+	var (
+		status     exitStatus
+		version    qcow2.UnsupportedVersionError
+		features   qcow2.UnsupportedFeaturesError
+		corrupt    qcow2.CorruptionError
+		compressed errCompressed
+		pathErr    *fs.PathError
+		errno      syscall.Errno
+	)
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &status):
+		return int(status)
+	case errors.Is(err, errBadFlags):
+		return exitUsage
+	case errors.Is(err, qcow2.ErrBadMagic), errors.As(err, &compressed):
+		return exitNotQcow2
+	case errors.As(err, &version), errors.As(err, &features), errors.Is(err, qcow2.ErrEncrypted), errors.Is(err, qcow2.ErrExtensionsSkipped):
+		return exitUnsupported
+	// an image whose header is cut short is corrupt too
+	case errors.As(err, &corrupt), errors.Is(err, qcow2.ErrInvalidEntry), errors.Is(err, qcow2.ErrNeedsRepair), errors.Is(err, qcow2.ErrBackingLoop), errors.Is(err, io.ErrUnexpectedEOF):
+		return exitCorrupt
+	case errors.As(err, &pathErr), errors.As(err, &errno), errors.Is(err, qcow2.ErrLocked), errors.Is(err, errNotSeekable):
+		return exitIO
+	}
+	return exitUsage
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["ext-dump"] = command{
+		usage: "ext-dump --type TYPE [--index N] [-o FILE] IMAGE (writes the data of a header extension, to stdout by default)",
+		run:   extDump,
+	}
+}
+
+func extDump(args []string) error {
+	fs := newFlagSet("ext-dump")
+	typeArg := fs.String("type", "", "type of the extension, as 0x12345678")
+	index := fs.Int("index", 0, "which of the extensions of the type, from 0")
+	out := fs.String("o", "-", "file to write the data to, - for stdout")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 1 || *typeArg == "" {
+		return fmt.Errorf("ext-dump: expected --type and IMAGE")
+	}
+	t, err := strconv.ParseUint(*typeArg, 0, 32)
+	if err != nil || t == 0 {
+		return fmt.Errorf("ext-dump: invalid extension type %q", *typeArg)
+	}
+	h, _, err := readHeaderOnly(operands[0])
+	if err != nil {
+		return err
+	}
+	var found []qcow2.ExtHeader
+	for _, e := range h.ExtHeaders {
+		if e.Type == qcow2.HeaderExtensionType(t) {
+			found = append(found, e)
+		}
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("ext-dump: %s has no extension of type %#08x", operands[0], t)
+	}
+	if *index < 0 || *index >= len(found) {
+		return fmt.Errorf("ext-dump: %s has %d extensions of type %#08x, not one at index %d", operands[0], len(found), t, *index)
+	}
+	data := found[*index].Data
+	if *out == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	fh, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if _, err := fh.Write(data); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
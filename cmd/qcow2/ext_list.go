@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+func init() {
+	commands["ext-list"] = command{
+		usage: "ext-list [--hex] IMAGE (the header extensions, with a preview of their data)",
+		run:   extList,
+	}
+}
+
+// extPreview is how many bytes of data ext-list shows
+const extPreview = 16
+
+func extList(args []string) error {
+	fs := newFlagSet("ext-list")
+	r := hexFlag(fs, false)
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 1 {
+		return fmt.Errorf("ext-list: expected IMAGE")
+	}
+	h, c, err := readHeaderOnly(operands[0])
+	if err != nil {
+		return err
+	}
+	if c != nil {
+		fmt.Printf("read from a %s container: the offsets are those of the decompressed image\n", c.name)
+	}
+	table := [][]string{{"INDEX", "TYPE", "NAME", "OFFSET", "SIZE", "DATA"}}
+	for i, e := range h.ExtHeaders {
+		preview := fmt.Sprintf("%x", e.Data[:min(len(e.Data), extPreview)])
+		if len(e.Data) > extPreview {
+			preview += "..."
+		}
+		table = append(table, []string{strconv.Itoa(i), fmt.Sprintf("%#08x", uint32(e.Type)), e.Type.String(), r.format(h.ExtensionOffset(i)), r.format(int64(e.Size)), preview})
+	}
+	printTable(table)
+	return nil
+}
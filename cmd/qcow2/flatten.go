@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["flatten"] = command{
+		usage: "flatten [-p] [-c|--keep-compressed] [--dedupe] [-o OPTIONS] [--jobs N] [--rate BYTES] IMAGE DEST",
+		run:   flatten,
+	}
+}
+
+func flatten(args []string) error {
+	fs := newFlagSet("flatten")
+	createOpts := fs.String("o", "", "comma separated qcow2 options: cluster_size, preallocation, compat, refcount_bits")
+	compress := fs.Bool("c", false, "compress all the data clusters of DEST")
+	keepCompressed := fs.Bool("keep-compressed", false, "compress the clusters of DEST that are compressed in the chain")
+	dedupe := fs.Bool("dedupe", false, "store identical data clusters of DEST once")
+	jobs := fs.Int("jobs", 0, "number of parallel workers, all CPUs when 0")
+	rate := fs.String("rate", "", "limit file I/O to this many bytes per second")
+	showProgress := fs.Bool("p", false, "show progress on a terminal")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 2 {
+		return fmt.Errorf("flatten: expected IMAGE and DEST")
+	}
+	opts, err := parseCreateOptions(*createOpts)
+	if err != nil {
+		return fmt.Errorf("flatten: %w", err)
+	}
+	if opts.BackingFile != "" {
+		return fmt.Errorf("flatten: DEST cannot have a backing file")
+	}
+	var limiter *qcow2.RateLimiter
+	if *rate != "" {
+		n, err := parseSize(*rate)
+		if err != nil {
+			return fmt.Errorf("flatten: --rate: %w", err)
+		}
+		limiter = qcow2.NewRateLimiter(n)
+	}
+	opts.Compress, opts.KeepCompressed, opts.Dedupe, opts.Jobs = *compress, *keepCompressed, *dedupe, *jobs
+	opts.RateLimiter, opts.Progress = limiter, progressBar(*showProgress)
+
+	img, err := openImage(operands[0], qcow2.WithRateLimiter(limiter))
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	if err := img.Flatten(operands[1], opts); err != nil {
+		return err
+	}
+	reportDedupe(opts)
+	return nil
+}
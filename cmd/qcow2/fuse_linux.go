@@ -0,0 +1,411 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// The FUSE protocol of the kernel, as in include/uapi/linux/fuse.h, for a
+// read-only file system of a fixed tree
+const (
+	fuseLookup      = 1
+	fuseForget      = 2
+	fuseGetattr     = 3
+	fuseOpen        = 14
+	fuseRead        = 15
+	fuseStatfs      = 17
+	fuseRelease     = 18
+	fuseFlush       = 25
+	fuseInit        = 26
+	fuseOpendir     = 27
+	fuseReaddir     = 28
+	fuseReleasedir  = 29
+	fuseAccess      = 34
+	fuseInterrupt   = 36
+	fuseDestroy     = 38
+	fuseBatchForget = 42
+
+	fuseKernelVersion = 7
+	// fuseMinorVersion is the newest ABI whose replies are laid out as here
+	fuseMinorVersion = 31
+	fuseMaxPagesFlag = 1 << 22
+	fuseMaxPages     = 256
+	fuseKeepCache    = 1 << 1
+	fuseRootID       = 1
+	fuseInHeaderSize = 40
+	// fuseBufferSize holds the largest request, a read of fuseMaxPages
+	// being the largest reply
+	fuseBufferSize = 1<<20 + 4096
+	// fuseValid is how long the kernel caches the names and attributes of
+	// the files, which never change while mounted
+	fuseValid = time.Minute
+)
+
+// fuseServer serves the tree of nodes mounted at dir over the FUSE device
+// fd, the nodes numbered from fuseRootID in the order of a walk of the tree
+type fuseServer struct {
+	fd      int
+	nodes   []*fuseNode
+	parents []uint64
+	mtime   time.Time
+}
+
+func fuseMountAndServe(dir, fsname string, root *fuseNode, mtime time.Time) error {
+	dev, unmount, err := fuseMount(dir, fsname)
+	if err != nil {
+		return fmt.Errorf("mount: %w", err)
+	}
+	defer dev.Close()
+	s := &fuseServer{fd: int(dev.Fd()), mtime: mtime}
+	s.add(root, fuseRootID)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		<-sig
+		// the kernel ends the requests once unmounted, which ends serve
+		if err := unmount(); err != nil {
+			logger.Warn("unmounting failed", "mountpoint", dir, "err", err)
+		}
+	}()
+	logger.Info("mounted", "image", fsname, "mountpoint", dir)
+	return s.serve()
+}
+
+func (s *fuseServer) add(n *fuseNode, parent uint64) {
+	s.nodes, s.parents = append(s.nodes, n), append(s.parents, parent)
+	id := uint64(len(s.nodes))
+	for _, c := range n.children {
+		s.add(c, id)
+	}
+}
+
+// fuseMount mounts the FUSE file system of fsname at dir, returning the
+// device to serve it on and how to unmount it: directly as root, or else by
+// fusermount
+func fuseMount(dir, fsname string) (*os.File, func() error, error) {
+	maxRead := fuseMaxPages * os.Getpagesize()
+	if os.Geteuid() == 0 {
+		dev, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		data := fmt.Sprintf("fd=%d,rootmode=40000,user_id=0,group_id=0,default_permissions,allow_other,max_read=%d", dev.Fd(), maxRead)
+		if err := syscall.Mount(fsname, dir, "fuse.qcow2", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, data); err != nil {
+			dev.Close()
+			return nil, nil, &os.PathError{Op: "mount", Path: dir, Err: err}
+		}
+		return dev, func() error {
+			if err := syscall.Unmount(dir, 0); err == syscall.EBUSY {
+				// still in use: detached, it goes once the last user does
+				return syscall.Unmount(dir, syscall.MNT_DETACH)
+			} else if err != nil {
+				return err
+			}
+			return nil
+		}, nil
+	}
+
+	bin, err := exec.LookPath("fusermount3")
+	if err != nil {
+		if bin, err = exec.LookPath("fusermount"); err != nil {
+			return nil, nil, errors.New("mounting takes root, or fusermount3 or fusermount to be installed")
+		}
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	ours, theirs := os.NewFile(uintptr(fds[0]), "fusermount"), os.NewFile(uintptr(fds[1]), "fusermount")
+	defer ours.Close()
+	cmd := exec.Command(bin, "-o", fmt.Sprintf("ro,nosuid,nodev,default_permissions,fsname=%s,subtype=qcow2,max_read=%d", fsname, maxRead), "--", dir)
+	cmd.ExtraFiles = []*os.File{theirs}
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	err = cmd.Run()
+	theirs.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", bin, err)
+	}
+	// the device comes back over the socket
+	conn, err := net.FileConn(ours)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := conn.(*net.UnixConn).ReadMsgUnix(make([]byte, 1), oob)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", bin, err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return nil, nil, fmt.Errorf("%s did not pass the FUSE device", bin)
+	}
+	devFds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(devFds) != 1 {
+		return nil, nil, fmt.Errorf("%s did not pass the FUSE device", bin)
+	}
+	return os.NewFile(uintptr(devFds[0]), "/dev/fuse"), func() error {
+		return exec.Command(bin, "-u", "-z", "--", dir).Run()
+	}, nil
+}
+
+// serve answers the requests of the kernel one at a time, until the file
+// system is unmounted
+func (s *fuseServer) serve() error {
+	buf := make([]byte, fuseBufferSize)
+	for {
+		n, err := syscall.Read(s.fd, buf)
+		switch err {
+		case nil:
+		case syscall.EINTR, syscall.EAGAIN, syscall.ENOENT:
+			// ENOENT is a request interrupted before it was read
+			continue
+		case syscall.ENODEV:
+			logger.Info("unmounted")
+			return nil
+		default:
+			return fmt.Errorf("mount: reading the FUSE device: %w", err)
+		}
+		if n < fuseInHeaderSize {
+			return fmt.Errorf("mount: short FUSE request of %d bytes", n)
+		}
+		if done := s.handle(buf[:n]); done {
+			return nil
+		}
+	}
+}
+
+// handle answers the request req, reporting whether it ends the session
+func (s *fuseServer) handle(req []byte) bool {
+	ne := binary.NativeEndian
+	opcode, unique, nodeid := ne.Uint32(req[4:]), ne.Uint64(req[8:]), ne.Uint64(req[16:])
+	in := req[fuseInHeaderSize:]
+	logger.Debug("FUSE request", "opcode", opcode, "node", nodeid)
+	var node *fuseNode
+	if nodeid >= fuseRootID && nodeid <= uint64(len(s.nodes)) {
+		node = s.nodes[nodeid-1]
+	}
+
+	switch opcode {
+	case fuseForget, fuseBatchForget, fuseInterrupt:
+		// no reply: the nodes live as long as the mount
+		return false
+	case fuseInit:
+		major, minor, readahead, flags := ne.Uint32(in), ne.Uint32(in[4:]), ne.Uint32(in[8:]), ne.Uint32(in[12:])
+		if major < fuseKernelVersion {
+			s.reply(unique, syscall.EPROTO, nil)
+			return true
+		}
+		out := make([]byte, 64)
+		ne.PutUint32(out, fuseKernelVersion)
+		ne.PutUint32(out[4:], min(minor, fuseMinorVersion))
+		ne.PutUint32(out[8:], readahead)
+		ne.PutUint32(out[12:], flags&fuseMaxPagesFlag)
+		ne.PutUint16(out[16:], 16)      // max_background
+		ne.PutUint16(out[18:], 12)      // congestion_threshold
+		ne.PutUint32(out[20:], 128<<10) // max_write
+		ne.PutUint32(out[24:], 1)       // time_gran
+		ne.PutUint16(out[28:], fuseMaxPages)
+		if major == fuseKernelVersion && minor < 23 {
+			out = out[:24]
+		}
+		s.reply(unique, 0, out)
+		return false
+	case fuseDestroy:
+		s.reply(unique, 0, nil)
+		return true
+	}
+	if node == nil {
+		s.reply(unique, syscall.ENOENT, nil)
+		return false
+	}
+
+	switch opcode {
+	case fuseLookup:
+		name := string(in)
+		if i := bytes.IndexByte(in, 0); i >= 0 {
+			name = string(in[:i])
+		}
+		for i, c := range node.children {
+			if c.name == name {
+				s.reply(unique, 0, s.entry(s.childID(nodeid, i)))
+				return false
+			}
+		}
+		s.reply(unique, syscall.ENOENT, nil)
+	case fuseGetattr:
+		out := make([]byte, 16, 104)
+		ne.PutUint64(out, uint64(fuseValid/time.Second))
+		s.reply(unique, 0, append(out, s.attr(nodeid)...))
+	case fuseOpen, fuseOpendir:
+		flags := ne.Uint32(in)
+		switch {
+		case opcode == fuseOpen && node.r == nil:
+			s.reply(unique, syscall.EISDIR, nil)
+		case opcode == fuseOpendir && node.r != nil:
+			s.reply(unique, syscall.ENOTDIR, nil)
+		case flags&syscall.O_ACCMODE != syscall.O_RDONLY:
+			s.reply(unique, syscall.EROFS, nil)
+		default:
+			out := make([]byte, 16)
+			if opcode == fuseOpen {
+				ne.PutUint32(out[8:], fuseKeepCache)
+			}
+			s.reply(unique, 0, out)
+		}
+	case fuseRead:
+		off, size := int64(ne.Uint64(in[8:])), int64(ne.Uint32(in[16:]))
+		if node.r == nil {
+			s.reply(unique, syscall.EISDIR, nil)
+			return false
+		}
+		if off >= node.size {
+			s.reply(unique, 0, nil)
+			return false
+		}
+		p := make([]byte, min(size, node.size-off))
+		if _, err := node.r.ReadAt(p, off); err != nil && err != io.EOF {
+			logger.Warn("FUSE read failed", "file", node.name, "offset", off, "length", len(p), "err", err)
+			s.reply(unique, syscall.EIO, nil)
+			return false
+		}
+		s.reply(unique, 0, p)
+	case fuseReaddir:
+		if node.r != nil {
+			s.reply(unique, syscall.ENOTDIR, nil)
+			return false
+		}
+		s.reply(unique, 0, s.readdir(nodeid, int64(ne.Uint64(in[8:])), int(ne.Uint32(in[16:]))))
+	case fuseStatfs:
+		var total int64
+		for _, n := range s.nodes {
+			total += n.size
+		}
+		out := make([]byte, 80)
+		ne.PutUint64(out, uint64((total+4095)/4096))
+		ne.PutUint64(out[24:], uint64(len(s.nodes)))
+		ne.PutUint32(out[40:], 4096) // bsize
+		ne.PutUint32(out[44:], 255)  // namelen
+		ne.PutUint32(out[48:], 4096) // frsize
+		s.reply(unique, 0, out)
+	case fuseRelease, fuseReleasedir, fuseFlush, fuseAccess:
+		s.reply(unique, 0, nil)
+	default:
+		s.reply(unique, syscall.ENOSYS, nil)
+	}
+	return false
+}
+
+// childID is the node number of child i of the node id
+func (s *fuseServer) childID(id uint64, i int) uint64 {
+	for c := id + 1; c <= uint64(len(s.nodes)); c++ {
+		if s.parents[c-1] == id {
+			if i == 0 {
+				return c
+			}
+			i--
+		}
+	}
+	panic("fuse: no such child")
+}
+
+// entry is the fuse_entry_out of the node id
+func (s *fuseServer) entry(id uint64) []byte {
+	ne := binary.NativeEndian
+	out := make([]byte, 40, 128)
+	ne.PutUint64(out, id)
+	ne.PutUint64(out[16:], uint64(fuseValid/time.Second))
+	ne.PutUint64(out[24:], uint64(fuseValid/time.Second))
+	return append(out, s.attr(id)...)
+}
+
+// attr is the fuse_attr of the node id
+func (s *fuseServer) attr(id uint64) []byte {
+	ne := binary.NativeEndian
+	n := s.nodes[id-1]
+	out := make([]byte, 88)
+	ne.PutUint64(out, id)
+	ne.PutUint64(out[8:], uint64(n.size))
+	ne.PutUint64(out[16:], uint64((n.size+511)/512))
+	for _, at := range []int{24, 32, 40} {
+		ne.PutUint64(out[at:], uint64(s.mtime.Unix()))
+		ne.PutUint32(out[48+(at-24)/2:], uint32(s.mtime.Nanosecond()))
+	}
+	mode, nlink := uint32(syscall.S_IFREG|0o444), uint32(1)
+	if n.r == nil {
+		mode, nlink = syscall.S_IFDIR|0o555, 2
+		for _, c := range n.children {
+			if c.r == nil {
+				nlink++
+			}
+		}
+	}
+	ne.PutUint32(out[60:], mode)
+	ne.PutUint32(out[64:], nlink)
+	ne.PutUint32(out[68:], uint32(os.Getuid()))
+	ne.PutUint32(out[72:], uint32(os.Getgid()))
+	ne.PutUint32(out[80:], 4096) // blksize
+	return out
+}
+
+// readdir packs the fuse_dirents of the directory id from entry off on,
+// ".", ".." and the children, into size bytes
+func (s *fuseServer) readdir(id uint64, off int64, size int) []byte {
+	ne := binary.NativeEndian
+	n := s.nodes[id-1]
+	var out []byte
+	for i := off; i < int64(len(n.children))+2; i++ {
+		ino, name, typ := id, ".", uint32(syscall.DT_DIR)
+		switch i {
+		case 0:
+		case 1:
+			ino, name = max(s.parents[id-1], fuseRootID), ".."
+		default:
+			ino = s.childID(id, int(i-2))
+			c := s.nodes[ino-1]
+			name = c.name
+			if c.r != nil {
+				typ = syscall.DT_REG
+			}
+		}
+		dirent := make([]byte, 24, (24+len(name)+7)&^7)
+		ne.PutUint64(dirent, ino)
+		ne.PutUint64(dirent[8:], uint64(i+1))
+		ne.PutUint32(dirent[16:], uint32(len(name)))
+		ne.PutUint32(dirent[20:], typ)
+		dirent = append(dirent, name...)
+		dirent = dirent[:cap(dirent)]
+		if len(out)+len(dirent) > size {
+			break
+		}
+		out = append(out, dirent...)
+	}
+	return out
+}
+
+// reply answers the request unique with data, or fails it with errno
+func (s *fuseServer) reply(unique uint64, errno syscall.Errno, data []byte) {
+	ne := binary.NativeEndian
+	out := make([]byte, 16, 16+len(data))
+	ne.PutUint32(out, uint32(16+len(data)))
+	ne.PutUint32(out[4:], uint32(-int32(errno)))
+	ne.PutUint64(out[8:], unique)
+	if _, err := syscall.Write(s.fd, append(out, data...)); err != nil && err != syscall.ENOENT {
+		// ENOENT is the request having been interrupted
+		logger.Warn("FUSE reply failed", "err", err)
+	}
+}
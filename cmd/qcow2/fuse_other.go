@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+func fuseMountAndServe(dir, fsname string, root *fuseNode, mtime time.Time) error {
+	return errors.New("mount: FUSE is only supported on Linux")
+}
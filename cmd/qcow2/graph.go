@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["graph"] = command{
+		usage: "graph [--force-share] DIR|IMAGE... (a Graphviz DOT graph of the backing files of the qcow2 images, for dot -Tsvg)",
+		run:   graph,
+	}
+}
+
+// graphNode is a file of the graph, by its absolute path
+type graphNode struct {
+	path   string
+	format string
+	// listed is set for the files named or found in a directory named, and
+	// unset for the backing files they brought in
+	listed     bool
+	size       int64
+	actualSize int64
+	// err is why the file could not be read, as when it is missing
+	err error
+	// the backing file, with the format the image records for it
+	backing, backingFormat string
+}
+
+func graph(args []string) error {
+	fs := newFlagSet("graph")
+	forceShareFlag(fs)
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) == 0 {
+		return fmt.Errorf("graph: expected DIR or IMAGE")
+	}
+	nodes := map[string]*graphNode{}
+	var pending []string
+	for _, name := range operands {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			pending = append(pending, name)
+			continue
+		}
+		// the qcow2 images of the directory, and not its other files
+		entries, err := os.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			path := filepath.Join(name, e.Name())
+			if !e.Type().IsRegular() {
+				continue
+			}
+			if format, err := probe(path); err == nil && format == "qcow2" {
+				pending = append(pending, path)
+			}
+		}
+	}
+	for _, name := range pending {
+		if err := addGraphNode(nodes, name, true); err != nil {
+			return err
+		}
+	}
+	// then the backing files, wherever they are
+	for added := true; added; {
+		added = false
+		for _, n := range sortedNodes(nodes) {
+			if n.backing == "" || nodes[n.backing] != nil {
+				continue
+			}
+			if err := addGraphNode(nodes, n.backing, false); err != nil {
+				return err
+			}
+			added = true
+		}
+	}
+	return writeDOT(os.Stdout, nodes)
+}
+
+// addGraphNode reads the file at name into nodes, with the format of its
+// magic rather than that recorded for it
+func addGraphNode(nodes map[string]*graphNode, name string, listed bool) error {
+	path, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	if n := nodes[path]; n != nil {
+		n.listed = n.listed || listed
+		return nil
+	}
+	n := &graphNode{path: path, listed: listed}
+	nodes[path] = n
+	fi, err := os.Stat(path)
+	if err != nil {
+		n.err = err
+		return nil
+	}
+	n.size, n.actualSize = fi.Size(), diskUsage(fi)
+	if n.format, err = probe(path); err != nil {
+		n.err = err
+		return nil
+	}
+	if n.format == "raw" {
+		return nil
+	}
+	inf, err := readInfo(path)
+	if err != nil {
+		n.err = err
+		return nil
+	}
+	n.size = inf.Size
+	if inf.BackingFile != "" {
+		if n.backing, err = filepath.Abs(inf.FullBackingFile()); err != nil {
+			return err
+		}
+		n.backingFormat = inf.BackingFormat()
+	}
+	return nil
+}
+
+func sortedNodes(nodes map[string]*graphNode) []*graphNode {
+	sorted := make([]*graphNode, 0, len(nodes))
+	for _, n := range nodes {
+		sorted = append(sorted, n)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].path < sorted[j].path })
+	return sorted
+}
+
+// writeDOT writes the nodes sorted by path, each with an edge to its backing
+// file. Missing and unreadable files are red, backing files that were not
+// listed are grey, and the edge to a backing file of another format than
+// recorded is red and labeled with both.
+func writeDOT(w io.Writer, nodes map[string]*graphNode) error {
+	var b strings.Builder
+	b.WriteString("digraph backing {\n\tnode [shape=box];\n")
+	for _, n := range sortedNodes(nodes) {
+		label := displayPath(n.path)
+		var attrs []string
+		switch {
+		case n.err != nil && os.IsNotExist(n.err):
+			label += "\nmissing"
+			attrs = append(attrs, "color=red", "fontcolor=red", "style=dashed")
+		case n.err != nil:
+			label += "\n" + errorText(n.err)
+			attrs = append(attrs, "color=red", "fontcolor=red")
+		default:
+			label += fmt.Sprintf("\n%s\nvirtual size %s\ndisk size %s", n.format, qcow2.FormatSize(n.size), qcow2.FormatSize(n.actualSize))
+			if !n.listed {
+				attrs = append(attrs, "style=filled", "fillcolor=lightgrey")
+			}
+		}
+		if n.format == "raw" {
+			attrs = append(attrs, "shape=cylinder")
+		}
+		fmt.Fprintf(&b, "\t%s [label=%s", dotQuote(n.path), dotQuote(label))
+		for _, a := range attrs {
+			b.WriteString(", " + a)
+		}
+		b.WriteString("];\n")
+	}
+	for _, n := range sortedNodes(nodes) {
+		if n.backing == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "\t%s -> %s", dotQuote(n.path), dotQuote(n.backing))
+		base := nodes[n.backing]
+		switch {
+		case base.err != nil:
+			b.WriteString(" [color=red, style=dashed]")
+		case n.backingFormat != "" && n.backingFormat != base.format:
+			fmt.Fprintf(&b, " [color=red, fontcolor=red, label=%s]", dotQuote(fmt.Sprintf("recorded as %s, is %s", n.backingFormat, base.format)))
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// displayPath is path relative to the working directory when it is below
+// it, which keeps the labels short
+func displayPath(path string) string {
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return path
+}
+
+// dotQuote is s as a DOT string, in which a newline is a line break of a label
+func dotQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+func init() {
+	commands["hexdump"] = command{
+		usage: "hexdump [--raw-host] IMAGE OFFSET [LENGTH] (256 bytes of guest data by default)",
+		run:   hexdump,
+	}
+}
+
+func hexdump(args []string) error {
+	fs := newFlagSet("hexdump")
+	rawHost := fs.Bool("raw-host", false, "dump the image file at a host offset, without translating guest offsets")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 2 && len(operands) != 3 {
+		return fmt.Errorf("hexdump: expected IMAGE, OFFSET and an optional LENGTH")
+	}
+	off, err := parseSize(operands[1])
+	if err != nil {
+		return fmt.Errorf("hexdump: OFFSET: %w", err)
+	}
+	n := int64(256)
+	if len(operands) == 3 {
+		if n, err = parseSize(operands[2]); err != nil {
+			return fmt.Errorf("hexdump: LENGTH: %w", err)
+		}
+	}
+	if off < 0 || n < 0 {
+		return fmt.Errorf("hexdump: negative OFFSET or LENGTH")
+	}
+
+	var in io.ReaderAt
+	var size int64
+	if *rawHost {
+		fh, err := os.Open(operands[0])
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		in, size = fh, rawFile{fh}.Size()
+		fmt.Fprintf(os.Stderr, "[WARN] host file offsets of %s, not guest offsets\n", operands[0])
+	} else {
+		r, s, err := openInput(operands[0])
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		in, size = r, s
+	}
+	n = min(n, max(0, size-off))
+	w := bufio.NewWriter(os.Stdout)
+	if err := writeHexdump(w, io.NewSectionReader(in, off, n), off); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// writeHexdump writes r in the canonical format of hexdump -C, with offsets
+// starting at base. Runs of identical lines are collapsed into a "*".
+func writeHexdump(w io.Writer, r io.Reader, base int64) error {
+	line := make([]byte, 16)
+	var prev []byte
+	repeated := false
+	off := base
+	for {
+		n, err := io.ReadFull(r, line)
+		if n == 0 {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if n == 16 && prev != nil && bytes.Equal(line, prev) {
+			if !repeated {
+				fmt.Fprintln(w, "*")
+				repeated = true
+			}
+			off += 16
+			continue
+		}
+		repeated = false
+		prev = append(prev[:0], line[:n]...)
+
+		fmt.Fprintf(w, "%08x ", off)
+		for i := 0; i < 16; i++ {
+			if i == 8 {
+				fmt.Fprint(w, " ")
+			}
+			if i < n {
+				fmt.Fprintf(w, " %02x", line[i])
+			} else {
+				fmt.Fprint(w, "   ")
+			}
+		}
+		ascii := make([]byte, n)
+		for i, c := range line[:n] {
+			if c < 0x20 || c > 0x7e {
+				c = '.'
+			}
+			ascii[i] = c
+		}
+		fmt.Fprintf(w, "  |%s|\n", ascii)
+		off += int64(n)
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%08x\n", off)
+	return err
+}
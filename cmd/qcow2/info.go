@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["info"] = command{
+		usage: "info [--force-share] [--skip-extensions] [-v] [-q] [--output human|json|csv] [--bytes] [--hex] [--backing-chain] [--summary] [--format TEMPLATE] [--format-help] [--fail-fast] IMAGE...",
+		run:   info,
+	}
+}
+
+func info(args []string) error {
+	fs := newFlagSet("info")
+	forceShareFlag(fs)
+	skipExtensionsFlag(fs)
+	output := fs.String("output", "human", "print the information as human text, as json in the schema of qemu-img, or as the csv of --summary")
+	format := fs.String("format", "", "print the information with a Go template, one line per image")
+	formatHelp := fs.Bool("format-help", false, "list the fields of --format")
+	exact := fs.Bool("bytes", false, "print sizes in bytes only, rather than in IEC units")
+	verbose := fs.Bool("v", false, "decode the header extensions")
+	quiet := fs.Bool("q", false, "print one line of key=value pairs per image, of "+strings.Join(quietFields, ", "))
+	r := hexFlag(fs, false)
+	failFast := fs.Bool("fail-fast", false, "stop at the first image that fails")
+	summary := fs.Bool("summary", false, "print a line per image, sorted by name")
+	backingChain := fs.Bool("backing-chain", false, "print the information of each backing file too, down to the base")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if *formatHelp {
+		printTemplateFields()
+		return nil
+	}
+	if len(operands) == 0 {
+		return fmt.Errorf("info: expected IMAGE")
+	}
+	if *output != "human" && *output != "json" && *output != "csv" {
+		return fmt.Errorf("info: unknown output format %q", *output)
+	}
+	// csv is only of the summary, which it implies
+	if *output == "csv" && !*quiet {
+		*summary = true
+	}
+	if *quiet && (*output != "human" || *format != "" || *summary || *backingChain || *verbose) {
+		return fmt.Errorf("info: -q cannot be used with --output, --format, --summary, --backing-chain or -v")
+	}
+	if *summary {
+		if *format != "" || *backingChain {
+			return fmt.Errorf("info: --summary cannot be used with --format or --backing-chain")
+		}
+		return printSummary(operands, *output, *exact, *failFast)
+	}
+	if *backingChain {
+		if *format != "" {
+			return fmt.Errorf("info: --backing-chain and --format cannot be used together")
+		}
+		printed := 0
+		return eachImage(operands, *failFast, func(name string) error {
+			if printed > 0 && *output == "human" {
+				fmt.Println()
+			}
+			printed++
+			if name == stdinName {
+				return fmt.Errorf("--backing-chain: %w", errNotSeekable)
+			}
+			return printChain(name, *output == "json", *exact, r)
+		})
+	}
+	var tmpl *template.Template
+	if *format != "" {
+		if tmpl, err = template.New("--format").Parse(*format); err != nil {
+			return fmt.Errorf("info: %w", err)
+		}
+	}
+	printed := 0
+	return eachImage(operands, *failFast, func(name string) error {
+		inf, err := readInfo(name)
+		if err != nil {
+			return err
+		}
+		if *quiet {
+			fmt.Println(inf.quietLine())
+			return nil
+		}
+		if tmpl != nil {
+			var line bytes.Buffer
+			if err := tmpl.Execute(&line, inf); err != nil {
+				return err
+			}
+			fmt.Println(strings.TrimSuffix(line.String(), "\n"))
+			return nil
+		}
+		if *output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "    ")
+			return enc.Encode(inf.qemu(r))
+		}
+		if printed > 0 {
+			fmt.Println()
+		}
+		printed++
+		inf.print(*exact, r)
+		if *verbose {
+			inf.printExtensions(r)
+		}
+		return nil
+	})
+}
+
+// imageInfo is what the header and the snapshot table say about an image
+type imageInfo struct {
+	qcow2.Header
+	Filename string
+	// ActualSize is the space the file takes on disk
+	ActualSize int64
+	Snapshots  []qcow2.Snapshot
+	Metadata   map[string]string
+	// Bitmaps are those of the bitmap directory, and LUKS the header of an
+	// image with LUKS encryption, unless they could not be read
+	Bitmaps    []qcow2.BitmapInfo
+	bitmapsErr error
+	LUKS       *qcow2.LUKSHeader
+	luksErr    error
+	// Container is the compression the image was read out of, if any
+	Container string
+	// streamed is set for an image read from stdin or a container, of
+	// which only the header is known
+	streamed bool
+}
+
+// readInfo reads the information of the image at name, or of the header of
+// the image on stdin for -
+func readInfo(name string) (*imageInfo, error) {
+	if name == stdinName {
+		return readStreamInfo(os.Stdin, name)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if c, err := containerOf(name); err != nil {
+		return nil, err
+	} else if c != nil {
+		fh, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer fh.Close()
+		inf, err := readStreamInfo(fh, name)
+		if err != nil {
+			return nil, err
+		}
+		inf.ActualSize = diskUsage(fi)
+		return inf, nil
+	}
+	// what is wrong with the image is for check to say
+	img, err := openImage(name, qcow2.WithNoBacking(), qcow2.WithDamagedSnapshots(), qcow2.WithIgnoreUnknownIncompatible())
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	md, err := img.Header.Metadata()
+	if err != nil {
+		return nil, err
+	}
+	inf := &imageInfo{
+		Header:     img.Header,
+		Filename:   name,
+		ActualSize: diskUsage(fi),
+		Snapshots:  img.Snapshots(),
+		Metadata:   md,
+	}
+	inf.Bitmaps, inf.bitmapsErr = img.Bitmaps()
+	if _, _, ok, _ := img.Header.CryptHeaderLocation(); ok {
+		inf.LUKS, inf.luksErr = img.LUKSHeader()
+	}
+	return inf, nil
+}
+
+// Compat is the version as qemu names it
+func (inf *imageInfo) Compat() string {
+	if inf.Version >= 3 {
+		return "1.1"
+	}
+	return "0.10"
+}
+
+// FullBackingFile is the backing file relative to the working directory,
+// rather than to the image
+func (inf *imageInfo) FullBackingFile() string {
+	if inf.BackingFile == "" || filepath.IsAbs(inf.BackingFile) {
+		return inf.BackingFile
+	}
+	return filepath.Join(filepath.Dir(inf.Filename), inf.BackingFile)
+}
+
+// VirtualSizeHuman is the virtual size in IEC units
+func (inf *imageInfo) VirtualSizeHuman() string {
+	return qcow2.FormatSize(inf.Size)
+}
+
+// ChainDepth is the number of backing files below the image, counting those
+// that can be opened
+func (inf *imageInfo) ChainDepth() (int, error) {
+	if inf.BackingFile == "" {
+		return 0, nil
+	}
+	img, err := openImage(inf.Filename)
+	if err != nil {
+		return 0, err
+	}
+	defer img.Close()
+	depth := 0
+	for b := img; b != nil && b.Header.BackingFile != ""; b = b.BackingImage() {
+		depth++
+	}
+	return depth, nil
+}
+
+// printTemplateFields lists what the --format template can use: the fields
+// of the header and of the information about the image, and its methods
+func printTemplateFields() {
+	fmt.Println("Fields and methods of --format, as in '{{.Size}} {{.ClusterSize}}':")
+	t := reflect.TypeOf(&imageInfo{})
+	var names []string
+	var walk func(reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			switch {
+			case f.Anonymous:
+				walk(f.Type)
+			case f.IsExported():
+				names = append(names, fmt.Sprintf("  .%-24s %s", f.Name, f.Type))
+			}
+		}
+	}
+	walk(t.Elem())
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		// what a template can call: no arguments, and a value or a value and an error
+		returns := m.Type.NumOut() == 1 || m.Type.NumOut() == 2 && m.Type.Out(1) == reflect.TypeOf((*error)(nil)).Elem()
+		if m.Type.NumIn() == 1 && returns && m.Name != "MarshalBinary" {
+			names = append(names, fmt.Sprintf("  .%-24s %s", m.Name, m.Type.Out(0)))
+		}
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Println(n)
+	}
+}
+
+// print prints the information in the words of qemu-img info, with sizes in
+// bytes only when exact is set, followed by where the metadata is stored
+func (inf *imageInfo) print(exact bool, r *radix) {
+	size := func(n int64) string {
+		if exact {
+			return strconv.FormatInt(n, 10)
+		}
+		return fmt.Sprintf("%s (%d bytes)", qcow2.FormatSize(n), n)
+	}
+	fmt.Printf("image: %s\nfile format: qcow2\n", inf.Filename)
+	if inf.Container != "" {
+		fmt.Printf("container: %s, of which only the header is read\n", inf.Container)
+	}
+	if inf.ExtensionsSkipped {
+		fmt.Printf("note: %s\n", skippedExtensions(inf.Header))
+	}
+	fmt.Printf("virtual size: %s\n", size(inf.Size))
+	switch {
+	case inf.Filename == stdinName:
+		fmt.Println("disk size: unknown, read from a stream")
+	case inf.Container != "":
+		fmt.Printf("disk size: %s, compressed\n", size(inf.ActualSize))
+	default:
+		fmt.Printf("disk size: %s\n", size(inf.ActualSize))
+	}
+	fmt.Printf("cluster_size: %s\n", size(inf.ClusterSize()))
+	if inf.BackingFile != "" {
+		fmt.Printf("backing file: %s\n", inf.BackingFile)
+		if format := inf.BackingFormat(); format != "" {
+			fmt.Printf("backing file format: %s\n", format)
+		}
+	}
+	if inf.CryptMethod != 0 {
+		fmt.Println("encrypted: yes")
+	}
+	if len(inf.Snapshots) > 0 {
+		fmt.Println("Snapshot list:")
+		printSnapshots(inf.Snapshots, exact)
+	} else if inf.streamed && inf.NbSnapshots > 0 {
+		fmt.Printf("snapshots: %d, whose table is not read from a stream\n", inf.NbSnapshots)
+	}
+
+	fmt.Println("Format specific information:")
+	fmt.Printf("    compat: %s\n", inf.Compat())
+	if inf.Version >= 3 {
+		fmt.Printf("    lazy refcounts: %t\n", inf.CompatibleFeatures&qcow2.CompatLazyRefcounts != 0)
+	}
+	fmt.Printf("    refcount bits: %d\n", 1<<inf.RefcountOrder)
+	fmt.Printf("    corrupt: %t\n", inf.IncompatibleFeatures&qcow2.IncompatCorrupt != 0)
+	fmt.Printf("    extended l2: %t\n", inf.IncompatibleFeatures&qcow2.IncompatExtendedL2 != 0)
+
+	if len(inf.Metadata) > 0 {
+		keys := make([]string, 0, len(inf.Metadata))
+		for k := range inf.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Println("Metadata:")
+		for _, k := range keys {
+			fmt.Printf("    %s: %s\n", k, inf.Metadata[k])
+		}
+	}
+
+	fmt.Println("Layout:")
+	fmt.Printf("    header length: %s\n", r.format(int64(inf.HeaderLength)))
+	fmt.Printf("    l1 table: %s (%d entries)\n", r.format(inf.L1TableOffset), inf.L1Size)
+	fmt.Printf("    refcount table: %s (%d clusters)\n", r.format(inf.RefcountTableOffset), inf.RefcountTableClusters)
+	if inf.SnapshotsOffset != 0 {
+		fmt.Printf("    snapshot table: %s (%d entries)\n", r.format(inf.SnapshotsOffset), inf.NbSnapshots)
+	}
+	for i, e := range inf.ExtHeaders {
+		fmt.Printf("    extension %#08x: %s (%s bytes)\n", uint32(e.Type), r.format(inf.ExtensionOffset(i)), r.format(int64(e.Size)))
+	}
+	if inf.BackingFileOffset != 0 {
+		fmt.Printf("    backing file name: %s (%s bytes)\n", r.format(inf.BackingFileOffset), r.format(int64(inf.BackingFileSize)))
+	}
+}
+
+// extDumpSize bounds the hex dump of an unknown extension in info -v
+const extDumpSize = 64
+
+// printExtensions decodes each header extension, with the parsers of the
+// library, and dumps the start of those it does not know
+func (inf *imageInfo) printExtensions(r *radix) {
+	if len(inf.ExtHeaders) == 0 {
+		return
+	}
+	fmt.Println("Extensions:")
+	for i, e := range inf.ExtHeaders {
+		fmt.Printf("    %#08x %s at %s (%s bytes)", uint32(e.Type), e.Type, r.format(inf.ExtensionOffset(i)), r.format(int64(e.Size)))
+		switch e.Type {
+		case qcow2.HdrExtBackingFileFormat:
+			fmt.Printf(": %s\n", inf.BackingFormat())
+		case qcow2.HdrExtExternalDataFile:
+			fmt.Printf(": %s\n", inf.ExternalDataFile())
+		case qcow2.HdrExtFeatureNameTable:
+			fmt.Println(":")
+			for _, f := range inf.FeatureNames() {
+				fmt.Printf("        %s bit %d: %s\n", f.Type, f.Bit, f.Name)
+			}
+		case qcow2.HdrExtBitmaps:
+			if inf.bitmapsErr != nil {
+				fmt.Printf(": %s\n", errorText(inf.bitmapsErr))
+				continue
+			}
+			fmt.Printf(": %d bitmaps\n", len(inf.Bitmaps))
+			for _, b := range inf.Bitmaps {
+				var flags []string
+				if b.InUse {
+					flags = append(flags, "in-use")
+				}
+				if b.Auto {
+					flags = append(flags, "auto")
+				}
+				if len(flags) == 0 {
+					flags = append(flags, "none")
+				}
+				fmt.Printf("        %q: granularity %s, flags %s, table at %s (%d entries)\n", b.Name, qcow2.FormatSize(b.Granularity), strings.Join(flags, ","), r.format(b.TableOffset), b.TableSize)
+			}
+		case qcow2.HdrExtFullDiskCrypt:
+			off, length, _, err := inf.CryptHeaderLocation()
+			if err != nil {
+				fmt.Printf(": %s\n", errorText(err))
+				continue
+			}
+			fmt.Printf(": LUKS header at %s (%s bytes)\n", r.format(off), r.format(length))
+			switch l := inf.LUKS; {
+			case inf.luksErr != nil:
+				fmt.Printf("        %s\n", errorText(inf.luksErr))
+			case l.Version == 1:
+				fmt.Printf("        LUKS version 1, cipher %s-%s, hash %s, %d byte key, %d active key slots, uuid %s\n", l.CipherName, l.CipherMode, l.HashSpec, l.KeyBytes, l.ActiveKeySlots, l.UUID)
+			default:
+				fmt.Printf("        LUKS version %d, uuid %s\n", l.Version, l.UUID)
+			}
+		default:
+			fmt.Println(":")
+			var dump bytes.Buffer
+			writeHexdump(&dump, bytes.NewReader(e.Data[:min(len(e.Data), extDumpSize)]), 0)
+			for _, line := range strings.SplitAfter(dump.String(), "\n") {
+				if line != "" {
+					fmt.Print("        " + line)
+				}
+			}
+			if len(e.Data) > extDumpSize {
+				fmt.Printf("        (%d more bytes)\n", len(e.Data)-extDumpSize)
+			}
+		}
+	}
+}
+
+// qemuInfo is the image information in the schema of qemu-img info
+// --output=json. What qemu has no field for is under the key of this tool,
+// which qemu does not use.
+type qemuInfo struct {
+	Filename              string         `json:"filename"`
+	Format                string         `json:"format"`
+	VirtualSize           int64          `json:"virtual-size"`
+	ActualSize            int64          `json:"actual-size"`
+	ClusterSize           int64          `json:"cluster-size"`
+	Encrypted             bool           `json:"encrypted,omitempty"`
+	BackingFilename       string         `json:"backing-filename,omitempty"`
+	FullBackingFilename   string         `json:"full-backing-filename,omitempty"`
+	BackingFilenameFormat string         `json:"backing-filename-format,omitempty"`
+	Snapshots             []qemuSnapshot `json:"snapshots,omitempty"`
+	DirtyFlag             bool           `json:"dirty-flag"`
+	FormatSpecific        struct {
+		Type string    `json:"type"`
+		Data qemuQcow2 `json:"data"`
+	} `json:"format-specific"`
+	Extra qcow2Info `json:"vbatts-qcow2"`
+}
+
+type qemuSnapshot struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	VMStateSize int64  `json:"vm-state-size"`
+	DateSec     int64  `json:"date-sec"`
+	DateNsec    int64  `json:"date-nsec"`
+	VMClockSec  int64  `json:"vm-clock-sec"`
+	VMClockNsec int64  `json:"vm-clock-nsec"`
+}
+
+type qemuQcow2 struct {
+	Compat          string `json:"compat"`
+	CompressionType string `json:"compression-type"`
+	// version 3 only
+	LazyRefcounts *bool `json:"lazy-refcounts,omitempty"`
+	RefcountBits  int   `json:"refcount-bits"`
+	Corrupt       *bool `json:"corrupt,omitempty"`
+	ExtendedL2    *bool `json:"extended-l2,omitempty"`
+}
+
+// qcow2Info is the header as stored, which qemu-img does not report. With
+// --hex, each offset and length has a parallel string field in hex.
+type qcow2Info struct {
+	Version                qcow2.Version     `json:"version"`
+	Container              string            `json:"container,omitempty"`
+	ExtensionsSkipped      bool              `json:"extensions-skipped,omitempty"`
+	HeaderLength           int               `json:"header-length"`
+	HeaderLengthHex        *string           `json:"header-length-hex,omitempty"`
+	L1Size                 int               `json:"l1-size"`
+	L1TableOffset          int64             `json:"l1-table-offset"`
+	L1TableOffsetHex       *string           `json:"l1-table-offset-hex,omitempty"`
+	RefcountTableOffset    int64             `json:"refcount-table-offset"`
+	RefcountTableOffsetHex *string           `json:"refcount-table-offset-hex,omitempty"`
+	RefcountTableClusters  int               `json:"refcount-table-clusters"`
+	SnapshotsOffset        int64             `json:"snapshots-offset"`
+	SnapshotsOffsetHex     *string           `json:"snapshots-offset-hex,omitempty"`
+	IncompatibleFeatures   uint64            `json:"incompatible-features"`
+	CompatibleFeatures     uint64            `json:"compatible-features"`
+	AutoclearFeatures      uint64            `json:"autoclear-features"`
+	Extensions             []qcow2Extension  `json:"extensions,omitempty"`
+	Metadata               map[string]string `json:"metadata,omitempty"`
+}
+
+type qcow2Extension struct {
+	Type      uint32  `json:"type"`
+	Offset    int64   `json:"offset"`
+	OffsetHex *string `json:"offset-hex,omitempty"`
+	Length    int64   `json:"length"`
+	LengthHex *string `json:"length-hex,omitempty"`
+}
+
+func (inf *imageInfo) qemu(r *radix) qemuInfo {
+	q := qemuInfo{
+		Filename:              inf.Filename,
+		Format:                "qcow2",
+		VirtualSize:           inf.Size,
+		ActualSize:            inf.ActualSize,
+		ClusterSize:           inf.ClusterSize(),
+		Encrypted:             inf.CryptMethod != 0,
+		BackingFilename:       inf.BackingFile,
+		FullBackingFilename:   inf.FullBackingFile(),
+		BackingFilenameFormat: inf.BackingFormat(),
+		DirtyFlag:             inf.IncompatibleFeatures&qcow2.IncompatDirty != 0,
+		Extra: qcow2Info{
+			Version:                inf.Version,
+			Container:              inf.Container,
+			ExtensionsSkipped:      inf.ExtensionsSkipped,
+			HeaderLength:           inf.HeaderLength,
+			HeaderLengthHex:        r.field(int64(inf.HeaderLength)),
+			L1Size:                 inf.L1Size,
+			L1TableOffset:          inf.L1TableOffset,
+			L1TableOffsetHex:       r.field(inf.L1TableOffset),
+			RefcountTableOffset:    inf.RefcountTableOffset,
+			RefcountTableOffsetHex: r.field(inf.RefcountTableOffset),
+			RefcountTableClusters:  inf.RefcountTableClusters,
+			SnapshotsOffset:        inf.SnapshotsOffset,
+			SnapshotsOffsetHex:     r.field(inf.SnapshotsOffset),
+			IncompatibleFeatures:   inf.IncompatibleFeatures,
+			CompatibleFeatures:     inf.CompatibleFeatures,
+			AutoclearFeatures:      inf.AutoclearFeatures,
+		},
+	}
+	if len(inf.Metadata) > 0 {
+		q.Extra.Metadata = inf.Metadata
+	}
+	for i, e := range inf.ExtHeaders {
+		off, size := inf.ExtensionOffset(i), int64(e.Size)
+		q.Extra.Extensions = append(q.Extra.Extensions, qcow2Extension{uint32(e.Type), off, r.field(off), size, r.field(size)})
+	}
+	for _, s := range inf.Snapshots {
+		q.Snapshots = append(q.Snapshots, qemuSnapshot{
+			ID:          s.ID,
+			Name:        s.Name,
+			VMStateSize: s.VMStateSize,
+			DateSec:     s.Date.Unix(),
+			DateNsec:    int64(s.Date.Nanosecond()),
+			VMClockSec:  int64(s.VMClock / 1e9),
+			VMClockNsec: int64(s.VMClock % 1e9),
+		})
+	}
+	q.FormatSpecific.Type = "qcow2"
+	d := &q.FormatSpecific.Data
+	d.Compat, d.CompressionType, d.RefcountBits = inf.Compat(), "zlib", 1<<inf.RefcountOrder
+	if inf.IncompatibleFeatures&qcow2.IncompatCompressionType != 0 && len(inf.ExtraHeader) > 0 && inf.ExtraHeader[0] == 1 {
+		// the compression type byte follows the version 3 header
+		d.CompressionType = "zstd"
+	}
+	if inf.Version >= 3 {
+		lazy := inf.CompatibleFeatures&qcow2.CompatLazyRefcounts != 0
+		corrupt := inf.IncompatibleFeatures&qcow2.IncompatCorrupt != 0
+		extended := inf.IncompatibleFeatures&qcow2.IncompatExtendedL2 != 0
+		d.LazyRefcounts, d.Corrupt, d.ExtendedL2 = &lazy, &corrupt, &extended
+	}
+	return q
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/vbatts/qcow2"
+)
+
+// chainLink is an element of a backing chain, at its position from the top
+type chainLink struct {
+	Position int
+	// Path is the absolute path of the file
+	Path string
+	// Info is that of a qcow2 image, and nil for a raw file or an error
+	Info *imageInfo
+	// Size and ActualSize are those of a raw file
+	Size, ActualSize int64
+	// Allocated is the guest data stored in the file itself
+	Allocated int64
+	// Err is what ends the chain here, the file being missing, unreadable
+	// or already above
+	Err error
+}
+
+// readChain reads the image at name and its backing files, down to the base
+// or to the first that cannot be read, which is the last link with its Err
+func readChain(name string) []chainLink {
+	var chain []chainLink
+	seen := map[string]bool{}
+	format := ""
+	for pos := 0; ; pos++ {
+		path, err := filepath.Abs(name)
+		if err != nil {
+			return append(chain, chainLink{Position: pos, Path: name, Err: err})
+		}
+		link := chainLink{Position: pos, Path: path}
+		if seen[path] {
+			link.Err = qcow2.ErrBackingLoop
+			return append(chain, link)
+		}
+		seen[path] = true
+		if format == "" && pos > 0 {
+			if format, err = probe(path); err != nil {
+				link.Err = err
+				return append(chain, link)
+			}
+		}
+		if format == "raw" {
+			fi, err := os.Stat(path)
+			if err != nil {
+				link.Err = err
+			} else {
+				link.Size, link.ActualSize, link.Allocated = fi.Size(), diskUsage(fi), fi.Size()
+			}
+			return append(chain, link)
+		}
+		if link.Info, err = readInfo(name); err == nil {
+			link.Info.Filename = path
+			link.Allocated, err = allocatedBytes(path)
+		}
+		if err != nil {
+			link.Info, link.Err = nil, err
+			return append(chain, link)
+		}
+		chain = append(chain, link)
+		if link.Info.BackingFile == "" {
+			return chain
+		}
+		name, format = link.Info.FullBackingFile(), link.Info.BackingFormat()
+	}
+}
+
+// allocatedBytes is the guest data the image at path stores itself, not
+// counting its backing file
+func allocatedBytes(path string) (int64, error) {
+	img, err := openImage(path, qcow2.WithNoBacking(), qcow2.WithDamagedSnapshots())
+	if err != nil {
+		return 0, err
+	}
+	defer img.Close()
+	var n int64
+	err = img.WalkExtents(0, img.Size(), func(e qcow2.Extent) error {
+		if e.Type == qcow2.ExtentData || e.Type == qcow2.ExtentCompressed {
+			n += e.Length
+		}
+		return nil
+	})
+	return n, err
+}
+
+// chainTotals sums what the links that could be read allocate and take on
+// disk. The depth is the number of backing files read below the top.
+func chainTotals(chain []chainLink) (depth int, allocated, actual int64) {
+	for _, link := range chain {
+		if link.Err != nil {
+			continue
+		}
+		if link.Position > 0 {
+			depth++
+		}
+		allocated += link.Allocated
+		if link.Info != nil {
+			actual += link.Info.ActualSize
+		} else {
+			actual += link.ActualSize
+		}
+	}
+	return depth, allocated, actual
+}
+
+// printChain prints the information of each link of the chain of name, as
+// qemu-img info --backing-chain does, and a summary of the chain. A broken
+// chain is reported where it breaks, and returned as the error of the link.
+func printChain(name string, asJSON, exact bool, r *radix) error {
+	chain := readChain(name)
+	depth, allocated, actual := chainTotals(chain)
+	broken := chain[len(chain)-1].Err
+
+	if asJSON {
+		type rawInfo struct {
+			Filename    string `json:"filename"`
+			Format      string `json:"format"`
+			VirtualSize int64  `json:"virtual-size"`
+			ActualSize  int64  `json:"actual-size"`
+		}
+		type brokenLink struct {
+			Filename string `json:"filename"`
+			Error    string `json:"error"`
+		}
+		out := struct {
+			Chain          []any `json:"chain"`
+			Depth          int   `json:"depth"`
+			AllocatedBytes int64 `json:"allocated-bytes"`
+			ActualSize     int64 `json:"actual-size"`
+		}{Chain: []any{}, Depth: depth, AllocatedBytes: allocated, ActualSize: actual}
+		for _, link := range chain {
+			switch {
+			case link.Err != nil:
+				out.Chain = append(out.Chain, brokenLink{link.Path, errorText(link.Err)})
+			case link.Info != nil:
+				out.Chain = append(out.Chain, link.Info.qemu(r))
+			default:
+				out.Chain = append(out.Chain, rawInfo{link.Path, "raw", link.Size, link.ActualSize})
+			}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		if err := enc.Encode(out); err != nil {
+			return err
+		}
+	} else {
+		size := func(n int64) string {
+			if exact {
+				return strconv.FormatInt(n, 10)
+			}
+			return fmt.Sprintf("%s (%d bytes)", qcow2.FormatSize(n), n)
+		}
+		for _, link := range chain {
+			fmt.Printf("Chain position %d: %s\n", link.Position, link.Path)
+			switch {
+			case link.Err != nil:
+				fmt.Printf("error: %s\n", errorText(link.Err))
+			case link.Info != nil:
+				link.Info.print(exact, r)
+			default:
+				fmt.Printf("image: %s\nfile format: raw\nvirtual size: %s\ndisk size: %s\n", link.Path, size(link.Size), size(link.ActualSize))
+			}
+			fmt.Println()
+		}
+		fmt.Println("Chain summary:")
+		fmt.Printf("    depth: %d\n", depth)
+		fmt.Printf("    allocated: %s\n", size(allocated))
+		fmt.Printf("    disk size: %s\n", size(actual))
+	}
+	if broken != nil && len(chain) == 1 {
+		return broken
+	} else if broken != nil {
+		return fmt.Errorf("backing chain broken at position %d: %w", len(chain)-1, broken)
+	}
+	return nil
+}
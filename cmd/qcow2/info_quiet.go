@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/vbatts/qcow2"
+)
+
+// quietFields are the keys of the line of info -q, in their order. Scripts
+// split on them, so they are only ever added to, at the end.
+var quietFields = []string{"file", "version", "virtual_size", "cluster_size", "backing", "snapshots", "dirty", "corrupt"}
+
+// quietLine is the line of info -q for the image: key=value pairs of
+// quietFields separated by spaces. Sizes are in bytes, snapshots the count of
+// the header, and a value that holds a space, a quote, an = or what is not
+// printable is quoted as in Go, with its spaces as \x20 so that the line
+// always splits on spaces.
+func (inf *imageInfo) quietLine() string {
+	values := []string{
+		inf.Filename,
+		strconv.Itoa(int(inf.Version)),
+		strconv.FormatInt(inf.Size, 10),
+		strconv.FormatInt(inf.ClusterSize(), 10),
+		inf.BackingFile,
+		strconv.Itoa(inf.NbSnapshots),
+		strconv.FormatBool(inf.IncompatibleFeatures&qcow2.IncompatDirty != 0),
+		strconv.FormatBool(inf.IncompatibleFeatures&qcow2.IncompatCorrupt != 0),
+	}
+	pairs := make([]string, len(quietFields))
+	for i, key := range quietFields {
+		pairs[i] = key + "=" + quietValue(values[i])
+	}
+	return strings.Join(pairs, " ")
+}
+
+func quietValue(v string) string {
+	if strings.ContainsFunc(v, func(r rune) bool { return r == ' ' || r == '"' || r == '=' || !unicode.IsPrint(r) }) {
+		return strings.ReplaceAll(strconv.Quote(v), " ", `\x20`)
+	}
+	return v
+}
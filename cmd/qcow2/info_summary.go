@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vbatts/qcow2"
+)
+
+// summaryRow is the line of info --summary for an image, or the error that
+// stopped it from being read
+type summaryRow struct {
+	Filename    string `json:"filename"`
+	Version     int    `json:"version,omitempty"`
+	VirtualSize int64  `json:"virtual-size,omitempty"`
+	ActualSize  int64  `json:"actual-size,omitempty"`
+	ClusterSize int64  `json:"cluster-size,omitempty"`
+	BackingFile string `json:"backing-filename,omitempty"`
+	// BackingFormat is that of the header extension, if any
+	BackingFormat string `json:"backing-format,omitempty"`
+	Snapshots     int    `json:"snapshots"`
+	// Compressed is set for an image with compressed clusters of its own
+	Compressed bool   `json:"compressed"`
+	Encrypted  bool   `json:"encrypted"`
+	Dirty      bool   `json:"dirty-flag"`
+	Corrupt    bool   `json:"corrupt"`
+	Error      string `json:"error,omitempty"`
+}
+
+// summaryCSVHeader is the header row of info --summary --output=csv, whose
+// columns are in this order for good
+var summaryCSVHeader = []string{"filename", "version", "virtual-size", "actual-size", "cluster-size", "backing-filename", "backing-format", "snapshots", "compressed", "encrypted", "dirty-flag", "corrupt", "error"}
+
+// csv is the row of the image under summaryCSVHeader, with sizes in bytes.
+// That of an error has only its filename and error.
+func (row summaryRow) csv() []string {
+	if row.Error != "" {
+		line := make([]string, len(summaryCSVHeader))
+		line[0], line[len(line)-1] = row.Filename, row.Error
+		return line
+	}
+	return []string{row.Filename, strconv.Itoa(row.Version), strconv.FormatInt(row.VirtualSize, 10), strconv.FormatInt(row.ActualSize, 10), strconv.FormatInt(row.ClusterSize, 10), row.BackingFile, row.BackingFormat, strconv.Itoa(row.Snapshots), strconv.FormatBool(row.Compressed), strconv.FormatBool(row.Encrypted), strconv.FormatBool(row.Dirty), strconv.FormatBool(row.Corrupt), ""}
+}
+
+// errCompressedCluster stops hasCompressedClusters at the first one
+var errCompressedCluster = errors.New("compressed cluster")
+
+// hasCompressedClusters reports whether the image at name maps any of the
+// guest disk to compressed clusters of its own, not of its backing files
+func hasCompressedClusters(name string) (bool, error) {
+	img, err := openImage(name, qcow2.WithNoBacking(), qcow2.WithDamagedSnapshots(), qcow2.WithIgnoreUnknownIncompatible())
+	if err != nil {
+		return false, err
+	}
+	defer img.Close()
+	err = img.WalkExtents(0, img.Size(), func(e qcow2.Extent) error {
+		if e.Type == qcow2.ExtentCompressed && e.Depth == 0 {
+			return errCompressedCluster
+		}
+		return nil
+	})
+	if err == errCompressedCluster {
+		return true, nil
+	}
+	return false, err
+}
+
+// printSummary prints a table of the images sorted by name, or a JSON array
+// or CSV file of them. An image that cannot be read gets its error in place
+// of its columns, so the table goes on, until the exit status of 1.
+func printSummary(names []string, output string, exact, failFast bool) error {
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+	rows := make([]summaryRow, 0, len(names))
+	// the status of the first image that fails
+	var status exitStatus
+	for _, name := range names {
+		inf, err := readInfo(name)
+		var compressed bool
+		if err == nil && !inf.streamed {
+			compressed, err = hasCompressedClusters(name)
+		}
+		if err != nil {
+			if failFast {
+				reportError(name, err)
+				return exitStatus(exitCode(err))
+			}
+			// the name is in its own column
+			msg := strings.TrimPrefix(errorText(err), name+": ")
+			var pe *os.PathError
+			if errors.As(err, &pe) && pe.Path == name {
+				msg = pe.Err.Error()
+			}
+			rows = append(rows, summaryRow{Filename: name, Error: msg})
+			if status == exitOK {
+				status = exitStatus(exitCode(err))
+			}
+			continue
+		}
+		rows = append(rows, summaryRow{
+			Filename:      name,
+			Version:       int(inf.Version),
+			VirtualSize:   inf.Size,
+			ActualSize:    inf.ActualSize,
+			ClusterSize:   inf.ClusterSize(),
+			BackingFile:   inf.BackingFile,
+			BackingFormat: inf.BackingFormat(),
+			Snapshots:     len(inf.Snapshots),
+			Compressed:    compressed,
+			Encrypted:     inf.CryptMethod != 0,
+			Dirty:         inf.IncompatibleFeatures&qcow2.IncompatDirty != 0,
+			Corrupt:       inf.IncompatibleFeatures&qcow2.IncompatCorrupt != 0,
+		})
+	}
+
+	switch output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		if err := enc.Encode(rows); err != nil {
+			return err
+		}
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write(summaryCSVHeader)
+		for _, row := range rows {
+			w.Write(row.csv())
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+	default:
+		size := func(n int64) string {
+			if exact {
+				return strconv.FormatInt(n, 10)
+			}
+			return qcow2.FormatSize(n)
+		}
+		table := [][]string{{"FILE", "VERSION", "VIRTUAL SIZE", "DISK SIZE", "CLUSTER SIZE", "BACKING FILE", "SNAPSHOTS", "FLAGS"}}
+		for _, row := range rows {
+			if row.Error != "" {
+				table = append(table, []string{row.Filename, "ERROR: " + row.Error})
+				continue
+			}
+			backing := row.BackingFile
+			if backing == "" {
+				backing = "-"
+			}
+			var flags []string
+			if row.Compressed {
+				flags = append(flags, "compressed")
+			}
+			if row.Encrypted {
+				flags = append(flags, "encrypted")
+			}
+			if row.Dirty {
+				flags = append(flags, "dirty")
+			}
+			if row.Corrupt {
+				flags = append(flags, "corrupt")
+			}
+			if len(flags) == 0 {
+				flags = append(flags, "-")
+			}
+			table = append(table, []string{row.Filename, strconv.Itoa(row.Version), size(row.VirtualSize), size(row.ActualSize), size(row.ClusterSize), backing, strconv.Itoa(row.Snapshots), strings.Join(flags, ",")})
+		}
+		printTable(table)
+	}
+	if status != exitOK {
+		return status
+	}
+	return nil
+}
+
+// printTable prints the cells of each line in columns two spaces apart, as
+// wide as the widest of their cells. The last cell of a line does not widen
+// its column, so a line with fewer cells, like that of an error, can run
+// across those it lacks without moving the others.
+func printTable(table [][]string) {
+	var widths []int
+	for _, line := range table {
+		for i, cell := range line[:len(line)-1] {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], len(cell))
+		}
+	}
+	for _, line := range table {
+		var b strings.Builder
+		for i, cell := range line[:len(line)-1] {
+			fmt.Fprintf(&b, "%-*s  ", widths[i], cell)
+		}
+		b.WriteString(line[len(line)-1])
+		fmt.Println(strings.TrimRight(b.String(), " "))
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/vbatts/qcow2"
+)
+
+// command is a subcommand of the qcow2 tool
+type command struct {
+	usage string
+	run   func(args []string) error
+	// errorStatus is the exit status on errors, rather than the exitCode of
+	// their class, for the commands that exit as qemu-img does
+	errorStatus int
+}
+
+// exitStatus is returned by commands that have reported their outcome and
+// only need to set the exit status
+type exitStatus int
+
+func (s exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(s))
+}
+
+var commands = map[string]command{}
+
+// newFlagSet is the flag set of a command, which leaves the exit status to
+// main. Its usage is that registered for the command.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s\n", progName, commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses the flags of a command, which may come before or after its
+// operands, and returns the operands. The error of bad flags, which the flag
+// set has reported, is errBadFlags, and that of -h an exitStatus of 0.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var operands []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, exitStatus(0)
+			}
+			return nil, errBadFlags
+		}
+		if fs.NArg() == 0 {
+			return operands, nil
+		}
+		operands = append(operands, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// logger is where the images log, at the level of -v or -vv
+var logger = newLogger(os.Stderr, slog.LevelWarn)
+
+// newLogger logs the records of level and above to w, without their time
+func newLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+}
+
+// forceShare is set by the --force-share of the commands that only read
+// images
+var forceShare bool
+
+// forceShareFlag adds --force-share to the flags of a command that only reads
+// images, which then opens them as qemu-img -U does
+func forceShareFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&forceShare, "force-share", false, "open the images without locking them, even when another process holds them; what is read may be inconsistent if it is writing")
+}
+
+// skipExtensions is set by the --skip-extensions of the commands that only
+// read images
+var skipExtensions bool
+
+// skipExtensionsFlag adds --skip-extensions to the flags of a command that
+// only reads images, which then opens them as qcow2.WithoutExtensionParsing
+func skipExtensionsFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&skipExtensions, "skip-extensions", false, "do not parse the header extensions, for an image whose extension area is damaged; what they hold, like the backing format, is then unknown")
+}
+
+// skippedExtensions is what skipping the header extensions of the image of h
+// leaves unknown, for the note the commands print
+func skippedExtensions(h qcow2.Header) string {
+	msg := "the header extensions were skipped (--skip-extensions)"
+	var unknown []string
+	if h.BackingFile != "" {
+		unknown = append(unknown, "the backing format is unknown, and probed")
+	}
+	if h.AutoclearFeatures&qcow2.AutoclearBitmaps != 0 {
+		unknown = append(unknown, "the bitmaps are not read")
+	}
+	if h.CryptMethod == qcow2.CryptLUKS {
+		unknown = append(unknown, "the encrypted data can not be read")
+	}
+	if len(unknown) > 0 {
+		msg += ": " + strings.Join(unknown, ", ")
+	}
+	return msg
+}
+
+// openImage opens an image read-only, as qcow2.Open, logging to logger
+func openImage(name string, opts ...qcow2.Option) (*qcow2.Image, error) {
+	return openImageFile(name, os.O_RDONLY, opts...)
+}
+
+// openImageFile opens an image as qcow2.OpenFile, logging to logger. An
+// image can not be opened from stdin, which is only read in sequence.
+func openImageFile(name string, flag int, opts ...qcow2.Option) (*qcow2.Image, error) {
+	if name == stdinName {
+		return nil, fmt.Errorf("stdin: %w", errNotSeekable)
+	}
+	img, err := qcow2.OpenFile(name, flag, imageOptions(opts)...)
+	if errors.Is(err, qcow2.ErrBadMagic) {
+		return nil, checkCompressed(name, err)
+	}
+	return img, err
+}
+
+// imageOptions are opts and those of the flags of the tool
+func imageOptions(opts []qcow2.Option) []qcow2.Option {
+	opts = append(opts, qcow2.WithLogger(logger), qcow2.WithPassphraseFunc(askPassphrase, passphraseAttempts))
+	if forceShare {
+		opts = append(opts, qcow2.WithForceShare())
+	}
+	if skipExtensions {
+		opts = append(opts, qcow2.WithoutExtensionParsing())
+	}
+	return opts
+}
+
+// progName is the name the tool was run as
+var progName = filepath.Base(os.Args[0])
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-v|-vv] [-passphrase-file FILE] [-passphrase-attempts N] COMMAND [OPTIONS] ARGS...\n       %s IMAGE... (as info)\n\nCommands:\n", progName, progName)
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\n-v logs what is done to the images to stderr, and -vv what is done to each\ncluster as well; warnings are logged either way.\n")
+	fmt.Fprintf(os.Stderr, "\nThe passphrase of an encrypted image is asked for on the terminal when its data\nis first read, up to -passphrase-attempts times (3), or read from the first\nline of -passphrase-file.\n")
+	fmt.Fprintf(os.Stderr, "\ninfo, ext-list and ext-dump read the header of an image compressed as a whole\nwith gzip, xz or zstd; xz and zstd are decompressed by the xz and zstd\ncommands, which must be installed.\n")
+	fmt.Fprint(os.Stderr, exitCodes)
+	fmt.Fprintf(os.Stderr, "\nRun '%s help COMMAND' for the options of a command.\n", progName)
+}
+
+func init() {
+	commands["help"] = command{
+		usage: "help [COMMAND]",
+		run:   help,
+	}
+}
+
+func help(args []string) error {
+	if len(args) == 0 {
+		usage()
+		return nil
+	}
+	if _, ok := commands[args[0]]; !ok || len(args) > 1 {
+		return fmt.Errorf("help: unknown command %q", strings.Join(args, " "))
+	}
+	return commands[args[0]].run([]string{"-h"})
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs the command named by args, and returns the exit status of the
+// tool. Arguments naming no command but an existing file are those of info,
+// as the tool used to only print the header of its arguments.
+func run(args []string) int {
+	top := flag.NewFlagSet(progName, flag.ContinueOnError)
+	top.Usage = usage
+	verbose := top.Bool("v", false, "log what is done to the images")
+	debug := top.Bool("vv", false, "log the decisions taken for each cluster as well")
+	top.StringVar(&passphraseFile, "passphrase-file", "", "read the passphrase of encrypted images from the first line of `FILE`, rather than ask for it on the terminal")
+	top.IntVar(&passphraseAttempts, "passphrase-attempts", passphraseAttempts, "ask for the passphrase of an encrypted image up to `N` times")
+	if err := top.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if passphraseAttempts < 1 {
+		fmt.Fprintf(os.Stderr, "[ERR] -passphrase-attempts must be at least 1\n")
+		return exitUsage
+	}
+	level := slog.LevelWarn
+	switch {
+	case *debug:
+		level = slog.LevelDebug
+	case *verbose:
+		level = slog.LevelInfo
+	}
+	logger = newLogger(os.Stderr, level)
+	if top.NArg() == 0 {
+		usage()
+		return exitUsage
+	}
+	name, args := top.Arg(0), top.Args()[1:]
+	cmd, ok := commands[name]
+	if !ok {
+		if _, err := os.Stat(name); err != nil {
+			fmt.Fprintf(os.Stderr, "[ERR] unknown command %q\n", name)
+			usage()
+			return exitUsage
+		}
+		cmd, args = commands["info"], top.Args()
+	}
+	err := cmd.run(args)
+	var status exitStatus
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &status):
+		return int(status)
+	case !errors.Is(err, errBadFlags):
+		reportError("", err)
+	}
+	if cmd.errorStatus != 0 {
+		return cmd.errorStatus
+	}
+	return exitCode(err)
+}
+
+// reportError prints err on stderr, after the name of the file it is about
+// when there is one and the error does not already name it
+func reportError(name string, err error) {
+	msg := errorText(err)
+	if name != "" && !namesFile(err, msg, name) {
+		msg = name + ": " + msg
+	}
+	fmt.Fprintf(os.Stderr, "[ERR] %s\n", msg)
+}
+
+// errorText is the message of err, with all there is to know about corruption
+func errorText(err error) string {
+	var corrupt qcow2.CorruptionError
+	if errors.As(err, &corrupt) {
+		return formatCorruption(corrupt)
+	}
+	return err.Error()
+}
+
+// namesFile reports whether msg, the text of err, already names the file,
+// as those of the library and of system calls do
+func namesFile(err error, msg, name string) bool {
+	var pe *os.PathError
+	return strings.HasPrefix(msg, name+": ") || errors.As(err, &pe) && pe.Path == name && msg == pe.Error()
+}
+
+// eachImage runs do for each of names, which commands taking several images
+// use so that one bad file does not hide the others. The error of a name is
+// reported with it, and the next one is attempted unless failFast is set.
+// The error returned is the exitStatus of the first name that failed.
+func eachImage(names []string, failFast bool, do func(name string) error) error {
+	var status exitStatus
+	for _, name := range names {
+		err := do(name)
+		if err == nil {
+			continue
+		}
+		reportError(name, err)
+		if status == exitOK {
+			status = exitStatus(exitCode(err))
+		}
+		if failFast {
+			break
+		}
+	}
+	if status != exitOK {
+		return status
+	}
+	return nil
+}
+
+// formatCorruption puts all there is to know about a corruption on one line,
+// the offset in hex for the hex editor and in decimal for dd
+func formatCorruption(e qcow2.CorruptionError) string {
+	s := fmt.Sprintf("corrupt %s at offset %#x (%d)", e.Structure, e.Offset, e.Offset)
+	if e.Index >= 0 {
+		s += fmt.Sprintf(" index %d", e.Index)
+	}
+	return s + fmt.Sprintf(" value %#x: %s", e.Value, e.Reason)
+}
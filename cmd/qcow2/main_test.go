@@ -0,0 +1,2180 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vbatts/qcow2"
+)
+
+// The tests run the test binary itself as the tool, which it becomes when
+// this is set in its environment
+const runMainEnv = "QCOW2_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		progName = "qcow2"
+		os.Exit(run(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// qcow2Tool runs the tool with args, returning what it printed and its exit
+// status
+func qcow2Tool(t *testing.T, args ...string) (stdout, stderr string, status int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	// snapshot dates are printed in local time
+	cmd.Env = append(os.Environ(), runMainEnv+"=1", "TZ=UTC")
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	if exit, ok := err.(*exec.ExitError); ok {
+		return out.String(), errOut.String(), exit.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), 0
+}
+
+// fixture is the image qemu made for the tests of the package
+func fixture(t *testing.T) string {
+	t.Helper()
+	return unpackFixture(t, "file.qcow2")
+}
+
+// unpackFixture unpacks the gzipped image of testdata into a temporary
+// directory
+func unpackFixture(t *testing.T, base string) string {
+	t.Helper()
+	fh, err := os.Open("../../testdata/" + base + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	gz, err := gzip.NewReader(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), base)
+	out, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, gz); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func expectStatus(t *testing.T, what string, status, want int, stderr string) {
+	t.Helper()
+	if status != want {
+		t.Fatalf("%s: got exit status %d, want %d; stderr:\n%s", what, status, want, stderr)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	_, stderr, status := qcow2Tool(t, "--help")
+	expectStatus(t, "--help", status, 0, stderr)
+	for _, cmd := range []string{"info ", "check ", "create ", "convert ", "map ", "snapshot -l", "resize IMAGE"} {
+		if !strings.Contains(stderr, "\n  "+cmd) {
+			t.Errorf("--help does not list %q:\n%s", cmd, stderr)
+		}
+	}
+
+	_, stderr, status = qcow2Tool(t, "help", "check")
+	expectStatus(t, "help check", status, 0, stderr)
+	if !strings.HasPrefix(stderr, "Usage: qcow2 check ") || !strings.Contains(stderr, "-deep") {
+		t.Errorf("got the help of check:\n%s", stderr)
+	}
+	_, stderr, status = qcow2Tool(t, "resize", "-h")
+	expectStatus(t, "resize -h", status, 0, stderr)
+
+	_, stderr, status = qcow2Tool(t, "no-such-command")
+	expectStatus(t, "an unknown command", status, 1, stderr)
+	if !strings.HasPrefix(stderr, `[ERR] unknown command "no-such-command"`) {
+		t.Errorf("got %q", stderr)
+	}
+	_, stderr, status = qcow2Tool(t)
+	expectStatus(t, "no command", status, 1, stderr)
+	_, stderr, status = qcow2Tool(t, "info", "--no-such-flag", fixture(t))
+	expectStatus(t, "a bad flag", status, exitUsage, stderr)
+	_, stderr, status = qcow2Tool(t, "info")
+	expectStatus(t, "info without IMAGE", status, 1, stderr)
+	if stderr != "[ERR] info: expected IMAGE\n" {
+		t.Errorf("got %q", stderr)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	name := fixture(t)
+	stdout, stderr, status := qcow2Tool(t, "info", name)
+	expectStatus(t, "info", status, 0, stderr)
+	for _, line := range []string{"image: " + name, "file format: qcow2", "virtual size: 100 MiB (104857600 bytes)", "cluster_size: 64 KiB (65536 bytes)", "    compat: 1.1", "    refcount bits: 16", "    corrupt: false"} {
+		if !strings.Contains(stdout, line+"\n") {
+			t.Errorf("info does not print %q:\n%s", line, stdout)
+		}
+	}
+
+	exact, stderr, status := qcow2Tool(t, "info", "--bytes", name)
+	expectStatus(t, "info --bytes", status, 0, stderr)
+	for _, line := range []string{"virtual size: 104857600", "cluster_size: 65536"} {
+		if !strings.Contains(exact, "\n"+line+"\n") {
+			t.Errorf("info --bytes does not print %q:\n%s", line, exact)
+		}
+	}
+	if !regexp.MustCompile(`\n1         base +0 B 2015-`).MatchString(stdout) || !regexp.MustCompile(`\n1         base +0 2015-`).MatchString(exact) {
+		t.Errorf("got the VM state sizes as\n%s\nand with --bytes\n%s", stdout, exact)
+	}
+
+	// the way the tool used to be run
+	alias, stderr, status := qcow2Tool(t, name)
+	expectStatus(t, "the info alias", status, 0, stderr)
+	if alias != stdout {
+		t.Errorf("got %q with the alias, want %q", alias, stdout)
+	}
+
+	// one block per image
+	both, stderr, status := qcow2Tool(t, "info", name, name)
+	expectStatus(t, "info of two images", status, 0, stderr)
+	if both != stdout+"\n"+stdout {
+		t.Errorf("got %q", both)
+	}
+}
+
+// qemuOnly are the keys of qemu-img info --output=json without a counterpart
+// in the information of the tool
+var qemuOnly = map[string]bool{"children": true}
+
+func TestInfoJSON(t *testing.T) {
+	name := fixture(t)
+	stdout, stderr, status := qcow2Tool(t, "info", "--output=json", name)
+	expectStatus(t, "info --output=json", status, 0, stderr)
+	var ours map[string]any
+	if err := json.Unmarshal([]byte(stdout), &ours); err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := os.ReadFile("../../testdata/file.qcow2.info.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var qemu map[string]any
+	if err := json.Unmarshal(recorded, &qemu); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := ours["vbatts-qcow2"].(map[string]any); !ok {
+		t.Errorf("got no information of our own in %s", stdout)
+	}
+	delete(ours, "vbatts-qcow2")
+	// where the fixture was unpacked, and what the file system made of it
+	if filepath.Base(ours["filename"].(string)) != qemu["filename"] {
+		t.Errorf("got filename %v, want it named %v", ours["filename"], qemu["filename"])
+	}
+	delete(ours, "filename")
+	delete(ours, "actual-size")
+	for k, v := range ours {
+		if !reflect.DeepEqual(v, qemu[k]) {
+			t.Errorf("%s: got %v, qemu-img has %v", k, v, qemu[k])
+		}
+	}
+	for k := range qemu {
+		if _, ok := ours[k]; !ok && !qemuOnly[k] && k != "filename" && k != "actual-size" {
+			t.Errorf("%s: missing, qemu-img has %v", k, qemu[k])
+		}
+	}
+}
+
+func TestInfoJSONBacking(t *testing.T) {
+	dir := t.TempDir()
+	base, overlay := filepath.Join(dir, "base.qcow2"), filepath.Join(dir, "overlay.qcow2")
+	img, err := qcow2.Create(base, 1<<20, &qcow2.CreateOptions{Version: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	img, err = qcow2.Create(overlay, 1<<20, &qcow2.CreateOptions{BackingFile: "base.qcow2", BackingFormat: "qcow2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+
+	stdout, stderr, status := qcow2Tool(t, "info", "--output=json", overlay, base)
+	expectStatus(t, "info --output=json", status, 0, stderr)
+	dec := json.NewDecoder(strings.NewReader(stdout))
+	var o, b map[string]any
+	if err := dec.Decode(&o); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&b); err != nil {
+		t.Fatal(err)
+	}
+	if o["backing-filename"] != "base.qcow2" || o["full-backing-filename"] != base || o["backing-filename-format"] != "qcow2" {
+		t.Errorf("got the backing file of the overlay as %v, %v and %v", o["backing-filename"], o["full-backing-filename"], o["backing-filename-format"])
+	}
+	want := map[string]any{"compat": "0.10", "compression-type": "zlib", "refcount-bits": 16.0}
+	if got := b["format-specific"].(map[string]any)["data"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got the format specific data of a version 2 image as %v, want %v", got, want)
+	}
+	if _, ok := b["backing-filename"]; ok {
+		t.Errorf("got a backing file for the base: %v", b)
+	}
+}
+
+func TestInfoFormat(t *testing.T) {
+	dir := t.TempDir()
+	base, overlay := filepath.Join(dir, "base.qcow2"), filepath.Join(dir, "overlay.qcow2")
+	img, err := qcow2.Create(base, 3<<29, &qcow2.CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	img, err = qcow2.Create(overlay, 3<<29, &qcow2.CreateOptions{BackingFile: "base.qcow2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+
+	stdout, stderr, status := qcow2Tool(t, "info", "--format", "{{.Size}} {{.ClusterBits}} {{.ClusterSize}} {{.VirtualSizeHuman}} {{.ChainDepth}} {{.BackingFile}}", overlay, base)
+	expectStatus(t, "info --format", status, 0, stderr)
+	want := "1610612736 16 65536 1.5 GiB 1 base.qcow2\n1610612736 12 4096 1.5 GiB 0 \n"
+	if stdout != want {
+		t.Errorf("got %q, want %q", stdout, want)
+	}
+
+	// where the template goes wrong
+	_, stderr, status = qcow2Tool(t, "info", "--format", "{{.Size}} {{.NoSuchField}}", base)
+	expectStatus(t, "info --format with a bad field", status, 1, stderr)
+	if !strings.Contains(stderr, "--format:1:12: executing") || !strings.Contains(stderr, "NoSuchField") {
+		t.Errorf("got %q", stderr)
+	}
+	_, stderr, status = qcow2Tool(t, "info", "--format", "{{.Size", base)
+	expectStatus(t, "info --format with a bad template", status, 1, stderr)
+	if !strings.Contains(stderr, "--format:1: unclosed action") {
+		t.Errorf("got %q", stderr)
+	}
+
+	stdout, stderr, status = qcow2Tool(t, "info", "--format-help")
+	expectStatus(t, "info --format-help", status, 0, stderr)
+	for _, field := range []string{".Size ", ".ClusterBits ", ".BackingFile ", ".ClusterSize ", ".VirtualSizeHuman ", ".ChainDepth "} {
+		if !strings.Contains(stdout, "\n  "+field) {
+			t.Errorf("--format-help does not list %s:\n%s", field, stdout)
+		}
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// TestInfoVerbose compares info -v of each fixture with its golden file, in
+// which the disk usage, which depends on the file system, is left out
+func TestInfoVerbose(t *testing.T) {
+	for _, base := range []string{"file.qcow2", "extensions.qcow2"} {
+		name := unpackFixture(t, base)
+		stdout, stderr, status := qcow2Tool(t, "info", "-v", name)
+		expectStatus(t, "info -v "+base, status, 0, stderr)
+		got := strings.Replace(stdout, "image: "+name+"\n", "image: "+base+"\n", 1)
+		got = regexp.MustCompile(`(?m)^disk size: .*$`).ReplaceAllString(got, "disk size: -")
+		golden := "../../testdata/" + base + ".info-v.txt"
+		if *update {
+			if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(want) {
+			t.Errorf("%s: got\n%s\nwant\n%s", base, got, want)
+		}
+	}
+}
+
+func TestInfoCorrupt(t *testing.T) {
+	name := fixture(t)
+	fh, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.WriteAt(binary.BigEndian.AppendUint32(nil, 40), 20); err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	stdout, stderr, status := qcow2Tool(t, "info", name)
+	expectStatus(t, "info", status, exitCorrupt, stderr)
+	if stdout != "" || stderr != "[ERR] "+name+": corrupt header at offset 0x14 (20) value 0x28: invalid cluster bits 40\n" {
+		t.Errorf("got %q", stderr)
+	}
+}
+
+func TestInfoEachImage(t *testing.T) {
+	good := fixture(t)
+	dir := t.TempDir()
+	truncated := filepath.Join(dir, "truncated.qcow2")
+	data, err := os.ReadFile(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(truncated, data[:50], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	text := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(text, []byte("not an image at all\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cmd := range []string{"info", "checksum"} {
+		stdout, stderr, status := qcow2Tool(t, cmd, truncated, good, text)
+		// the status is of the first failure, the truncated header
+		expectStatus(t, cmd, status, exitCorrupt, stderr)
+		if !strings.Contains(stdout, good) {
+			t.Errorf("%s: got no output for the good image after the truncated one:\n%s", cmd, stdout)
+		}
+		lines := strings.Split(strings.TrimSuffix(stderr, "\n"), "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[0], "[ERR] "+truncated+": ") || !strings.HasPrefix(lines[1], "[ERR] "+text+": ") ||
+			strings.Count(lines[0], truncated) != 1 || strings.Count(lines[1], text) != 1 {
+			t.Errorf("%s: got the errors\n%s", cmd, stderr)
+		}
+
+		stdout, stderr, status = qcow2Tool(t, cmd, "--fail-fast", truncated, good, text)
+		expectStatus(t, cmd+" --fail-fast", status, exitCorrupt, stderr)
+		if stdout != "" || strings.Count(stderr, "[ERR] ") != 1 || !strings.HasPrefix(stderr, "[ERR] "+truncated+": ") {
+			t.Errorf("%s --fail-fast: got\n%s\nand\n%s", cmd, stdout, stderr)
+		}
+
+		stdout, stderr, status = qcow2Tool(t, cmd, good, good)
+		expectStatus(t, cmd+" of good images", status, 0, stderr)
+		if strings.Count(stdout, good) != 2 {
+			t.Errorf("%s: got\n%s", cmd, stdout)
+		}
+	}
+}
+
+func TestInfoSummary(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "b-disk.qcow2")
+	if _, stderr, status := qcow2Tool(t, "create", good, "1G"); status != 0 {
+		t.Fatal(stderr)
+	}
+	overlay := filepath.Join(dir, "a-overlay-with-a-long-name.qcow2")
+	if _, stderr, status := qcow2Tool(t, "create", "-b", good, "-F", "qcow2", overlay); status != 0 {
+		t.Fatal(stderr)
+	}
+	text := filepath.Join(dir, "c-notes.txt")
+	if err := os.WriteFile(text, []byte("not an image at all\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr, status := qcow2Tool(t, "info", "--summary", text, good, overlay)
+	expectStatus(t, "info --summary", status, exitNotQcow2, stderr)
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	if len(lines) != 4 || stderr != "" {
+		t.Fatalf("got\n%s\nand\n%s", stdout, stderr)
+	}
+	if !strings.HasPrefix(lines[1], overlay+"  ") || !strings.HasPrefix(lines[2], good+" ") || !strings.HasPrefix(lines[3], text+" ") {
+		t.Errorf("got the images out of order:\n%s", stdout)
+	}
+	// the columns line up after the longest name
+	col := strings.Index(lines[0], "VERSION")
+	for _, line := range lines[1:3] {
+		if col != len(overlay)+2 || line[col:col+2] != "3 " {
+			t.Errorf("got the version column at %d in\n%s", col, stdout)
+		}
+	}
+	if fields := strings.Fields(lines[1]); len(fields) != 11 || fields[8] != good || fields[9] != "0" || fields[10] != "-" {
+		t.Errorf("got the overlay as %q", fields)
+	}
+	if fields := strings.Fields(lines[2]); fields[2] != "1" || fields[3] != "GiB" || fields[8] != "-" {
+		t.Errorf("got the base as %q", fields)
+	}
+	if !strings.HasPrefix(lines[3][col:], "ERROR: ") {
+		t.Errorf("got the text file as %q", lines[3])
+	}
+
+	stdout, stderr, status = qcow2Tool(t, "info", "--summary", "--output=json", "--bytes", text, good, overlay)
+	expectStatus(t, "info --summary --output=json", status, exitNotQcow2, stderr)
+	var rows []map[string]any
+	if err := json.Unmarshal([]byte(stdout), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[1]["virtual-size"] != float64(1<<30) || rows[0]["backing-filename"] != good || rows[2]["error"] == nil || rows[1]["error"] != nil {
+		t.Errorf("got %v", rows)
+	}
+
+	stdout, stderr, status = qcow2Tool(t, "info", "--summary", good, overlay)
+	expectStatus(t, "info --summary of good images", status, 0, stderr)
+}
+
+func TestInfoSummaryCSV(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base, the first.qcow2")
+	img, err := qcow2.Create(base, 1<<20, &qcow2.CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteCompressedAt(bytes.Repeat([]byte("z"), 4096), 64<<10); err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	overlay := filepath.Join(dir, "overlay.qcow2")
+	img, err = qcow2.Create(overlay, 2<<20, &qcow2.CreateOptions{BackingFile: filepath.Base(base), BackingFormat: "qcow2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	text := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(text, []byte("not an image at all\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr, status := qcow2Tool(t, "info", "--output=csv", overlay, text, base)
+	expectStatus(t, "info --output=csv", status, exitNotQcow2, stderr)
+	records, err := csv.NewReader(strings.NewReader(stdout)).ReadAll()
+	if err != nil {
+		t.Fatalf("%v in\n%s", err, stdout)
+	}
+	want := [][]string{
+		{"filename", "version", "virtual-size", "actual-size", "cluster-size", "backing-filename", "backing-format", "snapshots", "compressed", "encrypted", "dirty-flag", "corrupt", "error"},
+		{base, "3", "1048576", "", "4096", "", "", "0", "true", "false", "false", "false", ""},
+		{text, "", "", "", "", "", "", "", "", "", "", "", ""},
+		{overlay, "3", "2097152", "", "65536", filepath.Base(base), "qcow2", "0", "false", "false", "false", "false", ""},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d:\n%s", len(records), len(want), stdout)
+	}
+	for i, r := range records {
+		// the sizes on disk and the error vary
+		if i > 0 && i != 2 {
+			if _, err := strconv.ParseInt(r[3], 10, 64); err != nil {
+				t.Errorf("got the actual size %q", r[3])
+			}
+			r[3] = ""
+		}
+		if i == 2 {
+			if r[12] == "" {
+				t.Errorf("got no error for %s", text)
+			}
+			r[12] = ""
+		}
+		if !reflect.DeepEqual(r, want[i]) {
+			t.Errorf("got the record\n%q\nwant\n%q", r, want[i])
+		}
+	}
+
+	stdout, stderr, status = qcow2Tool(t, "info", "--summary", "--output=csv", base)
+	expectStatus(t, "info --summary --output=csv", status, 0, stderr)
+	if !strings.Contains(stdout, `"`+base+`"`) {
+		t.Errorf("the name with a comma is not quoted in\n%s", stdout)
+	}
+}
+
+func TestInfoBackingChain(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.raw")
+	if err := os.WriteFile(base, bytes.Repeat([]byte{1}, 1<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mid := filepath.Join(dir, "mid.qcow2")
+	top := filepath.Join(dir, "top.qcow2")
+	for _, args := range [][]string{
+		{"create", "-b", "base.raw", "-F", "raw", mid, "1M"},
+		{"create", "-b", "mid.qcow2", "-F", "qcow2", top, "1M"},
+		{"dd", "if=" + base, "of=" + top, "count=64k"},
+	} {
+		if _, stderr, status := qcow2Tool(t, args...); status != 0 {
+			t.Fatalf("%s: %s", args, stderr)
+		}
+	}
+
+	stdout, stderr, status := qcow2Tool(t, "info", "--backing-chain", top)
+	expectStatus(t, "info --backing-chain", status, 0, stderr)
+	for _, want := range []string{
+		"Chain position 0: " + top + "\nimage: " + top + "\n",
+		"Chain position 1: " + mid + "\nimage: " + mid + "\n",
+		"Chain position 2: " + base + "\nimage: " + base + "\nfile format: raw\nvirtual size: 1 MiB (1048576 bytes)\n",
+		"Chain summary:\n    depth: 2\n    allocated: 1.1 MiB (1114112 bytes)\n",
+	} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("got no %q in\n%s", want, stdout)
+		}
+	}
+
+	stdout, stderr, status = qcow2Tool(t, "info", "--backing-chain", "--output=json", top)
+	expectStatus(t, "info --backing-chain --output=json", status, 0, stderr)
+	var out struct {
+		Chain []struct {
+			Filename string `json:"filename"`
+			Format   string `json:"format"`
+		} `json:"chain"`
+		Depth          int   `json:"depth"`
+		AllocatedBytes int64 `json:"allocated-bytes"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Chain) != 3 || out.Chain[0].Filename != top || out.Chain[1].Filename != mid || out.Chain[2].Format != "raw" ||
+		out.Depth != 2 || out.AllocatedBytes != 64<<10+1<<20 {
+		t.Errorf("got %+v", out)
+	}
+
+	// a missing base comes after what was read
+	if err := os.Remove(base); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, status = qcow2Tool(t, "info", "--backing-chain", top)
+	expectStatus(t, "info --backing-chain with no base", status, exitIO, stderr)
+	if !strings.Contains(stdout, "Chain position 1: "+mid+"\nimage: ") || !strings.Contains(stdout, "Chain position 2: "+base+"\nerror: ") ||
+		!strings.Contains(stdout, "    depth: 1\n") || !strings.Contains(stderr, "broken at position 2") {
+		t.Errorf("got\n%s\nand\n%s", stdout, stderr)
+	}
+
+	// and a loop where it loops
+	if _, stderr, status := qcow2Tool(t, "rebase", "-u", "-b", "top.qcow2", "-F", "qcow2", mid); status != 0 {
+		t.Fatal(stderr)
+	}
+	stdout, stderr, status = qcow2Tool(t, "info", "--backing-chain", top)
+	expectStatus(t, "info --backing-chain of a loop", status, exitCorrupt, stderr)
+	if !strings.Contains(stdout, "Chain position 1: "+mid+"\nimage: ") || !strings.Contains(stdout, "Chain position 2: "+top+"\nerror: qcow2: backing chain loops\n") {
+		t.Errorf("got\n%s\nand\n%s", stdout, stderr)
+	}
+}
+
+func TestGraph(t *testing.T) {
+	bases, dir := t.TempDir(), t.TempDir()
+	base := filepath.Join(bases, "base.raw")
+	if err := os.WriteFile(base, make([]byte, 1<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mid := filepath.Join(dir, "mid.qcow2")
+	gone := filepath.Join(dir, "gone.qcow2")
+	for _, args := range [][]string{
+		{"create", "-b", base, "-F", "raw", mid, "1M"},
+		{"create", "-b", "mid.qcow2", filepath.Join(dir, "top.qcow2"), "1M"},
+		{"create", "-b", "mid.qcow2", filepath.Join(dir, "wrong.qcow2"), "1M"},
+		{"rebase", "-u", "-b", "mid.qcow2", "-F", "raw", filepath.Join(dir, "wrong.qcow2")},
+		{"create", "-b", "mid.qcow2", gone, "1M"},
+		{"create", "-b", "gone.qcow2", filepath.Join(dir, "orphan.qcow2"), "1M"},
+	} {
+		if _, stderr, status := qcow2Tool(t, args...); status != 0 {
+			t.Fatalf("%s: %s", args, stderr)
+		}
+	}
+	if err := os.Remove(gone); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not an image\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr, status := qcow2Tool(t, "graph", dir)
+	expectStatus(t, "graph", status, 0, stderr)
+	q := strconv.Quote
+	want := "digraph backing {\n\tnode [shape=box];\n" +
+		"\t" + q(base) + ` [label="` + base + `\nraw\nvirtual size 1 MiB\ndisk size `
+	// the base is not listed, but is there
+	if !strings.HasPrefix(stdout, want) || !strings.Contains(stdout, `", style=filled, fillcolor=lightgrey, shape=cylinder];`) {
+		t.Errorf("got\n%s\nwant it to start with\n%s", stdout, want)
+	}
+	for _, want := range []string{
+		q(gone) + ` [label="` + gone + `\nmissing", color=red, fontcolor=red, style=dashed];`,
+		q(mid) + " -> " + q(base) + ";\n",
+		q(filepath.Join(dir, "top.qcow2")) + " -> " + q(mid) + ";\n",
+		q(filepath.Join(dir, "wrong.qcow2")) + " -> " + q(mid) + ` [color=red, fontcolor=red, label="recorded as raw, is qcow2"];`,
+		q(filepath.Join(dir, "orphan.qcow2")) + " -> " + q(gone) + " [color=red, style=dashed];",
+	} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("got no %s in\n%s", want, stdout)
+		}
+	}
+	if strings.Contains(stdout, "notes.txt") || strings.Count(stdout, " -> ") != 4 || strings.Count(stdout, "[label=") != 6 {
+		t.Errorf("got\n%s", stdout)
+	}
+	// in the same order every time
+	again, _, _ := qcow2Tool(t, "graph", filepath.Join(dir, "wrong.qcow2"), dir)
+	if again != stdout {
+		t.Errorf("got\n%s\nthen\n%s", stdout, again)
+	}
+}
+
+func TestCreateResizeSnapshot(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "disk.qcow2")
+	stdout, stderr, status := qcow2Tool(t, "create", "-o", "cluster_size=4k", name, "1M")
+	expectStatus(t, "create", status, 0, stderr)
+	if want := "Formatting '" + name + "', fmt=qcow2 cluster_size=4096 size=1048576\n"; stdout != want {
+		t.Errorf("got %q, want %q", stdout, want)
+	}
+	_, stderr, status = qcow2Tool(t, "create", name)
+	expectStatus(t, "create without SIZE", status, 1, stderr)
+
+	large := filepath.Join(t.TempDir(), "large.qcow2")
+	stdout, stderr, status = qcow2Tool(t, "create", large, "1.5T")
+	expectStatus(t, "create 1.5T", status, 0, stderr)
+	if !strings.HasSuffix(stdout, " size=1649267441664\n") {
+		t.Errorf("got %q", stdout)
+	}
+	_, stderr, status = qcow2Tool(t, "create", large, "10GB")
+	expectStatus(t, "create 10GB", status, 1, stderr)
+	if !strings.Contains(stderr, `unknown unit "GB"`) {
+		t.Errorf("got %q", stderr)
+	}
+
+	overlay := filepath.Join(t.TempDir(), "overlay.qcow2")
+	_, stderr, status = qcow2Tool(t, "create", "-b", name, "-F", "qcow2", overlay)
+	expectStatus(t, "create an overlay", status, 0, stderr)
+	stdout, stderr, status = qcow2Tool(t, "info", overlay)
+	expectStatus(t, "info of the overlay", status, 0, stderr)
+	if !strings.Contains(stdout, "virtual size: 1 MiB (1048576 bytes)\n") || !strings.Contains(stdout, "backing file: "+name+"\nbacking file format: qcow2\n") {
+		t.Errorf("got the overlay info:\n%s", stdout)
+	}
+
+	_, stderr, status = qcow2Tool(t, "resize", name, "+1M")
+	expectStatus(t, "resize", status, 0, stderr)
+	_, stderr, status = qcow2Tool(t, "snapshot", "-c", "two-megs", name)
+	expectStatus(t, "snapshot -c", status, 0, stderr)
+	_, stderr, status = qcow2Tool(t, "resize", name, "-1536k")
+	expectStatus(t, "resize", status, 0, stderr)
+	stdout, stderr, status = qcow2Tool(t, "info", name)
+	expectStatus(t, "info", status, 0, stderr)
+	if !strings.Contains(stdout, "virtual size: 512 KiB (524288 bytes)\n") {
+		t.Errorf("got the info of the resized image:\n%s", stdout)
+	}
+
+	stdout, stderr, status = qcow2Tool(t, "snapshot", "-l", name)
+	expectStatus(t, "snapshot -l", status, 0, stderr)
+	if lines := strings.Split(stdout, "\n"); len(lines) != 4 || !strings.HasPrefix(lines[2], "1         two-megs ") {
+		t.Errorf("got the snapshot list:\n%s", stdout)
+	}
+	_, stderr, status = qcow2Tool(t, "snapshot", "-a", "two-megs", name)
+	expectStatus(t, "snapshot -a", status, 0, stderr)
+	img, err := qcow2.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if img.Size() != 2<<20 {
+		t.Errorf("got %d bytes after applying the snapshot, want %d", img.Size(), 2<<20)
+	}
+	_, stderr, status = qcow2Tool(t, "snapshot", "-l", "-c", "both", name)
+	expectStatus(t, "snapshot -l -c", status, 1, stderr)
+}
+
+func TestCreateBackingSize(t *testing.T) {
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "base.raw")
+	if err := os.WriteFile(raw, make([]byte, 3<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, status := qcow2Tool(t, "create", "-b", raw, "-F", "raw", filepath.Join(dir, "o.qcow2"))
+	expectStatus(t, "create over a raw backing file", status, 0, stderr)
+	if !strings.HasSuffix(stdout, " size=3145728\n") {
+		t.Errorf("got %q", stdout)
+	}
+	stdout, stderr, status = qcow2Tool(t, "create", "-b", raw, filepath.Join(dir, "probed.qcow2"))
+	expectStatus(t, "create over a raw backing file of no format", status, 0, stderr)
+	if !strings.HasSuffix(stdout, " size=3145728\n") {
+		t.Errorf("got %q", stdout)
+	}
+
+	// a relative backing file is found next to the image, not in the cwd
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, status = qcow2Tool(t, "create", filepath.Join(sub, "b.qcow2"), "2M")
+	expectStatus(t, "create", status, 0, stderr)
+	stdout, stderr, status = qcow2Tool(t, "create", "-b", "b.qcow2", "-F", "qcow2", filepath.Join(sub, "o2.qcow2"))
+	expectStatus(t, "create over a relative backing file", status, 0, stderr)
+	if !strings.HasSuffix(stdout, " size=2097152\n") {
+		t.Errorf("got %q", stdout)
+	}
+}
+
+func TestMap(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "disk.qcow2")
+	img, err := qcow2.Create(name, 1<<20, &qcow2.CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte{1}, 8192), 64<<10); err != nil {
+		t.Fatal(err)
+	}
+	var host int64
+	img.WalkExtents(64<<10, 1, func(e qcow2.Extent) error {
+		host = e.HostOffset
+		return nil
+	})
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, status := qcow2Tool(t, "map", name)
+	expectStatus(t, "map", status, 0, stderr)
+	want := "Offset          Length          Mapped to       Type        File\n" +
+		fmt.Sprintf("0x10000         0x2000          %-16sdata        %s\n", fmt.Sprintf("%#x", host), name)
+	if stdout != want {
+		t.Errorf("got\n%s\nwant\n%s", stdout, want)
+	}
+}
+
+func TestMapJSON(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.raw")
+	if err := os.WriteFile(base, bytes.Repeat([]byte{1}, 64<<10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "disk.qcow2")
+	img, err := qcow2.Create(name, 1<<20, &qcow2.CreateOptions{ClusterSize: 4096, BackingFile: "base.raw", BackingFormat: "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte{2}, 8192), 128<<10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(make([]byte, 4096), 136<<10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.TrimZeroClusters(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteCompressedAt(bytes.Repeat([]byte("z"), 4096), 256<<10); err != nil {
+		t.Fatal(err)
+	}
+	var host int64
+	img.WalkExtents(128<<10, 1, func(e qcow2.Extent) error {
+		host = e.HostOffset
+		return nil
+	})
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr, status := qcow2Tool(t, "map", "--output=json", name)
+	expectStatus(t, "map --output=json", status, 0, stderr)
+	want := `[{ "start": 0, "length": 65536, "depth": 1, "present": true, "zero": false, "data": true, "compressed": false, "offset": 0},
+{ "start": 65536, "length": 65536, "depth": 1, "present": false, "zero": true, "data": false, "compressed": false},
+{ "start": 131072, "length": 8192, "depth": 0, "present": true, "zero": false, "data": true, "compressed": false, "offset": ` + strconv.FormatInt(host, 10) + `},
+{ "start": 139264, "length": 4096, "depth": 0, "present": true, "zero": true, "data": false, "compressed": false},
+{ "start": 143360, "length": 118784, "depth": 1, "present": false, "zero": true, "data": false, "compressed": false},
+{ "start": 262144, "length": 4096, "depth": 0, "present": true, "zero": false, "data": true, "compressed": true},
+{ "start": 266240, "length": 782336, "depth": 1, "present": false, "zero": true, "data": false, "compressed": false}]
+`
+	if stdout != want {
+		t.Errorf("got\n%s\nwant\n%s", stdout, want)
+	}
+	var records []map[string]any
+	if err := json.Unmarshal([]byte(stdout), &records); err != nil || len(records) != 7 {
+		t.Errorf("got %d records: %v", len(records), err)
+	}
+}
+
+// TestMapJSONQemu compares map --output=json with that of qemu-img, where
+// it is installed
+func TestMapJSONQemu(t *testing.T) {
+	qemuImg, err := exec.LookPath("qemu-img")
+	if err != nil {
+		t.Skip("no qemu-img")
+	}
+	name := fixture(t)
+	want, err := exec.Command(qemuImg, "map", "--output=json", name).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, status := qcow2Tool(t, "map", "--output=json", name)
+	expectStatus(t, "map --output=json", status, 0, stderr)
+	var got, qemu []map[string]any
+	if err := json.Unmarshal([]byte(stdout), &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(want, &qemu); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, qemu) {
+		t.Errorf("got\n%s\nand qemu-img\n%s", stdout, want)
+	}
+}
+
+func TestExtDump(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "disk.qcow2")
+	img, err := qcow2.Create(name, 1<<20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// two extensions of a vendor type, which AddExtension would not store
+	fh, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := qcow2.ReadHeader(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := []byte("vendor data\x00\xff"), bytes.Repeat([]byte{0xab}, 40)
+	h.ExtHeaders = append(h.ExtHeaders,
+		qcow2.ExtHeader{Type: 0x12345678, Size: len(first), Data: first},
+		qcow2.ExtHeader{Type: 0x12345678, Size: len(second), Data: second})
+	buf, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.WriteAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+
+	stdout, stderr, status := qcow2Tool(t, "ext-list", name)
+	expectStatus(t, "ext-list", status, 0, stderr)
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	want := [][]string{
+		{"INDEX", "TYPE", "NAME", "OFFSET", "SIZE", "DATA"},
+		{"0", "0x6803f857", "feature", "name", "table", "104", "384"},
+		{"1", "0x12345678", "unknown", fmt.Sprint(h.ExtensionOffset(1)), "13", fmt.Sprintf("%x", first)},
+		{"2", "0x12345678", "unknown", fmt.Sprint(h.ExtensionOffset(2)), "40", strings.Repeat("ab", 16) + "..."},
+	}
+	if len(lines) != 4 || strings.Index(lines[0], "DATA") != strings.Index(lines[3], "abab") {
+		t.Fatalf("got\n%s", stdout)
+	}
+	for i, line := range lines {
+		if fields := strings.Fields(line); !reflect.DeepEqual(fields[:min(len(fields), len(want[i]))], want[i]) {
+			t.Errorf("got %q, want %q", fields, want[i])
+		}
+	}
+
+	stdout, stderr, status = qcow2Tool(t, "ext-dump", "--type", "0x12345678", name)
+	expectStatus(t, "ext-dump", status, 0, stderr)
+	if stdout != string(first) {
+		t.Errorf("got %q, want %q", stdout, first)
+	}
+	out := filepath.Join(t.TempDir(), "payload.bin")
+	_, stderr, status = qcow2Tool(t, "ext-dump", "--type", "0x12345678", "--index", "1", name, "-o", out)
+	expectStatus(t, "ext-dump --index 1", status, 0, stderr)
+	if got, err := os.ReadFile(out); err != nil || !bytes.Equal(got, second) {
+		t.Errorf("got %x, %v, want %x", got, err, second)
+	}
+	for _, args := range [][]string{
+		{"--type", "0x12345678", "--index", "2"},
+		{"--type", "0x87654321"},
+		{"--type", "bogus"},
+	} {
+		_, stderr, status = qcow2Tool(t, append(append([]string{"ext-dump"}, args...), name)...)
+		expectStatus(t, "ext-dump "+strings.Join(args, " "), status, 1, stderr)
+	}
+}
+
+// sameValues checks that two outputs are the same but for the radix of
+// their numbers
+func sameValues(t *testing.T, what, dec, hex string) {
+	t.Helper()
+	dw, hw := strings.Fields(dec), strings.Fields(hex)
+	if len(dw) != len(hw) {
+		t.Fatalf("%s: got\n%s\nin decimal and\n%s\nin hex", what, dec, hex)
+	}
+	differ := 0
+	for i := range dw {
+		if dw[i] == hw[i] {
+			continue
+		}
+		d, err1 := strconv.ParseInt(strings.Trim(dw[i], "(),"), 10, 64)
+		h, err2 := strconv.ParseInt(strings.Trim(hw[i], "(),"), 0, 64)
+		if err1 != nil || err2 != nil || d != h || !strings.HasPrefix(strings.Trim(hw[i], "("), "0x") {
+			t.Errorf("%s: got %q in decimal and %q in hex", what, dw[i], hw[i])
+		}
+		differ++
+	}
+	if differ == 0 {
+		t.Errorf("%s: --hex changed nothing in\n%s", what, dec)
+	}
+}
+
+func TestHex(t *testing.T) {
+	name := fixture(t)
+	run := func(args ...string) string {
+		t.Helper()
+		stdout, stderr, status := qcow2Tool(t, append(args, name)...)
+		expectStatus(t, strings.Join(args, " "), status, 0, stderr)
+		return stdout
+	}
+	sameValues(t, "map", run("map", "--hex=false"), run("map"))
+	sameValues(t, "digests", run("digests", "--granularity", "65536"), run("digests", "--granularity", "65536", "--hex"))
+
+	// the layout is the same in both, and the rest does not change
+	dec, hex := run("info"), run("info", "--hex")
+	if !strings.Contains(dec, "\nLayout:\n    header length: ") {
+		t.Fatalf("info does not print the layout:\n%s", dec)
+	}
+	sameValues(t, "info", dec, hex)
+
+	var plain, both struct {
+		Extra map[string]json.RawMessage `json:"vbatts-qcow2"`
+	}
+	if err := json.Unmarshal([]byte(run("info", "--output", "json")), &plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(run("info", "--output", "json", "--hex")), &both); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"header-length", "l1-table-offset", "refcount-table-offset", "snapshots-offset"} {
+		if _, ok := plain.Extra[key+"-hex"]; ok {
+			t.Errorf("got %s-hex without --hex", key)
+		}
+		var n int64
+		var s string
+		if err := json.Unmarshal(both.Extra[key], &n); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if err := json.Unmarshal(both.Extra[key+"-hex"], &s); err != nil {
+			t.Fatalf("%s-hex: %v", key, err)
+		}
+		if s != fmt.Sprintf("%#x", n) {
+			t.Errorf("got %s %d and %s-hex %q", key, n, key, s)
+		}
+		if string(plain.Extra[key]) != string(both.Extra[key]) {
+			t.Errorf("--hex changed %s from %s to %s", key, plain.Extra[key], both.Extra[key])
+		}
+	}
+}
+
+func TestBench(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "bench.qcow2")
+	img, err := qcow2.Create(name, 4<<20, &qcow2.CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte("bench"), 200<<10), 0); err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+
+	stdout, stderr, status := qcow2Tool(t, "bench", "--duration", "200ms", "--warmup", "50ms", "--jobs", "2", "--bs", "16k", "--output=json", name)
+	expectStatus(t, "bench --output=json", status, 0, stderr)
+	var r benchResult
+	if err := json.Unmarshal([]byte(stdout), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Pattern != "seq" || r.BlockSize != 16<<10 || r.Jobs != 2 || !r.L2Cache || r.Length != 4<<20 || r.Interrupted {
+		t.Errorf("got the settings %+v", r)
+	}
+	if r.Reads == 0 || r.Bytes != r.Reads*r.BlockSize || r.Duration < 0.19 || r.Duration > 0.21 || r.IOPS <= 0 ||
+		r.Latency.Min > r.Latency.P50 || r.Latency.P50 > r.Latency.P99 || r.Latency.P99 > r.Latency.Max {
+		t.Errorf("got the results %+v", r)
+	}
+
+	stdout, stderr, status = qcow2Tool(t, "bench", "--pattern", "rand", "--no-cache", "--offset", "1M", "--length", "64k", "--duration", "100ms", "--warmup", "0s", name)
+	expectStatus(t, "bench --no-cache", status, 0, stderr)
+	for _, want := range []string{"pattern:    rand reads of 64 KiB over 64 KiB at 1048576\n", "L2 cache:   off\n", "duration:   100ms\n", "latency:    min "} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("missing %q in\n%s", want, stdout)
+		}
+	}
+
+	_, stderr, status = qcow2Tool(t, "bench", "--offset", "4M", name)
+	expectStatus(t, "bench past the end", status, 1, stderr)
+
+	// an interrupt ends the run early, with what was measured up to then
+	cmd := exec.Command(os.Args[0], "bench", "--duration", "1m", "--warmup", "0s", name)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Skipf("interrupting the tool: %v", err)
+	}
+	err = cmd.Wait()
+	if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != 130 {
+		t.Errorf("interrupted bench returned %v", err)
+	}
+	if !strings.Contains(out.String(), " (interrupted)\n") || strings.Contains(out.String(), "reads:      0 ") {
+		t.Errorf("got the partial results\n%s", out.String())
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), make([]byte, 1<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "overlay.qcow2")
+	img, err := qcow2.Create(name, 1<<20, &qcow2.CreateOptions{BackingFile: "base.raw", BackingFormat: "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	data := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(data, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	opened := `level=INFO msg="opened backing file" image=` + name
+	_, stderr, status := qcow2Tool(t, "checksum", name)
+	expectStatus(t, "checksum", status, 0, stderr)
+	if stderr != "" {
+		t.Errorf("logged without -v:\n%s", stderr)
+	}
+	_, stderr, status = qcow2Tool(t, "-v", "checksum", name)
+	expectStatus(t, "-v checksum", status, 0, stderr)
+	if !strings.HasPrefix(stderr, opened) || strings.Contains(stderr, "level=DEBUG") {
+		t.Errorf("got the log of -v:\n%s", stderr)
+	}
+	_, stderr, status = qcow2Tool(t, "-vv", "dd", "if="+data, "of="+name)
+	expectStatus(t, "-vv dd", status, 0, stderr)
+	if !strings.Contains(stderr, opened) || !strings.Contains(stderr, `level=DEBUG msg="allocated data cluster" image=`+name+" guest-offset=0 ") {
+		t.Errorf("got the log of -vv:\n%s", stderr)
+	}
+}
+
+func TestForceShare(t *testing.T) {
+	name := fixture(t)
+	img, err := qcow2.OpenFile(name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	_, stderr, status := qcow2Tool(t, "info", name)
+	expectStatus(t, "info of a locked image", status, exitIO, stderr)
+	if !strings.Contains(stderr, "in use by another process") {
+		t.Errorf("got the error %q", stderr)
+	}
+	for _, args := range [][]string{{"info"}, {"map"}, {"check"}} {
+		stdout, stderr, status := qcow2Tool(t, append(append(args, "--force-share"), name)...)
+		expectStatus(t, args[0]+" --force-share", status, 0, stderr)
+		if stdout == "" || !strings.Contains(stderr, "level=WARN msg=\"opened without a lock") {
+			t.Errorf("%s --force-share: got stdout %q and stderr %q", args[0], stdout, stderr)
+		}
+	}
+	_, stderr, status = qcow2Tool(t, "check", "--force-share", "-r", "leaks", name)
+	expectStatus(t, "check --force-share -r", status, 1, stderr)
+	if !strings.Contains(stderr, "can not be repaired") {
+		t.Errorf("got the error %q", stderr)
+	}
+	_, stderr, status = qcow2Tool(t, "resize", "--force-share", name, "+1M")
+	expectStatus(t, "resize --force-share", status, exitUsage, stderr)
+}
+
+// qcow2ToolStdin runs the tool as qcow2Tool, with stdin read from a pipe
+func qcow2ToolStdin(t *testing.T, stdin io.Reader, args ...string) (stdout, stderr string, status int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1", "TZ=UTC")
+	// not an *os.File, so the tool gets a pipe
+	cmd.Stdin = stdin
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	if exit, ok := err.(*exec.ExitError); ok {
+		return out.String(), errOut.String(), exit.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), 0
+}
+
+func TestStdin(t *testing.T) {
+	name := fixture(t)
+	tool := func(stdin io.Reader, args ...string) (stdout, stderr string, status int) {
+		t.Helper()
+		return qcow2ToolStdin(t, stdin, args...)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, stderr, status := qcow2Tool(t, "info", "--output=json", name)
+	expectStatus(t, "info", status, 0, stderr)
+	stdout, stderr, status := tool(bytes.NewReader(data), "info", "--output=json", "-")
+	expectStatus(t, "info -", status, 0, stderr)
+	var fromFile, fromStdin qemuInfo
+	if err := json.Unmarshal([]byte(want), &fromFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(stdout), &fromStdin); err != nil {
+		t.Fatal(err)
+	}
+	fromFile.Filename, fromFile.ActualSize, fromFile.FullBackingFilename = "-", 0, ""
+	fromFile.Snapshots = nil
+	if !reflect.DeepEqual(fromStdin, fromFile) {
+		t.Errorf("info - printed\n%s\nwant\n%s", stdout, want)
+	}
+
+	// only the header is there to read
+	stdout, stderr, status = tool(bytes.NewReader(data[:64<<10]), "info", "-")
+	expectStatus(t, "info - of the first cluster", status, 0, stderr)
+	if !strings.Contains(stdout, "image: -\n") || !strings.Contains(stdout, "disk size: unknown, read from a stream\n") {
+		t.Errorf("info - printed\n%s", stdout)
+	}
+	stdout, stderr, status = tool(bytes.NewReader(data[:64<<10]), "ext-list", "-")
+	expectStatus(t, "ext-list -", status, 0, stderr)
+	if !strings.HasPrefix(stdout, "INDEX") {
+		t.Errorf("ext-list - printed\n%s", stdout)
+	}
+	_, stderr, status = tool(bytes.NewReader(data[:100]), "info", "-")
+	expectStatus(t, "info - of a truncated header", status, 1, stderr)
+	if !strings.Contains(stderr, "the stream ends within the header") {
+		t.Errorf("got the error %q", stderr)
+	}
+
+	// check fails as qemu-img check does
+	for args, want := range map[string]int{"map -": exitIO, "check -": 1, "info --backing-chain -": exitIO} {
+		args := strings.Fields(args)
+		_, stderr, status = tool(bytes.NewReader(data), args...)
+		expectStatus(t, strings.Join(args, " "), status, want, stderr)
+		if !strings.Contains(stderr, "requires a seekable input") {
+			t.Errorf("%s: got the error %q", strings.Join(args, " "), stderr)
+		}
+	}
+}
+
+func TestDDStdin(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "disk.qcow2")
+	_, stderr, status := qcow2Tool(t, "create", name, "1M")
+	expectStatus(t, "create", status, 0, stderr)
+
+	// if= defaults to stdin, which is read in sequence
+	_, stderr, status = qcow2ToolStdin(t, strings.NewReader("skipped:written"), "dd", "of="+name, "seek=4096", "skip=8")
+	expectStatus(t, "dd of an image from stdin", status, 0, stderr)
+	stdout, stderr, status := qcow2Tool(t, "dd", "if="+name, "skip=4095", "count=8")
+	expectStatus(t, "dd to stdout", status, 0, stderr)
+	if stdout != "\x00written" {
+		t.Errorf("got %q", stdout)
+	}
+	_, stderr, status = qcow2ToolStdin(t, strings.NewReader("past the end"), "dd", "if=-", "of="+name, "seek=1048570")
+	expectStatus(t, "dd from stdin past the end", status, 1, stderr)
+
+	raw := filepath.Join(dir, "out.raw")
+	_, stderr, status = qcow2ToolStdin(t, strings.NewReader("0123456789"), "dd", "of="+raw, "seek=2", "count=4")
+	expectStatus(t, "dd of a raw file from stdin", status, 0, stderr)
+	if got, err := os.ReadFile(raw); err != nil || string(got) != "\x00\x000123" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestCompressedContainers(t *testing.T) {
+	for _, tc := range []struct{ ext, container, command string }{
+		{"gz", "gzip", ""},
+		{"xz", "xz", "xz"},
+		{"zst", "zstd", "zstd"},
+	} {
+		t.Run(tc.container, func(t *testing.T) {
+			name := "../../testdata/small.qcow2." + tc.ext
+			// the container is told by its magic, with no command to run
+			out := filepath.Join(t.TempDir(), "out.raw")
+			for _, cmd := range []struct {
+				args []string
+				want int
+			}{{[]string{"map", name}, exitNotQcow2}, {[]string{"check", name}, 1}, {[]string{"convert", "-O", "raw", name, out}, exitNotQcow2}} {
+				args := cmd.args
+				_, stderr, status := qcow2Tool(t, args...)
+				expectStatus(t, strings.Join(args, " "), status, cmd.want, stderr)
+				if !strings.Contains(stderr, tc.container+"-compressed as a whole, and random access into it is not supported") {
+					t.Errorf("%s: got the error %q", strings.Join(args, " "), stderr)
+				}
+			}
+			if tc.command != "" {
+				if _, err := exec.LookPath(tc.command); err != nil {
+					t.Skipf("%s is not installed", tc.command)
+				}
+			}
+
+			stdout, stderr, status := qcow2Tool(t, "info", name)
+			expectStatus(t, "info", status, 0, stderr)
+			for _, want := range []string{"container: " + tc.container + ", of which only the header is read\n", "virtual size: 1 MiB (1048576 bytes)\n", "cluster_size: 4 KiB (4096 bytes)\n", "backing file: base.qcow2\n", ", compressed\n"} {
+				if !strings.Contains(stdout, want) {
+					t.Errorf("info printed\n%s\nwithout %q", stdout, want)
+				}
+			}
+			stdout, stderr, status = qcow2Tool(t, "info", "--output=json", name)
+			expectStatus(t, "info --output=json", status, 0, stderr)
+			var inf qemuInfo
+			if err := json.Unmarshal([]byte(stdout), &inf); err != nil {
+				t.Fatal(err)
+			}
+			if inf.Extra.Container != tc.container || inf.VirtualSize != 1<<20 || inf.BackingFilenameFormat != "qcow2" {
+				t.Errorf("info --output=json printed\n%s", stdout)
+			}
+			stdout, stderr, status = qcow2Tool(t, "ext-list", name)
+			expectStatus(t, "ext-list", status, 0, stderr)
+			if !strings.HasPrefix(stdout, "read from a "+tc.container+" container") || !strings.Contains(stdout, "backing file format") {
+				t.Errorf("ext-list printed\n%s", stdout)
+			}
+		})
+	}
+}
+
+func TestCompressedContainerCommandMissing(t *testing.T) {
+	// no xz to be found, the tool itself being run by its path
+	t.Setenv("PATH", t.TempDir())
+	_, stderr, status := qcow2Tool(t, "info", "../../testdata/small.qcow2.xz")
+	expectStatus(t, "info", status, 1, stderr)
+	if !strings.Contains(stderr, "in a xz container, which needs the xz command to decompress, and it is not installed") {
+		t.Errorf("got the error %q", stderr)
+	}
+}
+
+func TestInfoQuiet(t *testing.T) {
+	name := fixture(t)
+	stdout, stderr, status := qcow2Tool(t, "info", "-q", name)
+	expectStatus(t, "info -q", status, 0, stderr)
+	if want := "file=" + name + " version=3 virtual_size=104857600 cluster_size=65536 backing= snapshots=2 dirty=false corrupt=false\n"; stdout != want {
+		t.Errorf("info -q printed\n%q\nwant\n%q", stdout, want)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "my base.raw"), make([]byte, 1<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	overlay := filepath.Join(dir, "overlay.qcow2")
+	img, err := qcow2.Create(overlay, 1<<20, &qcow2.CreateOptions{BackingFile: "my base.raw", BackingFormat: "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	garbage := filepath.Join(dir, "garbage.qcow2")
+	if err := os.WriteFile(garbage, []byte("not an image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, status = qcow2Tool(t, "info", "-q", overlay, garbage)
+	expectStatus(t, "info -q of a garbage file", status, exitNotQcow2, stderr)
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], ` backing="my\x20base.raw" `) || len(strings.Fields(lines[0])) != 8 {
+		t.Errorf("info -q printed\n%s", stdout)
+	}
+	if !strings.Contains(stderr, garbage) {
+		t.Errorf("got the error %q", stderr)
+	}
+
+	_, stderr, status = qcow2Tool(t, "info", "-q", "--output=json", name)
+	expectStatus(t, "info -q --output=json", status, 1, stderr)
+}
+
+func TestVersion(t *testing.T) {
+	stdout, stderr, status := qcow2Tool(t, "version", "--output=json")
+	expectStatus(t, "version --output=json", status, 0, stderr)
+	var v versionInfo
+	if err := json.Unmarshal([]byte(stdout), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.GoVersion == "" || len(v.Capabilities.Features) != len(qcow2.KnownFeatures) || !reflect.DeepEqual(v.Capabilities.CompressionTypes, []string{"zlib"}) {
+		t.Errorf("version --output=json printed\n%s", stdout)
+	}
+	for _, f := range v.Capabilities.Features {
+		if f.Name == "extended L2 entries" && f.Supported {
+			t.Errorf("extended L2 entries are reported as supported")
+		}
+	}
+
+	stdout, stderr, status = qcow2Tool(t, "version")
+	expectStatus(t, "version", status, 0, stderr)
+	for _, want := range []string{"go: " + v.GoVersion, "cluster bits: 9 to 21 (512 B to 2 MiB)\n", "dirty bit", "LUKS"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("version printed\n%s\nwithout %q", stdout, want)
+		}
+	}
+}
+
+// fakeTerminal answers the prompts for passphrases with answers, in turn
+type fakeTerminal struct {
+	terminal bool
+	answers  []string
+	prompts  []string
+}
+
+func (f *fakeTerminal) isTerminal() bool { return f.terminal }
+
+func (f *fakeTerminal) readPassphrase(prompt string) ([]byte, error) {
+	f.prompts = append(f.prompts, prompt)
+	if len(f.prompts) > len(f.answers) {
+		return nil, io.EOF
+	}
+	return []byte(f.answers[len(f.prompts)-1]), nil
+}
+
+func TestPassphrasePrompt(t *testing.T) {
+	// encrypted with the passphrase qcow2, holding "secret data, " at 6000
+	name := unpackFixture(t, "luks.qcow2")
+	defer func(r terminal) { passphraseReader = r }(passphraseReader)
+	read := func(term *fakeTerminal) ([]byte, error) {
+		passphraseReader = term
+		img, err := openImage(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer img.Close()
+		if len(term.prompts) != 0 {
+			t.Errorf("asked for the passphrase when opening")
+		}
+		buf := make([]byte, 13)
+		_, err = img.ReadAt(buf, 6000)
+		return buf, err
+	}
+
+	prompt := "Passphrase for " + name + ": "
+	term := &fakeTerminal{terminal: true, answers: []string{"wrong", "qcow2"}}
+	if buf, err := read(term); err != nil || string(buf) != "secret data, " {
+		t.Errorf("read %q, %v", buf, err)
+	}
+	if !reflect.DeepEqual(term.prompts, []string{prompt, "Wrong passphrase, try again.\n" + prompt}) {
+		t.Errorf("prompted %q", term.prompts)
+	}
+
+	term = &fakeTerminal{terminal: true, answers: []string{"a", "b", "c", "qcow2"}}
+	if _, err := read(term); err != qcow2.ErrBadPassphrase || len(term.prompts) != passphraseAttempts {
+		t.Errorf("after %d wrong passphrases: %v", len(term.prompts), err)
+	}
+
+	term = &fakeTerminal{}
+	if _, err := read(term); err == nil || !strings.Contains(err.Error(), "not a terminal") || len(term.prompts) != 0 {
+		t.Errorf("without a terminal: %v, after %d prompts", err, len(term.prompts))
+	}
+}
+
+func TestEncryptedImage(t *testing.T) {
+	name := unpackFixture(t, "luks.qcow2")
+	// stdin is not a terminal, so asking for the passphrase would fail
+	stdout, stderr, status := qcow2Tool(t, "info", name)
+	expectStatus(t, "info", status, 0, stderr)
+	if !strings.Contains(stdout, "encrypted: yes") {
+		t.Errorf("info printed\n%s", stdout)
+	}
+	_, stderr, status = qcow2Tool(t, "read", name, "6000", "13")
+	expectStatus(t, "read without a passphrase", status, 1, stderr)
+	if !strings.Contains(stderr, "is encrypted, and stdin is not a terminal") {
+		t.Errorf("read without a passphrase printed %q", stderr)
+	}
+
+	file := filepath.Join(t.TempDir(), "passphrase")
+	if err := os.WriteFile(file, []byte("qcow2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, status = qcow2Tool(t, "-passphrase-file", file, "read", name, "6000", "13")
+	expectStatus(t, "read with -passphrase-file", status, 0, stderr)
+	if stdout != "secret data, " {
+		t.Errorf("read printed %q", stdout)
+	}
+	if err := os.WriteFile(file, []byte("wrong\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, status = qcow2Tool(t, "-passphrase-file", file, "read", name, "6000", "13")
+	expectStatus(t, "read with a wrong -passphrase-file", status, 1, stderr)
+	if !strings.Contains(stderr, "unlocks no key slot") {
+		t.Errorf("read with a wrong passphrase printed %q", stderr)
+	}
+}
+
+func TestSkipExtensions(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "damaged.qcow2")
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), bytes.Repeat([]byte("base"), 1<<18), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	img, err := qcow2.Create(name, 1<<20, &qcow2.CreateOptions{BackingFile: "base.raw", BackingFormat: "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := int64(img.Header.HeaderLength)
+	img.Close()
+	// garbage over the extensions, before the backing file name
+	fh, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fh.WriteAt(bytes.Repeat([]byte{0xff}, 16), at)
+	fh.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, stderr, status := qcow2Tool(t, "info", name)
+	expectStatus(t, "info", status, exitCorrupt, stderr)
+	stdout, stderr, status := qcow2Tool(t, "info", "--skip-extensions", name)
+	expectStatus(t, "info --skip-extensions", status, 0, stderr)
+	for _, want := range []string{"note: the header extensions were skipped (--skip-extensions): the backing format is unknown, and probed\n", "backing file: base.raw\n"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("info --skip-extensions printed\n%s\nwithout %q", stdout, want)
+		}
+	}
+	if strings.Contains(stdout, "backing file format") {
+		t.Errorf("info --skip-extensions printed a backing file format\n%s", stdout)
+	}
+	stdout, stderr, status = qcow2Tool(t, "info", "--skip-extensions", "--output=json", name)
+	expectStatus(t, "info --skip-extensions --output=json", status, 0, stderr)
+	if !strings.Contains(stdout, `"extensions-skipped": true`) {
+		t.Errorf("info --skip-extensions --output=json printed\n%s", stdout)
+	}
+
+	for _, cmd := range []string{"check", "map"} {
+		_, stderr, status = qcow2Tool(t, cmd, "--skip-extensions", name)
+		expectStatus(t, cmd+" --skip-extensions", status, 0, stderr)
+		if !strings.Contains(stderr, "[WARN] "+name+": the header extensions were skipped") {
+			t.Errorf("%s --skip-extensions printed %q", cmd, stderr)
+		}
+	}
+	_, stderr, status = qcow2Tool(t, "check", "--skip-extensions", "-r", "leaks", name)
+	expectStatus(t, "check --skip-extensions -r leaks", status, 1, stderr)
+}
+
+func TestExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	good := fixture(t)
+	data, err := os.ReadFile(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched := func(name string, off int, v uint32) string {
+		b := append([]byte(nil), data...)
+		binary.BigEndian.PutUint32(b[off:], v)
+		return write(name, b)
+	}
+	v4 := patched("v4.qcow2", 4, 4)
+	corrupt := patched("corrupt.qcow2", 20, 40)
+	text := write("notes.txt", []byte("not an image at all\n"))
+	ref := write("ref.raw", make([]byte, 1<<20))
+	img, err := qcow2.Create(filepath.Join(dir, "small.qcow2"), 1<<20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	small := filepath.Join(dir, "small.qcow2")
+	empty := filepath.Join(dir, "empty.qcow2")
+	if img, err = qcow2.Create(empty, 1<<20, nil); err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	missing := filepath.Join(dir, "missing.qcow2")
+
+	for _, tc := range []struct {
+		args []string
+		want int
+	}{
+		{[]string{"info", good}, exitOK},
+		{[]string{"info"}, exitUsage},
+		{[]string{"info", "--no-such-flag", good}, exitUsage},
+		{[]string{"info", missing}, exitIO},
+		{[]string{"info", text}, exitNotQcow2},
+		{[]string{"info", v4}, exitUnsupported},
+		{[]string{"info", corrupt}, exitCorrupt},
+		{[]string{"verify", small, ref}, exitCorrupt},
+		// as qemu-img
+		{[]string{"check", missing}, 1},
+		{[]string{"check", "--no-such-flag", good}, 1},
+		{[]string{"compare", small, empty}, 1},
+		{[]string{"compare", small, missing}, 2},
+		{[]string{"compare", "--no-such-flag", small, empty}, 2},
+	} {
+		_, stderr, status := qcow2Tool(t, tc.args...)
+		if status != tc.want {
+			t.Errorf("%s: got exit status %d, want %d; stderr:\n%s", strings.Join(tc.args, " "), status, tc.want, stderr)
+		}
+	}
+}
+
+func TestCompareRaw(t *testing.T) {
+	name := fixture(t)
+	raw := filepath.Join(t.TempDir(), "file.raw")
+	_, stderr, status := qcow2Tool(t, "convert", "-O", "raw", name, raw)
+	expectStatus(t, "convert -O raw", status, 0, stderr)
+
+	stdout, stderr, status := qcow2Tool(t, "compare", name, raw)
+	expectStatus(t, "compare with a probed raw file", status, 0, stderr+stdout)
+	stdout, stderr, status = qcow2Tool(t, "compare", "-f", "raw", "-F", "qcow2", raw, name)
+	expectStatus(t, "compare -f raw -F qcow2", status, 0, stderr+stdout)
+	_, stderr, status = qcow2Tool(t, "compare", "-F", "qcow2", name, raw)
+	expectStatus(t, "compare of a raw file as qcow2", status, 2, stderr)
+
+	fh, err := os.OpenFile(raw, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.WriteAt([]byte{0xff}, 4097); err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	stdout, stderr, status = qcow2Tool(t, "compare", name, raw)
+	expectStatus(t, "compare with a changed raw file", status, 1, stderr)
+	if stdout != "Content mismatch at offset 4097!\n" {
+		t.Errorf("got %q", stdout)
+	}
+}
+
+func TestOffset(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), bytes.Repeat([]byte("base"), 1<<16), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "top.qcow2")
+	img, err := qcow2.Create(name, 2<<20, &qcow2.CreateOptions{BackingFile: "base.raw", BackingFormat: "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt([]byte("data"), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+
+	for _, tc := range []struct {
+		off  string
+		want []string
+	}{
+		{"1M", []string{
+			"guest offset 0x100000 (1048576), in cluster 16 of 65536 bytes",
+			"depth 0: image " + name + " L1 index: 0,",
+			"L2 index: 16, entry at",
+			"type: data host offset:",
+			"remaining: 65536 bytes to the end of the cluster",
+		}},
+		{"0x1234", []string{
+			"L2 entry: 0x0000000000000000 type: unallocated, left to the backing file remaining: 60876 bytes to the end of the cluster",
+			"depth 1: raw file " + filepath.Join(dir, "base.raw") + " type: data host offset: 0x1234 (4660)",
+		}},
+		{"1536K", []string{
+			"raw file " + filepath.Join(dir, "base.raw") + " type: past the end of the file, reads as zeros",
+		}},
+	} {
+		stdout, stderr, status := qcow2Tool(t, "offset", name, tc.off)
+		expectStatus(t, "offset "+tc.off, status, 0, stderr)
+		// the columns of the tables are as wide as their keys
+		words := strings.Join(strings.Fields(stdout), " ")
+		for _, want := range tc.want {
+			if !strings.Contains(words, want) {
+				t.Errorf("offset %s printed\n%s\nwithout %q", tc.off, stdout, want)
+			}
+		}
+	}
+	for _, off := range []string{"2M", "-1", "lots"} {
+		_, stderr, status := qcow2Tool(t, "offset", name, off)
+		expectStatus(t, "offset "+off, status, exitUsage, stderr)
+	}
+}
+
+func TestParts(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "disk.qcow2")
+	img, err := qcow2.Create(name, 64<<20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbr := make([]byte, 512)
+	for i, p := range []struct {
+		status, id     byte
+		start, sectors uint32
+	}{{0x80, 0xef, 2048, 8192}, {0, 0x83, 10240, 120832}} {
+		e := mbr[446+16*i:]
+		e[0], e[4] = p.status, p.id
+		binary.LittleEndian.PutUint32(e[8:], p.start)
+		binary.LittleEndian.PutUint32(e[12:], p.sectors)
+	}
+	mbr[510], mbr[511] = 0x55, 0xaa
+	if _, err := img.WriteAt(mbr, 0); err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+
+	stdout, stderr, status := qcow2Tool(t, "parts", name)
+	expectStatus(t, "parts", status, 0, stderr)
+	want := "MBR partition table, 512 byte sectors\n" +
+		"NUMBER  START    SIZE    TYPE               NAME  FLAGS\n" +
+		"1       1048576  4 MiB   0xef (EFI System)        bootable\n" +
+		"2       5242880  59 MiB  0x83 (Linux)\n"
+	if stdout != want {
+		t.Errorf("parts printed\n%s\nwant\n%s", stdout, want)
+	}
+	stdout, stderr, status = qcow2Tool(t, "parts", "--json", "--hex", name)
+	expectStatus(t, "parts --json", status, 0, stderr)
+	var got struct {
+		Scheme     string `json:"scheme"`
+		Partitions []struct {
+			Number   int      `json:"number"`
+			StartHex string   `json:"start-hex"`
+			Size     int64    `json:"size"`
+			TypeName string   `json:"type-name"`
+			Flags    []string `json:"flags"`
+		} `json:"partitions"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &got); err != nil {
+		t.Fatalf("parts --json printed %s: %v", stdout, err)
+	}
+	if got.Scheme != "mbr" || len(got.Partitions) != 2 || got.Partitions[1].StartHex != "0x500000" || got.Partitions[1].Size != 120832*512 ||
+		got.Partitions[0].TypeName != "EFI System" || len(got.Partitions[0].Flags) != 1 || got.Partitions[1].Flags == nil {
+		t.Errorf("parts --json printed\n%s", stdout)
+	}
+
+	_, stderr, status = qcow2Tool(t, "parts", fixture(t))
+	expectStatus(t, "parts of a disk without partitions", status, 1, stderr)
+	if !strings.Contains(stderr, "no partition table found") {
+		t.Errorf("parts of a disk without partitions printed %q", stderr)
+	}
+}
+
+func TestPartsExtract(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "disk.qcow2")
+	img, err := qcow2.Create(name, 8<<20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbr := make([]byte, 512)
+	mbr[446+4] = 0x83
+	binary.LittleEndian.PutUint32(mbr[446+8:], 2048)
+	binary.LittleEndian.PutUint32(mbr[446+12:], 8192)
+	mbr[510], mbr[511] = 0x55, 0xaa
+	// data at both ends of the partition, and a hole in between
+	for _, w := range []struct {
+		p   []byte
+		off int64
+	}{{mbr, 0}, {[]byte("superblock"), 1<<20 + 1024}, {[]byte("last"), 5<<20 - 4}, {[]byte("after"), 5 << 20}} {
+		if _, err := img.WriteAt(w.p, w.off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	img.Close()
+
+	part := filepath.Join(dir, "part1.img")
+	_, stderr, status := qcow2Tool(t, "parts", "--extract", "1", name, "-o", part)
+	expectStatus(t, "parts --extract 1", status, 0, stderr)
+	got, err := os.ReadFile(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 4<<20)
+	copy(want[1024:], "superblock")
+	copy(want[len(want)-4:], "last")
+	if !bytes.Equal(got, want) {
+		t.Errorf("extracted %d bytes, not the partition", len(got))
+	}
+	// the hole between the two takes no space, where the file system knows
+	if fi, err := os.Stat(part); err == nil && runtime.GOOS == "linux" && diskUsage(fi) >= 1<<20 {
+		t.Errorf("the extracted partition takes %d bytes, not sparse", diskUsage(fi))
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--offset", "0x500000", "--length", "5"}, "after"},
+		{[]string{"--extract", "1", "--offset", "5M-4"}, ""},
+		{[]string{"--extract", "1", "--offset", "0x4ffffc"}, "last"},
+		{[]string{"--extract", "1", "--length", "2K"}, string(want[:2048])},
+	} {
+		out := filepath.Join(dir, "range.img")
+		args := append(append([]string{"parts"}, tc.args...), "-o", out, name)
+		_, stderr, status := qcow2Tool(t, args...)
+		if tc.want == "" {
+			expectStatus(t, strings.Join(args, " "), status, exitUsage, stderr)
+			continue
+		}
+		expectStatus(t, strings.Join(args, " "), status, 0, stderr)
+		if got, err := os.ReadFile(out); err != nil || string(got) != tc.want {
+			t.Errorf("%s copied %q, %v", strings.Join(args, " "), got, err)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"parts", "--extract", "2", "-o", part, name},
+		{"parts", "--offset", "7M", "--length", "2M", "-o", part, name},
+		{"parts", "--extract", "1", name},
+		{"parts", "-o", part, name},
+	} {
+		_, stderr, status := qcow2Tool(t, args...)
+		expectStatus(t, strings.Join(args, " "), status, exitUsage, stderr)
+	}
+}
+
+// nbdClient is the client side of an NBD connection, for the tests
+type nbdClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func (c *nbdClient) write(vs ...any) {
+	c.t.Helper()
+	for _, v := range vs {
+		if s, ok := v.(string); ok {
+			v = []byte(s)
+		}
+		if err := binary.Write(c.conn, binary.BigEndian, v); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+func (c *nbdClient) read(vs ...any) {
+	c.t.Helper()
+	for _, v := range vs {
+		if err := binary.Read(c.conn, binary.BigEndian, v); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+// option sends an option and reads its replies up to the final one, whose
+// type it returns with the data of the replies before it
+func (c *nbdClient) option(option uint32, data []byte) (uint32, [][]byte) {
+	c.t.Helper()
+	c.write(uint64(nbdOptMagic), option, uint32(len(data)), data)
+	var replies [][]byte
+	for {
+		var magic uint64
+		var opt, typ, n uint32
+		c.read(&magic, &opt, &typ, &n)
+		if magic != nbdRepMagic || opt != option {
+			c.t.Fatalf("got the reply magic %#x for the option %d", magic, opt)
+		}
+		b := make([]byte, n)
+		c.read(b)
+		if typ == nbdRepAck || typ&(1<<31) != 0 {
+			return typ, replies
+		}
+		replies = append(replies, append(binary.BigEndian.AppendUint32(nil, typ), b...))
+	}
+}
+
+// request sends a request and reads the chunks of its structured reply,
+// returning their types and payloads
+func (c *nbdClient) request(typ uint16, flags uint16, off uint64, n uint32, payload []byte) ([]uint16, [][]byte) {
+	c.t.Helper()
+	c.write(uint32(nbdRequestMagic), flags, typ, uint64(42), off, n, payload)
+	var types []uint16
+	var payloads [][]byte
+	for {
+		var magic uint32
+		var chunkFlags, chunkType uint16
+		var cookie uint64
+		var length uint32
+		c.read(&magic, &chunkFlags, &chunkType, &cookie, &length)
+		if magic != nbdStructMagic || cookie != 42 {
+			c.t.Fatalf("got the reply magic %#x for cookie %d", magic, cookie)
+		}
+		b := make([]byte, length)
+		c.read(b)
+		types, payloads = append(types, chunkType), append(payloads, b)
+		if chunkFlags&nbdReplyFlagDone != 0 {
+			return types, payloads
+		}
+	}
+}
+
+// nbdField is s after its length, as strings go in options
+func nbdField(s string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(s))), s...)
+}
+
+func TestNBD(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "disk.qcow2")
+	img, err := qcow2.Create(name, 16<<20, &qcow2.CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("nbd data"), 1024)
+	if _, err := img.WriteAt(data, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	img, err = qcow2.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	e := &nbdExport{name: "disk", img: img}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := listen("unix:" + filepath.Join(t.TempDir(), "nbd.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() { served <- serveNBD(ctx, l, e) }()
+	connect := func() *nbdClient {
+		conn, err := net.Dial("unix", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		c := &nbdClient{t, conn}
+		var magic, opt uint64
+		var flags uint16
+		c.read(&magic, &opt, &flags)
+		if magic != nbdMagic || opt != nbdOptMagic || flags != nbdFlagFixed|nbdFlagNoZeroes {
+			t.Fatalf("got the greeting %#x %#x %#x", magic, opt, flags)
+		}
+		c.write(uint32(nbdFlagFixed | nbdFlagNoZeroes))
+		return c
+	}
+
+	c := connect()
+	if typ, replies := c.option(nbdOptList, nil); typ != nbdRepAck || len(replies) != 1 || !bytes.Equal(replies[0][4:], nbdField("disk")) {
+		t.Errorf("NBD_OPT_LIST: got %#x, %q", typ, replies)
+	}
+	if typ, _ := c.option(nbdOptSetMetaContext, append(append(nbdField("disk"), 0, 0, 0, 1), nbdField("base:allocation")...)); typ != nbdRepErrInvalid {
+		t.Errorf("set a meta context without structured replies: %#x", typ)
+	}
+	if typ, _ := c.option(nbdOptStructuredReply, nil); typ != nbdRepAck {
+		t.Errorf("NBD_OPT_STRUCTURED_REPLY: got %#x", typ)
+	}
+	if typ, replies := c.option(nbdOptSetMetaContext, append(append(nbdField("disk"), 0, 0, 0, 1), nbdField("base:allocation")...)); typ != nbdRepAck || len(replies) != 1 {
+		t.Errorf("NBD_OPT_SET_META_CONTEXT: got %#x, %q", typ, replies)
+	}
+	if typ, _ := c.option(nbdOptInfo, append(nbdField("other"), 0, 0)); typ != nbdRepErrUnknown {
+		t.Errorf("NBD_OPT_INFO of an unknown export: got %#x", typ)
+	}
+	typ, replies := c.option(nbdOptGo, append(nbdField("disk"), 0, 1, 0, nbdInfoBlockSize))
+	if typ != nbdRepAck || len(replies) != 2 {
+		t.Fatalf("NBD_OPT_GO: got %#x, %q", typ, replies)
+	}
+	if info := replies[0]; binary.BigEndian.Uint64(info[6:]) != 16<<20 || binary.BigEndian.Uint16(info[14:])&nbdFlagReadOnly == 0 {
+		t.Errorf("NBD_OPT_GO: got the export info %x", info)
+	}
+
+	types, payloads := c.request(nbdCmdRead, 0, 1<<20-10, 20, nil)
+	if len(types) != 1 || types[0] != nbdReplyOffsetData || binary.BigEndian.Uint64(payloads[0]) != 1<<20-10 ||
+		!bytes.Equal(payloads[0][8:], append(make([]byte, 10), data[:10]...)) {
+		t.Errorf("read: got the chunks %d, %q", types, payloads)
+	}
+	types, payloads = c.request(nbdCmdBlockStatus, 0, 1<<20-8192, 24576, nil)
+	want := []uint32{nbdAllocationID, 8192, nbdStateHole | nbdStateZero, 8192, 0, 8192, nbdStateHole | nbdStateZero}
+	if len(types) != 1 || types[0] != nbdReplyBlockStatus || !reflect.DeepEqual(nbdUint32s(payloads[0]), want) {
+		t.Errorf("block status: got the chunks %d, %v", types, nbdUint32s(payloads[0]))
+	}
+	types, payloads = c.request(nbdCmdBlockStatus, nbdCmdFlagReqOne, 1<<20, 1<<20, nil)
+	if len(types) != 1 || !reflect.DeepEqual(nbdUint32s(payloads[0]), []uint32{nbdAllocationID, 8192, 0}) {
+		t.Errorf("block status of one extent: got the chunks %d, %v", types, nbdUint32s(payloads[0]))
+	}
+	for _, req := range []struct {
+		typ     uint16
+		off     uint64
+		n       uint32
+		payload []byte
+		errno   uint32
+	}{
+		{nbdCmdRead, 16<<20 - 1, 2, nil, nbdEINVAL},
+		{nbdCmdBlockStatus, 0, 0, nil, nbdEINVAL},
+		// the data of a write is read past, to the next request
+		{nbdCmdWrite, 0, 4, []byte("data"), nbdEPERM},
+		{nbdCmdTrim, 0, 4096, nil, nbdEPERM},
+		{nbdCmdFlush, 0, 0, nil, 0},
+	} {
+		types, payloads := c.request(req.typ, 0, req.off, req.n, req.payload)
+		switch {
+		case req.errno == 0 && (len(types) != 1 || types[0] != nbdReplyNone):
+			t.Errorf("command %d: got the chunks %d", req.typ, types)
+		case req.errno != 0 && (len(types) != 1 || types[0] != nbdReplyError || binary.BigEndian.Uint32(payloads[0]) != req.errno):
+			t.Errorf("command %d: got the chunks %d, %q", req.typ, types, payloads)
+		}
+	}
+	c.write(uint32(nbdRequestMagic), uint16(0), uint16(nbdCmdDisc), uint64(42), uint64(0), uint32(0))
+	if n, err := c.conn.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Errorf("the connection is still open after NBD_CMD_DISC: %v", err)
+	}
+
+	// the old way in, with simple replies, on a second connection
+	c = connect()
+	c.write(uint64(nbdOptMagic), uint32(nbdOptExportName), uint32(0))
+	var size uint64
+	var flags uint16
+	c.read(&size, &flags)
+	if size != 16<<20 || flags != nbdTransmissionFlags {
+		t.Errorf("NBD_OPT_EXPORT_NAME: got the size %d and flags %#x", size, flags)
+	}
+	c.write(uint32(nbdRequestMagic), uint16(0), uint16(nbdCmdRead), uint64(7), uint64(1<<20), uint32(8))
+	var magic, errno uint32
+	var cookie uint64
+	got := make([]byte, 8)
+	c.read(&magic, &errno, &cookie, got)
+	if magic != nbdSimpleMagic || errno != 0 || cookie != 7 || string(got) != "nbd data" {
+		t.Errorf("simple read: got %#x %d %d %q", magic, errno, cookie, got)
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Errorf("serving stopped with %v", err)
+	}
+	if _, err := os.Stat(l.Addr().String()); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the socket is left behind: %v", err)
+	}
+}
+
+func nbdUint32s(b []byte) []uint32 {
+	var u []uint32
+	for ; len(b) >= 4; b = b[4:] {
+		u = append(u, binary.BigEndian.Uint32(b))
+	}
+	return u
+}
+
+func TestTar(t *testing.T) {
+	name := fixture(t)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "disk.tar")
+	_, stderr, status := qcow2Tool(t, "export-tar", name, archive)
+	expectStatus(t, "export-tar", status, 0, stderr)
+	stdout, stderr, status := qcow2Tool(t, "export-tar", name, "-")
+	expectStatus(t, "export-tar to stdout", status, 0, stderr)
+	written, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// but for the times of the entries
+	if len(stdout) != len(written) {
+		t.Errorf("export-tar wrote %d bytes to stdout, and %d to a file", len(stdout), len(written))
+	}
+
+	imported := filepath.Join(dir, "imported.qcow2")
+	_, stderr, status = qcow2Tool(t, "import-tar", archive, imported)
+	expectStatus(t, "import-tar", status, 0, stderr)
+	stdout, stderr, status = qcow2Tool(t, "compare", name, imported)
+	expectStatus(t, "compare", status, 0, stderr+stdout)
+
+	_, stderr, status = qcow2Tool(t, "import-tar", name, filepath.Join(dir, "not-a-tar.qcow2"))
+	expectStatus(t, "import-tar of an image", status, 1, stderr)
+	if !strings.Contains(stderr, "tar") {
+		t.Errorf("import-tar of an image: %s", stderr)
+	}
+}
+
+func TestConvertVPC(t *testing.T) {
+	name := fixture(t)
+	vhd := filepath.Join(t.TempDir(), "disk.vhd")
+	_, stderr, status := qcow2Tool(t, "convert", "-O", "vpc", name, vhd)
+	expectStatus(t, "convert -O vpc", status, 0, stderr)
+	got, err := os.ReadFile(vhd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, status := qcow2Tool(t, "convert", "-O", "vpc", name, "-")
+	expectStatus(t, "convert -O vpc to stdout", status, 0, stderr)
+	// the fixture is of a whole number of MiB
+	for what, b := range map[string][]byte{"file": got, "stdout": []byte(stdout)} {
+		if len(b) != 100<<20+512 || string(b[100<<20:100<<20+8]) != "conectix" {
+			t.Errorf("%s: got %d bytes, not a fixed VHD of 100 MiB", what, len(b))
+		}
+	}
+}
+
+func TestBitmap(t *testing.T) {
+	name := fixture(t)
+	_, stderr, status := qcow2Tool(t, "bitmap", "--add", "-g", "1M", "nightly", name)
+	expectStatus(t, "bitmap --add", status, 0, stderr)
+	_, stderr, status = qcow2Tool(t, "bitmap", "--add", "weekly", name)
+	expectStatus(t, "bitmap --add", status, 0, stderr)
+	_, stderr, status = qcow2Tool(t, "bitmap", "--add", "weekly", name)
+	expectStatus(t, "bitmap --add of an existing bitmap", status, 1, stderr)
+	_, stderr, status = qcow2Tool(t, "bitmap", "--add", "-g", "3K", "odd", name)
+	expectStatus(t, "bitmap --add of an odd granularity", status, 1, stderr)
+	_, stderr, status = qcow2Tool(t, "bitmap", "--remove", "nightly", name)
+	expectStatus(t, "bitmap --remove", status, 0, stderr)
+	_, stderr, status = qcow2Tool(t, "bitmap", "nightly", name)
+	expectStatus(t, "bitmap without an action", status, 1, stderr)
+
+	img, err := qcow2.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitmaps, err := img.Bitmaps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bitmaps) != 1 || bitmaps[0].Name != "weekly" || bitmaps[0].Granularity != 64<<10 {
+		t.Errorf("got bitmaps %+v", bitmaps)
+	}
+	img.Close()
+	stdout, stderr, status := qcow2Tool(t, "check", name)
+	expectStatus(t, "check", status, 0, stderr+stdout)
+
+	_, stderr, status = qcow2Tool(t, "bitmap", "--add", "-g", "1M", "tmp", name)
+	expectStatus(t, "bitmap --add", status, 0, stderr)
+	img, err = qcow2.OpenFile(name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := qcow2.NewBitmap(img.Size(), 1<<20)
+	tmp.SetRange(5<<20, 1)
+	if err := img.WriteBitmap("tmp", tmp); err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	_, stderr, status = qcow2Tool(t, "bitmap", "--merge", "tmp", "--into", "weekly", name)
+	expectStatus(t, "bitmap --merge", status, 0, stderr)
+	_, stderr, status = qcow2Tool(t, "bitmap", "--merge", "tmp", name)
+	expectStatus(t, "bitmap --merge without --into", status, 1, stderr)
+	img, err = qcow2.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	weekly, err := img.ReadBitmap("weekly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := weekly.Ranges(); len(got) != 1 || got[0] != (qcow2.Range{Start: 5 << 20, Length: 1 << 20}) {
+		t.Errorf("got the dirty ranges %v of the merged bitmap", got)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	name := fixture(t)
+	dir := t.TempDir()
+	full, inc, raw := filepath.Join(dir, "full.qcow2"), filepath.Join(dir, "inc.qcow2"), filepath.Join(dir, "copy.raw")
+	_, stderr, status := qcow2Tool(t, "bitmap", "--add", "nightly", name)
+	expectStatus(t, "bitmap --add", status, 0, stderr)
+	_, stderr, status = qcow2Tool(t, "backup", "--bitmap", "nightly", name, full)
+	expectStatus(t, "backup", status, 0, stderr)
+	_, stderr, status = qcow2Tool(t, "convert", "-O", "raw", name, raw)
+	expectStatus(t, "convert -O raw", status, 0, stderr)
+
+	img, err := qcow2.OpenFile(name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("written since the full backup")
+	if _, err := img.WriteAt(data, 7<<20+3); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, stderr, status = qcow2Tool(t, "backup", "--bitmap", "nightly", "--new-bitmap", "next", "-b", full, name, inc)
+	expectStatus(t, "backup -b", status, 0, stderr)
+	stdout, stderr, status := qcow2Tool(t, "compare", name, inc)
+	expectStatus(t, "compare with the chain of the backups", status, 0, stderr+stdout)
+	_, stderr, status = qcow2Tool(t, "backup", "--bitmap", "nightly", "--target", "raw", "--apply-to", raw, name)
+	expectStatus(t, "backup --target raw", status, 0, stderr)
+	fh, err := os.Open(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	got := make([]byte, len(data))
+	if _, err := fh.ReadAt(got, 7<<20+3); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("the patched raw copy reads %q, %v", got, err)
+	}
+
+	_, stderr, status = qcow2Tool(t, "backup", "--bitmap", "missing", name, filepath.Join(dir, "missing.qcow2"))
+	expectStatus(t, "backup of a missing bitmap", status, 1, stderr)
+	_, stderr, status = qcow2Tool(t, "backup", "--target", "raw", "--bitmap", "nightly", name)
+	expectStatus(t, "backup --target raw without --apply-to", status, 1, stderr)
+
+	img, err = qcow2.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	for _, bitmap := range []string{"nightly", "next"} {
+		if b, err := img.ReadBitmap(bitmap); err != nil || b.Count() != 0 {
+			t.Errorf("bitmap %s after the backups: %v", bitmap, err)
+		}
+	}
+}
+
+func TestBitmapDump(t *testing.T) {
+	name := fixture(t)
+	dump := filepath.Join(t.TempDir(), "bits.bin")
+	_, stderr, status := qcow2Tool(t, "bitmap", "--add", "nightly", name)
+	expectStatus(t, "bitmap --add", status, 0, stderr)
+
+	img, err := qcow2.OpenFile(name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := img.ReadBitmap("nightly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetRange(1<<20, 3<<20)
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the bitmap left in use, as by a crash
+	var dir int64
+	for _, e := range img.Header.ExtHeaders {
+		if e.Type == qcow2.HdrExtBitmaps {
+			dir = int64(binary.BigEndian.Uint64(e.Data[16:24]))
+		}
+	}
+	img.Close()
+	fh, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.WriteAt([]byte{0, 0, 0, 3}, dir+12); err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+
+	_, stderr, status = qcow2Tool(t, "bitmap", "--dump", "nightly", name, "-o", dump)
+	expectStatus(t, "bitmap --dump of a bitmap in use", status, 1, stderr)
+	if !strings.Contains(stderr, "--force") {
+		t.Errorf("bitmap --dump of a bitmap in use: %s", stderr)
+	}
+	_, stderr, status = qcow2Tool(t, "bitmap", "--dump", "--force", "nightly", name, "-o", dump)
+	expectStatus(t, "bitmap --dump --force", status, 0, stderr)
+
+	if err := os.WriteFile(dump, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, status = qcow2Tool(t, "bitmap", "--load", "nightly", name, "-i", dump)
+	expectStatus(t, "bitmap --load", status, 0, stderr)
+	stdout, stderr, status := qcow2Tool(t, "bitmap", "--dump", "nightly", name)
+	expectStatus(t, "bitmap --dump to stdout", status, 0, stderr)
+	if stdout != string(data) {
+		t.Error("bitmap --dump does not write the bits loaded")
+	}
+	stdout, stderr, status = qcow2Tool(t, "check", name)
+	expectStatus(t, "check", status, 0, stderr+stdout)
+}
+
+func TestHashJobs(t *testing.T) {
+	name := fixture(t)
+	for _, cmd := range [][]string{{"checksum"}, {"digests", "--granularity", "4096"}} {
+		var want string
+		for _, jobs := range []string{"1", "4"} {
+			stdout, stderr, status := qcow2Tool(t, append(append(cmd, "--jobs", jobs), name)...)
+			expectStatus(t, cmd[0], status, 0, stderr)
+			if want == "" {
+				want = stdout
+			} else if stdout != want {
+				t.Errorf("%s --jobs %s prints differently from --jobs 1", cmd[0], jobs)
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["map"] = command{
+		usage: "map [--force-share] [--skip-extensions] [--output human|json] [--hex=false] IMAGE (the guest ranges stored in the image and its backing files)",
+		run:   mapImage,
+	}
+}
+
+func mapImage(args []string) error {
+	fs := newFlagSet("map")
+	forceShareFlag(fs)
+	skipExtensionsFlag(fs)
+	output := fs.String("output", "human", "print the ranges as a human table, or as json in the schema of qemu-img map")
+	r := hexFlag(fs, true)
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 1 {
+		return fmt.Errorf("map: expected IMAGE")
+	}
+	if *output != "human" && *output != "json" {
+		return fmt.Errorf("map: unknown output format %q", *output)
+	}
+	img, err := openImage(operands[0])
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	if skipExtensions {
+		fmt.Fprintf(os.Stderr, "[WARN] %s: %s\n", operands[0], skippedExtensions(img.Header))
+	}
+	// the images of the chain by depth, which a raw backing file ends
+	var chain []*qcow2.Image
+	for b := img; b != nil; b = b.BackingImage() {
+		chain = append(chain, b)
+	}
+	if *output == "json" {
+		return mapJSON(img, chain)
+	}
+	fmt.Printf("%-16s%-16s%-16s%-12s%s\n", "Offset", "Length", "Mapped to", "Type", "File")
+	return img.WalkExtents(0, img.Size(), func(e qcow2.Extent) error {
+		if e.Type == qcow2.ExtentUnallocated {
+			return nil
+		}
+		var file string
+		if e.Depth < len(chain) {
+			file = chain[e.Depth].Name()
+		} else {
+			file = chain[len(chain)-1].Header.BackingFile
+		}
+		mapped := "-"
+		if e.Type == qcow2.ExtentData {
+			mapped = r.format(e.HostOffset)
+		}
+		fmt.Printf("%-16s%-16s%-16s%-12s%s\n", r.format(e.Start), r.format(e.Length), mapped, e.Type, file)
+		return nil
+	})
+}
+
+// mapJSON prints the extents of the image as qemu-img map --output=json
+// does, field for field and line for line, so that the outputs of both can
+// be compared as text. The offset is only there for data stored as is,
+// neither compressed nor encrypted.
+func mapJSON(img *qcow2.Image, chain []*qcow2.Image) error {
+	w := bufio.NewWriter(os.Stdout)
+	w.WriteString("[")
+	first := true
+	err := img.WalkExtents(0, img.Size(), func(e qcow2.Extent) error {
+		if !first {
+			w.WriteString(",\n")
+		}
+		first = false
+		present := e.Type != qcow2.ExtentUnallocated
+		fmt.Fprintf(w, `{ "start": %d, "length": %d, "depth": %d, "present": %t, "zero": %t, "data": %t, "compressed": %t`,
+			e.Start, e.Length, e.Depth, present, e.ReadsAsZeros(), e.Type == qcow2.ExtentData || e.Type == qcow2.ExtentCompressed, e.Type == qcow2.ExtentCompressed)
+		if e.Type == qcow2.ExtentData && (e.Depth >= len(chain) || chain[e.Depth].Header.CryptMethod == 0) {
+			fmt.Fprintf(w, `, "offset": %d`, e.HostOffset)
+		}
+		w.WriteString("}")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteString("]\n")
+	return w.Flush()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["measure"] = command{
+		usage: "measure [--force-share] [-f raw|qcow2] [-O raw|qcow2] [-o OPTIONS] --size SIZE | --input FILE",
+		run:   measure,
+	}
+}
+
+func measure(args []string) error {
+	fs := newFlagSet("measure")
+	forceShareFlag(fs)
+	inFormat := fs.String("f", "", "input format, probed when empty")
+	format := fs.String("O", "qcow2", "output format")
+	createOpts := fs.String("o", "", "comma separated qcow2 options: cluster_size, preallocation, compat, refcount_bits, extended_l2")
+	size := fs.String("size", "", "virtual size of an empty disk to measure")
+	input := fs.String("input", "", "the disk to measure the conversion of")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(operands) == 1 && *input == "":
+		*input = operands[0]
+	case len(operands) > 0:
+		return fmt.Errorf("measure: unexpected arguments %q", operands)
+	}
+	if (*size == "") == (*input == "") {
+		return fmt.Errorf("measure: expected one of --size and --input")
+	}
+	opts, err := parseCreateOptions(*createOpts)
+	if err != nil {
+		return fmt.Errorf("measure: %w", err)
+	}
+
+	var src io.ReaderAt
+	var n int64
+	if *size != "" {
+		if n, err = parseSize(*size); err != nil {
+			return fmt.Errorf("measure: --size: %w", err)
+		}
+	} else {
+		if *inFormat == "" {
+			if *inFormat, err = probe(*input); err != nil {
+				return err
+			}
+		}
+		switch *inFormat {
+		case "qcow2":
+			img, err := openImage(*input)
+			if err != nil {
+				return err
+			}
+			defer img.Close()
+			src, n = img, img.Size()
+		case "raw":
+			fh, err := os.Open(*input)
+			if err != nil {
+				return err
+			}
+			defer fh.Close()
+			src, n = fh, rawFile{fh}.Size()
+		default:
+			return fmt.Errorf("measure: unsupported input format %q", *inFormat)
+		}
+	}
+	m, err := qcow2.Measure(src, n, *format, &opts.CreateOptions)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("required size: %d\nfully allocated size: %d\n", m.Required, m.FullyAllocated)
+	return nil
+}
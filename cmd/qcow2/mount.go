@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["mount"] = command{
+		usage: "mount [--force-share] IMAGE MOUNTPOINT (the guest disk as MOUNTPOINT/disk.raw and each snapshot as MOUNTPOINT/snapshots/NAME.raw, read-only over FUSE, until SIGINT or SIGTERM)",
+		run:   mount,
+	}
+}
+
+// fuseNode is a file or directory of a FUSE mount, all of them read-only
+type fuseNode struct {
+	name string
+	// r is the contents of a file, of size bytes, and children are the
+	// entries of a directory, which has no r
+	r        io.ReaderAt
+	size     int64
+	children []*fuseNode
+}
+
+func mount(args []string) error {
+	fs := newFlagSet("mount")
+	forceShareFlag(fs)
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 2 {
+		return fmt.Errorf("mount: expected IMAGE and MOUNTPOINT")
+	}
+	img, err := openImage(operands[0])
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	fi, err := os.Stat(operands[0])
+	if err != nil {
+		return err
+	}
+	root, err := mountTree(img)
+	if err != nil {
+		return err
+	}
+	return fuseMountAndServe(operands[1], operands[0], root, fi.ModTime())
+}
+
+// mountTree is what a mount of img holds: the guest disk, and the snapshots
+// by name
+func mountTree(img *qcow2.Image) (*fuseNode, error) {
+	snapshots := &fuseNode{name: "snapshots"}
+	root := &fuseNode{children: []*fuseNode{{name: "disk.raw", r: img, size: img.Size()}, snapshots}}
+	seen := map[string]bool{}
+	for _, s := range img.Snapshots() {
+		view, err := img.SnapshotView(s.ID)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.ReplaceAll(s.Name, "/", "_")
+		if name == "" || name == "." || name == ".." || seen[name] {
+			// names are not unique, but IDs are
+			name += "-" + s.ID
+		}
+		seen[name] = true
+		snapshots.children = append(snapshots.children, &fuseNode{name: name + ".raw", r: view, size: view.Size()})
+	}
+	return root, nil
+}
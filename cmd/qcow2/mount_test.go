@@ -0,0 +1,110 @@
+//go:build linux && fuse
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vbatts/qcow2"
+)
+
+// TestMount mounts the fixture, which takes /dev/fuse and either root or
+// fusermount, so it runs only with -tags fuse
+func TestMount(t *testing.T) {
+	name := fixture(t)
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "mount", name, dir)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	var errOut bytes.Buffer
+	cmd.Stderr = &errOut
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	t.Cleanup(func() {
+		if cmd.ProcessState == nil {
+			cmd.Process.Kill()
+			<-done
+		}
+	})
+
+	disk := filepath.Join(dir, "disk.raw")
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if _, err := os.Stat(disk); err == nil {
+			break
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("mount exited: %v: %s", err, errOut.String())
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s did not appear: %s", disk, errOut.String())
+		}
+	}
+
+	img, err := qcow2.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	files := map[string]*io.SectionReader{"disk.raw": io.NewSectionReader(img, 0, img.Size())}
+	for _, s := range img.Snapshots() {
+		view, err := img.SnapshotView(s.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files["snapshots/"+s.Name+".raw"] = io.NewSectionReader(view, 0, view.Size())
+	}
+	for file, want := range files {
+		if got, want := fileSum(t, filepath.Join(dir, file)), readerSum(t, want); got != want {
+			t.Errorf("%s: got sha256 %x, want %x", file, got, want)
+		}
+	}
+	if err := os.WriteFile(disk, []byte("x"), 0o644); err == nil {
+		t.Errorf("writing %s succeeded on a read-only mount", disk)
+	}
+
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("mount: %v: %s", err, errOut.String())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("mount did not exit on SIGINT")
+	}
+	if _, err := os.Stat(disk); err == nil {
+		t.Errorf("%s is still there after unmounting", disk)
+	}
+}
+
+func fileSum(t *testing.T, name string) [sha256.Size]byte {
+	t.Helper()
+	fh, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	return readerSum(t, fh)
+}
+
+func readerSum(t *testing.T, r io.Reader) (sum [sha256.Size]byte) {
+	t.Helper()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		t.Fatal(err)
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/vbatts/qcow2"
+)
+
+// The NBD protocol, as in doc/proto.md of the NBD project: the fixed
+// newstyle handshake, then the transmission phase, read-only
+const (
+	nbdMagic         = 0x4e42444d41474943 // NBDMAGIC
+	nbdOptMagic      = 0x49484156454f5054 // IHAVEOPT
+	nbdRepMagic      = 0x0003e889045565a9
+	nbdRequestMagic  = 0x25609513
+	nbdSimpleMagic   = 0x67446698
+	nbdStructMagic   = 0x668e33ef
+	nbdFlagFixed     = 1 << 0
+	nbdFlagNoZeroes  = 1 << 1
+	nbdClientFlags   = nbdFlagFixed | nbdFlagNoZeroes
+	nbdMaxOption     = 64 << 10
+	nbdMaxRequest    = 32 << 20
+	nbdMaxExtents    = 1 << 16
+	nbdAllocation    = "base:allocation"
+	nbdAllocationID  = 1
+	nbdPreferredSize = 4096
+)
+
+// options of the handshake
+const (
+	nbdOptExportName      = 1
+	nbdOptAbort           = 2
+	nbdOptList            = 3
+	nbdOptInfo            = 6
+	nbdOptGo              = 7
+	nbdOptStructuredReply = 8
+	nbdOptListMetaContext = 9
+	nbdOptSetMetaContext  = 10
+)
+
+// replies to the options, and the information of NBD_REP_INFO
+const (
+	nbdRepAck         = 1
+	nbdRepServer      = 2
+	nbdRepInfo        = 3
+	nbdRepMetaContext = 4
+	nbdRepErrUnsup    = 1<<31 | 1
+	nbdRepErrInvalid  = 1<<31 | 3
+	nbdRepErrUnknown  = 1<<31 | 6
+	nbdRepErrTooBig   = 1<<31 | 9
+
+	nbdInfoExport    = 0
+	nbdInfoName      = 1
+	nbdInfoBlockSize = 3
+)
+
+// the transmission flags of the export, commands, their flags and replies
+const (
+	nbdFlagHasFlags     = 1 << 0
+	nbdFlagReadOnly     = 1 << 1
+	nbdFlagSendFlush    = 1 << 2
+	nbdFlagSendDF       = 1 << 7
+	nbdFlagCanMultiConn = 1 << 8
+
+	nbdCmdRead        = 0
+	nbdCmdWrite       = 1
+	nbdCmdDisc        = 2
+	nbdCmdFlush       = 3
+	nbdCmdTrim        = 4
+	nbdCmdWriteZeroes = 6
+	nbdCmdBlockStatus = 7
+
+	nbdCmdFlagReqOne = 1 << 3
+
+	nbdReplyFlagDone      = 1 << 0
+	nbdReplyNone          = 0
+	nbdReplyOffsetData    = 1
+	nbdReplyBlockStatus   = 5
+	nbdReplyError         = 1<<15 | 1
+	nbdStateHole          = 1 << 0
+	nbdStateZero          = 1 << 1
+	nbdEPERM              = 1
+	nbdEIO                = 5
+	nbdEINVAL             = 22
+	nbdEOVERFLOW          = 75
+	nbdTransmissionFlags  = nbdFlagHasFlags | nbdFlagReadOnly | nbdFlagSendFlush | nbdFlagSendDF | nbdFlagCanMultiConn
+	nbdHandshakeZeroBytes = 124
+)
+
+var nbdCommands = map[uint16]string{
+	nbdCmdRead:        "read",
+	nbdCmdWrite:       "write",
+	nbdCmdDisc:        "disconnect",
+	nbdCmdFlush:       "flush",
+	nbdCmdTrim:        "trim",
+	nbdCmdWriteZeroes: "write-zeroes",
+	nbdCmdBlockStatus: "block-status",
+}
+
+// errNBDAbort ends a connection whose client gave up in the handshake
+var errNBDAbort = errors.New("nbd: the client aborted the handshake")
+
+// nbdExport is the disk an NBD server serves, read-only, to any number of
+// connections at once
+type nbdExport struct {
+	// name is that of the export, which the default export "" is as well
+	name string
+	img  *qcow2.Image
+}
+
+// nbdConn is a connection to a client
+type nbdConn struct {
+	e *nbdExport
+	r *bufio.Reader
+	w *bufio.Writer
+	// structured is set once the client asked for structured replies, and
+	// allocation once it selected the base:allocation meta context
+	structured, allocation bool
+	log                    *slog.Logger
+}
+
+// serve runs the handshake with the client conn, then serves its requests
+// until it disconnects
+func (e *nbdExport) serve(conn io.ReadWriter, log *slog.Logger) error {
+	c := &nbdConn{e: e, r: bufio.NewReader(conn), w: bufio.NewWriter(conn), log: log}
+	if err := c.handshake(); err != nil {
+		// a client hanging up at a reply boundary only left early
+		if err == errNBDAbort || err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	return c.transmit()
+}
+
+func (c *nbdConn) handshake() error {
+	w := c.w
+	binary.Write(w, binary.BigEndian, uint64(nbdMagic))
+	binary.Write(w, binary.BigEndian, uint64(nbdOptMagic))
+	binary.Write(w, binary.BigEndian, uint16(nbdFlagFixed|nbdFlagNoZeroes))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	var flags uint32
+	if err := binary.Read(c.r, binary.BigEndian, &flags); err != nil {
+		return err
+	}
+	if flags&^nbdClientFlags != 0 || flags&nbdFlagFixed == 0 {
+		return fmt.Errorf("nbd: unsupported client flags %#x", flags)
+	}
+	noZeroes := flags&nbdFlagNoZeroes != 0
+
+	for {
+		var h struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		if err := binary.Read(c.r, binary.BigEndian, &h); err != nil {
+			return err
+		}
+		if h.Magic != nbdOptMagic {
+			return fmt.Errorf("nbd: bad option magic %#x", h.Magic)
+		}
+		if h.Length > nbdMaxOption {
+			if _, err := io.CopyN(io.Discard, c.r, int64(h.Length)); err != nil {
+				return err
+			}
+			if err := c.optionReply(h.Option, nbdRepErrTooBig, []byte("option too long")); err != nil {
+				return err
+			}
+			continue
+		}
+		data := make([]byte, h.Length)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return err
+		}
+		c.log.Debug("nbd option", "option", h.Option, "length", h.Length)
+
+		switch h.Option {
+		case nbdOptExportName:
+			if !c.e.known(string(data)) {
+				return fmt.Errorf("nbd: the client asked for the unknown export %q", data)
+			}
+			binary.Write(w, binary.BigEndian, uint64(c.e.img.Size()))
+			binary.Write(w, binary.BigEndian, uint16(nbdTransmissionFlags))
+			if !noZeroes {
+				w.Write(make([]byte, nbdHandshakeZeroBytes))
+			}
+			return w.Flush()
+		case nbdOptAbort:
+			c.optionReply(h.Option, nbdRepAck, nil)
+			return errNBDAbort
+		case nbdOptList:
+			if len(data) != 0 {
+				if err := c.optionReply(h.Option, nbdRepErrInvalid, []byte("NBD_OPT_LIST takes no data")); err != nil {
+					return err
+				}
+				continue
+			}
+			reply := binary.BigEndian.AppendUint32(nil, uint32(len(c.e.name)))
+			if err := c.optionReply(h.Option, nbdRepServer, append(reply, c.e.name...)); err != nil {
+				return err
+			}
+			if err := c.optionReply(h.Option, nbdRepAck, nil); err != nil {
+				return err
+			}
+		case nbdOptStructuredReply:
+			if len(data) != 0 {
+				if err := c.optionReply(h.Option, nbdRepErrInvalid, []byte("NBD_OPT_STRUCTURED_REPLY takes no data")); err != nil {
+					return err
+				}
+				continue
+			}
+			c.structured = true
+			if err := c.optionReply(h.Option, nbdRepAck, nil); err != nil {
+				return err
+			}
+		case nbdOptInfo, nbdOptGo:
+			done, err := c.info(h.Option, data)
+			if err != nil || (done && h.Option == nbdOptGo) {
+				return err
+			}
+		case nbdOptListMetaContext, nbdOptSetMetaContext:
+			if err := c.metaContext(h.Option, data); err != nil {
+				return err
+			}
+		default:
+			if err := c.optionReply(h.Option, nbdRepErrUnsup, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// known reports whether name is that of the export
+func (e *nbdExport) known(name string) bool {
+	return name == "" || name == e.name
+}
+
+func (c *nbdConn) optionReply(option, typ uint32, data []byte) error {
+	var b []byte
+	b = binary.BigEndian.AppendUint64(b, nbdRepMagic)
+	b = binary.BigEndian.AppendUint32(b, option)
+	b = binary.BigEndian.AppendUint32(b, typ)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	c.w.Write(b)
+	c.w.Write(data)
+	return c.w.Flush()
+}
+
+// info answers NBD_OPT_INFO and NBD_OPT_GO, reporting whether the export
+// was found
+func (c *nbdConn) info(option uint32, data []byte) (bool, error) {
+	name, rest, ok := nbdString(data)
+	if !ok || len(rest) < 2 || len(rest) != 2+2*int(binary.BigEndian.Uint16(rest)) {
+		return false, c.optionReply(option, nbdRepErrInvalid, []byte("malformed request"))
+	}
+	if !c.e.known(name) {
+		return false, c.optionReply(option, nbdRepErrUnknown, []byte("unknown export"))
+	}
+	export := binary.BigEndian.AppendUint16(nil, nbdInfoExport)
+	export = binary.BigEndian.AppendUint64(export, uint64(c.e.img.Size()))
+	export = binary.BigEndian.AppendUint16(export, nbdTransmissionFlags)
+	if err := c.optionReply(option, nbdRepInfo, export); err != nil {
+		return false, err
+	}
+	for requests := rest[2:]; len(requests) > 0; requests = requests[2:] {
+		var info []byte
+		switch binary.BigEndian.Uint16(requests) {
+		case nbdInfoName:
+			info = append(binary.BigEndian.AppendUint16(nil, nbdInfoName), c.e.name...)
+		case nbdInfoBlockSize:
+			info = binary.BigEndian.AppendUint16(nil, nbdInfoBlockSize)
+			info = binary.BigEndian.AppendUint32(info, 1)
+			info = binary.BigEndian.AppendUint32(info, nbdPreferredSize)
+			info = binary.BigEndian.AppendUint32(info, nbdMaxRequest)
+		default:
+			continue
+		}
+		if err := c.optionReply(option, nbdRepInfo, info); err != nil {
+			return false, err
+		}
+	}
+	return true, c.optionReply(option, nbdRepAck, nil)
+}
+
+// metaContext answers NBD_OPT_LIST_META_CONTEXT and
+// NBD_OPT_SET_META_CONTEXT, of which there is base:allocation alone
+func (c *nbdConn) metaContext(option uint32, data []byte) error {
+	if !c.structured {
+		return c.optionReply(option, nbdRepErrInvalid, []byte("structured replies were not negotiated"))
+	}
+	name, rest, ok := nbdString(data)
+	if !ok || len(rest) < 4 {
+		return c.optionReply(option, nbdRepErrInvalid, []byte("malformed request"))
+	}
+	n := binary.BigEndian.Uint32(rest)
+	var queries []string
+	for rest = rest[4:]; len(rest) > 0; {
+		var q string
+		if q, rest, ok = nbdString(rest); !ok {
+			return c.optionReply(option, nbdRepErrInvalid, []byte("malformed request"))
+		}
+		queries = append(queries, q)
+	}
+	if uint32(len(queries)) != n {
+		return c.optionReply(option, nbdRepErrInvalid, []byte("malformed request"))
+	}
+	if !c.e.known(name) {
+		return c.optionReply(option, nbdRepErrUnknown, []byte("unknown export"))
+	}
+	match := option == nbdOptListMetaContext && n == 0
+	for _, q := range queries {
+		if q == nbdAllocation || (option == nbdOptListMetaContext && q == "base:") {
+			match = true
+		}
+	}
+	if option == nbdOptSetMetaContext {
+		c.allocation = match
+	}
+	if match {
+		reply := binary.BigEndian.AppendUint32(nil, nbdAllocationID)
+		if err := c.optionReply(option, nbdRepMetaContext, append(reply, nbdAllocation...)); err != nil {
+			return err
+		}
+	}
+	return c.optionReply(option, nbdRepAck, nil)
+}
+
+// nbdString splits the string of data, after its 32 bit length, from the
+// rest
+func nbdString(data []byte) (string, []byte, bool) {
+	if len(data) < 4 || uint64(len(data)-4) < uint64(binary.BigEndian.Uint32(data)) {
+		return "", nil, false
+	}
+	n := 4 + int(binary.BigEndian.Uint32(data))
+	return string(data[4:n]), data[n:], true
+}
+
+// nbdRequest is a request of the transmission phase
+type nbdRequest struct {
+	Magic  uint32
+	Flags  uint16
+	Type   uint16
+	Cookie uint64
+	Offset uint64
+	Length uint32
+}
+
+// transmit serves the requests of the client one at a time
+func (c *nbdConn) transmit() error {
+	for {
+		var req nbdRequest
+		if err := binary.Read(c.r, binary.BigEndian, &req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if req.Magic != nbdRequestMagic {
+			return fmt.Errorf("nbd: bad request magic %#x", req.Magic)
+		}
+		command, ok := nbdCommands[req.Type]
+		if !ok {
+			command = fmt.Sprintf("%d", req.Type)
+		}
+		c.log.Debug("nbd request", "command", command, "offset", req.Offset, "length", req.Length)
+
+		size := uint64(c.e.img.Size())
+		inRange := req.Offset <= size && uint64(req.Length) <= size-req.Offset
+		var err error
+		switch req.Type {
+		case nbdCmdDisc:
+			return nil
+		case nbdCmdRead:
+			switch {
+			case !inRange:
+				err = c.replyError(req, nbdEINVAL, "read past the end of the disk")
+			case req.Length > nbdMaxRequest:
+				err = c.replyError(req, nbdEOVERFLOW, "read longer than the maximum block size")
+			default:
+				err = c.read(req)
+			}
+		case nbdCmdFlush:
+			err = c.replyDone(req)
+		case nbdCmdBlockStatus:
+			switch {
+			case !c.allocation:
+				err = c.replyError(req, nbdEINVAL, "the base:allocation meta context was not selected")
+			case !inRange || req.Length == 0:
+				err = c.replyError(req, nbdEINVAL, "block status of a range not on the disk")
+			default:
+				err = c.blockStatus(req)
+			}
+		case nbdCmdWrite:
+			// the data comes along, to be read past to the next request
+			if _, err := io.CopyN(io.Discard, c.r, int64(req.Length)); err != nil {
+				return err
+			}
+			err = c.replyError(req, nbdEPERM, "the export is read-only")
+		case nbdCmdTrim, nbdCmdWriteZeroes:
+			err = c.replyError(req, nbdEPERM, "the export is read-only")
+		default:
+			err = c.replyError(req, nbdEINVAL, "unsupported command")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *nbdConn) read(req nbdRequest) error {
+	buf := make([]byte, req.Length)
+	if _, err := c.e.img.ReadAt(buf, int64(req.Offset)); err != nil && err != io.EOF {
+		c.log.Warn("nbd read failed", "offset", req.Offset, "length", req.Length, "err", err)
+		return c.replyError(req, nbdEIO, errorText(err))
+	}
+	if !c.structured {
+		c.simpleReply(req, 0)
+		c.w.Write(buf)
+		return c.w.Flush()
+	}
+	c.chunkHeader(req, nbdReplyFlagDone, nbdReplyOffsetData, 8+len(buf))
+	binary.Write(c.w, binary.BigEndian, req.Offset)
+	c.w.Write(buf)
+	return c.w.Flush()
+}
+
+// blockStatus replies with the allocation of the range of req, in extents
+// of holes reading as zeros and of data
+func (c *nbdConn) blockStatus(req nbdRequest) error {
+	var descriptors []byte
+	var last uint32
+	err := c.e.img.WalkExtents(int64(req.Offset), int64(req.Length), func(e qcow2.Extent) error {
+		var flags uint32
+		if e.ReadsAsZeros() {
+			flags = nbdStateHole | nbdStateZero
+		}
+		n := len(descriptors)
+		if n > 0 && last == flags {
+			binary.BigEndian.PutUint32(descriptors[n-8:], binary.BigEndian.Uint32(descriptors[n-8:])+uint32(e.Length))
+			return nil
+		}
+		if n/8 == nbdMaxExtents || (n > 0 && req.Flags&nbdCmdFlagReqOne != 0) {
+			return errStopExtents
+		}
+		descriptors = binary.BigEndian.AppendUint32(descriptors, uint32(e.Length))
+		descriptors = binary.BigEndian.AppendUint32(descriptors, flags)
+		last = flags
+		return nil
+	})
+	if err != nil && err != errStopExtents {
+		c.log.Warn("nbd block status failed", "offset", req.Offset, "length", req.Length, "err", err)
+		return c.replyError(req, nbdEIO, errorText(err))
+	}
+	c.chunkHeader(req, nbdReplyFlagDone, nbdReplyBlockStatus, 4+len(descriptors))
+	binary.Write(c.w, binary.BigEndian, uint32(nbdAllocationID))
+	c.w.Write(descriptors)
+	return c.w.Flush()
+}
+
+// errStopExtents ends the walk of the extents once the reply has enough
+var errStopExtents = errors.New("enough extents")
+
+func (c *nbdConn) simpleReply(req nbdRequest, errno uint32) {
+	binary.Write(c.w, binary.BigEndian, uint32(nbdSimpleMagic))
+	binary.Write(c.w, binary.BigEndian, errno)
+	binary.Write(c.w, binary.BigEndian, req.Cookie)
+}
+
+func (c *nbdConn) chunkHeader(req nbdRequest, flags, typ uint16, length int) {
+	binary.Write(c.w, binary.BigEndian, uint32(nbdStructMagic))
+	binary.Write(c.w, binary.BigEndian, flags)
+	binary.Write(c.w, binary.BigEndian, typ)
+	binary.Write(c.w, binary.BigEndian, req.Cookie)
+	binary.Write(c.w, binary.BigEndian, uint32(length))
+}
+
+// replyDone replies that req succeeded, without data
+func (c *nbdConn) replyDone(req nbdRequest) error {
+	if c.structured {
+		c.chunkHeader(req, nbdReplyFlagDone, nbdReplyNone, 0)
+	} else {
+		c.simpleReply(req, 0)
+	}
+	return c.w.Flush()
+}
+
+// replyError replies that req failed with errno, and why in a structured
+// reply
+func (c *nbdConn) replyError(req nbdRequest, errno uint32, msg string) error {
+	if !c.structured {
+		c.simpleReply(req, errno)
+		return c.w.Flush()
+	}
+	if len(msg) > 4096 {
+		msg = msg[:4096]
+	}
+	c.chunkHeader(req, nbdReplyFlagDone, nbdReplyError, 6+len(msg))
+	binary.Write(c.w, binary.BigEndian, errno)
+	binary.Write(c.w, binary.BigEndian, uint16(len(msg)))
+	c.w.WriteString(msg)
+	return c.w.Flush()
+}
+
+// listen listens at addr, unix:PATH or tcp:HOST:PORT
+func listen(addr string) (net.Listener, error) {
+	network, address, _ := strings.Cut(addr, ":")
+	if (network != "unix" && network != "tcp") || address == "" {
+		return nil, fmt.Errorf("expected unix:PATH or tcp:HOST:PORT, not %q", addr)
+	}
+	return net.Listen(network, address)
+}
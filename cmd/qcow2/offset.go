@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["offset"] = command{
+		usage: "offset [--force-share] IMAGE GUEST_OFFSET (each step of the lookup of the offset, down the backing chain)",
+		run:   offset,
+	}
+}
+
+func offset(args []string) error {
+	fs := newFlagSet("offset")
+	forceShareFlag(fs)
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 2 {
+		return fmt.Errorf("offset: expected IMAGE and GUEST_OFFSET")
+	}
+	off, err := parseSize(operands[1])
+	if err != nil {
+		return fmt.Errorf("offset: GUEST_OFFSET: %w", err)
+	}
+	img, err := openImage(operands[0])
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	chain, err := img.TranslateOffset(off)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("guest offset %s, in cluster %d of %d bytes\n", hexDec(off), off/img.Header.ClusterSize(), img.Header.ClusterSize())
+	for _, t := range chain {
+		printTranslation(t)
+	}
+	if last := chain[len(chain)-1]; last.Invalid != "" {
+		reportError(last.Name, errors.New(last.Invalid))
+		return exitStatus(exitCorrupt)
+	}
+	return nil
+}
+
+// hexDec is an offset in hex for the hex editor and in decimal for dd
+func hexDec(n int64) string {
+	return fmt.Sprintf("%#x (%d)", n, n)
+}
+
+// printTranslation prints the steps of the lookup in one file of the chain
+func printTranslation(t qcow2.Translation) {
+	kind := "image"
+	if t.Raw {
+		kind = "raw file"
+	}
+	fmt.Printf("\ndepth %d: %s %s\n", t.Depth, kind, t.Name)
+	var table [][]string
+	add := func(key, format string, args ...any) {
+		table = append(table, []string{"    " + key + ":", fmt.Sprintf(format, args...)})
+	}
+	switch {
+	case t.PastEnd:
+		add("type", "past the end of the file, reads as zeros")
+		printTable(table)
+		return
+	case t.Raw:
+		add("type", "data")
+		add("host offset", "%s", hexDec(t.HostOffset))
+		printTable(table)
+		return
+	}
+	if t.L1EntryOffset == 0 {
+		add("L1 index", "%d, past the L1 table", t.L1Index)
+	} else {
+		add("L1 index", "%d, entry at %s", t.L1Index, hexDec(t.L1EntryOffset))
+		add("L1 entry", "%#016x", t.L1Entry)
+		if t.L2TableOffset == 0 {
+			add("L2 table", "none")
+		} else {
+			add("L2 table", "%s", hexDec(t.L2TableOffset))
+		}
+	}
+	if t.L2EntryOffset != 0 {
+		add("L2 index", "%d, entry at %s", t.L2Index, hexDec(t.L2EntryOffset))
+		add("L2 entry", "%#016x", t.L2Entry)
+	}
+	switch t.Type {
+	case qcow2.ExtentUnallocated:
+		add("type", "unallocated, left to the backing file")
+	case qcow2.ExtentZero:
+		if t.HostOffset != 0 {
+			add("type", "zero, preallocated at %s", hexDec(t.HostOffset))
+		} else {
+			add("type", "zero")
+		}
+	case qcow2.ExtentCompressed:
+		add("type", "compressed")
+		add("host offset", "%s, %d bytes of compressed data", hexDec(t.HostOffset), t.CompressedSize)
+	case qcow2.ExtentData:
+		add("type", "data")
+		add("host offset", "%s", hexDec(t.HostOffset))
+	}
+	add("remaining", "%d bytes to the end of the cluster", t.Remaining)
+	if t.Invalid != "" {
+		add("invalid", "%s", t.Invalid)
+	}
+	printTable(table)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["parts"] = command{
+		usage: "parts [--force-share] [--json] [--bytes] [--hex] | [-p] [--extract NUMBER] [--offset OFFSET] [--length BYTES] -o DEST IMAGE (list the MBR or GPT partitions of the guest disk, or copy one, or the range given, to the sparse raw file DEST)",
+		run:   parts,
+	}
+}
+
+type partsJSON struct {
+	Scheme     string          `json:"scheme"`
+	SectorSize int64           `json:"sector-size"`
+	DiskGUID   string          `json:"disk-guid,omitempty"`
+	Hybrid     bool            `json:"hybrid,omitempty"`
+	Partitions []partitionJSON `json:"partitions"`
+	Warnings   []string        `json:"warnings,omitempty"`
+}
+
+type partitionJSON struct {
+	Number     int      `json:"number"`
+	Start      int64    `json:"start"`
+	StartHex   *string  `json:"start-hex,omitempty"`
+	Size       int64    `json:"size"`
+	SizeHex    *string  `json:"size-hex,omitempty"`
+	Type       string   `json:"type"`
+	TypeName   string   `json:"type-name,omitempty"`
+	Logical    bool     `json:"logical,omitempty"`
+	GUID       string   `json:"guid,omitempty"`
+	Name       string   `json:"name,omitempty"`
+	Attributes uint64   `json:"attributes"`
+	Flags      []string `json:"flags"`
+}
+
+func parts(args []string) error {
+	fs := newFlagSet("parts")
+	forceShareFlag(fs)
+	asJSON := fs.Bool("json", false, "print the partition table as JSON")
+	exact := fs.Bool("bytes", false, "print sizes in bytes only, rather than in IEC units")
+	r := hexFlag(fs, false)
+	extract := fs.Int("extract", 0, "copy the partition of this number to DEST")
+	offset := fs.String("offset", "", "copy from this guest offset, rather than the start of the partition")
+	length := fs.String("length", "", "copy this many bytes, rather than the size of the partition or the rest of the disk")
+	dest := fs.String("o", "", "the raw file to copy to")
+	showProgress := fs.Bool("p", false, "show progress on a terminal")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 1 {
+		return fmt.Errorf("parts: expected IMAGE")
+	}
+	extracting := *extract != 0 || *offset != "" || *length != ""
+	switch {
+	case extracting && *dest == "":
+		return fmt.Errorf("parts: --extract, --offset and --length copy to the file given with -o")
+	case !extracting && *dest != "":
+		return fmt.Errorf("parts: -o needs --extract, or --offset or --length")
+	case *extract < 0:
+		return fmt.Errorf("parts: --extract %d is not a partition number", *extract)
+	}
+	img, err := openImage(operands[0])
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	if extracting && *extract == 0 {
+		return extractRange(img, 0, img.Size(), *offset, *length, *dest, *showProgress)
+	}
+	t, err := qcow2.ReadPartitions(img, img.Size())
+	if err != nil {
+		return err
+	}
+	for _, w := range t.Warnings {
+		fmt.Fprintf(os.Stderr, "[WARN] %s: %s\n", operands[0], w)
+	}
+	if extracting {
+		for _, p := range t.Partitions {
+			if p.Number == *extract {
+				return extractRange(img, p.Start, p.Size, *offset, *length, *dest, *showProgress)
+			}
+		}
+		return fmt.Errorf("parts: %s has no partition %d", operands[0], *extract)
+	}
+
+	if *asJSON {
+		out := partsJSON{Scheme: t.Scheme.String(), SectorSize: t.SectorSize, Hybrid: t.Hybrid, Partitions: []partitionJSON{}, Warnings: t.Warnings}
+		if t.Scheme == qcow2.PartitionGPT {
+			out.DiskGUID = t.DiskGUID.String()
+		}
+		for _, p := range t.Partitions {
+			j := partitionJSON{
+				Number: p.Number, Start: p.Start, StartHex: r.field(p.Start), Size: p.Size, SizeHex: r.field(p.Size),
+				Type: p.Type(), TypeName: p.TypeName(), Logical: p.Logical, Name: p.Name, Attributes: p.Attributes, Flags: p.Flags(),
+			}
+			if j.Flags == nil {
+				j.Flags = []string{}
+			}
+			if p.Scheme == qcow2.PartitionGPT {
+				j.GUID = p.GUID.String()
+			}
+			out.Partitions = append(out.Partitions, j)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		return enc.Encode(out)
+	}
+
+	head := fmt.Sprintf("%s partition table, %d byte sectors", strings.ToUpper(t.Scheme.String()), t.SectorSize)
+	if t.Scheme == qcow2.PartitionGPT {
+		head += ", disk GUID " + t.DiskGUID.String()
+	}
+	if t.Hybrid {
+		head += ", hybrid MBR"
+	}
+	fmt.Println(head)
+	table := [][]string{{"NUMBER", "START", "SIZE", "TYPE", "NAME", "FLAGS"}}
+	for _, p := range t.Partitions {
+		typ := p.Type()
+		if name := p.TypeName(); name != "" {
+			typ += " (" + name + ")"
+		}
+		size := qcow2.FormatSize(p.Size)
+		if *exact {
+			size = r.format(p.Size)
+		}
+		number := strconv.Itoa(p.Number)
+		if p.Logical {
+			number += " (logical)"
+		}
+		table = append(table, []string{number, r.format(p.Start), size, typ, p.Name, strings.Join(p.Flags(), ",")})
+	}
+	printTable(table)
+	return nil
+}
+
+// extractRange copies the n bytes of img at off, unless the --offset and
+// --length given replace them, to the sparse raw file dest. Without --length
+// an --offset copies up to the end of the range it replaces the start of.
+func extractRange(img *qcow2.Image, off, n int64, offset, length, dest string, showProgress bool) error {
+	end := off + n
+	if offset != "" {
+		var err error
+		if off, err = parseSize(offset); err != nil {
+			return fmt.Errorf("parts: --offset: %w", err)
+		}
+		n = end - off
+	}
+	if length != "" {
+		var err error
+		if n, err = parseSize(length); err != nil {
+			return fmt.Errorf("parts: --length: %w", err)
+		}
+	}
+	if off < 0 || n < 0 || off > img.Size() || n > img.Size()-off {
+		return fmt.Errorf("parts: %d bytes at %d are beyond the virtual size %d", n, off, img.Size())
+	}
+	return img.ConvertRangeToRaw(dest, off, n, &qcow2.ConvertOptions{Progress: progressBar(showProgress)})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/vbatts/qcow2"
+)
+
+// passphraseFile and passphraseAttempts are set by the flags of the same
+// names before the command, for the encrypted images of every command
+var (
+	passphraseFile     string
+	passphraseAttempts = 3
+)
+
+// terminal is where passphrases are asked for
+type terminal interface {
+	// isTerminal is whether there is someone to ask
+	isTerminal() bool
+	// readPassphrase prints prompt on stderr and reads a line, without
+	// echoing it
+	readPassphrase(prompt string) ([]byte, error)
+}
+
+// passphraseReader is the terminal of the tool, a variable for the tests
+var passphraseReader terminal = stdinTerminal{}
+
+// askPassphrase is the qcow2.PassphraseFunc of the tool. The passphrase is
+// the first line of -passphrase-file when it is given, and is otherwise
+// asked for on the terminal, each of the -passphrase-attempts times; when
+// stdin is not a terminal it fails rather than wait for a passphrase that
+// never comes.
+func askPassphrase(name string, attempt int) ([]byte, error) {
+	if passphraseFile != "" {
+		if attempt > 1 {
+			// the file says the same the second time
+			return nil, fmt.Errorf("%s: the passphrase of %s: %w", passphraseFile, name, qcow2.ErrBadPassphrase)
+		}
+		b, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		line, _, _ := bytes.Cut(b, []byte("\n"))
+		return bytes.TrimSuffix(line, []byte("\r")), nil
+	}
+	if !passphraseReader.isTerminal() {
+		return nil, fmt.Errorf("%s is encrypted, and stdin is not a terminal to ask for its passphrase on: give it with -passphrase-file", name)
+	}
+	prompt := fmt.Sprintf("Passphrase for %s: ", name)
+	if attempt > 1 {
+		prompt = "Wrong passphrase, try again.\n" + prompt
+	}
+	p, err := passphraseReader.readPassphrase(prompt)
+	if err != nil {
+		return nil, fmt.Errorf("reading the passphrase of %s: %w", name, err)
+	}
+	return p, nil
+}
+
+// readLine reads a line from f a byte at a time, so that nothing past it is
+// taken from stdin. A line cut short by the end of the file is no line.
+func readLine(f *os.File) ([]byte, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := f.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				return bytes.TrimSuffix(line, []byte("\r")), nil
+			}
+			line = append(line, b[0])
+			continue
+		}
+		if err != nil {
+			return nil, errors.New("no passphrase was given")
+		}
+	}
+}
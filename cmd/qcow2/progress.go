@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/vbatts/qcow2"
+)
+
+// progressBar renders progress on a single line of stderr, like qemu-img -p.
+// It is nil, so nothing is shown, unless enabled and stderr is a terminal.
+func progressBar(enabled bool) qcow2.ProgressFunc {
+	if fi, err := os.Stderr.Stat(); !enabled || err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	start := time.Now()
+	return func(done, total int64) {
+		pct := 100.0
+		if total > 0 {
+			pct = float64(done) * 100 / float64(total)
+		}
+		rate := float64(done) / time.Since(start).Seconds()
+		eta := ""
+		if rate > 0 && done < total {
+			eta = fmt.Sprintf(", %s left", (time.Duration(float64(total-done)/rate) * time.Second).Round(time.Second))
+		}
+		fmt.Fprintf(os.Stderr, "\r    (%.2f/100%%) %.1f MiB/s%s\x1b[K", pct, rate/(1<<20), eta)
+		if done >= total {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+)
+
+// radix is how a command prints offsets and lengths: in hex when its --hex
+// flag is set, or else in decimal. In JSON the numbers stay numbers, and hex
+// adds a parallel string field of each named with a -hex suffix.
+type radix struct {
+	hex bool
+}
+
+// hexFlag adds the --hex flag to fs, set by default for the commands that
+// dump metadata
+func hexFlag(fs *flag.FlagSet, def bool) *radix {
+	r := &radix{}
+	fs.BoolVar(&r.hex, "hex", def, "print offsets and lengths in hex")
+	return r
+}
+
+func (r *radix) format(n int64) string {
+	if r.hex {
+		return fmt.Sprintf("%#x", n)
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// field is the parallel JSON field of n, omitted without hex
+func (r *radix) field(n int64) *string {
+	if !r.hex {
+		return nil
+	}
+	s := fmt.Sprintf("%#x", n)
+	return &s
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+func init() {
+	commands["read"] = command{
+		usage: "read [--allow-short] IMAGE OFFSET LENGTH (writes the guest bytes to stdout)",
+		run:   read,
+	}
+}
+
+func read(args []string) error {
+	fs := newFlagSet("read")
+	allowShort := fs.Bool("allow-short", false, "stop at the end of the disk instead of failing")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 3 {
+		return fmt.Errorf("read: expected IMAGE, OFFSET and LENGTH")
+	}
+	off, err := parseSize(operands[1])
+	if err != nil {
+		return fmt.Errorf("read: OFFSET: %w", err)
+	}
+	n, err := parseSize(operands[2])
+	if err != nil {
+		return fmt.Errorf("read: LENGTH: %w", err)
+	}
+	if off < 0 || n < 0 {
+		return fmt.Errorf("read: negative OFFSET or LENGTH")
+	}
+	in, size, err := openInput(operands[0])
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if off+n > size {
+		if !*allowShort {
+			return fmt.Errorf("read: %d bytes at %d are beyond the virtual size %d", n, off, size)
+		}
+		n = max(0, size-off)
+	}
+	_, err = io.CopyBuffer(os.Stdout, io.NewSectionReader(in, off, n), make([]byte, 64<<10))
+	return err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["rebase"] = command{
+		usage: "rebase [-p] [-u] -b BACKING [-F raw|qcow2] IMAGE (an empty BACKING removes the backing file)",
+		run:   rebase,
+	}
+}
+
+func rebase(args []string) error {
+	fs := newFlagSet("rebase")
+	backing := fs.String("b", "", "the new backing file, relative to IMAGE")
+	format := fs.String("F", "", "format of the new backing file, probed when empty")
+	showProgress := fs.Bool("p", false, "show progress on a terminal")
+	unsafe := fs.Bool("u", false, "only rewrite the backing file reference, without comparing contents")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 1 {
+		return fmt.Errorf("rebase: expected IMAGE")
+	}
+	if *unsafe {
+		return rebaseUnsafe(operands[0], *backing, *format)
+	}
+	img, err := openImageFile(operands[0], os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	if *backing != "" && *format == "" {
+		if *format, err = probe(backingPath(img, *backing)); err != nil {
+			return err
+		}
+	}
+	return img.Rebase(*backing, *format, &qcow2.RebaseOptions{Progress: progressBar(*showProgress)})
+}
+
+// rebaseUnsafe rewrites the backing file reference of the named image, which
+// is opened without its backing file so that a missing one can be replaced,
+// warning when the new backing file cannot be what the image expects
+func rebaseUnsafe(name, backing, format string) error {
+	img, err := openImageFile(name, os.O_RDWR, qcow2.WithNoBacking())
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	if backing == "" {
+		return img.Rebase("", "", &qcow2.RebaseOptions{Unsafe: true})
+	}
+	path := backingPath(img, backing)
+	fi, err := os.Stat(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[WARN] the new backing file %s cannot be found: %s\n", path, err)
+		return img.Rebase(backing, format, &qcow2.RebaseOptions{Unsafe: true})
+	}
+	if format == "" {
+		if format, err = probe(path); err != nil {
+			return err
+		}
+	}
+	if err := img.Rebase(backing, format, &qcow2.RebaseOptions{Unsafe: true}); err != nil {
+		return err
+	}
+	size := fi.Size()
+	if format == "qcow2" {
+		b, err := openImage(path, qcow2.WithNoLock(), qcow2.WithNoBacking())
+		if err != nil {
+			return err
+		}
+		size = b.Size()
+		b.Close()
+	}
+	if size < img.Size() {
+		fmt.Fprintf(os.Stderr, "[WARN] the new backing file of %d bytes is smaller than the image of %d bytes\n", size, img.Size())
+	}
+	return nil
+}
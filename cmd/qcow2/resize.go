@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+func init() {
+	commands["resize"] = command{
+		usage: "resize IMAGE [+|-]SIZE (shrinking refuses to discard allocated clusters)",
+		run:   resize,
+	}
+}
+
+func resize(args []string) error {
+	fs := newFlagSet("resize")
+	// -1G would be taken for a flag
+	var operands []string
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-") && len(arg) > 1 && arg[1] >= '0' && arg[1] <= '9' {
+			operands = append(operands, arg)
+			args = append(args[:i:i], args[i+1:]...)
+			break
+		}
+	}
+	rest, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	operands = append(rest, operands...)
+	if len(operands) != 2 {
+		return fmt.Errorf("resize: expected IMAGE and SIZE")
+	}
+	img, err := openImageFile(operands[0], os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	arg := operands[1]
+	sign := int64(0)
+	switch arg[0] {
+	case '+':
+		sign, arg = 1, arg[1:]
+	case '-':
+		sign, arg = -1, arg[1:]
+	}
+	n, err := parseSize(arg)
+	if err != nil {
+		return fmt.Errorf("resize: SIZE: %w", err)
+	}
+	if sign != 0 {
+		n = img.Size() + sign*n
+	}
+	if err := img.Resize(n); err != nil {
+		return err
+	}
+	fmt.Println("Image resized.")
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+func init() {
+	commands["serve"] = command{
+		usage: "serve nbd [--force-share] --listen unix:PATH|tcp:HOST:PORT [--name NAME] IMAGE (export the guest disk read-only over NBD, until SIGINT or SIGTERM)",
+		run:   serve,
+	}
+}
+
+func serve(args []string) error {
+	if len(args) == 0 || args[0] != "nbd" {
+		return fmt.Errorf("serve: expected the protocol, nbd")
+	}
+	fs := newFlagSet("serve nbd")
+	forceShareFlag(fs)
+	addr := fs.String("listen", "", "where to listen: unix:PATH, or tcp:HOST:PORT")
+	name := fs.String("name", "", "the name of the export, which clients asking for the default export get as well")
+	operands, err := parseArgs(fs, args[1:])
+	if err != nil {
+		return err
+	}
+	if len(operands) != 1 || *addr == "" {
+		return fmt.Errorf("serve nbd: expected --listen and IMAGE")
+	}
+	img, err := openImage(operands[0])
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	l, err := listen(*addr)
+	if err != nil {
+		return fmt.Errorf("serve nbd: %w", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	logger.Info("serving over NBD", "image", operands[0], "listen", *addr, "export", *name)
+	return serveNBD(ctx, l, &nbdExport{name: *name, img: img})
+}
+
+// serveNBD serves e to each client connecting to l, until ctx is done. Then
+// it closes l and the connections, and returns once they are.
+func serveNBD(ctx context.Context, l net.Listener, e *nbdExport) error {
+	var (
+		mu    sync.Mutex
+		conns = map[net.Conn]bool{}
+		wg    sync.WaitGroup
+	)
+	go func() {
+		<-ctx.Done()
+		l.Close()
+		mu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			wg.Wait()
+			if ctx.Err() != nil {
+				logger.Info("stopped serving over NBD")
+				return nil
+			}
+			return err
+		}
+		mu.Lock()
+		if ctx.Err() != nil {
+			mu.Unlock()
+			conn.Close()
+			continue
+		}
+		conns[conn] = true
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log := logger.With("remote", conn.RemoteAddr().String())
+			log.Info("NBD client connected")
+			err := e.serve(conn, log)
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+			conn.Close()
+			if err != nil && ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				log.Warn("NBD client failed", "err", err)
+				return
+			}
+			log.Info("NBD client disconnected")
+		}()
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["snapshot"] = command{
+		usage: "snapshot -l [--bytes] | -c NAME | -a NAME|ID IMAGE (list, create or apply internal snapshots)",
+		run:   snapshot,
+	}
+}
+
+func snapshot(args []string) error {
+	fs := newFlagSet("snapshot")
+	list := fs.Bool("l", false, "list the snapshots")
+	create := fs.String("c", "", "create a snapshot of this name")
+	apply := fs.String("a", "", "revert the disk to this snapshot")
+	exact := fs.Bool("bytes", false, "list the VM state sizes in bytes, rather than in IEC units")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 1 {
+		return fmt.Errorf("snapshot: expected IMAGE")
+	}
+	actions := 0
+	for _, set := range []bool{*list, *create != "", *apply != ""} {
+		if set {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return fmt.Errorf("snapshot: expected one of -l, -c and -a")
+	}
+
+	if *list {
+		img, err := openImage(operands[0], qcow2.WithNoBacking())
+		if err != nil {
+			return err
+		}
+		defer img.Close()
+		if snaps := img.Snapshots(); len(snaps) > 0 {
+			fmt.Println("Snapshot list:")
+			printSnapshots(snaps, *exact)
+		}
+		return nil
+	}
+	img, err := openImageFile(operands[0], os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	if *create != "" {
+		return img.CreateSnapshot(*create)
+	}
+	return img.ApplySnapshot(*apply)
+}
+
+// printSnapshots prints a table of snapshots, laid out as by qemu-img, with
+// the VM state sizes in bytes when exact is set
+func printSnapshots(snaps []qcow2.Snapshot, exact bool) {
+	fmt.Printf("%-10s%-17s%12s%20s%15s\n", "ID", "TAG", "VM SIZE", "DATE", "VM CLOCK")
+	for _, s := range snaps {
+		clock := s.VMClock
+		vmSize := qcow2.FormatSize(s.VMStateSize)
+		if exact {
+			vmSize = strconv.FormatInt(s.VMStateSize, 10)
+		}
+		fmt.Printf("%-10s%-17s%12s%20s%15s\n", s.ID, s.Name, vmSize, s.Date.Local().Format("2006-01-02 15:04:05"),
+			fmt.Sprintf("%02d:%02d:%02d.%03d", int(clock.Hours()), int(clock.Minutes())%60, int(clock.Seconds())%60, clock.Milliseconds()%1000))
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["snapshot-copy"] = command{
+		usage: "snapshot-copy [-p] [--resize] --name NAME|ID SOURCE DEST",
+		run:   snapshotCopy,
+	}
+}
+
+func snapshotCopy(args []string) error {
+	fs := newFlagSet("snapshot-copy")
+	name := fs.String("name", "", "name or ID of the snapshot to copy")
+	resize := fs.Bool("resize", false, "copy a snapshot of another virtual size than DEST")
+	showProgress := fs.Bool("p", false, "show progress on a terminal")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 2 || *name == "" {
+		return fmt.Errorf("snapshot-copy: expected --name, SOURCE and DEST")
+	}
+	src, err := openImage(operands[0])
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := openImageFile(operands[1], os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	if err := dst.CopySnapshot(src, *name, &qcow2.SnapshotCopyOptions{Resize: *resize, Progress: progressBar(*showProgress)}); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
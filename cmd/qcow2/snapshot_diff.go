@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+func init() {
+	commands["snapshot-diff"] = command{
+		usage: "snapshot-diff [--force-share] --name NAME|ID [--content] [--json] [--hex] IMAGE",
+		run:   snapshotDiff,
+	}
+}
+
+func snapshotDiff(args []string) error {
+	fs := newFlagSet("snapshot-diff")
+	forceShareFlag(fs)
+	name := fs.String("name", "", "name or ID of the snapshot to compare with")
+	content := fs.Bool("content", false, "leave out clusters rewritten with the same data")
+	asJSON := fs.Bool("json", false, "print the ranges as JSON")
+	r := hexFlag(fs, false)
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 1 || *name == "" {
+		return fmt.Errorf("snapshot-diff: expected --name and IMAGE")
+	}
+	img, err := openImage(operands[0])
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	changed, err := img.SnapshotDiff(*name, *content)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		type jsonRange struct {
+			Start     int64   `json:"start"`
+			StartHex  *string `json:"start-hex,omitempty"`
+			Length    int64   `json:"length"`
+			LengthHex *string `json:"length-hex,omitempty"`
+		}
+		out := make([]jsonRange, 0, len(changed))
+		for _, c := range changed {
+			out = append(out, jsonRange{c.Start, r.field(c.Start), c.Length, r.field(c.Length)})
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+	for _, c := range changed {
+		fmt.Printf("%s %s\n", r.format(c.Start), r.format(c.Length))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["snapshot-export"] = command{
+		usage: "snapshot-export [--force-share] [-p] --name NAME|ID [-O raw|qcow2] [-c] [-o OPTIONS] IMAGE DEST",
+		run:   snapshotExport,
+	}
+}
+
+func snapshotExport(args []string) error {
+	fs := newFlagSet("snapshot-export")
+	forceShareFlag(fs)
+	name := fs.String("name", "", "name or ID of the snapshot to export")
+	format := fs.String("O", "raw", "output format")
+	createOpts := fs.String("o", "", "comma separated qcow2 options: cluster_size, preallocation, compat, refcount_bits")
+	compress := fs.Bool("c", false, "compress the data clusters of a qcow2 DEST")
+	showProgress := fs.Bool("p", false, "show progress on a terminal")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 2 || *name == "" {
+		return fmt.Errorf("snapshot-export: expected --name, IMAGE and DEST")
+	}
+	img, err := openImage(operands[0])
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	snap, err := img.SnapshotView(*name)
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "raw":
+		return snap.ConvertToRaw(operands[1], &qcow2.ConvertOptions{Progress: progressBar(*showProgress)})
+	case "qcow2":
+		opts, err := parseCreateOptions(*createOpts)
+		if err != nil {
+			return fmt.Errorf("snapshot-export: %w", err)
+		}
+		if opts.BackingFile != "" {
+			return fmt.Errorf("snapshot-export: DEST cannot have a backing file")
+		}
+		opts.Compress, opts.Progress = *compress, progressBar(*showProgress)
+		return snap.Flatten(operands[1], opts)
+	}
+	return fmt.Errorf("snapshot-export: unsupported output format %q", *format)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/vbatts/qcow2"
+)
+
+// stdinName is the name of an image read from stdin, by the commands that
+// only need its header
+const stdinName = "-"
+
+// errNotSeekable is the error of the commands that read images at random,
+// when given one as a stream
+var errNotSeekable = errors.New("the image is read at random, which requires a seekable input: only its header can be read from a stream, by info, ext-list and ext-dump")
+
+// readStreamHeader reads the header of an image from r, which is read in
+// sequence, and no further than the first cluster
+func readStreamHeader(r io.Reader) (*qcow2.Header, error) {
+	read := qcow2.ReadHeader
+	if skipExtensions {
+		read = qcow2.ReadHeaderWithoutExtensions
+	}
+	h, err := read(r)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = errors.New("the stream ends within the header")
+	}
+	return h, err
+}
+
+// readContainedHeader is readStreamHeader of r, decompressed first when it
+// is in a container, which is returned too
+func readContainedHeader(r io.Reader) (*qcow2.Header, *container, error) {
+	rc, c, err := openContainer(r)
+	if err != nil {
+		return nil, c, err
+	}
+	defer rc.Close()
+	h, err := readStreamHeader(rc)
+	if err != nil && c != nil {
+		err = fmt.Errorf("in a %s container: %w", c.name, err)
+	}
+	return h, c, err
+}
+
+// readStreamInfo is what the header of an image read from r, or from the
+// container r is, says about it. The rest of the image is not read, so its
+// size on disk, its snapshot table, bitmaps and LUKS header are unknown.
+func readStreamInfo(r io.Reader, name string) (*imageInfo, error) {
+	h, c, err := readContainedHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	md, err := h.Metadata()
+	if err != nil {
+		return nil, err
+	}
+	inf := &imageInfo{Header: *h, Filename: name, Metadata: md, streamed: true, bitmapsErr: errNotSeekable, luksErr: errNotSeekable}
+	if c != nil {
+		inf.Container = c.name
+		inf.bitmapsErr, inf.luksErr = errCompressed{c}, errCompressed{c}
+	}
+	return inf, nil
+}
+
+// readHeaderOnly reads the header of the image at name, or of stdin for -,
+// without opening the rest, which may be what is being looked into. An image
+// in a container is decompressed, and its container returned.
+func readHeaderOnly(name string) (*qcow2.Header, *container, error) {
+	r, label := io.Reader(os.Stdin), "stdin"
+	if name != stdinName {
+		fh, err := os.Open(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer fh.Close()
+		r, label = fh, name
+	}
+	h, c, err := readContainedHeader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", label, err)
+	}
+	return h, c, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["export-tar"] = command{
+		usage: "export-tar [--force-share] [-p] IMAGE DEST (the data of the guest disk as a tar of manifest.json and an entry for each extent, - is stdout)",
+		run:   exportTar,
+	}
+	commands["import-tar"] = command{
+		usage: "import-tar [-p] [-c] [-o OPTIONS] SOURCE IMAGE (create the image from a tar written by export-tar, - is stdin)",
+		run:   importTar,
+	}
+}
+
+func exportTar(args []string) error {
+	fs := newFlagSet("export-tar")
+	forceShareFlag(fs)
+	showProgress := fs.Bool("p", false, "show progress on a terminal")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 2 {
+		return fmt.Errorf("export-tar: expected IMAGE and DEST")
+	}
+	img, err := openImage(operands[0])
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	opts := &qcow2.ConvertOptions{Progress: progressBar(*showProgress)}
+	if operands[1] == "-" {
+		w := bufio.NewWriterSize(os.Stdout, 1<<20)
+		if err := img.ExportTar(w, opts); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	fh, err := os.Create(operands[1])
+	if err != nil {
+		return err
+	}
+	if err := img.ExportTar(fh, opts); err != nil {
+		fh.Close()
+		os.Remove(operands[1])
+		return err
+	}
+	return fh.Close()
+}
+
+func importTar(args []string) error {
+	fs := newFlagSet("import-tar")
+	createOpts := fs.String("o", "", "comma separated qcow2 options: cluster_size, preallocation, compat, refcount_bits, rather than those of the exported image")
+	compress := fs.Bool("c", false, "compress the data clusters")
+	showProgress := fs.Bool("p", false, "show progress on a terminal")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 2 {
+		return fmt.Errorf("import-tar: expected SOURCE and IMAGE")
+	}
+	opts, err := parseCreateOptions(*createOpts)
+	if err != nil {
+		return fmt.Errorf("import-tar: %w", err)
+	}
+	if opts.BackingFile != "" {
+		return fmt.Errorf("import-tar: IMAGE cannot have a backing file")
+	}
+	opts.Compress, opts.Progress = *compress, progressBar(*showProgress)
+	var r io.Reader = os.Stdin
+	if operands[0] != "-" {
+		fh, err := os.Open(operands[0])
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		r = fh
+	}
+	if err := qcow2.ImportTar(bufio.NewReaderSize(r, 1<<20), operands[1], opts); err != nil {
+		return fmt.Errorf("%s: %w", operands[0], err)
+	}
+	if *compress {
+		return reportCompression(operands[1])
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import "errors"
+
+// stdinTerminal is never a terminal here, where echoing can not be turned
+// off: passphrases are only read from -passphrase-file
+type stdinTerminal struct{}
+
+func (stdinTerminal) isTerminal() bool { return false }
+
+func (stdinTerminal) readPassphrase(string) ([]byte, error) {
+	return nil, errors.New("passphrases can not be asked for on this system")
+}
@@ -0,0 +1,44 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// stdinTerminal asks on the terminal of stdin, if it is one
+type stdinTerminal struct{}
+
+func termios(fd uintptr, req uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (stdinTerminal) isTerminal() bool {
+	var t syscall.Termios
+	return termios(os.Stdin.Fd(), ioctlGetTermios, &t) == nil
+}
+
+func (stdinTerminal) readPassphrase(prompt string) ([]byte, error) {
+	fd := os.Stdin.Fd()
+	var old syscall.Termios
+	if err := termios(fd, ioctlGetTermios, &old); err != nil {
+		return nil, err
+	}
+	noEcho := old
+	noEcho.Lflag &^= syscall.ECHO
+	noEcho.Lflag |= syscall.ICANON | syscall.ISIG
+	if err := termios(fd, ioctlSetTermios, &noEcho); err != nil {
+		return nil, err
+	}
+	defer termios(fd, ioctlSetTermios, &old)
+	fmt.Fprint(os.Stderr, prompt)
+	// the newline typed was not echoed
+	defer fmt.Fprintln(os.Stderr)
+	return readLine(os.Stdin)
+}
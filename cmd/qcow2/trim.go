@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func init() {
+	commands["trim-zeros"] = command{
+		usage: "trim-zeros IMAGE",
+		run:   trimZeros,
+	}
+}
+
+func trimZeros(args []string) error {
+	fs := newFlagSet("trim-zeros")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 1 {
+		return fmt.Errorf("trim-zeros: expected IMAGE")
+	}
+	img, err := openImageFile(operands[0], os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	n, err := img.TrimZeroClusters()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("freed %d clusters of zeros\n", n)
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import "os"
+
+// diskUsage is the size of the file, as the space it takes on disk is not
+// known here
+func diskUsage(fi os.FileInfo) int64 {
+	return fi.Size()
+}
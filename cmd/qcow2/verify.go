@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["verify"] = command{
+		usage: "verify [--force-share] [--checksum-only] IMAGE REFERENCE (REFERENCE is raw, exits 0 when identical, 5 when different)",
+		run:   verify,
+	}
+}
+
+func verify(args []string) error {
+	fs := newFlagSet("verify")
+	forceShareFlag(fs)
+	checksumOnly := fs.Bool("checksum-only", false, "only compare the SHA-256 of the contents")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 2 {
+		return fmt.Errorf("verify: expected IMAGE and REFERENCE")
+	}
+	img, err := openImage(operands[0])
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	fh, err := os.Open(operands[1])
+	if err != nil {
+		return err
+	}
+	ref := rawFile{fh}
+	defer ref.Close()
+	refSize := ref.Size()
+
+	if *checksumOnly {
+		h := sha256.New()
+		if _, err := img.WriteRawTo(h); err != nil {
+			return err
+		}
+		sum := h.Sum(nil)
+		h.Reset()
+		if _, err := io.Copy(h, io.NewSectionReader(ref, 0, refSize)); err != nil {
+			return err
+		}
+		refSum := h.Sum(nil)
+		fmt.Printf("%x  %s\n%x  %s\n", sum, operands[0], refSum, operands[1])
+		if string(sum) != string(refSum) {
+			fmt.Println("Checksum mismatch!")
+			return exitStatus(exitCorrupt)
+		}
+		fmt.Println("Checksums match.")
+		return nil
+	}
+
+	mismatches, err := qcow2.VerifyAgainstRaw(img, ref, refSize)
+	if err != nil {
+		return err
+	}
+	if len(mismatches) == 0 {
+		fmt.Println("Image matches the reference.")
+		return nil
+	}
+	if img.Size() != refSize {
+		fmt.Printf("Size mismatch: %d and %d bytes\n", img.Size(), refSize)
+	}
+	var total int64
+	for _, m := range mismatches {
+		fmt.Printf("Mismatch at offset %d, %d bytes\n", m.Start, m.Length)
+		total += m.Length
+	}
+	fmt.Printf("%d bytes in %d ranges differ\n", total, len(mismatches))
+	return exitStatus(exitCorrupt)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/vbatts/qcow2"
+)
+
+func init() {
+	commands["version"] = command{
+		usage: "version [--output human|json]",
+		run:   version,
+	}
+}
+
+// versionInfo is what the binary is and what it does with images, for bug
+// reports
+type versionInfo struct {
+	Module string `json:"module"`
+	// Version is that of the module, "(devel)" when built from a checkout
+	Version string `json:"version"`
+	// Revision, RevisionTime and Modified are from the VCS the binary was
+	// built in, when it was
+	Revision     string              `json:"revision,omitempty"`
+	RevisionTime string              `json:"revision-time,omitempty"`
+	Modified     bool                `json:"modified"`
+	GoVersion    string              `json:"go-version"`
+	Platform     string              `json:"platform"`
+	Capabilities versionCapabilities `json:"capabilities"`
+}
+
+type versionCapabilities struct {
+	Versions         []int               `json:"versions"`
+	Features         []versionFeature    `json:"features"`
+	CompressionTypes []string            `json:"compression-types"`
+	Encryption       []versionEncryption `json:"encryption"`
+	MinClusterBits   int                 `json:"min-cluster-bits"`
+	MaxClusterBits   int                 `json:"max-cluster-bits"`
+	Write            bool                `json:"write"`
+}
+
+type versionFeature struct {
+	Type      string `json:"type"`
+	Bit       int    `json:"bit"`
+	Name      string `json:"name"`
+	Supported bool   `json:"supported"`
+}
+
+type versionEncryption struct {
+	Method string `json:"method"`
+	Read   bool   `json:"read"`
+	Write  bool   `json:"write"`
+	Header bool   `json:"header"`
+}
+
+func version(args []string) error {
+	fs := newFlagSet("version")
+	output := fs.String("output", "human", "print the version as human text or as json")
+	operands, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 0 {
+		return fmt.Errorf("version: expected no operands")
+	}
+	if *output != "human" && *output != "json" {
+		return fmt.Errorf("version: unknown output format %q", *output)
+	}
+	v := readVersionInfo()
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		return enc.Encode(v)
+	}
+	v.print()
+	return nil
+}
+
+// readVersionInfo is the build information of the binary and the
+// capabilities of the package it was built with
+func readVersionInfo() versionInfo {
+	v := versionInfo{GoVersion: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		v.Module, v.Version = bi.Main.Path, bi.Main.Version
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				v.Revision = s.Value
+			case "vcs.time":
+				v.RevisionTime = s.Value
+			case "vcs.modified":
+				v.Modified = s.Value == "true"
+			}
+		}
+	}
+	caps := qcow2.SupportedCapabilities()
+	c := versionCapabilities{
+		CompressionTypes: caps.CompressionTypes,
+		MinClusterBits:   caps.MinClusterBits,
+		MaxClusterBits:   caps.MaxClusterBits,
+		Write:            caps.Write,
+	}
+	for _, ver := range caps.Versions {
+		c.Versions = append(c.Versions, int(ver))
+	}
+	for _, f := range caps.Features {
+		c.Features = append(c.Features, versionFeature{f.Type.String(), f.Bit, f.Name, f.Supported})
+	}
+	for _, e := range caps.Encryption {
+		c.Encryption = append(c.Encryption, versionEncryption{e.Method.String(), e.Read, e.Write, e.Header})
+	}
+	v.Capabilities = c
+	return v
+}
+
+func (v versionInfo) print() {
+	built := v.Version
+	if built == "" {
+		built = "unknown"
+	}
+	if v.Revision != "" {
+		built += ", revision " + v.Revision
+		if v.RevisionTime != "" {
+			built += " of " + v.RevisionTime
+		}
+		if v.Modified {
+			built += ", modified"
+		}
+	}
+	c := v.Capabilities
+	versions := make([]string, len(c.Versions))
+	for i, ver := range c.Versions {
+		versions[i] = strconv.Itoa(ver)
+	}
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	fmt.Printf("%s %s\n", progName, built)
+	if v.Module != "" {
+		fmt.Printf("module: %s\n", v.Module)
+	}
+	fmt.Printf("go: %s %s\n", v.GoVersion, v.Platform)
+	fmt.Printf("image versions: %s\n", strings.Join(versions, ", "))
+	fmt.Printf("cluster bits: %d to %d (%s to %s)\n", c.MinClusterBits, c.MaxClusterBits, qcow2.FormatSize(1<<c.MinClusterBits), qcow2.FormatSize(1<<c.MaxClusterBits))
+	fmt.Printf("compression types: %s\n", strings.Join(c.CompressionTypes, ", "))
+	fmt.Printf("write: %s\n", yesNo(c.Write))
+	fmt.Println("features:")
+	table := [][]string{{"    TYPE", "BIT", "NAME", "SUPPORTED"}}
+	for _, f := range c.Features {
+		table = append(table, []string{"    " + f.Type, strconv.Itoa(f.Bit), f.Name, yesNo(f.Supported)})
+	}
+	printTable(table)
+	fmt.Println("encryption:")
+	table = [][]string{{"    METHOD", "READ", "WRITE", "HEADER"}}
+	for _, e := range c.Encryption {
+		table = append(table, []string{"    " + e.Method, yesNo(e.Read), yesNo(e.Write), yesNo(e.Header)})
+	}
+	printTable(table)
+}
@@ -0,0 +1,140 @@
+package qcow2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CommitOptions are the parameters of Image.Commit
+type CommitOptions struct {
+	// Base is the depth in the backing chain of the image committed into,
+	// 1, the default, being the backing file of the image. The images in
+	// between are committed too, and no longer consistent afterwards.
+	Base int
+	// Empty drops the clusters of the image once they are committed, so that
+	// it reads through to the base. It requires Base to be 1.
+	Empty bool
+	// Progress is told how many bytes have been committed, out of those the
+	// images above the base provide
+	Progress ProgressFunc
+}
+
+// Commit writes the ranges of the guest disk that the image and the images
+// above the base provide into the base, which is qcow2 or raw, so that the
+// base reads as the image did. Zero clusters are written as zero clusters, or
+// by dropping clusters, where the base can. The base is opened read-write for
+// the duration of the commit.
+func (img *Image) Commit(opts *CommitOptions) error {
+	if opts == nil {
+		opts = &CommitOptions{}
+	}
+	depth := max(1, opts.Base)
+	if opts.Empty && depth != 1 {
+		return errors.New("qcow2: emptying the image requires committing into its backing file")
+	}
+	if opts.Empty && img.readOnly {
+		return ErrReadOnly
+	}
+	// parent has the base as its backing file
+	parent := img
+	for d := 1; d < depth; d++ {
+		if parent = parent.BackingImage(); parent == nil {
+			return fmt.Errorf("qcow2: no qcow2 image at depth %d of the backing chain", d)
+		}
+	}
+	if parent.backing == nil {
+		return fmt.Errorf("qcow2: no backing file at depth %d of the backing chain", depth)
+	}
+
+	var extents []Extent
+	var total int64
+	err := img.WalkExtents(0, img.Size(), func(e Extent) error {
+		if e.Depth >= depth {
+			return nil
+		}
+		if e.Start+e.Length > parent.backingSize {
+			if e.Type != ExtentUnallocated {
+				return fmt.Errorf("qcow2: backing file of %d bytes is too small to commit %d bytes at %d", parent.backingSize, e.Length, e.Start)
+			}
+			// past the end of an image above the base, and of the base
+			if e.Length = parent.backingSize - e.Start; e.Length <= 0 {
+				return nil
+			}
+		}
+		extents = append(extents, e)
+		total += e.Length
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := parent.reopenBacking(true); err != nil {
+		return err
+	}
+	err = img.commitExtents(parent.backing, extents, newProgress(opts.Progress, total))
+	if rerr := parent.reopenBacking(false); err == nil {
+		err = rerr
+	}
+	if err != nil || !opts.Empty {
+		return err
+	}
+	return img.empty()
+}
+
+// commitExtents copies the guest contents of the extents into base
+func (img *Image) commitExtents(base io.ReaderAt, extents []Extent, prog *progress) error {
+	buf := make([]byte, convertChunk)
+	for _, e := range extents {
+		for off := e.Start; off < e.Start+e.Length; {
+			n := min(convertChunk, e.Start+e.Length-off)
+			var err error
+			switch b := base.(type) {
+			case *Image:
+				if e.ReadsAsZeros() {
+					err = b.writeZeroes(off, n)
+				} else if _, err = img.ReadAt(buf[:n], off); err == nil {
+					_, err = b.WriteAt(buf[:n], off)
+				}
+			case *hostFile:
+				p := buf[:n]
+				if e.ReadsAsZeros() {
+					clear(p)
+				} else {
+					_, err = img.ReadAt(p, off)
+				}
+				if err == nil {
+					_, err = b.WriteAt(p, off)
+				}
+			}
+			if err != nil {
+				return err
+			}
+			prog.add(n)
+			off += n
+		}
+	}
+	prog.finish()
+	return nil
+}
+
+// empty drops every cluster of the active state, so that the image reads
+// through to its backing file
+func (img *Image) empty() error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	for i, e := range img.l1 {
+		if e&entryOffsetMask == 0 {
+			continue
+		}
+		if err := img.updateTreeRefcounts([]uint64{e}, -1); err != nil {
+			return err
+		}
+		if err := img.setL1(int64(i), 0); err != nil {
+			return err
+		}
+	}
+	img.freeHint = 0
+	return nil
+}
@@ -0,0 +1,101 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// backedImage creates an image of size bytes, with 4 KiB clusters, in dir
+// backed by the named file
+func backedImage(t *testing.T, name string, size int64, backing, format string) *Image {
+	t.Helper()
+	img, err := Create(name, size, &CreateOptions{ClusterSize: 4096, BackingFile: backing, BackingFormat: format})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { img.Close() })
+	return img
+}
+
+func TestCommit(t *testing.T) {
+	const size = 1 << 20
+	for _, format := range []string{"qcow2", "raw"} {
+		dir := t.TempDir()
+		baseName := filepath.Join(dir, "base."+format)
+		if format == "raw" {
+			if err := os.WriteFile(baseName, bytes.Repeat([]byte("base"), size/4), 0644); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			base := backedImage(t, baseName, size, "", "")
+			if _, err := base.WriteAt(bytes.Repeat([]byte("base"), size/4), 0); err != nil {
+				t.Fatal(err)
+			}
+			base.Close()
+		}
+		mid := backedImage(t, filepath.Join(dir, "mid.qcow2"), size, "base."+format, format)
+		if _, err := mid.WriteAt(bytes.Repeat([]byte("mid"), 3000), 100000); err != nil {
+			t.Fatal(err)
+		}
+		mid.Close()
+		top := backedImage(t, filepath.Join(dir, "top.qcow2"), size, "mid.qcow2", "qcow2")
+		if _, err := top.WriteAt(bytes.Repeat([]byte("top"), 3000), 104000); err != nil {
+			t.Fatal(err)
+		}
+		if err := top.writeZeroes(200000, 20000); err != nil {
+			t.Fatal(err)
+		}
+		want := checksum(t, top)
+
+		// commit the top image into the mid image, emptying it
+		if err := top.Commit(&CommitOptions{Empty: true}); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if checksum(t, top) != want {
+			t.Errorf("%s: the emptied image reads differently", format)
+		}
+		verifyRefcounts(t, top)
+		if err := top.WalkExtents(0, size, func(e Extent) error {
+			if e.Depth == 0 && e.Type != ExtentUnallocated {
+				t.Errorf("%s: %+v left in the emptied image", format, e)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		top.Close()
+
+		// and all of it into the base
+		top, err := OpenFile(filepath.Join(dir, "top.qcow2"), os.O_RDWR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer top.Close()
+		if _, err := top.WriteAt([]byte("more"), 5000); err != nil {
+			t.Fatal(err)
+		}
+		want = checksum(t, top)
+		if err := top.Commit(&CommitOptions{Base: 2}); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if checksum(t, top) != want {
+			t.Errorf("%s: the image reads differently after committing", format)
+		}
+		top.Close()
+
+		var base *Image
+		if format == "raw" {
+			base = backedImage(t, filepath.Join(dir, "check.qcow2"), size, "base.raw", "raw")
+		} else if base, err = Open(baseName); err != nil {
+			t.Fatal(err)
+		} else {
+			defer base.Close()
+			verifyRefcounts(t, base)
+		}
+		if checksum(t, base) != want {
+			t.Errorf("%s: the base does not read as the image", format)
+		}
+	}
+}
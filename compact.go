@@ -0,0 +1,237 @@
+package qcow2
+
+import (
+	"errors"
+)
+
+// ErrNeedsRepair is returned by operations refusing to run on an image that
+// is marked dirty or corrupt
+var ErrNeedsRepair = errors.New("qcow2: image is marked dirty or corrupt, and needs repairing first")
+
+// tableRef is an L2 table of the image, wherever it currently is
+type tableRef struct {
+	off int64
+	// l1 are the host offsets of the L1 entries pointing to the table
+	l1 []int64
+}
+
+// entryRef is an L2 entry pointing to a data cluster
+type entryRef struct {
+	table *tableRef
+	index int64
+}
+
+// Compact moves data clusters and L2 tables from the end of the file into
+// the free clusters before them, then truncates the file, returning the
+// number of bytes reclaimed. Every cluster is copied and flushed before the
+// tables are pointed to the copy, which is flushed before the old cluster is
+// freed, so that a crash leaves at worst a leaked cluster. Other metadata and
+// compressed clusters are not moved, so the file only shrinks down to the
+// last of them. Whatever follows the last cluster in use is truncated, like by
+// TruncateTrailing.
+func (img *Image) Compact() (int64, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return 0, ErrReadOnly
+	}
+	if img.Header.IncompatibleFeatures&(IncompatDirty|IncompatCorrupt) != 0 {
+		return 0, ErrNeedsRepair
+	}
+	if img.crypt != nil {
+		// LUKS encrypts the data by its host offset, which moving changes
+		return 0, ErrEncrypted
+	}
+	tables, data, err := img.movableClusters()
+	if err != nil {
+		return 0, err
+	}
+
+	fi, err := img.fh.Stat()
+	if err != nil {
+		return 0, err
+	}
+	before := fi.Size()
+	buf := make([]byte, img.clusterSize)
+	free, last := img.nextFree(img.clusterSize), img.lastUsed(img.end)
+	for free >= 0 && last > free {
+		t, isTable := tables[last]
+		refs, isData := data[last]
+		if !isTable && !isData {
+			break
+		}
+		rc, err := img.refcount(last)
+		if err != nil {
+			return 0, err
+		}
+		// copy
+		if _, err := img.fh.ReadAt(buf, last); err != nil {
+			return 0, err
+		}
+		if _, err := img.fh.WriteAt(buf, free); err != nil {
+			return 0, err
+		}
+		if err := img.setRefcount(free, rc); err != nil {
+			return 0, err
+		}
+		if err := img.fh.Sync(); err != nil {
+			return 0, err
+		}
+		// repoint
+		if isTable {
+			for _, e := range t.l1 {
+				if err := img.moveEntry(e, free); err != nil {
+					return 0, err
+				}
+			}
+			t.off = free
+			delete(tables, last)
+			tables[free] = t
+		} else {
+			for _, r := range refs {
+				if err := img.moveEntry(r.table.off+r.index*8, free); err != nil {
+					return 0, err
+				}
+			}
+			delete(data, last)
+			data[free] = refs
+		}
+		if err := img.fh.Sync(); err != nil {
+			return 0, err
+		}
+		// free
+		if err := img.setRefcount(last, 0); err != nil {
+			return 0, err
+		}
+		free, last = img.nextFree(free+img.clusterSize), img.lastUsed(last)
+	}
+	return img.truncateAfter(last, before)
+}
+
+// TruncateTrailing truncates the file after the last cluster in use, by a
+// refcount, without moving anything, and returns the number of bytes
+// reclaimed. That removes the data tools may have left past the end of the
+// image, which Check reports.
+func (img *Image) TruncateTrailing() (int64, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return 0, ErrReadOnly
+	}
+	if img.Header.IncompatibleFeatures&(IncompatDirty|IncompatCorrupt) != 0 {
+		return 0, ErrNeedsRepair
+	}
+	fi, err := img.fh.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return img.truncateAfter(img.lastUsed(img.end), fi.Size())
+}
+
+// truncateAfter truncates the file of before bytes after the cluster at
+// last, and returns the number of bytes reclaimed
+func (img *Image) truncateAfter(last, before int64) (int64, error) {
+	if last < 0 {
+		return 0, errors.New("qcow2: no cluster in use")
+	}
+	img.end = last + img.clusterSize
+	img.freeHint, img.compressedNext = 0, 0
+	if err := img.fh.Truncate(img.end); err != nil {
+		return 0, err
+	}
+	return max(0, before-img.end), img.fh.Sync()
+}
+
+// movableClusters indexes the L2 tables of the image, and the uncompressed
+// data clusters with the L2 entries pointing to them
+func (img *Image) movableClusters() (map[int64]*tableRef, map[int64][]entryRef, error) {
+	tables := map[int64]*tableRef{}
+	data := map[int64][]entryRef{}
+	l1Offsets := []int64{img.Header.L1TableOffset}
+	for _, s := range img.snapshots {
+		l1Offsets = append(l1Offsets, s.L1TableOffset)
+	}
+	l1Tables, err := img.l1Tables()
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, entries := range l1Tables {
+		l1off := l1Offsets[k]
+		for i, e := range entries {
+			l2off := int64(e & entryOffsetMask)
+			if l2off == 0 {
+				continue
+			}
+			if t, ok := tables[l2off]; ok {
+				t.l1 = append(t.l1, l1off+int64(i)*8)
+				continue
+			}
+			t := &tableRef{off: l2off, l1: []int64{l1off + int64(i)*8}}
+			tables[l2off] = t
+			l2, err := img.readTable(l2off, int(img.l2Entries))
+			if err != nil {
+				return nil, nil, err
+			}
+			for j, entry := range l2 {
+				if img.classify(entry) == clusterCompressed {
+					continue
+				}
+				if host := int64(entry & entryOffsetMask); host != 0 {
+					data[host] = append(data[host], entryRef{t, int64(j)})
+				}
+			}
+		}
+	}
+	// a cluster that also holds compressed data stays where it is
+	for _, l2 := range tables {
+		entries, err := img.readTable(l2.off, int(img.l2Entries))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, entry := range entries {
+			if img.classify(entry) != clusterCompressed {
+				continue
+			}
+			off, size := img.compressedRange(entry)
+			for c := off &^ (img.clusterSize - 1); c < off+size; c += img.clusterSize {
+				delete(data, c)
+			}
+		}
+	}
+	return tables, data, nil
+}
+
+// moveEntry points the L1 or L2 entry at host offset off to the cluster at
+// to, keeping its flags
+func (img *Image) moveEntry(off, to int64) error {
+	e, err := img.readEntry(off)
+	if err != nil {
+		return err
+	}
+	e = e&^entryOffsetMask | uint64(to)
+	if l1i := (off - img.Header.L1TableOffset) / 8; off >= img.Header.L1TableOffset && l1i < int64(len(img.l1)) {
+		img.l1[l1i] = e
+	}
+	return img.writeEntry(off, e)
+}
+
+// nextFree is the first free cluster at or after off, or -1 when there is
+// none before the end of the file
+func (img *Image) nextFree(off int64) int64 {
+	for c := off; c < img.end; c += img.clusterSize {
+		if rc, err := img.refcount(c); err == nil && rc == 0 {
+			return c
+		}
+	}
+	return -1
+}
+
+// lastUsed is the last cluster in use before off, or -1 when there is none
+func (img *Image) lastUsed(off int64) int64 {
+	for c := off - img.clusterSize; c >= 0; c -= img.clusterSize {
+		if rc, err := img.refcount(c); err != nil || rc != 0 {
+			return c
+		}
+	}
+	return -1
+}
@@ -0,0 +1,78 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "img.qcow2")
+	img, err := Create(name, 8<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if _, err := img.WriteAt(bytes.Repeat([]byte("early"), 400000), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.CreateSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	snap := checksum(t, img)
+	// copies of the snapshot clusters go to the end, in L2 tables of their own
+	if _, err := img.WriteAt(bytes.Repeat([]byte("late"), 10000), 7<<20); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte("cow"), 10000), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte("last"), 10000), 6<<20); err != nil {
+		t.Fatal(err)
+	}
+	// and free what the snapshot does not hold on to
+	if err := img.writeZeroes(7<<20, 40000); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.writeZeroes(1<<20, 30000); err != nil {
+		t.Fatal(err)
+	}
+	want := checksum(t, img)
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reclaimed, err := img.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the 9 clusters of zeros at 7 MiB, and the 7 copied at 1 MiB
+	if reclaimed != 16*4096 || after.Size() != fi.Size()-reclaimed {
+		t.Errorf("reclaimed %d bytes, from %d to %d bytes", reclaimed, fi.Size(), after.Size())
+	}
+	verifyRefcounts(t, img)
+	if checksum(t, img) != want {
+		t.Error("compacting changed the contents")
+	}
+	img = reopen(t, img)
+	if checksum(t, img) != want {
+		t.Error("compacting changed the contents as stored")
+	}
+	if err := img.ApplySnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	if checksum(t, img) != snap {
+		t.Error("compacting changed the snapshot")
+	}
+
+	img.Header.IncompatibleFeatures |= IncompatDirty
+	if _, err := img.Compact(); err != ErrNeedsRepair {
+		t.Errorf("expected ErrNeedsRepair for a dirty image, got %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package qcow2
+
+import "bytes"
+
+// DiffResult is the outcome of comparing the contents of two images
+type DiffResult struct {
+	// Identical is set when the guest visible contents are the same
+	Identical bool
+	// SizeMismatch is set when the virtual sizes differ, unless trailing
+	// zeros are tolerated. The contents are not compared then.
+	SizeMismatch bool
+	// FirstDifference is the guest offset of the first differing byte, or -1
+	FirstDifference int64
+	// DifferingBytes is the number of differing bytes, counted when asked
+	// for with CompareCountDiffering. Otherwise it is at most 1.
+	DifferingBytes int64
+	// AllocationMismatches are the ranges the images map differently, found
+	// with CompareStrict whatever the contents
+	AllocationMismatches []AllocationMismatch
+}
+
+// AllocationMismatch is a range of the guest disk that two images map
+// differently: as different types of extent, or with one image storing what
+// the other leaves to its backing file
+type AllocationMismatch struct {
+	Start  int64
+	Length int64
+	// A and B are the extents of each image, limited to the range
+	A, B Extent
+}
+
+// sameAllocation reports whether two extents map their range the same way.
+// Unallocated ranges are the same whether or not there is a backing file.
+func sameAllocation(x, y Extent) bool {
+	return x.Type == y.Type && (x.Type == ExtentUnallocated || (x.Depth == 0) == (y.Depth == 0))
+}
+
+// CompareOption configures Compare
+type CompareOption func(*compareOptions)
+
+type compareOptions struct {
+	trailingZeros bool
+	count         bool
+	strict        bool
+}
+
+// CompareTrailingZeros compares images of different virtual sizes, which are
+// identical when the part of the larger past the end of the smaller reads as
+// zeros, like qemu-img compare does without -s
+func CompareTrailingZeros() CompareOption {
+	return func(o *compareOptions) {
+		o.trailingZeros = true
+	}
+}
+
+// CompareCountDiffering reads the images to the end, counting all differing
+// bytes rather than stopping at the first
+func CompareCountDiffering() CompareOption {
+	return func(o *compareOptions) {
+		o.count = true
+	}
+}
+
+// CompareStrict also compares how the images map their contents, reporting
+// the ranges they allocate differently, such as zeros written out in one and
+// unallocated in the other, or data compressed only in one
+func CompareStrict() CompareOption {
+	return func(o *compareOptions) {
+		o.strict = true
+	}
+}
+
+// Compare compares the guest visible contents of two images, read through
+// their backing chains. Ranges that both images know to read as zeros are
+// skipped without reading them, so unallocated and zero clusters compare
+// equal to each other.
+func Compare(a, b *Image, opts ...CompareOption) (DiffResult, error) {
+	var o compareOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	res := DiffResult{FirstDifference: -1}
+	if a.Size() != b.Size() && !o.trailingZeros {
+		res.SizeMismatch = true
+		return res, nil
+	}
+	size := max(a.Size(), b.Size())
+	ea, err := comparedExtents(a, size)
+	if err != nil {
+		return res, err
+	}
+	eb, err := comparedExtents(b, size)
+	if err != nil {
+		return res, err
+	}
+
+	if o.strict {
+		res.AllocationMismatches = allocationMismatches(ea, eb)
+	}
+
+	zero := make([]byte, convertChunk)
+	bufA, bufB := make([]byte, convertChunk), make([]byte, convertChunk)
+	for off := int64(0); off < size; {
+		x, y := ea[0], eb[0]
+		end := min(x.Start+x.Length, y.Start+y.Length)
+		for off < end && !(x.ReadsAsZeros() && y.ReadsAsZeros()) {
+			n := min(convertChunk, end-off)
+			pa, pb := zero[:n], zero[:n]
+			if !x.ReadsAsZeros() {
+				pa = bufA[:n]
+				if _, err := a.ReadAt(pa, off); err != nil {
+					return res, err
+				}
+			}
+			if !y.ReadsAsZeros() {
+				pb = bufB[:n]
+				if _, err := b.ReadAt(pb, off); err != nil {
+					return res, err
+				}
+			}
+			if !bytes.Equal(pa, pb) {
+				for i := range pa {
+					if pa[i] == pb[i] {
+						continue
+					}
+					if res.FirstDifference < 0 {
+						res.FirstDifference = off + int64(i)
+					}
+					res.DifferingBytes++
+					if !o.count {
+						return res, nil
+					}
+				}
+			}
+			off += n
+		}
+		off = end
+		if x.Start+x.Length == end {
+			ea = ea[1:]
+		}
+		if y.Start+y.Length == end {
+			eb = eb[1:]
+		}
+	}
+	res.Identical = res.FirstDifference < 0
+	return res, nil
+}
+
+// allocationMismatches walks the extents of two images covering the same
+// range in lockstep, collecting where they are allocated differently
+func allocationMismatches(ea, eb []Extent) []AllocationMismatch {
+	var mismatches []AllocationMismatch
+	for len(ea) > 0 && len(eb) > 0 {
+		x, y := ea[0], eb[0]
+		start := max(x.Start, y.Start)
+		end := min(x.Start+x.Length, y.Start+y.Length)
+		if !sameAllocation(x, y) {
+			n := len(mismatches)
+			if n > 0 && mismatches[n-1].Start+mismatches[n-1].Length == start &&
+				sameAllocation(mismatches[n-1].A, x) && sameAllocation(mismatches[n-1].B, y) {
+				mismatches[n-1].Length += end - start
+				mismatches[n-1].A.Length += end - start
+				mismatches[n-1].B.Length += end - start
+			} else {
+				mismatches = append(mismatches, AllocationMismatch{
+					Start:  start,
+					Length: end - start,
+					A:      clipExtent(x, start, end),
+					B:      clipExtent(y, start, end),
+				})
+			}
+		}
+		if x.Start+x.Length == end {
+			ea = ea[1:]
+		}
+		if y.Start+y.Length == end {
+			eb = eb[1:]
+		}
+	}
+	return mismatches
+}
+
+// clipExtent limits e to [start, end)
+func clipExtent(e Extent, start, end int64) Extent {
+	if e.Type == ExtentData {
+		e.HostOffset += start - e.Start
+	}
+	e.Start, e.Length = start, end-start
+	return e
+}
+
+// comparedExtents lists the extents of the image, extended to size with an
+// unallocated range when the image is smaller
+func comparedExtents(img *Image, size int64) ([]Extent, error) {
+	var extents []Extent
+	err := img.WalkExtents(0, img.Size(), func(e Extent) error {
+		extents = append(extents, e)
+		return nil
+	})
+	if img.Size() < size {
+		extents = append(extents, Extent{Start: img.Size(), Length: size - img.Size(), Type: ExtentUnallocated})
+	}
+	return extents, err
+}
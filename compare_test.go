@@ -0,0 +1,115 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	dir := t.TempDir()
+	create := func(name string, size int64) *Image {
+		img, err := Create(filepath.Join(dir, name), size, &CreateOptions{ClusterSize: 4096})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { img.Close() })
+		return img
+	}
+	data := bytes.Repeat([]byte("compare"), 3000)
+	a := create("a.qcow2", 4<<20)
+	b := create("b.qcow2", 4<<20)
+	for _, img := range []*Image{a, b} {
+		if _, err := img.WriteAt(data, 1<<20+3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// allocated zeros compare equal to unallocated clusters
+	if _, err := b.WriteAt(make([]byte, 10000), 2<<20); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Identical || res.FirstDifference != -1 || res.AllocationMismatches != nil {
+		t.Errorf("expected identical images, got %+v", res)
+	}
+	// but not in strict mode
+	res, err = Compare(a, b, CompareStrict())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := res.AllocationMismatches; !res.Identical || len(m) != 1 || m[0].Start != 2<<20 || m[0].Length != 3*4096 ||
+		m[0].A.Type != ExtentUnallocated || m[0].B.Type != ExtentData {
+		t.Errorf("expected the zeros written to be reported, got %+v", res)
+	}
+
+	// as do compressed clusters to the data they hold
+	raw := filepath.Join(dir, "a.raw")
+	if err := a.ConvertToRaw(raw, nil); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := ConvertRawToQcow2(f, a.Size(), filepath.Join(dir, "c.qcow2"), &ConvertOptions{CreateOptions: CreateOptions{ClusterSize: 4096}, Compress: true}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Open(filepath.Join(dir, "c.qcow2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if res, err := Compare(a, c); err != nil || !res.Identical {
+		t.Errorf("expected the compressed copy to be identical, got %+v: %v", res, err)
+	}
+	res, err = Compare(a, c, CompareStrict())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := res.AllocationMismatches; len(m) != 1 || m[0].Start != 1<<20 || m[0].A.Type != ExtentData || m[0].B.Type != ExtentCompressed {
+		t.Errorf("expected the compressed clusters to be reported, got %+v", res)
+	}
+
+	if _, err := b.WriteAt([]byte{1, 2, 3}, 2<<20+100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.WriteAt([]byte("x"), 1<<20+10); err != nil {
+		t.Fatal(err)
+	}
+	res, err = Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Identical || res.FirstDifference != 1<<20+10 || res.DifferingBytes != 1 {
+		t.Errorf("expected the first difference at %d, got %+v", 1<<20+10, res)
+	}
+	res, err = Compare(a, b, CompareCountDiffering())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.FirstDifference != 1<<20+10 || res.DifferingBytes != 4 {
+		t.Errorf("expected 4 differing bytes, got %+v", res)
+	}
+
+	big := create("big.qcow2", 5<<20)
+	if _, err := big.WriteAt(data, 1<<20+3); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := Compare(a, big); err != nil || res.Identical || !res.SizeMismatch {
+		t.Errorf("expected a size mismatch, got %+v: %v", res, err)
+	}
+	if res, err := Compare(a, big, CompareTrailingZeros()); err != nil || !res.Identical {
+		t.Errorf("expected trailing zeros to be tolerated, got %+v: %v", res, err)
+	}
+	if _, err := big.WriteAt([]byte{1}, 5<<20-1); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := Compare(big, a, CompareTrailingZeros()); err != nil || res.FirstDifference != 5<<20-1 {
+		t.Errorf("expected a difference in the trailing data, got %+v: %v", res, err)
+	}
+}
@@ -0,0 +1,108 @@
+package qcow2
+
+import "fmt"
+
+// compressionTypes are the compressions of clusters this package reads and
+// writes, by the names of qemu
+var compressionTypes = []string{"zlib"}
+
+// compressWindow is the deflate window qemu decompresses clusters with
+const compressWindow = 4096
+
+// compressCluster deflates a full cluster the way qemu expects it, with no
+// back references further than compressWindow. It returns false when the
+// result would not be smaller than the cluster.
+func compressCluster(p []byte) ([]byte, bool) {
+	z := deflate(p, compressWindow)
+	return z, len(z) < len(p)
+}
+
+// WriteCompressedAt stores the full cluster p at the cluster aligned guest
+// offset off as a compressed cluster, or as a normal one when p does not
+// compress. The last cluster of the disk may be short of a full cluster.
+func (img *Image) WriteCompressedAt(p []byte, off int64) (int, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return 0, ErrReadOnly
+	}
+	if img.Header.CryptMethod != 0 {
+		return 0, ErrEncrypted
+	}
+	if off&(img.clusterSize-1) != 0 {
+		return 0, fmt.Errorf("qcow2: compressed write at %d is not cluster aligned", off)
+	}
+	if want := min(img.clusterSize, img.Header.Size-off); off < 0 || int64(len(p)) != want {
+		return 0, fmt.Errorf("qcow2: compressed write of %d bytes at %d is not a whole cluster", len(p), off)
+	}
+	if err := img.trackWrite(off, int64(len(p))); err != nil {
+		return 0, err
+	}
+	cluster := p
+	if int64(len(p)) < img.clusterSize {
+		cluster = make([]byte, img.clusterSize)
+		copy(cluster, p)
+	}
+	z, ok := compressCluster(cluster)
+	if !ok {
+		if err := img.writeGuest(p, off); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if err := img.storeCompressed(z, off); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// storeCompressed maps the cluster at guest offset off to the compressed data z
+func (img *Image) storeCompressed(z []byte, off int64) error {
+	entryOff, err := img.l2ForWrite(off)
+	if err != nil {
+		return err
+	}
+	old, err := img.readEntry(entryOff)
+	if err != nil {
+		return err
+	}
+	host, err := img.allocBytes(int64(len(z)))
+	if err != nil {
+		return err
+	}
+	if _, err := img.fh.WriteAt(z, host); err != nil {
+		return err
+	}
+	x := 62 - (img.clusterBits - 8)
+	sectors := uint64((host+int64(len(z))-1)>>9 - host>>9)
+	if err := img.writeEntry(entryOff, flagCompressed|sectors<<x|uint64(host)); err != nil {
+		return err
+	}
+	return img.releaseEntry(old)
+}
+
+// allocBytes finds room for size bytes of compressed data, packing it after
+// the previous compressed cluster when it fits in the rest of its host
+// cluster and its refcount can take another reference. Every host cluster
+// holding some of the data takes a reference.
+func (img *Image) allocBytes(size int64) (int64, error) {
+	if next := img.compressedNext; next&(img.clusterSize-1) != 0 && next&(img.clusterSize-1)+size <= img.clusterSize {
+		rc, err := img.refcount(next)
+		if err != nil {
+			return 0, err
+		}
+		if rc < img.refcountMax() {
+			if err := img.updateRefcount(next, size, 1); err != nil {
+				return 0, err
+			}
+			img.compressedNext += size
+			return next, nil
+		}
+	}
+	off, err := img.allocClusters((size + img.clusterSize - 1) / img.clusterSize)
+	if err != nil {
+		return 0, err
+	}
+	img.compressedNext = off + size
+	return off, nil
+}
@@ -0,0 +1,159 @@
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConvertCompressed(t *testing.T) {
+	src := tempImage(t)
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain.qcow2")
+	if err := ConvertRawToQcow2(src, src.Size(), plain, nil); err != nil {
+		t.Fatal(err)
+	}
+	packed := filepath.Join(dir, "packed.qcow2")
+	if err := ConvertRawToQcow2(src, src.Size(), packed, &ConvertOptions{Compress: true}); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Open(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	verifyRefcounts(t, img)
+	if checksum(t, img) != checksum(t, src) {
+		t.Error("compressed image contents differ from the source")
+	}
+	var compressed int64
+	if err := img.WalkExtents(0, img.Size(), func(e Extent) error {
+		if e.Type == ExtentCompressed {
+			compressed += e.Length
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if compressed == 0 {
+		t.Error("expected compressed clusters")
+	}
+	a, err := os.Stat(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Size() >= a.Size() {
+		t.Errorf("compressed image of %d bytes is not smaller than %d", b.Size(), a.Size())
+	}
+
+	if err := ConvertRawToQcow2(src, src.Size(), filepath.Join(dir, "zstd.qcow2"), &ConvertOptions{Compress: true, CompressionType: "zstd"}); err == nil {
+		t.Error("expected zstd to be refused")
+	}
+}
+
+func TestConvertJobs(t *testing.T) {
+	src := tempImage(t)
+	dir := t.TempDir()
+	var sums [][32]byte
+	for _, jobs := range []int{1, 4} {
+		out := filepath.Join(dir, "out.qcow2")
+		if err := ConvertRawToQcow2(src, src.Size(), out, &ConvertOptions{Compress: true, Jobs: jobs}); err != nil {
+			t.Fatal(err)
+		}
+		sums = append(sums, fileChecksum(t, out))
+	}
+	if sums[0] != sums[1] {
+		t.Error("the output depends on the number of jobs")
+	}
+
+	// a failing read removes the partial output
+	out := filepath.Join(dir, "failed.qcow2")
+	err := ConvertRawToQcow2(failingReader{src, 50 << 20}, src.Size(), out, &ConvertOptions{Jobs: 4})
+	if err == nil {
+		t.Fatal("expected the read error")
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("expected the output to be removed, got %v", err)
+	}
+}
+
+// failingReader fails reads beyond an offset
+type failingReader struct {
+	io.ReaderAt
+	limit int64
+}
+
+func (r failingReader) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > r.limit {
+		return 0, errors.New("read failed")
+	}
+	return r.ReaderAt.ReadAt(p, off)
+}
+
+func BenchmarkConvertCompressedSource(b *testing.B) {
+	// a compressed copy of the fixture is the source, so reading it is work
+	src := tempImage(b)
+	dir := b.TempDir()
+	packed := filepath.Join(dir, "packed.qcow2")
+	if err := ConvertRawToQcow2(src, src.Size(), packed, &ConvertOptions{Compress: true}); err != nil {
+		b.Fatal(err)
+	}
+	img, err := Open(packed)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer img.Close()
+	for _, jobs := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := img.ConvertToRaw(filepath.Join(dir, "out.raw"), &ConvertOptions{Jobs: jobs}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteCompressedAt(t *testing.T) {
+	img := tempImage(t)
+	cs := img.clusterSize
+	text := bytes.Repeat([]byte("compressible "), int(cs)/13+1)[:cs]
+	off := unallocatedOffset(t, img)
+	// a fresh cluster, then overwriting it, then one that packs in after it
+	for _, o := range []int64{off, off, off + cs} {
+		if _, err := img.WriteCompressedAt(text, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entry, _, err := img.l2Entry(img.l1, img.Header.L1TableOffset, off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.classify(entry) != clusterCompressed {
+		t.Errorf("expected a compressed cluster, got entry %#x", entry)
+	}
+	got := make([]byte, 2*cs)
+	if _, err := img.ReadAt(got, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:cs], text) || !bytes.Equal(got[cs:], text) {
+		t.Error("read back different data")
+	}
+	// writing into a compressed cluster turns it into a normal one
+	if _, err := img.WriteAt([]byte("x"), off+10); err != nil {
+		t.Fatal(err)
+	}
+	verifyRefcounts(t, img)
+
+	if _, err := img.WriteCompressedAt(text, off+1); err == nil {
+		t.Error("expected an error for an unaligned compressed write")
+	}
+}
@@ -0,0 +1,623 @@
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+)
+
+// sparseBlock is the granularity at which runs of zeros in data are skipped
+// rather than written, like the default of `qemu-img convert -S`
+const sparseBlock = 4096
+
+// convertChunk is the most read from the image at once
+const convertChunk = 1 << 20
+
+// serialLimit is the size below which conversions do not bother with workers
+const serialLimit = 8 * convertChunk
+
+// ConvertOptions are the parameters of a conversion.
+//
+// Conversions read the data of their input once, in guest order. Before that
+// they look up where the data is, which reads the metadata of an image input
+// or asks the file system for the holes of a raw file, but no data. Memory
+// use does not grow with the size of the disk: each worker holds a chunk of
+// 1 MiB, or a cluster when clusters are larger, along with its compressed
+// clusters, and at most twice as many chunks wait to be written as there are
+// workers. The L2 tables of the output are written in place as they fill, so
+// beyond the chunks only the L1 table and the refcount blocks touched, which
+// take 2 bytes per output cluster with the default refcount width, are kept.
+// With Dedupe, the hash of every distinct cluster stored is kept as well.
+type ConvertOptions struct {
+	// CreateOptions apply to qcow2 output
+	CreateOptions
+
+	// Compress stores the data clusters compressed, except for those that
+	// do not get any smaller
+	Compress bool
+	// KeepCompressed compresses, when flattening an image, the clusters that
+	// are compressed in the image
+	KeepCompressed bool
+
+	// Dedupe stores identical data clusters once, with the L2 entries of the
+	// copies referencing the cluster stored first. Clusters are matched by
+	// SHA-256 and then compared in full.
+	Dedupe bool
+	// Deduplicated is set by the conversion to the number of clusters that
+	// Dedupe found to be copies, and did not store again
+	Deduplicated int64
+	// CompressionType is the compression of the clusters. Only "zlib", the
+	// default, is supported.
+	CompressionType string
+
+	// Jobs is the number of chunks read and compressed in parallel,
+	// GOMAXPROCS when zero. The output is the same for any number of jobs.
+	Jobs int
+
+	// RateLimiter limits the I/O of the output and of raw input. An Image
+	// given as input is limited by the options it was opened with, so that
+	// it counts the bytes read from its file rather than those decompressed.
+	RateLimiter *RateLimiter
+
+	// Progress is told how many bytes have been copied, out of the data found
+	// in the input, or of the virtual size when reading a stream
+	Progress ProgressFunc
+
+	// Logger is that of the output image, as given WithLogger
+	Logger *slog.Logger
+}
+
+func (o *ConvertOptions) progress(total int64) *progress {
+	if o == nil {
+		return nil
+	}
+	return newProgress(o.Progress, total)
+}
+
+func (o *ConvertOptions) limiter() *RateLimiter {
+	if o == nil {
+		return nil
+	}
+	return o.RateLimiter
+}
+
+func (o *ConvertOptions) workers(size int64) int {
+	if o == nil || size < serialLimit {
+		return 1
+	}
+	return workers(o.Jobs)
+}
+
+// create makes the output image of a conversion
+func (o *ConvertOptions) create(dst string, size int64) (*Image, error) {
+	if o == nil {
+		o = &ConvertOptions{}
+	}
+	if o.CompressionType != "" && !slices.Contains(compressionTypes, o.CompressionType) {
+		return nil, fmt.Errorf("qcow2: unsupported compression type %q", o.CompressionType)
+	}
+	return Create(dst, size, &o.CreateOptions, WithRateLimiter(o.RateLimiter), WithLogger(o.Logger))
+}
+
+// convertRange is a range of the disk copied by a conversion
+type convertRange struct {
+	off, n int64
+	// data holds the contents, for input that cannot be read at random
+	data []byte
+	// compress stores the clusters of the range compressed
+	compress bool
+	// zero makes the whole clusters of the range zero clusters, without
+	// reading anything
+	zero bool
+}
+
+// ConvertToRaw writes the guest visible contents of the image, flattened
+// through its backing chain, to a new raw file. Only data is written: zero
+// and unallocated ranges, and blocks of data that are all zeros, are left as
+// holes of the sparse output file. Of opts, the CreateOptions and
+// compression do not apply. On failure the output file is removed.
+func (img *Image) ConvertToRaw(name string, opts *ConvertOptions) error {
+	return img.ConvertRangeToRaw(name, 0, img.Size(), opts)
+}
+
+// ConvertRangeToRaw is ConvertToRaw of the length bytes of the guest disk
+// at off alone, like a partition, which start the raw file
+func (img *Image) ConvertRangeToRaw(name string, off, length int64, opts *ConvertOptions) error {
+	if off < 0 || length < 0 || off > img.Size() || length > img.Size()-off {
+		return fmt.Errorf("qcow2: range of %d bytes at %d is beyond the virtual size %d", length, off, img.Size())
+	}
+	out, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := img.writeSparse(out, off, length, opts); err != nil {
+		out.Close()
+		os.Remove(name)
+		return err
+	}
+	return out.Close()
+}
+
+// writeSparse writes the data of the n bytes of the image at off into the
+// empty file out, from its start, then extends it to n bytes
+func (img *Image) writeSparse(out *os.File, off, n int64, opts *ConvertOptions) error {
+	jobs := func() func() (convertRange, bool, error) {
+		next := img.extentsIn(off, off+n)
+		return chunkJobs(func() (convertRange, bool, error) {
+			for {
+				e, ok, err := next()
+				if err != nil || !ok {
+					return convertRange{}, ok, err
+				}
+				if !e.ReadsAsZeros() {
+					return convertRange{off: e.Start, n: e.Length}, true, nil
+				}
+			}
+		}, convertChunk)
+	}
+	total, err := countJobs(jobs())
+	if err != nil {
+		return err
+	}
+	prog := opts.progress(total)
+	w := &hostFile{storage: out, limiter: opts.limiter()}
+	type chunk struct {
+		off int64
+		p   []byte
+	}
+	err = runOrdered(context.Background(), opts.workers(n), jobs(),
+		func(_ context.Context, r convertRange) (chunk, error) {
+			p := make([]byte, r.n)
+			_, err := img.ReadAt(p, r.off)
+			return chunk{r.off, p}, err
+		},
+		func(c chunk) error {
+			if err := writeNonZero(w, c.p, c.off-off, img.opts.maxIO()); err != nil {
+				return err
+			}
+			prog.add(int64(len(c.p)))
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	if err := out.Truncate(n); err != nil {
+		return err
+	}
+	prog.finish()
+	return nil
+}
+
+// extentWindow is how much of the disk extents are looked up for at once
+const extentWindow = 1 << 30
+
+// extents returns the extents of the image one at a time and in order. They
+// are looked up a window of the disk at a time, so that only the extents of
+// one window are held in memory, and do not span windows.
+func (img *Image) extents() func() (Extent, bool, error) {
+	return img.extentsIn(0, img.Size())
+}
+
+// extentsIn is extents of the range [off, end) of the disk alone
+func (img *Image) extentsIn(off, end int64) func() (Extent, bool, error) {
+	var buf []Extent
+	return func() (Extent, bool, error) {
+		for len(buf) == 0 {
+			if off >= end {
+				return Extent{}, false, nil
+			}
+			n := min(extentWindow, end-off)
+			if err := img.WalkExtents(off, n, func(e Extent) error {
+				buf = append(buf, e)
+				return nil
+			}); err != nil {
+				return Extent{}, false, err
+			}
+			off += n
+		}
+		e := buf[0]
+		if buf = buf[1:]; len(buf) == 0 {
+			buf = nil
+		}
+		return e, true, nil
+	}
+}
+
+// chunkJobs splits the ranges produced by next into ranges of at most n bytes
+func chunkJobs(next func() (convertRange, bool, error), n int64) func() (convertRange, bool, error) {
+	var cur convertRange
+	return func() (convertRange, bool, error) {
+		for cur.n == 0 {
+			var ok bool
+			var err error
+			if cur, ok, err = next(); err != nil || !ok {
+				return convertRange{}, ok, err
+			}
+		}
+		r := cur
+		r.n = min(cur.n, n)
+		cur.off, cur.n = cur.off+r.n, cur.n-r.n
+		return r, true, nil
+	}
+}
+
+// countJobs adds up the bytes of the ranges of data produced by next
+func countJobs(next func() (convertRange, bool, error)) (int64, error) {
+	var total int64
+	for {
+		r, ok, err := next()
+		if err != nil || !ok {
+			return total, err
+		}
+		if !r.zero {
+			total += r.n
+		}
+	}
+}
+
+// sliceJobs produces the jobs of runOrdered from a slice
+func sliceJobs[J any](jobs []J) func() (J, bool, error) {
+	return func() (J, bool, error) {
+		var j J
+		if len(jobs) == 0 {
+			return j, false, nil
+		}
+		j, jobs = jobs[0], jobs[1:]
+		return j, true, nil
+	}
+}
+
+// writeNonZero writes p to w at off, skipping the blocks that are all zeros,
+// with one write for each run of the others of up to maxIO bytes
+func writeNonZero(w io.WriterAt, p []byte, off, maxIO int64) error {
+	zero := make([]byte, sparseBlock)
+	// run is how many bytes of data from the start of p are yet to be written
+	run := 0
+	flush := func() error {
+		if run > 0 {
+			if _, err := w.WriteAt(p[:run], off); err != nil {
+				return err
+			}
+		}
+		p, off, run = p[run:], off+int64(run), 0
+		return nil
+	}
+	for run < len(p) {
+		n := min(len(p)-run, sparseBlock)
+		if bytes.Equal(p[run:run+n], zero[:n]) {
+			if err := flush(); err != nil {
+				return err
+			}
+			p, off = p[n:], off+int64(n)
+			continue
+		}
+		if run > 0 && int64(run+n) > maxIO {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		run += n
+	}
+	return flush()
+}
+
+// ConvertRawToQcow2 creates the image dst holding the size bytes of raw disk
+// contents read from src. Clusters that are all zeros are left unallocated,
+// and when src is a file its holes are skipped without reading them. On
+// failure the output file is removed.
+func ConvertRawToQcow2(src io.ReaderAt, size int64, dst string, opts *ConvertOptions) error {
+	img, err := opts.create(dst, size)
+	if err != nil {
+		return err
+	}
+	if err := img.copyRaw(src, size, opts); err != nil {
+		img.Close()
+		os.Remove(dst)
+		return err
+	}
+	return img.Close()
+}
+
+// chunkSize is the most copied into the image at once, in whole clusters
+func (img *Image) chunkSize() int64 {
+	return max(convertChunk, img.clusterSize)
+}
+
+// copyRaw writes the clusters of src that are not all zeros into the image
+func (img *Image) copyRaw(src io.ReaderAt, size int64, opts *ConvertOptions) error {
+	data := [][2]int64{{0, size}}
+	if f, ok := src.(*os.File); ok {
+		if r, ok := dataRanges(f, size); ok {
+			data = r
+		}
+	}
+	jobs := func() func() (convertRange, bool, error) {
+		data := data
+		var prev int64
+		return chunkJobs(func() (convertRange, bool, error) {
+			for ; len(data) > 0; data = data[1:] {
+				// work in whole clusters, as that is what gets allocated
+				start := max(data[0][0]&^(img.clusterSize-1), prev)
+				end := min(img.alignUp(data[0][1]), size)
+				if start < end {
+					data, prev = data[1:], end
+					return convertRange{off: start, n: end - start}, true, nil
+				}
+			}
+			return convertRange{}, false, nil
+		}, img.chunkSize())
+	}
+	total, err := countJobs(jobs())
+	if err != nil {
+		return err
+	}
+	_, isImage := src.(*Image)
+	return img.writeRanges(jobs(), opts, opts.progress(total), func(ctx context.Context, r convertRange) ([]byte, error) {
+		if !isImage {
+			if err := opts.limiter().Wait(ctx, int(r.n)); err != nil {
+				return nil, err
+			}
+		}
+		p := make([]byte, r.n)
+		if m, err := src.ReadAt(p, r.off); err != nil && !(err == io.EOF && int64(m) == r.n) {
+			return nil, err
+		}
+		return p, nil
+	}, opts.workers(size))
+}
+
+// clusterData is a cluster to store, compressed when z is set
+type clusterData struct {
+	off int64
+	p   []byte
+	z   []byte
+	// sum is the hash of a full cluster, when deduplicating
+	sum *[sha256.Size]byte
+}
+
+// writeRanges copies the ranges produced by next into the image, reading
+// them with read. The clusters that are all zeros are left out, and the rest
+// are compressed when the options ask for it. Reading and compressing happen
+// on the workers, while storing and reporting progress happen in order.
+func (img *Image) writeRanges(next func() (convertRange, bool, error), opts *ConvertOptions, prog *progress, read func(context.Context, convertRange) ([]byte, error), workers int) error {
+	compressAll := opts != nil && opts.Compress
+	var dd *dedupe
+	if opts != nil && opts.Dedupe && img.refcountMax() > 1 {
+		dd = &dedupe{seen: map[[sha256.Size]byte]int64{}}
+	}
+	zero := make([]byte, img.clusterSize)
+	type result struct {
+		clusters []clusterData
+		n        int64
+		zero     *convertRange
+	}
+	work := func(ctx context.Context, r convertRange) (result, error) {
+		if r.zero {
+			return result{zero: &r}, nil
+		}
+		p, err := read(ctx, r)
+		if err != nil {
+			return result{}, err
+		}
+		compress := compressAll || r.compress
+		var clusters []clusterData
+		for off := r.off; len(p) > 0; {
+			c := p[:len(img.clusterChunk(p, off))]
+			p = p[len(c):]
+			if bytes.Equal(c, zero[:len(c)]) {
+				off += int64(len(c))
+				continue
+			}
+			cd := clusterData{off: off, p: c}
+			if dd != nil && int64(len(c)) == img.clusterSize {
+				sum := sha256.Sum256(c)
+				cd.sum = &sum
+			}
+			if compress {
+				if err := ctx.Err(); err != nil {
+					return result{}, err
+				}
+				full := c
+				if int64(len(c)) < img.clusterSize {
+					full = make([]byte, img.clusterSize)
+					copy(full, c)
+				}
+				if z, ok := compressCluster(full); ok {
+					cd.z = z
+				}
+			}
+			clusters = append(clusters, cd)
+			off += int64(len(c))
+		}
+		return result{clusters: clusters, n: r.n}, nil
+	}
+	err := runOrdered(context.Background(), workers, next, work, func(r result) error {
+		img.mu.Lock()
+		defer img.mu.Unlock()
+		if z := r.zero; z != nil {
+			for off := z.off; off < z.off+z.n; off += img.clusterSize {
+				if err := img.replaceEntry(off, flagZero); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		for _, c := range r.clusters {
+			if c.sum != nil {
+				if ok, err := img.storeDuplicate(c, dd); err != nil {
+					return err
+				} else if ok {
+					continue
+				}
+			}
+			var err error
+			if c.z != nil {
+				err = img.storeCompressed(c.z, c.off)
+			} else {
+				err = img.writeGuest(c.p, c.off)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		prog.add(r.n)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if dd != nil {
+		opts.Deduplicated = dd.copies
+	}
+	prog.finish()
+	return nil
+}
+
+// dedupe tracks the clusters stored by a conversion, to find copies
+type dedupe struct {
+	// seen is the guest offset of the first cluster stored with a hash
+	seen   map[[sha256.Size]byte]int64
+	copies int64
+}
+
+// storeDuplicate maps the cluster to an identical cluster stored before, the
+// two then sharing the host cluster. It reports false when there is no such
+// cluster, or when the refcount of the host cluster cannot go any higher.
+func (img *Image) storeDuplicate(c clusterData, d *dedupe) (bool, error) {
+	prior, ok := d.seen[*c.sum]
+	if !ok {
+		d.seen[*c.sum] = c.off
+		return false, nil
+	}
+	buf := make([]byte, img.clusterSize)
+	if err := img.readGuest(img.l1, img.Header.L1TableOffset, buf, prior); err != nil {
+		return false, err
+	}
+	if !bytes.Equal(buf, c.p) {
+		return false, nil
+	}
+	entry, entryOff, err := img.l2Entry(img.l1, img.Header.L1TableOffset, prior)
+	if err != nil {
+		return false, err
+	}
+	var host, size int64
+	switch img.classify(entry) {
+	case clusterCompressed:
+		host, size = img.compressedRange(entry)
+	case clusterNormal:
+		host, size = int64(entry&entryOffsetMask), img.clusterSize
+	default:
+		return false, nil
+	}
+	for cl := host &^ (img.clusterSize - 1); cl < host+size; cl += img.clusterSize {
+		if rc, err := img.refcount(cl); err != nil || rc >= img.refcountMax() {
+			return false, err
+		}
+	}
+	if entry&flagCopied != 0 {
+		// the cluster is no longer referenced only once
+		entry &^= flagCopied
+		if err := img.writeEntry(entryOff, entry); err != nil {
+			return false, err
+		}
+	}
+	if err := img.updateRefcount(host, size, 1); err != nil {
+		return false, err
+	}
+	target, err := img.l2ForWrite(c.off)
+	if err != nil {
+		return false, err
+	}
+	if err := img.writeEntry(target, entry); err != nil {
+		return false, err
+	}
+	d.copies++
+	return true, nil
+}
+
+// ConvertStreamToQcow2 creates the image dst of size bytes from raw disk
+// contents read sequentially from r, such as a pipe. Clusters that are all
+// zeros are left unallocated, as is everything past the end of a stream that
+// is shorter than size. A stream longer than size is an error. On failure the
+// output file is removed.
+func ConvertStreamToQcow2(r io.Reader, size int64, dst string, opts *ConvertOptions) error {
+	img, err := opts.create(dst, size)
+	if err != nil {
+		return err
+	}
+	if err := img.copyStream(r, opts); err != nil {
+		img.Close()
+		os.Remove(dst)
+		return err
+	}
+	return img.Close()
+}
+
+// copyStream writes the clusters read from r that are not all zeros into the
+// image, up to the virtual size
+func (img *Image) copyStream(r io.Reader, opts *ConvertOptions) error {
+	var off int64
+	eof := false
+	next := func() (convertRange, bool, error) {
+		if eof {
+			return convertRange{}, false, nil
+		}
+		buf := make([]byte, img.chunkSize())
+		n, err := io.ReadFull(r, buf)
+		if lerr := opts.limiter().Wait(context.Background(), n); lerr != nil {
+			return convertRange{}, false, lerr
+		}
+		if int64(n) > img.Size()-off {
+			return convertRange{}, false, fmt.Errorf("qcow2: input is larger than the virtual size of %d bytes", img.Size())
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = true
+		} else if err != nil {
+			return convertRange{}, false, err
+		}
+		cr := convertRange{off: off, n: int64(n), data: buf[:n]}
+		off += int64(n)
+		return cr, n > 0, nil
+	}
+	read := func(_ context.Context, cr convertRange) ([]byte, error) {
+		return cr.data, nil
+	}
+	return img.writeRanges(next, opts, opts.progress(img.Size()), read, opts.workers(img.Size()))
+}
+
+// WriteRawTo writes the guest visible contents of the image to w, strictly
+// sequentially and with zero and unallocated ranges as literal zeros, so that
+// w can be a pipe
+func (img *Image) WriteRawTo(w io.Writer) (int64, error) {
+	buf := make([]byte, convertChunk)
+	zero := make([]byte, convertChunk)
+	var written int64
+	err := img.WalkExtents(0, img.Size(), func(e Extent) error {
+		for off := e.Start; off < e.Start+e.Length; {
+			n := int64(len(buf))
+			if rem := e.Start + e.Length - off; rem < n {
+				n = rem
+			}
+			p := zero[:n]
+			if !e.ReadsAsZeros() {
+				p = buf[:n]
+				if _, err := img.readAtUnlocked(p, off); err != nil {
+					return err
+				}
+			}
+			m, err := w.Write(p)
+			written += int64(m)
+			if err != nil {
+				return err
+			}
+			off += n
+		}
+		return nil
+	})
+	return written, err
+}
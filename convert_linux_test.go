@@ -0,0 +1,109 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestConvertToRawSparse(t *testing.T) {
+	img := tempImage(t)
+	raw := filepath.Join(t.TempDir(), "file.raw")
+	if err := img.ConvertToRaw(raw, nil); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(img.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rfi, err := os.Stat(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the output holds no more than the data of the image, not its virtual size
+	allocated := rfi.Sys().(*syscall.Stat_t).Blocks * 512
+	if allocated > fi.Size() {
+		t.Errorf("raw file allocates %d bytes, more than the %d bytes of the image", allocated, fi.Size())
+	}
+}
+
+// peakHeap samples the heap in use until the returned function is called,
+// which reports the most seen
+func peakHeap() func() uint64 {
+	var peak uint64
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		var ms runtime.MemStats
+		for {
+			runtime.ReadMemStats(&ms)
+			peak = max(peak, ms.HeapAlloc)
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	return func() uint64 {
+		close(stop)
+		<-done
+		return peak
+	}
+}
+
+func TestConvertBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("converts a large sparse image")
+	}
+	// the conversions hold a few chunks per worker, however large the disk
+	const limit = 32 << 20
+	defer debug.SetMemoryLimit(debug.SetMemoryLimit(limit))
+	dir := t.TempDir()
+	img, err := Create(filepath.Join(dir, "sparse.qcow2"), 64<<30, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	data := bytes.Repeat([]byte("bounded"), 1<<16)
+	for off := int64(0); off < img.Size(); off += 1 << 30 {
+		if _, err := img.WriteAt(data, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := &ConvertOptions{Jobs: 4}
+
+	for _, tc := range []struct {
+		name    string
+		convert func() error
+	}{
+		{"raw", func() error {
+			return img.ConvertToRaw(filepath.Join(dir, "sparse.raw"), opts)
+		}},
+		{"flatten", func() error {
+			return img.Flatten(filepath.Join(dir, "flat.qcow2"), opts)
+		}},
+		{"raw to qcow2", func() error {
+			f, err := os.Open(filepath.Join(dir, "sparse.raw"))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return ConvertRawToQcow2(f, img.Size(), filepath.Join(dir, "back.qcow2"), opts)
+		}},
+	} {
+		runtime.GC()
+		peak := peakHeap()
+		if err := tc.convert(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := peak(); got > limit {
+			t.Errorf("%s: the heap reached %d bytes", tc.name, got)
+		}
+	}
+}
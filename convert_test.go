@@ -0,0 +1,194 @@
+package qcow2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fileChecksum hashes the contents of the named file
+func fileChecksum(t *testing.T, name string) [sha256.Size]byte {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		t.Fatal(err)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+func TestConvertToRaw(t *testing.T) {
+	img := tempImage(t)
+	raw := filepath.Join(t.TempDir(), "file.raw")
+	if err := img.ConvertToRaw(raw, nil); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != img.Size() {
+		t.Errorf("expected %d bytes, got %d", img.Size(), fi.Size())
+	}
+	if fileChecksum(t, raw) != checksum(t, img) {
+		t.Error("raw file differs from the image contents")
+	}
+}
+
+func TestConvertRangeToRaw(t *testing.T) {
+	img := tempImage(t)
+	raw := filepath.Join(t.TempDir(), "range.raw")
+	off, n := img.Size()/3+1000, img.Size()/3
+	if err := img.ConvertRangeToRaw(raw, off, n, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, n)
+	if _, err := img.ReadAt(want, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("the raw file of %d bytes differs from the range of the image", len(got))
+	}
+	if err := img.ConvertRangeToRaw(raw, off, img.Size(), nil); err == nil {
+		t.Error("converted a range past the virtual size")
+	}
+}
+
+// writeRecorder records the writes made to it, as offset and length
+type writeRecorder [][2]int64
+
+func (w *writeRecorder) WriteAt(p []byte, off int64) (int, error) {
+	*w = append(*w, [2]int64{off, int64(len(p))})
+	return len(p), nil
+}
+
+func TestWriteNonZero(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), sparseBlock)
+	zero := make([]byte, sparseBlock)
+	// blocks of data, zeros and data again, the last block short
+	p := bytes.Join([][]byte{data, data, data, zero, zero, data, data[:100]}, nil)
+	for _, c := range []struct {
+		maxIO int64
+		want  writeRecorder
+	}{
+		{1 << 20, writeRecorder{{1000, 3 * sparseBlock}, {1000 + 5*sparseBlock, sparseBlock + 100}}},
+		{2 * sparseBlock, writeRecorder{{1000, 2 * sparseBlock}, {1000 + 2*sparseBlock, sparseBlock}, {1000 + 5*sparseBlock, sparseBlock + 100}}},
+		// a size smaller than a block still writes whole blocks
+		{1, writeRecorder{{1000, sparseBlock}, {1000 + sparseBlock, sparseBlock}, {1000 + 2*sparseBlock, sparseBlock}, {1000 + 5*sparseBlock, sparseBlock}, {1000 + 6*sparseBlock, 100}}},
+	} {
+		var got writeRecorder
+		if err := writeNonZero(&got, p, 1000, c.maxIO); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("up to %d bytes: got writes %v, want %v", c.maxIO, got, c.want)
+		}
+	}
+}
+
+func TestWriteRawTo(t *testing.T) {
+	img := tempImage(t)
+	r, w := io.Pipe()
+	go func() {
+		_, err := img.WriteRawTo(w)
+		w.CloseWithError(err)
+	}()
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != img.Size() {
+		t.Errorf("expected %d bytes, got %d", img.Size(), n)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	if sum != checksum(t, img) {
+		t.Error("streamed contents differ from the image contents")
+	}
+}
+
+func TestWalkExtents(t *testing.T) {
+	img := tempImage(t)
+	var next int64
+	counts := map[ExtentType]int64{}
+	err := img.WalkExtents(0, img.Size(), func(e Extent) error {
+		if e.Start != next || e.Length <= 0 {
+			t.Fatalf("extent %+v does not follow %d", e, next)
+		}
+		next = e.Start + e.Length
+		counts[e.Type] += e.Length
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != img.Size() {
+		t.Errorf("extents end at %d, expected %d", next, img.Size())
+	}
+	if counts[ExtentData] == 0 || counts[ExtentUnallocated] == 0 {
+		t.Errorf("expected both data and unallocated extents, got %v", counts)
+	}
+
+	// unallocated clusters come from the backing file
+	base := filepath.Join(filepath.Dir(img.Name()), "base.raw")
+	if err := os.WriteFile(base, make([]byte, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.SetBackingFile("base.raw", "raw"); err != nil {
+		t.Fatal(err)
+	}
+	off := unallocatedOffset(t, img)
+	var got []Extent
+	if err := img.WalkExtents(off, img.clusterSize, func(e Extent) error {
+		got = append(got, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := Extent{Start: off, Length: img.clusterSize, Type: ExtentUnallocated, Depth: 1}
+	if off < 1<<20 {
+		want = Extent{Start: off, Length: img.clusterSize, Type: ExtentData, Depth: 1, HostOffset: off}
+	}
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestWalkExtentsConcurrentRead(t *testing.T) {
+	img := tempImage(t)
+	// the walk holds the image no more than ReadAt does, so a read from
+	// another goroutine finishes while fn waits on it
+	err := img.WalkExtents(0, img.Size(), func(e Extent) error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := img.ReadAt(make([]byte, 512), e.Start)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(5 * time.Second):
+			return errors.New("ReadAt blocked on WalkExtents")
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
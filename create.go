@@ -0,0 +1,288 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// CreateOptions are the parameters of a new image. The zero value creates a
+// version 3 image with 64 KiB clusters and 16 bit refcounts.
+type CreateOptions struct {
+	// ClusterSize is a power of two from 512 bytes to 2 MiB
+	ClusterSize int64
+	// Version is 2 or 3
+	Version Version
+	// RefcountBits is the width of refcounts, a power of two up to 64
+	RefcountBits int
+	// Preallocation is "off", "metadata" to allocate the L2 tables and data
+	// clusters, or "full" to also write zeros to the data clusters
+	Preallocation string
+	// ExtendedL2 uses L2 entries with subclusters. Measure accounts for
+	// them, but Create does not support them.
+	ExtendedL2 bool
+
+	BackingFile   string
+	BackingFormat string
+}
+
+func (o *CreateOptions) clusterBits() (int, error) {
+	if o.ClusterSize == 0 {
+		return 16, nil
+	}
+	for bits := minClusterBits; bits <= maxClusterBits; bits++ {
+		if int64(1)<<bits == o.ClusterSize {
+			return bits, nil
+		}
+	}
+	return 0, fmt.Errorf("qcow2: invalid cluster size %d", o.ClusterSize)
+}
+
+func (o *CreateOptions) refcountOrder() (int, error) {
+	if o.RefcountBits == 0 {
+		return 4, nil
+	}
+	for order := 0; order <= 6; order++ {
+		if 1<<order == o.RefcountBits {
+			return order, nil
+		}
+	}
+	return 0, fmt.Errorf("qcow2: invalid refcount width of %d bits", o.RefcountBits)
+}
+
+// layout is how Create lays out an image, and what its metadata takes
+type layout struct {
+	version     Version
+	clusterBits int
+	order       int
+	size        int64
+
+	clusterSize int64
+	l2Entries   int64
+	// refblockEntries is the number of refcounts in a refcount block
+	refblockEntries int64
+	l1Entries       int64
+	l1Clusters      int64
+	// reftableClusters is enough for the image fully allocated, so that the
+	// refcount table never moves while data is added
+	reftableClusters int64
+}
+
+// layout checks the options and plans an image of size bytes
+func (o *CreateOptions) layout(size int64) (*layout, error) {
+	if size < 0 {
+		return nil, errors.New("qcow2: negative size")
+	}
+	bits, err := o.clusterBits()
+	if err != nil {
+		return nil, err
+	}
+	order, err := o.refcountOrder()
+	if err != nil {
+		return nil, err
+	}
+	version := o.Version
+	if version == 0 {
+		version = 3
+	}
+	if !version.supported() {
+		return nil, UnsupportedVersionError{Version: version}
+	}
+	if version == 2 && order != 4 {
+		return nil, errors.New("qcow2: version 2 images only support 16 bit refcounts")
+	}
+	switch o.Preallocation {
+	case "", "off", "metadata", "full":
+	default:
+		return nil, fmt.Errorf("qcow2: unsupported preallocation mode %q", o.Preallocation)
+	}
+
+	cs := int64(1) << bits
+	l := &layout{
+		version:         version,
+		clusterBits:     bits,
+		order:           order,
+		size:            (size + 511) &^ 511,
+		clusterSize:     cs,
+		l2Entries:       cs / 8,
+		refblockEntries: cs * 8 >> order,
+	}
+	if o.ExtendedL2 {
+		// entries of 128 bits, with the subcluster bitmaps
+		l.l2Entries = cs / 16
+	}
+	l.l1Entries = ceilDiv(l.size, l.l2Entries*cs)
+	l.l1Clusters = ceilDiv(l.l1Entries*8, cs)
+
+	l.reftableClusters = 1
+	for {
+		_, refblocks := l.clusters(l.l1Entries, l.dataClusters())
+		n := max(1, ceilDiv(refblocks*8, cs))
+		if n == l.reftableClusters {
+			return l, nil
+		}
+		l.reftableClusters = n
+	}
+}
+
+// dataClusters is the number of clusters of the guest disk
+func (l *layout) dataClusters() int64 {
+	return ceilDiv(l.size, l.clusterSize)
+}
+
+// clusters counts the clusters of the image holding data in the given number
+// of L2 tables and data clusters, and the refcount blocks among them
+func (l *layout) clusters(l2Tables, data int64) (total, refblocks int64) {
+	n := 1 + l.reftableClusters + l.l1Clusters + l2Tables + data
+	return n + l.refblocks(n), l.refblocks(n)
+}
+
+// refblocks is the number of refcount blocks for n clusters and the blocks
+// themselves
+func (l *layout) refblocks(n int64) int64 {
+	b := ceilDiv(n, l.refblockEntries)
+	for {
+		next := ceilDiv(n+b, l.refblockEntries)
+		if next == b {
+			return b
+		}
+		b = next
+	}
+}
+
+func ceilDiv(a, b int64) int64 {
+	return (a + b - 1) / b
+}
+
+// Create makes a new image of size bytes, which is rounded up to a multiple
+// of 512, and returns it opened read-write with the options given
+func Create(name string, size int64, opts *CreateOptions, imgOpts ...Option) (*Image, error) {
+	var o options
+	for _, opt := range imgOpts {
+		opt(&o)
+	}
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+	l, err := opts.layout(size)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ExtendedL2 {
+		return nil, errors.New("qcow2: extended L2 entries are not supported")
+	}
+
+	// start out empty, with the header, the refcount table and the refcount
+	// blocks for these first clusters, and grow from there
+	cs := l.clusterSize
+	h := Header{
+		Version:               l.version,
+		ClusterBits:           l.clusterBits,
+		RefcountTableOffset:   cs,
+		RefcountTableClusters: int(l.reftableClusters),
+		RefcountOrder:         l.order,
+		HeaderLength:          V2HeaderSize,
+	}
+	if l.version == 3 {
+		h.HeaderLength = V2HeaderSize + V3HeaderSize
+		if err := h.AddExtension(HdrExtFeatureNameTable, encodeFeatureNames(KnownFeatures)); err != nil {
+			return nil, err
+		}
+	}
+	hdr, err := h.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	refblocks := l.refblocks(1 + l.reftableClusters)
+	n := 1 + l.reftableClusters + refblocks
+	buf := make([]byte, n*cs)
+	copy(buf, hdr)
+	for i := int64(0); i < refblocks; i++ {
+		boff := (1 + l.reftableClusters + i) * cs
+		binary.BigEndian.PutUint64(buf[cs+i*8:], uint64(boff))
+		for c := i * l.refblockEntries; c < n && c < (i+1)*l.refblockEntries; c++ {
+			putRefcount(buf[boff:], c-i*l.refblockEntries, 1<<uint(l.order), 1)
+		}
+	}
+
+	fh, st, err := openFile(name, os.O_RDWR|os.O_CREATE, 0644, o)
+	if err != nil {
+		return nil, err
+	}
+	if !o.noLock {
+		if err := lockFile(fh, true); err != nil {
+			fh.Close()
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if err := st.Truncate(0); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	if _, err := st.WriteAt(buf, 0); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	img, err := newImage(name, st, false, o)
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	if err := img.initialize(l.size, opts); err != nil {
+		img.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+// initialize sizes the empty image created by Create
+func (img *Image) initialize(size int64, opts *CreateOptions) error {
+	l1Size := (size + img.l2Entries*img.clusterSize - 1) / (img.l2Entries * img.clusterSize)
+	if l1Size > 0 {
+		if err := img.growL1(int(l1Size)); err != nil {
+			return err
+		}
+	}
+	img.Header.Size = size
+	if err := img.writeHeader(); err != nil {
+		return err
+	}
+	if opts.BackingFile != "" {
+		if err := img.SetBackingFile(opts.BackingFile, opts.BackingFormat); err != nil {
+			return err
+		}
+	}
+	switch opts.Preallocation {
+	case "metadata", "full":
+		return img.preallocate(opts.Preallocation == "full")
+	}
+	// pad the last cluster of metadata, so the file is whole clusters
+	return img.fh.Truncate(img.end)
+}
+
+// preallocate allocates every L2 table and data cluster, writing zeros to the
+// data clusters when full is set. Otherwise they are past the end of the
+// file, which is extended to cover them.
+func (img *Image) preallocate(full bool) error {
+	zeros := make([]byte, img.clusterSize)
+	for off := int64(0); off < img.Header.Size; off += img.clusterSize {
+		entryOff, err := img.l2ForWrite(off)
+		if err != nil {
+			return err
+		}
+		host, err := img.allocClusters(1)
+		if err != nil {
+			return err
+		}
+		if full {
+			if _, err := img.fh.WriteAt(zeros, host); err != nil {
+				return err
+			}
+		}
+		if err := img.writeEntry(entryOff, uint64(host)|flagCopied); err != nil {
+			return err
+		}
+	}
+	return img.fh.Truncate(img.end)
+}
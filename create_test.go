@@ -0,0 +1,131 @@
+package qcow2
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreate(t *testing.T) {
+	for _, opts := range []CreateOptions{
+		{},
+		{Version: 2, ClusterSize: 4096},
+		{ClusterSize: 512, RefcountBits: 1},
+		{Preallocation: "metadata"},
+		{Preallocation: "full", ClusterSize: 4096},
+	} {
+		name := filepath.Join(t.TempDir(), "new.qcow2")
+		img, err := Create(name, 10<<20+100, &opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		if img.Size() != 10<<20+512 {
+			t.Errorf("%+v: expected the size rounded up to 512, got %d", opts, img.Size())
+		}
+		data := bytes.Repeat([]byte("qcow2"), 1000)
+		if _, err := img.WriteAt(data, 3<<20+7); err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		verifyRefcounts(t, img)
+		img.Close()
+
+		img, err = Open(name)
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		got := make([]byte, len(data)+2)
+		if _, err := img.ReadAt(got, 3<<20+6); err != nil {
+			t.Fatal(err)
+		}
+		if got[0] != 0 || got[len(got)-1] != 0 || !bytes.Equal(got[1:len(got)-1], data) {
+			t.Errorf("%+v: read back different data", opts)
+		}
+		img.Close()
+	}
+}
+
+func TestConvertRawToQcow2(t *testing.T) {
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "disk.raw")
+	f, err := os.Create(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// data at the start, a hole, a data cluster of zeros, and data at the end
+	if _, err := f.WriteAt(bytes.Repeat([]byte{0xaa}, 100000), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(make([]byte, 1<<16), 8<<20); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("end"), 16<<20-3); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	out := filepath.Join(dir, "disk.qcow2")
+	f, err = os.Open(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := ConvertRawToQcow2(f, 16<<20, out, nil); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	verifyRefcounts(t, img)
+	if checksum(t, img) != fileChecksum(t, raw) {
+		t.Error("image contents differ from the raw file")
+	}
+	var data int64
+	if err := img.WalkExtents(0, img.Size(), func(e Extent) error {
+		if e.Type == ExtentData {
+			data += e.Length
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if data != 3<<16 {
+		t.Errorf("expected 3 data clusters, got %d bytes of data", data)
+	}
+}
+
+func TestConvertStreamToQcow2(t *testing.T) {
+	src := tempImage(t)
+	dir := t.TempDir()
+	out := filepath.Join(dir, "stream.qcow2")
+	r, w := io.Pipe()
+	go func() {
+		_, err := src.WriteRawTo(w)
+		w.CloseWithError(err)
+	}()
+	if err := ConvertStreamToQcow2(r, src.Size(), out, nil); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	verifyRefcounts(t, img)
+	if checksum(t, img) != checksum(t, src) {
+		t.Error("image contents differ from the stream")
+	}
+
+	// a short stream leaves the rest unallocated, a long one is refused
+	short := filepath.Join(dir, "short.qcow2")
+	if err := ConvertStreamToQcow2(bytes.NewReader([]byte("short")), 1<<20, short, nil); err != nil {
+		t.Fatal(err)
+	}
+	long := filepath.Join(dir, "long.qcow2")
+	if err := ConvertStreamToQcow2(bytes.NewReader(make([]byte, 1<<20+1)), 1<<20, long, nil); err == nil {
+		t.Error("expected an error for a stream longer than the size")
+	}
+}
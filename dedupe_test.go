@@ -0,0 +1,60 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConvertDedupe(t *testing.T) {
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "disk.raw")
+	// the same cluster 10 times, with a unique one in between
+	var data []byte
+	for i := 0; i < 10; i++ {
+		data = append(data, bytes.Repeat([]byte("same"), 1024)...)
+		data = append(data, bytes.Repeat([]byte{byte(i + 1)}, 4096)...)
+	}
+	if err := os.WriteFile(raw, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, compress := range []bool{false, true} {
+		name := filepath.Join(dir, "out.qcow2")
+		opts := &ConvertOptions{CreateOptions: CreateOptions{ClusterSize: 4096}, Compress: compress, Dedupe: true}
+		if err := ConvertRawToQcow2(f, int64(len(data)), name, opts); err != nil {
+			t.Fatal(err)
+		}
+		if opts.Deduplicated != 9 {
+			t.Errorf("compress %v: expected 9 copies, found %d", compress, opts.Deduplicated)
+		}
+		img, err := Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(data))
+		if _, err := img.ReadAt(got, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("compress %v: deduplicated image reads differently", compress)
+		}
+		verifyRefcounts(t, img)
+		for off := int64(0); off < int64(len(data)); off += 8192 {
+			entry, _, err := img.l2Entry(img.l1, img.Header.L1TableOffset, off)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry&flagCopied != 0 {
+				t.Errorf("compress %v: shared cluster at %d has the COPIED flag", compress, off)
+			}
+		}
+		img.Close()
+	}
+}
@@ -0,0 +1,367 @@
+package qcow2
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// A raw deflate encoder whose back references reach no further than a given
+// window. compress/flate always uses a 32 KiB window, while qemu inflates
+// compressed clusters with a 4 KiB one and rejects anything reaching further.
+
+const (
+	deflateMinMatch  = 3
+	deflateMaxMatch  = 258
+	deflateMaxChain  = 128
+	deflateNiceMatch = 128
+	deflateHashBits  = 15
+	// deflateBlockTokens is the most tokens coded with one set of tables
+	deflateBlockTokens = 1 << 14
+)
+
+// token is a literal byte, or a match when dist is non-zero
+type token struct {
+	lit  byte
+	len  uint16
+	dist uint16
+}
+
+var (
+	lengthBase  = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+
+	// codeLengthOrder is the order code length code lengths are stored in
+	codeLengthOrder = [19]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+// deflate compresses p into a single raw deflate stream
+func deflate(p []byte, window int) []byte {
+	tokens := lz77(p, window)
+	var w bitWriter
+	for len(tokens) > 0 {
+		n := min(len(tokens), deflateBlockTokens)
+		w.block(tokens[:n], n == len(tokens))
+		tokens = tokens[n:]
+	}
+	if len(p) == 0 {
+		w.block(nil, true)
+	}
+	return w.bytes()
+}
+
+// lz77 splits p into literals and matches, with lazy matching like zlib
+func lz77(p []byte, window int) []token {
+	head := make([]int32, 1<<deflateHashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, len(p))
+	hash := func(i int) int {
+		return int((uint32(p[i])<<16|uint32(p[i+1])<<8|uint32(p[i+2]))*2654435761>>(32-deflateHashBits)) & (1<<deflateHashBits - 1)
+	}
+	insert := func(i int) {
+		if i+deflateMinMatch <= len(p) {
+			h := hash(i)
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+	longest := func(i int) (length, dist int) {
+		if i+deflateMinMatch > len(p) {
+			return 0, 0
+		}
+		limit := min(deflateMaxMatch, len(p)-i)
+		for j, chain := int(head[hash(i)]), 0; j >= 0 && i-j <= window && chain < deflateMaxChain; j, chain = int(prev[j]), chain+1 {
+			if p[j+length] != p[i+length] {
+				continue
+			}
+			n := 0
+			for n < limit && p[j+n] == p[i+n] {
+				n++
+			}
+			if n > length {
+				length, dist = n, i-j
+				if n >= deflateNiceMatch || n == limit {
+					break
+				}
+			}
+		}
+		if length < deflateMinMatch {
+			return 0, 0
+		}
+		return length, dist
+	}
+
+	var tokens []token
+	for i := 0; i < len(p); {
+		length, dist := longest(i)
+		insert(i)
+		if length > 0 && length < deflateNiceMatch && i+1 < len(p) {
+			if next, _ := longest(i + 1); next > length {
+				// a longer match starts at the next byte
+				tokens = append(tokens, token{lit: p[i]})
+				i++
+				continue
+			}
+		}
+		if length == 0 {
+			tokens = append(tokens, token{lit: p[i]})
+			i++
+			continue
+		}
+		tokens = append(tokens, token{len: uint16(length), dist: uint16(dist)})
+		for j := i + 1; j < i+length; j++ {
+			insert(j)
+		}
+		i += length
+	}
+	return tokens
+}
+
+func lengthCode(n int) int {
+	return sort.Search(len(lengthBase), func(i int) bool { return int(lengthBase[i]) > n }) - 1
+}
+
+func distCode(d int) int {
+	return sort.Search(len(distBase), func(i int) bool { return int(distBase[i]) > d }) - 1
+}
+
+// huffmanLengths computes code lengths of at most limit bits for freqs.
+// Symbols that do not occur get no code, but there are always at least two
+// codes so that the code is complete.
+func huffmanLengths(freqs []int, limit int) []uint8 {
+	lengths := make([]uint8, len(freqs))
+	var used []int
+	for sym, f := range freqs {
+		if f > 0 {
+			used = append(used, sym)
+		}
+	}
+	switch len(used) {
+	case 0:
+		lengths[0], lengths[1] = 1, 1
+		return lengths
+	case 1:
+		other := 0
+		if used[0] == 0 {
+			other = 1
+		}
+		lengths[used[0]], lengths[other] = 1, 1
+		return lengths
+	}
+	f := append([]int(nil), freqs...)
+	for {
+		if huffmanDepths(f, used, lengths) <= limit {
+			return lengths
+		}
+		// flatten the distribution until the tree is shallow enough
+		for _, sym := range used {
+			f[sym] = f[sym]/2 + 1
+		}
+	}
+}
+
+type huffNode struct {
+	freq        int
+	sym         int // leaf symbol, or -1
+	left, right *huffNode
+}
+
+type huffHeap []*huffNode
+
+func (h huffHeap) Len() int { return len(h) }
+func (h huffHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].sym < h[j].sym
+}
+func (h huffHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *huffHeap) Push(x any)   { *h = append(*h, x.(*huffNode)) }
+func (h *huffHeap) Pop() any {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// huffmanDepths stores the depth of each used symbol in a Huffman tree for
+// freqs, returning the deepest
+func huffmanDepths(freqs, used []int, lengths []uint8) int {
+	h := make(huffHeap, 0, len(used))
+	for _, sym := range used {
+		h = append(h, &huffNode{freq: freqs[sym], sym: sym})
+	}
+	heap.Init(&h)
+	for h.Len() > 1 {
+		a := heap.Pop(&h).(*huffNode)
+		b := heap.Pop(&h).(*huffNode)
+		heap.Push(&h, &huffNode{freq: a.freq + b.freq, sym: -1, left: a, right: b})
+	}
+	deepest := 0
+	var walk func(n *huffNode, depth int)
+	walk = func(n *huffNode, depth int) {
+		if n.sym >= 0 {
+			lengths[n.sym] = uint8(depth)
+			deepest = max(deepest, depth)
+			return
+		}
+		walk(n.left, depth+1)
+		walk(n.right, depth+1)
+	}
+	walk(h[0], 0)
+	return deepest
+}
+
+// canonicalCodes assigns the codes of the lengths, bit reversed for writing
+// least significant bit first
+func canonicalCodes(lengths []uint8) []uint16 {
+	var count [16]int
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+	var next [16]int
+	code := 0
+	for bits := 1; bits < 16; bits++ {
+		code = (code + count[bits-1]) << 1
+		next[bits] = code
+	}
+	codes := make([]uint16, len(lengths))
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		var rev uint16
+		for i := uint8(0); i < l; i++ {
+			rev = rev<<1 | uint16(c>>i&1)
+		}
+		codes[sym] = rev
+	}
+	return codes
+}
+
+// bitWriter assembles a deflate stream least significant bit first
+type bitWriter struct {
+	out   []byte
+	bits  uint64
+	nbits uint
+}
+
+func (w *bitWriter) write(v uint64, n uint) {
+	w.bits |= v << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.out = append(w.out, byte(w.bits))
+		w.bits >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.bits))
+		w.bits, w.nbits = 0, 0
+	}
+	return w.out
+}
+
+// block writes tokens as a block with dynamic Huffman codes
+func (w *bitWriter) block(tokens []token, final bool) {
+	litFreq := make([]int, 286)
+	distFreq := make([]int, 30)
+	for _, t := range tokens {
+		if t.dist == 0 {
+			litFreq[t.lit]++
+		} else {
+			litFreq[257+lengthCode(int(t.len))]++
+			distFreq[distCode(int(t.dist))]++
+		}
+	}
+	litFreq[256] = 1
+	litLens := huffmanLengths(litFreq, 15)
+	distLens := huffmanLengths(distFreq, 15)
+
+	hlit := 286
+	for hlit > 257 && litLens[hlit-1] == 0 {
+		hlit--
+	}
+	hdist := 30
+	for hdist > 1 && distLens[hdist-1] == 0 {
+		hdist--
+	}
+
+	// run length code the code lengths of both alphabets together
+	all := append(append([]uint8(nil), litLens[:hlit]...), distLens[:hdist]...)
+	type clSym struct{ sym, extra, extraBits int }
+	var cl []clSym
+	for i := 0; i < len(all); {
+		l := all[i]
+		run := 1
+		for i+run < len(all) && all[i+run] == l {
+			run++
+		}
+		switch {
+		case l == 0 && run >= 11:
+			run = min(run, 138)
+			cl = append(cl, clSym{18, run - 11, 7})
+		case l == 0 && run >= 3:
+			cl = append(cl, clSym{17, run - 3, 3})
+		case l != 0 && run >= 4:
+			run = min(run, 7)
+			cl = append(cl, clSym{int(l), 0, 0}, clSym{16, run - 4, 2})
+		default:
+			run = 1
+			cl = append(cl, clSym{int(l), 0, 0})
+		}
+		i += run
+	}
+	clFreq := make([]int, 19)
+	for _, c := range cl {
+		clFreq[c.sym]++
+	}
+	clLens := huffmanLengths(clFreq, 7)
+	hclen := 19
+	for hclen > 4 && clLens[codeLengthOrder[hclen-1]] == 0 {
+		hclen--
+	}
+
+	finalBit := uint64(0)
+	if final {
+		finalBit = 1
+	}
+	w.write(finalBit|2<<1, 3)
+	w.write(uint64(hlit-257), 5)
+	w.write(uint64(hdist-1), 5)
+	w.write(uint64(hclen-4), 4)
+	for _, sym := range codeLengthOrder[:hclen] {
+		w.write(uint64(clLens[sym]), 3)
+	}
+	clCodes := canonicalCodes(clLens)
+	for _, c := range cl {
+		w.write(uint64(clCodes[c.sym]), uint(clLens[c.sym]))
+		if c.extraBits > 0 {
+			w.write(uint64(c.extra), uint(c.extraBits))
+		}
+	}
+
+	litCodes := canonicalCodes(litLens)
+	distCodes := canonicalCodes(distLens)
+	for _, t := range tokens {
+		if t.dist == 0 {
+			w.write(uint64(litCodes[t.lit]), uint(litLens[t.lit]))
+			continue
+		}
+		lc := lengthCode(int(t.len))
+		w.write(uint64(litCodes[257+lc]), uint(litLens[257+lc]))
+		w.write(uint64(int(t.len)-int(lengthBase[lc])), uint(lengthExtra[lc]))
+		dc := distCode(int(t.dist))
+		w.write(uint64(distCodes[dc]), uint(distLens[dc]))
+		w.write(uint64(int(t.dist)-int(distBase[dc])), uint(distExtra[dc]))
+	}
+	w.write(uint64(litCodes[256]), uint(litLens[256]))
+}
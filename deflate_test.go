@@ -0,0 +1,42 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestDeflate(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 70000)
+	rnd.Read(random)
+	words := []string{"qcow2 ", "cluster ", "refcount ", "snapshot "}
+	var text bytes.Buffer
+	for text.Len() < 1<<16 {
+		text.WriteString(words[rnd.Intn(len(words))])
+	}
+	for name, p := range map[string][]byte{
+		"empty":  nil,
+		"byte":   {42},
+		"zeros":  make([]byte, 1<<16),
+		"text":   text.Bytes(),
+		"random": random,
+		"mixed":  append(append([]byte(nil), random[:5000]...), text.Bytes()...),
+	} {
+		for _, tok := range lz77(p, compressWindow) {
+			if int(tok.dist) > compressWindow {
+				t.Fatalf("%s: back reference of %d bytes", name, tok.dist)
+			}
+		}
+		z := deflate(p, compressWindow)
+		got, err := io.ReadAll(flate.NewReader(bytes.NewReader(z)))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, p) {
+			t.Errorf("%s: round trip differs", name)
+		}
+	}
+}
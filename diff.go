@@ -0,0 +1,136 @@
+package qcow2
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Diff creates the overlay dst, backed by base, holding the clusters of the
+// image that read differently from base, so that dst reads as the image. The
+// ranges both images know to read as zeros are not compared. The backing
+// file reference is opts.BackingFile when set, and otherwise the name of
+// base relative to dst. On failure the output file is removed.
+func (img *Image) Diff(base *Image, dst string, opts *ConvertOptions) error {
+	if base.Size() != img.Size() {
+		return fmt.Errorf("qcow2: cannot diff images of %d and %d bytes", base.Size(), img.Size())
+	}
+	var o ConvertOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.BackingFile == "" {
+		o.BackingFile = base.Name()
+		if rel, err := relativeTo(dst, base.Name()); err == nil {
+			o.BackingFile = rel
+		}
+		o.BackingFormat = "qcow2"
+	}
+	out, err := o.create(dst, img.Size())
+	if err != nil {
+		return err
+	}
+	if err := out.copyDiff(base, img, &o); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// relativeTo is the path of name relative to the directory of the file from
+func relativeTo(from, name string) (string, error) {
+	dir, err := filepath.Abs(filepath.Dir(from))
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(dir, abs)
+}
+
+// dataRangesOf lists the ranges of the image that are not known to read as
+// zeros, in whole clusters of size cs
+func dataRangesOf(img *Image, cs int64) ([][2]int64, error) {
+	var ranges [][2]int64
+	err := img.WalkExtents(0, img.Size(), func(e Extent) error {
+		if !e.ReadsAsZeros() {
+			ranges = append(ranges, [2]int64{e.Start &^ (cs - 1), min((e.Start+e.Length+cs-1)&^(cs-1), img.Size())})
+		}
+		return nil
+	})
+	return ranges, err
+}
+
+// mergeRanges sorts ranges and joins those that overlap or touch
+func mergeRanges(ranges [][2]int64) [][2]int64 {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	var merged [][2]int64
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r[0] <= merged[n-1][1] {
+			merged[n-1][1] = max(merged[n-1][1], r[1])
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// copyDiff stores into the image, backed by base, the clusters of next that
+// read differently from base
+func (img *Image) copyDiff(base, next *Image, opts *ConvertOptions) error {
+	a, err := dataRangesOf(base, img.clusterSize)
+	if err != nil {
+		return err
+	}
+	b, err := dataRangesOf(next, img.clusterSize)
+	if err != nil {
+		return err
+	}
+	ranges := mergeRanges(append(a, b...))
+	var total int64
+	for _, r := range ranges {
+		total += r[1] - r[0]
+	}
+	prog := opts.progress(total)
+
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	old, buf := make([]byte, img.chunkSize()), make([]byte, img.chunkSize())
+	zero := make([]byte, img.clusterSize)
+	for _, r := range ranges {
+		for off := r[0]; off < r[1]; {
+			n := min(img.chunkSize(), r[1]-off)
+			p, q := old[:n], buf[:n]
+			if m, err := base.ReadAt(p, off); err != nil && !(err == io.EOF && int64(m) == n) {
+				return err
+			}
+			if m, err := next.ReadAt(q, off); err != nil && !(err == io.EOF && int64(m) == n) {
+				return err
+			}
+			for len(q) > 0 {
+				c := img.clusterChunk(q, off)
+				var err error
+				switch {
+				case bytes.Equal(c, p[:len(c)]):
+				case img.Header.Version >= 3 && bytes.Equal(c, zero[:len(c)]):
+					err = img.replaceEntry(off, flagZero)
+				default:
+					err = img.writeGuest(c, off)
+				}
+				if err != nil {
+					return err
+				}
+				p, q, off = p[len(c):], q[len(c):], off+int64(len(c))
+			}
+			prog.add(n)
+		}
+	}
+	prog.finish()
+	return nil
+}
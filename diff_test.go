@@ -0,0 +1,57 @@
+package qcow2
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	const size = 1 << 20
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("version one "), 50000)
+	base := backedImage(t, filepath.Join(dir, "old.qcow2"), size, "", "")
+	next := backedImage(t, filepath.Join(dir, "new.qcow2"), size, "", "")
+	for _, img := range []*Image{base, next} {
+		if _, err := img.WriteAt(data, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := next.WriteAt([]byte("version two"), 300000); err != nil {
+		t.Fatal(err)
+	}
+	if err := next.writeZeroes(40960, 8192); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := next.WriteAt([]byte("new data"), 900000); err != nil {
+		t.Fatal(err)
+	}
+
+	base.Close()
+	base, err := Open(base.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+
+	name := filepath.Join(dir, "delta.qcow2")
+	if err := next.Diff(base, name, &ConvertOptions{CreateOptions: CreateOptions{ClusterSize: 4096}}); err != nil {
+		t.Fatal(err)
+	}
+	delta, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delta.Close()
+	if delta.Header.BackingFile != "old.qcow2" {
+		t.Errorf("expected old.qcow2 as the backing file, got %q", delta.Header.BackingFile)
+	}
+	if res, err := Compare(delta, next); err != nil || !res.Identical {
+		t.Errorf("expected the delta to read as the new image, got %+v: %v", res, err)
+	}
+	verifyRefcounts(t, delta)
+	// the changed cluster, the two of zeros and the new one
+	if n := allocated(t, delta); n != 4*4096 {
+		t.Errorf("expected 4 clusters in the delta, got %d bytes", n)
+	}
+}
@@ -0,0 +1,152 @@
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+)
+
+// ZeroDigest stands for the digest of blocks of zeros, so that they match
+// whatever their length and however they are allocated
+var ZeroDigest [sha256.Size]byte
+
+// digestWindow is how many blocks Digests maps at a time
+const digestWindow = 1024
+
+// BlockDigest is the digest of a block of the guest disk
+type BlockDigest struct {
+	Start  int64
+	Length int64
+	// Type is how the block is allocated. A block over several extents has
+	// the type of the first of data, compressed, zero and unallocated among
+	// them.
+	Type ExtentType
+	// Sum is the SHA-256 of the contents, or ZeroDigest when they are all
+	// zeros
+	Sum [sha256.Size]byte
+}
+
+// DigestOptions are the parameters of DigestsContext
+type DigestOptions struct {
+	// Granularity is the size of the blocks, which must divide or be a
+	// multiple of the cluster size, the cluster size when zero
+	Granularity int64
+	// Jobs is the number of blocks read and hashed in parallel, all CPUs
+	// when zero. The digests do not depend on it.
+	Jobs int
+}
+
+// Digests calls fn with the digest of each block of granularity bytes of the
+// guest disk, in order; the last block may be shorter. The granularity must
+// divide or be a multiple of the cluster size, which it is when zero. Blocks
+// known to read as zeros are not read.
+func (img *Image) Digests(granularity int64, fn func(BlockDigest) error) error {
+	return img.DigestsContext(context.Background(), &DigestOptions{Granularity: granularity}, fn)
+}
+
+// DigestsContext is Digests with the parameters of opts, which may be nil,
+// until ctx is done. The blocks are read and hashed by the jobs, while fn is
+// called with their digests in order, on the calling goroutine.
+func (img *Image) DigestsContext(ctx context.Context, opts *DigestOptions, fn func(BlockDigest) error) error {
+	if opts == nil {
+		opts = &DigestOptions{}
+	}
+	granularity := opts.Granularity
+	if granularity == 0 {
+		granularity = img.clusterSize
+	}
+	if granularity < 0 || (granularity%img.clusterSize != 0 && img.clusterSize%granularity != 0) {
+		return fmt.Errorf("qcow2: granularity of %d bytes does not divide or multiply the cluster size %d", granularity, img.clusterSize)
+	}
+	bufs := sync.Pool{New: func() any {
+		b := make([]byte, granularity)
+		return &b
+	}}
+	return runOrdered(ctx, workers(opts.Jobs), img.digestJobs(granularity),
+		func(_ context.Context, blocks []BlockDigest) ([]BlockDigest, error) {
+			buf := bufs.Get().(*[]byte)
+			defer bufs.Put(buf)
+			for i := range blocks {
+				b := &blocks[i]
+				if b.Type == ExtentUnallocated || b.Type == ExtentZero {
+					continue
+				}
+				p := (*buf)[:b.Length]
+				if _, err := img.ReadAt(p, b.Start); err != nil {
+					return nil, err
+				}
+				if len(bytes.TrimLeft(p, "\x00")) > 0 {
+					b.Sum = sha256.Sum256(p)
+				}
+			}
+			return blocks, nil
+		},
+		func(blocks []BlockDigest) error {
+			for _, b := range blocks {
+				if err := fn(b); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+}
+
+// digestJobs maps the blocks of granularity bytes of the guest disk, a window
+// of them at a time, and returns them in order in batches of up to
+// convertChunk bytes, or of one block when larger
+func (img *Image) digestJobs(granularity int64) func() ([]BlockDigest, bool, error) {
+	window := granularity * digestWindow
+	var start int64
+	var blocks []BlockDigest
+	return func() ([]BlockDigest, bool, error) {
+		for len(blocks) == 0 {
+			if start >= img.Size() {
+				return nil, false, nil
+			}
+			var err error
+			if blocks, err = img.mapBlocks(start, min(window, img.Size()-start), granularity); err != nil {
+				return nil, false, err
+			}
+			start += window
+		}
+		n := min(int(max(1, convertChunk/granularity)), len(blocks))
+		batch := blocks[:n:n]
+		blocks = blocks[n:]
+		return batch, true, nil
+	}
+}
+
+// mapBlocks returns the blocks of granularity bytes of the n bytes of the
+// guest disk at start, with their types but no digests
+func (img *Image) mapBlocks(start, n, granularity int64) ([]BlockDigest, error) {
+	blocks := make([]BlockDigest, 0, ceilDiv(n, granularity))
+	for off := start; off < start+n; off += granularity {
+		blocks = append(blocks, BlockDigest{Start: off, Length: min(granularity, img.Size()-off), Type: -1})
+	}
+	err := img.WalkExtents(start, n, func(e Extent) error {
+		first := (e.Start - start) / granularity
+		last := (e.Start + e.Length - 1 - start) / granularity
+		for i := first; i <= last; i++ {
+			if b := &blocks[i]; b.Type < 0 || digestRank(e.Type) < digestRank(b.Type) {
+				b.Type = e.Type
+			}
+		}
+		return nil
+	})
+	return blocks, err
+}
+
+// digestRank orders the types of the extents of a block, lowest first
+func digestRank(t ExtentType) int {
+	switch t {
+	case ExtentData:
+		return 0
+	case ExtentCompressed:
+		return 1
+	case ExtentZero:
+		return 2
+	}
+	return 3
+}
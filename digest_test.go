@@ -0,0 +1,126 @@
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDigests(t *testing.T) {
+	img, err := Create(filepath.Join(t.TempDir(), "disk.qcow2"), 5*4096, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	data := bytes.Repeat([]byte("D"), 4096)
+	if _, err := img.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	// data clusters of zeros digest as zeros
+	if _, err := img.WriteAt(make([]byte, 4096), 4096); err != nil {
+		t.Fatal(err)
+	}
+	dataSum, halfSum := sha256.Sum256(data), sha256.Sum256(data[:2048])
+
+	for _, tc := range []struct {
+		granularity int64
+		want        []BlockDigest
+	}{
+		{0, []BlockDigest{
+			{0, 4096, ExtentData, dataSum},
+			{4096, 4096, ExtentData, ZeroDigest},
+			{2 * 4096, 4096, ExtentUnallocated, ZeroDigest},
+			{3 * 4096, 4096, ExtentUnallocated, ZeroDigest},
+			{4 * 4096, 4096, ExtentUnallocated, ZeroDigest},
+		}},
+		{2048, []BlockDigest{
+			{0, 2048, ExtentData, halfSum},
+			{2048, 2048, ExtentData, halfSum},
+		}},
+		{3 * 4096, []BlockDigest{
+			{0, 3 * 4096, ExtentData, sha256.Sum256(append(data, make([]byte, 2*4096)...))},
+			{3 * 4096, 2 * 4096, ExtentUnallocated, ZeroDigest},
+		}},
+	} {
+		var got []BlockDigest
+		if err := img.Digests(tc.granularity, func(b BlockDigest) error {
+			got = append(got, b)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) < len(tc.want) {
+			t.Fatalf("granularity %d: got %d blocks, want at least %d", tc.granularity, len(got), len(tc.want))
+		}
+		for i, want := range tc.want {
+			if got[i] != want {
+				t.Errorf("granularity %d: block %d: got %+v, want %+v", tc.granularity, i, got[i], want)
+			}
+		}
+	}
+	if err := img.Digests(3000, func(BlockDigest) error { return nil }); err == nil {
+		t.Error("expected an error for a granularity of 3000 bytes")
+	}
+}
+
+// digestsOf collects the digests of img
+func digestsOf(t testing.TB, img *Image, ctx context.Context, opts *DigestOptions) ([]BlockDigest, error) {
+	t.Helper()
+	var got []BlockDigest
+	err := img.DigestsContext(ctx, opts, func(b BlockDigest) error {
+		got = append(got, b)
+		return nil
+	})
+	return got, err
+}
+
+func TestDigestsJobs(t *testing.T) {
+	img := tempImage(t)
+	for _, granularity := range []int64{512, 0, 4 << 20} {
+		want, err := digestsOf(t, img, context.Background(), &DigestOptions{Granularity: granularity, Jobs: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := granularity
+		if g == 0 {
+			g = img.clusterSize
+		}
+		if n := ceilDiv(img.Size(), g); int64(len(want)) != n {
+			t.Errorf("granularity %d: got %d blocks, want %d", granularity, len(want), n)
+		}
+		for _, jobs := range []int{0, 2, 8} {
+			got, err := digestsOf(t, img, context.Background(), &DigestOptions{Granularity: granularity, Jobs: jobs})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("granularity %d: the digests of %d jobs differ from those of one", granularity, jobs)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := digestsOf(t, img, ctx, &DigestOptions{Jobs: 4}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the digests to be canceled, got %v", err)
+	}
+}
+
+func BenchmarkDigestsCompressed(b *testing.B) {
+	img := packedImage(b)
+	for _, jobs := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			b.SetBytes(img.Size())
+			for i := 0; i < b.N; i++ {
+				if _, err := digestsOf(b, img, context.Background(), &DigestOptions{Jobs: jobs}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package qcow2
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// ErrDirectIONotSupported is returned when opening an image WithDirectIO on a
+// platform or file system that does not support direct I/O
+var ErrDirectIONotSupported = errors.New("qcow2: direct I/O is not supported")
+
+// directAlign is the alignment of the offsets, lengths and memory of direct
+// I/O. It is assumed rather than discovered: 4096 bytes suits logical blocks
+// of up to 4 KiB, which covers the disks in use.
+const directAlign = 4096
+
+// directBufferSize is the size of the pooled buffers direct I/O goes through,
+// and so the most that one read or write of the file moves
+const directBufferSize = 1 << 20
+
+var directBuffers = sync.Pool{
+	New: func() any {
+		b := alignedBuffer(directBufferSize, directAlign)
+		return &b
+	},
+}
+
+// alignedBuffer is a buffer of n bytes whose address is a multiple of align
+func alignedBuffer(n, align int) []byte {
+	b := make([]byte, n+align)
+	skip := (align - int(uintptr(unsafe.Pointer(&b[0])))&(align-1)) & (align - 1)
+	return b[skip : skip+n]
+}
+
+// directFile does the I/O of an image opened WithDirectIO through aligned
+// buffers, reading the blocks a write covers in part first, so that the file
+// is only ever read and written in whole, aligned blocks
+type directFile struct {
+	storage
+	align int64
+}
+
+// openFile opens the named file of an image, as the file to lock and the
+// storage to do its I/O through, which is a directFile WithDirectIO
+func openFile(name string, flag int, perm os.FileMode, o options) (*os.File, storage, error) {
+	if !o.directIO {
+		fh, err := os.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fh, fh, nil
+	}
+	fh, err := openDirect(name, flag, perm)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fh, &directFile{storage: fh, align: directAlign}, nil
+}
+
+// span is the aligned range of the file to move for the bytes of [pos, end)
+// going through buf
+func (f *directFile) span(pos, end int64, buf []byte) (start, stop int64) {
+	start = pos &^ (f.align - 1)
+	stop = min((end+f.align-1)&^(f.align-1), start+int64(len(buf)))
+	return start, stop
+}
+
+func (f *directFile) ReadAt(p []byte, off int64) (int, error) {
+	bp := directBuffers.Get().(*[]byte)
+	defer directBuffers.Put(bp)
+	end := off + int64(len(p))
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		start, stop := f.span(pos, end, *bp)
+		m, err := f.storage.ReadAt((*bp)[:stop-start], start)
+		if err == nil && m < int(stop-start) {
+			err = io.EOF
+		}
+		if skip := int(pos - start); m > skip {
+			n += copy(p[n:], (*bp)[skip:m])
+		}
+		if err != nil {
+			if err == io.EOF && n == len(p) {
+				err = nil
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (f *directFile) WriteAt(p []byte, off int64) (int, error) {
+	bp := directBuffers.Get().(*[]byte)
+	defer directBuffers.Put(bp)
+	end := off + int64(len(p))
+	// size is what the file is cut back to when the last block was read past
+	// its end, for the write not to grow it to a whole block
+	size := int64(-1)
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		start, stop := f.span(pos, end, *bp)
+		chunk := (*bp)[:stop-start]
+		last := min(stop, end)
+		// the first and last blocks p covers in part are read first
+		eof := int64(-1)
+		var err error
+		if pos != start {
+			if eof, err = f.readBlock(chunk, start, start); err != nil {
+				return n, err
+			}
+		}
+		if tail := (last - 1) &^ (f.align - 1); last != stop && (tail != start || pos == start) {
+			if eof, err = f.readBlock(chunk, start, tail); err != nil {
+				return n, err
+			}
+		}
+		if eof >= 0 {
+			size = max(eof, end)
+		}
+		copy(chunk[pos-start:], p[n:n+int(last-pos)])
+		if _, err := f.storage.WriteAt(chunk, start); err != nil {
+			return n, err
+		}
+		n += int(last - pos)
+	}
+	if size >= 0 {
+		if err := f.storage.Truncate(size); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// readBlock reads the block of the file at off into its place in chunk, which
+// holds the file from start, the part of it past the end of the file reading
+// as zeros. It returns where the file ends when it ends before the end of the
+// block, and -1 otherwise.
+func (f *directFile) readBlock(chunk []byte, start, off int64) (int64, error) {
+	b := chunk[off-start : off-start+f.align]
+	m, err := f.storage.ReadAt(b, off)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if m == len(b) {
+		return -1, nil
+	}
+	clear(b[m:])
+	return off + int64(m), nil
+}
@@ -0,0 +1,18 @@
+package qcow2
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// openDirect opens the named file with O_DIRECT, which file systems that do
+// not support it refuse with EINVAL
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	fh, err := os.OpenFile(name, flag|syscall.O_DIRECT, perm)
+	if errors.Is(err, syscall.EINVAL) {
+		return nil, fmt.Errorf("%s: %w", name, ErrDirectIONotSupported)
+	}
+	return fh, err
+}
@@ -0,0 +1,71 @@
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWithDirectIO(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "direct.qcow2")
+	// 512 byte clusters are smaller than the blocks of direct I/O
+	img, err := Create(name, 4<<20, &CreateOptions{ClusterSize: 512}, WithDirectIO())
+	if errors.Is(err, ErrDirectIONotSupported) {
+		t.Skipf("the file system of %s: %v", dir, err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if _, ok := img.fh.storage.(*directFile); !ok {
+		t.Fatalf("the storage is a %T", img.fh.storage)
+	}
+	writes := []struct {
+		off int64
+		p   []byte
+	}{
+		{3, []byte("odd")},
+		{4095, bytes.Repeat([]byte("x"), 2)},
+		{1 << 20, bytes.Repeat([]byte("data"), 100000)},
+	}
+	for _, w := range writes {
+		if _, err := img.WriteAt(w.p, w.off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := img.WriteCompressedAt(bytes.Repeat([]byte("z"), 512), 3<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.CreateSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	direct := checksum(t, img)
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file reads the same through the page cache
+	img, err = OpenFile(name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checksum(t, img) != direct {
+		t.Error("the image reads differently without direct I/O")
+	}
+	checkClean(t, img)
+
+	again, err := Open(name, WithDirectIO(), WithNoLock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	for _, w := range writes {
+		got := make([]byte, len(w.p))
+		if _, err := again.ReadAt(got, w.off); err != nil || !bytes.Equal(got, w.p) {
+			t.Errorf("reading %d bytes at %d: %v", len(w.p), w.off, err)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package qcow2
+
+import (
+	"fmt"
+	"os"
+)
+
+// openDirect fails, as direct I/O is only implemented on Linux
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return nil, fmt.Errorf("%s: %w", name, ErrDirectIONotSupported)
+}
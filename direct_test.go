@@ -0,0 +1,129 @@
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+	"unsafe"
+)
+
+// alignedStore is an in-memory storage failing any I/O that is not of whole,
+// aligned blocks from aligned memory, as O_DIRECT does
+type alignedStore struct {
+	align int64
+	data  []byte
+}
+
+func (s *alignedStore) check(p []byte, off int64) error {
+	if off%s.align != 0 || int64(len(p))%s.align != 0 || len(p) > 0 && int64(uintptr(unsafe.Pointer(&p[0])))%s.align != 0 {
+		return fmt.Errorf("unaligned I/O of %d bytes at %d", len(p), off)
+	}
+	return nil
+}
+
+func (s *alignedStore) ReadAt(p []byte, off int64) (int, error) {
+	if err := s.check(p, off); err != nil {
+		return 0, err
+	}
+	if off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *alignedStore) WriteAt(p []byte, off int64) (int, error) {
+	if err := s.check(p, off); err != nil {
+		return 0, err
+	}
+	if end := off + int64(len(p)); end > int64(len(s.data)) {
+		s.data = append(s.data, make([]byte, end-int64(len(s.data)))...)
+	}
+	return copy(s.data[off:], p), nil
+}
+
+func (s *alignedStore) Truncate(size int64) error {
+	if size <= int64(len(s.data)) {
+		s.data = s.data[:size]
+	} else {
+		s.data = append(s.data, make([]byte, size-int64(len(s.data)))...)
+	}
+	return nil
+}
+
+func (s *alignedStore) Stat() (os.FileInfo, error) { return nil, errors.New("no stat") }
+func (s *alignedStore) Sync() error                { return nil }
+func (s *alignedStore) Close() error               { return nil }
+
+func TestDirectFile(t *testing.T) {
+	store := &alignedStore{align: 512}
+	f := &directFile{storage: store, align: 512}
+	// what the file should hold, written as is
+	var want []byte
+	write := func(p []byte, off int64) {
+		t.Helper()
+		if n, err := f.WriteAt(p, off); n != len(p) || err != nil {
+			t.Fatalf("writing %d bytes at %d: %d, %v", len(p), off, n, err)
+		}
+		if end := off + int64(len(p)); end > int64(len(want)) {
+			want = append(want, make([]byte, end-int64(len(want)))...)
+		}
+		copy(want[off:], p)
+		if !bytes.Equal(store.data, want) {
+			t.Fatalf("after writing %d bytes at %d, the file of %d bytes differs from the %d written", len(p), off, len(store.data), len(want))
+		}
+	}
+	rnd := rand.New(rand.NewSource(1))
+	bytesOf := func(n int) []byte {
+		p := make([]byte, n)
+		rnd.Read(p)
+		return p
+	}
+	// a sub-sector header, odd offsets and lengths within a block and across
+	// blocks, whole blocks, writes past the end leaving a gap, and one
+	// larger than a pooled buffer
+	write(bytesOf(104), 0)
+	write(bytesOf(7), 3)
+	write(bytesOf(1), 511)
+	write(bytesOf(2), 511)
+	write(bytesOf(1000), 700)
+	write(bytesOf(1024), 2048)
+	write(bytesOf(10), 5000)
+	write(bytesOf(512), 8192)
+	write(bytesOf(directBufferSize+777), 1234)
+	write(bytesOf(3), int64(len(want))-1)
+	write(nil, 100)
+
+	for _, r := range []struct{ off, n int64 }{
+		{0, 1}, {5, 1000}, {511, 2}, {1234, directBufferSize + 300}, {int64(len(want)) - 5, 5},
+	} {
+		p := make([]byte, r.n)
+		if n, err := f.ReadAt(p, r.off); n != len(p) || err != nil || !bytes.Equal(p, want[r.off:r.off+r.n]) {
+			t.Errorf("reading %d bytes at %d: %d, %v", r.n, r.off, n, err)
+		}
+	}
+	// reads past the end are short
+	p := make([]byte, 100)
+	if n, err := f.ReadAt(p, int64(len(want))-10); n != 10 || err != io.EOF || !bytes.Equal(p[:10], want[len(want)-10:]) {
+		t.Errorf("reading past the end: %d, %v", n, err)
+	}
+	if n, err := f.ReadAt(p, int64(len(want))+1000); n != 0 || err != io.EOF {
+		t.Errorf("reading beyond the end: %d, %v", n, err)
+	}
+}
+
+func TestAlignedBuffer(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		b := alignedBuffer(4096+i, 4096)
+		if len(b) != 4096+i || uintptr(unsafe.Pointer(&b[0]))%4096 != 0 {
+			t.Errorf("got a buffer of %d bytes at %p", len(b), &b[0])
+		}
+	}
+}
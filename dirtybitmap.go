@@ -0,0 +1,173 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/bits"
+)
+
+// bitmapDumpMagic starts the encoding of a Bitmap
+const bitmapDumpMagic = "QCOWBMAP"
+
+// bitmapDumpVersion is the version of the encoding MarshalBinary writes, and
+// the newest UnmarshalBinary reads
+const bitmapDumpVersion = 1
+
+// bitmapDumpHeaderSize is the size of the fields before the bits
+const bitmapDumpHeaderSize = 24
+
+// Bitmap holds the bits of a persistent dirty bitmap. Bit i stands for the
+// Granularity bytes of the guest disk at i*Granularity, and is set when they
+// were written to since the bitmap was cleared.
+type Bitmap struct {
+	// Granularity is a power of two, from 512 bytes to 2 GiB
+	Granularity int64
+	// Size is the virtual size of the disk the bitmap covers
+	Size int64
+	// InUse is set for a bitmap that was not saved cleanly, whose bits can
+	// not be trusted
+	InUse bool
+	// Bits holds a bit for each granule, starting with the least significant
+	// bit of the first byte, as qcow2 stores them
+	Bits []byte
+}
+
+// NewBitmap is a bitmap of a disk of size bytes with no bits set
+func NewBitmap(size, granularity int64) *Bitmap {
+	b := &Bitmap{Granularity: granularity, Size: size}
+	b.Bits = make([]byte, ceilDiv(b.Len(), 8))
+	return b
+}
+
+// Len is the number of bits of the bitmap
+func (b *Bitmap) Len() int64 {
+	return ceilDiv(b.Size, b.Granularity)
+}
+
+// Get reports whether bit i is set
+func (b *Bitmap) Get(i int64) bool {
+	return b.Bits[i/8]&(1<<(i%8)) != 0
+}
+
+// SetRange sets the bits of every granule overlapping the n guest bytes at
+// off, up to the end of the disk
+func (b *Bitmap) SetRange(off, n int64) {
+	n = min(n, b.Size-off)
+	if n <= 0 {
+		return
+	}
+	for i := off / b.Granularity; i <= (off+n-1)/b.Granularity; i++ {
+		b.Bits[i/8] |= 1 << (i % 8)
+	}
+}
+
+// Ranges are the ranges of the guest disk whose bits are set, in order, those
+// that touch merged and the last ending at the end of the disk
+func (b *Bitmap) Ranges() []Range {
+	var ranges []Range
+	for i := int64(0); i < b.Len(); i++ {
+		if b.Bits[i/8] == 0 {
+			i |= 7 // skip the byte of clear bits
+			continue
+		}
+		if !b.Get(i) {
+			continue
+		}
+		off := i * b.Granularity
+		n := min(b.Granularity, b.Size-off)
+		if r := len(ranges); r > 0 && ranges[r-1].Start+ranges[r-1].Length == off {
+			ranges[r-1].Length += n
+		} else {
+			ranges = append(ranges, Range{off, n})
+		}
+	}
+	return ranges
+}
+
+// Merge sets the bits of b for every range of the disk whose bits are set in
+// src, a bitmap of a disk of the same size. Where the granularities differ,
+// the ranges take the coarser one: a bit of a coarser src sets every bit of b
+// it covers, and bits of a finer src set the bit of b covering them.
+func (b *Bitmap) Merge(src *Bitmap) error {
+	if src.Size != b.Size {
+		return fmt.Errorf("qcow2: cannot merge a bitmap of a disk of %d bytes into one of %d", src.Size, b.Size)
+	}
+	if src.Granularity == b.Granularity {
+		for i, c := range src.Bits {
+			b.Bits[i] |= c
+		}
+		return nil
+	}
+	for _, r := range src.Ranges() {
+		b.SetRange(r.Start, r.Length)
+	}
+	return nil
+}
+
+// Count is the number of bits set
+func (b *Bitmap) Count() int64 {
+	var n int
+	for _, c := range b.Bits {
+		n += bits.OnesCount8(c)
+	}
+	return int64(n)
+}
+
+// MarshalBinary encodes the bitmap portably, all numbers big-endian:
+//
+//	offset  size  field
+//	0       8     magic "QCOWBMAP"
+//	8       4     version, 1
+//	12      4     log2 of the granularity
+//	16      8     virtual size of the disk in bytes
+//	24      n     the bits, ceil(ceil(size/granularity)/8) bytes, bit i in
+//	              byte i/8 at 1<<(i%8)
+//	24+n    4     CRC-32 (IEEE) of the bytes before it
+//
+// The in-use flag is not recorded.
+func (b *Bitmap) MarshalBinary() ([]byte, error) {
+	if b.Granularity <= 0 || b.Granularity&(b.Granularity-1) != 0 {
+		return nil, fmt.Errorf("qcow2: bitmap granularity %d is not a power of two", b.Granularity)
+	}
+	if want := ceilDiv(b.Len(), 8); int64(len(b.Bits)) != want {
+		return nil, fmt.Errorf("qcow2: bitmap of %d bytes, where a disk of %d bytes needs %d", len(b.Bits), b.Size, want)
+	}
+	buf := make([]byte, bitmapDumpHeaderSize, bitmapDumpHeaderSize+len(b.Bits)+4)
+	copy(buf, bitmapDumpMagic)
+	binary.BigEndian.PutUint32(buf[8:12], bitmapDumpVersion)
+	binary.BigEndian.PutUint32(buf[12:16], uint32(bits.TrailingZeros64(uint64(b.Granularity))))
+	binary.BigEndian.PutUint64(buf[16:24], uint64(b.Size))
+	buf = append(buf, b.Bits...)
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf)), nil
+}
+
+// UnmarshalBinary decodes a bitmap encoded by MarshalBinary
+func (b *Bitmap) UnmarshalBinary(data []byte) error {
+	if len(data) < bitmapDumpHeaderSize+4 || string(data[:8]) != bitmapDumpMagic {
+		return errors.New("qcow2: not an encoded bitmap")
+	}
+	if v := binary.BigEndian.Uint32(data[8:12]); v < 1 || v > bitmapDumpVersion {
+		return fmt.Errorf("qcow2: encoded bitmap of version %d, not one of 1 to %d", v, bitmapDumpVersion)
+	}
+	sum := binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(data[:len(data)-4]) != sum {
+		return errors.New("qcow2: encoded bitmap fails its checksum")
+	}
+	g := binary.BigEndian.Uint32(data[12:16])
+	if g < minBitmapGranularityBits || g > maxBitmapGranularityBits {
+		return fmt.Errorf("qcow2: encoded bitmap of a granularity of 2^%d bytes, where 2^%d to 2^%d are allowed", g, minBitmapGranularityBits, maxBitmapGranularityBits)
+	}
+	size := int64(binary.BigEndian.Uint64(data[16:24]))
+	if size < 0 {
+		return fmt.Errorf("qcow2: encoded bitmap of invalid size %d", size)
+	}
+	d := Bitmap{Granularity: 1 << g, Size: size, Bits: data[bitmapDumpHeaderSize : len(data)-4]}
+	if want := ceilDiv(d.Len(), 8); int64(len(d.Bits)) != want {
+		return fmt.Errorf("qcow2: encoded bitmap holds %d bytes of bits, where a disk of %d bytes needs %d", len(d.Bits), size, want)
+	}
+	d.Bits = append([]byte(nil), d.Bits...)
+	*b = d
+	return nil
+}
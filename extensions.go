@@ -0,0 +1,159 @@
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ExternalDataFile is the name of the external data file recorded in the
+// header, if any
+func (h Header) ExternalDataFile() string {
+	for _, e := range h.ExtHeaders {
+		if e.Type == HdrExtExternalDataFile {
+			return string(e.Data)
+		}
+	}
+	return ""
+}
+
+// CryptHeaderLocation is where the full disk encryption extension says the
+// LUKS header of the image is stored in its file, reporting false without one
+func (h Header) CryptHeaderLocation() (offset, length int64, ok bool, err error) {
+	for i, e := range h.ExtHeaders {
+		if e.Type != HdrExtFullDiskCrypt {
+			continue
+		}
+		if len(e.Data) < 16 {
+			return 0, 0, true, CorruptionError{Offset: h.ExtensionOffset(i), Structure: StructExtension, Index: int64(i), Value: uint64(len(e.Data)),
+				Reason: fmt.Sprintf("full disk encryption extension of %d bytes is too short", len(e.Data))}
+		}
+		return be64(e.Data[0:8]), be64(e.Data[8:16]), true, nil
+	}
+	return 0, 0, false, nil
+}
+
+// luksMagic starts a LUKS header
+var luksMagic = []byte("LUKS\xba\xbe")
+
+// LUKS1 key slots
+const (
+	luksKeySlots       = 8
+	luksKeySlotEnabled = 0x00ac71f3
+)
+
+// LUKSHeader is what the LUKS header of an encrypted image says about its
+// encryption. Version 2 headers keep the cipher in their JSON area, which is
+// not decoded, so only the version and UUID of those are set.
+type LUKSHeader struct {
+	Version    int
+	CipherName string
+	CipherMode string
+	HashSpec   string
+	// KeyBytes is the size of the master key
+	KeyBytes int
+	// PayloadOffset is where the encrypted data starts, in 512 byte sectors
+	PayloadOffset int64
+	UUID          string
+	// ActiveKeySlots is the number of passphrases that unlock the key
+	ActiveKeySlots int
+}
+
+// LUKSHeader reads the LUKS header of an image of CryptMethod 2, where the
+// full disk encryption extension says it is
+func (img *Image) LUKSHeader() (*LUKSHeader, error) {
+	l, _, _, _, err := img.readLUKSHeader()
+	return l, err
+}
+
+// readLUKSHeader is LUKSHeader, with the start of the header as stored, up to
+// the end of its key slots, and where it is in the file
+func (img *Image) readLUKSHeader() (l *LUKSHeader, buf []byte, off, length int64, err error) {
+	if img.Header.ExtensionsSkipped {
+		return nil, nil, 0, 0, ErrExtensionsSkipped
+	}
+	off, length, ok, err := img.Header.CryptHeaderLocation()
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	if !ok {
+		return nil, nil, 0, 0, errors.New("qcow2: no full disk encryption extension")
+	}
+	if length < 592 {
+		return nil, nil, 0, 0, fmt.Errorf("qcow2: LUKS header of %d bytes is too short", length)
+	}
+	buf = make([]byte, 592)
+	if _, err := img.fh.ReadAt(buf, off); err != nil {
+		if err == io.EOF {
+			err = errors.New("past the end of the file")
+		}
+		return nil, nil, 0, 0, fmt.Errorf("qcow2: reading the LUKS header at %#x: %w", off, err)
+	}
+	if !bytes.Equal(buf[:6], luksMagic) {
+		return nil, nil, 0, 0, fmt.Errorf("qcow2: no LUKS header at %#x", off)
+	}
+	str := func(b []byte) string {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		return string(b)
+	}
+	l = &LUKSHeader{Version: be16(buf[6:8]), UUID: str(buf[168:208])}
+	if l.Version != 1 {
+		return l, buf, off, length, nil
+	}
+	l.CipherName, l.CipherMode, l.HashSpec = str(buf[8:40]), str(buf[40:72]), str(buf[72:104])
+	l.PayloadOffset, l.KeyBytes = int64(be32(buf[104:108])), be32(buf[108:112])
+	for i := 0; i < luksKeySlots; i++ {
+		if be32(buf[208+48*i:]) == luksKeySlotEnabled {
+			l.ActiveKeySlots++
+		}
+	}
+	return l, buf, off, length, nil
+}
+
+// BitmapInfo describes a persistent dirty bitmap of the image
+type BitmapInfo struct {
+	Name string
+	// Granularity is the number of guest bytes each bit stands for
+	Granularity int64
+	// InUse is set while the bitmap is being changed, so a bitmap left with
+	// it set was not saved and can not be trusted
+	InUse bool
+	// Auto is set on the bitmaps every write must be recorded in
+	Auto bool
+	// TableOffset and TableSize locate the bitmap table in the file
+	TableOffset int64
+	TableSize   int
+}
+
+// Bitmaps lists the bitmaps of the bitmap directory, which is empty for an
+// image without the bitmaps extension
+func (img *Image) Bitmaps() ([]BitmapInfo, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.Header.ExtensionsSkipped {
+		return nil, ErrExtensionsSkipped
+	}
+	ext, ok, err := img.Header.readBitmapsExt()
+	if err != nil || !ok {
+		return nil, err
+	}
+	bitmaps, err := img.readBitmaps(ext)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]BitmapInfo, 0, len(bitmaps))
+	for _, b := range bitmaps {
+		infos = append(infos, BitmapInfo{
+			Name:        b.name,
+			Granularity: 1 << b.granularityBits,
+			InUse:       b.flags&bitmapInUse != 0,
+			Auto:        b.flags&bitmapAuto != 0,
+			TableOffset: b.tableOffset,
+			TableSize:   b.tableSize,
+		})
+	}
+	return infos, nil
+}
@@ -0,0 +1,214 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var updateFixtures = flag.Bool("update-fixtures", false, "rewrite testdata/extensions.qcow2.gz")
+
+// extensionsImage creates an image at name with one extension of each type,
+// and a vendor one: two bitmaps, one of them left in use, and a LUKS1 header
+// of made up parameters that unlocks nothing. It is the fixture of info -v.
+func extensionsImage(t *testing.T, name string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(filepath.Dir(name), "base.raw"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Create(name, 1<<20, &CreateOptions{BackingFile: "base.raw", BackingFormat: "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if _, err := img.WriteAt(bytes.Repeat([]byte("data"), 1024), 0); err != nil {
+		t.Fatal(err)
+	}
+	addBitmaps(t, img, []bitmap{
+		{name: "nightly", tableSize: 1, flags: bitmapAuto, typ: bitmapTypeDirty, granularityBits: 16},
+		{name: "crashed", tableSize: 1, flags: bitmapInUse, typ: bitmapTypeDirty, granularityBits: 20},
+	})
+
+	luks, err := img.allocClusters(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := make([]byte, 592)
+	copy(hdr, luksMagic)
+	binary.BigEndian.PutUint16(hdr[6:], 1)
+	copy(hdr[8:], "aes")
+	copy(hdr[40:], "xts-plain64")
+	copy(hdr[72:], "sha256")
+	binary.BigEndian.PutUint32(hdr[104:], 4096)
+	binary.BigEndian.PutUint32(hdr[108:], 64)
+	copy(hdr[168:], "5b1c3c9e-2f1a-4c43-9d8e-1f2a3b4c5d6e")
+	for i := 0; i < luksKeySlots; i++ {
+		state := uint32(0xdead)
+		if i < 2 {
+			state = luksKeySlotEnabled
+		}
+		binary.BigEndian.PutUint32(hdr[208+48*i:], state)
+	}
+	if _, err := img.fh.WriteAt(hdr, luks); err != nil {
+		t.Fatal(err)
+	}
+	loc := binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, uint64(luks)), uint64(img.clusterSize))
+	if err := img.AddExtension(HdrExtFullDiskCrypt, loc); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.AddExtension(HdrExtExternalDataFile, []byte("data.raw")); err != nil {
+		t.Fatal(err)
+	}
+	vendor := make([]byte, 100)
+	for i := range vendor {
+		vendor[i] = byte(i)
+	}
+	copy(vendor, "appliance v2")
+	if err := img.AddExtension(0x12345678, vendor); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// damagedExtensionsImage creates an image at name whose extension area is
+// overwritten with garbage, but for the backing file name stored after it:
+// that of base.raw, whose second half reads "base" and first half is
+// overlaid by "data" in the image
+func damagedExtensionsImage(t *testing.T, name string) {
+	t.Helper()
+	base := bytes.Repeat([]byte("base"), 1<<18)
+	if err := os.WriteFile(filepath.Join(filepath.Dir(name), "base.raw"), base, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Create(name, 1<<20, &CreateOptions{BackingFile: "base.raw", BackingFormat: "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte("data"), 1<<17), 0); err != nil {
+		t.Fatal(err)
+	}
+	at := int64(img.Header.HeaderLength)
+	img.Close()
+	fh, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	if _, err := fh.WriteAt(bytes.Repeat([]byte{0xff}, 16), at); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithoutExtensionParsing(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "damaged.qcow2")
+	damagedExtensionsImage(t, name)
+	var corrupt CorruptionError
+	if _, err := Open(name); !errors.As(err, &corrupt) || corrupt.Structure != StructExtension {
+		t.Fatalf("opened the damaged image: %v", err)
+	}
+	if _, err := OpenFile(name, os.O_RDWR, WithoutExtensionParsing()); !errors.Is(err, ErrExtensionsSkipped) {
+		t.Errorf("opened the image for writing without its extensions: %v", err)
+	}
+
+	img, err := Open(name, WithoutExtensionParsing())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	h := img.Header
+	if !h.ExtensionsSkipped || len(h.ExtHeaders) != 0 || h.BackingFile != "base.raw" || h.BackingFormat() != "" {
+		t.Errorf("got the header %+v", h)
+	}
+	// the backing file is probed as raw
+	buf := make([]byte, 8)
+	for off, want := range map[int64]string{0: "datadata", 1 << 19: "basebase"} {
+		if _, err := img.ReadAt(buf, off); err != nil || string(buf) != want {
+			t.Errorf("read %q at %d, %v", buf, off, err)
+		}
+	}
+	if _, err := img.Bitmaps(); err != ErrExtensionsSkipped {
+		t.Errorf("listed the bitmaps: %v", err)
+	}
+	if _, err := h.MarshalBinary(); err != ErrExtensionsSkipped {
+		t.Errorf("marshaled the header: %v", err)
+	}
+	if rep, err := img.Check(nil); err != nil || !rep.Clean() {
+		t.Errorf("check found %v, %v", rep.Findings, err)
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "extensions.qcow2")
+	extensionsImage(t, name)
+	img, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	if got := img.Header.ExternalDataFile(); got != "data.raw" {
+		t.Errorf("got the external data file %q", got)
+	}
+	var types []string
+	for _, e := range img.Header.ExtHeaders {
+		types = append(types, e.Type.String())
+	}
+	want := []string{"feature name table", "backing file format", "bitmaps", "full disk encryption", "external data file", "unknown"}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("got the extensions %q, want %q", types, want)
+	}
+
+	bitmaps, err := img.Bitmaps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bitmaps) != 2 || bitmaps[0].Name != "nightly" || bitmaps[0].Granularity != 64<<10 || !bitmaps[0].Auto || bitmaps[0].InUse ||
+		bitmaps[1].Name != "crashed" || bitmaps[1].Granularity != 1<<20 || !bitmaps[1].InUse || bitmaps[1].TableSize != 1 {
+		t.Errorf("got the bitmaps %+v", bitmaps)
+	}
+
+	luks, err := img.LUKSHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLUKS := LUKSHeader{Version: 1, CipherName: "aes", CipherMode: "xts-plain64", HashSpec: "sha256", KeyBytes: 64,
+		PayloadOffset: 4096, UUID: "5b1c3c9e-2f1a-4c43-9d8e-1f2a3b4c5d6e", ActiveKeySlots: 2}
+	if *luks != wantLUKS {
+		t.Errorf("got the LUKS header %+v, want %+v", *luks, wantLUKS)
+	}
+
+	// without them
+	plain, err := Create(filepath.Join(t.TempDir(), "plain.qcow2"), 1<<20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if bitmaps, err := plain.Bitmaps(); err != nil || bitmaps != nil {
+		t.Errorf("got the bitmaps %v, %v", bitmaps, err)
+	}
+	if _, err := plain.LUKSHeader(); err == nil {
+		t.Error("got a LUKS header without the extension")
+	}
+	if _, _, ok, err := plain.Header.CryptHeaderLocation(); ok || err != nil {
+		t.Errorf("got a LUKS header location: %v", err)
+	}
+
+	if *updateFixtures {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		gz, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		gz.Write(data)
+		gz.Close()
+		if err := os.WriteFile("testdata/extensions.qcow2.gz", buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
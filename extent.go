@@ -0,0 +1,171 @@
+package qcow2
+
+import "fmt"
+
+// ExtentType classifies a range of the guest disk by where its data comes from
+type ExtentType int
+
+const (
+	// ExtentUnallocated has no data anywhere in the backing chain, and reads as zeros
+	ExtentUnallocated ExtentType = iota
+	// ExtentZero is made of zero clusters
+	ExtentZero
+	// ExtentData is stored uncompressed at HostOffset
+	ExtentData
+	// ExtentCompressed is stored as compressed clusters
+	ExtentCompressed
+)
+
+func (et ExtentType) String() string {
+	switch et {
+	case ExtentUnallocated:
+		return "unallocated"
+	case ExtentZero:
+		return "zero"
+	case ExtentData:
+		return "data"
+	case ExtentCompressed:
+		return "compressed"
+	}
+	return fmt.Sprintf("ExtentType(%d)", int(et))
+}
+
+// Extent is a range of the guest disk mapped the same way
+type Extent struct {
+	Start  int64
+	Length int64
+	Type   ExtentType
+	// Depth is the position in the backing chain of the file providing the
+	// range, 0 being the image itself. Unallocated ranges have the depth of
+	// the last file consulted.
+	Depth int
+	// HostOffset is where an ExtentData range starts in the file at Depth
+	HostOffset int64
+}
+
+// ReadsAsZeros reports whether the range is known to read as zeros without
+// reading its data
+func (e Extent) ReadsAsZeros() bool {
+	return e.Type == ExtentUnallocated || e.Type == ExtentZero
+}
+
+// WalkExtents calls fn with the extents covering [off, off+length) of the
+// guest disk, in order, looking through the backing chain for the ranges the
+// image does not allocate. Adjacent clusters mapped the same way are merged.
+// The image is read locked while fn runs, so readers go on alongside it, but
+// fn must not call the methods that change the image, such as WriteAt.
+func (img *Image) WalkExtents(off, length int64, fn func(Extent) error) error {
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+	if off < 0 || off+length > img.Header.Size {
+		return fmt.Errorf("qcow2: extents of %d bytes at %d are beyond the virtual size %d", length, off, img.Header.Size)
+	}
+	var pending Extent
+	emit := func(e Extent) error {
+		if pending.Length > 0 && pending.Start+pending.Length == e.Start && pending.Type == e.Type &&
+			pending.Depth == e.Depth && (e.Type != ExtentData || pending.HostOffset+pending.Length == e.HostOffset) {
+			pending.Length += e.Length
+			return nil
+		}
+		if pending.Length > 0 {
+			if err := fn(pending); err != nil {
+				return err
+			}
+		}
+		pending = e
+		return nil
+	}
+	if err := img.walkExtents(img.l1, off, length, 0, emit); err != nil {
+		return err
+	}
+	if pending.Length > 0 {
+		return fn(pending)
+	}
+	return nil
+}
+
+// walkExtents emits the unmerged extents of [off, off+length) as mapped by
+// l1, at the given depth of the chain
+func (img *Image) walkExtents(l1 []uint64, off, length int64, depth int, emit func(Extent) error) error {
+	end := off + length
+	var unallocated int64 = -1 // start of a run of unallocated clusters
+	flush := func(upto int64) error {
+		if unallocated < 0 {
+			return nil
+		}
+		start := unallocated
+		unallocated = -1
+		return img.walkBacking(start, upto-start, depth, emit)
+	}
+	for off < end {
+		n := img.clusterSize - off&(img.clusterSize-1)
+		if n > end-off {
+			n = end - off
+		}
+		entry, _, err := img.l2Entry(l1, img.Header.L1TableOffset, off)
+		if err != nil {
+			return err
+		}
+		e := Extent{Start: off, Length: n, Depth: depth}
+		switch img.classify(entry) {
+		case clusterUnallocated:
+			if unallocated < 0 {
+				unallocated = off
+			}
+			if l1i := off >> img.clusterBits / img.l2Entries; l1i >= int64(len(l1)) || l1[l1i]&entryOffsetMask == 0 {
+				// without an L2 table, the rest of its range is unallocated too
+				n = min(end, (l1i+1)*img.l2Entries*img.clusterSize) - off
+			}
+			off += n
+			continue
+		case clusterZero:
+			e.Type = ExtentZero
+		case clusterCompressed:
+			e.Type = ExtentCompressed
+		default:
+			e.Type = ExtentData
+			e.HostOffset = int64(entry&entryOffsetMask) + off&(img.clusterSize-1)
+		}
+		if err := flush(off); err != nil {
+			return err
+		}
+		if err := emit(e); err != nil {
+			return err
+		}
+		off += n
+	}
+	return flush(end)
+}
+
+// walkBacking emits the extents of [off, off+length) from the backing file
+// of the image at depth
+func (img *Image) walkBacking(off, length int64, depth int, emit func(Extent) error) error {
+	inBacking := int64(0)
+	if off < img.backingSize {
+		inBacking = img.backingSize - off
+		if inBacking > length {
+			inBacking = length
+		}
+	}
+	if inBacking > 0 {
+		switch b := img.backing.(type) {
+		case *Image:
+			if err := b.walkExtents(b.l1, off, inBacking, depth+1, emit); err != nil {
+				return err
+			}
+		case *hostFile:
+			// a raw file is all data, as far as we can tell
+			if err := emit(Extent{Start: off, Length: inBacking, Type: ExtentData, Depth: depth + 1, HostOffset: off}); err != nil {
+				return err
+			}
+		}
+	}
+	if rest := length - inBacking; rest > 0 {
+		d := depth
+		if img.backing != nil {
+			d = depth + 1
+		}
+		return emit(Extent{Start: off + inBacking, Length: rest, Type: ExtentUnallocated, Depth: d})
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package qcow2
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// IncompatibleFeatures bits
+const (
+	IncompatDirty           = 1 << 0
+	IncompatCorrupt         = 1 << 1
+	IncompatExternalData    = 1 << 2
+	IncompatCompressionType = 1 << 3
+	IncompatExtendedL2      = 1 << 4
+)
+
+// CompatibleFeatures bits
+const (
+	CompatLazyRefcounts = 1 << 0
+)
+
+// supportedIncompatible are the incompatible features this package
+// implements. An image with any other incompatible bit set can not be read
+// correctly.
+const supportedIncompatible = IncompatDirty | IncompatCorrupt
+
+// AutoclearFeatures bits
+const (
+	AutoclearBitmaps     = 1 << 0
+	AutoclearRawExternal = 1 << 1
+)
+
+// FeatureType is which of the feature bitmasks a feature belongs to
+type FeatureType int
+
+const (
+	FeatureIncompatible FeatureType = 0
+	FeatureCompatible   FeatureType = 1
+	FeatureAutoclear    FeatureType = 2
+)
+
+func (ft FeatureType) String() string {
+	switch ft {
+	case FeatureIncompatible:
+		return "incompatible"
+	case FeatureCompatible:
+		return "compatible"
+	case FeatureAutoclear:
+		return "autoclear"
+	}
+	return fmt.Sprintf("FeatureType(%d)", int(ft))
+}
+
+// Feature is an entry of the feature name table
+type Feature struct {
+	Type FeatureType
+	Bit  int
+	Name string
+}
+
+// KnownFeatures are the feature bits defined by the qcow2 specification, as
+// qemu stores them in the feature name table
+var KnownFeatures = []Feature{
+	{FeatureIncompatible, 0, "dirty bit"},
+	{FeatureIncompatible, 1, "corrupt bit"},
+	{FeatureIncompatible, 2, "external data file"},
+	{FeatureIncompatible, 3, "compression type"},
+	{FeatureIncompatible, 4, "extended L2 entries"},
+	{FeatureCompatible, 0, "lazy refcounts"},
+	{FeatureAutoclear, 0, "bitmaps"},
+	{FeatureAutoclear, 1, "raw external data"},
+}
+
+// knownFeatureMask is the bitmask of KnownFeatures of type ft
+func knownFeatureMask(ft FeatureType) uint64 {
+	var mask uint64
+	for _, f := range KnownFeatures {
+		if f.Type == ft {
+			mask |= 1 << f.Bit
+		}
+	}
+	return mask
+}
+
+// UnsupportedFeaturesError is returned when opening an image with incompatible
+// features this package does not implement. Features are named by the feature
+// name table of the image, or else by KnownFeatures, when either has them.
+type UnsupportedFeaturesError struct {
+	Features []Feature
+}
+
+func (e UnsupportedFeaturesError) Error() string {
+	names := make([]string, len(e.Features))
+	for i, f := range e.Features {
+		if f.Name != "" {
+			names[i] = fmt.Sprintf("'%s'", f.Name)
+		} else {
+			names[i] = fmt.Sprintf("bit %d", f.Bit)
+		}
+	}
+	s := "qcow2: unsupported incompatible feature: "
+	if len(names) > 1 {
+		s = "qcow2: unsupported incompatible features: "
+	}
+	return s + strings.Join(names, ", ")
+}
+
+// unsupportedFeatures returns an UnsupportedFeaturesError when the image has
+// incompatible features this package does not implement
+func (h Header) unsupportedFeatures() error {
+	bits := h.IncompatibleFeatures &^ supportedIncompatible
+	if bits == 0 {
+		return nil
+	}
+	var e UnsupportedFeaturesError
+	for bit := 0; bit < 64; bit++ {
+		if bits&(1<<bit) == 0 {
+			continue
+		}
+		f := Feature{Type: FeatureIncompatible, Bit: bit}
+		for _, known := range append(h.FeatureNames(), KnownFeatures...) {
+			if known.Type == FeatureIncompatible && known.Bit == bit {
+				f.Name = known.Name
+				break
+			}
+		}
+		e.Features = append(e.Features, f)
+	}
+	return e
+}
+
+const featureNameSize = 46
+
+// FeatureNames decodes the feature name table extension, if present
+func (h Header) FeatureNames() []Feature {
+	var features []Feature
+	for _, e := range h.ExtHeaders {
+		if e.Type != HdrExtFeatureNameTable {
+			continue
+		}
+		for b := e.Data; len(b) >= 2+featureNameSize; b = b[2+featureNameSize:] {
+			name := b[2 : 2+featureNameSize]
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+			features = append(features, Feature{Type: FeatureType(b[0]), Bit: int(b[1]), Name: string(name)})
+		}
+	}
+	return features
+}
+
+// encodeFeatureNames is the feature name table extension data for features
+func encodeFeatureNames(features []Feature) []byte {
+	buf := make([]byte, 0, len(features)*(2+featureNameSize))
+	for _, f := range features {
+		entry := make([]byte, 2+featureNameSize)
+		entry[0], entry[1] = byte(f.Type), byte(f.Bit)
+		copy(entry[2:], f.Name)
+		buf = append(buf, entry...)
+	}
+	return buf
+}
@@ -0,0 +1,89 @@
+package qcow2
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// Flatten creates the standalone image dst, with no backing file, holding
+// the guest visible contents of the image read through its backing chain.
+// What is unallocated throughout the chain stays unallocated, and zero
+// clusters stay zero clusters when dst is a version 3 image. With
+// opts.KeepCompressed, compressed clusters stay compressed. On failure the
+// output file is removed.
+func (img *Image) Flatten(dst string, opts *ConvertOptions) error {
+	var o ConvertOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.BackingFile, o.BackingFormat = "", ""
+	out, err := o.create(dst, img.Size())
+	if err != nil {
+		return err
+	}
+	if err := out.copyFlattened(img, &o); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if opts != nil {
+		opts.Deduplicated = o.Deduplicated
+	}
+	return out.Close()
+}
+
+// copyFlattened copies the data of src into the image, and marks as zero
+// clusters those that src has as zero clusters
+func (img *Image) copyFlattened(src *Image, opts *ConvertOptions) error {
+	jobs := func() func() (convertRange, bool, error) {
+		next := src.extents()
+		var prev int64
+		return chunkJobs(func() (convertRange, bool, error) {
+			for {
+				e, ok, err := next()
+				if err != nil || !ok {
+					return convertRange{}, ok, err
+				}
+				end := e.Start + e.Length
+				switch e.Type {
+				case ExtentUnallocated:
+					continue
+				case ExtentZero:
+					// without zero clusters, what is not written reads as
+					// zeros anyway
+					if img.Header.Version < 3 {
+						continue
+					}
+					// only whole clusters, or the last one of the disk
+					start := img.alignUp(e.Start)
+					if end != img.Size() {
+						end &^= img.clusterSize - 1
+					}
+					if start < end {
+						return convertRange{off: start, n: end - start, zero: true}, true, nil
+					}
+					continue
+				}
+				// in whole clusters of the output, which may differ from those of src
+				start := max(e.Start&^(img.clusterSize-1), prev)
+				end = min(img.alignUp(end), src.Size())
+				if start < end {
+					prev = end
+					return convertRange{off: start, n: end - start, compress: opts.KeepCompressed && e.Type == ExtentCompressed}, true, nil
+				}
+			}
+		}, img.chunkSize())
+	}
+	total, err := countJobs(jobs())
+	if err != nil {
+		return err
+	}
+	return img.writeRanges(jobs(), opts, opts.progress(total), func(_ context.Context, r convertRange) ([]byte, error) {
+		p := make([]byte, r.n)
+		if m, err := src.ReadAt(p, r.off); err != nil && !(err == io.EOF && int64(m) == r.n) {
+			return nil, err
+		}
+		return p, nil
+	}, opts.workers(src.Size()))
+}
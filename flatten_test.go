@@ -0,0 +1,77 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFlatten(t *testing.T) {
+	const size = 1 << 20
+	dir := t.TempDir()
+	base := backedImage(t, filepath.Join(dir, "base.qcow2"), size, "", "")
+	if _, err := base.WriteAt(bytes.Repeat([]byte("base"), 50000), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := base.WriteCompressedAt(bytes.Repeat([]byte("packed"), 4096)[:4096], 512<<10); err != nil {
+		t.Fatal(err)
+	}
+	base.Close()
+	img := backedImage(t, filepath.Join(dir, "img.qcow2"), size, "base.qcow2", "qcow2")
+	if _, err := img.WriteAt([]byte("overlay"), 100000); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.writeZeroes(40960, 8192); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keep := range []bool{false, true} {
+		name := filepath.Join(dir, "flat.qcow2")
+		if err := img.Flatten(name, &ConvertOptions{CreateOptions: CreateOptions{ClusterSize: 4096}, KeepCompressed: keep}); err != nil {
+			t.Fatal(err)
+		}
+		flat, err := Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flat.Header.BackingFile != "" {
+			t.Errorf("expected no backing file, got %q", flat.Header.BackingFile)
+		}
+		if res, err := Compare(img, flat); err != nil || !res.Identical {
+			t.Errorf("expected the flattened image to be identical, got %+v: %v", res, err)
+		}
+		verifyRefcounts(t, flat)
+		types := map[ExtentType]int64{}
+		if err := flat.WalkExtents(0, flat.Size(), func(e Extent) error {
+			types[e.Type] += e.Length
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		compressed := int64(0)
+		if keep {
+			compressed = 4096
+		}
+		if types[ExtentZero] != 8192 || types[ExtentCompressed] != compressed || types[ExtentData] != 200000/4096*4096+4096-8192+4096-compressed {
+			t.Errorf("keep compressed %v: unexpected extents %v", keep, types)
+		}
+
+		var used int64
+		for _, name := range []string{"base.qcow2", "img.qcow2"} {
+			fi, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			used += fi.Size()
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > used {
+			t.Errorf("expected at most %d bytes, got %d", used, fi.Size())
+		}
+		flat.Close()
+	}
+}
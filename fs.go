@@ -0,0 +1,239 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// FS returns a read-only file system of the image, holding the guest disk as
+// disk.raw, the disk of each internal snapshot as snapshots/ID-NAME.raw and
+// the header as info.json, with any "/" of a snapshot name replaced by "_".
+// The files are read through ReadAt, and implement io.ReaderAt and
+// io.Seeker. The snapshots and the header are those of when FS is called;
+// the image must stay open while the file system is in use.
+func (img *Image) FS() fs.FS {
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+	var mtime time.Time
+	if img.fh != nil {
+		if fi, err := img.fh.Stat(); err == nil {
+			mtime = fi.ModTime()
+		}
+	}
+	info, err := json.MarshalIndent(img.Header, "", "    ")
+	if err != nil {
+		// the header is plain data
+		panic(err)
+	}
+	info = append(info, '\n')
+
+	snapshots := &fsEntry{name: "snapshots", mode: fs.ModeDir | 0o555, modTime: mtime}
+	for _, s := range img.snapshots {
+		size := s.DiskSize
+		if size == 0 {
+			size = img.Header.Size
+		}
+		id := s.ID
+		snapshots.children = append(snapshots.children, &fsEntry{
+			name:    strings.ReplaceAll(s.ID+"-"+s.Name, "/", "_") + ".raw",
+			mode:    0o444,
+			size:    size,
+			modTime: s.Date,
+			open: func() (io.ReaderAt, error) {
+				return img.SnapshotView(id)
+			},
+		})
+	}
+	slices.SortFunc(snapshots.children, func(a, b *fsEntry) int { return strings.Compare(a.name, b.name) })
+	return &imageFS{root: &fsEntry{name: ".", mode: fs.ModeDir | 0o555, modTime: mtime, children: []*fsEntry{
+		{name: "disk.raw", mode: 0o444, size: img.Header.Size, modTime: mtime, open: func() (io.ReaderAt, error) { return img, nil }},
+		{name: "info.json", mode: 0o444, size: int64(len(info)), modTime: mtime, open: func() (io.ReaderAt, error) { return bytes.NewReader(info), nil }},
+		snapshots,
+	}}}
+}
+
+// imageFS is the file system returned by Image.FS
+type imageFS struct {
+	root *fsEntry
+}
+
+// fsEntry is a file or directory of an imageFS. Directories have children,
+// sorted by name, and files are read from what open returns.
+type fsEntry struct {
+	name     string
+	mode     fs.FileMode
+	size     int64
+	modTime  time.Time
+	open     func() (io.ReaderAt, error)
+	children []*fsEntry
+}
+
+func (e *fsEntry) Name() string               { return e.name }
+func (e *fsEntry) Size() int64                { return e.size }
+func (e *fsEntry) Mode() fs.FileMode          { return e.mode }
+func (e *fsEntry) ModTime() time.Time         { return e.modTime }
+func (e *fsEntry) IsDir() bool                { return e.mode.IsDir() }
+func (e *fsEntry) Sys() any                   { return nil }
+func (e *fsEntry) Type() fs.FileMode          { return e.mode.Type() }
+func (e *fsEntry) Info() (fs.FileInfo, error) { return e, nil }
+
+func (fsys *imageFS) Open(name string) (fs.File, error) {
+	e, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.IsDir() {
+		return &fsDir{e: e}, nil
+	}
+	r, err := e.open()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &fsFile{e: e, r: io.NewSectionReader(r, 0, e.size)}, nil
+}
+
+func (fsys *imageFS) Stat(name string) (fs.FileInfo, error) {
+	return fsys.lookup("stat", name)
+}
+
+func (fsys *imageFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries := make([]fs.DirEntry, len(e.children))
+	for i, c := range e.children {
+		entries[i] = c
+	}
+	return entries, nil
+}
+
+func (fsys *imageFS) lookup(op, name string) (*fsEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	e := fsys.root
+	if name == "." {
+		return e, nil
+	}
+next:
+	for _, elem := range strings.Split(path.Clean(name), "/") {
+		for _, c := range e.children {
+			if c.name == elem {
+				e = c
+				continue next
+			}
+		}
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+// fsFile is an open file of an imageFS
+type fsFile struct {
+	e      *fsEntry
+	r      *io.SectionReader
+	closed bool
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, f.err("stat", fs.ErrClosed)
+	}
+	return f.e, nil
+}
+
+func (f *fsFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, f.err("read", fs.ErrClosed)
+	}
+	return f.r.Read(p)
+}
+
+func (f *fsFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, f.err("read", fs.ErrClosed)
+	}
+	return f.r.ReadAt(p, off)
+}
+
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, f.err("seek", fs.ErrClosed)
+	}
+	return f.r.Seek(offset, whence)
+}
+
+func (f *fsFile) Close() error {
+	if f.closed {
+		return f.err("close", fs.ErrClosed)
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *fsFile) err(op string, err error) error {
+	return &fs.PathError{Op: op, Path: f.e.name, Err: err}
+}
+
+// fsDir is an open directory of an imageFS
+type fsDir struct {
+	e      *fsEntry
+	pos    int
+	closed bool
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) {
+	if d.closed {
+		return nil, d.err("stat", fs.ErrClosed)
+	}
+	return d.e, nil
+}
+
+func (d *fsDir) Read([]byte) (int, error) {
+	if d.closed {
+		return 0, d.err("read", fs.ErrClosed)
+	}
+	return 0, d.err("read", errors.New("is a directory"))
+}
+
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, d.err("readdir", fs.ErrClosed)
+	}
+	rest := d.e.children[d.pos:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	d.pos += len(rest)
+	entries := make([]fs.DirEntry, len(rest))
+	for i, c := range rest {
+		entries[i] = c
+	}
+	return entries, nil
+}
+
+func (d *fsDir) Close() error {
+	if d.closed {
+		return d.err("close", fs.ErrClosed)
+	}
+	d.closed = true
+	return nil
+}
+
+func (d *fsDir) err(op string, err error) error {
+	return &fs.PathError{Op: op, Path: d.e.name, Err: err}
+}
@@ -0,0 +1,113 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	img, err := Create(filepath.Join(t.TempDir(), "disk.qcow2"), 1<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	a := bytes.Repeat([]byte("A"), 3*4096)
+	if _, err := img.WriteAt(a, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.CreateSnapshot("pattern/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Resize(2 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte("B"), 2*4096), 2*4096); err != nil {
+		t.Fatal(err)
+	}
+	snapA := make([]byte, 1<<20)
+	copy(snapA[4096:], a)
+	disk := make([]byte, 2<<20)
+	if _, err := img.ReadAt(disk, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := img.FS()
+	if err := fstest.TestFS(fsys, "disk.raw", "info.json", "snapshots/1-pattern_a.raw"); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string][]byte{"disk.raw": disk, "snapshots/1-pattern_a.raw": snapA} {
+		got, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s does not hold the disk", name)
+		}
+	}
+	info, err := fs.ReadFile(fsys, "info.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h Header
+	if err := json.Unmarshal(info, &h); err != nil {
+		t.Fatal(err)
+	}
+	if h.Size != 2<<20 || h.NbSnapshots != 1 {
+		t.Errorf("info.json: got size %d and %d snapshots", h.Size, h.NbSnapshots)
+	}
+	fi, err := fs.Stat(fsys, "snapshots/1-pattern_a.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap := img.Snapshots()[0]; fi.Size() != 1<<20 || !fi.ModTime().Equal(snap.Date) {
+		t.Errorf("snapshot: got size %d and time %v, want %d and %v", fi.Size(), fi.ModTime(), 1<<20, snap.Date)
+	}
+
+	// opens of the same file are independent of each other
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, err := fsys.Open("disk.raw")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer f.Close()
+			got, err := io.ReadAll(f)
+			if err != nil || !bytes.Equal(got, disk) {
+				t.Errorf("concurrent read of disk.raw: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	f, err := fsys.Open("disk.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(make([]byte, 1)); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("reading after close: got %v, want fs.ErrClosed", err)
+	}
+	if err := f.Close(); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("closing twice: got %v, want fs.ErrClosed", err)
+	}
+	if f, err = fsys.Open("disk.raw"); err != nil {
+		t.Fatalf("opening after close: %v", err)
+	}
+	f.Close()
+	if _, err := fsys.Open("snapshots/2-missing.raw"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("opening a missing snapshot: got %v, want fs.ErrNotExist", err)
+	}
+}
@@ -0,0 +1,149 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The fuzz targets hold that no input makes the parser or the metadata walkers
+// panic or allocate without bound, only fail. Regressions they found are kept
+// in testdata/fuzz.
+
+// qemuHeader is the header cluster of the image qemu made for the tests
+func qemuHeader(f *testing.F) []byte {
+	fh, err := os.Open(testQcowFile)
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer fh.Close()
+	gz, err := gzip.NewReader(fh)
+	if err != nil {
+		f.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	if _, err := io.ReadFull(gz, buf); err != nil {
+		f.Fatal(err)
+	}
+	return buf
+}
+
+// fuzzImages are small images of the shapes qemu makes, for seeds
+func fuzzImages(f *testing.F) [][]byte {
+	var seeds [][]byte
+	for _, opts := range []*CreateOptions{
+		{ClusterSize: 512},
+		{ClusterSize: 512, Version: 2},
+		{ClusterSize: 512, RefcountBits: 1},
+		{ClusterSize: 512, RefcountBits: 64},
+		{ClusterSize: 4096},
+	} {
+		name := filepath.Join(f.TempDir(), "seed.qcow2")
+		img, err := Create(name, 64<<10, opts)
+		if err != nil {
+			f.Fatal(err)
+		}
+		if _, err := img.WriteAt(bytes.Repeat([]byte("seed"), 300), 1000); err != nil {
+			f.Fatal(err)
+		}
+		if _, err := img.WriteCompressedAt(bytes.Repeat([]byte("z"), int(img.clusterSize)), 16<<10); err != nil {
+			f.Fatal(err)
+		}
+		if opts.ClusterSize == 4096 {
+			// the extensions do not fit in the header cluster of the others
+			addBitmaps(f, img, []bitmap{{name: "b0", tableSize: 1, typ: bitmapTypeDirty, granularityBits: 16, flags: bitmapAuto}})
+			if err := img.SetMetadata(map[string]string{"key": "value"}); err != nil {
+				f.Fatal(err)
+			}
+		}
+		if opts.RefcountBits != 1 {
+			if err := img.CreateSnapshot("snap"); err != nil {
+				f.Fatal(err)
+			}
+			if _, err := img.WriteAt([]byte("after the snapshot"), 1000); err != nil {
+				f.Fatal(err)
+			}
+		}
+		if err := img.Close(); err != nil {
+			f.Fatal(err)
+		}
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		seeds = append(seeds, buf)
+	}
+	return seeds
+}
+
+// openFuzzImage opens data as an image, or returns nil when it is not one
+func openFuzzImage(t *testing.T, data []byte) *Image {
+	name := filepath.Join(t.TempDir(), "fuzz.qcow2")
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Open(name, WithNoLock(), WithNoBacking(), WithDamagedSnapshots(), WithIgnoreUnknownIncompatible())
+	if err != nil {
+		return nil
+	}
+	t.Cleanup(func() { img.Close() })
+	return img
+}
+
+func FuzzParseHeader(f *testing.F) {
+	f.Add(qemuHeader(f))
+	for _, seed := range fuzzImages(f) {
+		f.Add(seed[:512])
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, err := ReadHeader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		_ = h.unsupportedFeatures()
+		if _, err := h.MarshalBinary(); err != nil {
+			return
+		}
+		h.readBitmapsExt()
+		h.Metadata()
+		h.BackingFormat()
+	})
+}
+
+func FuzzOpenAndWalk(f *testing.F) {
+	for _, seed := range fuzzImages(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		img := openFuzzImage(t, data)
+		if img == nil {
+			return
+		}
+		img.Check(&CheckOptions{Deep: true})
+		img.WalkExtents(0, img.Size(), func(Extent) error { return nil })
+		img.Metadata()
+		for _, s := range img.Snapshots() {
+			if view, err := img.SnapshotView(s.ID); err == nil {
+				view.WalkExtents(0, view.Size(), func(Extent) error { return nil })
+				view.Close()
+			}
+		}
+	})
+}
+
+func FuzzReadAt(f *testing.F) {
+	for _, seed := range fuzzImages(f) {
+		f.Add(seed, int64(0), uint16(4096))
+		f.Add(seed, int64(16<<10)-7, uint16(600))
+	}
+	f.Fuzz(func(t *testing.T, data []byte, off int64, n uint16) {
+		img := openFuzzImage(t, data)
+		if img == nil {
+			return
+		}
+		img.ReadAt(make([]byte, n), off)
+	})
+}
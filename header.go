@@ -0,0 +1,375 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+var (
+	// ErrBadMagic is returned when the input does not start with the qcow2 Magic
+	ErrBadMagic = errors.New("qcow2: does not appear to be a qcow2 image")
+)
+
+const (
+	minClusterBits = 9
+	maxClusterBits = 21
+)
+
+// UnsupportedVersionError is returned for images that are neither version 2 nor 3
+type UnsupportedVersionError struct {
+	Version Version
+}
+
+func (e UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("qcow2: unsupported version %d", e.Version)
+}
+
+// ClusterSize is the size in bytes of each cluster of the image
+func (h Header) ClusterSize() int64 {
+	return 1 << uint(h.ClusterBits)
+}
+
+// ReadHeader parses the header from the start of r, including the version 3
+// fields, the header extensions and the backing file name. Only sequential
+// reads are performed, so r need not be seekable.
+func ReadHeader(r io.Reader) (*Header, error) {
+	return readHeader(r, false)
+}
+
+// ReadHeaderWithoutExtensions parses the header from the start of r as
+// ReadHeader, but for its header extensions, which are left unparsed, so that
+// the fixed fields and the backing file name of an image whose extension area
+// is damaged can still be read. The header has ExtensionsSkipped set, and
+// says nothing of what the extensions hold, like the backing format.
+func ReadHeaderWithoutExtensions(r io.Reader) (*Header, error) {
+	return readHeader(r, true)
+}
+
+func readHeader(r io.Reader, skipExtensions bool) (*Header, error) {
+	buf := make([]byte, V2HeaderSize)
+	// a file too short for a header is no image either, when its start says
+	// so
+	if n, err := io.ReadFull(r, buf); n >= len(Magic) && !bytes.Equal(buf[:4], Magic) {
+		return nil, ErrBadMagic
+	} else if err != nil {
+		return nil, err
+	}
+
+	// field is the 32 bit field of the header at off, in b. A value that does
+	// not fit an int, as on 32 bit platforms, is corrupt, and the first such
+	// is fieldErr.
+	var fieldErr error
+	field := func(b []byte, off int64) int {
+		v := binary.BigEndian.Uint32(b)
+		if uint64(v) > math.MaxInt {
+			if fieldErr == nil {
+				fieldErr = headerField(off, uint64(v), "value %d does not fit an int", v)
+			}
+			return 0
+		}
+		return int(v)
+	}
+	h := Header{
+		Version:               Version(field(buf[4:8], 4)),
+		BackingFileOffset:     be64(buf[8:16]),
+		BackingFileSize:       field(buf[16:20], 16),
+		ClusterBits:           field(buf[20:24], 20),
+		Size:                  be64(buf[24:32]),
+		CryptMethod:           CryptMethod(field(buf[32:36], 32)),
+		L1Size:                field(buf[36:40], 36),
+		L1TableOffset:         be64(buf[40:48]),
+		RefcountTableOffset:   be64(buf[48:56]),
+		RefcountTableClusters: field(buf[56:60], 56),
+		NbSnapshots:           field(buf[60:64], 60),
+		SnapshotsOffset:       be64(buf[64:72]),
+		RefcountOrder:         4,  // v2 always has 16 bit refcounts
+		HeaderLength:          72, // v2 this is a standard length
+	}
+	if fieldErr != nil {
+		return nil, fieldErr
+	}
+	if !h.Version.supported() {
+		return nil, UnsupportedVersionError{Version: h.Version}
+	}
+	if h.ClusterBits < minClusterBits || h.ClusterBits > maxClusterBits {
+		return nil, headerField(20, uint64(h.ClusterBits), "invalid cluster bits %d", h.ClusterBits)
+	}
+	if h.Size < 0 {
+		return nil, headerField(24, uint64(h.Size), "invalid size %d", h.Size)
+	}
+	pos := int64(V2HeaderSize)
+
+	if h.Version == 3 {
+		buf = buf[:V3HeaderSize]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		pos += int64(V3HeaderSize)
+
+		h.IncompatibleFeatures = binary.BigEndian.Uint64(buf[0:8])
+		h.CompatibleFeatures = binary.BigEndian.Uint64(buf[8:16])
+		h.AutoclearFeatures = binary.BigEndian.Uint64(buf[16:24])
+		h.RefcountOrder = field(buf[24:28], 96)
+		h.HeaderLength = field(buf[28:32], 100)
+		if fieldErr != nil {
+			return nil, fieldErr
+		}
+
+		if h.HeaderLength < V2HeaderSize+V3HeaderSize || int64(h.HeaderLength) > h.ClusterSize() {
+			return nil, headerField(100, uint64(h.HeaderLength), "invalid header length %d", h.HeaderLength)
+		}
+		if h.RefcountOrder > 6 {
+			return nil, headerField(96, uint64(h.RefcountOrder), "invalid refcount order %d", h.RefcountOrder)
+		}
+		if extra := int64(h.HeaderLength) - pos; extra > 0 {
+			h.ExtraHeader = make([]byte, extra)
+			if _, err := io.ReadFull(r, h.ExtraHeader); err != nil {
+				return nil, err
+			}
+			pos += extra
+		}
+	}
+
+	// Process the extension header data, which is confined to the first cluster
+	h.ExtensionsSkipped = skipExtensions
+	for !skipExtensions {
+		if pos+8 > h.ClusterSize() {
+			return nil, CorruptionError{Offset: pos, Structure: StructExtension, Index: int64(len(h.ExtHeaders)), Reason: "header extensions exceed the first cluster, with no end marker"}
+		}
+		if _, err := io.ReadFull(r, buf[:8]); err != nil {
+			return nil, err
+		}
+		pos += 8
+		t := HeaderExtensionType(binary.BigEndian.Uint32(buf[:4]))
+		if t == HdrExtEndOfArea {
+			break
+		}
+		// the size is checked as read, before it is an int, which a size of
+		// 2 GiB or more would overflow on 32 bit platforms
+		size := int64(binary.BigEndian.Uint32(buf[4:8]))
+		padded := (size + 7) &^ 7
+		if pos+padded > h.ClusterSize() {
+			return nil, CorruptionError{Offset: pos - 8, Structure: StructExtension, Index: int64(len(h.ExtHeaders)), Value: uint64(size),
+				Reason: fmt.Sprintf("header extension %#x of %d bytes exceeds the first cluster", uint32(t), size)}
+		}
+		exthdr := ExtHeader{
+			Type: t,
+			Size: int(size),
+		}
+		data := make([]byte, padded)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		pos += padded
+		exthdr.Data = data[:exthdr.Size:exthdr.Size]
+		exthdr.padding = data[exthdr.Size:]
+		h.ExtHeaders = append(h.ExtHeaders, exthdr)
+	}
+
+	if h.BackingFileOffset != 0 {
+		if h.BackingFileSize > 1023 {
+			return nil, headerField(16, uint64(h.BackingFileSize), "backing file name of %d bytes is longer than 1023", h.BackingFileSize)
+		}
+		if h.BackingFileOffset < pos || h.BackingFileOffset+int64(h.BackingFileSize) > h.ClusterSize() {
+			return nil, headerField(8, uint64(h.BackingFileOffset), "invalid backing file name at %d (%d bytes)", h.BackingFileOffset, h.BackingFileSize)
+		}
+		h.gap = make([]byte, h.BackingFileOffset-pos)
+		if _, err := io.ReadFull(r, h.gap); err != nil {
+			return nil, err
+		}
+		name := make([]byte, h.BackingFileSize)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+		h.BackingFile = string(name)
+		pos = h.BackingFileOffset + int64(h.BackingFileSize)
+	}
+
+	// keep the rest of the first cluster, so it can be written back unchanged
+	h.layoutEnd = pos
+	h.trailer = make([]byte, h.ClusterSize()-pos)
+	n, err := io.ReadFull(r, h.trailer)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	h.trailer = h.trailer[:n]
+
+	return &h, nil
+}
+
+// ExtensionOffset is the offset in the file of the header extension i, that
+// is of its type field, with its data 8 bytes further
+func (h Header) ExtensionOffset(i int) int64 {
+	off := int64(h.HeaderLength)
+	for _, e := range h.ExtHeaders[:i] {
+		off += 8 + int64(len(e.Data)+7)&^7
+	}
+	return off
+}
+
+// BackingFormat is the format named by the backing file format extension, if present
+func (h Header) BackingFormat() string {
+	for _, e := range h.ExtHeaders {
+		if e.Type == HdrExtBackingFileFormat {
+			return string(e.Data)
+		}
+	}
+	return ""
+}
+
+// AddExtension stores a header extension of type t, replacing the data of an
+// existing extension of that type in place, or appending it after the others
+func (h *Header) AddExtension(t HeaderExtensionType, data []byte) error {
+	if t == HdrExtEndOfArea {
+		return errors.New("qcow2: the end of area marker is not an extension")
+	}
+	mark := h.backingFollowsExtensions()
+	exthdr := ExtHeader{Type: t, Size: len(data), Data: append([]byte(nil), data...)}
+	replaced := false
+	for i, e := range h.ExtHeaders {
+		if e.Type == t {
+			h.ExtHeaders[i] = exthdr
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		h.ExtHeaders = append(h.ExtHeaders, exthdr)
+	}
+	h.placeBackingFile(mark)
+	return nil
+}
+
+// RemoveExtension drops every header extension of type t, reporting whether
+// there were any
+func (h *Header) RemoveExtension(t HeaderExtensionType) bool {
+	mark := h.backingFollowsExtensions()
+	exts := h.ExtHeaders[:0]
+	for _, e := range h.ExtHeaders {
+		if e.Type != t {
+			exts = append(exts, e)
+		}
+	}
+	removed := len(exts) != len(h.ExtHeaders)
+	h.ExtHeaders = exts
+	h.placeBackingFile(mark)
+	return removed
+}
+
+// backingFollowsExtensions reports whether the backing file name is stored
+// directly after the end of area marker, as qemu lays it out
+func (h Header) backingFollowsExtensions() bool {
+	return h.BackingFileOffset != 0 && h.BackingFileOffset == h.extensionsEnd()
+}
+
+// placeBackingFile keeps the backing file name directly after the extensions
+// when it was there before, and moves it out of their way otherwise
+func (h *Header) placeBackingFile(follows bool) {
+	if h.BackingFileOffset == 0 {
+		return
+	}
+	if end := h.extensionsEnd(); follows || h.BackingFileOffset < end {
+		h.BackingFileOffset = end
+	}
+}
+
+// MarshalBinary encodes the header as stored at the start of the image: the
+// fixed fields, the header extensions and the backing file name. For a header
+// parsed by ReadHeader, the padding and any other bytes of the first cluster
+// are reproduced as they were read, so that an unmodified header encodes to
+// exactly the bytes it was parsed from.
+func (h Header) MarshalBinary() ([]byte, error) {
+	if h.ExtensionsSkipped {
+		return nil, ErrExtensionsSkipped
+	}
+	buf := h.fixedBytes()
+	var hdr [8]byte
+	for _, e := range h.ExtHeaders {
+		binary.BigEndian.PutUint32(hdr[:4], uint32(e.Type))
+		binary.BigEndian.PutUint32(hdr[4:], uint32(len(e.Data)))
+		buf = append(buf, hdr[:]...)
+		buf = append(buf, e.Data...)
+		if pad := (8 - len(e.Data)%8) % 8; len(e.padding) == pad {
+			buf = append(buf, e.padding...)
+		} else {
+			buf = append(buf, make([]byte, pad)...)
+		}
+	}
+	buf = append(buf, make([]byte, 8)...) // HdrExtEndOfArea
+
+	if h.BackingFileOffset != 0 {
+		gap := h.BackingFileOffset - int64(len(buf))
+		if gap < 0 {
+			return nil, fmt.Errorf("qcow2: backing file name at %d overlaps the header extensions ending at %d", h.BackingFileOffset, len(buf))
+		}
+		if int64(len(h.gap)) == gap {
+			buf = append(buf, h.gap...)
+		} else {
+			buf = append(buf, make([]byte, gap)...)
+		}
+		buf = append(buf, h.BackingFile...)
+	}
+	if int64(len(buf)) > h.ClusterSize() {
+		return nil, fmt.Errorf("qcow2: header of %d bytes does not fit in the first cluster of %d bytes", len(buf), h.ClusterSize())
+	}
+	if int64(len(buf)) == h.layoutEnd {
+		// whatever followed the header when it was read is kept as it was
+		buf = append(buf, h.trailer...)
+	}
+	return buf, nil
+}
+
+// extensionsEnd is the offset just past the end-of-area marker
+func (h Header) extensionsEnd() int64 {
+	end := int64(h.HeaderLength)
+	for _, e := range h.ExtHeaders {
+		end += 8 + int64(len(e.Data)+7)&^7
+	}
+	return end + 8
+}
+
+// fixedBytes is the on-disk encoding of the fixed header fields, up to the
+// end of the version 3 fields (and any extra header bytes)
+func (h Header) fixedBytes() []byte {
+	buf := make([]byte, V2HeaderSize, V2HeaderSize+V3HeaderSize+len(h.ExtraHeader))
+	copy(buf[:4], Magic)
+	binary.BigEndian.PutUint32(buf[4:8], uint32(h.Version))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(h.BackingFileOffset))
+	binary.BigEndian.PutUint32(buf[16:20], uint32(h.BackingFileSize))
+	binary.BigEndian.PutUint32(buf[20:24], uint32(h.ClusterBits))
+	binary.BigEndian.PutUint64(buf[24:32], uint64(h.Size))
+	binary.BigEndian.PutUint32(buf[32:36], uint32(h.CryptMethod))
+	binary.BigEndian.PutUint32(buf[36:40], uint32(h.L1Size))
+	binary.BigEndian.PutUint64(buf[40:48], uint64(h.L1TableOffset))
+	binary.BigEndian.PutUint64(buf[48:56], uint64(h.RefcountTableOffset))
+	binary.BigEndian.PutUint32(buf[56:60], uint32(h.RefcountTableClusters))
+	binary.BigEndian.PutUint32(buf[60:64], uint32(h.NbSnapshots))
+	binary.BigEndian.PutUint64(buf[64:72], uint64(h.SnapshotsOffset))
+	if h.Version < 3 {
+		return buf
+	}
+
+	buf = buf[:V2HeaderSize+V3HeaderSize]
+	binary.BigEndian.PutUint64(buf[72:80], h.IncompatibleFeatures)
+	binary.BigEndian.PutUint64(buf[80:88], h.CompatibleFeatures)
+	binary.BigEndian.PutUint64(buf[88:96], h.AutoclearFeatures)
+	binary.BigEndian.PutUint32(buf[96:100], uint32(h.RefcountOrder))
+	binary.BigEndian.PutUint32(buf[100:104], uint32(h.HeaderLength))
+	return append(buf, h.ExtraHeader...)
+}
+
+func be16(b []byte) int {
+	return int(binary.BigEndian.Uint16(b))
+}
+
+func be32(b []byte) int {
+	return int(binary.BigEndian.Uint32(b))
+}
+
+func be64(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b))
+}
@@ -0,0 +1,473 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// vendorExtension is an extension type qemu does not know
+const vendorExtension HeaderExtensionType = 0x12345678
+
+func TestExtensionRoundTrip(t *testing.T) {
+	img := tempImage(t)
+
+	// write a vendor extension by hand, ahead of the end of area marker
+	ext := make([]byte, 24)
+	binary.BigEndian.PutUint32(ext[0:4], uint32(vendorExtension))
+	binary.BigEndian.PutUint32(ext[4:8], 5)
+	copy(ext[8:], "hello\x00\x00\x00")
+	if _, err := img.fh.WriteAt(ext, int64(img.Header.HeaderLength)); err != nil {
+		t.Fatal(err)
+	}
+	raw := make([]byte, img.clusterSize)
+	if _, err := img.fh.ReadAt(raw, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := ReadHeader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.ExtHeaders) != 1 || h.ExtHeaders[0].Type != vendorExtension || string(h.ExtHeaders[0].Data) != "hello" {
+		t.Fatalf("unexpected extensions %#v", h.ExtHeaders)
+	}
+	orig, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(orig, raw[:len(orig)]) {
+		t.Errorf("re-encoded header differs:\n%x\n%x", orig, raw[:len(orig)])
+	}
+
+	// adding then removing keeps the order and layout of the others
+	if err := h.AddExtension(0xabcd, []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AddExtension(vendorExtension, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if h.ExtHeaders[0].Type != vendorExtension || h.ExtHeaders[1].Type != 0xabcd {
+		t.Errorf("extension order changed: %#v", h.ExtHeaders)
+	}
+	if !h.RemoveExtension(0xabcd) {
+		t.Error("expected the extension to be removed")
+	}
+	buf, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, orig) {
+		t.Errorf("header differs after adding and removing an extension:\n%x\n%x", buf, orig)
+	}
+
+	if err := h.AddExtension(0xabcd, make([]byte, img.clusterSize)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.MarshalBinary(); err == nil {
+		t.Error("expected an error for extensions beyond the first cluster")
+	}
+}
+
+func TestExtensionTypes(t *testing.T) {
+	img := tempImage(t)
+	defer img.Close()
+	const high HeaderExtensionType = 0xfedcba98
+	parse := func(size uint32) (*Header, error) {
+		t.Helper()
+		ext := make([]byte, 24)
+		binary.BigEndian.PutUint32(ext[0:4], uint32(high))
+		binary.BigEndian.PutUint32(ext[4:8], size)
+		copy(ext[8:], "32 bits!")
+		raw := make([]byte, img.clusterSize)
+		if _, err := img.fh.ReadAt(raw, 0); err != nil {
+			t.Fatal(err)
+		}
+		copy(raw[img.Header.HeaderLength:], ext)
+		return ReadHeader(bytes.NewReader(raw))
+	}
+
+	// types with the top bit set, like that of the backing file format, read
+	// as the same on every platform
+	h, err := parse(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.ExtHeaders) != 1 || h.ExtHeaders[0].Type != high || h.ExtHeaders[0].Type.String() != "unknown" || string(h.ExtHeaders[0].Data) != "32 bits!" {
+		t.Fatalf("unexpected extensions %#v", h.ExtHeaders)
+	}
+	if HdrExtBackingFileFormat.String() != "backing file format" || uint32(HdrExtBackingFileFormat) != 0xE2792ACA {
+		t.Errorf("the backing file format extension is %#x, %s", uint32(HdrExtBackingFileFormat), HdrExtBackingFileFormat)
+	}
+
+	// a size that does not fit an int of 32 bits is corrupt, not negative
+	var corrupt CorruptionError
+	if _, err := parse(0xffffffff); !errors.As(err, &corrupt) || corrupt.Structure != StructExtension || corrupt.Value != 0xffffffff {
+		t.Errorf("read an extension of 4 GiB: %v", err)
+	}
+}
+
+func TestExtensionsWithBackingFile(t *testing.T) {
+	img := tempImage(t)
+	if err := img.SetBackingFile("base.qcow2", ""); err == nil {
+		t.Fatal("expected an error opening a missing backing file")
+	}
+	before := img.Header.BackingFileOffset
+	if err := img.AddExtension(vendorExtension, []byte("some vendor data")); err != nil {
+		t.Fatal(err)
+	}
+	if img.Header.BackingFileOffset != before+24 {
+		t.Errorf("expected the backing file name to move to %d, got %d", before+24, img.Header.BackingFileOffset)
+	}
+	if err := img.RemoveExtension(vendorExtension); err != nil {
+		t.Fatal(err)
+	}
+	if img.Header.BackingFileOffset != before {
+		t.Errorf("expected the backing file name back at %d, got %d", before, img.Header.BackingFileOffset)
+	}
+
+	h, err := ReadHeader(io.NewSectionReader(img.fh, 0, img.clusterSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.BackingFile != "base.qcow2" || len(h.ExtHeaders) != 0 {
+		t.Errorf("unexpected header %#v", h)
+	}
+}
+
+// roundTrip asserts that the first cluster of an image encodes back to
+// exactly the bytes it was parsed from
+func roundTrip(t *testing.T, raw []byte) *Header {
+	t.Helper()
+	h, err := ReadHeader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster := raw[:h.ClusterSize()]
+	if !bytes.Equal(buf, cluster) {
+		for i := range cluster {
+			if i >= len(buf) || buf[i] != cluster[i] {
+				t.Fatalf("re-encoded header of %d bytes differs from the original at offset %d", len(buf), i)
+			}
+		}
+		t.Fatalf("re-encoded header of %d bytes is longer than the first cluster", len(buf))
+	}
+	return h
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	img := tempImage(t)
+	raw := make([]byte, img.clusterSize)
+	if _, err := img.fh.ReadAt(raw, 0); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, raw)
+
+	// a longer v3 header, a vendor extension with garbage padding, junk
+	// before the backing file name and after it
+	odd := append([]byte(nil), raw...)
+	binary.BigEndian.PutUint32(odd[100:104], 112)
+	copy(odd[104:112], []byte{0, 1, 2, 3, 4, 5, 6, 7})
+	binary.BigEndian.PutUint32(odd[112:116], uint32(vendorExtension))
+	binary.BigEndian.PutUint32(odd[116:120], 5)
+	copy(odd[120:128], "hello\xaa\xbb\xcc")
+	binary.BigEndian.PutUint32(odd[128:132], uint32(HdrExtBackingFileFormat))
+	binary.BigEndian.PutUint32(odd[132:136], 5)
+	copy(odd[136:144], "qcow2\x00\x00\x00")
+	copy(odd[144:152], make([]byte, 8))
+	copy(odd[152:156], "GAP!")
+	binary.BigEndian.PutUint64(odd[8:16], 156)
+	binary.BigEndian.PutUint32(odd[16:20], 10)
+	copy(odd[156:166], "base.qcow2")
+	copy(odd[1000:], "trailing garbage")
+	odd[len(odd)-1] = 0xff
+	h := roundTrip(t, odd)
+	if h.BackingFile != "base.qcow2" || h.BackingFormat() != "qcow2" || len(h.ExtraHeader) != 8 {
+		t.Errorf("unexpected backing file %q (%q), extra header %x", h.BackingFile, h.BackingFormat(), h.ExtraHeader)
+	}
+
+	// and the same through the version 2 layout
+	if err := img.AmendVersion(2, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.fh.ReadAt(raw, 0); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, raw)
+	v2 := append([]byte(nil), raw...)
+	copy(v2[2000:], "more trailing garbage")
+	roundTrip(t, v2)
+}
+
+func TestHeaderRoundTripTestdata(t *testing.T) {
+	names, err := filepath.Glob("testdata/*.qcow2.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) == 0 {
+		t.Fatal("no images in testdata")
+	}
+	for _, name := range names {
+		t.Run(filepath.Base(name), func(t *testing.T) {
+			fh, err := os.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fh.Close()
+			gz, err := gzip.NewReader(fh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// enough for the largest cluster
+			raw, err := io.ReadAll(io.LimitReader(gz, 1<<maxClusterBits))
+			if err != nil {
+				t.Fatal(err)
+			}
+			roundTrip(t, raw)
+		})
+	}
+}
+
+// TestHeaderRoundTripCreated round-trips the header of an image made by
+// Create, with a backing file and a bitmap, and with the features Create does
+// not make set on it as qemu lays them out: zstd compression, in the header
+// bytes past the version 3 fields, and extended L2 entries.
+func TestHeaderRoundTripCreated(t *testing.T) {
+	dir := t.TempDir()
+	base, err := Create(filepath.Join(dir, "base.qcow2"), 1<<20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base.Close()
+	img, err := Create(filepath.Join(dir, "top.qcow2"), 1<<20, &CreateOptions{ClusterSize: 4096, BackingFile: "base.qcow2", BackingFormat: "qcow2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.AddBitmap("nightly", 16); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "top.qcow2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := roundTrip(t, data)
+	hasBitmaps := false
+	for _, e := range h.ExtHeaders {
+		hasBitmaps = hasBitmaps || e.Type == HdrExtBitmaps
+	}
+	if h.BackingFile != "base.qcow2" || h.BackingFormat() != "qcow2" || !hasBitmaps {
+		t.Fatalf("unexpected header %+v", h)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		incompat uint64
+	}{
+		{"zstd", IncompatCompressionType},
+		{"extended_l2", IncompatExtendedL2},
+		{"zstd and extended_l2", IncompatCompressionType | IncompatExtendedL2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := roundTrip(t, data)
+			mark := h.backingFollowsExtensions()
+			h.IncompatibleFeatures |= tc.incompat
+			if tc.incompat&IncompatCompressionType != 0 {
+				h.HeaderLength = V2HeaderSize + V3HeaderSize + 8
+				h.ExtraHeader = []byte{1, 0, 0, 0, 0, 0, 0, 0}
+			}
+			h.placeBackingFile(mark)
+			buf, err := h.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw := append(buf, make([]byte, h.ClusterSize()-int64(len(buf)))...)
+			got := roundTrip(t, raw)
+			if got.IncompatibleFeatures != h.IncompatibleFeatures || !bytes.Equal(got.ExtraHeader, h.ExtraHeader) ||
+				got.BackingFile != "base.qcow2" || len(got.ExtHeaders) != len(h.ExtHeaders) {
+				t.Errorf("read back\n%+v\nwant\n%+v", got, h)
+			}
+		})
+	}
+}
+
+// TestReadHeaderStream reads the header from a pipe, whose reads return
+// short, as they do from stdin
+func TestReadHeaderStream(t *testing.T) {
+	img := tempImage(t)
+	defer img.Close()
+	data, err := os.ReadFile(img.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		// a few bytes at a time, and then what follows the first cluster
+		for off := 0; off < len(data); off += 13 {
+			if _, err := pw.Write(data[off:min(off+13, len(data))]); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+	h, err := ReadHeader(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*h, img.Header) {
+		t.Errorf("read the header from a pipe as\n%+v\nwant\n%+v", *h, img.Header)
+	}
+	rest, err := io.ReadAll(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(rest)) != int64(len(data))-img.clusterSize {
+		t.Errorf("read %d bytes of %d from the pipe, want the first cluster of %d", len(data)-len(rest), len(data), img.clusterSize)
+	}
+
+	// too short for a header, that of an image or not
+	if _, err := ReadHeader(bytes.NewReader(data[:50])); err != io.ErrUnexpectedEOF {
+		t.Errorf("read a truncated header: %v", err)
+	}
+	if _, err := ReadHeader(strings.NewReader("not an image\n")); err != ErrBadMagic {
+		t.Errorf("read a short text file: %v", err)
+	}
+}
+
+// patchedFixture is a copy of the fixture with the 32 bit value v written at
+// each of offs
+func patchedFixture(t *testing.T, v uint32, offs ...int64) (string, *Image) {
+	t.Helper()
+	img := tempImage(t)
+	img.Close()
+	fh, err := os.OpenFile(img.Name(), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	for _, off := range offs {
+		if _, err := fh.WriteAt(binary.BigEndian.AppendUint32(nil, v), off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return img.Name(), img
+}
+
+// TestHeaderFields32Bit reads fields as large as 32 bits allow, which do not
+// fit an int on 32 bit platforms but must fail the same there
+func TestHeaderFields32Bit(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		off  int64
+		v    uint32
+		// also is the offset of a second field to write v to
+		also int64
+	}{
+		// a backing file name at least as long as the first cluster
+		{"backing file size", 16, 0xffffffff, 8 + 4},
+		{"cluster bits", 20, 0xffffffff, 0},
+		{"L1 size", 36, 0x80000000, 0},
+		{"refcount table clusters", 56, 0xffffffff, 0},
+		{"refcount order", 96, 0xffffffff, 0},
+		{"header length", 100, 0xffffffff, 0},
+	} {
+		offs := []int64{c.off}
+		if c.also != 0 {
+			offs = append(offs, c.also)
+		}
+		name, _ := patchedFixture(t, c.v, offs...)
+		var corrupt CorruptionError
+		if _, err := Open(name); !errors.As(err, &corrupt) || corrupt.Structure != StructHeader || corrupt.Offset != c.off {
+			t.Errorf("%s of %#x: %v", c.name, c.v, err)
+		}
+	}
+
+	name, _ := patchedFixture(t, 0xffffffff, 4)
+	if _, err := Open(name); err == nil {
+		t.Error("opened version 0xffffffff")
+	}
+}
+
+func TestFeatureBit40(t *testing.T) {
+	// bit 40 of the incompatible features, which does not fit 32 bits
+	name, img := patchedFixture(t, 1<<8, 72)
+	if _, err := Open(name); !errors.As(err, new(UnsupportedFeaturesError)) {
+		t.Errorf("opened an image with incompatible feature bit 40: %v", err)
+	}
+	h, err := img.Header.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint64(h[72:], 1<<40)
+	parsed, err := ReadHeader(bytes.NewReader(append(h, make([]byte, img.clusterSize)...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.IncompatibleFeatures != 1<<40 {
+		t.Errorf("got incompatible features %#x", parsed.IncompatibleFeatures)
+	}
+
+	// the unknown autoclear bit 40 is cleared by a writable open
+	name, _ = patchedFixture(t, 1<<8, 88)
+	rw, err := OpenFile(name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw.Close()
+	ro, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if ro.Header.AutoclearFeatures != 0 {
+		t.Errorf("autoclear features %#x are left", ro.Header.AutoclearFeatures)
+	}
+}
+
+func TestSnapshotFields32Bit(t *testing.T) {
+	img := tempImage(t)
+	if img.Header.NbSnapshots == 0 {
+		t.Fatal("the fixture has no snapshots")
+	}
+	at := img.Header.SnapshotsOffset
+	img.Close()
+
+	// extra data of 4 GiB is corrupt
+	name, _ := patchedFixture(t, 0xffffffff, at+36)
+	var corrupt CorruptionError
+	if _, err := Open(name); !errors.As(err, &corrupt) || corrupt.Structure != StructSnapshotTable || corrupt.Offset != at+36 {
+		t.Errorf("opened a snapshot table with extra data of 4 GiB: %v", err)
+	}
+
+	// an L1 table too large for an int is corrupt, and one that is not is
+	// read as is, for Check to report
+	name, _ = patchedFixture(t, 0xffffffff, at+8)
+	damaged, err := Open(name)
+	if uint64(0xffffffff) > math.MaxInt {
+		if !errors.As(err, &corrupt) || corrupt.Offset != at+8 {
+			t.Errorf("opened a snapshot table with an L1 table of 0xffffffff entries: %v", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer damaged.Close()
+	if s := damaged.Snapshots(); len(s) == 0 || uint64(s[0].L1Size) != 0xffffffff {
+		t.Errorf("got snapshots %+v", s)
+	}
+}
@@ -0,0 +1,325 @@
+package qcow2
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrRangeNotSupported is returned reading a URL whose server ignores range
+// requests, answering them with the whole file, which would be downloaded
+// again for every read
+var ErrRangeNotSupported = errors.New("qcow2: server does not support range requests")
+
+// ErrRemoteChanged is returned reading a URL whose file has changed since it
+// was opened, as its ETag tells
+var ErrRemoteChanged = errors.New("qcow2: remote file changed since it was opened")
+
+// HTTPOptions configures how images and backing files are read over HTTP(S)
+type HTTPOptions struct {
+	// Client makes the requests, http.DefaultClient when nil
+	Client *http.Client
+	// Header is added to every request, as for authorization
+	Header http.Header
+	// Timeout limits each request, including reading its body, unless zero
+	Timeout time.Duration
+	// Retries is how many times a request is tried again after a network
+	// error or a 5xx or 429 status, waiting RetryDelay, 100ms when zero,
+	// and twice as long after each attempt
+	Retries    int
+	RetryDelay time.Duration
+	// CacheDir, unless empty, keeps the blocks of BlockSize bytes read, 256
+	// KiB when zero, in files under it, for as long as the file on the
+	// server keeps its size, ETag and modification time
+	CacheDir  string
+	BlockSize int64
+}
+
+const (
+	defaultRetryDelay    = 100 * time.Millisecond
+	defaultHTTPBlockSize = 256 << 10
+)
+
+// HTTPFile is a file read over HTTP(S) with range requests, which are sent
+// with the ETag of the file, when it has a strong one, to fail with
+// ErrRemoteChanged rather than mix the contents of two versions. It is safe
+// for concurrent use.
+type HTTPFile struct {
+	url     string
+	opts    HTTPOptions
+	size    int64
+	modTime time.Time
+	etag    string
+	// cache is the directory of the cached blocks, if any
+	cache string
+}
+
+// httpStatusError is a response of an unexpected status
+type httpStatusError struct {
+	url    string
+	status string
+	code   int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("qcow2: GET %s: %s", e.url, e.status)
+}
+
+// OpenHTTP opens the file at url, reading its size from the answer to a
+// first range request. opts may be nil.
+func OpenHTTP(url string, opts *HTTPOptions) (*HTTPFile, error) {
+	f := &HTTPFile{url: url}
+	if opts != nil {
+		f.opts = *opts
+	}
+	if f.opts.RetryDelay <= 0 {
+		f.opts.RetryDelay = defaultRetryDelay
+	}
+	if f.opts.BlockSize <= 0 {
+		f.opts.BlockSize = defaultHTTPBlockSize
+	}
+	err := f.retry(func() error {
+		resp, cancel, err := f.get("bytes=0-0")
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			_, size, err := contentRange(resp.Header.Get("Content-Range"))
+			if err != nil {
+				return fmt.Errorf("qcow2: GET %s: %w", url, err)
+			}
+			f.size = size
+		case http.StatusRequestedRangeNotSatisfiable:
+			// the one range not satisfiable is that of an empty file
+			if resp.Header.Get("Content-Range") != "bytes */0" {
+				return &httpStatusError{url: url, status: resp.Status, code: resp.StatusCode}
+			}
+		case http.StatusOK:
+			return fmt.Errorf("%w: GET %s", ErrRangeNotSupported, url)
+		default:
+			return &httpStatusError{url: url, status: resp.Status, code: resp.StatusCode}
+		}
+		f.modTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+		if etag := resp.Header.Get("ETag"); !strings.HasPrefix(etag, "W/") {
+			f.etag = etag
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if f.opts.CacheDir != "" {
+		key := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%s\x00%d\x00%d", url, f.size, f.etag, f.modTime.Unix(), f.opts.BlockSize)))
+		f.cache = filepath.Join(f.opts.CacheDir, hex.EncodeToString(key[:16]))
+		if err := os.MkdirAll(f.cache, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Name is the URL of the file
+func (f *HTTPFile) Name() string {
+	return f.url
+}
+
+// Size is the size of the file, as the server told when it was opened
+func (f *HTTPFile) Size() int64 {
+	return f.size
+}
+
+// ModTime is the modification time the server told, or the zero time
+func (f *HTTPFile) ModTime() time.Time {
+	return f.modTime
+}
+
+// Close releases the file, which holds nothing open between reads
+func (f *HTTPFile) Close() error {
+	return nil
+}
+
+// ReadAt reads the file at off, through its cache of blocks if it has one
+func (f *HTTPFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("qcow2: GET %s: negative offset %d", f.url, off)
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), f.size-off))
+	var err error
+	if f.cache == "" {
+		err = f.fetch(p[:n], off)
+	} else {
+		err = f.readCached(p[:n], off)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readCached reads p at off, within the file, from the blocks of the cache,
+// fetching those that are not in it yet
+func (f *HTTPFile) readCached(p []byte, off int64) error {
+	bs := f.opts.BlockSize
+	for len(p) > 0 {
+		block := off / bs
+		start := block * bs
+		name := filepath.Join(f.cache, strconv.FormatInt(block, 16))
+		data, err := os.ReadFile(name)
+		if want := min(bs, f.size-start); err != nil || int64(len(data)) != want {
+			data = make([]byte, want)
+			if err := f.fetch(data, start); err != nil {
+				return err
+			}
+			if err := writeCacheFile(name, data); err != nil {
+				return err
+			}
+		}
+		n := copy(p, data[off-start:])
+		p, off = p[n:], off+int64(n)
+	}
+	return nil
+}
+
+// writeCacheFile stores a block of the cache whole, so that a reader, in this
+// process or another, never sees part of it
+func writeCacheFile(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".block-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// fetch reads p at off, within the file, from the server
+func (f *HTTPFile) fetch(p []byte, off int64) error {
+	return f.retry(func() error {
+		resp, cancel, err := f.get(fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+		case http.StatusOK:
+			return fmt.Errorf("%w: GET %s", ErrRangeNotSupported, f.url)
+		case http.StatusPreconditionFailed:
+			return fmt.Errorf("%w: GET %s", ErrRemoteChanged, f.url)
+		default:
+			return &httpStatusError{url: f.url, status: resp.Status, code: resp.StatusCode}
+		}
+		if start, _, err := contentRange(resp.Header.Get("Content-Range")); err != nil {
+			return fmt.Errorf("qcow2: GET %s: %w", f.url, err)
+		} else if start != off {
+			return fmt.Errorf("qcow2: GET %s: asked for bytes from %d, got them from %d", f.url, off, start)
+		}
+		if _, err := io.ReadFull(resp.Body, p); err != nil {
+			return fmt.Errorf("qcow2: GET %s: %w", f.url, err)
+		}
+		return nil
+	})
+}
+
+// get sends a request for the range given, which lasts until cancel is
+// called
+func (f *HTTPFile) get(ranges string) (*http.Response, context.CancelFunc, error) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if f.opts.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, f.opts.Timeout)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.url, nil)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	for k, v := range f.opts.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Range", ranges)
+	if f.etag != "" {
+		req.Header.Set("If-Match", f.etag)
+	}
+	client := f.opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return resp, cancel, nil
+}
+
+// retry calls fn until it succeeds, fails for good, or has been retried as
+// many times as configured
+func (f *HTTPFile) retry(fn func() error) error {
+	delay := f.opts.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= f.opts.Retries || !retryable(err) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// retryable tells whether a request that failed with err may succeed when
+// sent again: all but those the server answered with a status that is not
+// a 5xx or 429
+func retryable(err error) bool {
+	if errors.Is(err, ErrRangeNotSupported) || errors.Is(err, ErrRemoteChanged) {
+		return false
+	}
+	var status *httpStatusError
+	if errors.As(err, &status) {
+		return status.code >= 500 || status.code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// contentRange parses a Content-Range header of "bytes START-END/SIZE"
+func contentRange(s string) (start, size int64, err error) {
+	rest, ok := strings.CutPrefix(s, "bytes ")
+	startEnd, total, ok2 := strings.Cut(rest, "/")
+	first, _, ok3 := strings.Cut(startEnd, "-")
+	if !ok || !ok2 || !ok3 {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	if size, err = strconv.ParseInt(total, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("Content-Range %q does not give the size of the file", s)
+	}
+	return start, size, nil
+}
@@ -0,0 +1,251 @@
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fileServer serves files from memory with range requests, counting the
+// requests, and failing the first failures of them
+type fileServer struct {
+	mu       sync.Mutex
+	files    map[string][]byte
+	etag     string
+	requests int
+	failures int
+	noRange  bool
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	data, ok := s.files[r.URL.Path]
+	fail := s.failures > 0
+	if fail {
+		s.failures--
+	}
+	etag, noRange := s.etag, s.noRange
+	s.mu.Unlock()
+	switch {
+	case fail:
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+	case !ok:
+		http.NotFound(w, r)
+	case noRange:
+		w.Write(data)
+	default:
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Unix(1700000000, 0), bytes.NewReader(data))
+	}
+}
+
+func (s *fileServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// remoteChain writes a qcow2 image over a qcow2 base over a raw base into
+// dir, returning their names and the guest disk of the top one
+func remoteChain(t *testing.T, dir string) (files map[string][]byte, disk []byte) {
+	t.Helper()
+	raw := bytes.Repeat([]byte("R"), 1<<20)
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mid, err := Create(filepath.Join(dir, "mid.qcow2"), 1<<20, &CreateOptions{ClusterSize: 4096, BackingFile: "base.raw", BackingFormat: "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mid.WriteAt(bytes.Repeat([]byte("M"), 3*4096), 4096); err != nil {
+		t.Fatal(err)
+	}
+	mid.Close()
+	top, err := Create(filepath.Join(dir, "top.qcow2"), 1<<20, &CreateOptions{ClusterSize: 4096, BackingFile: "mid.qcow2", BackingFormat: "qcow2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer top.Close()
+	if _, err := top.WriteAt(bytes.Repeat([]byte("T"), 4096), 2*4096); err != nil {
+		t.Fatal(err)
+	}
+	disk = make([]byte, top.Size())
+	if _, err := top.ReadAt(disk, 0); err != nil {
+		t.Fatal(err)
+	}
+	files = map[string][]byte{}
+	for _, name := range []string{"base.raw", "mid.qcow2", "top.qcow2"} {
+		if files["/"+name], err = os.ReadFile(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files, disk
+}
+
+func readAll(t *testing.T, img *Image) []byte {
+	t.Helper()
+	got := make([]byte, img.Size())
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestOpenURL(t *testing.T) {
+	files, disk := remoteChain(t, t.TempDir())
+	s := &fileServer{files: files, etag: `"v1"`}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	cache := t.TempDir()
+	opts := &HTTPOptions{CacheDir: cache, BlockSize: 64 << 10}
+	img, err := OpenURL(srv.URL+"/top.qcow2", WithHTTPOptions(opts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if got := readAll(t, img); !bytes.Equal(got, disk) {
+		t.Error("the chain read over HTTP does not hold the guest disk")
+	}
+	if b := img.BackingImage(); b == nil || b.Name() != srv.URL+"/mid.qcow2" {
+		t.Errorf("backing image: got %v, want %s/mid.qcow2", b, srv.URL)
+	}
+	if rep, err := img.Check(nil); err != nil || !rep.Clean() {
+		t.Errorf("checking the chain over HTTP: %v %+v", err, rep)
+	}
+
+	// the cache answers once the blocks have been read
+	before := s.count()
+	again, err := OpenURL(srv.URL+"/top.qcow2", WithHTTPOptions(opts), WithL2CacheSize(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if got := readAll(t, again); !bytes.Equal(got, disk) {
+		t.Error("the chain read from the cache does not hold the guest disk")
+	}
+	// one request for each file of the chain, to learn its size
+	if n := s.count() - before; n != 3 {
+		t.Errorf("reading from the cache took %d requests, want 3", n)
+	}
+
+	// the file changing is noticed, rather than mixing two versions
+	uncached, err := OpenURL(srv.URL+"/top.qcow2", WithL2CacheSize(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uncached.Close()
+	s.mu.Lock()
+	s.etag = `"v2"`
+	s.mu.Unlock()
+	if _, err := uncached.ReadAt(make([]byte, 4096), 0); !errors.Is(err, ErrRemoteChanged) {
+		t.Errorf("reading a changed file: got %v, want ErrRemoteChanged", err)
+	}
+}
+
+func TestOpenHTTP(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	s := &fileServer{files: map[string][]byte{"/f": data}}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	f, err := OpenHTTP(srv.URL+"/f", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Size() != int64(len(data)) || !f.ModTime().Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("got size %d and time %v", f.Size(), f.ModTime())
+	}
+	p := make([]byte, 100)
+	if n, err := f.ReadAt(p, int64(len(data))-50); n != 50 || err != io.EOF || !bytes.Equal(p[:50], data[len(data)-50:]) {
+		t.Errorf("reading across the end: got %d, %v", n, err)
+	}
+
+	s.failures = 2
+	if _, err := f.ReadAt(p, 0); err == nil {
+		t.Error("expected an error from a failing server without retries")
+	}
+	s.failures = 2
+	f, err = OpenHTTP(srv.URL+"/f", &HTTPOptions{Retries: 2, RetryDelay: time.Millisecond})
+	if err != nil {
+		t.Fatalf("opening with retries: %v", err)
+	}
+	s.failures = 2
+	if _, err := f.ReadAt(p, 16); err != nil || !bytes.Equal(p, data[16:116]) {
+		t.Errorf("reading with retries: %v", err)
+	}
+
+	if _, err := OpenHTTP(srv.URL+"/missing", &HTTPOptions{Retries: 5}); err == nil {
+		t.Error("expected an error opening a missing file")
+	}
+	s.noRange = true
+	if _, err := OpenHTTP(srv.URL+"/f", nil); !errors.Is(err, ErrRangeNotSupported) {
+		t.Errorf("a server ignoring ranges: got %v, want ErrRangeNotSupported", err)
+	}
+}
+
+func TestBackingResolver(t *testing.T) {
+	dir := t.TempDir()
+	files, disk := remoteChain(t, dir)
+	// the top image refers to its backing file by a scheme of its own
+	top, err := OpenFile(filepath.Join(dir, "top.qcow2"), os.O_RDWR, WithNoBacking())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := top.SetBackingFile("mem:///mid.qcow2", "qcow2"); err != nil {
+		t.Fatal(err)
+	}
+	top.Close()
+
+	var resolved []string
+	resolver := func(name, format string) (io.ReaderAt, int64, error) {
+		resolved = append(resolved, name+" "+format)
+		if name, ok := strings.CutPrefix(name, "mem://"); ok {
+			if data, ok := files[name]; ok {
+				return bytes.NewReader(data), int64(len(data)), nil
+			}
+		}
+		return nil, 0, nil
+	}
+	// plain paths are still opened locally when the resolver leaves them
+	mid, err := Open(filepath.Join(dir, "mid.qcow2"), WithBackingResolver(resolver))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mid.Close()
+	if want := filepath.Join(dir, "base.raw") + " raw"; len(resolved) != 1 || resolved[0] != want {
+		t.Errorf("resolved %q, want %q", resolved, want)
+	}
+
+	resolved = nil
+	os.Remove(filepath.Join(dir, "mid.qcow2"))
+	img, err := Open(filepath.Join(dir, "top.qcow2"), WithBackingResolver(resolver))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if got := readAll(t, img); !bytes.Equal(got, disk) {
+		t.Error("the chain read through the resolver does not hold the guest disk")
+	}
+	// the backing file of mid.qcow2 is relative to its URL
+	if len(resolved) != 2 || resolved[0] != "mem:///mid.qcow2 qcow2" || resolved[1] != "mem:///base.raw raw" {
+		t.Errorf("resolved %q", resolved)
+	}
+
+	if _, err := Open(filepath.Join(dir, "top.qcow2"), WithBackingResolver(func(string, string) (io.ReaderAt, int64, error) {
+		return nil, 0, errors.New("no")
+	})); err == nil {
+		t.Error("expected the error of the resolver")
+	}
+}
@@ -0,0 +1,590 @@
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	// ErrReadOnly is returned when modifying an image that was opened read-only
+	ErrReadOnly = errors.New("qcow2: image is opened read-only")
+
+	// ErrLocked is returned when opening an image that another process holds locked
+	ErrLocked = errors.New("qcow2: image is in use by another process")
+
+	// ErrEncrypted is returned when writing to an encrypted image, which is
+	// not supported, and when reading its data without a passphrase
+	ErrEncrypted = errors.New("qcow2: image is encrypted")
+
+	// ErrBackingLoop is returned when opening an image whose backing chain
+	// leads back to an image above
+	ErrBackingLoop = errors.New("qcow2: backing chain loops")
+
+	// ErrForceShareWrite is returned when opening an image for writing
+	// WithForceShare
+	ErrForceShareWrite = errors.New("qcow2: images opened with force-share are read-only")
+
+	// ErrExtensionsSkipped is returned for what needs the header extensions
+	// of an image opened WithoutExtensionParsing, or of a header read by
+	// ReadHeaderWithoutExtensions: writing it, and reading the data of an
+	// encrypted image
+	ErrExtensionsSkipped = errors.New("qcow2: the header extensions were skipped")
+
+	// ErrChainTooDeep is returned when opening an image with more than
+	// maxChainDepth backing files under it
+	ErrChainTooDeep = errors.New("qcow2: backing chain is too deep")
+)
+
+// maxChainDepth is the most backing files an image may have under it
+const maxChainDepth = 64
+
+// maxL1Entries is the largest L1 table qemu accepts, of 32 MiB
+const maxL1Entries = 32 << 20 / 8
+
+// maxRefcountTableSize is the largest refcount table qemu accepts
+const maxRefcountTableSize = 8 << 20
+
+// Image is an opened qcow2 file, providing access to the guest visible disk
+type Image struct {
+	Header Header
+
+	name     string
+	fh       *hostFile
+	readOnly bool
+
+	clusterBits uint
+	clusterSize int64
+	l2Entries   int64
+
+	l1       []uint64
+	reftable []uint64
+
+	// end is the first cluster aligned offset past everything in the file
+	end int64
+	// freeHint is where searching for free clusters begins
+	freeHint int64
+	// compressedNext is where the next compressed cluster can be packed, or
+	// zero to start a new host cluster
+	compressedNext int64
+
+	snapshots     []Snapshot
+	snapTableSize int64
+	// snapshotsErr is why the snapshot table could not be read in full,
+	// when opened WithDamagedSnapshots
+	snapshotsErr error
+	// featuresErr is the UnsupportedFeaturesError of an image opened with
+	// WithIgnoreUnknownIncompatible, returned when accessing its guest data
+	featuresErr error
+
+	backing     io.ReaderAt
+	backingSize int64
+	// crypt is the key of an encrypted image, which is nil for others
+	crypt *luksKey
+
+	opts options
+	log  *slog.Logger
+	// view is set for the images returned by SnapshotView, which share the
+	// file of the image they were made from
+	view bool
+
+	// tracked holds the bits of the enabled persistent bitmaps by name, with
+	// the writes since they were last stored, once tracking is set by the
+	// first write. They are stored by Sync and Close.
+	tracked  map[string]*Bitmap
+	tracking bool
+
+	// mu is held to change the image, and shared by readers
+	mu sync.RWMutex
+}
+
+// Open opens the named image read-only
+func Open(name string, opts ...Option) (*Image, error) {
+	return OpenFile(name, os.O_RDONLY, opts...)
+}
+
+// OpenFile opens the named image. flag is os.O_RDONLY or os.O_RDWR.
+//
+// Unless WithNoLock is given, the image file is locked for as long as it is
+// open: shared when read-only and exclusively when writable, failing with
+// ErrLocked when that conflicts with the lock of another process.
+func OpenFile(name string, flag int, opts ...Option) (*Image, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	readOnly := flag&(os.O_WRONLY|os.O_RDWR) == 0
+	if o.forceShare && !readOnly {
+		return nil, fmt.Errorf("%s: %w", name, ErrForceShareWrite)
+	}
+	if o.noExtensions && !readOnly {
+		return nil, fmt.Errorf("%s: opening for writing: %w", name, ErrExtensionsSkipped)
+	}
+	fh, st, err := openFile(name, flag&(os.O_RDONLY|os.O_WRONLY|os.O_RDWR), 0, o)
+	if err != nil {
+		return nil, err
+	}
+	if !o.noLock {
+		if err := lockFile(fh, !readOnly); err != nil {
+			fh.Close()
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	img, err := newImage(name, st, readOnly, o)
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+func newImage(name string, f storage, readOnly bool, o options) (*Image, error) {
+	fh := &hostFile{storage: f, limiter: o.limiter}
+	h, err := readHeader(io.NewSectionReader(fh, 0, 1<<maxClusterBits), o.noExtensions)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	featuresErr := h.unsupportedFeatures()
+	if featuresErr != nil && (!o.ignoreUnknown || !readOnly) {
+		return nil, fmt.Errorf("%s: %w", name, featuresErr)
+	}
+	img := &Image{
+		Header:      *h,
+		name:        name,
+		fh:          fh,
+		readOnly:    readOnly,
+		clusterBits: uint(h.ClusterBits),
+		clusterSize: h.ClusterSize(),
+		l2Entries:   h.ClusterSize() / 8,
+		opts:        o,
+		log:         o.logger(name),
+		featuresErr: featuresErr,
+	}
+	fh.l2, fh.refcounts = o.metadataCaches(img.clusterSize)
+	if fh.key, err = absName(name); err != nil {
+		fh.key = name
+	}
+	if h.CryptMethod != CryptNone {
+		img.crypt = &luksKey{}
+	}
+	img.logOddities()
+	if o.forceShare && len(o.chain) == 0 {
+		// once for the chain, by the image opened
+		img.log.Warn("opened without a lock: what is read may be inconsistent if another process is writing to the image")
+		if h.IncompatibleFeatures&IncompatDirty != 0 {
+			img.log.Warn("the dirty bit is set, as when the image is in use: its refcounts may be out of date", "offset", int64(72), structure(StructHeader))
+		}
+	}
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+	img.end = img.alignUp(fi.Size())
+
+	if err := img.checkTables(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if img.l1, err = img.readTable(h.L1TableOffset, h.L1Size); err != nil {
+		return nil, fmt.Errorf("%s: reading L1 table: %w", name, err)
+	}
+	if img.reftable, err = img.readTable(h.RefcountTableOffset, h.RefcountTableClusters*int(img.l2Entries)); err != nil {
+		return nil, fmt.Errorf("%s: reading refcount table: %w", name, err)
+	}
+	if err := img.readSnapshots(); err != nil {
+		if !o.damagedSnapshots || !readOnly {
+			return nil, fmt.Errorf("%s: reading snapshot table: %w", name, err)
+		}
+		img.snapshotsErr = err
+	}
+	if unknown := h.AutoclearFeatures &^ knownFeatureMask(FeatureAutoclear); unknown != 0 && !readOnly {
+		// what an unknown autoclear bit says of the image may not hold once
+		// this package writes to it, which is why it must be cleared first
+		img.Header.AutoclearFeatures &^= unknown
+		if err := img.writeHeader(); err != nil {
+			return nil, fmt.Errorf("%s: clearing autoclear features: %w", name, err)
+		}
+		img.log.Info("cleared unknown autoclear features", "bits", fmt.Sprintf("%#x", unknown), "offset", int64(88), structure(StructHeader))
+	}
+
+	if h.BackingFile != "" && !o.noBacking {
+		if err := img.openBacking(false); err != nil {
+			img.Close()
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// checkTables checks the header fields locating the L1 and refcount tables,
+// before the tables are read
+func (img *Image) checkTables() error {
+	h := img.Header
+	if h.L1Size > maxL1Entries {
+		return headerField(36, uint64(h.L1Size), "L1 table of %d entries is larger than the maximum of %d", h.L1Size, maxL1Entries)
+	}
+	if int64(h.L1Size)*img.l2Entries*img.clusterSize < h.Size {
+		return headerField(36, uint64(h.L1Size), "L1 table of %d entries is too small for %d bytes", h.L1Size, h.Size)
+	}
+	if why := img.invalidOffset(h.L1TableOffset, int64(h.L1Size)*8, true); h.L1Size > 0 && why != "" {
+		return headerField(40, uint64(h.L1TableOffset), "L1 table offset %s", why)
+	}
+	if int64(h.RefcountTableClusters)*img.clusterSize > maxRefcountTableSize {
+		return headerField(56, uint64(h.RefcountTableClusters), "refcount table of %d clusters is larger than the maximum of %d bytes", h.RefcountTableClusters, maxRefcountTableSize)
+	}
+	if why := img.invalidOffset(h.RefcountTableOffset, int64(h.RefcountTableClusters)*img.clusterSize, true); h.RefcountTableClusters > 0 && why != "" {
+		return headerField(48, uint64(h.RefcountTableOffset), "refcount table offset %s", why)
+	}
+	return nil
+}
+
+// openBacking opens the backing file, which is only written to when writable
+// is set
+func (img *Image) openBacking(writable bool) error {
+	// the format recorded, if any, is in the extensions, which may have been
+	// skipped
+	b, size, err := img.openBackingFile(img.Header.BackingFile, img.Header.BackingFormat(), img.Header.ExtensionsSkipped, writable)
+	if err != nil {
+		return err
+	}
+	img.backing, img.backingSize = b, size
+	return nil
+}
+
+// backingPath is where the backing file name refers to, relative to the image
+func (img *Image) backingPath(name string) string {
+	if isURL(name) {
+		return name
+	}
+	if isURL(img.name) {
+		base, _ := url.Parse(img.name)
+		if ref, err := url.Parse(name); err == nil {
+			return base.ResolveReference(ref).String()
+		}
+	}
+	if !filepath.IsAbs(name) {
+		return filepath.Join(filepath.Dir(img.name), name)
+	}
+	return name
+}
+
+// chainTo returns the images above the backing file at path, which is
+// refused when it is one of them or one too many
+func (img *Image) chainTo(path string) ([]string, error) {
+	abs, err := absName(img.name)
+	if err != nil {
+		return nil, err
+	}
+	chain := append(img.opts.chain[:len(img.opts.chain):len(img.opts.chain)], abs)
+	if abs, err = absName(path); err != nil {
+		return nil, err
+	}
+	for _, above := range chain {
+		if above == abs {
+			return nil, ErrBackingLoop
+		}
+	}
+	if len(chain) > maxChainDepth {
+		return nil, ErrChainTooDeep
+	}
+	return chain, nil
+}
+
+// absName is the absolute path of a file, or the URL of a remote one
+func absName(name string) (string, error) {
+	if isURL(name) {
+		return name, nil
+	}
+	return filepath.Abs(name)
+}
+
+// openBackingFile opens the named file as a backing file of the image, with
+// the image's options, and returns it with its size. Its format is probed
+// when probe is set, and as qemu does when no format is given.
+func (img *Image) openBackingFile(name, format string, probe, writable bool) (io.ReaderAt, int64, error) {
+	probe = probe || format == ""
+	path := img.backingPath(name)
+	chain, err := img.chainTo(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: opening backing file %s: %w", img.name, path, err)
+	}
+	r, size, err := img.resolveBacking(path, format)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: opening backing file %s: %w", img.name, path, err)
+	}
+	if r != nil {
+		return img.openRemoteBacking(path, format, probe, writable, r, size, chain)
+	}
+	if probe {
+		if format, err = ProbeFormat(path); err != nil {
+			return nil, 0, fmt.Errorf("%s: opening backing file: %w", img.name, err)
+		}
+	}
+	flag := os.O_RDONLY
+	if writable {
+		flag = os.O_RDWR
+	}
+	if format == "raw" {
+		fh, st, err := openFile(path, flag, 0, img.opts)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: opening backing file: %w", img.name, err)
+		}
+		if !img.opts.noLock {
+			if err := lockFile(fh, writable); err != nil {
+				fh.Close()
+				return nil, 0, fmt.Errorf("%s: %s: %w", img.name, path, err)
+			}
+		}
+		fi, err := fh.Stat()
+		if err != nil {
+			fh.Close()
+			return nil, 0, err
+		}
+		img.log.Info("opened backing file", "backing", path, "format", format)
+		return &hostFile{storage: st, limiter: img.opts.limiter}, fi.Size(), nil
+	}
+	b, err := OpenFile(path, flag, func(o *options) {
+		*o = img.opts
+		o.chain = chain
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: opening backing file: %w", img.name, err)
+	}
+	img.log.Info("opened backing file", "backing", path, "format", "qcow2")
+	return b, b.Size(), nil
+}
+
+// SetBackingFile rewrites the backing file reference of the image. The format
+// is stored in the backing file format extension, which is removed when format
+// is empty. An empty name detaches the backing file, so that unallocated
+// clusters read as zeros. The reference is stored even when the new backing
+// file cannot be opened, which is then reported as an error.
+func (img *Image) SetBackingFile(name, format string) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	if len(name) > 1023 {
+		return fmt.Errorf("qcow2: backing file name of %d bytes is too long", len(name))
+	}
+	if name == "" && format != "" {
+		return errors.New("qcow2: backing file format given without a backing file")
+	}
+
+	h := img.Header
+	h.ExtHeaders = append([]ExtHeader(nil), h.ExtHeaders...)
+	if format == "" {
+		h.RemoveExtension(HdrExtBackingFileFormat)
+	} else if err := h.AddExtension(HdrExtBackingFileFormat, []byte(format)); err != nil {
+		return err
+	}
+	h.BackingFile = name
+	h.BackingFileOffset, h.BackingFileSize = 0, 0
+	if name != "" {
+		h.BackingFileOffset, h.BackingFileSize = h.extensionsEnd(), len(name)
+	}
+	if err := img.writeFullHeader(h); err != nil {
+		return err
+	}
+
+	if c, ok := img.backing.(io.Closer); ok {
+		c.Close()
+	}
+	img.backing, img.backingSize = nil, 0
+	if name == "" || img.opts.noBacking {
+		return nil
+	}
+	return img.openBacking(false)
+}
+
+// AddExtension stores a header extension in the image, as Header.AddExtension
+func (img *Image) AddExtension(t HeaderExtensionType, data []byte) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	h := img.Header
+	h.ExtHeaders = append([]ExtHeader(nil), h.ExtHeaders...)
+	if err := h.AddExtension(t, data); err != nil {
+		return err
+	}
+	return img.writeFullHeader(h)
+}
+
+// RemoveExtension drops header extensions from the image, as Header.RemoveExtension
+func (img *Image) RemoveExtension(t HeaderExtensionType) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	h := img.Header
+	h.ExtHeaders = append([]ExtHeader(nil), h.ExtHeaders...)
+	if !h.RemoveExtension(t) {
+		return nil
+	}
+	return img.writeFullHeader(h)
+}
+
+// writeFullHeader replaces the first cluster with h, including its header
+// extensions and backing file name
+func (img *Image) writeFullHeader(h Header) error {
+	buf, err := h.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	cluster := make([]byte, img.clusterSize)
+	copy(cluster, buf)
+	if _, err := img.fh.WriteAt(cluster, 0); err != nil {
+		return err
+	}
+	// parse what was written, so the header mirrors the first cluster
+	written, err := ReadHeader(bytes.NewReader(cluster))
+	if err != nil {
+		return err
+	}
+	img.Header = *written
+	return nil
+}
+
+// BackingImage is the qcow2 backing file of the image, or nil when it has no
+// backing file or a raw one
+func (img *Image) BackingImage() *Image {
+	b, _ := img.backing.(*Image)
+	return b
+}
+
+// reopenBacking closes the backing file and opens it again, read-write when
+// writable is set
+func (img *Image) reopenBacking(writable bool) error {
+	if c, ok := img.backing.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	img.backing, img.backingSize = nil, 0
+	return img.openBacking(writable)
+}
+
+// Close stores the bits of the persistent bitmaps the writes were recorded
+// in, and releases the image and its backing files
+func (img *Image) Close() error {
+	if img.view {
+		return nil
+	}
+	img.mu.Lock()
+	err := img.storeTracked()
+	img.mu.Unlock()
+	if c, ok := img.backing.(io.Closer); ok {
+		c.Close()
+	}
+	if cerr := img.fh.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Name is the path the image was opened with
+func (img *Image) Name() string {
+	return img.name
+}
+
+// Size is the virtual size of the guest disk
+func (img *Image) Size() int64 {
+	return img.Header.Size
+}
+
+// ReadAt reads the guest visible disk contents at off. Clusters that follow
+// one another in the image file are read together, up to WithMaxIOSize.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+	return img.readAtUnlocked(p, off)
+}
+
+func (img *Image) readAtUnlocked(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("qcow2: negative offset")
+	}
+
+	var err error
+	if off >= img.Header.Size {
+		return 0, io.EOF
+	}
+	if rem := img.Header.Size - off; int64(len(p)) > rem {
+		p, err = p[:rem], io.EOF
+	}
+	maxIO := img.opts.maxIO()
+	n := 0
+	for n < len(p) {
+		m, rerr := img.readRun(img.l1, img.Header.L1TableOffset, p[n:], off+int64(n), maxIO)
+		if rerr != nil {
+			return n, rerr
+		}
+		n += m
+	}
+	return n, err
+}
+
+// WriteAt writes p to the guest visible disk at off, allocating clusters and
+// copying any that are shared with snapshots as needed. The write is recorded
+// in the enabled persistent bitmaps, unless opened WithoutBitmapTracking.
+func (img *Image) WriteAt(p []byte, off int64) (int, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return 0, ErrReadOnly
+	}
+	if img.Header.CryptMethod != 0 {
+		return 0, ErrEncrypted
+	}
+	if off < 0 || off+int64(len(p)) > img.Header.Size {
+		return 0, fmt.Errorf("qcow2: write of %d bytes at %d is beyond the virtual size %d", len(p), off, img.Header.Size)
+	}
+	if err := img.trackWrite(off, int64(len(p))); err != nil {
+		return 0, err
+	}
+	n := 0
+	for n < len(p) {
+		chunk := img.clusterChunk(p[n:], off+int64(n))
+		if err := img.writeGuest(chunk, off+int64(n)); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// Sync stores the bits of the persistent bitmaps the writes were recorded in,
+// no longer in use, and commits the image file to stable storage
+func (img *Image) Sync() error {
+	img.mu.Lock()
+	err := img.storeTracked()
+	img.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return img.fh.Sync()
+}
+
+// clusterChunk limits p to the bytes remaining in the cluster holding off
+func (img *Image) clusterChunk(p []byte, off int64) []byte {
+	if rem := img.clusterSize - off&(img.clusterSize-1); int64(len(p)) > rem {
+		return p[:rem]
+	}
+	return p
+}
+
+// writeHeader stores the fixed header fields
+func (img *Image) writeHeader() error {
+	_, err := img.fh.WriteAt(img.Header.fixedBytes(), 0)
+	return err
+}
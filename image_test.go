@@ -0,0 +1,158 @@
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// unallocatedOffset finds a guest cluster with no data in the active state
+func unallocatedOffset(t *testing.T, img *Image) int64 {
+	t.Helper()
+	for off := int64(0); off < img.Size(); off += img.clusterSize {
+		entry, _, err := img.l2Entry(img.l1, img.Header.L1TableOffset, off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.classify(entry) == clusterUnallocated {
+			return off
+		}
+	}
+	t.Fatal("no unallocated cluster")
+	return 0
+}
+
+func TestSetBackingFile(t *testing.T) {
+	img := tempImage(t)
+	dir := filepath.Dir(img.Name())
+	off := unallocatedOffset(t, img)
+
+	base := bytes.Repeat([]byte("base"), int(img.Size()/4))
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), base, 0644); err != nil {
+		t.Fatal(err)
+	}
+	longName := strings.Repeat("d/", 400) + "base.raw"
+	if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(longName)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "base.raw"), filepath.Join(dir, longName)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{longName, ""} {
+		format := "raw"
+		if name == "" {
+			format = ""
+		}
+		if err := img.SetBackingFile(name, format); err != nil {
+			t.Fatal(err)
+		}
+		verifyRefcounts(t, img)
+
+		// reopen to see what was stored
+		reopened, err := Open(img.Name(), WithNoLock())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reopened.Header.BackingFile != name || reopened.Header.BackingFormat() != format {
+			t.Errorf("expected backing file %q (%q), got %q (%q)", name, format, reopened.Header.BackingFile, reopened.Header.BackingFormat())
+		}
+		want := make([]byte, 4096)
+		if name != "" {
+			want = base[off : off+4096]
+		}
+		got := make([]byte, 4096)
+		if _, err := reopened.ReadAt(got, off); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("backing file %q: unallocated cluster reads %q", name, got[:8])
+		}
+		reopened.Close()
+	}
+
+	if err := img.SetBackingFile(strings.Repeat("x", 1024), "raw"); err == nil {
+		t.Error("expected an error for a backing file name that is too long")
+	}
+}
+
+func TestBackingChainTooDeep(t *testing.T) {
+	dir := t.TempDir()
+	backing := ""
+	for i := 0; i <= maxChainDepth; i++ {
+		name := fmt.Sprintf("%d.qcow2", i)
+		img, err := Create(filepath.Join(dir, name), 1<<20, &CreateOptions{BackingFile: backing, BackingFormat: "qcow2"})
+		if err != nil {
+			t.Fatalf("image %d: %v", i, err)
+		}
+		img.Close()
+		backing = name
+	}
+	if _, err := Create(filepath.Join(dir, "top.qcow2"), 1<<20, &CreateOptions{BackingFile: backing, BackingFormat: "qcow2"}); !errors.Is(err, ErrChainTooDeep) {
+		t.Errorf("got %v, want %v", err, ErrChainTooDeep)
+	}
+}
+
+func TestRawBackingWithoutFormat(t *testing.T) {
+	dir := t.TempDir()
+	want := bytes.Repeat([]byte("base"), 1<<18)
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), want, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// with no backing file format, it is probed from the magic as qemu does
+	img, err := Create(filepath.Join(dir, "top.qcow2"), int64(len(want)), &CreateOptions{BackingFile: "base.raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if img.Header.BackingFormat() != "" {
+		t.Fatalf("got backing format %q", img.Header.BackingFormat())
+	}
+	got := make([]byte, len(want))
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("the image does not read as its raw backing file")
+	}
+}
+
+func TestUnsupportedFeatures(t *testing.T) {
+	img := tempImage(t)
+	img.Header.IncompatibleFeatures |= IncompatCompressionType | 1<<9
+	if err := img.writeHeader(); err != nil {
+		t.Fatal(err)
+	}
+	name := img.Name()
+	img.Close()
+
+	want := "qcow2: unsupported incompatible features: 'compression type', bit 9"
+	for _, flag := range []int{os.O_RDONLY, os.O_RDWR} {
+		_, err := OpenFile(name, flag, WithNoLock())
+		var uerr UnsupportedFeaturesError
+		if !errors.As(err, &uerr) || uerr.Error() != want {
+			t.Errorf("flag %d: got %v, want %q", flag, err, want)
+		}
+	}
+	if _, err := OpenFile(name, os.O_RDWR, WithNoLock(), WithIgnoreUnknownIncompatible()); err == nil {
+		t.Error("opened an image with unsupported features for writing")
+	}
+
+	// the metadata can be inspected, but not the data
+	img, err := Open(name, WithNoLock(), WithIgnoreUnknownIncompatible())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if _, err := img.Check(nil); err != nil {
+		t.Errorf("check: %v", err)
+	}
+	var uerr UnsupportedFeaturesError
+	if _, err := img.ReadAt(make([]byte, 512), 0); !errors.As(err, &uerr) {
+		t.Errorf("reading: got %v, want an UnsupportedFeaturesError", err)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package qcow2
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const lockSupported = true
+
+// lockFile takes a flock(2) lock on fh, which is released when fh is closed
+func lockFile(fh *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err := syscall.Flock(int(fh.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrLocked
+	}
+	return err
+}
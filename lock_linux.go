@@ -0,0 +1,27 @@
+package qcow2
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// F_OFD_SETLK, which the syscall package does not define
+const fOFDSetlk = 37
+
+const lockSupported = true
+
+// lockFile takes an open file description lock on the whole of fh, which is
+// released when fh is closed. As the descriptor is close-on-exec, child
+// processes do not inherit it.
+func lockFile(fh *os.File, exclusive bool) error {
+	lk := syscall.Flock_t{Type: syscall.F_RDLCK, Whence: 0}
+	if exclusive {
+		lk.Type = syscall.F_WRLCK
+	}
+	err := syscall.FcntlFlock(fh.Fd(), fOFDSetlk, &lk)
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EACCES) {
+		return ErrLocked
+	}
+	return err
+}
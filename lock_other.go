@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package qcow2
+
+import "os"
+
+const lockSupported = false
+
+// lockFile does nothing on this platform, so images are not protected from
+// concurrent writers
+func lockFile(fh *os.File, exclusive bool) error {
+	return nil
+}
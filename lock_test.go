@@ -0,0 +1,77 @@
+package qcow2
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+)
+
+func TestLocking(t *testing.T) {
+	if !lockSupported {
+		t.Skip("file locking is not supported on this platform")
+	}
+	img := tempImage(t)
+	name := img.Name()
+
+	if _, err := OpenFile(name, os.O_RDWR); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected a second writer to fail with ErrLocked, got %v", err)
+	}
+	if _, err := Open(name); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected a reader to fail with ErrLocked, got %v", err)
+	}
+	ro, err := Open(name, WithNoLock())
+	if err != nil {
+		t.Fatalf("expected WithNoLock to open a locked image, got %v", err)
+	}
+	ro.Close()
+
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+	readers := make([]*Image, 2)
+	for i := range readers {
+		if readers[i], err = Open(name); err != nil {
+			t.Fatalf("expected readers to share the image, got %v", err)
+		}
+		defer readers[i].Close()
+	}
+	if _, err := OpenFile(name, os.O_RDWR); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected a writer to fail with ErrLocked while there are readers, got %v", err)
+	}
+	for _, r := range readers {
+		r.Close()
+	}
+	rw, err := OpenFile(name, os.O_RDWR)
+	if err != nil {
+		t.Fatalf("expected the lock to be released on close, got %v", err)
+	}
+	rw.Close()
+}
+
+func TestForceShare(t *testing.T) {
+	if !lockSupported {
+		t.Skip("file locking is not supported on this platform")
+	}
+	img := tempImage(t)
+	defer img.Close()
+	name := img.Name()
+
+	if _, err := Open(name); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected a reader to fail with ErrLocked, got %v", err)
+	}
+	logger, records := newCaptureLogger()
+	shared, err := Open(name, WithForceShare(), WithLogger(logger))
+	if err != nil {
+		t.Fatalf("expected WithForceShare to open a locked image, got %v", err)
+	}
+	defer shared.Close()
+	if checksum(t, shared) != checksum(t, img) {
+		t.Error("the image reads differently shared")
+	}
+	findRecord(t, records(), slog.LevelWarn, "opened without a lock: what is read may be inconsistent if another process is writing to the image")
+
+	if _, err := OpenFile(name, os.O_RDWR, WithForceShare()); !errors.Is(err, ErrForceShareWrite) {
+		t.Errorf("expected a writable force-share open to fail with ErrForceShareWrite, got %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package qcow2
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// discardHandler drops the records of images opened without WithLogger
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// logger is the logger of an image at name, whose records all have its path
+func (o options) logger(name string) *slog.Logger {
+	l := o.log
+	if l == nil {
+		l = slog.New(discardHandler{})
+	}
+	return l.With("image", name)
+}
+
+// structure is the attribute naming the metadata structure a record is about
+func structure(s Structure) slog.Attr {
+	return slog.String("structure", s.String())
+}
+
+// logOddities warns of what the header of the image has that is ignored
+func (img *Image) logOddities() {
+	for i, e := range img.Header.ExtHeaders {
+		if e.Size == 0 {
+			img.log.Warn("zero-length header extension", "type", fmt.Sprintf("%#x", uint32(e.Type)), "offset", img.Header.ExtensionOffset(i), structure(StructExtension))
+		}
+	}
+	for i, b := range img.Header.trailer {
+		if b != 0 {
+			img.log.Warn("ignoring trailing garbage in the header cluster", "offset", img.Header.layoutEnd+int64(i), structure(StructHeader))
+			break
+		}
+	}
+}
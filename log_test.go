@@ -0,0 +1,162 @@
+package qcow2
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// logRecord is a record of captureHandler, with its attributes by key
+type logRecord struct {
+	level slog.Level
+	msg   string
+	attrs map[string]any
+}
+
+// captureHandler keeps the records of all levels
+type captureHandler struct {
+	mu      *sync.Mutex
+	records *[]logRecord
+	attrs   []slog.Attr
+}
+
+func newCaptureLogger() (*slog.Logger, func() []logRecord) {
+	h := captureHandler{mu: &sync.Mutex{}, records: &[]logRecord{}}
+	return slog.New(h), func() []logRecord {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		records := *h.records
+		*h.records = nil
+		return records
+	}
+}
+
+func (captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h captureHandler) Handle(_ context.Context, r slog.Record) error {
+	rec := logRecord{level: r.Level, msg: r.Message, attrs: map[string]any{}}
+	for _, a := range h.attrs {
+		rec.attrs[a.Key] = a.Value.Any()
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		rec.attrs[a.Key] = a.Value.Any()
+		return true
+	})
+	h.mu.Lock()
+	*h.records = append(*h.records, rec)
+	h.mu.Unlock()
+	return nil
+}
+
+func (h captureHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h.attrs = append(append([]slog.Attr(nil), h.attrs...), attrs...)
+	return h
+}
+
+func (h captureHandler) WithGroup(string) slog.Handler { return h }
+
+// findRecord is the first record of level and msg
+func findRecord(t *testing.T, records []logRecord, level slog.Level, msg string) logRecord {
+	t.Helper()
+	for _, r := range records {
+		if r.level == level && r.msg == msg {
+			return r
+		}
+	}
+	t.Fatalf("no %s record %q in %v", level, msg, records)
+	return logRecord{}
+}
+
+func TestWithLogger(t *testing.T) {
+	logger, records := newCaptureLogger()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), make([]byte, 1<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "overlay.qcow2")
+	img, err := Create(name, 1<<20, &CreateOptions{BackingFile: "base.raw", BackingFormat: "raw"}, WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := findRecord(t, records(), slog.LevelInfo, "opened backing file")
+	if r.attrs["image"] != name || r.attrs["backing"] != filepath.Join(dir, "base.raw") || r.attrs["format"] != "raw" {
+		t.Errorf("got the attributes %v", r.attrs)
+	}
+
+	if _, err := img.WriteAt([]byte("data"), 70<<10); err != nil {
+		t.Fatal(err)
+	}
+	got := records()
+	r = findRecord(t, got, slog.LevelDebug, "allocated L2 table")
+	if r.attrs["structure"] != "l2-table" || r.attrs["offset"].(int64) == 0 {
+		t.Errorf("got the attributes %v", r.attrs)
+	}
+	r = findRecord(t, got, slog.LevelDebug, "allocated data cluster")
+	if r.attrs["guest-offset"] != int64(64<<10) || r.attrs["replaces"] != "unallocated" {
+		t.Errorf("got the attributes %v", r.attrs)
+	}
+
+	oldOff := img.Header.RefcountTableOffset
+	if err := img.growRefcountTable(int64(len(img.reftable)) + 1); err != nil {
+		t.Fatal(err)
+	}
+	r = findRecord(t, records(), slog.LevelInfo, "grew the refcount table")
+	if r.attrs["old-offset"] != oldOff || r.attrs["offset"] != img.Header.RefcountTableOffset || r.attrs["structure"] != "refcount-table" {
+		t.Errorf("got the attributes %v", r.attrs)
+	}
+
+	// oddities of the header
+	if err := img.AddExtension(0x12345678, nil); err != nil {
+		t.Fatal(err)
+	}
+	extOff := img.Header.ExtensionOffset(len(img.Header.ExtHeaders) - 1)
+	if _, err := img.fh.WriteAt([]byte{0xff}, img.clusterSize-1); err != nil {
+		t.Fatal(err)
+	}
+	img.Header.AutoclearFeatures |= 1 << 5
+	if err := img.writeHeader(); err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+
+	img, err = Open(name, WithLogger(logger), WithNoBacking())
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	got = records()
+	r = findRecord(t, got, slog.LevelWarn, "zero-length header extension")
+	if r.attrs["offset"] != extOff || r.attrs["type"] != "0x12345678" {
+		t.Errorf("got the attributes %v", r.attrs)
+	}
+	r = findRecord(t, got, slog.LevelWarn, "ignoring trailing garbage in the header cluster")
+	if r.attrs["offset"] != img.clusterSize-1 {
+		t.Errorf("got the attributes %v", r.attrs)
+	}
+	for _, r := range got {
+		if r.msg == "cleared unknown autoclear features" {
+			t.Error("cleared the autoclear features of a read-only image")
+		}
+	}
+
+	img, err = OpenFile(name, os.O_RDWR, WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = findRecord(t, records(), slog.LevelInfo, "cleared unknown autoclear features")
+	if r.attrs["bits"] != "0x20" {
+		t.Errorf("got the attributes %v", r.attrs)
+	}
+	img.Close()
+	img, err = Open(name, WithNoBacking())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if img.Header.AutoclearFeatures != 0 {
+		t.Errorf("autoclear features %#x were not cleared", img.Header.AutoclearFeatures)
+	}
+}
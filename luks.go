@@ -0,0 +1,290 @@
+package qcow2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+)
+
+// ErrBadPassphrase is returned when reading the data of an encrypted image
+// whose passphrase unlocks none of its LUKS key slots
+var ErrBadPassphrase = errors.New("qcow2: the passphrase unlocks no key slot of the image")
+
+// PassphraseFunc returns the passphrase of the encrypted image at name, when
+// its data is first read. attempt counts the calls for the image from 1, and
+// is only past 1 once the passphrase before proved wrong.
+type PassphraseFunc func(name string, attempt int) ([]byte, error)
+
+// WithPassphrase unlocks the LUKS encryption of the image, and of its backing
+// files, with passphrase, which is otherwise unused
+func WithPassphrase(passphrase []byte) Option {
+	return WithPassphraseFunc(func(string, int) ([]byte, error) { return passphrase, nil }, 1)
+}
+
+// WithPassphraseFunc asks f, up to attempts times, for the passphrase of the
+// LUKS encryption of the image or a backing file, when its data is first
+// read. Images not encrypted, and work on their metadata alone, never ask.
+// Once the attempts are used up reads return ErrBadPassphrase, and an error
+// of f is returned as is.
+func WithPassphraseFunc(f PassphraseFunc, attempts int) Option {
+	return func(o *options) {
+		o.passphrase, o.passphraseAttempts = f, max(attempts, 1)
+	}
+}
+
+// luksSectorSize is the unit of encryption, whose number is its IV
+const luksSectorSize = 512
+
+func alignSector(off int64) int64 {
+	return (off + luksSectorSize - 1) &^ (luksSectorSize - 1)
+}
+
+// luksKey is the key of the data of an encrypted image, found the first time
+// its data is read, and shared with the snapshot views of the image
+type luksKey struct {
+	mu     sync.Mutex
+	done   bool
+	cipher *xtsCipher
+	err    error
+}
+
+// dataCipher is the cipher of the data of the encrypted image, unlocking it
+// the first time
+func (img *Image) dataCipher() (*xtsCipher, error) {
+	k := img.crypt
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !k.done {
+		k.cipher, k.err = img.unlock()
+		k.done = true
+	}
+	return k.cipher, k.err
+}
+
+// luksKeySlot is a key slot of a version 1 LUKS header
+type luksKeySlot struct {
+	iterations int
+	salt       []byte
+	// keyMaterial is the offset of the key material from the LUKS header, in
+	// sectors
+	keyMaterial int64
+	stripes     int
+}
+
+// unlock finds the master key of the LUKS header with the passphrase of
+// the options
+func (img *Image) unlock() (*xtsCipher, error) {
+	switch {
+	case img.Header.CryptMethod != CryptLUKS:
+		return nil, fmt.Errorf("%w with the %s method, which is not supported", ErrEncrypted, img.Header.CryptMethod)
+	case img.Header.ExtensionsSkipped:
+		return nil, fmt.Errorf("%w: they locate the LUKS header of the encrypted image", ErrExtensionsSkipped)
+	case img.opts.passphrase == nil:
+		return nil, fmt.Errorf("%w, and no passphrase was given", ErrEncrypted)
+	}
+	l, buf, off, length, err := img.readLUKSHeader()
+	if err != nil {
+		return nil, err
+	}
+	if l.Version != 1 {
+		return nil, fmt.Errorf("qcow2: LUKS version %d headers are not supported", l.Version)
+	}
+	if l.CipherName != "aes" || l.CipherMode != "xts-plain64" || (l.KeyBytes != 32 && l.KeyBytes != 64) {
+		return nil, fmt.Errorf("qcow2: unsupported LUKS cipher %s-%s of %d byte keys", l.CipherName, l.CipherMode, l.KeyBytes)
+	}
+	newHash, err := luksHash(l.HashSpec)
+	if err != nil {
+		return nil, err
+	}
+	mkDigest, mkSalt, mkIterations := buf[112:132], buf[132:164], be32(buf[164:168])
+
+	var slots []luksKeySlot
+	for i := 0; i < luksKeySlots; i++ {
+		s := buf[208+48*i : 208+48*(i+1)]
+		if be32(s) != luksKeySlotEnabled {
+			continue
+		}
+		slot := luksKeySlot{iterations: be32(s[4:8]), salt: s[8:40], keyMaterial: int64(be32(s[40:44])), stripes: be32(s[44:48])}
+		if slot.stripes < 1 || slot.iterations < 1 || (slot.keyMaterial+1)*luksSectorSize > length {
+			return nil, fmt.Errorf("qcow2: LUKS key slot %d is invalid", i)
+		}
+		slots = append(slots, slot)
+	}
+	for attempt := 1; attempt <= img.opts.passphraseAttempts; attempt++ {
+		passphrase, err := img.opts.passphrase(img.name, attempt)
+		if err != nil {
+			return nil, err
+		}
+		for _, slot := range slots {
+			material := make([]byte, alignSector(int64(l.KeyBytes*slot.stripes)))
+			if int64(len(material)) > length-slot.keyMaterial*luksSectorSize {
+				return nil, fmt.Errorf("qcow2: LUKS key material of %d bytes does not fit the header", len(material))
+			}
+			if _, err := img.fh.ReadAt(material, off+slot.keyMaterial*luksSectorSize); err != nil {
+				if err == io.EOF {
+					err = errors.New("past the end of the file")
+				}
+				return nil, fmt.Errorf("qcow2: reading LUKS key material: %w", err)
+			}
+			slotCipher, err := newXTSCipher(pbkdf2(newHash, passphrase, slot.salt, slot.iterations, l.KeyBytes))
+			if err != nil {
+				return nil, err
+			}
+			slotCipher.decrypt(material, 0)
+			key := afMerge(material[:l.KeyBytes*slot.stripes], l.KeyBytes, slot.stripes, newHash)
+			if subtle.ConstantTimeCompare(pbkdf2(newHash, key, mkSalt, mkIterations, len(mkDigest)), mkDigest) == 1 {
+				return newXTSCipher(key)
+			}
+		}
+	}
+	return nil, ErrBadPassphrase
+}
+
+// luksHash is the hash of the LUKS hash spec
+func luksHash(spec string) (func() hash.Hash, error) {
+	switch spec {
+	case "sha1":
+		return sha1.New, nil
+	case "sha256":
+		return sha256.New, nil
+	case "sha512":
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("qcow2: unsupported LUKS hash %q", spec)
+}
+
+// pbkdf2 derives a key of keyLen bytes from password, as in RFC 8018
+func pbkdf2(newHash func() hash.Hash, password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(newHash, password)
+	key := make([]byte, 0, keyLen+prf.Size())
+	u := make([]byte, prf.Size())
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		t := prf.Sum(nil)
+		copy(u, t)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			subtle.XORBytes(t, t, u)
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// afMerge recovers the key of keyBytes from the stripes the anti-forensic
+// splitter of LUKS spread it into
+func afMerge(material []byte, keyBytes, stripes int, newHash func() hash.Hash) []byte {
+	d := make([]byte, keyBytes)
+	for i := 0; i < stripes-1; i++ {
+		subtle.XORBytes(d, d, material[i*keyBytes:(i+1)*keyBytes])
+		afDiffuse(d, newHash)
+	}
+	subtle.XORBytes(d, d, material[(stripes-1)*keyBytes:])
+	return d
+}
+
+// afDiffuse replaces each digest sized block of d, numbered from 0, by the
+// hash of its number and itself, truncated for the last
+func afDiffuse(d []byte, newHash func() hash.Hash) {
+	h := newHash()
+	size := h.Size()
+	for i := 0; i*size < len(d); i++ {
+		block := d[i*size : min((i+1)*size, len(d))]
+		h.Reset()
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(i)))
+		h.Write(block)
+		copy(block, h.Sum(nil))
+	}
+}
+
+// xtsCipher is AES in the XTS mode, with the plain64 IV of LUKS: the number
+// of the sector, little endian
+type xtsCipher struct {
+	data, tweak cipher.Block
+}
+
+func newXTSCipher(key []byte) (*xtsCipher, error) {
+	data, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+	tweak, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+	return &xtsCipher{data, tweak}, nil
+}
+
+// decrypt decrypts the whole sectors of p in place, the first of which is
+// numbered sector
+func (x *xtsCipher) decrypt(p []byte, sector uint64) {
+	x.crypt(p, sector, x.data.Decrypt)
+}
+
+// encrypt is the inverse of decrypt
+func (x *xtsCipher) encrypt(p []byte, sector uint64) {
+	x.crypt(p, sector, x.data.Encrypt)
+}
+
+func (x *xtsCipher) crypt(p []byte, sector uint64, block func(dst, src []byte)) {
+	var t [aes.BlockSize]byte
+	for ; len(p) >= luksSectorSize; p, sector = p[luksSectorSize:], sector+1 {
+		clear(t[:])
+		binary.LittleEndian.PutUint64(t[:8], sector)
+		x.tweak.Encrypt(t[:], t[:])
+		for b := p[:luksSectorSize]; len(b) > 0; b = b[aes.BlockSize:] {
+			subtle.XORBytes(b[:aes.BlockSize], b[:aes.BlockSize], t[:])
+			block(b[:aes.BlockSize], b[:aes.BlockSize])
+			subtle.XORBytes(b[:aes.BlockSize], b[:aes.BlockSize], t[:])
+			// multiply the tweak by x in GF(2^128), little endian
+			carry := t[15] >> 7
+			for j := 15; j > 0; j-- {
+				t[j] = t[j]<<1 | t[j-1]>>7
+			}
+			t[0] = t[0]<<1 ^ 0x87*carry
+		}
+	}
+}
+
+// readDecrypted reads the data of an encrypted image at the host offset off
+// into p. LUKS encrypts the clusters by their host sectors, so p is read by
+// the whole sectors it lies in.
+func (img *Image) readDecrypted(p []byte, off int64) error {
+	c, err := img.dataCipher()
+	if err != nil {
+		return err
+	}
+	start := off &^ (luksSectorSize - 1)
+	buf, partial := p, start != off || len(p)%luksSectorSize != 0
+	if partial {
+		buf = make([]byte, alignSector(off+int64(len(p)))-start)
+	}
+	n, err := img.fh.ReadAt(buf, start)
+	if err == io.EOF {
+		// clusters allocated past the end of the file read as zeros
+		clear(buf[n:])
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	c.decrypt(buf, uint64(start/luksSectorSize))
+	if partial {
+		copy(p, buf[off-start:])
+	}
+	return nil
+}
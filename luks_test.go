@@ -0,0 +1,248 @@
+package qcow2
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestXTSCipher(t *testing.T) {
+	// from OpenSSL, as aes-256-xts and aes-128-xts with the sector as IV
+	for _, tc := range []struct {
+		key    []byte
+		sector uint64
+		plain  []byte
+		sha256 string
+	}{
+		{seq(0, 64), 5, bytes.Repeat(seq(0, 256), 4), "4e144ca93fb42d1919633e4a19500756c0f147c2aa571ce17f7dc9da65dc3adc"},
+		{seq(100, 32), 1 << 40, make([]byte, 512), "3fd7cfc073cf75ee971f788fd8074958d0eb22d18b7d20010f9e0eea865e583e"},
+	} {
+		x, err := newXTSCipher(tc.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := append([]byte(nil), tc.plain...)
+		x.encrypt(p, tc.sector)
+		if sum := sha256.Sum256(p); hex.EncodeToString(sum[:]) != tc.sha256 {
+			t.Errorf("%d byte key: encrypted to %x...", len(tc.key), p[:16])
+		}
+		x.decrypt(p, tc.sector)
+		if !bytes.Equal(p, tc.plain) {
+			t.Errorf("%d byte key: did not decrypt to the plain text", len(tc.key))
+		}
+	}
+}
+
+func TestPBKDF2(t *testing.T) {
+	// from Python's hashlib.pbkdf2_hmac
+	for _, tc := range []struct {
+		hash             string
+		password, salt   string
+		iterations, size int
+		want             string
+	}{
+		{"sha1", "password", "salt", 4096, 20, "4b007901b765489abead49d926f721d065a429c1"},
+		{"sha256", "passphrase", "saltsaltsaltsaltsaltsaltsaltsalt", 1000, 64, "b435dae8e6f7cd6fc0afd7145c19c2fe3c47aa0cdbc7cefe5d572c085ae6bc17ebdee92e7fabbb77ed9a8e12c6a313ad0ae1c02a201340bc537b2122766ec4e8"},
+		{"sha512", "key", "NaCl", 3, 80, "d2c733a453a2f7279c78843d24b50aa6e65e7a98198da74f31ca677f5d4cd40d49a4e58137f862f7230ab8b497458b1e64186fb3edf1c7d9e0c06b776bce39efc7de4ee4bacd593a29e6979dc6fdeb18"},
+	} {
+		newHash, err := luksHash(tc.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(pbkdf2(newHash, []byte(tc.password), []byte(tc.salt), tc.iterations, tc.size)); got != tc.want {
+			t.Errorf("%s: got %s", tc.hash, got)
+		}
+	}
+}
+
+// seq is n bytes counting up from first
+func seq(first byte, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = first + byte(i)
+	}
+	return b
+}
+
+// encryptLUKS encrypts the image at name in place, the way qemu does with
+// encrypt.format=luks: aes-xts-plain64 by host sectors, a key slot for each
+// passphrase, and the LUKS header in clusters of its own
+func encryptLUKS(t *testing.T, name string, passphrases ...string) {
+	t.Helper()
+	const (
+		keyBytes   = 64
+		stripes    = 4000
+		iterations = 1000
+	)
+	img, err := OpenFile(name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	key := make([]byte, keyBytes)
+	rand.Read(key)
+	x, err := newXTSCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the data clusters first, before the header takes clusters
+	buf := make([]byte, img.clusterSize)
+	for off := int64(0); off < img.Size(); off += img.clusterSize {
+		err := img.WalkExtents(off, img.clusterSize, func(e Extent) error {
+			if e.Type != ExtentData {
+				return nil
+			}
+			if _, err := img.fh.ReadAt(buf, e.HostOffset); err != nil {
+				return err
+			}
+			x.encrypt(buf, uint64(e.HostOffset/luksSectorSize))
+			_, err := img.fh.WriteAt(buf, e.HostOffset)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	slotSectors := alignSector(keyBytes*stripes) / luksSectorSize
+	hdr := make([]byte, 4096+int64(len(passphrases))*slotSectors*luksSectorSize)
+	copy(hdr, luksMagic)
+	binary.BigEndian.PutUint16(hdr[6:], 1)
+	copy(hdr[8:], "aes")
+	copy(hdr[40:], "xts-plain64")
+	copy(hdr[72:], "sha256")
+	binary.BigEndian.PutUint32(hdr[104:], uint32(len(hdr)/luksSectorSize))
+	binary.BigEndian.PutUint32(hdr[108:], keyBytes)
+	rand.Read(hdr[132:164])
+	binary.BigEndian.PutUint32(hdr[164:], iterations)
+	copy(hdr[112:132], pbkdf2(sha256.New, key, hdr[132:164], iterations, 20))
+	copy(hdr[168:], "5b1c3c9e-2f1a-4c43-9d8e-1f2a3b4c5d6e")
+	for i := 0; i < luksKeySlots; i++ {
+		binary.BigEndian.PutUint32(hdr[208+48*i:], 0x0000dead)
+		binary.BigEndian.PutUint32(hdr[208+48*i+44:], stripes)
+	}
+	for i, p := range passphrases {
+		s := hdr[208+48*i:]
+		binary.BigEndian.PutUint32(s, luksKeySlotEnabled)
+		binary.BigEndian.PutUint32(s[4:], iterations)
+		rand.Read(s[8:40])
+		material := 8 + int64(i)*slotSectors
+		binary.BigEndian.PutUint32(s[40:], uint32(material))
+		// the anti-forensic split that afMerge undoes
+		m := hdr[material*luksSectorSize : (material+slotSectors)*luksSectorSize]
+		rand.Read(m[:keyBytes*(stripes-1)])
+		d := make([]byte, keyBytes)
+		for j := 0; j < stripes-1; j++ {
+			for k := range d {
+				d[k] ^= m[j*keyBytes+k]
+			}
+			afDiffuse(d, sha256.New)
+		}
+		for k := range d {
+			m[(stripes-1)*keyBytes+k] = d[k] ^ key[k]
+		}
+		slot, err := newXTSCipher(pbkdf2(sha256.New, []byte(p), s[8:40], iterations, keyBytes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		slot.encrypt(m, 0)
+	}
+
+	off, err := img.allocClusters(int64(len(hdr)) / img.clusterSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.fh.WriteAt(hdr, off); err != nil {
+		t.Fatal(err)
+	}
+	img.Header.CryptMethod = CryptLUKS
+	if err := img.writeHeader(); err != nil {
+		t.Fatal(err)
+	}
+	var ext [16]byte
+	binary.BigEndian.PutUint64(ext[:], uint64(off))
+	binary.BigEndian.PutUint64(ext[8:], uint64(len(hdr)))
+	if err := img.AddExtension(HdrExtFullDiskCrypt, ext[:]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLUKSDecryption(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "luks.qcow2")
+	img, err := Create(name, 1<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("secret data, "), 1000)
+	if _, err := img.WriteAt(data, 6000); err != nil {
+		t.Fatal(err)
+	}
+	want := checksum(t, img)
+	img.Close()
+	encryptLUKS(t, name, "first", "second")
+
+	img, err = Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := img.LUKSHeader()
+	if err != nil || l.ActiveKeySlots != 2 || l.CipherMode != "xts-plain64" {
+		t.Fatalf("got the LUKS header %+v, %v", l, err)
+	}
+	buf := make([]byte, 1000)
+	if _, err := img.ReadAt(buf, 900<<10); err != nil || !bytes.Equal(buf, make([]byte, 1000)) {
+		t.Errorf("unallocated clusters read %v, not zeros", err)
+	}
+	if _, err := img.ReadAt(buf, 6000); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("read data without a passphrase: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(name, WithPassphrase([]byte("third")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.ReadAt(buf, 6000); err != ErrBadPassphrase {
+		t.Errorf("read with a wrong passphrase: %v", err)
+	}
+	img.Close()
+
+	var asked []int
+	ask := func(n string, attempt int) ([]byte, error) {
+		if n != name {
+			t.Errorf("asked for the passphrase of %s", n)
+		}
+		asked = append(asked, attempt)
+		if attempt == 1 {
+			return []byte("wrong"), nil
+		}
+		return []byte("second"), nil
+	}
+	img, err = OpenFile(name, os.O_RDWR, WithPassphraseFunc(ask, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if len(asked) != 0 {
+		t.Errorf("asked for the passphrase when opening")
+	}
+	// unaligned to the sectors, and across clusters
+	if _, err := img.ReadAt(buf, 8190); err != nil || !bytes.Equal(buf, data[8190-6000:][:1000]) {
+		t.Errorf("read %q, %v", buf[:20], err)
+	}
+	if checksum(t, img) != want || len(asked) != 2 {
+		t.Errorf("the decrypted disk differs, after asking %v", asked)
+	}
+	if _, err := img.WriteAt(buf, 0); err != ErrEncrypted {
+		t.Errorf("wrote to an encrypted image: %v", err)
+	}
+	if _, err := img.Compact(); err != ErrEncrypted {
+		t.Errorf("compacted an encrypted image: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package qcow2
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Measurement is the file size needed to convert a disk
+type Measurement struct {
+	// Required is the size of the output holding the data of the input
+	Required int64
+	// FullyAllocated is the size of the output with every cluster allocated
+	FullyAllocated int64
+}
+
+// Measure computes the size of the file that converting size bytes of src
+// to format, "qcow2" or "raw", produces without compression. For qcow2 it is
+// exactly the size of the image ConvertRawToQcow2 creates with opts. For raw
+// the required size is the data actually written, rather than the apparent
+// size of the sparse file. src may be nil to measure an empty disk.
+func Measure(src io.ReaderAt, size int64, format string, opts *CreateOptions) (Measurement, error) {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+	switch format {
+	case "raw":
+		var m Measurement
+		m.FullyAllocated = size
+		if src == nil {
+			return m, nil
+		}
+		err := scanNonZero(src, size, sparseBlock, func(block int64) {
+			m.Required += min(sparseBlock, size-block*sparseBlock)
+		})
+		return m, err
+	case "qcow2":
+	default:
+		return Measurement{}, fmt.Errorf("qcow2: cannot measure for format %q", format)
+	}
+
+	l, err := opts.layout(size)
+	if err != nil {
+		return Measurement{}, err
+	}
+	full, _ := l.clusters(l.l1Entries, l.dataClusters())
+	m := Measurement{FullyAllocated: full * l.clusterSize}
+	switch {
+	case opts.Preallocation == "metadata" || opts.Preallocation == "full":
+		m.Required = m.FullyAllocated
+		return m, nil
+	case src == nil:
+		n, _ := l.clusters(0, 0)
+		m.Required = n * l.clusterSize
+		return m, nil
+	}
+	var data int64
+	tables := map[int64]bool{}
+	err = scanNonZero(src, size, l.clusterSize, func(cluster int64) {
+		data++
+		tables[cluster/l.l2Entries] = true
+	})
+	if err != nil {
+		return Measurement{}, err
+	}
+	n, _ := l.clusters(int64(len(tables)), data)
+	m.Required = n * l.clusterSize
+	return m, nil
+}
+
+// scanNonZero calls fn with the index of every block of unit bytes of src that
+// is not all zeros, skipping the holes of a file and what an image knows to
+// read as zeros without reading them
+func scanNonZero(src io.ReaderAt, size, unit int64, fn func(int64)) error {
+	ranges := [][2]int64{{0, size}}
+	switch s := src.(type) {
+	case *os.File:
+		if r, ok := dataRanges(s, size); ok {
+			ranges = r
+		}
+	case *Image:
+		ranges = nil
+		err := s.WalkExtents(0, min(size, s.Size()), func(e Extent) error {
+			if !e.ReadsAsZeros() {
+				ranges = append(ranges, [2]int64{e.Start, e.Start + e.Length})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	chunk := max(convertChunk, unit)
+	buf := make([]byte, chunk)
+	zero := make([]byte, unit)
+	next := int64(0) // the first block not looked at yet
+	for _, r := range ranges {
+		end := min((r[1]+unit-1)/unit*unit, size)
+		for off := max(r[0]/unit*unit, next); off < end; {
+			n := min(chunk, end-off)
+			p := buf[:n]
+			if m, err := src.ReadAt(p, off); err != nil && !(err == io.EOF && int64(m) == n) {
+				return err
+			}
+			for i := int64(0); i < n; i += unit {
+				if !bytes.Equal(p[i:min(i+unit, n)], zero[:min(unit, n-i)]) {
+					fn((off + i) / unit)
+				}
+			}
+			off += n
+			next = off
+		}
+	}
+	return nil
+}
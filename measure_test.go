@@ -0,0 +1,127 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMeasure(t *testing.T) {
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "disk.raw")
+	f, err := os.Create(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// data in the first L2 table, a block of zeros, and data in the last
+	// cluster of a size that is not a whole number of clusters
+	const size = 300<<20 + 1000
+	for _, w := range []struct {
+		off int64
+		p   []byte
+	}{
+		{0, bytes.Repeat([]byte{1}, 100000)},
+		{5 << 20, make([]byte, 1<<20)},
+		{150<<20 + 512, []byte("qcow2")},
+		{size - 10, bytes.Repeat([]byte{2}, 10)},
+	} {
+		if _, err := f.WriteAt(w.p, w.off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fileSize := func(name string) int64 {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+	for _, opts := range []CreateOptions{
+		{},
+		{ClusterSize: 512},
+		{ClusterSize: 512, RefcountBits: 64},
+		{ClusterSize: 4096, RefcountBits: 1},
+		{ClusterSize: 2 << 20, Version: 2},
+		{ClusterSize: 4096, Preallocation: "metadata"},
+	} {
+		m, err := Measure(f, size, "qcow2", &opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		name := filepath.Join(dir, "disk.qcow2")
+		if err := ConvertRawToQcow2(f, size, name, &ConvertOptions{CreateOptions: opts}); err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		if got := fileSize(name); got != m.Required {
+			t.Errorf("%+v: measured %d bytes, converted into %d", opts, m.Required, got)
+		}
+
+		// measuring through an image finds the same data
+		img, err := Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m2, err := Measure(img, size, "qcow2", &opts); err != nil || m2 != m {
+			t.Errorf("%+v: measured %+v through the image, %+v from the raw file: %v", opts, m2, m, err)
+		}
+		img.Close()
+
+		full := opts
+		full.Preallocation = "metadata"
+		mf, err := Measure(nil, size, "qcow2", &full)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mf.FullyAllocated != m.FullyAllocated || mf.Required != mf.FullyAllocated {
+			t.Errorf("%+v: measured %+v preallocated, %+v not", opts, mf, m)
+		}
+		name = filepath.Join(dir, "full.qcow2")
+		if img, err = Create(name, size, &full); err != nil {
+			t.Fatal(err)
+		}
+		img.Close()
+		if got := fileSize(name); got != m.FullyAllocated {
+			t.Errorf("%+v: measured %d bytes fully allocated, created %d", opts, m.FullyAllocated, got)
+		}
+
+		empty, err := Measure(nil, size, "qcow2", &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opts.Preallocation == "" {
+			name = filepath.Join(dir, "empty.qcow2")
+			if img, err = Create(name, size, &opts); err != nil {
+				t.Fatal(err)
+			}
+			img.Close()
+			if got := fileSize(name); got != empty.Required {
+				t.Errorf("%+v: measured %d bytes empty, created %d", opts, empty.Required, got)
+			}
+		}
+		os.Remove(filepath.Join(dir, "empty.qcow2"))
+		os.Remove(filepath.Join(dir, "full.qcow2"))
+	}
+
+	// extended L2 entries take twice the room, so fully allocated there are
+	// twice the L2 tables
+	small, _ := Measure(nil, size, "qcow2", &CreateOptions{ClusterSize: 4096})
+	ext, err := Measure(nil, size, "qcow2", &CreateOptions{ClusterSize: 4096, ExtendedL2: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const tables, extTables = (size + 2<<20 - 1) / (2 << 20), (size + 1<<20 - 1) / (1 << 20)
+	if ext.Required != small.Required || ext.FullyAllocated != small.FullyAllocated+(extTables-tables)*4096 {
+		t.Errorf("measured %+v with extended L2 entries, %+v without", ext, small)
+	}
+
+	m, err := Measure(f, size, "raw", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.FullyAllocated != size || m.Required != (100000+4095)/4096*4096+4096+1000 {
+		t.Errorf("measured %+v for raw output", m)
+	}
+}
@@ -0,0 +1,249 @@
+package qcow2
+
+import (
+	"container/list"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"sync"
+)
+
+// defaultL2CacheSize is the size of the L2 tables an image caches unless
+// opened WithL2CacheSize, as qemu's default, which covers 8 GiB of guest disk
+// with 64 KiB clusters
+const defaultL2CacheSize = 1 << 20
+
+// defaultRefcountCacheSize is the size of the refcount blocks an image caches
+// unless opened WithMetadataCache, as qemu's default
+const defaultRefcountCacheSize = 256 << 10
+
+// MetadataKey locates a cluster of metadata: File is the absolute path, or
+// the URL, of the image file holding it, and Offset its host offset
+type MetadataKey struct {
+	File   string
+	Offset int64
+}
+
+// MetadataCache caches the clusters of metadata an image reads, its L2 tables
+// and refcount blocks, so that they are not read from the file every time.
+// One cache may be shared by many images, as by WithMetadataCache, which is
+// why its keys name the file as well. It must be safe for concurrent use.
+//
+// The contract on invalidation: an image calls Evict after each write to its
+// file, for the bytes written, and for the whole file when truncating it, and
+// only then Puts the cluster again when it wrote it itself. A refcount block
+// the image updates is Put again in place of the Evict. A cache can not
+// go stale as long as every image writing to a file is opened with it, which
+// the exclusive lock of a writable image ensures unless opened WithNoLock.
+type MetadataCache interface {
+	// Get returns the cluster of metadata cached for key, or nil. The cache
+	// must not modify its bytes. The image writing the file updates those of
+	// a refcount block in place, then writes and Puts it again.
+	Get(key MetadataKey) []byte
+	// Put caches data, the cluster of metadata at key, which accounts for
+	// len(data) bytes. The cache may drop it, or anything else it holds, at
+	// any time.
+	Put(key MetadataKey, data []byte)
+	// Evict drops the clusters of file overlapping the n bytes at off
+	Evict(file string, off, n int64)
+}
+
+// LRUCache is the MetadataCache images use by default, keeping the most
+// recently used clusters up to a size in bytes
+type LRUCache struct {
+	mu         sync.Mutex
+	size, used int64
+	files      map[string]*cachedFile
+	// lru is the clusters from the most to the least recently used
+	lru list.List
+}
+
+// cachedFile is what an LRUCache holds of one file, indexed by offset, and
+// the size of its clusters, to look up those a write overlaps
+type cachedFile struct {
+	clusterSize int64
+	clusters    map[int64]*list.Element
+}
+
+type cachedCluster struct {
+	key  MetadataKey
+	data []byte
+}
+
+// NewLRUCache caches up to size bytes of metadata
+func NewLRUCache(size int64) *LRUCache {
+	return &LRUCache{size: size, files: map[string]*cachedFile{}}
+}
+
+// Get returns the cluster cached for key, as MetadataCache
+func (c *LRUCache) Get(key MetadataKey) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.files[key.File]
+	if f == nil {
+		return nil
+	}
+	e := f.clusters[key.Offset]
+	if e == nil {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedCluster).data
+}
+
+// Put caches data for key, dropping the least recently used clusters as
+// needed to stay within the size, as MetadataCache
+func (c *LRUCache) Put(key MetadataKey, data []byte) {
+	n := int64(len(data))
+	if n == 0 || n > c.size {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.files[key.File]
+	if f == nil {
+		f = &cachedFile{clusterSize: n, clusters: map[int64]*list.Element{}}
+		c.files[key.File] = f
+	}
+	if e := f.clusters[key.Offset]; e != nil {
+		cl := e.Value.(*cachedCluster)
+		c.used += n - int64(len(cl.data))
+		cl.data = data
+		c.lru.MoveToFront(e)
+	} else {
+		f.clusterSize = max(f.clusterSize, n)
+		f.clusters[key.Offset] = c.lru.PushFront(&cachedCluster{key: key, data: data})
+		c.used += n
+	}
+	for c.used > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Evict drops the clusters of file overlapping the n bytes at off, as
+// MetadataCache
+func (c *LRUCache) Evict(file string, off, n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.files[file]
+	if f == nil || n <= 0 {
+		return
+	}
+	end := off + min(n, math.MaxInt64-off)
+	// clusters are aligned, so look up those written to, or go through the
+	// clusters of the file when there are fewer of those
+	if start := off &^ (f.clusterSize - 1); (end-start)/f.clusterSize <= int64(len(f.clusters)) {
+		for o := start; o < end; o += f.clusterSize {
+			if e := f.clusters[o]; e != nil {
+				c.remove(e)
+			}
+		}
+		return
+	}
+	for o, e := range f.clusters {
+		if o < end && off < o+int64(len(e.Value.(*cachedCluster).data)) {
+			c.remove(e)
+		}
+	}
+}
+
+// Used is the number of bytes of metadata cached
+func (c *LRUCache) Used() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.used
+}
+
+func (c *LRUCache) remove(e *list.Element) {
+	cl := e.Value.(*cachedCluster)
+	c.lru.Remove(e)
+	delete(c.files[cl.key.File].clusters, cl.key.Offset)
+	c.used -= int64(len(cl.data))
+}
+
+// metadataCaches are the caches of the L2 tables and of the refcount blocks
+// of an image opened with o. The L2 tables are not cached when there is no
+// room for one.
+func (o options) metadataCaches(clusterSize int64) (l2, refcounts MetadataCache) {
+	if o.cache != nil {
+		return o.cache, o.cache
+	}
+	if size := o.l2Cache(); size >= clusterSize {
+		l2 = NewLRUCache(size)
+	}
+	return l2, NewLRUCache(defaultRefcountCacheSize)
+}
+
+// cached returns the cluster of metadata c holds of off of the file, or nil,
+// and the count of writes to check when putting it back
+func (f *hostFile) cached(c MetadataCache, off int64) ([]byte, uint64) {
+	writes := f.writes.Load()
+	return c.Get(MetadataKey{f.key, off}), writes
+}
+
+// putCached caches in c the metadata read at off, unless the file was written
+// to since the count of writes was writes
+func (f *hostFile) putCached(c MetadataCache, off int64, data []byte, writes uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.writes.Load() == writes {
+		c.Put(MetadataKey{f.key, off}, data)
+	}
+}
+
+// evict drops the metadata overlapping the n bytes written at off from the
+// caches
+func (f *hostFile) evict(off, n int64) {
+	if f.l2 == nil && f.refcounts == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writes.Add(1)
+	if f.l2 != nil {
+		f.l2.Evict(f.key, off, n)
+	}
+	if f.refcounts != nil && f.refcounts != f.l2 {
+		f.refcounts.Evict(f.key, off, n)
+	}
+}
+
+// putRefblock caches the refcount block just written at off
+func (f *hostFile) putRefblock(off int64, data []byte) {
+	f.refcounts.Put(MetadataKey{f.key, off}, data)
+}
+
+// writeRefblock writes bytes start to end of b, the refcount block at off
+// updated in place, and caches it again rather than evicting it
+func (f *hostFile) writeRefblock(b []byte, off, start, end int64) error {
+	f.limiter.Wait(context.Background(), int(end-start))
+	_, err := f.storage.WriteAt(b[start:end], off+start)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writes.Add(1)
+	if f.l2 != nil && f.l2 != f.refcounts {
+		f.l2.Evict(f.key, off+start, end-start)
+	}
+	if err != nil {
+		f.refcounts.Evict(f.key, off, int64(len(b)))
+		return err
+	}
+	f.refcounts.Put(MetadataKey{f.key, off}, b)
+	return nil
+}
+
+// l2Entry is the entry at entryOff of the L2 table at off, reading the table
+// unless it is cached. The part of a table past the end of the file reads as
+// zeros.
+func (f *hostFile) l2Entry(off, entryOff, clusterSize int64) (uint64, error) {
+	data, writes := f.cached(f.l2, off)
+	if int64(len(data)) != clusterSize {
+		data = make([]byte, clusterSize)
+		if n, err := f.ReadAt(data, off); err != nil && (err != io.EOF || n <= int(entryOff-off)) {
+			return 0, err
+		}
+		f.putCached(f.l2, off, data, writes)
+	}
+	return binary.BigEndian.Uint64(data[entryOff-off:]), nil
+}
@@ -0,0 +1,273 @@
+package qcow2
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestL2Cache(t *testing.T) {
+	// 512 byte clusters, whose L2 tables map 32 KiB each
+	name := filepath.Join(t.TempDir(), "cache.qcow2")
+	img, err := Create(name, 1<<20, &CreateOptions{ClusterSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+	img, err = OpenFile(name, os.O_RDWR, WithL2CacheSize(2*512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	expect := func(what string, off int64, want []byte) {
+		t.Helper()
+		got := make([]byte, len(want))
+		if _, err := img.ReadAt(got, off); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: read %q at %#x, want %q", what, got[:8], off, want[:8])
+		}
+	}
+	one := bytes.Repeat([]byte("one."), 128)
+	two := bytes.Repeat([]byte("two."), 128)
+	zeros := make([]byte, 512)
+	for i := int64(0); i < 4; i++ {
+		if _, err := img.WriteAt(one, i<<15); err != nil {
+			t.Fatal(err)
+		}
+		expect("written", i<<15, one)
+	}
+	if n := img.fh.l2.(*LRUCache).Used(); n != 2*512 {
+		t.Errorf("cached %d bytes of L2 tables, want the 2 that fit", n)
+	}
+
+	// the snapshot shares the cached tables, which the next writes copy
+	if err := img.CreateSnapshot("one"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(two, 3<<15); err != nil {
+		t.Fatal(err)
+	}
+	expect("overwritten", 3<<15, two)
+	if _, err := img.WriteAt(zeros, 2<<15); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.TrimZeroClusters(); err != nil {
+		t.Fatal(err)
+	}
+	expect("trimmed", 2<<15, zeros)
+
+	if err := img.ApplySnapshot("one"); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 4; i++ {
+		expect("reverted", i<<15, one)
+	}
+
+	uncached, err := Open(name, WithNoLock(), WithL2CacheSize(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uncached.Close()
+	if uncached.fh.l2 != nil {
+		t.Error("cached L2 tables of a size of 0")
+	}
+	if checksum(t, uncached) != checksum(t, img) {
+		t.Error("reads without the L2 cache differ")
+	}
+}
+
+// recordingCache is a MetadataCache recording the calls made to it
+type recordingCache struct {
+	*LRUCache
+	mu    sync.Mutex
+	calls []cacheCall
+}
+
+type cacheCall struct {
+	op  string
+	key MetadataKey
+	n   int64
+	hit bool
+}
+
+func (c *recordingCache) Get(key MetadataKey) []byte {
+	data := c.LRUCache.Get(key)
+	c.record(cacheCall{op: "get", key: key, hit: data != nil})
+	return data
+}
+
+func (c *recordingCache) Put(key MetadataKey, data []byte) {
+	c.record(cacheCall{op: "put", key: key, n: int64(len(data))})
+	c.LRUCache.Put(key, data)
+}
+
+func (c *recordingCache) Evict(file string, off, n int64) {
+	c.record(cacheCall{op: "evict", key: MetadataKey{file, off}, n: n})
+	c.LRUCache.Evict(file, off, n)
+}
+
+func (c *recordingCache) record(call cacheCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, call)
+}
+
+// take returns the calls recorded since the last take
+func (c *recordingCache) take() []cacheCall {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	calls := c.calls
+	c.calls = nil
+	return calls
+}
+
+// count counts the calls of op for key, or those that are hits for a get
+func count(calls []cacheCall, op string, key MetadataKey, hit bool) int {
+	n := 0
+	for _, c := range calls {
+		if c.op == op && c.key == key && c.hit == hit {
+			n++
+		}
+	}
+	return n
+}
+
+// expectFresh fails the test when a cluster cached for name differs from the
+// file
+func (c *recordingCache) expectFresh(t *testing.T, name string) {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.LRUCache.mu.Lock()
+	defer c.LRUCache.mu.Unlock()
+	f := c.LRUCache.files[name]
+	if f == nil {
+		return
+	}
+	for off, e := range f.clusters {
+		cached := e.Value.(*cachedCluster).data
+		end := min(off+int64(len(cached)), int64(len(data)))
+		if !bytes.Equal(cached[:end-off], data[off:end]) {
+			t.Errorf("the cluster cached at %#x is stale", off)
+		}
+	}
+}
+
+func TestMetadataCache(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "file.qcow2")
+	img, err := Create(name, 1<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+
+	cache := &recordingCache{LRUCache: NewLRUCache(1 << 20)}
+	if img, err = OpenFile(name, os.O_RDWR, WithMetadataCache(cache)); err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	l2 := MetadataKey{name, int64(img.l1[0] & entryOffsetMask)}
+	refblock := MetadataKey{name, int64(img.reftable[0] & entryOffsetMask)}
+	buf := make([]byte, 4)
+	if _, err := img.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	calls := cache.take()
+	if count(calls, "get", l2, false) != 1 || count(calls, "put", l2, false) != 1 {
+		t.Errorf("the first read: %+v, want a miss and a put of the L2 table", calls)
+	}
+	if _, err := img.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if calls := cache.take(); count(calls, "get", l2, true) != 1 || count(calls, "put", l2, false) != 0 {
+		t.Errorf("the second read: %+v, want a hit", calls)
+	}
+
+	// the write of the L2 entry evicts the table, which the refcount block
+	// updated is not
+	if _, err := img.WriteAt([]byte("more"), 64<<10); err != nil {
+		t.Fatal(err)
+	}
+	calls = cache.take()
+	evicted := false
+	entry := l2.Offset + 16*8
+	for _, c := range calls {
+		if c.op == "evict" && c.key.File == name && c.key.Offset <= entry && entry < c.key.Offset+c.n {
+			evicted = true
+		}
+	}
+	if !evicted {
+		t.Errorf("the write of an L2 entry: %+v, want the table evicted", calls)
+	}
+	if count(calls, "put", refblock, false) == 0 {
+		t.Errorf("the refcount update: %+v, want the block put", calls)
+	}
+	cache.expectFresh(t, name)
+	if _, err := img.ReadAt(buf, 64<<10); err != nil || string(buf) != "more" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+
+	// truncating evicts the whole file
+	if _, err := img.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	cache.expectFresh(t, name)
+	if err := img.fh.Truncate(img.end); err != nil {
+		t.Fatal(err)
+	}
+	if calls := cache.take(); len(calls) == 0 || calls[len(calls)-1] != (cacheCall{op: "evict", key: MetadataKey{name, 0}, n: math.MaxInt64}) {
+		t.Errorf("truncating: %+v, want the whole file evicted", calls)
+	}
+}
+
+func TestMetadataCacheShared(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.qcow2")
+	img, err := Create(base, 1<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt([]byte("base"), 0); err != nil {
+		t.Fatal(err)
+	}
+	l2 := MetadataKey{base, int64(img.l1[0] & entryOffsetMask)}
+	img.Close()
+
+	// the overlays opened with the cache read the L2 table of their base once
+	cache := &recordingCache{LRUCache: NewLRUCache(1 << 20)}
+	for i := 0; i < 3; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("overlay%d.qcow2", i))
+		overlay, err := Create(name, 1<<20, &CreateOptions{ClusterSize: 4096, BackingFile: "base.qcow2", BackingFormat: "qcow2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		overlay.Close()
+		if overlay, err = Open(name, WithMetadataCache(cache)); err != nil {
+			t.Fatal(err)
+		}
+		defer overlay.Close()
+		buf := make([]byte, 4)
+		if _, err := overlay.ReadAt(buf, 0); err != nil || string(buf) != "base" {
+			t.Fatalf("read %q, %v", buf, err)
+		}
+	}
+	calls := cache.take()
+	if count(calls, "put", l2, false) != 1 || count(calls, "get", l2, true) != 2 {
+		t.Errorf("got %d puts and %d hits of the L2 table of the base, want 1 and 2", count(calls, "put", l2, false), count(calls, "get", l2, true))
+	}
+	if cache.Used() == 0 {
+		t.Error("nothing is cached")
+	}
+}
@@ -0,0 +1,98 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// HdrExtMetadata is the header extension this package uses to store user
+// metadata as key/value pairs. Its type is "vbat" in ASCII, which is not used
+// by qemu, so qemu skips it like any other unknown extension.
+const HdrExtMetadata HeaderExtensionType = 0x76626174
+
+// Metadata decodes the user metadata stored in the HdrExtMetadata extension.
+// The result is empty when the extension is not present.
+func (h Header) Metadata() (map[string]string, error) {
+	md := map[string]string{}
+	for _, e := range h.ExtHeaders {
+		if e.Type != HdrExtMetadata {
+			continue
+		}
+		buf := e.Data
+		next := func() (string, error) {
+			n, l := binary.Uvarint(buf)
+			if l <= 0 || n > uint64(len(buf)-l) {
+				return "", errors.New("qcow2: truncated metadata extension")
+			}
+			s := string(buf[l : l+int(n)])
+			buf = buf[l+int(n):]
+			return s, nil
+		}
+		for len(buf) > 0 {
+			k, err := next()
+			if err != nil {
+				return nil, err
+			}
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			md[k] = v
+		}
+	}
+	return md, nil
+}
+
+// encodeMetadata stores md as uvarint length prefixed keys and values, sorted by key
+func encodeMetadata(md map[string]string) []byte {
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf []byte
+	for _, k := range keys {
+		buf = binary.AppendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+		buf = binary.AppendUvarint(buf, uint64(len(md[k])))
+		buf = append(buf, md[k]...)
+	}
+	return buf
+}
+
+// Metadata is the user metadata stored in the image
+func (img *Image) Metadata() (map[string]string, error) {
+	return img.Header.Metadata()
+}
+
+// SetMetadata replaces the user metadata stored in the image. An empty md
+// removes the extension. The metadata shares the first cluster with the rest
+// of the header, so it is limited to what space remains there.
+func (img *Image) SetMetadata(md map[string]string) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	for k := range md {
+		if k == "" {
+			return errors.New("qcow2: metadata keys must not be empty")
+		}
+	}
+
+	h := img.Header
+	h.ExtHeaders = append([]ExtHeader(nil), h.ExtHeaders...)
+	h.RemoveExtension(HdrExtMetadata)
+	if len(md) > 0 {
+		data := encodeMetadata(md)
+		if err := h.AddExtension(HdrExtMetadata, data); err != nil {
+			return err
+		}
+		if _, err := h.MarshalBinary(); err != nil {
+			return fmt.Errorf("qcow2: metadata of %d bytes does not fit in the header: %w", len(data), err)
+		}
+	}
+	return img.writeFullHeader(h)
+}
@@ -0,0 +1,48 @@
+package qcow2
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMetadata(t *testing.T) {
+	img := tempImage(t)
+	md := map[string]string{
+		"pipeline": "1234",
+		"git-sha":  "bea77fc",
+		"empty":    "",
+		"params":   strings.Repeat("x", 300),
+	}
+	if err := img.SetMetadata(md); err != nil {
+		t.Fatal(err)
+	}
+	verifyRefcounts(t, img)
+
+	reopened, err := Open(img.Name(), WithNoLock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	got, err := reopened.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, md) {
+		t.Errorf("expected %v, got %v", md, got)
+	}
+
+	if err := img.SetMetadata(map[string]string{"big": strings.Repeat("x", int(img.clusterSize))}); err == nil {
+		t.Error("expected an error for metadata larger than the first cluster")
+	}
+	if got, _ := img.Metadata(); !reflect.DeepEqual(got, md) {
+		t.Errorf("failed update changed the metadata to %v", got)
+	}
+
+	if err := img.SetMetadata(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(img.Header.ExtHeaders) != 0 {
+		t.Errorf("expected the extension to be removed, got %#v", img.Header.ExtHeaders)
+	}
+}
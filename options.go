@@ -0,0 +1,198 @@
+package qcow2
+
+import "log/slog"
+
+// Option configures how an image is opened
+type Option func(*options)
+
+type options struct {
+	noLock           bool
+	forceShare       bool
+	noBacking        bool
+	damagedSnapshots bool
+	ignoreUnknown    bool
+	noExtensions     bool
+	noBitmapTracking bool
+	directIO         bool
+	limiter          *RateLimiter
+	log              *slog.Logger
+	// passphrase is asked for up to passphraseAttempts times
+	passphrase         PassphraseFunc
+	passphraseAttempts int
+	// l2CacheSize is set by WithL2CacheSize, defaultL2CacheSize otherwise
+	l2CacheSize    int64
+	l2CacheSizeSet bool
+	cache          MetadataCache
+	resolver       BackingResolver
+	http           *HTTPOptions
+	// maxIOSize is set by WithMaxIOSize, defaultMaxIOSize otherwise
+	maxIOSize    int64
+	maxIOSizeSet bool
+	// chain are the absolute paths of the images above a backing file
+	chain []string
+}
+
+// WithNoLock skips locking the image file, so that an image another process
+// holds locked can still be opened. WithForceShare does so read-only.
+func WithNoLock() Option {
+	return func(o *options) {
+		o.noLock = true
+	}
+}
+
+// WithForceShare opens the image without locking it, as WithNoLock, and
+// strictly read-only: OpenFile fails with ErrForceShareWrite when asked for
+// anything else. It warns, to the logger of WithLogger, that what is read may
+// be inconsistent when another process is writing to the image, as its dirty
+// bit and the L2 tables it is updating can be seen half done.
+func WithForceShare() Option {
+	return func(o *options) {
+		o.noLock = true
+		o.forceShare = true
+	}
+}
+
+// WithNoBacking opens the image without its backing file, so that an image
+// whose backing file is missing can still be inspected or rebased. Ranges
+// the image leaves to its backing file read as zeros.
+func WithNoBacking() Option {
+	return func(o *options) {
+		o.noBacking = true
+	}
+}
+
+// WithDamagedSnapshots opens an image read-only even when its snapshot
+// table can not be read in full, with the snapshots that could, so that
+// Check can report on it
+func WithDamagedSnapshots() Option {
+	return func(o *options) {
+		o.damagedSnapshots = true
+	}
+}
+
+// WithIgnoreUnknownIncompatible opens an image read-only even when it has
+// incompatible features this package does not implement, for its header and
+// metadata to be inspected, and checked. Its guest data can not be read, since
+// it would be misinterpreted.
+func WithIgnoreUnknownIncompatible() Option {
+	return func(o *options) {
+		o.ignoreUnknown = true
+	}
+}
+
+// WithoutExtensionParsing opens an image read-only without parsing its
+// header extensions, as ReadHeaderWithoutExtensions, so that an image whose
+// extension area is damaged can still be inspected, checked and read. What
+// the extensions say is then unknown: the format of the backing file is
+// probed, and Bitmaps, LUKSHeader and reading the data of an encrypted image
+// fail with ErrExtensionsSkipped, as does opening the image for writing.
+func WithoutExtensionParsing() Option {
+	return func(o *options) {
+		o.noExtensions = true
+	}
+}
+
+// WithoutBitmapTracking does not record the writes in the enabled persistent
+// bitmaps, for bulk writes that would touch most of their bits anyway. The
+// first write marks the bitmaps in use instead, which they are left, as their
+// bits no longer account for every write: the next backup taken with them
+// must be a full one.
+func WithoutBitmapTracking() Option {
+	return func(o *options) {
+		o.noBitmapTracking = true
+	}
+}
+
+// WithDirectIO opens the image file, and the files of its backing chain, with
+// O_DIRECT, bypassing the page cache of the host, as when benchmarking or to
+// keep a large copy from evicting everything else. All I/O then goes through
+// buffers aligned to 4096 bytes, in whole blocks of as much, the blocks a
+// write covers in part being read first. Opening fails with
+// ErrDirectIONotSupported where direct I/O is not, which is everywhere but on
+// Linux, and on Linux file systems that refuse O_DIRECT.
+func WithDirectIO() Option {
+	return func(o *options) {
+		o.directIO = true
+	}
+}
+
+// WithRateLimit limits the file I/O of the image and its backing files to
+// bytesPerSec
+func WithRateLimit(bytesPerSec int64) Option {
+	return WithRateLimiter(NewRateLimiter(bytesPerSec))
+}
+
+// WithRateLimiter limits the file I/O of the image and its backing files with
+// l, which may be shared with other images
+func WithRateLimiter(l *RateLimiter) Option {
+	return func(o *options) {
+		o.limiter = l
+	}
+}
+
+// WithLogger has the image, and its backing files, log to l: at Debug the
+// decisions taken for each cluster written, at Info the notable actions, like
+// opening a backing file or growing the refcount table, and at Warn the
+// oddities of the image that do not keep it from being used. The records
+// have the path of the image as "image", and where they are about metadata,
+// its host offset as "offset" and its Structure as "structure". Nothing is
+// logged without it.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) {
+		o.log = l
+	}
+}
+
+// WithL2CacheSize caches up to bytes of the L2 tables of the image, and of
+// each of its backing files, rather than the default of 1 MiB. A size smaller
+// than a cluster disables the cache, so that every guest cluster accessed
+// reads its L2 entry from the file. Refcount blocks are cached besides, up to
+// 256 KiB. It has no effect WithMetadataCache.
+func WithL2CacheSize(bytes int64) Option {
+	return func(o *options) {
+		o.l2CacheSize, o.l2CacheSizeSet = bytes, true
+	}
+}
+
+// WithMetadataCache caches the L2 tables and refcount blocks of the image, and
+// of its backing files, in c rather than in an LRUCache of their own. Images
+// opened with the same c share it, each of its keys naming the file: the
+// overlays of one base image, each opened with c, then read the metadata of
+// the base once between them, as when
+//
+//	cache := qcow2.NewLRUCache(64 << 20)
+//	for _, name := range overlays {
+//		img, err := qcow2.Open(name, qcow2.WithMetadataCache(cache))
+//		...
+//	}
+func WithMetadataCache(c MetadataCache) Option {
+	return func(o *options) {
+		o.cache = c
+	}
+}
+
+// WithMaxIOSize reads up to bytes of the clusters that follow one another in
+// the image file, and in each of its backing files, with one read, rather than
+// the default of 1 MiB. A size of a cluster or less reads a cluster at a time.
+// ConvertToRaw writes its output in runs of up to as much.
+func WithMaxIOSize(bytes int64) Option {
+	return func(o *options) {
+		o.maxIOSize, o.maxIOSizeSet = bytes, true
+	}
+}
+
+// maxIO is the most an image reads or writes of its file at once
+func (o options) maxIO() int64 {
+	if !o.maxIOSizeSet {
+		return defaultMaxIOSize
+	}
+	return o.maxIOSize
+}
+
+// l2Cache is the size of the L2 cache of an image
+func (o options) l2Cache() int64 {
+	if !o.l2CacheSizeSet {
+		return defaultL2CacheSize
+	}
+	return o.l2CacheSize
+}
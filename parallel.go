@@ -0,0 +1,108 @@
+package qcow2
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// runOrdered runs work for every job produced by next on up to workers
+// goroutines, and passes the results to done one at a time in the order of
+// the jobs. next returns false once there are no more jobs. The first error
+// cancels the jobs still running and is returned once they have stopped.
+//
+// With a single worker everything runs on the calling goroutine.
+func runOrdered[J, R any](ctx context.Context, workers int, next func() (J, bool, error), work func(context.Context, J) (R, error), done func(R) error) error {
+	if workers <= 1 {
+		for {
+			j, ok, err := next()
+			if err != nil || !ok {
+				return err
+			}
+			r, err := work(ctx, j)
+			if err != nil {
+				return err
+			}
+			if err := done(r); err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		r   R
+		err error
+	}
+	// pending holds the result channels in job order, bounding how far the
+	// workers run ahead of done
+	pending := make(chan chan result, 2*workers)
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	var nextErr error
+	go func() {
+		defer close(pending)
+		for ctx.Err() == nil {
+			j, ok, err := next()
+			if err != nil {
+				nextErr = err
+				return
+			}
+			if !ok {
+				return
+			}
+			ch := make(chan result, 1)
+			select {
+			case pending <- ch:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				ch <- result{err: ctx.Err()}
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				r, err := work(ctx, j)
+				ch <- result{r, err}
+			}()
+		}
+	}()
+
+	var err error
+	for ch := range pending {
+		res := <-ch
+		if err != nil {
+			continue // draining after a failure
+		}
+		if err = res.err; err == nil {
+			err = done(res.r)
+		}
+		if err != nil {
+			cancel()
+		}
+	}
+	wg.Wait()
+	if err == nil {
+		err = nextErr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+// workers is the number of goroutines to use when jobs are requested
+func workers(jobs int) int {
+	if jobs <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return jobs
+}
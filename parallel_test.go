@@ -0,0 +1,55 @@
+package qcow2
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRunOrdered(t *testing.T) {
+	jobs := make([]int, 100)
+	for i := range jobs {
+		jobs[i] = i
+	}
+	for _, workers := range []int{1, 4} {
+		var got []int
+		err := runOrdered(context.Background(), workers, sliceJobs(jobs),
+			func(_ context.Context, j int) (int, error) { return j * 2, nil },
+			func(r int) error {
+				got = append(got, r)
+				return nil
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, r := range got {
+			if r != i*2 {
+				t.Fatalf("%d workers: result %d is %d, out of order", workers, i, r)
+			}
+		}
+		if len(got) != len(jobs) {
+			t.Errorf("%d workers: %d results for %d jobs", workers, len(got), len(jobs))
+		}
+
+		// the first error stops the rest
+		boom := errors.New("boom")
+		calls := 0
+		err = runOrdered(context.Background(), workers, sliceJobs(jobs),
+			func(ctx context.Context, j int) (int, error) {
+				if j == 10 {
+					return 0, boom
+				}
+				return j, ctx.Err()
+			},
+			func(r int) error {
+				calls++
+				return nil
+			})
+		if !errors.Is(err, boom) {
+			t.Errorf("%d workers: expected the worker error, got %v", workers, err)
+		}
+		if calls != 10 {
+			t.Errorf("%d workers: %d results were handled before the failure, expected 10", workers, calls)
+		}
+	}
+}
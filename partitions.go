@@ -0,0 +1,521 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+	"unicode/utf16"
+)
+
+// ErrNoPartitionTable is returned by ReadPartitions for a disk with neither
+// an MBR nor a GPT
+var ErrNoPartitionTable = errors.New("qcow2: no partition table found")
+
+// PartitionScheme is the kind of the partition table of a guest disk
+type PartitionScheme int
+
+const (
+	PartitionMBR PartitionScheme = iota + 1
+	PartitionGPT
+)
+
+func (s PartitionScheme) String() string {
+	switch s {
+	case PartitionMBR:
+		return "mbr"
+	case PartitionGPT:
+		return "gpt"
+	}
+	return fmt.Sprintf("PartitionScheme(%d)", int(s))
+}
+
+// GUID is a GUID as stored in a GPT, its first three fields little endian
+type GUID [16]byte
+
+// String is the GUID in the usual form, in upper case as the UEFI
+// specification lists the partition types
+func (g GUID) String() string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X", binary.LittleEndian.Uint32(g[0:4]), binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]), g[8:10], g[10:16])
+}
+
+// IsZero reports whether the GUID is all zeros, which marks an unused GPT
+// entry
+func (g GUID) IsZero() bool {
+	return g == GUID{}
+}
+
+// Partition is a partition of a guest disk
+type Partition struct {
+	Scheme PartitionScheme
+	// Number is the number Linux gives the partition: the index of its GPT
+	// entry from 1, the slot of a primary MBR partition from 1, and 5 on for
+	// logical ones in the order of their chain
+	Number int
+	// Start and Size are in bytes
+	Start, Size int64
+	// MBRType is the system ID of an MBR partition
+	MBRType byte
+	// Logical is set for an MBR partition inside an extended one
+	Logical bool
+	// TypeGUID, GUID and Name are those of a GPT partition
+	TypeGUID GUID
+	GUID     GUID
+	Name     string
+	// Attributes are the attribute bits of a GPT partition, or the status
+	// byte of an MBR one, 0x80 when it is bootable
+	Attributes uint64
+}
+
+// Type is the type of the partition: its GUID, or its MBR system ID in hex
+func (p Partition) Type() string {
+	if p.Scheme == PartitionGPT {
+		return p.TypeGUID.String()
+	}
+	return fmt.Sprintf("0x%02x", p.MBRType)
+}
+
+// TypeName is the common name of the type of the partition, empty for the
+// types not known
+func (p Partition) TypeName() string {
+	if p.Scheme == PartitionGPT {
+		return gptTypeNames[p.TypeGUID.String()]
+	}
+	return mbrTypeNames[p.MBRType]
+}
+
+// Flags names the attribute bits set for the partition. The bits of a GPT
+// partition without a name, which mean something to its type alone, are
+// named by their number.
+func (p Partition) Flags() []string {
+	var flags []string
+	if p.Scheme != PartitionGPT {
+		if p.Attributes&0x80 != 0 {
+			flags = append(flags, "bootable")
+		}
+		return flags
+	}
+	names := map[int]string{0: "required", 1: "no-block-io", 2: "legacy-bios-bootable"}
+	if p.TypeGUID.String() == gptBasicData {
+		names[60], names[62], names[63] = "read-only", "hidden", "no-automount"
+	}
+	for bit := 0; bit < 64; bit++ {
+		if p.Attributes&(1<<bit) == 0 {
+			continue
+		}
+		if name, ok := names[bit]; ok {
+			flags = append(flags, name)
+		} else {
+			flags = append(flags, fmt.Sprintf("bit %d", bit))
+		}
+	}
+	return flags
+}
+
+// PartitionTable is the partition table of a guest disk, as ReadPartitions
+// finds it
+type PartitionTable struct {
+	Scheme PartitionScheme
+	// SectorSize is the size of the logical blocks the table counts in, 512
+	// or, for a GPT found at 4096 bytes, 4096
+	SectorSize int64
+	// DiskGUID is that of a GPT
+	DiskGUID GUID
+	// Hybrid is set for a GPT whose protective MBR has partitions of its
+	// own, which are not listed
+	Hybrid     bool
+	Partitions []Partition
+	// Warnings are what was wrong with the tables, which did not keep the
+	// partitions from being read
+	Warnings []string
+}
+
+func (t *PartitionTable) warn(format string, args ...any) {
+	t.Warnings = append(t.Warnings, fmt.Sprintf(format, args...))
+}
+
+const (
+	mbrSectorSize = 512
+	gptSignature  = "EFI PART"
+	gptBasicData  = "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7"
+	// maxGPTEntriesSize bounds the entry array, which is 128 entries of 128
+	// bytes on the disks the usual tools make
+	maxGPTEntriesSize = 1 << 20
+	// maxLogicalPartitions bounds the chain of extended boot records
+	maxLogicalPartitions = 128
+)
+
+var mbrTypeNames = map[byte]string{
+	0x01: "FAT12",
+	0x04: "FAT16 <32M",
+	0x05: "Extended",
+	0x06: "FAT16",
+	0x07: "NTFS/exFAT",
+	0x0b: "W95 FAT32",
+	0x0c: "W95 FAT32 (LBA)",
+	0x0e: "W95 FAT16 (LBA)",
+	0x0f: "W95 Extended (LBA)",
+	0x82: "Linux swap",
+	0x83: "Linux",
+	0x85: "Linux extended",
+	0x8e: "Linux LVM",
+	0xa5: "FreeBSD",
+	0xa6: "OpenBSD",
+	0xa9: "NetBSD",
+	0xee: "GPT protective",
+	0xef: "EFI System",
+	0xfd: "Linux RAID autodetect",
+}
+
+var gptTypeNames = map[string]string{
+	"C12A7328-F81F-11D2-BA4B-00A0C93EC93B": "EFI System",
+	"21686148-6449-6E6F-744E-656564454649": "BIOS boot",
+	"024DEE41-33E7-11D3-9D69-0008C781F39F": "MBR partition scheme",
+	"0FC63DAF-8483-4772-8E79-3D69D8477DE4": "Linux filesystem",
+	"0657FD6D-A4AB-43C4-84E5-0933C84B4F4F": "Linux swap",
+	"E6D6D379-F507-44C2-A23C-238F2A3DF928": "Linux LVM",
+	"A19D880F-05FC-4D3B-A006-743F0F84911E": "Linux RAID",
+	"44479540-F297-41B2-9AF7-D131D5F0458A": "Linux root (x86)",
+	"4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709": "Linux root (x86-64)",
+	"B921B045-1DF0-41C3-AF44-4C6F280D3FAE": "Linux root (ARM64)",
+	"933AC7E1-2EB4-4F13-B844-0E14E2AEF915": "Linux home",
+	"BC13C2FF-59E6-4262-A352-B275FD6F7172": "Linux extended boot",
+	"CA7D7CCB-63ED-4C53-861C-1742536059CC": "Linux LUKS",
+	gptBasicData:                           "Microsoft basic data",
+	"E3C9E316-0B5C-4DB8-817D-F92DF00215AE": "Microsoft reserved",
+	"DE94BBA4-06D1-4D40-A16A-BFD50179D6AC": "Windows recovery",
+	"516E7CB4-6ECF-11D6-8FF8-00022D09712B": "FreeBSD data",
+	"516E7CB5-6ECF-11D6-8FF8-00022D09712B": "FreeBSD swap",
+	"516E7CB6-6ECF-11D6-8FF8-00022D09712B": "FreeBSD UFS",
+	"516E7CBA-6ECF-11D6-8FF8-00022D09712B": "FreeBSD ZFS",
+	"48465300-0000-11AA-AA11-00306543ECAC": "Apple HFS+",
+	"7C3457EF-0000-11AA-AA11-00306543ECAC": "Apple APFS",
+}
+
+// ReadPartitions reads the partition table of the disk r of size bytes,
+// like an Image: a GPT, found with 512 or 4096 byte sectors, or else an MBR
+// with the logical partitions of its extended one. A GPT whose primary
+// header or entries are damaged is read from its backup, and what could not
+// be trusted is listed in the Warnings of the table.
+func ReadPartitions(r io.ReaderAt, size int64) (*PartitionTable, error) {
+	if size < mbrSectorSize {
+		return nil, ErrNoPartitionTable
+	}
+	mbr := make([]byte, mbrSectorSize)
+	if err := readDisk(r, mbr, 0, size); err != nil {
+		return nil, err
+	}
+	t := &PartitionTable{}
+	hasMBR := mbr[510] == 0x55 && mbr[511] == 0xaa
+	protective, others := false, false
+	if hasMBR {
+		for i := 0; i < 4; i++ {
+			switch e := mbr[446+16*i:][:16]; {
+			case e[4] == 0xee:
+				protective = true
+			case e[4] != 0 && binary.LittleEndian.Uint32(e[12:]) != 0:
+				others = true
+			}
+		}
+	}
+	for _, sector := range []int64{512, 4096} {
+		found, err := t.readGPT(r, size, sector, protective)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		switch {
+		case !protective:
+			t.warn("the GPT has no protective MBR")
+		case others:
+			t.Hybrid = true
+			t.warn("the protective MBR is hybrid, with partitions of its own that are not listed")
+		}
+		return t, nil
+	}
+	if !hasMBR {
+		return nil, ErrNoPartitionTable
+	}
+	if protective {
+		t.warn("the MBR is protective, but no valid GPT was found")
+	}
+	t.Scheme, t.SectorSize = PartitionMBR, mbrSectorSize
+	if err := t.readMBR(r, size, mbr); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// readDisk reads p at off, refusing to read past the size of the disk
+func readDisk(r io.ReaderAt, p []byte, off, size int64) error {
+	if off < 0 || off > size || int64(len(p)) > size-off {
+		return fmt.Errorf("qcow2: partition table read of %d bytes at %d is past the end of the disk", len(p), off)
+	}
+	_, err := r.ReadAt(p, off)
+	return err
+}
+
+// readMBR reads the partitions of the MBR, and each logical partition of
+// the first extended one
+func (t *PartitionTable) readMBR(r io.ReaderAt, size int64, mbr []byte) error {
+	var extended *Partition
+	for i := 0; i < 4; i++ {
+		p, ok := mbrPartition(mbr[446+16*i:][:16], 0)
+		if !ok {
+			continue
+		}
+		p.Number = i + 1
+		t.add(p, size)
+		if isExtended(p.MBRType) && extended == nil {
+			extended = &p
+		}
+	}
+	if extended == nil {
+		return nil
+	}
+	ebr := make([]byte, mbrSectorSize)
+	seen := map[int64]bool{}
+	n := 5
+	for next := extended.Start; next != 0; {
+		switch {
+		case len(seen) >= maxLogicalPartitions:
+			t.warn("the chain of logical partitions is longer than %d, and was cut there", maxLogicalPartitions)
+			return nil
+		case seen[next]:
+			t.warn("the chain of logical partitions loops back to the extended boot record at %d", next)
+			return nil
+		}
+		seen[next] = true
+		if next+mbrSectorSize > size {
+			t.warn("the extended boot record at %d is past the end of the disk", next)
+			return nil
+		}
+		if err := readDisk(r, ebr, next, size); err != nil {
+			return err
+		}
+		if ebr[510] != 0x55 || ebr[511] != 0xaa {
+			t.warn("the extended boot record at %d has no signature", next)
+			return nil
+		}
+		if p, ok := mbrPartition(ebr[446:462], next); ok {
+			p.Number, p.Logical = n, true
+			t.add(p, size)
+			n++
+		}
+		link, ok := mbrPartition(ebr[462:478], extended.Start)
+		if !ok || !isExtended(link.MBRType) {
+			break
+		}
+		next = link.Start
+	}
+	return nil
+}
+
+// mbrPartition is the MBR partition entry e, whose start is relative to
+// base, and whether it is in use
+func mbrPartition(e []byte, base int64) (Partition, bool) {
+	start, sectors := binary.LittleEndian.Uint32(e[8:]), binary.LittleEndian.Uint32(e[12:])
+	if e[4] == 0 || sectors == 0 {
+		return Partition{}, false
+	}
+	return Partition{
+		Scheme:     PartitionMBR,
+		Start:      base + int64(start)*mbrSectorSize,
+		Size:       int64(sectors) * mbrSectorSize,
+		MBRType:    e[4],
+		Attributes: uint64(e[0]),
+	}, true
+}
+
+func isExtended(id byte) bool {
+	return id == 0x05 || id == 0x0f || id == 0x85
+}
+
+// add lists p, warning when it does not fit the disk
+func (t *PartitionTable) add(p Partition, size int64) {
+	if p.Start+p.Size > size {
+		t.warn("partition %d ends at %d, past the end of the disk at %d", p.Number, p.Start+p.Size, size)
+	}
+	t.Partitions = append(t.Partitions, p)
+}
+
+// gptHeader is the part of a GPT header ReadPartitions uses
+type gptHeader struct {
+	lba, alternateLBA       int64
+	firstUsable, lastUsable int64
+	diskGUID                GUID
+	entriesLBA              int64
+	entries, entrySize      int64
+	entriesCRC              uint32
+}
+
+// readGPTHeader reads the GPT header at lba. A header not there at all is
+// nil, without an error; one that is there but not valid is nil, with why.
+func readGPTHeader(r io.ReaderAt, size, sector, lba int64) (*gptHeader, string, error) {
+	if lba < 1 || (lba+1)*sector > size {
+		return nil, "", nil
+	}
+	buf := make([]byte, sector)
+	if err := readDisk(r, buf, lba*sector, size); err != nil {
+		return nil, "", err
+	}
+	if string(buf[:8]) != gptSignature {
+		return nil, "", nil
+	}
+	le32, le64 := binary.LittleEndian.Uint32, binary.LittleEndian.Uint64
+	n := int64(le32(buf[12:]))
+	if n < 92 || n > sector {
+		return nil, fmt.Sprintf("has a header size of %d bytes", n), nil
+	}
+	want := le32(buf[16:])
+	binary.LittleEndian.PutUint32(buf[16:], 0)
+	if got := crc32.ChecksumIEEE(buf[:n]); got != want {
+		return nil, fmt.Sprintf("has a bad CRC32 %#08x, computed %#08x", want, got), nil
+	}
+	h := &gptHeader{
+		lba:          int64(le64(buf[24:])),
+		alternateLBA: int64(le64(buf[32:])),
+		firstUsable:  int64(le64(buf[40:])),
+		lastUsable:   int64(le64(buf[48:])),
+		entriesLBA:   int64(le64(buf[72:])),
+		entries:      int64(le32(buf[80:])),
+		entrySize:    int64(le32(buf[84:])),
+		entriesCRC:   le32(buf[88:]),
+	}
+	copy(h.diskGUID[:], buf[56:72])
+	switch {
+	case h.lba != lba:
+		return nil, fmt.Sprintf("says it is at LBA %d", h.lba), nil
+	case h.entrySize < 128 || h.entrySize%8 != 0:
+		return nil, fmt.Sprintf("has entries of %d bytes", h.entrySize), nil
+	case h.entries*h.entrySize > maxGPTEntriesSize:
+		return nil, fmt.Sprintf("has %d entries of %d bytes, more than %d bytes of them", h.entries, h.entrySize, maxGPTEntriesSize), nil
+	case h.entriesLBA < 1 || h.entriesLBA > size/sector || h.entries*h.entrySize > size-h.entriesLBA*sector:
+		return nil, fmt.Sprintf("has its entries at LBA %d, past the end of the disk", h.entriesLBA), nil
+	}
+	return h, "", nil
+}
+
+// readEntries reads the entry array of h, and whether its CRC32 matches
+func (h *gptHeader) readEntries(r io.ReaderAt, size, sector int64) ([]byte, bool, error) {
+	buf := make([]byte, h.entries*h.entrySize)
+	if err := readDisk(r, buf, h.entriesLBA*sector, size); err != nil {
+		return nil, false, err
+	}
+	return buf, crc32.ChecksumIEEE(buf) == h.entriesCRC, nil
+}
+
+// readGPT reads the GPT of the disk with sector byte sectors, from its
+// primary header or else its backup, reporting whether there is one
+func (t *PartitionTable) readGPT(r io.ReaderAt, size, sector int64, protective bool) (bool, error) {
+	lastLBA := size/sector - 1
+	primary, why, err := readGPTHeader(r, size, sector, 1)
+	if err != nil {
+		return false, err
+	}
+	if primary == nil && why == "" && !protective {
+		return false, nil
+	}
+	backupLBA := lastLBA
+	if primary != nil && primary.alternateLBA != lastLBA {
+		t.warn("the primary GPT header puts its backup at LBA %d, not at the last LBA %d", primary.alternateLBA, lastLBA)
+		if primary.alternateLBA > 1 && primary.alternateLBA < lastLBA {
+			backupLBA = primary.alternateLBA
+		}
+	}
+	backup, backupWhy, err := readGPTHeader(r, size, sector, backupLBA)
+	if err != nil {
+		return false, err
+	}
+	if primary == nil && backup == nil {
+		if why != "" {
+			t.warn("the primary GPT header at LBA 1 %s", why)
+		}
+		if why != "" || backupWhy != "" {
+			t.warn("no valid GPT header was found with %d byte sectors", sector)
+		}
+		return false, nil
+	}
+
+	var entries []byte
+	h := primary
+	if primary != nil {
+		var ok bool
+		if entries, ok, err = primary.readEntries(r, size, sector); err != nil {
+			return false, err
+		}
+		if !ok {
+			t.warn("the primary GPT entries have a bad CRC32")
+			if backup != nil {
+				b, ok, err := backup.readEntries(r, size, sector)
+				if err != nil {
+					return false, err
+				}
+				if ok {
+					t.warn("using the backup GPT entries at LBA %d", backup.entriesLBA)
+					entries, h = b, backup
+				}
+			}
+		}
+		switch {
+		case backup == nil && backupWhy != "":
+			t.warn("the backup GPT header at LBA %d %s", backupLBA, backupWhy)
+		case backup == nil:
+			t.warn("the backup GPT header at LBA %d is missing", backupLBA)
+		}
+	} else {
+		if why == "" {
+			why = "is missing"
+		}
+		t.warn("the primary GPT header at LBA 1 %s; using the backup at LBA %d", why, backupLBA)
+		var ok bool
+		if entries, ok, err = backup.readEntries(r, size, sector); err != nil {
+			return false, err
+		}
+		if !ok {
+			t.warn("the backup GPT entries have a bad CRC32")
+		}
+		h = backup
+	}
+
+	t.Scheme, t.SectorSize, t.DiskGUID = PartitionGPT, sector, h.diskGUID
+	for i := int64(0); i < h.entries; i++ {
+		e := entries[i*h.entrySize:][:128]
+		p := Partition{Scheme: PartitionGPT, Number: int(i) + 1}
+		copy(p.TypeGUID[:], e[0:16])
+		if p.TypeGUID.IsZero() {
+			continue
+		}
+		copy(p.GUID[:], e[16:32])
+		first, last := int64(binary.LittleEndian.Uint64(e[32:])), int64(binary.LittleEndian.Uint64(e[40:]))
+		if first < 0 || last < first || last > size/sector {
+			t.warn("GPT entry %d spans LBA %d to %d, which is not a range of the disk", p.Number, first, last)
+			continue
+		}
+		p.Start, p.Size = first*sector, (last-first+1)*sector
+		p.Attributes = binary.LittleEndian.Uint64(e[48:])
+		p.Name = gptName(e[56:128])
+		if first < h.firstUsable || last > h.lastUsable {
+			t.warn("partition %d lies outside of the usable LBAs %d to %d", p.Number, h.firstUsable, h.lastUsable)
+		}
+		t.add(p, size)
+	}
+	return true, nil
+}
+
+// gptName decodes the UTF-16LE name of a GPT entry, up to its first NUL
+func gptName(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	if i := slices.Index(u, 0); i >= 0 {
+		u = u[:i]
+	}
+	return string(utf16.Decode(u))
+}
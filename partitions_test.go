@@ -0,0 +1,190 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+var (
+	linuxFS   = GUID{0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47, 0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4}
+	efiSystem = GUID{0x28, 0x73, 0x2a, 0xc1, 0x1f, 0xf8, 0xd2, 0x11, 0xba, 0x4b, 0x00, 0xa0, 0xc9, 0x3e, 0xc9, 0x3b}
+)
+
+// makeGPT lays out a disk of size bytes with a protective MBR and a GPT of
+// the partitions, by their Number, with the primary and backup headers and
+// entries where the usual tools put them
+func makeGPT(size, sector int64, parts []Partition) []byte {
+	disk := make([]byte, size)
+	lastLBA := size/sector - 1
+	putMBREntry(disk, 0, 0, 0xee, 1, uint32(min(lastLBA, 0xffffffff)))
+
+	entries := make([]byte, 128*128)
+	for _, p := range parts {
+		e := entries[(p.Number-1)*128:]
+		copy(e, p.TypeGUID[:])
+		copy(e[16:], p.GUID[:])
+		binary.LittleEndian.PutUint64(e[32:], uint64(p.Start/sector))
+		binary.LittleEndian.PutUint64(e[40:], uint64((p.Start+p.Size)/sector-1))
+		binary.LittleEndian.PutUint64(e[48:], p.Attributes)
+		for i, u := range utf16.Encode([]rune(p.Name)) {
+			binary.LittleEndian.PutUint16(e[56+2*i:], u)
+		}
+	}
+	entrySectors := int64(len(entries)) / sector
+	header := func(lba, alternate, entriesLBA int64) {
+		h := disk[lba*sector:][:92]
+		copy(h, gptSignature)
+		binary.LittleEndian.PutUint32(h[8:], 0x00010000)
+		binary.LittleEndian.PutUint32(h[12:], 92)
+		binary.LittleEndian.PutUint64(h[24:], uint64(lba))
+		binary.LittleEndian.PutUint64(h[32:], uint64(alternate))
+		binary.LittleEndian.PutUint64(h[40:], uint64(2+entrySectors))
+		binary.LittleEndian.PutUint64(h[48:], uint64(lastLBA-1-entrySectors))
+		copy(h[56:], "disk guid 16 byt")
+		binary.LittleEndian.PutUint64(h[72:], uint64(entriesLBA))
+		binary.LittleEndian.PutUint32(h[80:], 128)
+		binary.LittleEndian.PutUint32(h[84:], 128)
+		binary.LittleEndian.PutUint32(h[88:], crc32.ChecksumIEEE(entries))
+		binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h))
+		copy(disk[entriesLBA*sector:], entries)
+	}
+	header(1, lastLBA, 2)
+	header(lastLBA, 1, lastLBA-entrySectors)
+	return disk
+}
+
+// putMBREntry fills slot i of the partition entries of the boot record at
+// off, and its signature
+func putMBREntry(disk []byte, off int64, i int, id byte, start, sectors uint32) {
+	e := disk[off+446+16*int64(i):][:16]
+	e[4] = id
+	binary.LittleEndian.PutUint32(e[8:], start)
+	binary.LittleEndian.PutUint32(e[12:], sectors)
+	disk[off+510], disk[off+511] = 0x55, 0xaa
+}
+
+func readPartitions(t *testing.T, disk []byte) *PartitionTable {
+	t.Helper()
+	pt, err := ReadPartitions(bytes.NewReader(disk), int64(len(disk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pt
+}
+
+func TestReadGPT(t *testing.T) {
+	parts := []Partition{
+		{Scheme: PartitionGPT, Number: 1, Start: 1 << 20, Size: 4 << 20, TypeGUID: efiSystem, GUID: GUID{1}, Name: "EFI system partition", Attributes: 1},
+		{Scheme: PartitionGPT, Number: 3, Start: 5 << 20, Size: 10 << 20, TypeGUID: linuxFS, GUID: GUID{3}, Name: "root ☃", Attributes: 1<<2 | 1<<60},
+	}
+	for _, sector := range []int64{512, 4096} {
+		pt := readPartitions(t, makeGPT(16<<20, sector, parts))
+		if pt.Scheme != PartitionGPT || pt.SectorSize != sector || pt.Hybrid || len(pt.Warnings) != 0 {
+			t.Errorf("%d byte sectors: got %+v", sector, pt)
+		}
+		if len(pt.Partitions) != 2 || pt.Partitions[0] != parts[0] || pt.Partitions[1] != parts[1] {
+			t.Fatalf("%d byte sectors: got the partitions %+v", sector, pt.Partitions)
+		}
+	}
+	p := parts[1]
+	if p.Type() != "0FC63DAF-8483-4772-8E79-3D69D8477DE4" || p.TypeName() != "Linux filesystem" {
+		t.Errorf("got the type %s (%s)", p.Type(), p.TypeName())
+	}
+	if flags := strings.Join(p.Flags(), ","); flags != "legacy-bios-bootable,bit 60" {
+		t.Errorf("got the flags %s", flags)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		damage func(disk []byte)
+		// want are in the warnings, warnings many of them
+		want     []string
+		warnings int
+	}{
+		{"primary header", func(disk []byte) { disk[512+40]++ }, []string{"the primary GPT header at LBA 1 has a bad CRC32", "using the backup at LBA 32767"}, 1},
+		{"primary entries", func(disk []byte) { disk[1024+56]++ }, []string{"the primary GPT entries have a bad CRC32", "using the backup GPT entries at LBA 32735"}, 2},
+		{"backup header", func(disk []byte) { disk[len(disk)-512+40]++ }, []string{"the backup GPT header at LBA 32767 has a bad CRC32"}, 1},
+		{"both entries", func(disk []byte) {
+			disk[1024+56]++
+			disk[32735*512+56]++
+		}, []string{"the primary GPT entries have a bad CRC32"}, 1},
+		{"hybrid", func(disk []byte) { putMBREntry(disk, 0, 1, 0x83, 2048, 8192) }, []string{"the protective MBR is hybrid"}, 1},
+		{"no protective MBR", func(disk []byte) { clear(disk[:512]) }, []string{"the GPT has no protective MBR"}, 1},
+	} {
+		disk := makeGPT(16<<20, 512, parts)
+		tc.damage(disk)
+		pt := readPartitions(t, disk)
+		if pt.Scheme != PartitionGPT || len(pt.Partitions) != 2 {
+			t.Errorf("%s: got %+v", tc.name, pt)
+		}
+		if got := strings.Join(pt.Warnings, "\n"); len(pt.Warnings) != tc.warnings || !containsAll(got, tc.want) {
+			t.Errorf("%s: got the warnings\n%s", tc.name, got)
+		}
+	}
+
+	// with both headers gone the protective MBR is all there is
+	disk := makeGPT(16<<20, 512, parts)
+	disk[512+40]++
+	disk[len(disk)-512+40]++
+	pt := readPartitions(t, disk)
+	if pt.Scheme != PartitionMBR || len(pt.Partitions) != 1 || pt.Partitions[0].MBRType != 0xee || len(pt.Warnings) != 3 {
+		t.Errorf("got %+v", pt)
+	}
+}
+
+func containsAll(s string, subs []string) bool {
+	for _, sub := range subs {
+		if !strings.Contains(s, sub) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReadMBR(t *testing.T) {
+	disk := make([]byte, 64<<20)
+	putMBREntry(disk, 0, 0, 0x0c, 2048, 20480)
+	disk[446] = 0x80
+	putMBREntry(disk, 0, 2, 0x05, 40960, 81920)
+	// two logical partitions, the first EBR linking to the second
+	ext := int64(40960 * 512)
+	putMBREntry(disk, ext, 0, 0x83, 2048, 10240)
+	putMBREntry(disk, ext, 1, 0x05, 20480, 40960)
+	putMBREntry(disk, ext+20480*512, 0, 0x82, 2048, 8192)
+
+	pt := readPartitions(t, disk)
+	want := []Partition{
+		{Scheme: PartitionMBR, Number: 1, Start: 1 << 20, Size: 10 << 20, MBRType: 0x0c, Attributes: 0x80},
+		{Scheme: PartitionMBR, Number: 3, Start: 20 << 20, Size: 40 << 20, MBRType: 0x05},
+		{Scheme: PartitionMBR, Number: 5, Start: 21 << 20, Size: 5 << 20, MBRType: 0x83, Logical: true},
+		{Scheme: PartitionMBR, Number: 6, Start: 31 << 20, Size: 4 << 20, MBRType: 0x82, Logical: true},
+	}
+	if pt.Scheme != PartitionMBR || pt.SectorSize != 512 || len(pt.Warnings) != 0 || len(pt.Partitions) != len(want) {
+		t.Fatalf("got %+v", pt)
+	}
+	for i, p := range pt.Partitions {
+		if p != want[i] {
+			t.Errorf("got the partition %+v, want %+v", p, want[i])
+		}
+	}
+	if p := pt.Partitions[0]; p.Type() != "0x0c" || p.TypeName() != "W95 FAT32 (LBA)" || strings.Join(p.Flags(), ",") != "bootable" {
+		t.Errorf("got the type %s (%s), flags %v", p.Type(), p.TypeName(), p.Flags())
+	}
+
+	// the second EBR links back to the first, and a partition runs off the disk
+	putMBREntry(disk, ext+20480*512, 1, 0x05, 0, 1)
+	putMBREntry(disk, 0, 1, 0x83, 100000, 100000)
+	pt = readPartitions(t, disk)
+	if got := strings.Join(pt.Warnings, "\n"); len(pt.Partitions) != 5 || !containsAll(got, []string{"partition 2 ends at", "loops back to the extended boot record at 20971520"}) {
+		t.Errorf("got %d partitions and the warnings\n%s", len(pt.Partitions), got)
+	}
+
+	if _, err := ReadPartitions(bytes.NewReader(make([]byte, 1<<20)), 1<<20); !errors.Is(err, ErrNoPartitionTable) {
+		t.Errorf("read a disk of zeros: %v", err)
+	}
+}
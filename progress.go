@@ -0,0 +1,58 @@
+package qcow2
+
+import (
+	"sync"
+	"time"
+)
+
+// ProgressFunc is told how far a long running operation has got, in bytes
+// or whatever unit the operation documents. total is the best estimate
+// available when the operation starts. The callback is invoked at most every
+// progressInterval, and once with done equal to total when the operation
+// succeeds.
+type ProgressFunc func(done, total int64)
+
+const progressInterval = 100 * time.Millisecond
+
+// progress throttles the reports to a ProgressFunc
+type progress struct {
+	fn    ProgressFunc
+	total int64
+
+	mu   sync.Mutex
+	done int64
+	last time.Time
+}
+
+func newProgress(fn ProgressFunc, total int64) *progress {
+	return &progress{fn: fn, total: total}
+}
+
+// add counts n more units done
+func (p *progress) add(n int64) {
+	if p == nil || p.fn == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	done := min(p.done, p.total)
+	if done >= p.total {
+		// reaching the end is left to finish, so it is only reported once
+		return
+	}
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.fn(done, p.total)
+	}
+}
+
+// finish reports that the operation is complete
+func (p *progress) finish() {
+	if p == nil || p.fn == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fn(p.total, p.total)
+}
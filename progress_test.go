@@ -0,0 +1,54 @@
+package qcow2
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestConvertProgress(t *testing.T) {
+	src := tempImage(t)
+	dir := t.TempDir()
+	var reports [][2]int64
+	record := func(done, total int64) {
+		reports = append(reports, [2]int64{done, total})
+	}
+	check := func(name string) {
+		t.Helper()
+		if len(reports) == 0 {
+			t.Fatalf("%s: no progress reported", name)
+		}
+		complete := 0
+		for i, r := range reports {
+			if r[0] > r[1] || (i > 0 && r[0] < reports[i-1][0]) {
+				t.Errorf("%s: report %d of %v is out of order", name, i, r)
+			}
+			if r[0] == r[1] {
+				complete++
+			}
+		}
+		if last := reports[len(reports)-1]; last[0] != last[1] || complete != 1 {
+			t.Errorf("%s: expected to end at 100%% exactly once, got %v", name, reports)
+		}
+	}
+
+	if err := src.ConvertToRaw(filepath.Join(dir, "out.raw"), &ConvertOptions{Progress: record}); err != nil {
+		t.Fatal(err)
+	}
+	check("raw")
+	reports = nil
+	if err := ConvertRawToQcow2(src, src.Size(), filepath.Join(dir, "out.qcow2"), &ConvertOptions{Progress: record}); err != nil {
+		t.Fatal(err)
+	}
+	check("qcow2")
+
+	reports = nil
+	err := ConvertRawToQcow2(failingReader{src, 50 << 20}, src.Size(), filepath.Join(dir, "failed.qcow2"), &ConvertOptions{Progress: record})
+	if err == nil {
+		t.Fatal("expected the read error")
+	}
+	for _, r := range reports {
+		if r[0] == r[1] {
+			t.Errorf("a failed conversion reported completion: %v", reports)
+		}
+	}
+}
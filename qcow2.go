@@ -1,5 +1,7 @@
 package qcow2
 
+import "slices"
+
 var (
 	// Magic is the front of the file fingerprint
 	Magic = []byte{0x51, 0x46, 0x49, 0xFB}
@@ -15,23 +17,63 @@ type (
 	// Version number of this image. Valid versions are 2 or 3
 	Version int
 
-	// CryptMethod is whether no encryption (0), or AES encryption (1)
+	// CryptMethod is whether no encryption (0), AES encryption (1) or LUKS
+	// encryption (2)
 	CryptMethod int
 
-	// HeaderExtensionType indicators the the entries in the optional header area
-	HeaderExtensionType int
+	// HeaderExtensionType indicators the the entries in the optional header
+	// area, as the 32 bit big-endian magic that starts each
+	HeaderExtensionType uint32
 )
 
 const (
 	HdrExtEndOfArea         HeaderExtensionType = 0x00000000
 	HdrExtBackingFileFormat HeaderExtensionType = 0xE2792ACA
-	HdrExtFeatureNameTable  HeaderExtensionType = 0x6803f857 // TODO needs processing for feature name table
+	HdrExtFeatureNameTable  HeaderExtensionType = 0x6803f857
+	HdrExtBitmaps           HeaderExtensionType = 0x23852875
+	HdrExtFullDiskCrypt     HeaderExtensionType = 0x0537be77
+	HdrExtExternalDataFile  HeaderExtensionType = 0x44415441
 	// any thing else is "other" and can be ignored
 )
 
+func (t HeaderExtensionType) String() string {
+	switch t {
+	case HdrExtEndOfArea:
+		return "end of area"
+	case HdrExtBackingFileFormat:
+		return "backing file format"
+	case HdrExtFeatureNameTable:
+		return "feature name table"
+	case HdrExtBitmaps:
+		return "bitmaps"
+	case HdrExtFullDiskCrypt:
+		return "full disk encryption"
+	case HdrExtExternalDataFile:
+		return "external data file"
+	}
+	return "unknown"
+}
+
+// supportedVersions are the versions of images this package reads and
+// creates
+var supportedVersions = []Version{2, 3}
+
+func (v Version) supported() bool {
+	return slices.Contains(supportedVersions, v)
+}
+
+const (
+	CryptNone CryptMethod = 0
+	CryptAES  CryptMethod = 1
+	CryptLUKS CryptMethod = 2
+)
+
 func (qcm CryptMethod) String() string {
-	if qcm == 1 {
+	switch qcm {
+	case CryptAES:
 		return "AES"
+	case CryptLUKS:
+		return "LUKS"
 	}
 	return "none"
 }
@@ -52,18 +94,36 @@ type Header struct {
 	SnapshotsOffset       int64       // [64:72]
 
 	// v3
-	IncompatibleFeatures int // [72:80] bitmask
-	CompatibleFeatures   int // [80:88] bitmask
-	AutoclearFeatures    int // [88:96] bitmask
-	RefcountOrder        int // [96:100]
-	HeaderLength         int // [100:104]
+	IncompatibleFeatures uint64 // [72:80] bitmask
+	CompatibleFeatures   uint64 // [80:88] bitmask
+	AutoclearFeatures    uint64 // [88:96] bitmask
+	RefcountOrder        int    // [96:100]
+	HeaderLength         int    // [100:104]
+
+	// ExtraHeader is any header data beyond [104:], up to HeaderLength
+	ExtraHeader []byte
 
 	// Header extensions
 	ExtHeaders []ExtHeader
+	// ExtensionsSkipped is set by ReadHeaderWithoutExtensions, for a header
+	// whose ExtHeaders were not parsed, and which can not be written back
+	ExtensionsSkipped bool
+
+	// BackingFile is the name stored at BackingFileOffset
+	BackingFile string
+
+	// the bytes between the extensions and BackingFile, and following the
+	// header in the first cluster, as read
+	gap       []byte
+	trailer   []byte
+	layoutEnd int64
 }
 
 type ExtHeader struct {
 	Type HeaderExtensionType
 	Size int
 	Data []byte
+
+	// padding to the next multiple of 8 bytes, as read
+	padding []byte
 }
@@ -5,7 +5,11 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/binary"
+	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
 	"testing"
 )
 
@@ -100,9 +104,9 @@ func TestHeader(t *testing.T) {
 			t.Fatalf("short read")
 		}
 
-		q.IncompatibleFeatures = be32(buf[0:8])
-		q.CompatibleFeatures = be32(buf[8:16])
-		q.AutoclearFeatures = be32(buf[16:24])
+		q.IncompatibleFeatures = binary.BigEndian.Uint64(buf[0:8])
+		q.CompatibleFeatures = binary.BigEndian.Uint64(buf[8:16])
+		q.AutoclearFeatures = binary.BigEndian.Uint64(buf[16:24])
 		q.RefcountOrder = be32(buf[24:28])
 		q.HeaderLength = be32(buf[28:32])
 	}
@@ -118,7 +122,7 @@ func TestHeader(t *testing.T) {
 		t.Fatalf("short read")
 	}
 	for {
-		t := HeaderExtensionType(be32(buf[:4]))
+		t := HeaderExtensionType(binary.BigEndian.Uint32(buf[:4]))
 		if t == HdrExtEndOfArea {
 			break
 		}
@@ -137,10 +141,127 @@ func TestHeader(t *testing.T) {
 	// TODO at this point we can do some assertions on the `q` values
 }
 
-func be32(b []byte) int {
-	return int(binary.BigEndian.Uint32(b))
+// tempImage decompresses the test image into a temporary file, opened read-write
+func tempImage(t testing.TB) *Image {
+	t.Helper()
+	f, err := os.Open(testQcowFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "file.qcow2")
+	out, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(out, gz); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	img, err := OpenFile(name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { img.Close() })
+	return img
+}
+
+// verifyRefcounts recomputes the reference count of every cluster from the
+// metadata and compares them with the stored refcounts
+func verifyRefcounts(t *testing.T, img *Image) {
+	t.Helper()
+	want := map[int64]uint64{}
+	ref := func(off, size int64) {
+		for c := off &^ (img.clusterSize - 1); c < off+size; c += img.clusterSize {
+			want[c]++
+		}
+	}
+	tree := func(l1 []uint64) {
+		for _, e := range l1 {
+			l2off := int64(e & entryOffsetMask)
+			if l2off == 0 {
+				continue
+			}
+			ref(l2off, img.clusterSize)
+			l2, err := img.readTable(l2off, int(img.l2Entries))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range l2 {
+				if img.classify(entry) == clusterCompressed {
+					ref(img.compressedRange(entry))
+				} else if host := int64(entry & entryOffsetMask); host != 0 {
+					ref(host, img.clusterSize)
+				}
+			}
+		}
+	}
+
+	ref(0, img.clusterSize)
+	ref(img.Header.L1TableOffset, int64(img.Header.L1Size)*8)
+	ref(img.Header.RefcountTableOffset, int64(img.Header.RefcountTableClusters)*img.clusterSize)
+	for _, e := range img.reftable {
+		if off := int64(e & entryOffsetMask); off != 0 {
+			ref(off, img.clusterSize)
+		}
+	}
+	ref(img.Header.SnapshotsOffset, img.snapTableSize)
+	tree(img.l1)
+	for _, s := range img.snapshots {
+		ref(s.L1TableOffset, int64(s.L1Size)*8)
+		l1, err := img.readTable(s.L1TableOffset, s.L1Size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree(l1)
+	}
+
+	for c := int64(0); c < img.end; c += img.clusterSize {
+		rc, err := img.refcount(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rc != want[c] {
+			t.Errorf("cluster %#x: refcount %d, referenced %d times", c, rc, want[c])
+		}
+	}
 }
 
-func be64(b []byte) int64 {
-	return int64(binary.BigEndian.Uint64(b))
+// build32BitEnv is set for the tests TestBuild32Bit runs, so that they do not
+// run it again
+const build32BitEnv = "QCOW2_TEST_32BIT"
+
+// TestBuild32Bit vets the module for platforms of 32 bit ints, where
+// constants like the types of header extensions must still fit, and on amd64
+// runs the tests of parsing headers, features and snapshot tables built for
+// 386, where fields of 32 bits must not overflow an int, as CI would. It needs
+// the go tool.
+func TestBuild32Bit(t *testing.T) {
+	if os.Getenv(build32BitEnv) != "" {
+		t.Skip("running for 32 bit platforms already")
+	}
+	gotool := filepath.Join(runtime.GOROOT(), "bin", "go")
+	if _, err := os.Stat(gotool); err != nil {
+		t.Skipf("no go tool: %v", err)
+	}
+	run := func(arch string, args ...string) {
+		t.Helper()
+		cmd := exec.Command(gotool, args...)
+		cmd.Env = append(os.Environ(), "GOOS=linux", "GOARCH="+arch, "CGO_ENABLED=0", build32BitEnv+"=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("GOARCH=%s go %s: %v\n%s", arch, args[0], err, out)
+		}
+	}
+	for _, arch := range []string{"386", "arm"} {
+		run(arch, "vet", "./...")
+	}
+	if runtime.GOOS == "linux" && runtime.GOARCH == "amd64" {
+		run("386", "test", "-short", "-count=1", "-run", "^Test(Header|ReadHeader|Extension|UnsupportedFeatures|FeatureBit40|SnapshotFields32Bit)", ".")
+	}
 }
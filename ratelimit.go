@@ -0,0 +1,104 @@
+package qcow2
+
+import (
+	"context"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting file I/O to a number of bytes per
+// second. It can be shared by several images and goroutines, which then
+// share the rate. A nil RateLimiter does not limit anything.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter limits I/O to bytesPerSec, allowing bursts of a tenth of a
+// second
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	burst := float64(bytesPerSec) / 10
+	return &RateLimiter{rate: float64(bytesPerSec), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Wait blocks until n bytes of I/O fit the rate, or ctx is done
+func (l *RateLimiter) Wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	// take the tokens up front, so that concurrent callers queue up behind
+	// each other rather than all waking at once
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens += float64(n)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// hostFile is the file of an image, with its I/O rate limited, and the cache
+// of its metadata
+type hostFile struct {
+	storage
+	limiter *RateLimiter
+	// l2 and refcounts cache the L2 tables and refcount blocks of the
+	// file as key. Raw files, and the L2 tables of an image opened with too
+	// small a WithL2CacheSize, have none.
+	l2, refcounts MetadataCache
+	key           string
+	// writes counts the writes evicting from the caches, for a cluster read
+	// while one happened not to be cached, and changes with mu held
+	mu     sync.Mutex
+	writes atomic.Uint64
+}
+
+// storage is what an image is stored in: an *os.File, or the readerStorage
+// of a remote file
+type storage interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+}
+
+func (f *hostFile) ReadAt(p []byte, off int64) (int, error) {
+	f.limiter.Wait(context.Background(), len(p))
+	return f.storage.ReadAt(p, off)
+}
+
+func (f *hostFile) WriteAt(p []byte, off int64) (int, error) {
+	f.limiter.Wait(context.Background(), len(p))
+	n, err := f.storage.WriteAt(p, off)
+	f.evict(off, int64(len(p)))
+	return n, err
+}
+
+func (f *hostFile) Truncate(size int64) error {
+	err := f.storage.Truncate(size)
+	f.evict(0, math.MaxInt64)
+	return err
+}
@@ -0,0 +1,54 @@
+package qcow2
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(1 << 20)
+	start := time.Now()
+	for i := 0; i < 8; i++ {
+		if err := l.Wait(context.Background(), 64<<10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// half a MiB at a MiB per second, less the initial burst
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("512 KiB at 1 MiB/s took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := l.Wait(ctx, 10<<20); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to end the wait, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled wait took %s", elapsed)
+	}
+
+	var none *RateLimiter
+	if err := none.Wait(context.Background(), 1<<30); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWithRateLimit(t *testing.T) {
+	src := tempImage(t)
+	img, err := Open(src.Name(), WithNoLock(), WithRateLimit(4<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	// the whole image is read at most in clusters, and holds some MiB of data
+	start := time.Now()
+	if checksum(t, img) != checksum(t, src) {
+		t.Error("rate limited reads differ")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("reading the image at 4 MiB/s took only %s", elapsed)
+	}
+}
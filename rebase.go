@@ -0,0 +1,152 @@
+package qcow2
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// RebaseOptions are the parameters of Image.Rebase
+type RebaseOptions struct {
+	// Unsafe only rewrites the backing file reference, for a new backing
+	// file known to read as the old one. Neither the contents nor the
+	// tables of the image are touched, and the reference is stored even
+	// when the new backing file cannot be opened, which is reported as an
+	// error unless the image was opened WithNoBacking.
+	Unsafe bool
+	// Progress is told how many bytes have been compared, out of those the
+	// image leaves to its backing file
+	Progress ProgressFunc
+}
+
+// Rebase makes name, of the given format, the backing file of the image
+// without changing what the guest sees: every range the image leaves to its
+// backing file that reads differently from the new backing file is first
+// copied into the image. An empty name leaves the image without a backing
+// file. Past the end of the new backing file, ranges must read as zeros.
+// When the new backing file is the current one, only the reference is
+// rewritten.
+func (img *Image) Rebase(name, format string, opts *RebaseOptions) error {
+	if opts == nil {
+		opts = &RebaseOptions{}
+	}
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	if !opts.Unsafe && !img.sameBacking(name) {
+		if err := img.copyChangedBacking(name, format, opts); err != nil {
+			return err
+		}
+	}
+	return img.SetBackingFile(name, format)
+}
+
+// sameBacking reports whether the named file is the current backing file
+func (img *Image) sameBacking(name string) bool {
+	if img.Header.BackingFile == "" || name == "" {
+		return img.Header.BackingFile == name
+	}
+	old, err := os.Stat(img.backingPath(img.Header.BackingFile))
+	if err != nil {
+		return false
+	}
+	fi, err := os.Stat(img.backingPath(name))
+	return err == nil && os.SameFile(old, fi)
+}
+
+// copyChangedBacking copies into the image the clusters it leaves to its
+// backing file that read differently from the named file
+func (img *Image) copyChangedBacking(name, format string, opts *RebaseOptions) error {
+	var ranges []Extent
+	var total int64
+	err := img.WalkExtents(0, img.Size(), func(e Extent) error {
+		if e.Depth > 0 || e.Type == ExtentUnallocated {
+			ranges = append(ranges, e)
+			total += e.Length
+		}
+		return nil
+	})
+	if err != nil || len(ranges) == 0 {
+		return err
+	}
+
+	var next io.ReaderAt
+	var nextSize int64
+	var nextZeros []Extent // the ranges of a qcow2 backing file known to be zeros
+	if name != "" {
+		if next, nextSize, err = img.openBackingFile(name, format, false, false); err != nil {
+			return err
+		}
+		if c, ok := next.(io.Closer); ok {
+			defer c.Close()
+		}
+		if b, ok := next.(*Image); ok {
+			if err := b.WalkExtents(0, b.Size(), func(e Extent) error {
+				if e.ReadsAsZeros() {
+					nextZeros = append(nextZeros, e)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	knownZeros := func(off, n int64) bool {
+		if off >= nextSize {
+			return true
+		}
+		for _, z := range nextZeros {
+			if z.Start <= off && off+n <= z.Start+z.Length {
+				return true
+			}
+		}
+		return false
+	}
+
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	prog := newProgress(opts.Progress, total)
+	old, buf := make([]byte, img.chunkSize()), make([]byte, img.chunkSize())
+	zero := make([]byte, img.clusterSize)
+	for _, e := range ranges {
+		for off := e.Start; off < e.Start+e.Length; {
+			n := min(img.chunkSize(), e.Start+e.Length-off)
+			if e.ReadsAsZeros() && knownZeros(off, n) {
+				prog.add(n)
+				off += n
+				continue
+			}
+			p, q := old[:n], buf[:n]
+			if _, err := img.readAtUnlocked(p, off); err != nil && err != io.EOF {
+				return err
+			}
+			m := 0
+			if next != nil && off < nextSize {
+				if m, err = next.ReadAt(q[:min(n, nextSize-off)], off); err != nil && err != io.EOF {
+					return err
+				}
+			}
+			clear(q[m:])
+			for len(p) > 0 {
+				c := img.clusterChunk(p, off)
+				var err error
+				switch {
+				case bytes.Equal(c, q[:len(c)]):
+				case img.Header.Version >= 3 && off&(img.clusterSize-1) == 0 &&
+					(int64(len(c)) == img.clusterSize || off+int64(len(c)) == img.Size()) && bytes.Equal(c, zero[:len(c)]):
+					// zeros hidden by the new backing file
+					err = img.replaceEntry(off, flagZero)
+				default:
+					err = img.writeGuest(c, off)
+				}
+				if err != nil {
+					return err
+				}
+				p, q, off = p[len(c):], q[len(c):], off+int64(len(c))
+			}
+			prog.add(n)
+		}
+	}
+	prog.finish()
+	return nil
+}
@@ -0,0 +1,118 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// allocated counts the bytes the image itself provides
+func allocated(t *testing.T, img *Image) int64 {
+	t.Helper()
+	var n int64
+	if err := img.WalkExtents(0, img.Size(), func(e Extent) error {
+		if e.Depth == 0 && e.Type != ExtentUnallocated {
+			n += e.Length
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestRebase(t *testing.T) {
+	const size = 1 << 20
+	dir := t.TempDir()
+	old := backedImage(t, filepath.Join(dir, "old.qcow2"), size, "", "")
+	if _, err := old.WriteAt(bytes.Repeat([]byte("old"), 100000), 0); err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+	// the new backing file matches the old one in part, and is smaller
+	next := bytes.Repeat([]byte("old"), 100000)
+	copy(next[50000:], bytes.Repeat([]byte("new"), 10000))
+	if err := os.WriteFile(filepath.Join(dir, "new.raw"), next[:200000], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	img := backedImage(t, filepath.Join(dir, "img.qcow2"), size, "old.qcow2", "qcow2")
+	if _, err := img.WriteAt([]byte("own data"), 60000); err != nil {
+		t.Fatal(err)
+	}
+	want := checksum(t, img)
+
+	// rebasing onto the same file copies nothing
+	before := allocated(t, img)
+	if err := img.Rebase("./old.qcow2", "qcow2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := allocated(t, img); n != before {
+		t.Errorf("rebasing onto the same file allocated %d bytes", n-before)
+	}
+
+	if err := img.Rebase("new.raw", "raw", nil); err != nil {
+		t.Fatal(err)
+	}
+	if img.Header.BackingFile != "new.raw" || img.Header.BackingFormat() != "raw" {
+		t.Errorf("expected new.raw as the backing file, got %q of format %q", img.Header.BackingFile, img.Header.BackingFormat())
+	}
+	if checksum(t, img) != want {
+		t.Error("the image reads differently after rebasing")
+	}
+	// only the clusters differing from the new backing file are copied: 8
+	// around the new data, including the one of the image, and the 26 past
+	// the end of the new backing file
+	if n := allocated(t, img); n != 34*4096 {
+		t.Errorf("expected %d bytes allocated, got %d", 34*4096, n)
+	}
+	verifyRefcounts(t, img)
+
+	if err := img.Rebase("", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	img = reopen(t, img)
+	if img.Header.BackingFile != "" {
+		t.Errorf("expected no backing file, got %q", img.Header.BackingFile)
+	}
+	if checksum(t, img) != want {
+		t.Error("the image reads differently without a backing file")
+	}
+	verifyRefcounts(t, img)
+}
+
+func TestRebaseUnsafe(t *testing.T) {
+	img := tempImage(t)
+	contents := func() []byte {
+		p, err := os.ReadFile(img.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p[img.clusterSize:]
+	}
+	before := contents()
+	if err := img.Rebase("missing.qcow2", "qcow2", &RebaseOptions{Unsafe: true}); err == nil {
+		t.Error("expected an error for a missing backing file")
+	}
+	if img.Header.BackingFile != "missing.qcow2" {
+		t.Errorf("expected the reference to be stored, got %q", img.Header.BackingFile)
+	}
+	if !bytes.Equal(contents(), before) {
+		t.Error("unsafe rebase changed more than the header")
+	}
+
+	// which can then be fixed
+	img.Close()
+	img, err := OpenFile(img.Name(), os.O_RDWR, WithNoBacking())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if err := img.Rebase("", "", &RebaseOptions{Unsafe: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents(), before) {
+		t.Error("unsafe rebase changed more than the header")
+	}
+}
@@ -0,0 +1,427 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrRefcountTooNarrow is returned when a cluster would take more references
+// than the refcounts of the image can count, like any snapshot of an image with
+// 1 bit refcounts
+var ErrRefcountTooNarrow = errors.New("qcow2: refcount width too small")
+
+// refcountBits is the width of each refcount block entry
+func (img *Image) refcountBits() uint {
+	return 1 << uint(img.Header.RefcountOrder)
+}
+
+// refcountMax is the largest refcount the image can store
+func (img *Image) refcountMax() uint64 {
+	return 1<<img.refcountBits() - 1
+}
+
+// refblockEntries is the number of clusters covered by one refcount block
+func (img *Image) refblockEntries() int64 {
+	return img.clusterSize * 8 / int64(img.refcountBits())
+}
+
+// refblock returns the refcount block stored at off, that of refcount table
+// index ti, from the cache when it is there
+func (img *Image) refblock(ti, off int64) ([]byte, error) {
+	b, writes := img.fh.cached(img.fh.refcounts, off)
+	if int64(len(b)) == img.clusterSize {
+		return b, nil
+	}
+	if why := img.invalidOffset(off, img.clusterSize, true); why != "" {
+		return nil, invalidEntry(StructRefcountTable, img.Header.RefcountTableOffset, ti, img.reftable[ti], "refcount block offset %#x %s", off, why)
+	}
+	b = make([]byte, img.clusterSize)
+	if _, err := img.fh.ReadAt(b, off); err != nil {
+		return nil, fmt.Errorf("qcow2: reading refcount block at %#x: %w", off, err)
+	}
+	img.fh.putCached(img.fh.refcounts, off, b, writes)
+	return b, nil
+}
+
+// refcount is the stored reference count of the cluster holding host offset off
+func (img *Image) refcount(off int64) (uint64, error) {
+	idx := off >> img.clusterBits
+	ti := idx / img.refblockEntries()
+	if ti >= int64(len(img.reftable)) {
+		return 0, nil
+	}
+	boff := int64(img.reftable[ti] & entryOffsetMask)
+	if boff == 0 {
+		return 0, nil
+	}
+	b, err := img.refblock(ti, boff)
+	if err != nil {
+		return 0, err
+	}
+	return getRefcount(b, idx%img.refblockEntries(), img.refcountBits()), nil
+}
+
+func getRefcount(b []byte, i int64, bits uint) uint64 {
+	switch bits {
+	case 1, 2, 4:
+		perByte := int64(8 / bits)
+		shift := uint(i%perByte) * bits
+		return uint64(b[i/perByte]>>shift) & (1<<bits - 1)
+	case 8:
+		return uint64(b[i])
+	case 16:
+		return uint64(binary.BigEndian.Uint16(b[i*2:]))
+	case 32:
+		return uint64(binary.BigEndian.Uint32(b[i*4:]))
+	}
+	return binary.BigEndian.Uint64(b[i*8:])
+}
+
+// putRefcount stores v as entry i of b, returning the byte range modified
+func putRefcount(b []byte, i int64, bits uint, v uint64) (start, end int64) {
+	switch bits {
+	case 1, 2, 4:
+		perByte := int64(8 / bits)
+		shift := uint(i%perByte) * bits
+		mask := byte(1<<bits-1) << shift
+		b[i/perByte] = b[i/perByte]&^mask | byte(v)<<shift&mask
+		return i / perByte, i/perByte + 1
+	case 8:
+		b[i] = byte(v)
+		return i, i + 1
+	case 16:
+		binary.BigEndian.PutUint16(b[i*2:], uint16(v))
+		return i * 2, i*2 + 2
+	case 32:
+		binary.BigEndian.PutUint32(b[i*4:], uint32(v))
+		return i * 4, i*4 + 4
+	}
+	binary.BigEndian.PutUint64(b[i*8:], v)
+	return i * 8, i*8 + 8
+}
+
+// setRefcount stores the reference count of the cluster holding host offset
+// off, allocating refcount blocks and growing the refcount table as needed
+func (img *Image) setRefcount(off int64, v uint64) error {
+	if v > img.refcountMax() {
+		return fmt.Errorf("%w: refcount of cluster %#x would exceed %d, the maximum for %d bit refcounts", ErrRefcountTooNarrow, off, img.refcountMax(), img.refcountBits())
+	}
+	idx := off >> img.clusterBits
+	ti := idx / img.refblockEntries()
+	if ti >= int64(len(img.reftable)) {
+		if err := img.growRefcountTable(ti + 1); err != nil {
+			return err
+		}
+	}
+	boff := int64(img.reftable[ti] & entryOffsetMask)
+	if boff == 0 {
+		if v == 0 {
+			return nil
+		}
+		var err error
+		if boff, err = img.newRefblock(ti); err != nil {
+			return err
+		}
+	}
+	b, err := img.refblock(ti, boff)
+	if err != nil {
+		return err
+	}
+	start, end := putRefcount(b, idx%img.refblockEntries(), img.refcountBits(), v)
+	if err := img.fh.writeRefblock(b, boff, start, end); err != nil {
+		return err
+	}
+	if v == 0 && off < img.freeHint {
+		img.freeHint = off &^ (img.clusterSize - 1)
+	}
+	return nil
+}
+
+// newRefblock allocates an empty refcount block for refcount table index ti
+func (img *Image) newRefblock(ti int64) (int64, error) {
+	boff := img.allocEnd(1)
+	b := make([]byte, img.clusterSize)
+	if _, err := img.fh.WriteAt(b, boff); err != nil {
+		return 0, err
+	}
+	img.fh.putRefblock(boff, b)
+	img.reftable[ti] = uint64(boff)
+	if err := img.writeEntry(img.Header.RefcountTableOffset+ti*8, uint64(boff)); err != nil {
+		return 0, err
+	}
+	// the block may well be the first cluster it covers
+	return boff, img.updateRefcount(boff, img.clusterSize, 1)
+}
+
+// growRefcountTable moves the refcount table to a larger allocation of at
+// least n entries
+func (img *Image) growRefcountTable(n int64) error {
+	if grown := int64(len(img.reftable)) * 2; n < grown {
+		n = grown
+	}
+	clusters := (n*8 + img.clusterSize - 1) / img.clusterSize
+	n = clusters * img.l2Entries
+
+	table := make([]uint64, n)
+	copy(table, img.reftable)
+	off := img.allocEnd(clusters)
+	if err := img.writeTable(table, off); err != nil {
+		return err
+	}
+
+	oldOff, oldClusters := img.Header.RefcountTableOffset, img.Header.RefcountTableClusters
+	img.reftable = table
+	img.Header.RefcountTableOffset = off
+	img.Header.RefcountTableClusters = int(clusters)
+	if err := img.writeHeader(); err != nil {
+		return err
+	}
+	if err := img.updateRefcount(off, clusters*img.clusterSize, 1); err != nil {
+		return err
+	}
+	img.log.Info("grew the refcount table", "offset", off, "clusters", clusters, "old-offset", oldOff, "old-clusters", oldClusters, structure(StructRefcountTable))
+	return img.updateRefcount(oldOff, int64(oldClusters)*img.clusterSize, -1)
+}
+
+// updateRefcount adds delta to the refcount of every cluster overlapping the
+// host range [off, off+size)
+func (img *Image) updateRefcount(off, size int64, delta int) error {
+	if size <= 0 {
+		return nil
+	}
+	for c := off &^ (img.clusterSize - 1); c < off+size; c += img.clusterSize {
+		rc, err := img.refcount(c)
+		if err != nil {
+			return err
+		}
+		if delta < 0 && rc < uint64(-delta) {
+			return fmt.Errorf("qcow2: refcount of cluster %#x would drop below zero", c)
+		}
+		if delta < 0 && c == img.compressedNext&^(img.clusterSize-1) {
+			// the space after the last compressed cluster may be reused
+			img.compressedNext = 0
+		}
+		if err := img.setRefcount(c, uint64(int64(rc)+int64(delta))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocEnd reserves n clusters at the end of the file, without setting
+// their refcounts
+func (img *Image) allocEnd(n int64) int64 {
+	off := img.end
+	img.end += n * img.clusterSize
+	return off
+}
+
+// allocClusters finds n contiguous free clusters, reusing freed space before
+// growing the file, and takes a reference on them
+func (img *Image) allocClusters(n int64) (int64, error) {
+	if img.freeHint < img.clusterSize {
+		img.freeHint = img.clusterSize
+	}
+	off := int64(-1)
+	run := int64(0)
+	for c := img.freeHint; c < img.end && run < n; c += img.clusterSize {
+		rc, err := img.refcount(c)
+		if err != nil {
+			return 0, err
+		}
+		if rc != 0 {
+			if run == 0 {
+				img.freeHint = c + img.clusterSize
+			}
+			run = 0
+			continue
+		}
+		if run == 0 {
+			off = c
+		}
+		run++
+	}
+	switch {
+	case run == n:
+	case run > 0 && off+run*img.clusterSize == img.end:
+		// extend the free run at the end of the file
+		img.allocEnd(n - run)
+	default:
+		off = img.allocEnd(n)
+	}
+	if err := img.updateRefcount(off, n*img.clusterSize, 1); err != nil {
+		return 0, err
+	}
+	return off, nil
+}
+
+// freeClusters drops a reference on n clusters at off
+func (img *Image) freeClusters(off, n int64) error {
+	return img.updateRefcount(off, n*img.clusterSize, -1)
+}
+
+// countReferences counts the references to each host cluster from the image
+// metadata and data, keyed by cluster offset. The refcount table and blocks
+// are not included.
+func (img *Image) countReferences() (map[int64]uint64, error) {
+	refs := map[int64]uint64{}
+	ref := func(off, size int64) {
+		for c := off &^ (img.clusterSize - 1); c < off+size; c += img.clusterSize {
+			refs[c]++
+		}
+	}
+	ref(0, img.clusterSize)
+	ref(img.Header.SnapshotsOffset, img.snapTableSize)
+
+	tables, err := img.l1Tables()
+	if err != nil {
+		return nil, err
+	}
+	if err := img.refBitmaps(ref); err != nil {
+		return nil, err
+	}
+	ref(img.Header.L1TableOffset, int64(img.Header.L1Size)*8)
+	for _, s := range img.snapshots {
+		ref(s.L1TableOffset, int64(s.L1Size)*8)
+	}
+	for _, l1 := range tables {
+		for _, e := range l1 {
+			l2off := int64(e & entryOffsetMask)
+			if l2off == 0 {
+				continue
+			}
+			ref(l2off, img.clusterSize)
+			l2, err := img.readTable(l2off, int(img.l2Entries))
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range l2 {
+				if img.classify(entry) == clusterCompressed {
+					ref(img.compressedRange(entry))
+				} else if host := int64(entry & entryOffsetMask); host != 0 {
+					ref(host, img.clusterSize)
+				}
+			}
+		}
+	}
+	return refs, nil
+}
+
+// AmendRefcountOrder rebuilds the refcount structures with entries of
+// 1<<order bits. The new refcount table and blocks are written past the end
+// of the file before the header is switched over to them, which frees the
+// old ones. Nothing is changed when a refcount does not fit the new width.
+func (img *Image) AmendRefcountOrder(order int) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	if order < 0 || order > 6 {
+		return fmt.Errorf("qcow2: invalid refcount order %d", order)
+	}
+	if img.Header.Version < 3 && order != 4 {
+		return errors.New("qcow2: version 2 images only support 16 bit refcounts")
+	}
+	if order == img.Header.RefcountOrder {
+		return nil
+	}
+
+	refs, err := img.countReferences()
+	if err != nil {
+		return err
+	}
+	bits := uint(1) << uint(order)
+	max := uint64(1)<<bits - 1
+	if bits == 64 {
+		max = 1<<64 - 1
+	}
+	for off, n := range refs {
+		if n > max {
+			return fmt.Errorf("qcow2: refcount %d of cluster %#x exceeds the maximum of %d for %d bit refcounts", n, off, max, bits)
+		}
+	}
+	if err := img.rebuildRefcounts(refs, order); err != nil {
+		return err
+	}
+	img.Header.RefcountOrder = order
+	return img.writeHeader()
+}
+
+// rebuildRefcounts writes new refcount structures with entries of 1<<order
+// bits holding refs, past the end of the file, and switches the in-memory
+// state over to them. The caller stores the header.
+func (img *Image) rebuildRefcounts(refs map[int64]uint64, order int) error {
+	return img.rebuildRefcountsAt(refs, order, img.end/img.clusterSize)
+}
+
+// refcountClusters is the number of refcount blocks and refcount table
+// clusters with entries of 1<<order bits for the image, with the structures
+// themselves starting at cluster index start
+func (img *Image) refcountClusters(order int, start int64) (blocks, tableClusters int64) {
+	perBlock := img.clusterSize * 8 >> uint(order)
+	// the new structures must also cover themselves
+	for {
+		total := max(img.end/img.clusterSize, start+blocks+tableClusters)
+		b := (total + perBlock - 1) / perBlock
+		tc := (b*8 + img.clusterSize - 1) / img.clusterSize
+		if b == blocks && tc == tableClusters {
+			return blocks, tableClusters
+		}
+		blocks, tableClusters = b, tc
+	}
+}
+
+// rebuildRefcountsAt is rebuildRefcounts with the table and blocks written
+// from cluster index start, which is free or past the end of the file
+func (img *Image) rebuildRefcountsAt(refs map[int64]uint64, order int, start int64) error {
+	bits := uint(1) << uint(order)
+	perBlock := img.clusterSize * 8 / int64(bits)
+	blocks, tableClusters := img.refcountClusters(order, start)
+	tableOff := start * img.clusterSize
+	blocksOff := tableOff + tableClusters*img.clusterSize
+	for c := tableOff; c < blocksOff+blocks*img.clusterSize; c += img.clusterSize {
+		refs[c] = 1
+	}
+
+	data := make([][]byte, blocks)
+	for off, n := range refs {
+		idx := off >> img.clusterBits
+		b := idx / perBlock
+		if b >= blocks {
+			return fmt.Errorf("qcow2: cluster %#x is past the end of the image", off)
+		}
+		if data[b] == nil {
+			data[b] = make([]byte, img.clusterSize)
+		}
+		putRefcount(data[b], idx%perBlock, bits, n)
+	}
+	table := make([]uint64, tableClusters*img.l2Entries)
+	for b := range data {
+		if data[b] == nil {
+			data[b] = make([]byte, img.clusterSize)
+		}
+		off := blocksOff + int64(b)*img.clusterSize
+		if _, err := img.fh.WriteAt(data[b], off); err != nil {
+			return err
+		}
+		table[b] = uint64(off)
+	}
+	if err := img.writeTable(table, tableOff); err != nil {
+		return err
+	}
+	if err := img.fh.Sync(); err != nil {
+		return err
+	}
+
+	img.reftable = table
+	for b := range data {
+		img.fh.putRefblock(blocksOff+int64(b)*img.clusterSize, data[b])
+	}
+	img.Header.RefcountTableOffset = tableOff
+	img.Header.RefcountTableClusters = int(tableClusters)
+	img.end = max(img.end, blocksOff+blocks*img.clusterSize)
+	img.freeHint = 0
+	return nil
+}
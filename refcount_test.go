@@ -0,0 +1,132 @@
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestRefcountPacking(t *testing.T) {
+	for _, bits := range []uint{1, 2, 4, 8, 16, 32, 64} {
+		b := make([]byte, 64)
+		n := int64(len(b)) * 8 / int64(bits)
+		max := uint64(1)<<bits - 1
+		if bits == 64 {
+			max = 1<<64 - 1
+		}
+		for i := int64(0); i < n; i++ {
+			putRefcount(b, i, bits, uint64(i)&max)
+		}
+		for i := int64(0); i < n; i++ {
+			if got := getRefcount(b, i, bits); got != uint64(i)&max {
+				t.Errorf("%d bits, entry %d: expected %d, got %d", bits, i, uint64(i)&max, got)
+			}
+		}
+	}
+	// sub-byte refcounts fill each byte starting from the least significant bit
+	b := make([]byte, 1)
+	putRefcount(b, 0, 1, 1)
+	putRefcount(b, 3, 1, 1)
+	if b[0] != 0x09 {
+		t.Errorf("expected 0x09, got %#x", b[0])
+	}
+}
+
+func TestAmendRefcountOrder(t *testing.T) {
+	img := tempImage(t)
+	sum := checksum(t, img)
+
+	for _, order := range []int{6, 3, 4} {
+		if err := img.AmendRefcountOrder(order); err != nil {
+			t.Fatal(err)
+		}
+		img = reopen(t, img)
+		if img.Header.RefcountOrder != order {
+			t.Fatalf("expected refcount order %d, got %d", order, img.Header.RefcountOrder)
+		}
+		verifyRefcounts(t, img)
+		if checksum(t, img) != sum {
+			t.Fatalf("contents changed by refcount order %d", order)
+		}
+	}
+
+	// the snapshots share clusters, which one bit refcounts cannot express
+	before := img.Header
+	if err := img.AmendRefcountOrder(0); err == nil {
+		t.Fatal("expected an error for refcounts that do not fit")
+	}
+	img = reopen(t, img)
+	if img.Header.RefcountTableOffset != before.RefcountTableOffset || img.Header.RefcountOrder != before.RefcountOrder {
+		t.Error("failed amend changed the header")
+	}
+	verifyRefcounts(t, img)
+}
+
+func TestOneBitRefcounts(t *testing.T) {
+	img, err := Create(filepath.Join(t.TempDir(), "file.qcow2"), 1<<20, &CreateOptions{ClusterSize: 4096, RefcountBits: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if _, err := img.WriteAt(bytes.Repeat([]byte("one reference "), 1000), 0); err != nil {
+		t.Fatal(err)
+	}
+	// compressed clusters are not packed into a host cluster, which would be
+	// two references
+	p := make([]byte, 4096)
+	for i := 0; i < 4; i++ {
+		for j := range p {
+			p[j] = 'a' + byte((i*4096+j)*7919%65521%16)
+		}
+		if _, err := img.WriteCompressedAt(p, int64(16+i)*4096); err != nil {
+			t.Fatal(err)
+		}
+	}
+	img = reopen(t, img)
+	verifyRefcounts(t, img)
+	sum := checksum(t, img)
+
+	clean := func() {
+		t.Helper()
+		rep, err := img.Check(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Corruptions != 0 || rep.Leaks != 0 {
+			t.Fatalf("expected a clean image, got %+v", rep.Findings)
+		}
+	}
+	clean()
+	end := img.end
+	if err := img.CreateSnapshot("snap"); !errors.Is(err, ErrRefcountTooNarrow) {
+		t.Fatalf("expected ErrRefcountTooNarrow, got %v", err)
+	}
+	if len(img.snapshots) != 0 || img.end != end {
+		t.Error("failed snapshot changed the image")
+	}
+	clean()
+
+	// leak a cluster, for check to repair
+	if _, err := img.allocClusters(1); err != nil {
+		t.Fatal(err)
+	}
+	img = reopen(t, img)
+	if _, err := img.Check(&CheckOptions{Repair: RepairAll}); err != nil {
+		t.Fatal(err)
+	}
+	clean()
+
+	if err := img.AmendRefcountOrder(4); err != nil {
+		t.Fatal(err)
+	}
+	img = reopen(t, img)
+	verifyRefcounts(t, img)
+	if checksum(t, img) != sum {
+		t.Fatal("contents changed by amend")
+	}
+	if err := img.CreateSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	clean()
+}
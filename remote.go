@@ -0,0 +1,145 @@
+package qcow2
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// BackingResolver opens the backing file name of an image, resolved against
+// the directory or the URL of the image, given the format the image records
+// for it, which may be empty. It returns the
+// contents and the size of the backing file, or a nil io.ReaderAt for the
+// backing file to be opened as usual: from the URL, for an http or https
+// one, or else from the file system. The io.ReaderAt is closed with the image
+// when it is an io.Closer.
+type BackingResolver func(name, format string) (io.ReaderAt, int64, error)
+
+// WithBackingResolver has the backing files of the image, and of its backing
+// files, opened by r
+func WithBackingResolver(r BackingResolver) Option {
+	return func(o *options) {
+		o.resolver = r
+	}
+}
+
+// WithHTTPOptions configures how the image and backing files are read when
+// they are http or https URLs
+func WithHTTPOptions(h *HTTPOptions) Option {
+	return func(o *options) {
+		o.http = h
+	}
+}
+
+// OpenURL opens the image at an http or https URL read-only, with range
+// requests as OpenHTTP, configured WithHTTPOptions. Its backing file names are
+// relative to the URL.
+func OpenURL(rawURL string, opts ...Option) (*Image, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if !isHTTP(rawURL) {
+		return nil, fmt.Errorf("qcow2: %q is not an http or https URL", rawURL)
+	}
+	f, err := OpenHTTP(rawURL, o.http)
+	if err != nil {
+		return nil, err
+	}
+	img, err := newImage(rawURL, newReaderStorage(rawURL, f, f.Size()), true, o)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+// isURL tells whether name is a URL, of any scheme, rather than a path
+func isURL(name string) bool {
+	u, err := url.Parse(name)
+	// one letter schemes are drive letters
+	return err == nil && len(u.Scheme) > 1 && strings.HasPrefix(name[len(u.Scheme):], "://")
+}
+
+// isHTTP tells whether name is an http or https URL
+func isHTTP(name string) bool {
+	u, err := url.Parse(name)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// resolveBacking opens the backing file at path with the BackingResolver of
+// the image, or over HTTP when it is a URL, or returns nil for it to be
+// opened from the file system
+func (img *Image) resolveBacking(path, format string) (io.ReaderAt, int64, error) {
+	if img.opts.resolver != nil {
+		r, size, err := img.opts.resolver(path, format)
+		if err != nil || r != nil {
+			return r, size, err
+		}
+	}
+	if isHTTP(path) {
+		f, err := OpenHTTP(path, img.opts.http)
+		if err != nil {
+			return nil, 0, err
+		}
+		return f, f.Size(), nil
+	}
+	return nil, 0, nil
+}
+
+// openRemoteBacking opens the backing file at path from r, as resolveBacking
+// returned it, which can only be read
+func (img *Image) openRemoteBacking(path, format string, probe, writable bool, r io.ReaderAt, size int64, chain []string) (io.ReaderAt, int64, error) {
+	s := newReaderStorage(path, r, size)
+	if writable {
+		s.Close()
+		return nil, 0, fmt.Errorf("%s: opening backing file %s for writing: %w", img.name, path, ErrReadOnly)
+	}
+	if probe {
+		format = probeReader(io.NewSectionReader(r, 0, size))
+	}
+	if format == "raw" {
+		img.log.Info("opened backing file", "backing", path, "format", format)
+		return &hostFile{storage: s, limiter: img.opts.limiter}, size, nil
+	}
+	o := img.opts
+	o.chain = chain
+	b, err := newImage(path, s, true, o)
+	if err != nil {
+		s.Close()
+		return nil, 0, fmt.Errorf("%s: opening backing file: %w", img.name, err)
+	}
+	img.log.Info("opened backing file", "backing", path, "format", "qcow2")
+	return b, b.Size(), nil
+}
+
+// readerStorage is the read-only storage of an image, or a raw backing file,
+// read from an io.ReaderAt, like a file over HTTP
+type readerStorage struct {
+	io.ReaderAt
+	info *fsEntry
+}
+
+func newReaderStorage(name string, r io.ReaderAt, size int64) *readerStorage {
+	info := &fsEntry{name: path.Base(name), mode: 0o444, size: size}
+	if m, ok := r.(interface{ ModTime() time.Time }); ok {
+		info.modTime = m.ModTime()
+	}
+	return &readerStorage{ReaderAt: r, info: info}
+}
+
+func (s *readerStorage) WriteAt([]byte, int64) (int, error) { return 0, ErrReadOnly }
+func (s *readerStorage) Truncate(int64) error               { return ErrReadOnly }
+func (s *readerStorage) Sync() error                        { return nil }
+func (s *readerStorage) Stat() (os.FileInfo, error)         { return s.info, nil }
+
+func (s *readerStorage) Close() error {
+	if c, ok := s.ReaderAt.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
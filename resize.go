@@ -0,0 +1,81 @@
+package qcow2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Resize changes the virtual size of the image to size bytes, rounded up to
+// a multiple of 512. Growing adds a range that reads from the backing file,
+// or as zeros without one. Shrinking refuses while the image allocates
+// clusters beyond the new size, rather than discarding their data; the tail
+// of a last partial cluster is zeroed instead so that it does not reappear
+// when the image grows again. Snapshots keep the size they were taken at.
+func (img *Image) Resize(size int64) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	if size < 0 {
+		return errors.New("qcow2: negative size")
+	}
+	if _, ok, _ := img.Header.readBitmapsExt(); ok {
+		return errors.New("qcow2: resizing an image with persistent bitmaps is not supported")
+	}
+	size = (size + 511) &^ 511
+	switch {
+	case size > img.Header.Size:
+		return img.grow(size)
+	case size < img.Header.Size:
+		return img.shrink(size)
+	}
+	return nil
+}
+
+func (img *Image) grow(size int64) error {
+	span := img.l2Entries * img.clusterSize
+	if n := ceilDiv(size, span); n > int64(len(img.l1)) {
+		if n > maxL1Entries {
+			return fmt.Errorf("qcow2: %d bytes need an L1 table of %d entries, larger than the maximum of %d", size, n, maxL1Entries)
+		}
+		if err := img.growL1(int(n)); err != nil {
+			return err
+		}
+	}
+	img.Header.Size = size
+	return img.writeHeader()
+}
+
+func (img *Image) shrink(size int64) error {
+	if img.Header.CryptMethod != 0 {
+		return ErrEncrypted
+	}
+	// whole clusters past the new end must be unallocated
+	for off := img.alignUp(size); off < img.Header.Size; off += img.clusterSize {
+		entry, _, err := img.l2Entry(img.l1, img.Header.L1TableOffset, off)
+		if err != nil {
+			return err
+		}
+		if img.classify(entry) != clusterUnallocated {
+			return fmt.Errorf("qcow2: shrinking to %d bytes would discard the cluster at guest offset %d", size, off)
+		}
+		if l1i := off >> img.clusterBits / img.l2Entries; img.l1[l1i]&entryOffsetMask == 0 {
+			// the range of a missing L2 table is all unallocated
+			off = (l1i+1)*img.l2Entries*img.clusterSize - img.clusterSize
+		}
+	}
+	if within := size & (img.clusterSize - 1); within != 0 {
+		entry, _, err := img.l2Entry(img.l1, img.Header.L1TableOffset, size)
+		if err != nil {
+			return err
+		}
+		if img.classify(entry) != clusterUnallocated {
+			if err := img.writeGuest(make([]byte, img.clusterSize-within), size); err != nil {
+				return err
+			}
+		}
+	}
+	img.Header.Size = size
+	return img.writeHeader()
+}
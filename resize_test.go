@@ -0,0 +1,91 @@
+package qcow2
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestResize(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "img.qcow2")
+	// one L2 table of 512 byte clusters covers 32 KiB
+	img, err := Create(name, 20<<10, &CreateOptions{ClusterSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	data := bytes.Repeat([]byte("data"), 1000)
+	if _, err := img.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.CreateSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+
+	// growing past the L1 table
+	if err := img.Resize(100<<10 + 1); err != nil {
+		t.Fatal(err)
+	}
+	if img.Size() != 100<<10+512 {
+		t.Fatalf("got size %d, want it rounded up to %d", img.Size(), 100<<10+512)
+	}
+	if len(img.l1) != 4 {
+		t.Errorf("got an L1 table of %d entries, want 4", len(img.l1))
+	}
+	if _, err := img.WriteAt([]byte("end"), img.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	verifyRefcounts(t, img)
+
+	if err := img.Resize(50 << 10); err == nil {
+		t.Fatal("shrinking discarded the data at the end")
+	}
+	if err := img.Resize(2000); err == nil {
+		t.Fatal("shrinking discarded data")
+	}
+	if _, err := img.WriteAt(make([]byte, 3), img.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	trimmed, err := img.TrimZeroClusters()
+	if err != nil || trimmed != 1 {
+		t.Fatalf("trimmed %d clusters: %v", trimmed, err)
+	}
+	// a v3 zero cluster still holds the range
+	if err := img.Resize(50 << 10); err == nil {
+		t.Fatal("shrinking discarded a zero cluster")
+	}
+
+	img2, err := Create(filepath.Join(t.TempDir(), "img.qcow2"), 100<<10, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img2.Close()
+	if _, err := img2.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	// the tail of the last cluster is zeroed, so growing does not bring it back
+	if err := img2.Resize(1024 + 512); err != nil {
+		t.Fatal(err)
+	}
+	if err := img2.Resize(8192); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	if _, err := img2.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:1536], data[:1536]) || !bytes.Equal(buf[1536:], make([]byte, 4096-1536)) {
+		t.Error("got the data beyond the shrunk size back")
+	}
+	verifyRefcounts(t, img2)
+
+	// the snapshot keeps its size
+	view, err := img.SnapshotView("snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+	if view.Size() != 20<<10 {
+		t.Errorf("got a snapshot of %d bytes, want %d", view.Size(), 20<<10)
+	}
+}
@@ -0,0 +1,38 @@
+package qcow2
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// dataRanges lists the ranges of f below size that hold data according to
+// the file system, or returns ok false when it cannot tell
+func dataRanges(f *os.File, size int64) (ranges [][2]int64, ok bool) {
+	for off := int64(0); off < size; {
+		start, err := f.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			break
+		} else if err != nil {
+			return nil, false
+		}
+		if start >= size {
+			break
+		}
+		end, err := f.Seek(start, seekHole)
+		if err != nil {
+			return nil, false
+		}
+		if end > size {
+			end = size
+		}
+		ranges = append(ranges, [2]int64{start, end})
+		off = end
+	}
+	return ranges, true
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package qcow2
+
+import "os"
+
+// dataRanges cannot ask the file system about holes here, so the whole file
+// is scanned for zeros instead
+func dataRanges(f *os.File, size int64) (ranges [][2]int64, ok bool) {
+	return nil, false
+}
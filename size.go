@@ -0,0 +1,88 @@
+package qcow2
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+
+// FormatSize is n bytes in the largest IEC unit it has at least one of, with
+// one decimal unless it is a whole number of them: 512 KiB, 1.5 GiB. The
+// decimal is rounded, so only the byte count itself is exact.
+func FormatSize(n int64) string {
+	if n < 0 {
+		return "-" + formatSize(uint64(-(n+1))+1)
+	}
+	return formatSize(uint64(n))
+}
+
+func formatSize(n uint64) string {
+	i := 0
+	for i+1 < len(sizeUnits) && n>>(10*(i+1)) > 0 {
+		i++
+	}
+	v := float64(n) / float64(uint64(1)<<(10*i))
+	if r := math.Round(v*10) / 10; r != math.Trunc(r) {
+		return fmt.Sprintf("%.1f %s", r, sizeUnits[i])
+	} else if r == 1024 && i+1 < len(sizeUnits) {
+		// rounded up into the next unit
+		return "1 " + sizeUnits[i+1]
+	}
+	return fmt.Sprintf("%.0f %s", v, sizeUnits[i])
+}
+
+// ParseSize reads a size in bytes with an optional IEC suffix: K, M, G, T, P
+// or E, case insensitive, optionally followed by iB, and optionally after a
+// space, so that it reads what FormatSize prints. A fraction is rounded to
+// the nearest byte, as in 1.5T or 2.3k. Suffixes like GB, which could mean
+// powers of 1000 or of 1024, are refused, as are negative sizes.
+func ParseSize(s string) (int64, error) {
+	num, unit := s, ""
+	if i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' }); i >= 0 {
+		num, unit = s[:i], strings.TrimPrefix(s[i:], " ")
+	}
+	shift := -1
+	switch u := strings.ToUpper(unit); {
+	case u == "" || u == "B":
+		shift = 0
+	case len(u) == 1 || len(u) == 3 && u[1:] == "IB":
+		if i := strings.IndexByte("KMGTPE", u[0]); i >= 0 {
+			shift = 10 * (i + 1)
+		}
+	}
+	if shift < 0 {
+		return 0, fmt.Errorf("qcow2: invalid size %q: unknown unit %q, expected K, M, G, T, P or E", s, unit)
+	}
+
+	whole, frac, _ := strings.Cut(num, ".")
+	if whole == "" || strings.ContainsAny(frac, ".") || (strings.Contains(num, ".") && frac == "") {
+		return 0, fmt.Errorf("qcow2: invalid size %q", s)
+	}
+	n, err := strconv.ParseUint(whole, 10, 64)
+	if err != nil || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("qcow2: invalid size %q", s)
+	}
+	n <<= shift
+	if frac != "" {
+		// the fraction of the unit, in bytes: f / 10^len(frac) << shift
+		f, err := strconv.ParseUint(frac, 10, 64)
+		if err != nil || len(frac) > 18 {
+			return 0, fmt.Errorf("qcow2: invalid size %q", s)
+		}
+		div := uint64(math.Pow10(len(frac)))
+		hi, lo := bits.Mul64(f, uint64(1)<<shift)
+		q, r := bits.Div64(hi, lo, div)
+		if 2*r >= div {
+			q++
+		}
+		if n+q > math.MaxInt64 {
+			return 0, fmt.Errorf("qcow2: invalid size %q", s)
+		}
+		n += q
+	}
+	return int64(n), nil
+}
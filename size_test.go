@@ -0,0 +1,83 @@
+package qcow2
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFormatSize(t *testing.T) {
+	for _, tc := range []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1 KiB"},
+		{512 << 10, "512 KiB"},
+		{1536, "1.5 KiB"},
+		{5308416, "5.1 MiB"},
+		{20 << 30, "20 GiB"},
+		{1<<30 - 1, "1 GiB"},
+		{3 << 39, "1.5 TiB"},
+		{math.MaxInt64, "8 EiB"},
+		{-1536, "-1.5 KiB"},
+		{math.MinInt64, "-8 EiB"},
+	} {
+		if got := FormatSize(tc.n); got != tc.want {
+			t.Errorf("%d: got %q, want %q", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want int64
+	}{
+		{"0", 0},
+		{"4096", 4096},
+		{"4096B", 4096},
+		{"64k", 64 << 10},
+		{"64K", 64 << 10},
+		{"512M", 512 << 20},
+		{"10G", 10 << 30},
+		{"10g", 10 << 30},
+		{"1.5T", 3 << 39},
+		{"2.5 KiB", 2560},
+		{"20 GiB", 20 << 30},
+		{"1.3k", 1331},
+		{"7E", 7 << 60},
+		{"0.001K", 1},
+	} {
+		got, err := ParseSize(tc.s)
+		if err != nil || got != tc.want {
+			t.Errorf("%q: got %d, %v, want %d", tc.s, got, err, tc.want)
+		}
+	}
+	for _, s := range []string{"", "G", "10GB", "10gb", "10 MB", "1iB", "-1G", " 1G", "1G ", "1,5G", "1.5.5G", "1.G", ".5G", "10Q", "8E", "99999999999999999999", "0x10", "1.0000000000000000001K"} {
+		if n, err := ParseSize(s); err == nil {
+			t.Errorf("%q: got %d, want an error", s, n)
+		}
+	}
+}
+
+func TestSizeRoundTrip(t *testing.T) {
+	// sizes that FormatSize prints exactly come back as they were
+	for _, n := range []int64{0, 1, 512, 1000, 1024, 1536, 64 << 10, 2560, 1 << 20, 3 << 29, 20 << 30, 5 << 39, 1 << 50, 3 << 59} {
+		got, err := ParseSize(FormatSize(n))
+		if err != nil || got != n {
+			t.Errorf("%d: %q came back as %d, %v", n, FormatSize(n), got, err)
+		}
+	}
+	// and the others to within the rounding of the decimal
+	for _, n := range []int64{1000000, 5308416, 1<<30 - 1, 123456789012, math.MaxInt64 >> 1} {
+		got, err := ParseSize(FormatSize(n))
+		if err != nil {
+			t.Errorf("%d: %q: %v", n, FormatSize(n), err)
+			continue
+		}
+		if math.Abs(float64(got-n)) > float64(n)/20 {
+			t.Errorf("%d: %q came back as %d", n, FormatSize(n), got)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// SnapshotCopyOptions tune CopySnapshot
+type SnapshotCopyOptions struct {
+	// Resize allows copying a snapshot of another virtual size, which the
+	// copy keeps
+	Resize bool
+	// Progress is told how many bytes of the snapshot have been copied
+	Progress ProgressFunc
+}
+
+// CopySnapshot recreates the snapshot with the given name or ID of src as an
+// internal snapshot of the image, with the same name, dates and extra data.
+// The current state of the image is left as it is. Clusters of the snapshot
+// holding the same data as the current state at the same offset, or as the
+// backing file where the current state leaves it to the backing file, are
+// shared rather than copied. The VM state of the snapshot is not copied.
+//
+// While the snapshot is being written, its tables are only referenced from
+// memory, so failing leaves no more than leaked clusters.
+func (img *Image) CopySnapshot(src *Image, nameOrID string, opts *SnapshotCopyOptions) error {
+	if opts == nil {
+		opts = &SnapshotCopyOptions{}
+	}
+	if src == img {
+		return errors.New("qcow2: cannot copy a snapshot within the same image")
+	}
+	view, err := src.SnapshotView(nameOrID)
+	if err != nil {
+		return err
+	}
+	i, _ := src.findSnapshot(nameOrID)
+	snap := src.snapshots[i]
+
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	if img.Header.CryptMethod != 0 || view.Header.CryptMethod != 0 {
+		return ErrEncrypted
+	}
+	for _, s := range img.snapshots {
+		if s.Name == snap.Name {
+			return fmt.Errorf("qcow2: a snapshot named %q already exists", snap.Name)
+		}
+	}
+	size := view.Size()
+	if size != img.Size() && !opts.Resize {
+		return fmt.Errorf("qcow2: snapshot %q of %d bytes does not match the virtual size %d", snap.Name, size, img.Size())
+	}
+
+	prog := newProgress(opts.Progress, size)
+	l1, l1off, err := img.buildSnapshot(view, prog)
+	if err != nil {
+		return err
+	}
+	for i, e := range l1 {
+		l1[i] = e &^ flagCopied
+	}
+	if err := img.writeTable(l1, l1off); err != nil {
+		return err
+	}
+
+	extra := append([]byte(nil), snap.ExtraData...)
+	if len(extra) < 16 {
+		extra = append(extra, make([]byte, 16-len(extra))...)
+	}
+	// without the VM state, only the disk size remains of the first fields
+	clear(extra[0:8])
+	binary.BigEndian.PutUint64(extra[8:16], uint64(size))
+	copied := Snapshot{
+		ID:            img.nextSnapshotID(),
+		Name:          snap.Name,
+		Date:          snap.Date,
+		VMClock:       snap.VMClock,
+		L1TableOffset: l1off,
+		L1Size:        len(l1),
+		DiskSize:      size,
+		ExtraData:     extra,
+	}
+	if err := img.writeSnapshots(append(img.Snapshots(), copied)); err != nil {
+		return err
+	}
+	prog.finish()
+	return nil
+}
+
+// buildSnapshot writes the contents of src into a new tree of tables, and
+// returns its L1 table and where it is stored. The data clusters and L2
+// tables are allocated by the usual write path, pointed at the new L1 table
+// instead of the active one.
+func (img *Image) buildSnapshot(src *Image, prog *progress) ([]uint64, int64, error) {
+	size := src.Size()
+	l1 := make([]uint64, ceilDiv(size, img.l2Entries*img.clusterSize))
+	var l1off int64
+	if len(l1) > 0 {
+		var err error
+		if l1off, err = img.allocClusters(img.alignUp(int64(len(l1))*8) / img.clusterSize); err != nil {
+			return nil, 0, err
+		}
+		if err := img.writeTable(l1, l1off); err != nil {
+			return nil, 0, err
+		}
+	}
+	ranges, err := dataRangesOf(src, img.clusterSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	ranges = mergeRanges(ranges)
+
+	active, activeOff := img.l1, img.Header.L1TableOffset
+	img.l1, img.Header.L1TableOffset = l1, l1off
+	defer func() {
+		img.l1, img.Header.L1TableOffset = active, activeOff
+	}()
+	p := make([]byte, img.clusterSize)
+	for off := int64(0); off < size; off += img.clusterSize {
+		n := min(img.clusterSize, size-off)
+		for len(ranges) > 0 && ranges[0][1] <= off {
+			ranges = ranges[1:]
+		}
+		clear(p)
+		if len(ranges) > 0 && ranges[0][0] <= off {
+			if _, err := src.ReadAt(p[:n], off); err != nil {
+				return nil, 0, err
+			}
+		}
+		if err := img.storeSnapshotCluster(active, activeOff, p[:n], off); err != nil {
+			return nil, 0, err
+		}
+		prog.add(n)
+	}
+	return l1, l1off, nil
+}
+
+// storeSnapshotCluster stores p, the contents of the cluster at off, in the
+// tree img.l1 is pointed at. The cluster is shared with the active tree, of
+// the L1 table active stored at activeOff, when that holds the same data, and left to the backing file when it does.
+func (img *Image) storeSnapshotCluster(active []uint64, activeOff int64, p []byte, off int64) error {
+	if len(bytes.TrimLeft(p, "\x00")) == 0 {
+		if img.backing == nil || off >= img.backingSize {
+			return nil
+		}
+		if img.Header.Version >= 3 {
+			entryOff, err := img.l2ForWrite(off)
+			if err != nil {
+				return err
+			}
+			return img.writeEntry(entryOff, flagZero)
+		}
+		return img.writeGuest(p, off)
+	}
+
+	entry, activeEntryOff, err := img.l2Entry(active, activeOff, off)
+	if err != nil {
+		return err
+	}
+	cur := make([]byte, len(p))
+	switch img.classify(entry) {
+	case clusterNormal:
+		if err := img.readGuest(active, activeOff, cur, off); err != nil {
+			return err
+		}
+		if !bytes.Equal(cur, p) {
+			break
+		}
+		entryOff, err := img.l2ForWrite(off)
+		if err != nil {
+			return err
+		}
+		host := entry & entryOffsetMask
+		if rc, err := img.refcount(int64(host)); err != nil {
+			return err
+		} else if rc >= img.refcountMax() {
+			break // too shared already, so it is copied
+		}
+		if err := img.updateRefcount(int64(host), img.clusterSize, 1); err != nil {
+			return err
+		}
+		if err := img.writeEntry(entryOff, host); err != nil {
+			return err
+		}
+		if entry&flagCopied != 0 {
+			return img.writeEntry(activeEntryOff, entry&^flagCopied)
+		}
+		return nil
+	case clusterUnallocated:
+		if img.backing == nil {
+			break
+		}
+		if err := img.readBacking(cur, off); err != nil {
+			return err
+		}
+		if bytes.Equal(cur, p) {
+			return nil
+		}
+	}
+	return img.writeGuest(p, off)
+}
@@ -0,0 +1,73 @@
+package qcow2
+
+import "bytes"
+
+// SnapshotDiff returns the ranges of the guest disk, in whole clusters, that
+// changed since the snapshot with the given name or ID was taken. Clusters
+// are compared by their L2 entries, which differ for every cluster written
+// since, as writes copy the clusters shared with the snapshot. With content,
+// changed clusters are also read, and those holding the same data as in the
+// snapshot are left out. When the virtual sizes differ, the range past the
+// smaller one has changed.
+func (img *Image) SnapshotDiff(nameOrID string, content bool) ([]Range, error) {
+	snap, err := img.SnapshotView(nameOrID)
+	if err != nil {
+		return nil, err
+	}
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+
+	var changed []Range
+	add := func(off, n int64) {
+		if m := len(changed); m > 0 && changed[m-1].Start+changed[m-1].Length == off {
+			changed[m-1].Length += n
+			return
+		}
+		changed = append(changed, Range{off, n})
+	}
+	var a, b []byte
+	if content {
+		a, b = make([]byte, img.clusterSize), make([]byte, img.clusterSize)
+	}
+	size := min(img.Size(), snap.Size())
+	span := img.l2Entries * img.clusterSize
+	for off := int64(0); off < size; {
+		l1i := off / span
+		if l1i < int64(len(img.l1)) && l1i < int64(len(snap.l1)) && img.l1[l1i]&entryOffsetMask == snap.l1[l1i]&entryOffsetMask {
+			// the whole L2 table is shared
+			off = (l1i + 1) * span
+			continue
+		}
+		n := min(img.clusterSize, size-off)
+		cur, _, err := img.l2Entry(img.l1, img.Header.L1TableOffset, off)
+		if err != nil {
+			return nil, err
+		}
+		old, _, err := img.l2Entry(snap.l1, snap.Header.L1TableOffset, off)
+		if err != nil {
+			return nil, err
+		}
+		if cur&^flagCopied == old&^flagCopied {
+			off += n
+			continue
+		}
+		if content {
+			if err := img.readGuest(img.l1, img.Header.L1TableOffset, a[:n], off); err != nil {
+				return nil, err
+			}
+			if err := img.readGuest(snap.l1, snap.Header.L1TableOffset, b[:n], off); err != nil {
+				return nil, err
+			}
+			if bytes.Equal(a[:n], b[:n]) {
+				off += n
+				continue
+			}
+		}
+		add(off, n)
+		off += n
+	}
+	if end := max(img.Size(), snap.Size()); end > size {
+		add(size, end-size)
+	}
+	return changed, nil
+}
@@ -0,0 +1,493 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ErrSnapshotNotFound is returned when no snapshot matches the requested name or ID
+var ErrSnapshotNotFound = errors.New("qcow2: snapshot not found")
+
+// Snapshot is an entry of the internal snapshot table
+type Snapshot struct {
+	ID            string
+	Name          string
+	Date          time.Time
+	VMClock       time.Duration
+	VMStateSize   int64
+	L1TableOffset int64
+	L1Size        int
+
+	// DiskSize is the virtual size of the disk when the snapshot was taken,
+	// or zero when the extra data does not record it
+	DiskSize int64
+
+	// ExtraData is the raw extra data of the entry
+	ExtraData []byte
+}
+
+const snapshotHeaderSize = 40
+
+// Snapshots lists the internal snapshots of the image
+func (img *Image) Snapshots() []Snapshot {
+	return append([]Snapshot(nil), img.snapshots...)
+}
+
+// findSnapshot looks up a snapshot by ID, then by name
+func (img *Image) findSnapshot(nameOrID string) (int, error) {
+	for i, s := range img.snapshots {
+		if s.ID == nameOrID {
+			return i, nil
+		}
+	}
+	for i, s := range img.snapshots {
+		if s.Name == nameOrID {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("%w: %q", ErrSnapshotNotFound, nameOrID)
+}
+
+// readSnapshots loads the snapshot table. On errors, the snapshots read
+// before are kept.
+func (img *Image) readSnapshots() error {
+	img.snapshots = nil
+	img.snapTableSize = 0
+	if img.Header.NbSnapshots == 0 {
+		return nil
+	}
+	r := io.NewSectionReader(img.fh, img.Header.SnapshotsOffset, 1<<62)
+	var size int64
+	for i := 0; i < img.Header.NbSnapshots; i++ {
+		at := img.Header.SnapshotsOffset + size
+		buf := make([]byte, snapshotHeaderSize)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		// the 32 bit fields are checked as read, before they are ints, which
+		// they may not fit on 32 bit platforms
+		l1Size := binary.BigEndian.Uint32(buf[8:12])
+		if uint64(l1Size) > math.MaxInt {
+			return CorruptionError{Offset: at + 8, Structure: StructSnapshotTable, Index: int64(i), Value: uint64(l1Size),
+				Reason: fmt.Sprintf("snapshot %d has an L1 table of %d entries, which does not fit an int", i, l1Size)}
+		}
+		s := Snapshot{
+			L1TableOffset: be64(buf[0:8]),
+			L1Size:        int(l1Size),
+			Date:          time.Unix(int64(binary.BigEndian.Uint32(buf[16:20])), int64(binary.BigEndian.Uint32(buf[20:24]))),
+			VMClock:       time.Duration(be64(buf[24:32])),
+			VMStateSize:   int64(binary.BigEndian.Uint32(buf[32:36])),
+		}
+		if extra := binary.BigEndian.Uint32(buf[36:40]); extra > 1024 {
+			return CorruptionError{Offset: at + 36, Structure: StructSnapshotTable, Index: int64(i), Value: uint64(extra),
+				Reason: fmt.Sprintf("snapshot %d has %d bytes of extra data, more than 1024", i, extra)}
+		}
+		idSize, nameSize := int(binary.BigEndian.Uint16(buf[12:14])), int(binary.BigEndian.Uint16(buf[14:16]))
+		extraSize := int(binary.BigEndian.Uint32(buf[36:40]))
+		rest := make([]byte, extraSize+idSize+nameSize)
+		if _, err := io.ReadFull(r, rest); err != nil {
+			return err
+		}
+		s.ExtraData = rest[:extraSize]
+		s.ID = string(rest[extraSize : extraSize+idSize])
+		s.Name = string(rest[extraSize+idSize:])
+		if extraSize >= 8 {
+			s.VMStateSize = be64(s.ExtraData[0:8])
+		}
+		if extraSize >= 16 {
+			s.DiskSize = be64(s.ExtraData[8:16])
+		}
+
+		entry := int64(snapshotHeaderSize + len(rest))
+		pad := (8 - entry%8) % 8
+		if _, err := io.CopyN(io.Discard, r, pad); err != nil {
+			return err
+		}
+		size += entry + pad
+		img.snapshots = append(img.snapshots, s)
+		img.snapTableSize = size
+	}
+	return nil
+}
+
+// marshalSnapshots encodes the snapshot table
+func marshalSnapshots(snaps []Snapshot) []byte {
+	var out []byte
+	for _, s := range snaps {
+		buf := make([]byte, snapshotHeaderSize)
+		binary.BigEndian.PutUint64(buf[0:8], uint64(s.L1TableOffset))
+		binary.BigEndian.PutUint32(buf[8:12], uint32(s.L1Size))
+		binary.BigEndian.PutUint16(buf[12:14], uint16(len(s.ID)))
+		binary.BigEndian.PutUint16(buf[14:16], uint16(len(s.Name)))
+		binary.BigEndian.PutUint32(buf[16:20], uint32(s.Date.Unix()))
+		binary.BigEndian.PutUint32(buf[20:24], uint32(s.Date.Nanosecond()))
+		binary.BigEndian.PutUint64(buf[24:32], uint64(s.VMClock))
+		vmState := s.VMStateSize
+		if vmState > 1<<32-1 {
+			vmState = 0 // only the large field of the extra data holds it
+		}
+		binary.BigEndian.PutUint32(buf[32:36], uint32(vmState))
+		binary.BigEndian.PutUint32(buf[36:40], uint32(len(s.ExtraData)))
+		buf = append(buf, s.ExtraData...)
+		buf = append(buf, s.ID...)
+		buf = append(buf, s.Name...)
+		for len(buf)%8 != 0 {
+			buf = append(buf, 0)
+		}
+		out = append(out, buf...)
+	}
+	return out
+}
+
+// writeSnapshots stores snaps as a new snapshot table and frees the old one
+func (img *Image) writeSnapshots(snaps []Snapshot) error {
+	buf := marshalSnapshots(snaps)
+	var off int64
+	if len(buf) > 0 {
+		clusters := (int64(len(buf)) + img.clusterSize - 1) / img.clusterSize
+		var err error
+		if off, err = img.allocClusters(clusters); err != nil {
+			return err
+		}
+		if _, err := img.fh.WriteAt(buf, off); err != nil {
+			return err
+		}
+	}
+
+	oldOff, oldSize := img.Header.SnapshotsOffset, img.snapTableSize
+	img.Header.SnapshotsOffset = off
+	img.Header.NbSnapshots = len(snaps)
+	if err := img.writeHeader(); err != nil {
+		return err
+	}
+	img.snapshots = snaps
+	img.snapTableSize = int64(len(buf))
+	if oldSize > 0 {
+		return img.updateRefcount(oldOff, oldSize, -1)
+	}
+	return nil
+}
+
+// updateTreeRefcounts adds delta to the refcount of every L2 table and data
+// cluster reachable through l1
+func (img *Image) updateTreeRefcounts(l1 []uint64, delta int) error {
+	for _, e := range l1 {
+		l2off := int64(e & entryOffsetMask)
+		if l2off == 0 {
+			continue
+		}
+		l2, err := img.readTable(l2off, int(img.l2Entries))
+		if err != nil {
+			return err
+		}
+		for _, entry := range l2 {
+			if img.classify(entry) == clusterCompressed {
+				off, size := img.compressedRange(entry)
+				err = img.updateRefcount(off, size, delta)
+			} else if host := int64(entry & entryOffsetMask); host != 0 {
+				err = img.updateRefcount(host, img.clusterSize, delta)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := img.updateRefcount(l2off, img.clusterSize, delta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeFits checks that the refcounts of the L2 tables and data clusters of l1
+// can take one more reference of the tree, before updateTreeRefcounts takes
+// them and fails half way. The references of the tree to each cluster are
+// only added up for refcounts narrower than 16 bits, for wider ones to take
+// no memory; those overflow long after qemu's limit of snapshots.
+func (img *Image) treeFits(l1 []uint64) error {
+	max := img.refcountMax()
+	var counts map[int64]uint64
+	if img.refcountBits() < 16 {
+		counts = map[int64]uint64{}
+	}
+	fits := func(off, size int64) error {
+		for c := off &^ (img.clusterSize - 1); c < off+size; c += img.clusterSize {
+			rc, err := img.refcount(c)
+			if err != nil {
+				return err
+			}
+			n := uint64(1)
+			if counts != nil {
+				counts[c]++
+				n = counts[c]
+			}
+			if rc > max-n {
+				return fmt.Errorf("%w: cluster %#x has %d references, and %d bit refcounts can not count %d more", ErrRefcountTooNarrow, c, rc, img.refcountBits(), n)
+			}
+		}
+		return nil
+	}
+	for _, e := range l1 {
+		l2off := int64(e & entryOffsetMask)
+		if l2off == 0 {
+			continue
+		}
+		if err := fits(l2off, img.clusterSize); err != nil {
+			return err
+		}
+		l2, err := img.readTable(l2off, int(img.l2Entries))
+		if err != nil {
+			return err
+		}
+		for _, entry := range l2 {
+			if img.classify(entry) == clusterCompressed {
+				err = fits(img.compressedRange(entry))
+			} else if host := int64(entry & entryOffsetMask); host != 0 {
+				err = fits(host, img.clusterSize)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fixCopiedFlags sets the COPIED flag of the active L1 and L2 entries whose
+// clusters are referenced exactly once, and clears it everywhere else
+func (img *Image) fixCopiedFlags() error {
+	for i, e := range img.l1 {
+		l2off := int64(e & entryOffsetMask)
+		if l2off == 0 {
+			continue
+		}
+		rc, err := img.refcount(l2off)
+		if err != nil {
+			return err
+		}
+		want := uint64(l2off)
+		if rc == 1 {
+			want |= flagCopied
+		}
+		if e != want {
+			if err := img.setL1(int64(i), want); err != nil {
+				return err
+			}
+		}
+		l2, err := img.readTable(l2off, int(img.l2Entries))
+		if err != nil {
+			return err
+		}
+		changed := false
+		for j, entry := range l2 {
+			host := int64(entry & entryOffsetMask)
+			if img.classify(entry) == clusterCompressed || host == 0 {
+				continue
+			}
+			rc, err := img.refcount(host)
+			if err != nil {
+				return err
+			}
+			want := entry &^ flagCopied
+			if rc == 1 {
+				want |= flagCopied
+			}
+			if want != entry {
+				l2[j] = want
+				changed = true
+			}
+		}
+		if changed {
+			if err := img.writeTable(l2, l2off); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// nextSnapshotID is one more than the largest numeric snapshot ID
+func (img *Image) nextSnapshotID() string {
+	max := 0
+	for _, s := range img.snapshots {
+		if id, err := strconv.Atoi(s.ID); err == nil && id > max {
+			max = id
+		}
+	}
+	return strconv.Itoa(max + 1)
+}
+
+// CreateSnapshot records the current disk state as an internal snapshot
+func (img *Image) CreateSnapshot(name string) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	for _, s := range img.snapshots {
+		if s.Name == name {
+			return fmt.Errorf("qcow2: a snapshot named %q already exists", name)
+		}
+	}
+
+	if err := img.treeFits(img.l1); err != nil {
+		return err
+	}
+	if err := img.updateTreeRefcounts(img.l1, 1); err != nil {
+		return err
+	}
+	if err := img.fixCopiedFlags(); err != nil {
+		return err
+	}
+
+	l1 := make([]uint64, len(img.l1))
+	for i, e := range img.l1 {
+		l1[i] = e &^ flagCopied
+	}
+	var l1off int64
+	if len(l1) > 0 {
+		var err error
+		if l1off, err = img.allocClusters(img.alignUp(int64(len(l1))*8) / img.clusterSize); err != nil {
+			return err
+		}
+		if err := img.writeTable(l1, l1off); err != nil {
+			return err
+		}
+	}
+
+	extra := make([]byte, 16)
+	binary.BigEndian.PutUint64(extra[8:16], uint64(img.Header.Size))
+	snap := Snapshot{
+		ID:            img.nextSnapshotID(),
+		Name:          name,
+		Date:          time.Now(),
+		L1TableOffset: l1off,
+		L1Size:        len(l1),
+		DiskSize:      img.Header.Size,
+		ExtraData:     extra,
+	}
+	return img.writeSnapshots(append(img.Snapshots(), snap))
+}
+
+// SnapshotView returns a read-only image of the disk as recorded by the
+// snapshot with the given name or ID, read through the backing chain, with
+// the virtual size the snapshot recorded. The view shares the file of the
+// image, which must not be written to or closed while the view is in use.
+// Closing the view does nothing.
+func (img *Image) SnapshotView(nameOrID string) (*Image, error) {
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+	i, err := img.findSnapshot(nameOrID)
+	if err != nil {
+		return nil, err
+	}
+	snap := img.snapshots[i]
+	l1, err := img.readTable(snap.L1TableOffset, snap.L1Size)
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: reading L1 table of snapshot %q: %w", snap.Name, err)
+	}
+	h := img.Header
+	h.L1TableOffset, h.L1Size = snap.L1TableOffset, snap.L1Size
+	if snap.DiskSize != 0 {
+		h.Size = snap.DiskSize
+	}
+	if h.Size < 0 || int64(snap.L1Size)*img.l2Entries*img.clusterSize < h.Size {
+		return nil, fmt.Errorf("qcow2: L1 table of snapshot %q of %d entries is too small for %d bytes", snap.Name, snap.L1Size, h.Size)
+	}
+	return &Image{
+		Header:        h,
+		name:          img.name,
+		fh:            img.fh,
+		readOnly:      true,
+		clusterBits:   img.clusterBits,
+		clusterSize:   img.clusterSize,
+		l2Entries:     img.l2Entries,
+		l1:            l1,
+		reftable:      img.reftable,
+		end:           img.end,
+		snapshots:     img.snapshots,
+		snapTableSize: img.snapTableSize,
+		backing:       img.backing,
+		backingSize:   img.backingSize,
+		crypt:         img.crypt,
+		opts:          img.opts,
+		view:          true,
+	}, nil
+}
+
+// ApplySnapshot reverts the disk to the state recorded by the snapshot with
+// the given name or ID. The snapshot is kept, so it can be applied again.
+func (img *Image) ApplySnapshot(nameOrID string) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	i, err := img.findSnapshot(nameOrID)
+	if err != nil {
+		return err
+	}
+	snap := img.snapshots[i]
+	snapL1, err := img.readTable(snap.L1TableOffset, snap.L1Size)
+	if err != nil {
+		return fmt.Errorf("qcow2: reading L1 table of snapshot %q: %w", snap.Name, err)
+	}
+	if len(snapL1) > len(img.l1) {
+		if err := img.growL1(len(snapL1)); err != nil {
+			return err
+		}
+	}
+
+	// take the references of the snapshot before dropping those of the
+	// current state, so that clusters they share are never freed
+	if err := img.treeFits(snapL1); err != nil {
+		return err
+	}
+	if err := img.updateTreeRefcounts(snapL1, 1); err != nil {
+		return err
+	}
+	old := img.l1
+	l1 := make([]uint64, len(old))
+	copy(l1, snapL1)
+	if err := img.writeTable(l1, img.Header.L1TableOffset); err != nil {
+		return err
+	}
+	img.l1 = l1
+	if err := img.updateTreeRefcounts(old, -1); err != nil {
+		return err
+	}
+	if err := img.fixCopiedFlags(); err != nil {
+		return err
+	}
+
+	if snap.DiskSize != 0 && snap.DiskSize != img.Header.Size {
+		img.Header.Size = snap.DiskSize
+		return img.writeHeader()
+	}
+	return nil
+}
+
+// growL1 moves the active L1 table to an allocation of n entries
+func (img *Image) growL1(n int) error {
+	l1 := make([]uint64, n)
+	copy(l1, img.l1)
+	off, err := img.allocClusters(img.alignUp(int64(n)*8) / img.clusterSize)
+	if err != nil {
+		return err
+	}
+	if err := img.writeTable(l1, off); err != nil {
+		return err
+	}
+	oldOff, oldSize := img.Header.L1TableOffset, int64(img.Header.L1Size)*8
+	img.l1 = l1
+	img.Header.L1TableOffset = off
+	img.Header.L1Size = n
+	if err := img.writeHeader(); err != nil {
+		return err
+	}
+	return img.updateRefcount(oldOff, oldSize, -1)
+}
@@ -0,0 +1,247 @@
+package qcow2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestApplySnapshot(t *testing.T) {
+	img := tempImage(t)
+	verifyRefcounts(t, img)
+
+	// straddle a cluster boundary, and touch a region qemu never wrote
+	offsets := []int64{img.clusterSize - 4096, 64 << 20}
+	write := func(pattern byte) {
+		buf := bytes.Repeat([]byte{pattern}, 3*4096)
+		for _, off := range offsets {
+			if _, err := img.WriteAt(buf, off); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	expect := func(pattern byte) {
+		t.Helper()
+		buf := make([]byte, 3*4096)
+		for _, off := range offsets {
+			if _, err := img.ReadAt(buf, off); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, bytes.Repeat([]byte{pattern}, len(buf))) {
+				t.Fatalf("at %d: expected pattern %#x, got %#x...", off, pattern, buf[:8])
+			}
+		}
+	}
+
+	write('A')
+	if err := img.CreateSnapshot("pattern-a"); err != nil {
+		t.Fatal(err)
+	}
+	verifyRefcounts(t, img)
+	for i := 0; i < 2; i++ {
+		write('B')
+		expect('B')
+		verifyRefcounts(t, img)
+
+		if err := img.ApplySnapshot("pattern-a"); err != nil {
+			t.Fatal(err)
+		}
+		expect('A')
+		verifyRefcounts(t, img)
+	}
+
+	if len(img.Snapshots()) != 3 {
+		t.Errorf("expected 3 snapshots, got %d", len(img.Snapshots()))
+	}
+	if err := img.ApplySnapshot("no-such-snapshot"); err == nil {
+		t.Error("expected an error applying a missing snapshot")
+	}
+
+	// the reverted state must survive reopening
+	name := img.Name()
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+	img, err := OpenFile(name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	expect('A')
+	verifyRefcounts(t, img)
+}
+
+func TestSnapshotView(t *testing.T) {
+	dir := t.TempDir()
+	img, err := Create(filepath.Join(dir, "disk.qcow2"), 1<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	a := bytes.Repeat([]byte("A"), 3*4096)
+	if _, err := img.WriteAt(a, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.CreateSnapshot("pattern-a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte("B"), 2*4096), 2*4096); err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, img.Size())
+	copy(want[4096:], a)
+
+	snap, err := img.SnapshotView("pattern-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snap.WriteAt(a, 0); err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly writing to the view, got %v", err)
+	}
+	raw := filepath.Join(dir, "out.raw")
+	if err := snap.ConvertToRaw(raw, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha256.Sum256(got) != sha256.Sum256(want) {
+		t.Error("the raw export does not hold the snapshot")
+	}
+
+	out := filepath.Join(dir, "out.qcow2")
+	if err := snap.Flatten(out, &ConvertOptions{Compress: true}); err != nil {
+		t.Fatal(err)
+	}
+	exported, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exported.Close()
+	got = make([]byte, exported.Size())
+	if _, err := exported.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if sha256.Sum256(got) != sha256.Sum256(want) {
+		t.Error("the qcow2 export does not hold the snapshot")
+	}
+
+	// closing the view leaves the image usable
+	snap.Close()
+	if _, err := img.ReadAt(got[:4096], 2*4096); err != nil || got[0] != 'B' {
+		t.Errorf("reading the image after closing the view: %v", err)
+	}
+	if _, err := img.SnapshotView("no-such-snapshot"); err == nil {
+		t.Error("expected an error viewing a missing snapshot")
+	}
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	img, err := Create(filepath.Join(t.TempDir(), "disk.qcow2"), 1<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	a := bytes.Repeat([]byte("A"), 4*4096)
+	if _, err := img.WriteAt(a, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.CreateSnapshot("base"); err != nil {
+		t.Fatal(err)
+	}
+	// change a cluster, rewrite another with the same data, and allocate a
+	// third past the data of the snapshot
+	if _, err := img.WriteAt([]byte("B"), 4096+10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(a[:4096], 2*4096); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(a[:1], 600<<10); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		content bool
+		want    []Range
+	}{
+		{false, []Range{{4096, 2 * 4096}, {600 << 10, 4096}}},
+		{true, []Range{{4096, 4096}, {600 << 10, 4096}}},
+	} {
+		got, err := img.SnapshotDiff("base", tc.content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("content %v: got %v, want %v", tc.content, got, tc.want)
+		}
+	}
+}
+
+func TestCopySnapshot(t *testing.T) {
+	dir := t.TempDir()
+	src, err := Create(filepath.Join(dir, "src.qcow2"), 1<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	a, b := bytes.Repeat([]byte("A"), 4*4096), bytes.Repeat([]byte("B"), 4*4096)
+	if _, err := src.WriteAt(a, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.WriteAt(b, 8*4096); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.CreateSnapshot("nightly"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.WriteAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := Create(filepath.Join(dir, "dst.qcow2"), 1<<20, &CreateOptions{ClusterSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	// the current state already holds half of the snapshot
+	if _, err := dst.WriteAt(b, 8*4096); err != nil {
+		t.Fatal(err)
+	}
+	before := dst.end
+	if err := dst.CopySnapshot(src, "nightly", nil); err != nil {
+		t.Fatal(err)
+	}
+	verifyRefcounts(t, src)
+	verifyRefcounts(t, dst)
+	// the L1 table, an L2 table, the clusters of A and the snapshot table
+	if got, want := dst.end-before, int64(7*4096); got != want {
+		t.Errorf("copying allocated %d bytes, want %d", got, want)
+	}
+	snaps := dst.Snapshots()
+	if len(snaps) != 1 || snaps[0].Name != "nightly" || !snaps[0].Date.Equal(src.Snapshots()[0].Date) {
+		t.Fatalf("unexpected snapshots %+v", snaps)
+	}
+
+	if err := dst.ApplySnapshot("nightly"); err != nil {
+		t.Fatal(err)
+	}
+	verifyRefcounts(t, dst)
+	want, got := make([]byte, 12*4096), make([]byte, 12*4096)
+	copy(want, a)
+	copy(want[8*4096:], b)
+	if _, err := dst.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("the copied snapshot does not hold the data of the original")
+	}
+
+	if err := dst.CopySnapshot(src, "nightly", nil); err == nil {
+		t.Error("expected an error copying a snapshot of an existing name")
+	}
+}
@@ -0,0 +1,292 @@
+package qcow2
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// TarManifestVersion is the version of the manifest ExportTar writes, and
+// the newest ImportTar reads
+const TarManifestVersion = 1
+
+// TarManifestName is the name of the manifest, the first entry of the tar
+// stream
+const TarManifestName = "manifest.json"
+
+// TarManifest describes the guest disk exported by ExportTar
+type TarManifest struct {
+	Version     int   `json:"version"`
+	VirtualSize int64 `json:"virtual-size"`
+	ClusterSize int64 `json:"cluster-size"`
+	// Extents are the ranges of the disk that do not read as zeros, in
+	// order, each stored as an entry of the stream. The rest of the disk
+	// reads as zeros.
+	Extents []TarExtent `json:"extents"`
+	Source  TarSource   `json:"source"`
+}
+
+// TarExtent is a range of the guest disk stored in the tar stream
+type TarExtent struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	SHA256 string `json:"sha256"`
+}
+
+// TarSource is what the header of the exported image said, of which
+// ImportTar keeps the version and the refcount width
+type TarSource struct {
+	Version              Version `json:"version"`
+	RefcountBits         int     `json:"refcount-bits"`
+	IncompatibleFeatures uint64  `json:"incompatible-features"`
+	CompatibleFeatures   uint64  `json:"compatible-features"`
+	AutoclearFeatures    uint64  `json:"autoclear-features"`
+	CryptMethod          string  `json:"crypt-method"`
+	Snapshots            int     `json:"snapshots"`
+	BackingFile          string  `json:"backing-file,omitempty"`
+	BackingFormat        string  `json:"backing-format,omitempty"`
+}
+
+// tarExtentName is the name of the entry of the extent at off
+func tarExtentName(off int64) string {
+	return fmt.Sprintf("data/%016x.bin", off)
+}
+
+// ExportTar writes the guest visible contents of the image, flattened through
+// its backing chain, to w as a tar stream: first the TarManifest, as
+// TarManifestName, and then an entry for each range of the disk that does not
+// read as zeros, named after its guest offset, as data/0000000000a00000.bin.
+// The ranges are read twice, once for the digests of the manifest. Of opts,
+// only Progress applies, which counts both reads.
+func (img *Image) ExportTar(w io.Writer, opts *ConvertOptions) error {
+	m := TarManifest{
+		Version:     TarManifestVersion,
+		VirtualSize: img.Size(),
+		ClusterSize: img.clusterSize,
+		Extents:     []TarExtent{},
+		Source: TarSource{
+			Version:              img.Header.Version,
+			RefcountBits:         1 << img.Header.RefcountOrder,
+			IncompatibleFeatures: img.Header.IncompatibleFeatures,
+			CompatibleFeatures:   img.Header.CompatibleFeatures,
+			AutoclearFeatures:    img.Header.AutoclearFeatures,
+			CryptMethod:          img.Header.CryptMethod.String(),
+			Snapshots:            img.Header.NbSnapshots,
+			BackingFile:          img.Header.BackingFile,
+			BackingFormat:        img.Header.BackingFormat(),
+		},
+	}
+	next := img.extents()
+	var total int64
+	for {
+		e, ok, err := next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if e.ReadsAsZeros() {
+			continue
+		}
+		if n := len(m.Extents); n > 0 && m.Extents[n-1].Offset+m.Extents[n-1].Length == e.Start {
+			m.Extents[n-1].Length += e.Length
+		} else {
+			m.Extents = append(m.Extents, TarExtent{Name: tarExtentName(e.Start), Offset: e.Start, Length: e.Length})
+		}
+		total += e.Length
+	}
+	prog := opts.progress(2 * total)
+	buf := make([]byte, convertChunk)
+	for i := range m.Extents {
+		h := sha256.New()
+		if err := img.copyExtent(h, m.Extents[i], buf, prog); err != nil {
+			return err
+		}
+		m.Extents[i].SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+
+	manifest, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return err
+	}
+	manifest = append(manifest, '\n')
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	if err := tw.WriteHeader(&tar.Header{Name: TarManifestName, Mode: 0o644, Size: int64(len(manifest)), ModTime: now, Format: tar.FormatPAX}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+	for _, e := range m.Extents {
+		if err := tw.WriteHeader(&tar.Header{Name: e.Name, Mode: 0o644, Size: e.Length, ModTime: now, Format: tar.FormatPAX}); err != nil {
+			return err
+		}
+		if err := img.copyExtent(tw, e, buf, prog); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	prog.finish()
+	return nil
+}
+
+// copyExtent writes the guest disk of the extent e to w, a buffer at a time
+func (img *Image) copyExtent(w io.Writer, e TarExtent, buf []byte, prog *progress) error {
+	for off := e.Offset; off < e.Offset+e.Length; {
+		p := buf[:min(int64(len(buf)), e.Offset+e.Length-off)]
+		if _, err := img.ReadAt(p, off); err != nil {
+			return err
+		}
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+		off += int64(len(p))
+		prog.add(int64(len(p)))
+	}
+	return nil
+}
+
+// ImportTar creates the image dst from a tar stream written by ExportTar,
+// read sequentially from r, checking the entries against the digests and
+// ranges of the manifest. The image has the cluster size, version and
+// refcount width of the exported image, unless the CreateOptions of opts set
+// them, and no backing file: the stream holds all of the disk. On failure
+// the output file is removed.
+func ImportTar(r io.Reader, dst string, opts *ConvertOptions) error {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err == io.EOF {
+		return errors.New("qcow2: tar stream is empty")
+	} else if err != nil {
+		return fmt.Errorf("qcow2: reading tar stream: %w", err)
+	}
+	if hdr.Name != TarManifestName {
+		return fmt.Errorf("qcow2: tar stream starts with %q rather than %s", hdr.Name, TarManifestName)
+	}
+	var m TarManifest
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return fmt.Errorf("qcow2: %s: %w", TarManifestName, err)
+	}
+	if err := m.check(); err != nil {
+		return err
+	}
+
+	var o ConvertOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.ClusterSize == 0 {
+		o.ClusterSize = m.ClusterSize
+	}
+	if o.Version == 0 {
+		o.Version = m.Source.Version
+	}
+	if o.RefcountBits == 0 {
+		o.RefcountBits = m.Source.RefcountBits
+	}
+	o.BackingFile, o.BackingFormat = "", ""
+	img, err := o.create(dst, m.VirtualSize)
+	if err != nil {
+		return err
+	}
+	if err := img.copyTar(tr, &m, &o); err != nil {
+		img.Close()
+		os.Remove(dst)
+		return err
+	}
+	if opts != nil {
+		opts.Deduplicated = o.Deduplicated
+	}
+	return img.Close()
+}
+
+// check validates the manifest, before any of the extents are read
+func (m *TarManifest) check() error {
+	if m.Version < 1 || m.Version > TarManifestVersion {
+		return fmt.Errorf("qcow2: %s is of version %d, not one of 1 to %d", TarManifestName, m.Version, TarManifestVersion)
+	}
+	if m.VirtualSize < 0 {
+		return fmt.Errorf("qcow2: %s: invalid virtual size %d", TarManifestName, m.VirtualSize)
+	}
+	var end int64
+	for _, e := range m.Extents {
+		if e.Offset < end || e.Length <= 0 || e.Length > m.VirtualSize-e.Offset {
+			return fmt.Errorf("qcow2: %s: extent %s of %d bytes at %d is out of order or beyond the virtual size %d", TarManifestName, e.Name, e.Length, e.Offset, m.VirtualSize)
+		}
+		end = e.Offset + e.Length
+	}
+	return nil
+}
+
+// copyTar writes the extents of the manifest m, read from the entries of tr
+// that follow it, into the image
+func (img *Image) copyTar(tr *tar.Reader, m *TarManifest, opts *ConvertOptions) error {
+	var total int64
+	for _, e := range m.Extents {
+		total += e.Length
+	}
+	var (
+		i      int
+		e      TarExtent
+		off    int64
+		digest hash.Hash
+	)
+	next := func() (convertRange, bool, error) {
+		if digest == nil {
+			if i == len(m.Extents) {
+				if hdr, err := tr.Next(); err != io.EOF {
+					if err == nil {
+						err = fmt.Errorf("unexpected entry %q", hdr.Name)
+					}
+					return convertRange{}, false, fmt.Errorf("qcow2: reading tar stream: %w", err)
+				}
+				return convertRange{}, false, nil
+			}
+			e = m.Extents[i]
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return convertRange{}, false, fmt.Errorf("qcow2: tar stream ends before %s", e.Name)
+			} else if err != nil {
+				return convertRange{}, false, fmt.Errorf("qcow2: reading tar stream: %w", err)
+			}
+			if hdr.Name != e.Name || hdr.Size != e.Length {
+				return convertRange{}, false, fmt.Errorf("qcow2: tar entry %q of %d bytes, where %s expects %s of %d", hdr.Name, hdr.Size, TarManifestName, e.Name, e.Length)
+			}
+			off, digest = e.Offset, sha256.New()
+		}
+		n := min(img.chunkSize()-off%img.chunkSize(), e.Offset+e.Length-off)
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(tr, buf); err != nil {
+			return convertRange{}, false, fmt.Errorf("qcow2: reading %s: %w", e.Name, err)
+		}
+		if err := opts.limiter().Wait(context.Background(), len(buf)); err != nil {
+			return convertRange{}, false, err
+		}
+		digest.Write(buf)
+		cr := convertRange{off: off, n: n, data: buf}
+		if off += n; off == e.Offset+e.Length {
+			if sum := hex.EncodeToString(digest.Sum(nil)); sum != e.SHA256 {
+				return convertRange{}, false, fmt.Errorf("qcow2: %s has SHA-256 %s, where %s expects %s", e.Name, sum, TarManifestName, e.SHA256)
+			}
+			i, digest = i+1, nil
+		}
+		return cr, true, nil
+	}
+	read := func(_ context.Context, cr convertRange) ([]byte, error) {
+		return cr.data, nil
+	}
+	return img.writeRanges(next, opts, opts.progress(total), read, opts.workers(img.Size()))
+}
@@ -0,0 +1,98 @@
+package qcow2
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportImportTar(t *testing.T) {
+	dir := t.TempDir()
+	_, disk := remoteChain(t, dir)
+	img, err := OpenFile(filepath.Join(dir, "top.qcow2"), os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	// a compressed cluster, and a zero cluster hiding the backing file
+	if _, err := img.WriteCompressedAt(bytes.Repeat([]byte("C"), 4096), 8*4096); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteAt(make([]byte, 4096), 16*4096); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.TrimZeroClusters(); err != nil {
+		t.Fatal(err)
+	}
+	copy(disk[8*4096:], bytes.Repeat([]byte("C"), 4096))
+	copy(disk[16*4096:], make([]byte, 4096))
+
+	var buf bytes.Buffer
+	if err := img.ExportTar(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != TarManifestName {
+		t.Fatalf("first entry: %v %v", hdr, err)
+	}
+	var m TarManifest
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	// all of the raw base is data, but for the zero cluster
+	if m.Version != TarManifestVersion || m.VirtualSize != 1<<20 || m.ClusterSize != 4096 || len(m.Extents) != 2 {
+		t.Fatalf("manifest: %+v", m)
+	}
+	if e := m.Extents[1]; e.Name != "data/0000000000011000.bin" || e.Offset != 17*4096 || e.Length != 1<<20-17*4096 {
+		t.Errorf("second extent: %+v", e)
+	}
+	if m.Source.BackingFile != "mid.qcow2" || m.Source.RefcountBits != 16 {
+		t.Errorf("source: %+v", m.Source)
+	}
+
+	out := filepath.Join(dir, "imported.qcow2")
+	if err := ImportTar(bytes.NewReader(buf.Bytes()), out, nil); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer imported.Close()
+	if imported.Header.BackingFile != "" || imported.Header.ClusterBits != 12 {
+		t.Errorf("imported header: %+v", imported.Header)
+	}
+	if got := readAll(t, imported); !bytes.Equal(got, disk) {
+		t.Error("the imported image does not hold the guest disk")
+	}
+	verifyRefcounts(t, imported)
+
+	for name, edit := range map[string]func(string) string{
+		"digest": func(s string) string {
+			return strings.Replace(s, "RRRR", "RRRX", 1)
+		},
+		"version": func(s string) string {
+			return strings.Replace(s, `"version": 1,`, `"version": 2,`, 1)
+		},
+		"truncated": func(s string) string {
+			return s[:len(s)/2]
+		},
+	} {
+		bad := filepath.Join(dir, name+".qcow2")
+		if err := ImportTar(strings.NewReader(edit(buf.String())), bad, nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if _, err := os.Stat(bad); err == nil {
+			t.Errorf("%s: the image is left after failing", name)
+		}
+	}
+	if err := ImportTar(io.LimitReader(&buf, 0), filepath.Join(dir, "empty.qcow2"), nil); err == nil {
+		t.Error("expected an error importing an empty stream")
+	}
+}
@@ -0,0 +1,138 @@
+package qcow2
+
+import "fmt"
+
+// Translation is how one file of the backing chain maps a guest offset, with
+// each step of the lookup, as TranslateOffset finds it
+type Translation struct {
+	// Depth is the position of the file in the backing chain, 0 being the
+	// image itself, and Name its path
+	Depth int
+	Name  string
+	// Raw is set for a raw backing file, which stores the guest offset at
+	// the same host offset and has no tables
+	Raw bool
+	// PastEnd is set when the offset lies past the end of the file, whose
+	// backing range reads as zeros there, with nothing else set
+	PastEnd bool
+
+	// L1Index is the entry of the L1 table for the offset, stored at
+	// L1EntryOffset, whose raw value is L1Entry. An index past the L1 table
+	// has neither.
+	L1Index       int64
+	L1EntryOffset int64
+	L1Entry       uint64
+	// L2TableOffset is where L1Entry says the L2 table is, zero when there
+	// is none
+	L2TableOffset int64
+	// L2Index is the entry of the L2 table for the offset, stored at
+	// L2EntryOffset, whose raw value is L2Entry
+	L2Index       int64
+	L2EntryOffset int64
+	L2Entry       uint64
+
+	// Type is what the entries make of the cluster. It is ExtentUnallocated
+	// when the next file of the chain is to be looked at.
+	Type ExtentType
+	// HostOffset is where the byte at the offset is stored, for ExtentData;
+	// the start of the compressed data, of CompressedSize bytes, for
+	// ExtentCompressed; and the preallocated cluster, if any, for
+	// ExtentZero
+	HostOffset     int64
+	CompressedSize int64
+	// Remaining is the number of bytes from the offset mapped the same way,
+	// to the end of its cluster
+	Remaining int64
+	// Invalid says why an entry can not be right, which ends the lookup
+	Invalid string
+}
+
+// TranslateOffset looks up the guest offset off as reading it does: through
+// the L1 and L2 tables of the image, and when its cluster is unallocated
+// through those of each backing file in turn. The translations are of each
+// file consulted, the last being the one that serves the offset, or found
+// an invalid entry.
+func (img *Image) TranslateOffset(off int64) ([]Translation, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if off < 0 || off >= img.Header.Size {
+		return nil, fmt.Errorf("qcow2: offset %d is beyond the virtual size %d", off, img.Header.Size)
+	}
+	if img.featuresErr != nil {
+		return nil, img.featuresErr
+	}
+	var chain []Translation
+	for depth, b := 0, img; ; depth++ {
+		t, err := b.translate(off, depth)
+		if err != nil {
+			return chain, err
+		}
+		chain = append(chain, t)
+		if t.Type != ExtentUnallocated || t.Invalid != "" || b.backing == nil {
+			return chain, nil
+		}
+		next := Translation{Depth: depth + 1, Name: b.backingPath(b.Header.BackingFile), Remaining: t.Remaining}
+		backing, isImage := b.backing.(*Image)
+		next.Raw = !isImage
+		switch {
+		case off >= b.backingSize:
+			next.PastEnd = true
+			return append(chain, next), nil
+		case next.Raw:
+			next.Type, next.HostOffset = ExtentData, off
+			return append(chain, next), nil
+		}
+		b = backing
+	}
+}
+
+// translate is the Translation of off by the tables of the image at depth
+func (img *Image) translate(off int64, depth int) (Translation, error) {
+	within := off & (img.clusterSize - 1)
+	t := Translation{
+		Depth:     depth,
+		Name:      img.name,
+		L1Index:   off >> img.clusterBits / img.l2Entries,
+		L2Index:   off >> img.clusterBits % img.l2Entries,
+		Remaining: img.clusterSize - within,
+	}
+	if t.L1Index >= int64(len(img.l1)) {
+		return t, nil
+	}
+	t.L1EntryOffset = img.Header.L1TableOffset + t.L1Index*8
+	t.L1Entry = img.l1[t.L1Index]
+	t.L2TableOffset = int64(t.L1Entry & entryOffsetMask)
+	if t.L2TableOffset == 0 {
+		return t, nil
+	}
+	if why := img.invalidOffset(t.L2TableOffset, img.clusterSize, true); why != "" {
+		t.Invalid = fmt.Sprintf("L2 table offset %#x %s", t.L2TableOffset, why)
+		return t, nil
+	}
+	entry, entryOff, err := img.l2Entry(img.l1, img.Header.L1TableOffset, off)
+	if err != nil {
+		return t, err
+	}
+	t.L2EntryOffset, t.L2Entry = entryOff, entry
+	switch img.classify(entry) {
+	case clusterUnallocated:
+	case clusterZero:
+		t.Type, t.HostOffset = ExtentZero, int64(entry&entryOffsetMask)
+	case clusterCompressed:
+		t.Type = ExtentCompressed
+		t.HostOffset, t.CompressedSize = img.compressedRange(entry)
+		if why := img.invalidOffset(t.HostOffset, t.CompressedSize, false); why != "" {
+			t.Invalid = fmt.Sprintf("compressed cluster at %#x of %d bytes %s", t.HostOffset, t.CompressedSize, why)
+		} else if img.crypt != nil {
+			t.Invalid = "compressed cluster in an encrypted image"
+		}
+	default:
+		t.Type = ExtentData
+		host := int64(entry & entryOffsetMask)
+		t.HostOffset = host + within
+		if why := img.invalidOffset(host, img.clusterSize, true); why != "" {
+			t.Invalid = fmt.Sprintf("cluster offset %#x %s", host, why)
+		}
+	}
+	return t, nil
+}
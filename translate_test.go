@@ -0,0 +1,122 @@
+package qcow2
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTranslateOffset(t *testing.T) {
+	dir := t.TempDir()
+	base := make([]byte, 256<<10)
+	rand.Read(base)
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), base, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mid, err := Create(filepath.Join(dir, "mid.qcow2"), 1<<20, &CreateOptions{ClusterSize: 4096, BackingFile: "base.raw", BackingFormat: "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mid.WriteAt([]byte("mid"), 8192); err != nil {
+		t.Fatal(err)
+	}
+	mid.Close()
+	name := filepath.Join(dir, "top.qcow2")
+	img, err := Create(name, 1<<20, &CreateOptions{ClusterSize: 4096, BackingFile: "mid.qcow2", BackingFormat: "qcow2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if _, err := img.WriteAt([]byte("top"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.writeZeroes(16384, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.WriteCompressedAt(bytes.Repeat([]byte("compressed "), 4096)[:4096], 20480); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		off   int64
+		types []ExtentType
+	}{
+		{5, []ExtentType{ExtentData}},
+		{8199, []ExtentType{ExtentUnallocated, ExtentData}},
+		{4196, []ExtentType{ExtentUnallocated, ExtentUnallocated, ExtentData}},
+		{512 << 10, []ExtentType{ExtentUnallocated, ExtentUnallocated, ExtentUnallocated}},
+		{16384, []ExtentType{ExtentZero}},
+		{20490, []ExtentType{ExtentCompressed}},
+	} {
+		chain, err := img.TranslateOffset(tc.off)
+		if err != nil {
+			t.Fatalf("%d: %v", tc.off, err)
+		}
+		if len(chain) != len(tc.types) {
+			t.Fatalf("%d: translated by %d files, not %d", tc.off, len(chain), len(tc.types))
+		}
+		for i, tr := range chain {
+			if tr.Depth != i || tr.Type != tc.types[i] || tr.Invalid != "" {
+				t.Errorf("%d: depth %d is %+v", tc.off, i, tr)
+			}
+		}
+		top, last := chain[0], chain[len(chain)-1]
+		if top.L1Index != 0 || top.L2Index != tc.off/4096 || top.Remaining != 4096-tc.off%4096 {
+			t.Errorf("%d: got the indexes %d and %d, %d bytes remaining", tc.off, top.L1Index, top.L2Index, top.Remaining)
+		}
+		if got := int64(top.L2Entry); top.L2EntryOffset == 0 || (got == 0) != (top.Type == ExtentUnallocated) {
+			t.Errorf("%d: got the L2 entry %#x at %#x", tc.off, got, top.L2EntryOffset)
+		}
+		switch {
+		case tc.off >= int64(len(base)):
+			if !last.Raw || !last.PastEnd || last.Name != filepath.Join(dir, "base.raw") {
+				t.Errorf("%d: past the raw file, got %+v", tc.off, last)
+			}
+		case last.Raw:
+			if last.HostOffset != tc.off {
+				t.Errorf("%d: got the raw host offset %d", tc.off, last.HostOffset)
+			}
+		case last.Type == ExtentData:
+			want := []byte("top")
+			if len(chain) == 2 {
+				want = []byte("mid")
+			}
+			var b [3]byte
+			f, err := os.Open(last.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.ReadAt(b[:], last.HostOffset-tc.off%4096)
+			f.Close()
+			if !bytes.Equal(b[:], want) {
+				t.Errorf("%d: the host offset %#x holds %q, not %q", tc.off, last.HostOffset, b, want)
+			}
+		case last.Type == ExtentCompressed:
+			if last.HostOffset == 0 || last.CompressedSize == 0 {
+				t.Errorf("%d: got the compressed range %#x of %d bytes", tc.off, last.HostOffset, last.CompressedSize)
+			}
+		}
+	}
+	if _, err := img.TranslateOffset(1 << 20); err == nil {
+		t.Errorf("translated past the virtual size")
+	}
+
+	chain, err := img.TranslateOffset(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putUint64At(t, img.fh, chain[0].L2EntryOffset, chain[0].L2Entry|1<<40)
+	img.Close()
+	img, err = Open(name, WithNoLock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	chain, err = img.TranslateOffset(0)
+	if err != nil || len(chain) != 1 || !strings.Contains(chain[0].Invalid, "past the end of the file") {
+		t.Errorf("got %+v, %v for a cluster past the end of the file", chain, err)
+	}
+}
@@ -0,0 +1,56 @@
+package qcow2
+
+import "bytes"
+
+// TrimZeroClusters frees the data clusters of the image that hold only
+// zeros, returning how many were freed. They become zero clusters in
+// version 3 images, and unallocated in version 2 images without a backing
+// file. Compressed clusters and those shared with snapshots are left alone.
+func (img *Image) TrimZeroClusters() (int, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.readOnly {
+		return 0, ErrReadOnly
+	}
+	if img.Header.Version < 3 && img.backing != nil {
+		return 0, nil
+	}
+	buf := make([]byte, img.clusterSize)
+	zero := make([]byte, img.clusterSize)
+	freed := 0
+	for i, e := range img.l1 {
+		l2off := int64(e & entryOffsetMask)
+		if l2off == 0 {
+			continue
+		}
+		l2, err := img.readTable(l2off, int(img.l2Entries))
+		if err != nil {
+			return freed, err
+		}
+		for j, entry := range l2 {
+			off := (int64(i)*img.l2Entries + int64(j)) << img.clusterBits
+			if off >= img.Header.Size || img.classify(entry) != clusterNormal {
+				continue
+			}
+			if owned, err := img.owned(entry); err != nil || !owned {
+				if err != nil {
+					return freed, err
+				}
+				continue
+			}
+			p := buf[:min(img.clusterSize, img.Header.Size-off)]
+			if err := img.readGuest(img.l1, img.Header.L1TableOffset, p, off); err != nil {
+				return freed, err
+			}
+			if !bytes.Equal(p, zero[:len(p)]) {
+				continue
+			}
+			if ok, err := img.zeroCluster(off); err != nil {
+				return freed, err
+			} else if ok {
+				freed++
+			}
+		}
+	}
+	return freed, nil
+}
@@ -0,0 +1,43 @@
+package qcow2
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestTrimZeroClusters(t *testing.T) {
+	for _, version := range []Version{2, 3} {
+		name := filepath.Join(t.TempDir(), "img.qcow2")
+		img, err := Create(name, 1<<20, &CreateOptions{ClusterSize: 4096, Version: version, Preallocation: "full"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer img.Close()
+		if _, err := img.WriteAt(bytes.Repeat([]byte("data"), 3000), 8192); err != nil {
+			t.Fatal(err)
+		}
+		if err := img.CreateSnapshot("snap"); err != nil {
+			t.Fatal(err)
+		}
+		// only the clusters written after the snapshot are owned
+		if _, err := img.WriteAt(make([]byte, 40960), 512<<10); err != nil {
+			t.Fatal(err)
+		}
+		want := checksum(t, img)
+		freed, err := img.TrimZeroClusters()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if freed != 10 {
+			t.Errorf("v%d: expected 10 clusters freed, got %d", version, freed)
+		}
+		if checksum(t, img) != want {
+			t.Errorf("v%d: trimming changed the contents", version)
+		}
+		verifyRefcounts(t, img)
+		if freed, err := img.TrimZeroClusters(); err != nil || freed != 0 {
+			t.Errorf("v%d: expected nothing more to trim, freed %d: %v", version, freed, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package qcow2
+
+import (
+	"bytes"
+	"io"
+)
+
+// verifyBlock is the granularity at which VerifyAgainstRaw reports mismatches
+const verifyBlock = 512
+
+// Range is a range of the guest disk
+type Range struct {
+	Start  int64
+	Length int64
+}
+
+// VerifyAgainstRaw compares the guest visible contents of the image with the
+// refSize bytes of raw disk contents in ref, returning the ranges that differ
+// in whole blocks of 512 bytes. Ranges the image knows to read as zeros are
+// only read from ref. When the sizes differ, everything past the end of the
+// smaller one is a mismatch.
+func VerifyAgainstRaw(img *Image, ref io.ReaderAt, refSize int64) ([]Range, error) {
+	var extents []Extent
+	size := min(img.Size(), refSize)
+	if err := img.WalkExtents(0, size, func(e Extent) error {
+		extents = append(extents, e)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var mismatches []Range
+	mismatch := func(off, n int64) {
+		if m := len(mismatches); m > 0 && mismatches[m-1].Start+mismatches[m-1].Length == off {
+			mismatches[m-1].Length += n
+			return
+		}
+		mismatches = append(mismatches, Range{off, n})
+	}
+	zero := make([]byte, convertChunk)
+	buf, refBuf := make([]byte, convertChunk), make([]byte, convertChunk)
+	for _, e := range extents {
+		for off := e.Start; off < e.Start+e.Length; {
+			n := min(convertChunk, e.Start+e.Length-off)
+			p, q := zero[:n], refBuf[:n]
+			if !e.ReadsAsZeros() {
+				p = buf[:n]
+				if _, err := img.ReadAt(p, off); err != nil {
+					return nil, err
+				}
+			}
+			if m, err := ref.ReadAt(q, off); err != nil && !(err == io.EOF && int64(m) == n) {
+				return nil, err
+			}
+			for i := int64(0); i < n; i += verifyBlock {
+				j := min(i+verifyBlock, n)
+				if !bytes.Equal(p[i:j], q[i:j]) {
+					mismatch(off+i, j-i)
+				}
+			}
+			off += n
+		}
+	}
+	if end := max(img.Size(), refSize); end > size {
+		mismatch(size, end-size)
+	}
+	return mismatches, nil
+}
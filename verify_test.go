@@ -0,0 +1,48 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyAgainstRaw(t *testing.T) {
+	img := tempImage(t)
+	raw := filepath.Join(t.TempDir(), "file.raw")
+	if err := img.ConvertToRaw(raw, nil); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(raw, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	mismatches, err := VerifyAgainstRaw(img, f, img.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Errorf("expected no mismatches, got %v", mismatches)
+	}
+
+	// change a byte, and two blocks of what the image has as zeros or data
+	if _, err := f.WriteAt([]byte{0xff}, 1000); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 1024)
+	if _, err := f.ReadAt(p, img.Size()-1024); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(bytes.Repeat([]byte{0x5a}, 1024), img.Size()-1024); err != nil {
+		t.Fatal(err)
+	}
+	mismatches, err = VerifyAgainstRaw(img, f, img.Size()+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Range{{512, 512}, {img.Size() - 1024, 1124}}
+	if len(mismatches) != len(expected) || mismatches[0] != expected[0] || mismatches[1] != expected[1] {
+		t.Errorf("expected mismatches %v, got %v", expected, mismatches)
+	}
+}
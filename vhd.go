@@ -0,0 +1,160 @@
+package qcow2
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	// vhdFooterSize is the size of the footer ending a VHD file
+	vhdFooterSize = 512
+	// vhdAlignment is what the disk of a fixed VHD is padded to a multiple
+	// of, as Azure requires
+	vhdAlignment = 1 << 20
+	// vhdMaxSize is the largest disk a VHD describes, of 2040 GiB
+	vhdMaxSize = 2040 << 30
+)
+
+// vhdEpoch is the start of the timestamps of VHD files
+var vhdEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// vhdSize is the size of the disk of a fixed VHD of the image, its virtual
+// size padded to a multiple of vhdAlignment
+func (img *Image) vhdSize() (int64, error) {
+	size := (img.Size() + vhdAlignment - 1) / vhdAlignment * vhdAlignment
+	if size > vhdMaxSize {
+		return 0, fmt.Errorf("qcow2: a VHD is at most %d bytes, not %d", int64(vhdMaxSize), img.Size())
+	}
+	return size, nil
+}
+
+// vhdGeometry is the cylinders, heads and sectors per track of a disk of
+// size bytes, as computed in appendix A of the VHD specification
+func vhdGeometry(size int64) (cylinders uint16, heads, sectors uint8) {
+	total := min(size/512, 65535*16*255)
+	var spt, h, cth int64
+	if total >= 65535*16*63 {
+		spt, h = 255, 16
+		cth = total / spt
+	} else {
+		spt = 17
+		cth = total / spt
+		h = max((cth+1023)/1024, 4)
+		if cth >= h*1024 || h > 16 {
+			spt, h = 31, 16
+			cth = total / spt
+		}
+		if cth >= h*1024 {
+			spt, h = 63, 16
+			cth = total / spt
+		}
+	}
+	return uint16(cth / h), uint8(h), uint8(spt)
+}
+
+// vhdFooter is the footer of a fixed VHD of a disk of size bytes, created
+// at t and identified by id
+func vhdFooter(size int64, t time.Time, id [16]byte) []byte {
+	f := make([]byte, vhdFooterSize)
+	be := binary.BigEndian
+	copy(f, "conectix")
+	be.PutUint32(f[8:], 2)           // features: reserved, always set
+	be.PutUint32(f[12:], 0x00010000) // format version 1.0
+	be.PutUint64(f[16:], ^uint64(0)) // data offset: none, for a fixed disk
+	be.PutUint32(f[24:], uint32(t.Sub(vhdEpoch)/time.Second))
+	copy(f[28:], "qcw2")             // creator application
+	be.PutUint32(f[32:], 0x00010000) // creator version
+	copy(f[36:], "Wi2k")             // creator host OS, as others write it
+	be.PutUint64(f[40:], uint64(size))
+	be.PutUint64(f[48:], uint64(size))
+	c, h, s := vhdGeometry(size)
+	be.PutUint16(f[56:], c)
+	f[58], f[59] = h, s
+	be.PutUint32(f[60:], 2) // disk type: fixed
+	copy(f[68:], id[:])
+	var sum uint32
+	for _, b := range f {
+		sum += uint32(b)
+	}
+	be.PutUint32(f[64:], ^sum)
+	return f
+}
+
+// newVHDFooter is vhdFooter of now, with a random version 4 UUID
+func newVHDFooter(size int64) ([]byte, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return vhdFooter(size, time.Now(), id), nil
+}
+
+// ConvertToVHD writes the guest visible contents of the image, flattened
+// through its backing chain, to a new fixed VHD file: the raw disk, padded
+// with zeros to a multiple of 1 MiB as Azure requires, followed by the VHD
+// footer. The disk is written sparse, as by ConvertToRaw, and of opts the
+// CreateOptions and compression do not apply. On failure the output file is
+// removed.
+func (img *Image) ConvertToVHD(name string, opts *ConvertOptions) error {
+	size, err := img.vhdSize()
+	if err != nil {
+		return err
+	}
+	footer, err := newVHDFooter(size)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = img.writeSparse(out, 0, img.Size(), opts)
+	if err == nil {
+		_, err = out.WriteAt(footer, size)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
+
+// WriteVHDTo writes the fixed VHD of ConvertToVHD to w, strictly
+// sequentially as WriteRawTo, so that w can be a pipe
+func (img *Image) WriteVHDTo(w io.Writer) (int64, error) {
+	size, err := img.vhdSize()
+	if err != nil {
+		return 0, err
+	}
+	footer, err := newVHDFooter(size)
+	if err != nil {
+		return 0, err
+	}
+	written, err := img.WriteRawTo(w)
+	if err != nil {
+		return written, err
+	}
+	n, err := io.CopyN(w, zeroReader{}, size-written)
+	written += n
+	if err != nil {
+		return written, err
+	}
+	m, err := w.Write(footer)
+	return written + int64(m), err
+}
+
+// zeroReader reads as endless zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
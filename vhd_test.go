@@ -0,0 +1,90 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVHDGeometry(t *testing.T) {
+	for _, tc := range []struct {
+		size    int64
+		c       uint16
+		h, s    uint8
+		comment string
+	}{
+		{10 << 20, 301, 4, 17, "17 sectors, at least 4 heads"},
+		{100 << 20, 1003, 12, 17, "17 sectors, fewer than 16 heads"},
+		{1 << 30, 2080, 16, 63, "63 sectors"},
+		{32 << 30, 16448, 16, 255, "255 sectors"},
+		{2040 << 30, 65535, 16, 255, "the largest geometry"},
+	} {
+		if c, h, s := vhdGeometry(tc.size); c != tc.c || h != tc.h || s != tc.s {
+			t.Errorf("%d bytes, %s: got %d/%d/%d, want %d/%d/%d", tc.size, tc.comment, c, h, s, tc.c, tc.h, tc.s)
+		}
+	}
+}
+
+func TestVHDFooter(t *testing.T) {
+	var id [16]byte
+	for i := range id {
+		id[i] = byte(i)
+	}
+	got := vhdFooter(1<<30, time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC), id)
+	// worked out from the VHD specification: the current size is the size
+	// itself rather than that of the geometry, as Azure requires
+	want, _ := hex.DecodeString("636f6e65637469780000000200010000ffffffffffffffff259e9d8071637732000100005769326b" +
+		"000000004000000000000000400000000820103f00000002ffffee7b000102030405060708090a0b0c0d0e0f")
+	if len(got) != 512 || !bytes.Equal(got[:len(want)], want) || !bytes.Equal(got[len(want):], make([]byte, 512-len(want))) {
+		t.Errorf("got footer\n%x\nwant\n%x", got, want)
+	}
+}
+
+func TestConvertToVHD(t *testing.T) {
+	img := tempImage(t)
+	raw := make([]byte, img.Size())
+	if _, err := img.ReadAt(raw, 0); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "disk.vhd")
+	if err := img.ConvertToVHD(name, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := (img.Size() + 1<<20 - 1) &^ (1<<20 - 1)
+	if int64(len(got)) != size+512 {
+		t.Fatalf("got %d bytes, want %d", len(got), size+512)
+	}
+	if !bytes.Equal(got[:len(raw)], raw) || !bytes.Equal(got[len(raw):size], make([]byte, size-int64(len(raw)))) {
+		t.Error("the VHD does not start with the guest disk")
+	}
+	footer := got[size:]
+	var sum uint32
+	for i, b := range footer {
+		if i < 64 || i >= 68 {
+			sum += uint32(b)
+		}
+	}
+	if string(footer[:8]) != "conectix" || binary.BigEndian.Uint32(footer[64:]) != ^sum || binary.BigEndian.Uint64(footer[48:]) != uint64(size) {
+		t.Errorf("invalid footer %x", footer[:96])
+	}
+	if footer[68+6]>>4 != 4 {
+		t.Errorf("unique ID %x is not a version 4 UUID", footer[68:84])
+	}
+
+	var buf bytes.Buffer
+	n, err := img.WriteVHDTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) || !bytes.Equal(buf.Bytes()[:size+24], got[:size+24]) || !bytes.Equal(buf.Bytes()[size+40:size+64], got[size+40:size+64]) {
+		t.Error("WriteVHDTo differs from ConvertToVHD but for the time and unique ID")
+	}
+}